@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type chatworkSecret struct {
+	APIToken string `json:"api_token"`
+}
+
+func buildConfig() (*lib.ChatworkConfig, error) {
+	var secret chatworkSecret
+	if err := lib.GetSecretValues(os.Getenv("CHATWORK_SECRET_ARN"), &secret); err != nil {
+		return nil, errors.Wrap(err, "Fail to get Chatwork secret")
+	}
+
+	return &lib.ChatworkConfig{
+		APIToken: secret.APIToken,
+		RoomID:   os.Getenv("CHATWORK_ROOM_ID"),
+		SeverityRooms: map[lib.ReportSeverity]string{
+			lib.SevUrgent:       os.Getenv("CHATWORK_ROOM_ID_URGENT"),
+			lib.SevUnclassified: os.Getenv("CHATWORK_ROOM_ID_UNCLASSIFIED"),
+			lib.SevSafe:         os.Getenv("CHATWORK_ROOM_ID_SAFE"),
+		},
+		ReportURL:     os.Getenv("REPORT_URL"),
+		ArchiveBucket: os.Getenv("ARCHIVE_BUCKET"),
+	}, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Chatwork")
+		if err := lib.PublishChatwork(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to Chatwork")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
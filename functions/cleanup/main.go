@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type openSearchSecret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func buildOption(ctx context.Context) (*lib.CleanupOption, error) {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	opt := lib.CleanupOption{
+		Region:      arn.Region(),
+		ReportTable: lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+		ReportData:  lib.ResolveTableName(os.Getenv("REPORT_DATA")),
+	}
+
+	if v := os.Getenv("CLEANUP_LIMIT"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, lib.NewConfigError("Invalid CLEANUP_LIMIT: " + v)
+		}
+		opt.Limit = limit
+	}
+	if v := os.Getenv("CLEANUP_WAIT"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			return nil, lib.NewConfigError("Invalid CLEANUP_WAIT: " + v)
+		}
+		opt.Wait = wait
+	}
+
+	if endpoint := os.Getenv("OPENSEARCH_ENDPOINT"); endpoint != "" {
+		cfg := lib.OpenSearchConfig{
+			Endpoint: endpoint,
+			Index:    os.Getenv("OPENSEARCH_INDEX"),
+			Region:   arn.Region(),
+		}
+		if secretArn := os.Getenv("OPENSEARCH_SECRET_ARN"); secretArn != "" {
+			var secret openSearchSecret
+			if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+				return nil, errors.Wrap(err, "Fail to get OpenSearch secret")
+			}
+			cfg.Username = secret.Username
+			cfg.Password = secret.Password
+		}
+		opt.OpenSearch = &cfg
+	}
+
+	return &opt, nil
+}
+
+// HandleCleanup is Lambda handler invoked by schedule.
+func HandleCleanup(ctx context.Context, event events.CloudWatchEvent) (*lib.CleanupResult, error) {
+	opt, err := buildOption(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := lib.CleanupReports(*opt)
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).WithField("result", result).Error("Fail to clean up reports")
+		return nil, err
+	}
+
+	if result.Remaining {
+		logger.WithField("limit", opt.Limit).Warn("Cleanup limit is reached, remaining reports are cleaned up by next run")
+	}
+	return result, nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(HandleCleanup)
+}
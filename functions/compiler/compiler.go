@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/m-mizutani/AlertResponder/lib"
@@ -14,9 +19,78 @@ type CompiledReport struct {
 	Report *lib.Report `json:"report"`
 }
 
+const defaultTextMaxSize = 32 * 1024
+
 type parameters struct {
 	region    string
 	tableName string
+
+	// reportTable stores compiled reports if set. The report and pages are
+	// also replicated to replicaRegion if set.
+	reportTable   string
+	replicaRegion string
+
+	// expectedAuthors is a list of inspector names that should submit pages
+	// before compiling if the report has no expected authors by alert rule.
+	// maxWait is limit of waiting for them since the alert
+	// was received.
+	expectedAuthors []string
+	maxWait         time.Duration
+
+	// minSeverity is the threshold of dispatch. Alerts below it have no
+	// inspection and are compiled without waiting for inspectors.
+	minSeverity lib.ReportSeverity
+
+	merge lib.MergeOption
+
+	// privateHosts is a policy for private IP addresses in remote hosts:
+	// "flag" (default) adds warnings, "move" moves them to local hosts and
+	// "ignore" does nothing.
+	privateHosts string
+
+	// renderText enables rendering Markdown text into the report. The text is
+	// truncated to textMaxSize bytes.
+	renderText  bool
+	textMaxSize int
+
+	// textTemplate overrides the built-in Markdown rendering if set.
+	textTemplate *template.Template
+
+	// metrics receives compilation metrics. Nil disables emission.
+	metrics lib.MetricsEmitter
+
+	// allowDomains are own domains excluded from archived observables.
+	allowDomains []string
+
+	// autoClose closes low severity reports without review if set.
+	autoClose *lib.AutoCloseRule
+
+	// ruleLabels seeds labels of reports by alert rule.
+	ruleLabels lib.RuleLabels
+
+	// severityOverrides force severity of matched reports after aggregation.
+	severityOverrides lib.SeverityOverrides
+}
+
+// reportTemplate is a custom template of report text loaded at cold start.
+var reportTemplate *template.Template
+
+// loadReportTemplate loads a custom template from REPORT_TEMPLATE or S3
+// object of REPORT_TEMPLATE_BUCKET and REPORT_TEMPLATE_KEY. Nil is returned if
+// neither is configured.
+func loadReportTemplate() (*template.Template, error) {
+	if text := os.Getenv("REPORT_TEMPLATE"); text != "" {
+		return lib.ParseReportTemplate(text)
+	}
+
+	bucket, key := os.Getenv("REPORT_TEMPLATE_BUCKET"), os.Getenv("REPORT_TEMPLATE_KEY")
+	if bucket == "" {
+		return nil, nil
+	}
+	if key == "" {
+		return nil, lib.NewConfigError("REPORT_TEMPLATE_KEY is not set")
+	}
+	return lib.LoadReportTemplate(nil, bucket, key)
 }
 
 func buildParameters(ctx context.Context) (*parameters, error) {
@@ -26,16 +100,203 @@ func buildParameters(ctx context.Context) (*parameters, error) {
 	}
 
 	params := parameters{
-		region:    arn.Region(),
-		tableName: os.Getenv("REPORT_DATA"),
+		region:        arn.Region(),
+		tableName:     lib.ResolveTableName(os.Getenv("REPORT_DATA")),
+		reportTable:   lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+		replicaRegion: os.Getenv("REPLICA_REGION"),
+		renderText:    os.Getenv("RENDER_TEXT") != "false",
+		privateHosts:  os.Getenv("PRIVATE_REMOTE_HOSTS"),
+		textMaxSize:   defaultTextMaxSize,
+		textTemplate:  reportTemplate,
+		minSeverity:   lib.DispatchMinSeverity,
+	}
+
+	if _, err := lib.ParseDispatchMinSeverity(os.Getenv("DISPATCH_MIN_SEVERITY")); err != nil {
+		return nil, err
+	}
+
+	for _, author := range strings.Split(os.Getenv("EXPECTED_AUTHORS"), ",") {
+		if author = strings.TrimSpace(author); author != "" {
+			params.expectedAuthors = append(params.expectedAuthors, author)
+		}
+	}
+
+	for _, domain := range strings.Split(os.Getenv("OBSERVABLE_ALLOW_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			params.allowDomains = append(params.allowDomains, domain)
+		}
+	}
+
+	if v := os.Getenv("MAX_INSPECTION_WAIT"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid MAX_INSPECTION_WAIT: %s", v)
+		}
+		params.maxWait = time.Duration(sec) * time.Second
+	}
+
+	params.merge.Strategy, err = lib.ParseMergeStrategy(os.Getenv("MERGE_STRATEGY"))
+	if err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv("MERGE_HISTORY_CAP"); v != "" {
+		params.merge.HistoryCap, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid MERGE_HISTORY_CAP: %s", v)
+		}
+	}
+
+	switch params.privateHosts {
+	case "":
+		params.privateHosts = "flag"
+	case "flag", "move", "ignore":
+	default:
+		return nil, fmt.Errorf("Invalid PRIVATE_REMOTE_HOSTS: %s", params.privateHosts)
+	}
+
+	if v := os.Getenv("TEXT_MAX_SIZE"); v != "" {
+		params.textMaxSize, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid TEXT_MAX_SIZE: %s", v)
+		}
+	}
+
+	params.autoClose, err = lib.ParseAutoCloseRule(os.Getenv("AUTO_CLOSE_RULE"))
+	if err != nil {
+		return nil, err
+	}
+
+	params.ruleLabels, err = lib.ParseRuleLabels(os.Getenv("RULE_LABELS"))
+	if err != nil {
+		return nil, err
+	}
+
+	params.severityOverrides, err = lib.ParseSeverityOverrides(os.Getenv("SEVERITY_OVERRIDES"))
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("METRICS_ENABLED") == "true" {
+		params.metrics = lib.NewCloudWatchEmitter(nil, params.region)
 	}
 
 	return &params, nil
 }
 
+// compileMetrics returns metrics of a compilation dimensioned by severity
+// hint of the alert. Severity of the result is not decided until review.
+func compileMetrics(report lib.Report, pageCount int, elapsed time.Duration, now time.Time) []lib.Metric {
+	sev := string(report.Alert.Severity)
+	if sev == "" {
+		sev = string(lib.SevUnclassified)
+	}
+	dims := map[string]string{"Severity": sev}
+
+	hosts := len(report.Content.OpponentHosts) + len(report.Content.AlliedHosts)
+	metrics := []lib.Metric{
+		{Name: "PagesFetched", Value: float64(pageCount), Unit: "Count", Dimensions: dims},
+		{Name: "HostsMerged", Value: float64(hosts), Unit: "Count", Dimensions: dims},
+		{Name: "CompileDuration", Value: float64(elapsed) / float64(time.Millisecond), Unit: "Milliseconds", Dimensions: dims},
+	}
+
+	// Latency since the alert was received shows delay of whole pipeline.
+	if !report.ReceivedAt.IsZero() {
+		latency := now.Sub(report.ReceivedAt)
+		metrics = append(metrics, lib.Metric{
+			Name: "ReportLatency", Value: float64(latency) / float64(time.Millisecond), Unit: "Milliseconds", Dimensions: dims,
+		})
+	}
+
+	return metrics
+}
+
+func compileReport(params parameters, report lib.Report, pages []*lib.ReportPage, now time.Time) (*lib.Report, error) {
+	logger := log.WithFields(report.LogFields())
+
+	if len(report.ExpectedAuthors) == 0 {
+		report.ExpectedAuthors = params.expectedAuthors
+	}
+	report.SetContributors(pages)
+
+	if !report.Alert.ShouldDispatch(params.minSeverity) {
+		logger.WithField("severity", report.Alert.Severity).Info("Compile without inspection")
+		report.Warnings = append(report.Warnings, fmt.Sprintf(
+			"Not inspected because alert severity %s is below %s", report.Alert.Severity, params.minSeverity))
+	} else if !lib.IsReportComplete(report) {
+		missing := report.MissingAuthors()
+		if now.Sub(report.ReceivedAt) < params.maxWait {
+			logger.WithField("missing", missing).Info("Waiting for inspectors")
+			return nil, lib.NewRetryableError(fmt.Sprintf("Inspectors have not reported yet: %s",
+				strings.Join(missing, ", ")))
+		}
+
+		logger.WithField("missing", missing).Warn("Compile without some inspectors")
+		for _, author := range missing {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("No result from inspector: %s", author))
+		}
+	}
+
+	params.ruleLabels.Seed(&report)
+
+	c := &report.Content
+	c.OpponentHosts = map[string]lib.ReportOpponentHost{}
+	c.AlliedHosts = map[string]lib.ReportAlliedHost{}
+
+	report.Conflicts = lib.MergePages(c, pages, params.merge)
+	if len(report.Conflicts) > 0 {
+		logger.WithField("conflicts", report.Conflicts).Info("Pages have conflicting values")
+	}
+
+	if params.privateHosts != "ignore" {
+		warnings := lib.FilterPrivateHosts(c, params.privateHosts == "move")
+		report.Warnings = append(report.Warnings, warnings...)
+	}
+
+	// Hosts without own account are regarded as ones in account of the alert.
+	for id, h := range c.OpponentHosts {
+		if h.AccountID == "" {
+			h.AccountID = report.AccountID
+			c.OpponentHosts[id] = h
+		}
+	}
+	for id, h := range c.AlliedHosts {
+		if h.AccountID == "" {
+			h.AccountID = report.AccountID
+			c.AlliedHosts[id] = h
+		}
+	}
+
+	report.Countries = c.CountryCounts()
+
+	if o := params.severityOverrides.Apply(&report); o != nil {
+		logger.WithFields(log.Fields{"override": o.Name, "severity": o.Severity}).Info("Overrode severity")
+	}
+
+	// Auto-close is decided before rendering so that the text has the result.
+	if params.autoClose != nil && params.autoClose.Apply(&report) {
+		logger.WithField("result", report.Result).Info("Auto-closed report")
+	}
+
+	if params.renderText {
+		text := lib.RenderMarkDown(report)
+		if params.textTemplate != nil {
+			var err error
+			if text, err = lib.ExecReportTemplate(params.textTemplate, report); err != nil {
+				return nil, err
+			}
+		}
+		report.Text = lib.TruncateMarkDown(text, params.textMaxSize)
+	}
+
+	return &report, nil
+}
+
 // HandleRequest is a main Lambda handler
 func HandleRequest(ctx context.Context, report lib.Report) (*lib.Report, error) {
-	log.WithField("report", report).Info("start")
+	logger := log.WithFields(report.LogFields())
+	logger.WithField("report", report).Info("start")
+	start := time.Now()
 
 	params, err := buildParameters(ctx)
 	if err != nil {
@@ -44,39 +305,82 @@ func HandleRequest(ctx context.Context, report lib.Report) (*lib.Report, error)
 
 	pages, err := lib.FetchReportPages(params.tableName, params.region, report.ID)
 	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to fetch pages")
+		// Throttled compilation is retried by the state machine later.
+		if errors.Cause(err) == lib.ErrThrottled {
+			return nil, lib.NewRetryableError(err.Error())
+		}
 		return nil, err
 	}
 
-	log.WithField("pages", pages).Info("Fetched pages")
+	logger.WithField("pages", pages).Info("Fetched pages")
 
-	c := &report.Content
-	c.OpponentHosts = map[string]lib.ReportOpponentHost{}
-	c.AlliedHosts = map[string]lib.ReportAlliedHost{}
+	// Comments are attached again because content of the report is rebuilt
+	// from pages.
+	comments, err := lib.FetchComments(params.tableName, params.region, report.ID)
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to fetch comments")
+		return nil, err
+	}
+	report.Comments = comments
 
-	for _, page := range pages {
-		for _, r := range page.OpponentHosts {
-			log.WithField("id", r.ID).Info("set section to remote")
-			h, _ := c.OpponentHosts[r.ID]
-			h.Merge(r)
-			c.OpponentHosts[r.ID] = h
+	// Labels, links of related reports, merges and severity of the last
+	// publication added after previous compilation are kept.
+	if params.reportTable != "" {
+		stored, err := lib.LoadReport(params.reportTable, params.region, report.ID)
+		if err != nil && err != lib.ErrReportNotFound {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to fetch stored report")
+			return nil, err
+		}
+		if stored != nil {
+			for _, label := range stored.Labels {
+				report.AddLabel(label)
+			}
+			report.ParentID = stored.ParentID
+			report.ChildIDs = stored.ChildIDs
+			report.MergedFrom = stored.MergedFrom
+			report.MergedInto = stored.MergedInto
+			report.PublishedSeverity = stored.PublishedSeverity
 		}
+	}
 
-		for _, r := range page.AlliedHosts {
-			log.WithField("id", r.ID).Info("set section to local")
-			h, _ := c.AlliedHosts[r.ID]
-			h.Merge(r)
-			c.AlliedHosts[r.ID] = h
+	compiled, err := compileReport(*params, report, pages, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	lib.EmitMetrics(params.metrics, compileMetrics(*compiled, len(pages), time.Since(start), time.Now().UTC()))
+
+	if params.reportTable != "" {
+		if err := lib.SaveReport(params.reportTable, params.region, *compiled); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to save report")
+			return nil, err
+		}
+	}
+
+	if lib.ArchiveBucket != "" {
+		keys, err := lib.ArchiveReport(nil, lib.ArchiveBucket, *compiled, lib.ArchiveHTML)
+		if err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Warn("Fail to archive report")
+		} else {
+			logger.WithField("keys", keys).Info("Archived report")
 		}
 
-		for _, r := range page.SubjectUser {
-			log.WithField("userName", r.UserName).Info("set section to local")
-			h, _ := c.SubjectUsers[r.UserName]
-			h.Merge(r)
-			c.SubjectUsers[r.UserName] = h
+		if lib.ArchiveObservables {
+			opts := lib.CSVOptions{Header: true, ExcludePrivateIPs: true, AllowDomains: params.allowDomains}
+			if _, err := lib.ArchiveObservablesCSV(nil, lib.ArchiveBucket, *compiled, opts); err != nil {
+				logger.WithFields(lib.ErrorFields(err)).Warn("Fail to archive observables")
+			}
 		}
 	}
 
-	return &report, nil
+	if params.replicaRegion != "" {
+		if err := lib.ReplicateReport(*compiled, pages, params.region, params.replicaRegion); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Warn("Fail to replicate report")
+		}
+	}
+
+	return compiled, nil
 }
 
 func main() {
@@ -94,5 +398,16 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	if err := lib.CheckEnvInts(); err != nil {
+		log.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	// A broken template stops the function at cold start instead of producing
+	// broken reports.
+	var err error
+	if reportTemplate, err = loadReportTemplate(); err != nil {
+		log.WithFields(lib.ErrorFields(err)).Fatal("Fail to load report template")
+	}
+
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReport(receivedAt time.Time) lib.Report {
+	report := lib.NewReport(lib.NewReportID(), lib.Alert{Rule: "test", ReceivedAt: receivedAt})
+	return report
+}
+
+func newTestPages(authors ...string) []*lib.ReportPage {
+	var pages []*lib.ReportPage
+	for _, author := range authors {
+		page := lib.NewReportPage()
+		page.Author = author
+		page.OpponentHosts = []lib.ReportOpponentHost{
+			{ID: "192.0.2.1", IPAddr: []string{"192.0.2.1"}},
+		}
+		pages = append(pages, &page)
+	}
+	return pages
+}
+
+func TestCompileAllAuthorsPresent(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{
+		expectedAuthors: []string{"blue", "orange"},
+		maxWait:         time.Minute * 10,
+	}
+
+	report, err := compileReport(params, newTestReport(now), newTestPages("orange", "blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(report.Warnings))
+	assert.Equal(t, 2, len(report.Content.OpponentHosts["192.0.2.1"].IPAddr))
+	assert.Equal(t, []string{"blue", "orange"}, report.Contributors())
+	assert.Equal(t, 2, report.ContributorCount)
+}
+
+func TestCompileMissingAuthorWithinWindow(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{
+		expectedAuthors: []string{"blue", "orange"},
+		maxWait:         time.Minute * 10,
+	}
+
+	report, err := compileReport(params, newTestReport(now.Add(-time.Minute)), newTestPages("blue"), now)
+	require.Error(t, err)
+	assert.Nil(t, report)
+	_, ok := err.(*lib.RetryableError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "orange")
+}
+
+func TestCompileMissingAuthorPastWindow(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{
+		expectedAuthors: []string{"blue", "orange", "magic"},
+		maxWait:         time.Minute * 10,
+	}
+
+	report, err := compileReport(params, newTestReport(now.Add(-time.Hour)), newTestPages("blue"), now)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(report.Warnings))
+	assert.Contains(t, report.Warnings[0], "orange")
+	assert.Contains(t, report.Warnings[1], "magic")
+	assert.Equal(t, 1, len(report.Content.OpponentHosts))
+}
+
+func TestCompileExpectedAuthorsOfReport(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{
+		expectedAuthors: []string{"blue", "orange"},
+		maxWait:         time.Minute * 10,
+	}
+
+	// Expected authors recorded by receptor override EXPECTED_AUTHORS.
+	report := newTestReport(now.Add(-time.Minute))
+	report.ExpectedAuthors = []string{"magic"}
+	_, err := compileReport(params, report, newTestPages("blue", "orange"), now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "magic")
+
+	compiled, err := compileReport(params, report, newTestPages("magic"), now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(compiled.Warnings))
+	assert.Equal(t, []string{"magic"}, compiled.ExpectedAuthors)
+}
+
+func TestCompileBelowDispatchThreshold(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{
+		expectedAuthors: []string{"blue", "orange"},
+		maxWait:         time.Minute * 10,
+		minSeverity:     lib.SevUnclassified,
+	}
+
+	// Compiled immediately without waiting for inspectors.
+	base := newTestReport(now)
+	base.Alert.Severity = lib.SevSafe
+	report, err := compileReport(params, base, nil, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(report.Warnings))
+	assert.Contains(t, report.Warnings[0], "below unclassified")
+	assert.Equal(t, 0, len(report.Content.OpponentHosts))
+
+	// Alerts above the threshold still wait.
+	base.Alert.Severity = lib.SevUrgent
+	_, err = compileReport(params, base, nil, now)
+	_, ok := err.(*lib.RetryableError)
+	assert.True(t, ok)
+}
+
+func TestCompileAutoClose(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{autoClose: &lib.AutoCloseRule{Below: lib.SevUnclassified}}
+
+	base := newTestReport(now)
+	base.Alert.Severity = lib.SevSafe
+	report, err := compileReport(params, base, newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, lib.StatusClosed, report.Status)
+	assert.Equal(t, lib.SevSafe, report.Result.Severity)
+	assert.True(t, strings.HasPrefix(report.Result.Reason, lib.AutoClosedReason))
+}
+
+func TestCompileAutoCloseReviewRequired(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{autoClose: &lib.AutoCloseRule{Below: lib.SevUnclassified}}
+
+	base := newTestReport(now)
+	base.Alert.Severity = lib.SevUrgent
+	report, err := compileReport(params, base, newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.False(t, report.IsClosed())
+	assert.Equal(t, lib.ReportResult{}, report.Result)
+
+	// A related domain is an IOC hit.
+	base.Alert.Severity = lib.SevSafe
+	pages := newTestPages("blue")
+	pages[0].OpponentHosts[0].RelatedDomains = []lib.ReportDomain{{Name: "bad.example.com"}}
+	report, err = compileReport(params, base, pages, now)
+	require.NoError(t, err)
+	assert.False(t, report.IsClosed())
+}
+
+func TestCompileSeedLabels(t *testing.T) {
+	now := time.Now().UTC()
+	labels, err := lib.ParseRuleLabels(`{"test": ["recon"]}`)
+	require.NoError(t, err)
+	params := parameters{ruleLabels: labels}
+
+	// Labels of previous compilation survive.
+	base := newTestReport(now)
+	base.AddLabel("false-positive")
+	report, err := compileReport(params, base, newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"false-positive", "recon"}, report.Labels)
+
+	report, err = compileReport(params, *report, newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"false-positive", "recon"}, report.Labels)
+}
+
+func TestCompileAccountID(t *testing.T) {
+	now := time.Now().UTC()
+	report := lib.NewReport(lib.NewReportID(), lib.Alert{AccountID: "111111111111"})
+	assert.Equal(t, "111111111111", report.AccountID)
+
+	pages := newTestPages("blue")
+	pages[0].AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-1234", AccountID: "222222222222"},
+	}
+
+	compiled, err := compileReport(parameters{}, report, pages, now)
+	require.NoError(t, err)
+	assert.Equal(t, "111111111111", compiled.Content.OpponentHosts["192.0.2.1"].AccountID)
+	assert.Equal(t, "222222222222", compiled.Content.AlliedHosts["i-1234"].AccountID)
+}
+
+func TestCompileRenderText(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{renderText: true, textMaxSize: 1024}
+
+	report, err := compileReport(params, newTestReport(now), newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Contains(t, report.Text, "### Remote Hosts")
+	assert.Contains(t, report.Text, "192.0.2.1")
+
+	params.renderText = false
+	report, err = compileReport(params, newTestReport(now), newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, "", report.Text)
+}
+
+func TestCompileRenderTextTemplate(t *testing.T) {
+	now := time.Now().UTC()
+	tmpl, err := lib.ParseReportTemplate("{{severityBadge .Result.Severity}} {{len .Content.OpponentHosts}} hosts")
+	require.NoError(t, err)
+	params := parameters{renderText: true, textMaxSize: 1024, textTemplate: tmpl}
+
+	report, err := compileReport(params, newTestReport(now), newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, "**[UNCLASSIFIED]** 1 hosts", report.Text)
+}
+
+func TestLoadReportTemplate(t *testing.T) {
+	defer os.Setenv("REPORT_TEMPLATE", os.Getenv("REPORT_TEMPLATE"))
+
+	os.Setenv("REPORT_TEMPLATE", "")
+	tmpl, err := loadReportTemplate()
+	require.NoError(t, err)
+	assert.Nil(t, tmpl)
+
+	os.Setenv("REPORT_TEMPLATE", "{{.Alert.Rule}}")
+	tmpl, err = loadReportTemplate()
+	require.NoError(t, err)
+	assert.NotNil(t, tmpl)
+
+	os.Setenv("REPORT_TEMPLATE", "{{.NoSuchField}}")
+	_, err = loadReportTemplate()
+	assert.Error(t, err)
+}
+
+func TestCompileKeepsComments(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{renderText: true, textMaxSize: 1024}
+
+	report := newTestReport(now)
+	report.Comments = []lib.Comment{{Author: "alice", Text: "Looking into it", Timestamp: now}}
+	compiled, err := compileReport(params, report, newTestPages("blue"), now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(compiled.Comments))
+	assert.Equal(t, "alice", compiled.Comments[0].Author)
+	assert.Contains(t, compiled.Text, "alice: Looking into it")
+}
+
+func mixedHostPages() []*lib.ReportPage {
+	page := lib.NewReportPage()
+	page.Author = "blue"
+	page.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "198.51.100.1", IPAddr: []string{"198.51.100.1"}},
+		{ID: "192.168.1.10", IPAddr: []string{"192.168.1.10"}},
+		{ID: "gw", IPAddr: []string{"203.0.113.5", "10.2.3.4"}},
+	}
+	return []*lib.ReportPage{&page}
+}
+
+func TestCompileReportFlagPrivateHosts(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{privateHosts: "flag"}
+
+	report, err := compileReport(params, newTestReport(now), mixedHostPages(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(report.Content.OpponentHosts))
+	assert.Equal(t, 0, len(report.Content.AlliedHosts))
+	assert.Equal(t, []string{
+		"Private IP address in remote host 192.168.1.10: 192.168.1.10",
+		"Private IP address in remote host gw: 10.2.3.4",
+	}, report.Warnings)
+}
+
+func TestCompileReportMovePrivateHosts(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{privateHosts: "move"}
+
+	report, err := compileReport(params, newTestReport(now), mixedHostPages(), now)
+	require.NoError(t, err)
+
+	c := report.Content
+	assert.Equal(t, 2, len(c.OpponentHosts))
+	assert.Equal(t, []string{"198.51.100.1"}, c.OpponentHosts["198.51.100.1"].IPAddr)
+	assert.Equal(t, []string{"203.0.113.5"}, c.OpponentHosts["gw"].IPAddr)
+
+	assert.Equal(t, 2, len(c.AlliedHosts))
+	assert.Equal(t, []string{"192.168.1.10"}, c.AlliedHosts["192.168.1.10"].IPAddr)
+	assert.Equal(t, []string{"10.2.3.4"}, c.AlliedHosts["10.2.3.4"].IPAddr)
+	assert.Equal(t, 2, len(report.Warnings))
+}
+
+func TestCompileReportIgnorePrivateHosts(t *testing.T) {
+	now := time.Now().UTC()
+	params := parameters{privateHosts: "ignore"}
+
+	report, err := compileReport(params, newTestReport(now), mixedHostPages(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(report.Content.OpponentHosts))
+	assert.Equal(t, 0, len(report.Warnings))
+}
+
+type mockMetricsEmitter struct {
+	metrics []lib.Metric
+}
+
+func (x *mockMetricsEmitter) Emit(metrics []lib.Metric) error {
+	x.metrics = append(x.metrics, metrics...)
+	return nil
+}
+
+func TestCompileMetrics(t *testing.T) {
+	now := time.Now().UTC()
+	pages := newTestPages("orange", "blue")
+	src := newTestReport(now.Add(-time.Minute))
+	src.Alert.Severity = lib.SevUrgent
+	report, err := compileReport(parameters{}, src, pages, now)
+	require.NoError(t, err)
+
+	emitter := &mockMetricsEmitter{}
+	lib.EmitMetrics(emitter, compileMetrics(*report, len(pages), 1500*time.Millisecond, now))
+
+	values := map[string]float64{}
+	for _, m := range emitter.metrics {
+		assert.Equal(t, map[string]string{"Severity": "urgent"}, m.Dimensions)
+		values[m.Name] = m.Value
+	}
+	assert.Equal(t, map[string]float64{
+		"PagesFetched":    2,
+		"HostsMerged":     1,
+		"CompileDuration": 1500,
+		"ReportLatency":   60000,
+	}, values)
+
+	// An alert without severity hint is counted as unclassified.
+	report.Alert.Severity = ""
+	for _, m := range compileMetrics(*report, len(pages), time.Second, now) {
+		assert.Equal(t, map[string]string{"Severity": "unclassified"}, m.Dimensions)
+	}
+}
+
+func TestCompileLogsCorrelationID(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	// Same ID as receptor test. The report is given as state machine input.
+	const correlationID = "feade4e55ed067c7a63517a2320cddf1"
+	var report lib.Report
+	require.NoError(t, json.Unmarshal([]byte(`{"report_id":"r1","correlation_id":"`+correlationID+`"}`), &report))
+
+	now := time.Now().UTC()
+	report.ReceivedAt = now
+	params := parameters{expectedAuthors: []string{"blue"}, maxWait: time.Minute}
+	_, err := compileReport(params, report, nil, now)
+	require.Error(t, err)
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "Waiting for inspectors", entry.Message)
+	assert.Equal(t, correlationID, entry.Data[lib.CorrelationKey])
+	assert.Equal(t, lib.ReportID("r1"), entry.Data["report_id"])
+}
+
+func TestCompileCountries(t *testing.T) {
+	now := time.Now().UTC()
+	pages := newTestPages("blue", "orange")
+	pages[0].OpponentHosts = []lib.ReportOpponentHost{
+		// Addresses in the same country are counted once for the host.
+		{ID: "198.51.100.7", Addrs: []lib.RemoteAddr{
+			{IP: "198.51.100.7", Country: "RU"},
+			{IP: "198.51.100.8", Country: "ru"},
+		}},
+		{ID: "203.0.113.9", Country: []string{"US"}},
+	}
+	pages[1].OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "203.0.113.9", Country: []string{"USA"}},
+		{ID: "203.0.113.10", Country: []string{"United States", "CN"}},
+		{ID: "203.0.113.11", Country: []string{"Unknown"}},
+	}
+	pages[1].AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-1234", Country: []string{"jp"}},
+	}
+
+	report, err := compileReport(parameters{privateHosts: "ignore"}, newTestReport(now), pages, now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"RU": 1, "US": 2, "CN": 1, "JP": 1}, report.Countries)
+}
+
+func TestCompileSeverityOverride(t *testing.T) {
+	now := time.Now().UTC()
+	overrides, err := lib.ParseSeverityOverrides(`[
+		{"name": "known-scanner", "rules": ["test"], "hosts": ["192.0.2.*"], "severity": "safe"}
+	]`)
+	require.NoError(t, err)
+	params := parameters{severityOverrides: overrides}
+
+	report, err := compileReport(params, newTestReport(now), newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, lib.SevSafe, report.Result.Severity)
+	assert.Equal(t, "severity-override: known-scanner", report.Result.Reason)
+}
+
+func TestCompileSeverityOverrideNoMatch(t *testing.T) {
+	now := time.Now().UTC()
+	overrides, err := lib.ParseSeverityOverrides(`[
+		{"name": "known-scanner", "rules": ["test"], "hosts": ["198.51.100.*"], "severity": "safe"}
+	]`)
+	require.NoError(t, err)
+	params := parameters{severityOverrides: overrides}
+
+	report, err := compileReport(params, newTestReport(now), newTestPages("blue"), now)
+	require.NoError(t, err)
+	assert.Equal(t, lib.ReportResult{}, report.Result)
+}
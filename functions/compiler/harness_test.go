@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/m-mizutani/AlertResponder/lib/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHandleRequestEndToEnd drives an alert to a compiled report. Receptor is
+// another main package and can not be called here, so the report is issued
+// from the alert as Receptor does for a new alert (see its harness test).
+func TestHandleRequestEndToEnd(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+
+	alert := lib.Alert{
+		Name:       "Suspicious Outbound",
+		Rule:       "malware-detected",
+		Key:        "10.1.2.3",
+		ReceivedAt: time.Now().UTC(),
+	}
+	alert.SetCorrelationID()
+	report := lib.NewReport(lib.NewReportID(), alert)
+
+	// Inspectors submit pages.
+	remote := lib.NewReportPage()
+	remote.Author = "remote-inspector"
+	remote.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "198.51.100.7", IPAddr: []string{"198.51.100.7"}, Country: []string{"RU"}},
+	}
+	require.NoError(t, h.SubmitPage(report.ID, remote))
+
+	local := lib.NewReportPage()
+	local.Author = "local-inspector"
+	local.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-0123456789", IPAddr: []string{"10.1.2.3"}, HostName: []string{"web-01"}},
+	}
+	require.NoError(t, h.SubmitPage(report.ID, local))
+
+	compiled, err := HandleRequest(h.Context("compiler"), report)
+	require.NoError(t, err)
+	assert.Equal(t, report.ID, compiled.ID)
+	assert.Equal(t, alert.CorrelationID, compiled.CorrelationID)
+	assert.Contains(t, compiled.Content.OpponentHosts, "198.51.100.7")
+	assert.Contains(t, compiled.Content.AlliedHosts, "i-0123456789")
+	assert.Contains(t, compiled.Text, "198.51.100.7")
+
+	// The compiled report is stored in the report table.
+	record, err := h.Reports.GetReport(report.ID)
+	require.NoError(t, err)
+	assert.Contains(t, string(record.Data), "198.51.100.7")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type datadogSecret struct {
+	APIKey string `json:"api_key"`
+	AppKey string `json:"app_key"`
+}
+
+func buildConfig() (*lib.DatadogConfig, error) {
+	cfg := lib.DatadogConfig{
+		Site:          os.Getenv("DATADOG_SITE"),
+		ReportURL:     os.Getenv("REPORT_URL"),
+		ArchiveBucket: os.Getenv("ARCHIVE_BUCKET"),
+	}
+
+	for _, tag := range strings.Split(os.Getenv("DATADOG_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.Tags = append(cfg.Tags, tag)
+		}
+	}
+
+	var secret datadogSecret
+	if err := lib.GetSecretValues(os.Getenv("DATADOG_SECRET_ARN"), &secret); err != nil {
+		return nil, errors.Wrap(err, "Fail to get Datadog secret")
+	}
+	cfg.APIKey = secret.APIKey
+	cfg.AppKey = secret.AppKey
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Datadog")
+		if err := lib.PublishDatadog(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to Datadog")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
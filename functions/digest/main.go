@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// now can be replaced for testing.
+var now = time.Now
+
+type parameters struct {
+	region    string
+	publisher string
+	digest    lib.DigestConfig
+	links     lib.DigestLinks
+}
+
+func buildParameters(ctx context.Context) (*parameters, error) {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	params := parameters{
+		region:    arn.Region(),
+		publisher: os.Getenv("PUBLISHER_FUNCTION"),
+		digest: lib.DigestConfig{
+			Table:  lib.ResolveTableName(os.Getenv("DIGEST_TABLE")),
+			Region: arn.Region(),
+		},
+		links: lib.DigestLinks{
+			ReportURL:     os.Getenv("REPORT_URL"),
+			ArchiveBucket: lib.ArchiveBucket,
+		},
+	}
+
+	if v := os.Getenv("DIGEST_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return nil, lib.NewConfigError("Invalid DIGEST_WINDOW: " + v)
+		}
+		params.digest.Window = window
+	}
+
+	return &params, nil
+}
+
+// HandleDigest is Lambda handler invoked by schedule. It publishes a digest of
+// the last completed window through the publisher function and clears its
+// entries. Nothing is published if no report is held in the window.
+func HandleDigest(ctx context.Context, event events.CloudWatchEvent) (*lib.Digest, error) {
+	params, err := buildParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current := params.digest.WindowOf(now())
+	window := params.digest.WindowOf(current.Add(-time.Nanosecond))
+
+	digest, err := lib.AssembleDigest(params.digest, window)
+	if err != nil {
+		return nil, err
+	}
+	if len(digest.Entries) == 0 {
+		logger.WithField("window", window).Info("No report for digest")
+		return digest, nil
+	}
+
+	if err := lib.PublishDigest(params.publisher, params.region, digest.Report(params.links)); err != nil {
+		return nil, err
+	}
+	if err := lib.ClearDigest(params.digest, *digest); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to clear digest entries")
+		return nil, err
+	}
+
+	logger.WithField("window", window).WithField("reports", len(digest.Entries)).Info("Published digest")
+	return digest, nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(HandleDigest)
+}
@@ -11,15 +11,28 @@ import (
 
 var logger = logrus.New()
 
+// publishTask sends a task to inspectors. It can be replaced for testing.
+var publishTask = lib.PublishSnsMessage
+
 func handleRequest(ctx context.Context, report lib.Report) error {
 	region := os.Getenv("AWS_REGION")
 	snsTopic := os.Getenv("TASK_NOTIFICATION")
-	logger.WithFields(logrus.Fields{
+	logger.WithFields(report.LogFields()).WithFields(logrus.Fields{
 		"report":   report,
 		"snsTopic": snsTopic,
 		"region":   region,
 	}).Info("Start")
 
+	// Alerts below the threshold are not inspected and compiled as a
+	// lightweight report by Compiler.
+	if !report.Alert.ShouldDispatch(lib.DispatchMinSeverity) {
+		logger.WithFields(report.LogFields()).WithFields(logrus.Fields{
+			"severity":    report.Alert.Severity,
+			"minSeverity": lib.DispatchMinSeverity,
+		}).Info("Skip dispatch below severity threshold")
+		return nil
+	}
+
 	for _, attr := range report.Alert.Attrs {
 		task := lib.Task{
 			Attr:     attr,
@@ -27,10 +40,12 @@ func handleRequest(ctx context.Context, report lib.Report) error {
 			Alert:    report.Alert,
 		}
 
-		logger.WithField("task", task).Info("Dispatch")
-		if err := lib.PublishSnsMessage(snsTopic, region, task); err != nil {
+		logger.WithFields(report.LogFields()).WithField("task", task).Info("Dispatch")
+		msgID, err := publishTask(ctx, snsTopic, region, task)
+		if err != nil {
 			return err
 		}
+		logger.WithFields(report.LogFields()).WithField("message_id", msgID).Info("Published task")
 	}
 
 	return nil
@@ -39,5 +54,14 @@ func handleRequest(ctx context.Context, report lib.Report) error {
 func main() {
 	logger.SetLevel(logrus.DebugLevel)
 	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	if _, err := lib.ParseDispatchMinSeverity(os.Getenv("DISPATCH_MIN_SEVERITY")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid DISPATCH_MIN_SEVERITY")
+	}
+
 	lambda.Start(handleRequest)
 }
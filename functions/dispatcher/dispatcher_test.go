@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dispatchTestReport(sev lib.ReportSeverity) lib.Report {
+	return lib.NewReport(lib.NewReportID(), lib.Alert{
+		Rule:     "test",
+		Severity: sev,
+		Attrs: []lib.Attribute{
+			{Type: "ipaddr", Value: "192.0.2.1", Key: "src"},
+			{Type: "domain", Value: "example.com", Key: "query"},
+		},
+	})
+}
+
+// setupDispatch replaces publishTask to record tasks. The returned function
+// restores the original settings.
+func setupDispatch(minSeverity lib.ReportSeverity) (*[]lib.Task, func()) {
+	var tasks []lib.Task
+	origPublish, origMin := publishTask, lib.DispatchMinSeverity
+	publishTask = func(ctx context.Context, topicArn, region string, data interface{}) (string, error) {
+		tasks = append(tasks, data.(lib.Task))
+		return fmt.Sprintf("msg-%d", len(tasks)), nil
+	}
+	lib.DispatchMinSeverity = minSeverity
+	return &tasks, func() {
+		publishTask, lib.DispatchMinSeverity = origPublish, origMin
+	}
+}
+
+func TestDispatchAboveThreshold(t *testing.T) {
+	tasks, restore := setupDispatch(lib.SevUnclassified)
+	defer restore()
+
+	report := dispatchTestReport(lib.SevUrgent)
+	require.NoError(t, handleRequest(context.Background(), report))
+	require.Equal(t, 2, len(*tasks))
+	assert.Equal(t, report.ID, (*tasks)[0].ReportID)
+	assert.Equal(t, "example.com", (*tasks)[1].Attr.Value)
+}
+
+func TestDispatchBelowThreshold(t *testing.T) {
+	tasks, restore := setupDispatch(lib.SevUnclassified)
+	defer restore()
+
+	require.NoError(t, handleRequest(context.Background(), dispatchTestReport(lib.SevSafe)))
+	assert.Equal(t, 0, len(*tasks))
+
+	// Alerts without hint are inspected.
+	require.NoError(t, handleRequest(context.Background(), dispatchTestReport("")))
+	assert.Equal(t, 2, len(*tasks))
+}
+
+func TestDispatchWithoutThreshold(t *testing.T) {
+	tasks, restore := setupDispatch("")
+	defer restore()
+
+	require.NoError(t, handleRequest(context.Background(), dispatchTestReport(lib.SevSafe)))
+	assert.Equal(t, 2, len(*tasks))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// notificationTemplates are templates of messages loaded at cold start.
+var notificationTemplates *lib.NotificationTemplates
+
+// splitAddresses parses comma separated email addresses.
+func splitAddresses(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func buildConfig() (*lib.EmailConfig, error) {
+	cfg := lib.EmailConfig{
+		Region:     os.Getenv("AWS_REGION"),
+		Sender:     os.Getenv("EMAIL_SENDER"),
+		Recipients: splitAddresses(os.Getenv("EMAIL_RECIPIENTS")),
+		SeverityRecipients: map[lib.ReportSeverity][]string{
+			lib.SevUrgent:       splitAddresses(os.Getenv("EMAIL_RECIPIENTS_URGENT")),
+			lib.SevUnclassified: splitAddresses(os.Getenv("EMAIL_RECIPIENTS_UNCLASSIFIED")),
+			lib.SevSafe:         splitAddresses(os.Getenv("EMAIL_RECIPIENTS_SAFE")),
+		},
+		ReportURL:      os.Getenv("REPORT_URL"),
+		TemplateBucket: os.Getenv("EMAIL_TEMPLATE_BUCKET"),
+		TemplateKey:    os.Getenv("EMAIL_TEMPLATE_KEY"),
+		Templates:      notificationTemplates,
+		Locale:         os.Getenv("NOTIFICATION_LOCALE"),
+	}
+
+	if !lib.ValidLocale(cfg.Locale) {
+		return nil, lib.NewConfigError("Unknown NOTIFICATION_LOCALE: " + cfg.Locale)
+	}
+
+	if cfg.Sender == "" {
+		return nil, lib.NewConfigError("EMAIL_SENDER is not set")
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report by email")
+		if err := lib.PublishEmail(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	var err error
+	if notificationTemplates, err = lib.ParseNotificationTemplates(os.Getenv("NOTIFICATION_TEMPLATES")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Fail to load notification templates")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type githubSecret struct {
+	Token          string `json:"token"`
+	AppID          string `json:"app_id"`
+	InstallationID string `json:"installation_id"`
+	PrivateKey     string `json:"private_key"`
+}
+
+func buildConfig() (*lib.GitHubConfig, error) {
+	cfg := lib.GitHubConfig{
+		APIURL:         os.Getenv("GITHUB_API_URL"),
+		Token:          os.Getenv("GITHUB_TOKEN"),
+		AppID:          os.Getenv("GITHUB_APP_ID"),
+		InstallationID: os.Getenv("GITHUB_INSTALLATION_ID"),
+		ReportURL:      os.Getenv("REPORT_URL"),
+	}
+
+	// GITHUB_REPO is "owner/repo"
+	repo := strings.SplitN(os.Getenv("GITHUB_REPO"), "/", 2)
+	if len(repo) != 2 {
+		return nil, lib.NewConfigError("GITHUB_REPO must be owner/repo")
+	}
+	cfg.Owner, cfg.Repo = repo[0], repo[1]
+
+	for _, label := range strings.Split(os.Getenv("GITHUB_LABELS"), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			cfg.Labels = append(cfg.Labels, label)
+		}
+	}
+
+	if secretArn := os.Getenv("GITHUB_SECRET_ARN"); secretArn != "" {
+		var secret githubSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get GitHub secret")
+		}
+		if secret.Token != "" {
+			cfg.Token = secret.Token
+		}
+		if secret.AppID != "" {
+			cfg.AppID = secret.AppID
+		}
+		if secret.InstallationID != "" {
+			cfg.InstallationID = secret.InstallationID
+		}
+		cfg.PrivateKey = secret.PrivateKey
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to GitHub")
+		if err := lib.PublishGitHub(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to GitHub")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type parameters struct {
+	region string
+
+	// Tables and topics to be checked. Empty ones are skipped.
+	alertMap           string
+	reportData         string
+	reportTable        string
+	taskNotification   string
+	reportNotification string
+}
+
+func buildParameters(ctx context.Context) (*parameters, error) {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	params := parameters{
+		region:             arn.Region(),
+		alertMap:           lib.ResolveTableName(os.Getenv("ALERT_MAP")),
+		reportData:         lib.ResolveTableName(os.Getenv("REPORT_DATA")),
+		reportTable:        lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+		taskNotification:   os.Getenv("TASK_NOTIFICATION"),
+		reportNotification: os.Getenv("REPORT_NOTIFICATION"),
+	}
+
+	return &params, nil
+}
+
+func buildProbes(params parameters) []lib.HealthProbe {
+	var probes []lib.HealthProbe
+
+	tables := []struct{ name, hashKey string }{
+		{params.alertMap, "alert_id"},
+		{params.reportData, "report_id"},
+		{params.reportTable, "report_id"},
+	}
+	for _, table := range tables {
+		if table.name != "" {
+			probes = append(probes, lib.NewTableProbe(params.region, table.name, table.hashKey))
+		}
+	}
+
+	for _, topicArn := range []string{params.taskNotification, params.reportNotification} {
+		if topicArn != "" {
+			probes = append(probes, lib.NewTopicProbe(nil, params.region, topicArn))
+		}
+	}
+
+	return probes
+}
+
+// healthCheck returns an error with failed dependencies if any probe fails.
+// The status is returned in both cases.
+func healthCheck(probes []lib.HealthProbe) (lib.HealthStatus, error) {
+	status := lib.CheckHealth(probes)
+	if status.Healthy {
+		return status, nil
+	}
+
+	var failed []string
+	for _, dep := range status.Dependencies {
+		if !dep.Healthy {
+			failed = append(failed, dep.Name+": "+dep.Error)
+		}
+	}
+
+	return status, errors.New("Unhealthy dependencies: " + strings.Join(failed, "; "))
+}
+
+// HandleHealthCheck is Lambda handler of liveness and readiness probe.
+func HandleHealthCheck(ctx context.Context) (lib.HealthStatus, error) {
+	params, err := buildParameters(ctx)
+	if err != nil {
+		return lib.HealthStatus{}, err
+	}
+
+	status, err := healthCheck(buildProbes(*params))
+	if err != nil {
+		logger.WithField("status", status).WithFields(lib.ErrorFields(err)).Error("Health check failed")
+		return status, err
+	}
+
+	logger.WithField("status", status).Info("Health check passed")
+	return status, nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(HandleHealthCheck)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildProbes(t *testing.T) {
+	probes := buildProbes(parameters{
+		region:             "ap-northeast-1",
+		alertMap:           "alert-map",
+		reportData:         "report-data",
+		reportNotification: "arn:aws:sns:ap-northeast-1:123456789012:reports",
+	})
+
+	var names []string
+	for _, probe := range probes {
+		names = append(names, probe.Name)
+	}
+	assert.Equal(t, []string{
+		"dynamodb:alert-map",
+		"dynamodb:report-data",
+		"sns:arn:aws:sns:ap-northeast-1:123456789012:reports",
+	}, names)
+}
+
+func TestHealthCheckHealthy(t *testing.T) {
+	status, err := healthCheck([]lib.HealthProbe{
+		{Name: "dynamodb:alert-map", Check: func() error { return nil }},
+		{Name: "sns:reports", Check: func() error { return nil }},
+	})
+	require.NoError(t, err)
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 2, len(status.Dependencies))
+}
+
+func TestHealthCheckUnhealthy(t *testing.T) {
+	status, err := healthCheck([]lib.HealthProbe{
+		{Name: "dynamodb:alert-map", Check: func() error { return errors.New("ResourceNotFoundException") }},
+		{Name: "sns:reports", Check: func() error { return nil }},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dynamodb:alert-map: ResourceNotFoundException")
+	assert.NotContains(t, err.Error(), "sns:reports")
+
+	assert.False(t, status.Healthy)
+	require.Equal(t, 2, len(status.Dependencies))
+	assert.False(t, status.Dependencies[0].Healthy)
+	assert.True(t, status.Dependencies[1].Healthy)
+}
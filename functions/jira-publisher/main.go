@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type jiraSecret struct {
+	Email    string `json:"email"`
+	APIToken string `json:"api_token"`
+}
+
+// parsePriorities parses mapping of severity and priority such as
+// "urgent=Highest,unclassified=Medium,safe=Low".
+func parsePriorities(s string) (map[lib.ReportSeverity]string, error) {
+	priorities := map[lib.ReportSeverity]string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, lib.NewConfigError(fmt.Sprintf("Invalid JIRA_PRIORITIES: %s", item))
+		}
+		priorities[lib.ReportSeverity(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return priorities, nil
+}
+
+func buildConfig() (*lib.JiraConfig, error) {
+	cfg := lib.JiraConfig{
+		BaseURL:         os.Getenv("JIRA_URL"),
+		ProjectKey:      os.Getenv("JIRA_PROJECT"),
+		IssueType:       os.Getenv("JIRA_ISSUE_TYPE"),
+		ExternalIDField: os.Getenv("JIRA_EXTERNAL_ID_FIELD"),
+		MinSeverity:     lib.ReportSeverity(os.Getenv("JIRA_MIN_SEVERITY")),
+		ReportURL:       os.Getenv("REPORT_URL"),
+	}
+
+	for _, label := range strings.Split(os.Getenv("JIRA_LABELS"), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			cfg.Labels = append(cfg.Labels, label)
+		}
+	}
+
+	priorities, err := parsePriorities(os.Getenv("JIRA_PRIORITIES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Priorities = priorities
+
+	if secretArn := os.Getenv("JIRA_SECRET_ARN"); secretArn != "" {
+		var secret jiraSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get JIRA secret")
+		}
+		cfg.Email = secret.Email
+		cfg.APIToken = secret.APIToken
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to JIRA")
+		if err := lib.PublishJira(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to JIRA")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type parameters struct {
+	region      string
+	reportTable string
+	reportData  string
+}
+
+// mergeRequest is an event of the handler. The secondary report is merged
+// into the primary report.
+type mergeRequest struct {
+	PrimaryID   lib.ReportID `json:"primary_id"`
+	SecondaryID lib.ReportID `json:"secondary_id"`
+}
+
+// mergeResult is a response of the handler.
+type mergeResult struct {
+	ReportID   lib.ReportID   `json:"report_id"`
+	MergedFrom []lib.ReportID `json:"merged_from"`
+	Severity   string         `json:"severity"`
+}
+
+func buildParameters(ctx context.Context) (*parameters, error) {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	params := parameters{
+		region:      arn.Region(),
+		reportTable: lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+		reportData:  lib.ResolveTableName(os.Getenv("REPORT_DATA")),
+	}
+	return &params, nil
+}
+
+func mergeReports(params parameters, req mergeRequest) (*mergeResult, error) {
+	if req.PrimaryID == "" || req.SecondaryID == "" {
+		return nil, lib.NewCodedError(lib.ErrCodeValidation, "Both primary_id and secondary_id are required")
+	}
+
+	merged, err := lib.MergeStoredReports(params.reportTable, params.reportData, params.region, req.PrimaryID, req.SecondaryID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mergeResult{
+		ReportID:   merged.ID,
+		MergedFrom: merged.MergedFrom,
+		Severity:   string(merged.Result.Severity),
+	}, nil
+}
+
+// HandleMerge is Lambda handler that merges a duplicate report into another
+// one by lib.MergeStoredReports.
+func HandleMerge(ctx context.Context, req mergeRequest) (*mergeResult, error) {
+	params, err := buildParameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := mergeReports(*params, req)
+	if err != nil {
+		logger.WithField("primary_id", req.PrimaryID).WithField("secondary_id", req.SecondaryID).
+			WithFields(lib.ErrorFields(err)).Error("Fail to merge reports")
+		return nil, err
+	}
+
+	logger.WithField("report_id", result.ReportID).WithField("merged_from", result.MergedFrom).Info("Merged reports")
+	return result, nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(HandleMerge)
+}
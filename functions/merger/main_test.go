@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeReports(t *testing.T) {
+	orig := lib.ReportStoreBackend
+	lib.ReportStoreBackend = "memory"
+	defer func() { lib.ReportStoreBackend = orig }()
+
+	params := parameters{region: "us-east-1", reportTable: "reports", reportData: "report-data"}
+	primary := lib.Report{ID: lib.NewReportID()}
+	primary.Result.Severity = lib.SevUnclassified
+	secondary := lib.Report{ID: lib.NewReportID()}
+	secondary.Result.Severity = lib.SevUrgent
+	require.NoError(t, lib.SaveReport(params.reportTable, params.region, primary))
+	require.NoError(t, lib.SaveReport(params.reportTable, params.region, secondary))
+
+	result, err := mergeReports(params, mergeRequest{PrimaryID: primary.ID, SecondaryID: secondary.ID})
+	require.NoError(t, err)
+	assert.Equal(t, primary.ID, result.ReportID)
+	assert.Equal(t, []lib.ReportID{secondary.ID}, result.MergedFrom)
+	assert.Equal(t, "urgent", result.Severity)
+
+	tombstone, err := lib.LoadReport(params.reportTable, params.region, secondary.ID)
+	require.NoError(t, err)
+	require.NotNil(t, tombstone.MergedInto)
+	assert.Equal(t, primary.ID, *tombstone.MergedInto)
+}
+
+func TestMergeReportsInvalidRequest(t *testing.T) {
+	_, err := mergeReports(parameters{}, mergeRequest{PrimaryID: "r1"})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type mispSecret struct {
+	APIKey string `json:"api_key"`
+}
+
+func buildConfig() (*lib.MISPConfig, error) {
+	cfg := lib.MISPConfig{
+		URL:         os.Getenv("MISP_URL"),
+		APIKey:      os.Getenv("MISP_API_KEY"),
+		MinSeverity: lib.ReportSeverity(os.Getenv("MISP_MIN_SEVERITY")),
+		Options: lib.MISPOptions{
+			TLP:             os.Getenv("MISP_TLP"),
+			IncludeInternal: os.Getenv("MISP_INCLUDE_INTERNAL") == "true",
+		},
+	}
+
+	for _, tag := range strings.Split(os.Getenv("MISP_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.Options.Tags = append(cfg.Options.Tags, tag)
+		}
+	}
+
+	if v := os.Getenv("MISP_DISTRIBUTION"); v != "" {
+		distribution, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, lib.NewConfigError("Invalid MISP_DISTRIBUTION: " + v)
+		}
+		cfg.Options.Distribution = distribution
+	}
+
+	if secretArn := os.Getenv("MISP_SECRET_ARN"); secretArn != "" {
+		var secret mispSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get MISP secret")
+		}
+		cfg.APIKey = secret.APIKey
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to MISP")
+		if err := lib.PublishMISP(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to MISP")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
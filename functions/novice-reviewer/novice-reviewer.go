@@ -22,5 +22,10 @@ func HandleRequest(ctx context.Context, report ar.Report) (ar.ReportResult, erro
 func main() {
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.InfoLevel)
+
+	if err := ar.CheckEnvInts(); err != nil {
+		logger.WithFields(ar.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type openSearchSecret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func buildConfig() (*lib.OpenSearchConfig, error) {
+	cfg := lib.OpenSearchConfig{
+		Endpoint: os.Getenv("OPENSEARCH_ENDPOINT"),
+		Index:    os.Getenv("OPENSEARCH_INDEX"),
+		Region:   os.Getenv("AWS_REGION"),
+		Username: os.Getenv("OPENSEARCH_USERNAME"),
+		Password: os.Getenv("OPENSEARCH_PASSWORD"),
+	}
+
+	for _, tag := range strings.Split(os.Getenv("OPENSEARCH_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.Tags = append(cfg.Tags, tag)
+		}
+	}
+
+	// Basic auth for self-hosted OpenSearch. SigV4 is used without it.
+	if secretArn := os.Getenv("OPENSEARCH_SECRET_ARN"); secretArn != "" {
+		var secret openSearchSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get OpenSearch secret")
+		}
+		cfg.Username = secret.Username
+		cfg.Password = secret.Password
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	var reports []lib.Report
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		reports = append(reports, lib.RedactReport(*report, *rules))
+	}
+
+	if os.Getenv("OPENSEARCH_BULK") == "true" && len(reports) > 1 {
+		logger.WithField("count", len(reports)).Info("Index reports to OpenSearch by bulk")
+		if err := lib.IndexOpenSearchBulk(*cfg, reports); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to index reports to OpenSearch")
+			return err
+		}
+		return nil
+	}
+
+	for _, report := range reports {
+		logger.WithFields(report.LogFields()).Info("Index report to OpenSearch")
+		if err := lib.PublishOpenSearch(*cfg, report); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to index report to OpenSearch")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
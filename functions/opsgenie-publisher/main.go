@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type opsgenieSecret struct {
+	APIKey string `json:"api_key"`
+}
+
+func buildConfig() (*lib.OpsgenieConfig, error) {
+	responders, err := lib.ParseOpsgenieResponders(os.Getenv("OPSGENIE_RESPONDERS"))
+	if err != nil {
+		return nil, err
+	}
+
+	var secret opsgenieSecret
+	if err := lib.GetSecretValues(os.Getenv("OPSGENIE_SECRET_ARN"), &secret); err != nil {
+		return nil, errors.Wrap(err, "Fail to get Opsgenie secret")
+	}
+
+	return &lib.OpsgenieConfig{
+		APIKey:     secret.APIKey,
+		Region:     os.Getenv("OPSGENIE_REGION"),
+		Responders: responders,
+		ReportURL:  os.Getenv("REPORT_URL"),
+	}, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Opsgenie")
+		if err := lib.PublishOpsgenie(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to Opsgenie")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
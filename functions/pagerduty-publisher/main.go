@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type pagerDutySecret struct {
+	RoutingKey string `json:"routing_key"`
+}
+
+func getRoutingKey() (string, error) {
+	secretArn := os.Getenv("PAGERDUTY_SECRET_ARN")
+	if secretArn == "" {
+		return os.Getenv("PAGERDUTY_ROUTING_KEY"), nil
+	}
+
+	var secret pagerDutySecret
+	if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+		return "", errors.Wrap(err, "Fail to get PagerDuty secret")
+	}
+	return secret.RoutingKey, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	routingKey, err := getRoutingKey()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to PagerDuty")
+		if err := lib.PublishPagerDuty(routingKey, lib.RedactReport(*report, *rules)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	if _, err := lib.ParsePagerDutyMinSeverity(os.Getenv("PAGERDUTY_MIN_SEVERITY")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid PAGERDUTY_MIN_SEVERITY")
+	}
+
+	lambda.Start(handleRequest)
+}
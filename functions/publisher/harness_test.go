@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/m-mizutani/AlertResponder/lib/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHandleRequestSeverityOverrideAfterReview drives a report compiled with
+// a severity override through the review. CheckPolicy replaces the result
+// that Compiler overrode, so Publisher must apply the override again.
+func TestHandleRequestSeverityOverrideAfterReview(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+
+	raw := `[{"name": "prod-db", "hosts": ["db-prod-*"], "severity": "urgent"}]`
+	h.Setenv("SEVERITY_OVERRIDES", raw)
+	overrides, err := lib.ParseSeverityOverrides(raw)
+	require.NoError(t, err)
+
+	// Compiler forces severity of the report.
+	report := lib.NewReport(lib.NewReportID(), lib.Alert{Name: "Port Scan", Rule: "port-scan", Key: "10.1.2.3"})
+	report.Content.AlliedHosts["i-1234"] = lib.ReportAlliedHost{ID: "i-1234", HostName: []string{"db-prod-01"}}
+	require.NotNil(t, overrides.Apply(&report))
+
+	// CheckPolicy stores its output to $.result.
+	report.Result = lib.ReportResult{Severity: lib.SevSafe, Reason: "known scanner"}
+
+	require.NoError(t, handleRequest(h.Context("publisher"), report))
+
+	messages := h.Messages(harness.ReportNotification)
+	require.Equal(t, 1, len(messages))
+	published, err := lib.UnmarshalReportMessage(string(messages[0].Data))
+	require.NoError(t, err)
+	assert.Equal(t, lib.SevUrgent, published.Result.Severity)
+	assert.Equal(t, "severity-override: prod-db; known scanner", published.Result.Reason)
+}
+
+// TestHandleRequestAutoClosedKeepsResult checks that a closed report, which
+// skips review, is published with the result of Compiler.
+func TestHandleRequestAutoClosedKeepsResult(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+
+	h.Setenv("SEVERITY_OVERRIDES", `[{"name": "scan", "rules": ["port-scan"], "severity": "safe"}]`)
+
+	report := lib.NewReport(lib.NewReportID(), lib.Alert{Name: "Port Scan", Rule: "port-scan", Key: "10.1.2.3"})
+	report.Status = lib.StatusClosed
+	report.Result = lib.ReportResult{Severity: lib.SevSafe, Reason: "severity-override: scan"}
+
+	require.NoError(t, handleRequest(h.Context("publisher"), report))
+
+	messages := h.Messages(harness.ReportNotification)
+	require.Equal(t, 1, len(messages))
+	published, err := lib.UnmarshalReportMessage(string(messages[0].Data))
+	require.NoError(t, err)
+	assert.Equal(t, lib.StatusClosed, published.Status)
+	assert.Equal(t, "severity-override: scan", published.Result.Reason)
+}
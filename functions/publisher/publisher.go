@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -15,6 +17,116 @@ var logger = logrus.New()
 type parameters struct {
 	region             string
 	reportNotification string
+	publish            lib.ReportPublishConfig
+
+	// reportTable stores severity of published reports to detect escalation
+	// if set.
+	reportTable string
+
+	// digest holds low severity reports for digest if set.
+	digest *lib.DigestConfig
+
+	// idempotency skips actions that already published the report in a
+	// retry if set.
+	idempotency *lib.IdempotencyConfig
+
+	// severityOverrides are applied again because review replaces result
+	// that Compiler overrode.
+	severityOverrides lib.SeverityOverrides
+}
+
+// publishRoutes is routing of reports loaded at cold start.
+var publishRoutes = lib.DefaultPublishRoutes
+
+// notificationTemplates are templates of messages loaded at cold start.
+var notificationTemplates *lib.NotificationTemplates
+
+// loadPublishRoutes loads routes from PUBLISH_ROUTES or S3 object of
+// PUBLISH_ROUTES_BUCKET and PUBLISH_ROUTES_KEY. DefaultPublishRoutes is
+// returned if neither is configured.
+func loadPublishRoutes() (lib.PublishRoutes, error) {
+	if raw := os.Getenv("PUBLISH_ROUTES"); raw != "" {
+		return lib.ParsePublishRoutes(raw)
+	}
+
+	bucket, key := os.Getenv("PUBLISH_ROUTES_BUCKET"), os.Getenv("PUBLISH_ROUTES_KEY")
+	if bucket == "" {
+		return lib.DefaultPublishRoutes, nil
+	}
+	if key == "" {
+		return lib.PublishRoutes{}, lib.NewConfigError("PUBLISH_ROUTES_KEY is not set")
+	}
+	return lib.LoadPublishRoutes(nil, bucket, key)
+}
+
+// publishers returns registry of publish actions. Slack, PagerDuty, SQS and
+// Kinesis are available only if their destination is configured.
+func (x *parameters) publishers() map[string]lib.Publisher {
+	registry := map[string]lib.Publisher{
+		lib.PublishActionSNS: func(ctx context.Context, report lib.Report) error {
+			cfg := x.publish
+			cfg.Locale = lib.LocaleFromContext(ctx)
+			cfg.Attributes = lib.RoutedAttributes(ctx)
+			return lib.PublishReport(cfg, report)
+		},
+	}
+
+	if lib.ArchiveBucket != "" {
+		registry[lib.PublishActionArchive] = func(ctx context.Context, report lib.Report) error {
+			_, err := lib.ArchiveReport(nil, lib.ArchiveBucket, report, lib.ArchiveHTML)
+			return err
+		}
+	}
+
+	if url := os.Getenv("SLACK_WEBHOOK_URL"); url != "" {
+		cfg := lib.SlackConfig{
+			WebhookURL: url,
+			ReportURL:  os.Getenv("REPORT_URL"),
+			Templates:  notificationTemplates,
+		}
+		registry[lib.PublishActionSlack] = func(ctx context.Context, report lib.Report) error {
+			c := cfg
+			c.Locale = lib.LocaleFromContext(ctx)
+			return lib.PublishSlack(c, report)
+		}
+	}
+
+	if key := os.Getenv("PAGERDUTY_ROUTING_KEY"); key != "" {
+		registry[lib.PublishActionPagerDuty] = func(ctx context.Context, report lib.Report) error {
+			return lib.PublishPagerDuty(key, report)
+		}
+	}
+
+	if url := os.Getenv("REPORT_QUEUE_URL"); url != "" {
+		cfg := lib.SQSConfig{
+			QueueURL:                  url,
+			Region:                    x.region,
+			ContentBasedDeduplication: os.Getenv("REPORT_QUEUE_DEDUPLICATION") == "content",
+			MaxMessageSize:            x.publish.MaxMessageSize,
+			AlwaysEnvelope:            x.publish.AlwaysEnvelope,
+			Bucket:                    x.publish.Bucket,
+			PresignExpiry:             x.publish.PresignExpiry,
+		}
+		registry[lib.PublishActionSQS] = func(ctx context.Context, report lib.Report) error {
+			return lib.PublishSQS(cfg, report)
+		}
+	}
+
+	if stream := os.Getenv("RESULT_STREAM"); stream != "" {
+		cfg := lib.KinesisConfig{
+			StreamName:     stream,
+			Region:         x.region,
+			Gzip:           os.Getenv("RESULT_STREAM_GZIP") == "true",
+			AlwaysEnvelope: x.publish.AlwaysEnvelope,
+			Bucket:         x.publish.Bucket,
+			PresignExpiry:  x.publish.PresignExpiry,
+		}
+		registry[lib.PublishActionKinesis] = func(ctx context.Context, report lib.Report) error {
+			return lib.PublishKinesis(cfg, report)
+		}
+	}
+
+	return registry
 }
 
 func buildParameters(ctx context.Context) (*parameters, error) {
@@ -26,26 +138,145 @@ func buildParameters(ctx context.Context) (*parameters, error) {
 	params := parameters{
 		region:             arn.Region(),
 		reportNotification: os.Getenv("REPORT_NOTIFICATION"),
+		reportTable:        lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+	}
+
+	if err := lib.ValidateSnsTopicArn(params.reportNotification, params.region); err != nil {
+		return nil, err
+	}
+
+	params.publish = lib.ReportPublishConfig{
+		TopicArn:       params.reportNotification,
+		Region:         params.region,
+		AlwaysEnvelope: os.Getenv("REPORT_ENVELOPE") == "always",
+		Bucket:         lib.ArchiveBucket,
+		Templates:      notificationTemplates,
+		ReportURL:      os.Getenv("REPORT_URL"),
+	}
+	if v := os.Getenv("MAX_MESSAGE_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, lib.NewConfigError("Invalid MAX_MESSAGE_SIZE: " + v)
+		}
+		params.publish.MaxMessageSize = size
+	}
+	if v := os.Getenv("PRESIGN_EXPIRY"); v != "" {
+		expiry, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, lib.NewConfigError("Invalid PRESIGN_EXPIRY: " + v)
+		}
+		params.publish.PresignExpiry = expiry
 	}
 
+	if v := os.Getenv("DIGEST_MAX_SEVERITY"); v != "" {
+		digest := lib.DigestConfig{
+			Table:       lib.ResolveTableName(os.Getenv("DIGEST_TABLE")),
+			Region:      params.region,
+			MaxSeverity: lib.ReportSeverity(v),
+		}
+		if digest.MaxSeverity.Level() == 0 {
+			return nil, lib.NewConfigError("Invalid DIGEST_MAX_SEVERITY: " + v)
+		}
+		if w := os.Getenv("DIGEST_WINDOW"); w != "" {
+			window, err := time.ParseDuration(w)
+			if err != nil || window <= 0 {
+				return nil, lib.NewConfigError("Invalid DIGEST_WINDOW: " + w)
+			}
+			digest.Window = window
+		}
+		params.digest = &digest
+	}
+
+	if table := lib.ResolveTableName(os.Getenv("IDEMPOTENCY_TABLE")); table != "" {
+		idempotency := lib.IdempotencyConfig{Table: table, Region: params.region}
+		if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return nil, lib.NewConfigError("Invalid IDEMPOTENCY_TTL: " + v)
+			}
+			idempotency.TTL = ttl
+		}
+		params.idempotency = &idempotency
+	}
+
+	overrides, err := lib.ParseSeverityOverrides(os.Getenv("SEVERITY_OVERRIDES"))
+	if err != nil {
+		return nil, err
+	}
+	params.severityOverrides = overrides
+
 	return &params, nil
 }
 
+// savePublishedSeverity records severity of the report in the report table to
+// detect escalation in the next publication. Digest reports are not stored.
+func (x *parameters) savePublishedSeverity(report lib.Report) error {
+	if x.reportTable == "" || report.Alert.Rule == lib.DigestRule {
+		return nil
+	}
+
+	report.MarkPublished()
+	if err := lib.SaveReport(x.reportTable, x.region, report); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to save published severity")
+		return err
+	}
+	return nil
+}
+
 // HandleRequest is Lambda handler
 func handleRequest(ctx context.Context, report lib.Report) error {
-	logger.WithField("report", report).Info("Start")
+	logger.WithFields(report.LogFields()).WithField("report", report).Info("Start")
 
 	params, err := buildParameters(ctx)
 	if err != nil {
 		return err
 	}
 
-	report.Status = lib.StatusPublished
-	err = lib.PublishSnsMessage(params.reportNotification, params.region, report)
+	router, err := lib.NewPublishRouter(publishRoutes, params.publishers())
 	if err != nil {
 		return err
 	}
+	if params.idempotency != nil {
+		router.EnableIdempotency(*params.idempotency)
+	}
 
+	// Auto-closed reports are published as closed. They skip review, so
+	// the result of Compiler is kept as it is.
+	if !report.IsClosed() {
+		report.Status = lib.StatusPublished
+		if o := params.severityOverrides.Apply(&report); o != nil {
+			logger.WithFields(logrus.Fields{"override": o.Name, "severity": o.Severity}).Info("Overrode severity")
+		}
+	}
+
+	if params.digest != nil {
+		if params.digest.Digested(report) {
+			if err := lib.AddToDigest(*params.digest, report, time.Now()); err != nil {
+				return err
+			}
+			logger.WithFields(report.LogFields()).WithField("severity", report.Result.Severity).Info("Held report for digest")
+			return params.savePublishedSeverity(report)
+		}
+
+		// A report escalated out of digest severities is published
+		// immediately and not included in the digest.
+		if err := lib.RemoveFromDigest(*params.digest, report.ID); err != nil {
+			return err
+		}
+	}
+
+	outcome, err := router.PublishReport(ctx, report)
+	if err != nil {
+		return err
+	}
+
+	// Severity is recorded only when all actions succeed, so a failed
+	// escalation is published again as escalated.
+	if err := params.savePublishedSeverity(report); err != nil {
+		return err
+	}
+
+	logger.WithFields(report.LogFields()).WithField("actions", outcome.Succeeded()).Info("Done")
 	return nil
 }
 
@@ -53,5 +284,17 @@ func main() {
 	logger.SetFormatter(&logrus.JSONFormatter{})
 	logger.SetLevel(logrus.InfoLevel)
 
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	var err error
+	if publishRoutes, err = loadPublishRoutes(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Fail to load publish routes")
+	}
+	if notificationTemplates, err = lib.ParseNotificationTemplates(os.Getenv("NOTIFICATION_TEMPLATES")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Fail to load notification templates")
+	}
+
 	lambda.Start(handleRequest)
 }
@@ -1,14 +1,9 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/json"
-	"fmt"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/guregu/dynamo"
 	"github.com/m-mizutani/AlertResponder/lib"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -17,61 +12,57 @@ import (
 var alertTimeToLive = time.Second * 86400
 
 type AlertMap struct {
-	table dynamo.Table
-}
-
-func NewAlertMap(tableName, region string) *AlertMap {
-	alertMap := AlertMap{}
-
-	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
-	alertMap.table = db.Table(tableName)
-
-	return &alertMap
-}
+	table  lib.AlertMapTable
+	region string
 
-type AlertRecord struct {
-	AlertID   string       `dynamo:"alert_id"`
-	AlertKey  string       `dynamo:"alert_key"`
-	Rule      string       `dynamo:"rule"`
-	ReportID  lib.ReportID `dynamo:"report_id"`
-	AlertData []byte       `dynamo:"alert_data"`
-	Timestamp time.Time    `dynamo:"timestamp"`
-	TTL       time.Time    `dynamo:"ttl"`
+	// creator writes mapping of a new report and the initial report item
+	// atomically if report table is configured.
+	creator lib.ReportCreator
 }
 
-func GenAlertKey(alertID, rule string) string {
-	data := fmt.Sprintf("%s=====%s", alertID, rule)
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+func NewAlertMap(tableName, reportTable, region string) *AlertMap {
+	alertMap := AlertMap{region: region}
+	alertMap.table = lib.OpenAlertMap(region, tableName)
+	if reportTable != "" {
+		alertMap.creator = lib.OpenReportCreator(region, tableName, reportTable)
+	}
+	return &alertMap
 }
 
-func (x *AlertMap) sync(alert lib.Alert) (lib.ReportID, bool, error) {
-	var reportID lib.ReportID
+func (x *AlertMap) sync(alert lib.Alert) (lib.AlertRecord, bool, error) {
+	var record lib.AlertRecord
 	var isNew bool
 
-	alertID := GenAlertKey(alert.Key, alert.Rule)
+	alertID := lib.GenAlertKey(alert.Key, alert.Rule, alert.AccountID)
 	log.WithField("alertID", alertID).Info("AlertID generated")
 	alertData, err := json.Marshal(alert)
 	if err != nil {
-		return reportID, isNew, errors.Wrap(err, "Fail to unmarshal alert")
+		return record, isNew, errors.Wrap(err, "Fail to unmarshal alert")
 	}
 
 	now := time.Now().UTC()
 	ttl := now.Add(alertTimeToLive)
 
-	var records []AlertRecord
-	err = x.table.Get("alert_id", alertID).Filter("'ttl' > ?", now).All(&records)
+	found, err := x.table.GetAlertRecords(alertID)
 	if err != nil {
-		return reportID, isNew, errors.Wrap(err, "Fail to get cache")
+		return record, isNew, err
+	}
+
+	var records []lib.AlertRecord
+	for _, r := range found {
+		if r.TTL.After(now) {
+			records = append(records, r)
+		}
 	}
 	log.WithField("records", records).Info("Fetched alert records")
 
-	var record AlertRecord
 	if len(records) == 0 {
-		record = AlertRecord{
-			AlertKey: alert.Key,
-			AlertID:  alertID,
-			Rule:     alert.Rule,
-			ReportID: lib.NewReportID(),
+		record = lib.AlertRecord{
+			AlertKey:  alert.Key,
+			AlertID:   alertID,
+			Rule:      alert.Rule,
+			AccountID: alert.AccountID,
+			ReportID:  lib.NewReportID(),
 		}
 		isNew = true
 		log.WithField("record", record).Info("New alert is created")
@@ -84,12 +75,34 @@ func (x *AlertMap) sync(alert lib.Alert) (lib.ReportID, bool, error) {
 	record.AlertData = alertData
 	record.Timestamp = now
 	record.TTL = ttl
+	record.Occurrences++
+
+	if isNew && x.creator != nil {
+		if err := x.create(alert, &record); err != nil {
+			return record, isNew, err
+		}
+		return record, isNew, nil
+	}
 
 	log.WithField("AlertRecord", record).Info("Put record")
-	err = x.table.Put(&record).Run()
+	if err := x.table.PutAlertRecord(&record); err != nil {
+		return record, isNew, err
+	}
+
+	return record, isNew, nil
+}
+
+// create stores the mapping and the initial report together.
+func (x *AlertMap) create(alert lib.Alert, record *lib.AlertRecord) error {
+	report := lib.NewReport(record.ReportID, alert)
+	report.Status = lib.StatusNew
+	report.Occurrences = record.Occurrences
+
+	initial, err := lib.NewReportRecord(report, x.region)
 	if err != nil {
-		return reportID, isNew, errors.Wrap(err, "Fail to put alert map")
+		return err
 	}
 
-	return record.ReportID, isNew, nil
+	log.WithField("AlertRecord", record).Info("Create report with record")
+	return x.creator.CreateReport(record, initial)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAlertMapTable struct {
+	records []lib.AlertRecord
+}
+
+func (x *mockAlertMapTable) GetAlertRecords(alertID string) ([]lib.AlertRecord, error) {
+	var records []lib.AlertRecord
+	for _, r := range x.records {
+		if r.AlertID == alertID {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (x *mockAlertMapTable) PutAlertRecord(record *lib.AlertRecord) error {
+	x.records = append(x.records, *record)
+	return nil
+}
+
+// mockReportCreator stores the mapping into table and the report only if
+// the transaction succeeds.
+type mockReportCreator struct {
+	table   *mockAlertMapTable
+	reports []*lib.ReportRecord
+	fail    bool
+}
+
+func (x *mockReportCreator) CreateReport(mapping *lib.AlertRecord, report *lib.ReportRecord) error {
+	if x.fail {
+		return errors.New("transaction canceled")
+	}
+	x.table.records = append(x.table.records, *mapping)
+	x.reports = append(x.reports, report)
+	return nil
+}
+
+func mockAlertMapStorage(table *mockAlertMapTable, creator *mockReportCreator) func() {
+	origMap, origCreator := lib.OpenAlertMap, lib.OpenReportCreator
+	lib.OpenAlertMap = func(region, tableName string) lib.AlertMapTable { return table }
+	lib.OpenReportCreator = func(region, alertMap, reportTable string) lib.ReportCreator { return creator }
+	return func() { lib.OpenAlertMap, lib.OpenReportCreator = origMap, origCreator }
+}
+
+func TestAlertMapCreateReport(t *testing.T) {
+	table := &mockAlertMapTable{}
+	creator := &mockReportCreator{table: table}
+	defer mockAlertMapStorage(table, creator)()
+
+	alert := lib.Alert{Name: "test", Rule: "r1", Key: "k1"}
+	alertMap := NewAlertMap("alert-map", "report-table", "ap-northeast-1")
+
+	record, isNew, err := alertMap.sync(alert)
+	require.NoError(t, err)
+	assert.True(t, isNew)
+	require.Equal(t, 1, len(table.records))
+	require.Equal(t, 1, len(creator.reports))
+	assert.Equal(t, record.ReportID, creator.reports[0].ReportID)
+	assert.Equal(t, table.records[0].ReportID, creator.reports[0].ReportID)
+
+	// Grouped alert updates only the mapping.
+	second, isNew, err := alertMap.sync(alert)
+	require.NoError(t, err)
+	assert.False(t, isNew)
+	assert.Equal(t, record.ReportID, second.ReportID)
+	assert.Equal(t, 2, len(table.records))
+	assert.Equal(t, 1, len(creator.reports))
+}
+
+func TestAlertMapCreateReportFailure(t *testing.T) {
+	table := &mockAlertMapTable{}
+	creator := &mockReportCreator{table: table, fail: true}
+	defer mockAlertMapStorage(table, creator)()
+
+	alertMap := NewAlertMap("alert-map", "report-table", "ap-northeast-1")
+	_, _, err := alertMap.sync(lib.Alert{Name: "test", Rule: "r1", Key: "k1"})
+	require.Error(t, err)
+	assert.Equal(t, 0, len(table.records))
+	assert.Equal(t, 0, len(creator.reports))
+}
+
+func TestAlertMapWithoutReportTable(t *testing.T) {
+	table := &mockAlertMapTable{}
+	creator := &mockReportCreator{table: table}
+	defer mockAlertMapStorage(table, creator)()
+
+	alertMap := NewAlertMap("alert-map", "", "ap-northeast-1")
+	_, isNew, err := alertMap.sync(lib.Alert{Name: "test", Rule: "r1", Key: "k1"})
+	require.NoError(t, err)
+	assert.True(t, isNew)
+	assert.Equal(t, 1, len(table.records))
+	assert.Equal(t, 0, len(creator.reports))
+}
+
+func TestHandlerSuppressFalsePositive(t *testing.T) {
+	table := &mockAlertMapTable{}
+	defer mockAlertMapStorage(table, &mockReportCreator{table: table})()
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+
+	suppressions := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	origOpen := lib.OpenSuppressionTable
+	lib.OpenSuppressionTable = func(region, tableName string) lib.SuppressionTable {
+		return suppressions
+	}
+	defer func() { lib.OpenSuppressionTable = origOpen }()
+
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+	require.NoError(t, store.MarkFalsePositive("k1", "r1"))
+
+	cfg := Config{AlertMapName: "alert-map", Region: "ap-northeast-1", SuppressionTable: "suppression"}
+	ids, err := Handler(cfg, []lib.Alert{
+		{Name: "test", Rule: "r1", Key: "k1"},
+		{Name: "test", Rule: "r2", Key: "k1"},
+		{Name: "test", Rule: "r1", Key: "k1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(ids))
+	require.Equal(t, 1, len(mock.alerts))
+	assert.Equal(t, "r2", mock.alerts[0].Rule)
+}
+
+type mockSuppressionTable struct {
+	items map[string]lib.Suppression
+}
+
+func (x *mockSuppressionTable) GetSuppression(id string) (*lib.Suppression, error) {
+	item, ok := x.items[id]
+	if !ok {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+func (x *mockSuppressionTable) PutSuppression(suppression *lib.Suppression) error {
+	x.items[suppression.SuppressionID] = *suppression
+	return nil
+}
+
+func (x *mockSuppressionTable) DeleteSuppression(id string) error {
+	delete(x.items, id)
+	return nil
+}
+
+func TestHandlerSuppressionList(t *testing.T) {
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+
+	suppressions := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	origOpen := lib.OpenSuppressionTable
+	lib.OpenSuppressionTable = func(region, tableName string) lib.SuppressionTable {
+		return suppressions
+	}
+	defer func() { lib.OpenSuppressionTable = origOpen }()
+
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+	require.NoError(t, store.AddSuppression("k1", "r1", "known scanner", 0))
+
+	cfg := Config{Region: "ap-northeast-1", SuppressionTable: "suppression"}
+	ids, err := Handler(cfg, []lib.Alert{
+		{Name: "test", Rule: "r1", Key: "k1"},
+		{Name: "test", Rule: "r2", Key: "k1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(ids))
+	require.Equal(t, 1, len(mock.alerts))
+	assert.Equal(t, "r2", mock.alerts[0].Rule)
+}
+
+func TestHandlerNormalizeRule(t *testing.T) {
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+	orig := lib.AlertRuleNormalization
+	lib.AlertRuleNormalization = lib.DefaultRuleNormalization
+	defer func() { lib.AlertRuleNormalization = orig }()
+
+	_, err := Handler(Config{}, []lib.Alert{
+		{Name: "test", Rule: "Malware_Detected", Key: "k1"},
+		{Name: "test", Rule: "Malware Detected", Key: "k1"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mock.alerts))
+	assert.Equal(t, "malware-detected", mock.alerts[0].Rule)
+	assert.Equal(t, "malware-detected", mock.alerts[1].Rule)
+}
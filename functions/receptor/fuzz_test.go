@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/m-mizutani/AlertResponder/lib"
+)
+
+// alertSeeds are known tricky payloads for the alert parser.
+var alertSeeds = []string{
+	`{"name":"test","rule":"r1","key":"k1"}`,
+	`{"name":"test","rule":"r1","key":"k1","attrs":[{"type":"ipaddr","value":"192.0.2.1","key":"src","context":["remote"]}]}`,
+	`{"timestamp":{"init":1548644645.5,"last":1e308}}`,
+	`{"timestamp":{"init":1e400}}`,
+	`{"timestamp":{"init":"yesterday"}}`,
+	`{"attrs":"not array"}`,
+	`{"attrs":[null,{}]}`,
+	`{"received_at":"not time"}`,
+	`{"correlation_id":""}`,
+	`{"name":"\u0000\ud800"}`,
+	"{\"rule\":\"\xff\xfe\"}",
+	`{"name":"a","name":"b"}`,
+	`null`,
+	`[]`,
+	`[{"name":"test"}]`,
+	`"string"`,
+	`0`,
+	``,
+	` `,
+	`{`,
+	`{"name":`,
+	`{}}`,
+	`{} {}`,
+	strings.Repeat(`{"a":`, 10000) + strings.Repeat(`}`, 10000),
+	strings.Repeat(`[`, 100000),
+}
+
+// checkParsed fails if the parser returned neither valid alerts nor an error.
+func checkParsed(t *testing.T, alerts []lib.Alert, err error, records int, receivedAt time.Time) {
+	if err != nil {
+		if _, ok := err.(*lib.SizeLimitError); ok {
+			return
+		}
+		if code := lib.ErrorCodeOf(err); code != lib.ErrCodeInvalidAlert {
+			t.Fatalf("unexpected error code %s: %v", code, err)
+		}
+		return
+	}
+
+	if len(alerts) != records {
+		t.Fatalf("expected %d alert(s), got %d", records, len(alerts))
+	}
+	for _, alert := range alerts {
+		if alert.CorrelationID == "" {
+			t.Fatal("correlation ID is not set")
+		}
+		if !alert.ReceivedAt.Equal(receivedAt) {
+			t.Fatalf("unexpected ReceivedAt: %v", alert.ReceivedAt)
+		}
+		if _, err := json.Marshal(alert); err != nil {
+			t.Fatalf("parsed alert can not be marshaled: %v", err)
+		}
+	}
+}
+
+func FuzzParseEvent(f *testing.F) {
+	for _, seed := range alertSeeds {
+		f.Add([]byte(seed))
+	}
+
+	arrival := time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var record events.KinesisEventRecord
+		record.Kinesis.Data = data
+		record.Kinesis.ApproximateArrivalTimestamp = events.SecondsEpochTime{Time: arrival}
+
+		alerts, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record, record}})
+		checkParsed(t, alerts, err, 2, arrival)
+	})
+}
+
+func FuzzParseSnsEvent(f *testing.F) {
+	for _, seed := range alertSeeds {
+		f.Add(seed)
+	}
+
+	arrival := time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, msg string) {
+		var record events.SNSEventRecord
+		record.SNS.Message = msg
+		record.SNS.Timestamp = arrival
+
+		alerts, err := ParseSnsEvent(events.SNSEvent{Records: []events.SNSEventRecord{record}})
+		checkParsed(t, alerts, err, 1, arrival)
+	})
+}
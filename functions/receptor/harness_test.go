@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/m-mizutani/AlertResponder/lib/harness"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRequestWithHarness(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+
+	alert := lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"}
+	event, err := h.SNSEvent(alert)
+	require.NoError(t, err)
+
+	resp, err := HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.ReportIDs))
+	reportID := lib.ReportID(resp.ReportIDs[0])
+
+	dispatched := h.Executions(harness.DispatchMachine)
+	require.Equal(t, 1, len(dispatched))
+	assert.Equal(t, reportID, dispatched[0].Report.ID)
+	assert.Equal(t, lib.StatusNew, dispatched[0].Report.Status)
+	assert.NotEmpty(t, dispatched[0].Report.CorrelationID)
+	assert.Equal(t, 1, len(h.Executions(harness.ReviewMachine)))
+
+	messages := h.Messages(harness.ReportNotification)
+	require.Equal(t, 1, len(messages))
+	var published lib.Report
+	require.NoError(t, json.Unmarshal(messages[0].Data, &published))
+	assert.Equal(t, reportID, published.ID)
+	assert.Equal(t, "r1", messages[0].Attributes["rule"])
+	assert.Equal(t, string(lib.StatusNew), messages[0].Attributes["status"])
+
+	// Alert with same key and rule is grouped into the report and review is
+	// not started again.
+	resp, err = HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+	assert.Equal(t, []string{string(reportID)}, resp.ReportIDs)
+
+	dispatched = h.Executions(harness.DispatchMachine)
+	require.Equal(t, 2, len(dispatched))
+	assert.Equal(t, lib.StatusOngoing, dispatched[1].Report.Status)
+	assert.Equal(t, 1, len(h.Executions(harness.ReviewMachine)))
+}
+
+func TestHandleRequestExpectedAuthors(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+	h.Setenv("EXPECTED_AUTHORS_BY_RULE", `{"malware-*": ["virustotal", "sandbox"]}`)
+
+	for _, rule := range []string{"malware-download", "port-scan"} {
+		event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: rule, Key: "198.51.100.7"})
+		require.NoError(t, err)
+		_, err = HandleRequest(h.Context("receptor"), event)
+		require.NoError(t, err)
+	}
+
+	dispatched := h.Executions(harness.DispatchMachine)
+	require.Equal(t, 2, len(dispatched))
+	assert.Equal(t, []string{"sandbox", "virustotal"}, dispatched[0].Report.ExpectedAuthors)
+	assert.Nil(t, dispatched[1].Report.ExpectedAuthors)
+}
+
+func TestHandleRequestNotifyOnDedup(t *testing.T) {
+	for _, flag := range []string{"", "true"} {
+		t.Run("NOTIFY_ON_DEDUP="+flag, func(t *testing.T) {
+			h := harness.New()
+			defer h.Close()
+			h.Setenv("NOTIFY_ON_DEDUP", flag)
+
+			event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"})
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err = HandleRequest(h.Context("receptor"), event)
+				require.NoError(t, err)
+			}
+
+			// All alerts are dispatched regardless of the flag.
+			assert.Equal(t, 3, len(h.Executions(harness.DispatchMachine)))
+
+			messages := h.Messages(harness.ReportNotification)
+			if flag == "" {
+				require.Equal(t, 1, len(messages))
+				return
+			}
+
+			require.Equal(t, 3, len(messages))
+			for i, msg := range messages {
+				var report lib.Report
+				require.NoError(t, json.Unmarshal(msg.Data, &report))
+				assert.Equal(t, i+1, report.Occurrences)
+			}
+			var last lib.Report
+			require.NoError(t, json.Unmarshal(messages[2].Data, &last))
+			assert.Equal(t, lib.StatusOngoing, last.Status)
+		})
+	}
+}
+
+func TestHandleRequestDedupFallback(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+	h.Setenv("DEDUP_FALLBACK", "true")
+	h.Alerts.Err = lib.WrapStoreError(lib.ErrCodeStoreGet, errors.New("service unavailable"), "Fail to get alert map")
+
+	event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"})
+	require.NoError(t, err)
+
+	resp1, err := HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+	resp2, err := HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+
+	// Alerts are not grouped while AlertMap is down, but inspection and
+	// review run for both of them.
+	require.Equal(t, 1, len(resp1.ReportIDs))
+	require.Equal(t, 1, len(resp2.ReportIDs))
+	assert.NotEqual(t, resp1.ReportIDs[0], resp2.ReportIDs[0])
+
+	dispatched := h.Executions(harness.DispatchMachine)
+	require.Equal(t, 2, len(dispatched))
+	assert.Equal(t, 2, len(h.Executions(harness.ReviewMachine)))
+	for _, exec := range dispatched {
+		assert.Equal(t, lib.StatusNew, exec.Report.Status)
+		assert.Equal(t, 1, len(exec.Report.Warnings))
+	}
+	assert.Equal(t, 2, len(h.Messages(harness.ReportNotification)))
+}
+
+func TestHandleRequestDedupFallbackDisabled(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+	h.Alerts.Err = lib.WrapStoreError(lib.ErrCodeStorePut, errors.New("service unavailable"), "Fail to put alert map")
+
+	event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"})
+	require.NoError(t, err)
+
+	_, err = HandleRequest(h.Context("receptor"), event)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeStorePut, lib.ErrorCodeOf(err))
+	assert.Empty(t, h.Executions(harness.DispatchMachine))
+
+	// Misconfiguration is not hidden by the fallback.
+	h.Setenv("DEDUP_FALLBACK", "true")
+	h.Alerts.Err = lib.NewConfigError("Alert map is not configured")
+	_, err = HandleRequest(h.Context("receptor"), event)
+	require.Error(t, err)
+	assert.Empty(t, h.Executions(harness.DispatchMachine))
+}
+
+func TestHandleRequestMachineDelays(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+	h.Setenv("DISPATCH_DELAY", "0")
+	h.Setenv("REVIEW_DELAY", "10m")
+
+	event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"})
+	require.NoError(t, err)
+	_, err = HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+
+	dispatched := h.Executions(harness.DispatchMachine)
+	require.Equal(t, 1, len(dispatched))
+	assert.Contains(t, dispatched[0].Input, `"delay_seconds":0`)
+	reviewed := h.Executions(harness.ReviewMachine)
+	require.Equal(t, 1, len(reviewed))
+	assert.Contains(t, reviewed[0].Input, `"delay_seconds":600`)
+
+	// Invalid delay is a configuration error.
+	h.Setenv("REVIEW_DELAY", "-1")
+	_, err = HandleRequest(h.Context("receptor"), event)
+	require.Error(t, err)
+	_, ok := errors.Cause(err).(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+type failingEventBridge struct {
+	calls int
+}
+
+func (x *failingEventBridge) PutEvents(input *lib.EventBridgePutEventsInput) (*lib.EventBridgePutEventsOutput, error) {
+	x.calls++
+	return nil, errors.New("event bus is unavailable")
+}
+
+func TestHandleRequestEventBridgeFailure(t *testing.T) {
+	h := harness.New()
+	defer h.Close()
+	h.Setenv("EVENT_BUS", "alerts")
+
+	client := &failingEventBridge{}
+	lib.EventBridgeClient = client
+	defer func() { lib.EventBridgeClient = nil }()
+
+	event, err := h.SNSEvent(lib.Alert{Name: "test", Rule: "r1", Key: "198.51.100.7"})
+	require.NoError(t, err)
+	resp, err := HandleRequest(h.Context("receptor"), event)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(resp.ReportIDs))
+	assert.Equal(t, 1, client.calls)
+
+	// The report is dispatched and notified once.
+	assert.Equal(t, 1, len(h.Executions(harness.DispatchMachine)))
+	assert.Equal(t, 1, len(h.Messages(harness.ReportNotification)))
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -19,8 +22,56 @@ type Config struct {
 	TaskStreamName string
 	AlertMapName   string
 	ReportTo       string
+
+	// ReportTable is a table of compiled reports. If set, the initial report
+	// is stored with its AlertMap mapping in a transaction.
+	ReportTable string
+
+	// NotifyOnDedup enables notification of alerts grouped into an existing
+	// report. Only new reports are notified by default.
+	NotifyOnDedup bool
+
+	// DedupFallback issues a report with a new ID when AlertMap is not
+	// available instead of failing. Duplicated reports may be issued while
+	// AlertMap is down.
+	DedupFallback bool
+
+	// SuppressionTable is a table of lib.SuppressionStore. Alerts in it are
+	// ignored before report creation if set.
+	SuppressionTable string
+
+	// ExpectedAuthors is inspectors expected to contribute to reports by
+	// alert rule. They are recorded to the report at dispatch.
+	ExpectedAuthors lib.RuleAuthors
+
+	// EventBus is name of EventBridge event bus. Reports are put to the bus
+	// as well as SNS topic if set. EventSource and EventDetailType are source
+	// and detail-type of the events.
+	EventBus        string
+	EventSource     string
+	EventDetailType string
+
+	// Machines are state machines started for each report in order.
+	Machines []DelayMachine
+}
+
+// DelayMachine is a state machine that processes a report after Delay.
+type DelayMachine struct {
+	Name  string
+	Arn   string
+	Delay time.Duration
+
+	// NewOnly starts the machine only for new reports, not for alerts grouped
+	// into an existing report.
+	NewOnly bool
 }
 
+// Default source and detail-type of EventBridge events.
+const (
+	defaultEventSource     = "alert-responder"
+	defaultEventDetailType = "AlertResponder Report"
+)
+
 type ReceptorResponse struct {
 	ReportIDs []string `json:"report_ids"`
 }
@@ -33,28 +84,128 @@ func buildConfig(ctx context.Context) (*Config, error) {
 
 	cfg := Config{
 		Region:         arn.Region(),
-		AlertMapName:   os.Getenv("ALERT_MAP"),
+		AlertMapName:   lib.ResolveTableName(os.Getenv("ALERT_MAP")),
 		TaskStreamName: os.Getenv("STREAM_NAME"),
 		ReportTo:       os.Getenv("REPORT_TO"),
+		ReportTable:    lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+		NotifyOnDedup:  os.Getenv("NOTIFY_ON_DEDUP") == "true",
+		DedupFallback:  os.Getenv("DEDUP_FALLBACK") == "true",
+
+		SuppressionTable: lib.ResolveTableName(os.Getenv("SUPPRESSION_TABLE")),
+
+		EventBus:        os.Getenv("EVENT_BUS"),
+		EventSource:     os.Getenv("EVENT_SOURCE"),
+		EventDetailType: os.Getenv("EVENT_DETAIL_TYPE"),
+	}
+	if cfg.EventSource == "" {
+		cfg.EventSource = defaultEventSource
+	}
+	if cfg.EventDetailType == "" {
+		cfg.EventDetailType = defaultEventDetailType
+	}
+
+	if cfg.ExpectedAuthors, err = lib.ParseRuleAuthors(os.Getenv("EXPECTED_AUTHORS_BY_RULE")); err != nil {
+		return nil, err
+	}
+	if _, err := lib.ParseRuleNormalization(os.Getenv("RULE_NORMALIZATION")); err != nil {
+		return nil, err
+	}
+
+	dispatchDelay, err := lib.ParseExecutionDelay(os.Getenv("DISPATCH_DELAY"))
+	if err != nil {
+		return nil, err
+	}
+	reviewDelay, err := lib.ParseExecutionDelay(os.Getenv("REVIEW_DELAY"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Machines = []DelayMachine{
+		{Name: "DispatchMachine", Arn: os.Getenv("DISPATCH_MACHINE"), Delay: dispatchDelay},
+		{Name: "ReviewMachine", Arn: os.Getenv("REVIEW_MACHINE"), Delay: reviewDelay, NewOnly: true},
 	}
 
 	return &cfg, nil
 }
 
+// dumpInvalidAlert saves raw data of invalid alert to debug bucket if enabled.
+func dumpInvalidAlert(src string) {
+	if key, err := lib.Dump("invalid-alert", src); err != nil {
+		log.WithError(err).Warn("Fail to dump invalid alert")
+	} else if key != "" {
+		log.WithField("key", key).Info("Dumped invalid alert")
+	}
+}
+
+// alertSchema validates raw alert records if not nil. It is loaded at cold
+// start.
+var alertSchema *lib.JSONSchema
+
+// loadAlertSchema loads JSON Schema of alerts from ALERT_SCHEMA. "default"
+// means lib.DefaultAlertSchema. Nil is returned if it is not set.
+func loadAlertSchema() (*lib.JSONSchema, error) {
+	switch raw := os.Getenv("ALERT_SCHEMA"); raw {
+	case "":
+		return nil, nil
+	case "default":
+		return lib.ParseJSONSchema(lib.DefaultAlertSchema)
+	default:
+		return lib.ParseJSONSchema(raw)
+	}
+}
+
+// parseAlert decodes a raw alert record. The record must be a JSON object;
+// other valid JSON such as null or an array is rejected as well as broken JSON.
+// The record is also validated by alertSchema if configured. Unknown fields
+// are rejected if lib.StrictAlertFields is set, otherwise they are recorded in
+// warnings of the alert.
+func parseAlert(src []byte, receivedAt time.Time) (lib.Alert, error) {
+	alert := lib.Alert{}
+	trimmed := bytes.TrimSpace(src)
+	err := json.Unmarshal(trimmed, &alert)
+	if err == nil && (len(trimmed) == 0 || trimmed[0] != '{') {
+		err = errors.New("Alert is not a JSON object")
+	}
+	if err == nil && alertSchema != nil {
+		err = alertSchema.Validate(trimmed)
+	}
+	if err == nil {
+		var unknown []string
+		if unknown, err = lib.UnknownAlertFields(trimmed); err == nil && len(unknown) > 0 {
+			if lib.StrictAlertFields {
+				err = fmt.Errorf("Unknown fields in alert: %s", strings.Join(unknown, ", "))
+			} else {
+				log.WithField("fields", unknown).Warn("Alert has unknown fields")
+				alert.Warnings = append(alert.Warnings, fmt.Sprintf("Unknown fields are ignored: %s", strings.Join(unknown, ", ")))
+			}
+		}
+	}
+	if err != nil {
+		log.Println("Invalid alert data: ", string(src))
+		dumpInvalidAlert(string(src))
+		return alert, err
+	}
+
+	alert.ReceivedAt = receivedAt.UTC()
+	alert.SetCorrelationID()
+	lib.WithCorrelation(log.StandardLogger(), alert.CorrelationID).
+		WithField("rule", alert.Rule).Info("Received alert")
+	return alert, nil
+}
+
 func ParseSnsEvent(event events.SNSEvent) ([]lib.Alert, error) {
 	alerts := []lib.Alert{}
 
-	for _, record := range event.Records {
+	for i, record := range event.Records {
 		src := record.SNS.Message
+		if lib.MaxAlertSize > 0 && len(src) > lib.MaxAlertSize {
+			return alerts, lib.NewSizeLimitError("SNS message", len(src), lib.MaxAlertSize)
+		}
 		log.Println("data = ", src)
 
-		alert := lib.Alert{}
-		err := json.Unmarshal([]byte(src), &alert)
+		alert, err := parseAlert([]byte(src), record.SNS.Timestamp)
 		if err != nil {
-			log.Println("Invalid alert data: ", string(src))
-			return alerts, errors.Wrap(err, "Invalid json format in SNS message")
+			return alerts, lib.WrapCode(lib.ErrCodeInvalidAlert, err, fmt.Sprintf("Invalid alert in SNS record %d", i))
 		}
-
 		alerts = append(alerts, alert)
 	}
 
@@ -64,17 +215,17 @@ func ParseSnsEvent(event events.SNSEvent) ([]lib.Alert, error) {
 func ParseEvent(event events.KinesisEvent) ([]lib.Alert, error) {
 	alerts := []lib.Alert{}
 
-	for _, record := range event.Records {
+	for i, record := range event.Records {
 		src := record.Kinesis.Data
+		if lib.MaxAlertSize > 0 && len(src) > lib.MaxAlertSize {
+			return alerts, lib.NewSizeLimitError("Kinesis record", len(src), lib.MaxAlertSize)
+		}
 		log.Println("data = ", string(src))
 
-		alert := lib.Alert{}
-		err := json.Unmarshal(src, &alert)
+		alert, err := parseAlert(src, record.Kinesis.ApproximateArrivalTimestamp.Time)
 		if err != nil {
-			log.Println("Invalid alert data: ", string(src))
-			return alerts, errors.Wrap(err, "Invalid json format in KinesisRecord")
+			return alerts, lib.WrapCode(lib.ErrCodeInvalidAlert, err, fmt.Sprintf("Invalid alert in Kinesis record %d", i))
 		}
-
 		alerts = append(alerts, alert)
 	}
 
@@ -82,15 +233,30 @@ func ParseEvent(event events.KinesisEvent) ([]lib.Alert, error) {
 }
 
 func alertToReport(cfg Config, alert lib.Alert) (lib.Report, error) {
-	log.WithField("alert", alert).Info("Convert alert to report")
+	lib.WithCorrelation(log.StandardLogger(), alert.CorrelationID).
+		WithField("alert", alert).Info("Convert alert to report")
 
-	alertMap := NewAlertMap(cfg.AlertMapName, cfg.Region)
+	alertMap := NewAlertMap(cfg.AlertMapName, cfg.ReportTable, cfg.Region)
 
-	reportID, isNew, err := alertMap.sync(alert)
+	record, isNew, err := alertMap.sync(alert)
+	degraded := false
 	if err != nil {
-		return lib.Report{}, err
+		// Misconfiguration is not recovered by the fallback.
+		if !cfg.DedupFallback || lib.ErrorCodeOf(err) == lib.ErrCodeInvalidConfig {
+			return lib.Report{}, err
+		}
+
+		lib.WithCorrelation(log.StandardLogger(), alert.CorrelationID).
+			WithFields(lib.ErrorFields(err)).Warn("AlertMap is unavailable, dedup is degraded")
+		record = lib.AlertRecord{ReportID: lib.NewReportID(), Occurrences: 1}
+		isNew, degraded = true, true
+	}
+	report := lib.NewReport(record.ReportID, alert)
+	report.Occurrences = record.Occurrences
+	report.ExpectedAuthors = cfg.ExpectedAuthors.Expect(alert.Rule)
+	if degraded {
+		report.Warnings = append(report.Warnings, "Alerts are not grouped because AlertMap was unavailable, the report may be duplicated")
 	}
-	report := lib.NewReport(reportID, alert)
 	if isNew {
 		report.Status = lib.StatusNew
 	} else {
@@ -100,31 +266,96 @@ func alertToReport(cfg Config, alert lib.Alert) (lib.Report, error) {
 	return report, nil
 }
 
-// Handler is main logic of Emitter
-func Handler(cfg Config, alerts []lib.Alert) ([]string, error) {
-	log.WithField("alerts", alerts).Info("Start handler")
-	resp := []string{}
+// dispatcher issues a report of the alert and starts inspection and review of
+// it. It is replaced with a mock in tests.
+type dispatcher interface {
+	Dispatch(cfg Config, alert lib.Alert) (*lib.Report, error)
+}
 
-	for _, alert := range alerts {
-		report, err := alertToReport(cfg, alert)
+type awsDispatcher struct{}
+
+func (x *awsDispatcher) Dispatch(cfg Config, alert lib.Alert) (*lib.Report, error) {
+	report, err := alertToReport(cfg, alert)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(report.LogFields()).WithField("status", report.Status).Info("Issued report")
+
+	for _, m := range cfg.Machines {
+		if m.NewOnly && !report.IsNew() {
+			continue
+		}
+		execArn, err := lib.ExecDelayMachineWithOptions(m.Arn, cfg.Region, report, lib.DelayOptions{Delay: m.Delay})
 		if err != nil {
-			return resp, err
+			return nil, errors.Wrapf(err, "Fail to start %s", m.Name)
 		}
+		log.WithFields(report.LogFields()).WithField("machine", m.Name).WithField("execution_arn", execArn).Info("Started execution")
+	}
+
+	if !report.IsNew() && !cfg.NotifyOnDedup {
+		log.WithFields(report.LogFields()).WithField("occurrences", report.Occurrences).
+			Info("Alert is grouped into existing report, skip notification")
+		return &report, nil
+	}
 
-		err = lib.ExecDelayMachine(os.Getenv("DISPATCH_MACHINE"), cfg.Region, report)
+	msgID, err := lib.PublishSnsMessage(context.Background(), os.Getenv("REPORT_NOTIFICATION"), cfg.Region, report)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(report.LogFields()).WithField("message_id", msgID).Info("Published report")
+
+	// The report is already dispatched, so failure of EventBridge does not
+	// fail the record. Retrying it would start machines and notify again.
+	if cfg.EventBus != "" {
+		err = lib.PublishEventBridge(cfg.EventBus, cfg.EventSource, cfg.EventDetailType, report, cfg.Region)
 		if err != nil {
-			return resp, errors.Wrap(err, "Fail to start DispatchMachine")
+			log.WithFields(report.LogFields()).WithFields(lib.ErrorFields(err)).
+				WithField("event_bus", cfg.EventBus).Error("Fail to put report to EventBridge")
 		}
+	}
 
-		if report.IsNew() {
-			err = lib.ExecDelayMachine(os.Getenv("REVIEW_MACHINE"), cfg.Region, report)
-			if err != nil {
-				return resp, errors.Wrap(err, "Fail to start ReviewMachine")
-			}
-		}
+	return &report, nil
+}
 
-		report.Status = "new"
-		err = lib.PublishSnsMessage(os.Getenv("REPORT_NOTIFICATION"), cfg.Region, report)
+var alertDispatcher dispatcher = &awsDispatcher{}
+
+// suppressed returns true if key and rule of the alert are in the suppression
+// list, e.g. marked as false positive by lib.SuppressionStore. The alert is not
+// suppressed if the check fails so that no alert is lost by failure of the
+// table.
+func suppressed(cfg Config, alert lib.Alert) bool {
+	if cfg.SuppressionTable == "" {
+		return false
+	}
+
+	logger := lib.WithCorrelation(log.StandardLogger(), alert.CorrelationID).
+		WithField("rule", alert.Rule).WithField("key", alert.Key)
+
+	store := lib.SuppressionStore{Table: cfg.SuppressionTable, Region: cfg.Region}
+	ok, err := store.IsSuppressed(alert.Key, alert.Rule)
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Warn("Fail to check suppression list")
+		return false
+	}
+	if ok {
+		logger.Info("Alert is in suppression list, suppressed")
+	}
+	return ok
+}
+
+// Handler is main logic of Emitter
+func Handler(cfg Config, alerts []lib.Alert) ([]string, error) {
+	log.WithField("alerts", alerts).Info("Start handler")
+	resp := []string{}
+
+	for _, alert := range alerts {
+		// Alerts not parsed by ParseEvent or ParseSnsEvent may have no ID.
+		alert.SetCorrelationID()
+		alert.Normalize()
+		if suppressed(cfg, alert) {
+			continue
+		}
+		report, err := alertDispatcher.Dispatch(cfg, alert)
 		if err != nil {
 			return resp, err
 		}
@@ -148,11 +379,13 @@ func HandleRequest(ctx context.Context, event events.SNSEvent) (ReceptorResponse
 
 	events, err := ParseSnsEvent(event)
 	if err != nil {
+		log.WithFields(lib.ErrorFields(err)).Error("Fail to parse event")
 		return resp, err
 	}
 
 	ids, err := Handler(*cfg, events)
 	if err != nil {
+		log.WithFields(lib.ErrorFields(err)).Error("Fail to handle alerts")
 		return resp, err
 	}
 
@@ -163,5 +396,27 @@ func HandleRequest(ctx context.Context, event events.SNSEvent) (ReceptorResponse
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
-	lambda.Start(HandleRequest)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		log.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	// A broken schema stops the function at cold start instead of rejecting
+	// all alerts.
+	var err error
+	if alertSchema, err = loadAlertSchema(); err != nil {
+		log.WithFields(lib.ErrorFields(err)).Fatal("Fail to load alert schema")
+	}
+
+	switch os.Getenv("RECEPTOR_MODE") {
+	case "replay":
+		lambda.Start(HandleReplay)
+	case "webhook":
+		if webhookSecret, err = loadWebhookSecret(); err != nil {
+			log.WithFields(lib.ErrorFields(err)).Fatal("Fail to load webhook secret")
+		}
+		lambda.Start(HandleWebhook)
+	default:
+		lambda.Start(HandleRequest)
+	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/m-mizutani/AlertResponder/lib"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEventArrivalTimestamp(t *testing.T) {
+	arrival := time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC)
+
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = []byte(`{"name":"test","rule":"r1","key":"k1"}`)
+	record.Kinesis.ApproximateArrivalTimestamp = events.SecondsEpochTime{Time: arrival}
+
+	alerts, err := ParseEvent(events.KinesisEvent{
+		Records: []events.KinesisEventRecord{record},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(alerts))
+	assert.Equal(t, arrival, alerts[0].ReceivedAt)
+
+	report := lib.NewReport(lib.NewReportID(), alerts[0])
+	assert.Equal(t, arrival, report.ReceivedAt)
+}
+
+func TestParseEventSizeLimit(t *testing.T) {
+	orig := lib.MaxAlertSize
+	defer func() { lib.MaxAlertSize = orig }()
+
+	data := []byte(`{"name":"test","rule":"r1","key":"k1"}`)
+	lib.MaxAlertSize = len(data)
+
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = data
+	alerts, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(alerts))
+
+	record.Kinesis.Data = append(data, ' ')
+	_, err = ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.Error(t, err)
+	sizeErr, ok := err.(*lib.SizeLimitError)
+	require.True(t, ok)
+	assert.Equal(t, len(data)+1, sizeErr.Size)
+	assert.Equal(t, len(data), sizeErr.Limit)
+}
+
+func TestParseEventInvalidAlertCode(t *testing.T) {
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = []byte(`{"name":`)
+
+	_, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+
+	var sns events.SNSEventRecord
+	sns.SNS.Message = "not json"
+	_, err = ParseSnsEvent(events.SNSEvent{Records: []events.SNSEventRecord{sns}})
+	assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+}
+
+func TestParseEventNotObject(t *testing.T) {
+	for _, data := range []string{`null`, ` null `, `[]`, `"alert"`, `1`} {
+		var record events.KinesisEventRecord
+		record.Kinesis.Data = []byte(data)
+		_, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+		require.Error(t, err, data)
+		assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+	}
+}
+
+func TestParseEventSchema(t *testing.T) {
+	defer func() { alertSchema = nil }()
+	defer os.Setenv("ALERT_SCHEMA", os.Getenv("ALERT_SCHEMA"))
+
+	os.Setenv("ALERT_SCHEMA", "default")
+	var err error
+	alertSchema, err = loadAlertSchema()
+	require.NoError(t, err)
+
+	var good, bad events.KinesisEventRecord
+	good.Kinesis.Data = []byte(`{"name":"test","rule":"r1","key":"k1"}`)
+	bad.Kinesis.Data = []byte(`{"name":"test","rule":"r1","attrs":[{"type":"ipaddr"}]}`)
+
+	alerts, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{good}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(alerts))
+
+	// Zero values of missing fields are not accepted.
+	_, err = ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{good, bad}})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "Kinesis record 1")
+	assert.Contains(t, err.Error(), "$.key: is required")
+	assert.Contains(t, err.Error(), "$.attrs[0].value: is required")
+
+	var sns events.SNSEventRecord
+	sns.SNS.Message = `{"name":"test","rule":"","key":"k1"}`
+	_, err = ParseSnsEvent(events.SNSEvent{Records: []events.SNSEventRecord{sns}})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "SNS record 0")
+	assert.Contains(t, err.Error(), "$.rule: must be at least 1 characters")
+}
+
+func TestLoadAlertSchema(t *testing.T) {
+	defer os.Setenv("ALERT_SCHEMA", os.Getenv("ALERT_SCHEMA"))
+
+	os.Setenv("ALERT_SCHEMA", "")
+	schema, err := loadAlertSchema()
+	require.NoError(t, err)
+	assert.Nil(t, schema)
+
+	os.Setenv("ALERT_SCHEMA", `{"type":"object","required":["account_id"]}`)
+	schema, err = loadAlertSchema()
+	require.NoError(t, err)
+	require.NotNil(t, schema)
+	assert.Error(t, schema.Validate([]byte(`{"name":"test"}`)))
+
+	os.Setenv("ALERT_SCHEMA", `{"type":"alert"}`)
+	_, err = loadAlertSchema()
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
+
+func TestParseEventUnknownFields(t *testing.T) {
+	defer func(orig bool) { lib.StrictAlertFields = orig }(lib.StrictAlertFields)
+
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = []byte(`{"name":"test","rule":"r1","key":"k1","score":9,"attrs":[{"type":"ipaddr","value":"10.0.0.1","confidence":"high"}]}`)
+
+	// Unknown fields are tolerated with a warning by default.
+	lib.StrictAlertFields = false
+	alerts, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(alerts))
+	assert.Equal(t, "r1", alerts[0].Rule)
+	assert.Equal(t, []string{"Unknown fields are ignored: $.attrs[0].confidence, $.score"}, alerts[0].Warnings)
+
+	lib.StrictAlertFields = true
+	_, err = ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidAlert, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "$.attrs[0].confidence, $.score")
+
+	record.Kinesis.Data = []byte(`{"name":"test","rule":"r1","key":"k1"}`)
+	alerts, err = ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.NoError(t, err)
+	assert.Nil(t, alerts[0].Warnings)
+}
+
+// testCorrelationID is the correlation ID of the record in
+// TestParseEventCorrelationID. Compiler test uses the same value to confirm
+// that the ID is carried through the pipeline.
+const testCorrelationID = "feade4e55ed067c7a63517a2320cddf1"
+
+func TestParseEventCorrelationID(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = []byte(`{"name":"test","rule":"r1","key":"k1"}`)
+	record.Kinesis.ApproximateArrivalTimestamp = events.SecondsEpochTime{
+		Time: time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC),
+	}
+
+	alerts, err := ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(alerts))
+	assert.Equal(t, testCorrelationID, alerts[0].CorrelationID)
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, testCorrelationID, entry.Data[lib.CorrelationKey])
+
+	// The ID is passed to state machines in the report.
+	report := lib.NewReport(lib.NewReportID(), alerts[0])
+	raw, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"correlation_id":"`+testCorrelationID+`"`)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplayRequest is input of the replay handler. Each key is an S3 object that
+// has stored raw records: a Kinesis or SNS event (e.g. a message of DLQ), a
+// raw alert or a dump of invalid alert by lib.Dump. Bucket is DEBUG_BUCKET if
+// empty.
+type ReplayRequest struct {
+	Bucket string   `json:"bucket"`
+	Keys   []string `json:"keys"`
+	DryRun bool     `json:"dry_run"`
+}
+
+// ReplayResult is an outcome of replay of one object. In dry run, Alerts has
+// alerts that would be dispatched and no report is issued.
+type ReplayResult struct {
+	Key       string      `json:"key"`
+	Alerts    []lib.Alert `json:"alerts,omitempty"`
+	ReportIDs []string    `json:"report_ids,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type ReplayResponse struct {
+	DryRun  bool           `json:"dry_run"`
+	Results []ReplayResult `json:"results"`
+}
+
+// replayS3 is S3 client to read stored records. A client of the region is
+// created if nil.
+var replayS3 s3iface.S3API
+
+// ParseStoredRecord extracts alerts from a stored record. Raw alerts without
+// arrival time are regarded as arrived at now.
+func ParseStoredRecord(data []byte, now time.Time) ([]lib.Alert, error) {
+	data = bytes.TrimSpace(data)
+
+	// lib.Dump stores a raw record as JSON string.
+	if len(data) > 0 && data[0] == '"' {
+		var raw string
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, lib.WrapCode(lib.ErrCodeInvalidAlert, err, "Invalid dumped record")
+		}
+		return ParseStoredRecord([]byte(raw), now)
+	}
+
+	var envelope struct {
+		Records []struct {
+			SNSSource     string `json:"EventSource"`
+			KinesisSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, lib.WrapCode(lib.ErrCodeInvalidAlert, err, "Invalid stored record")
+	}
+
+	if len(envelope.Records) > 0 {
+		switch {
+		case envelope.Records[0].SNSSource == "aws:sns":
+			var event events.SNSEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return nil, lib.WrapCode(lib.ErrCodeInvalidAlert, err, "Invalid SNS event")
+			}
+			return ParseSnsEvent(event)
+
+		case envelope.Records[0].KinesisSource == "aws:kinesis":
+			var event events.KinesisEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return nil, lib.WrapCode(lib.ErrCodeInvalidAlert, err, "Invalid Kinesis event")
+			}
+			return ParseEvent(event)
+		}
+	}
+
+	var record events.KinesisEventRecord
+	record.Kinesis.Data = data
+	record.Kinesis.ApproximateArrivalTimestamp = events.SecondsEpochTime{Time: now}
+	return ParseEvent(events.KinesisEvent{Records: []events.KinesisEventRecord{record}})
+}
+
+// Replay re-injects alerts of the stored record through Handler. If dryRun is
+// true, alerts are only parsed and returned without any side effect.
+func Replay(cfg Config, key string, data []byte, dryRun bool) ReplayResult {
+	result := ReplayResult{Key: key}
+	logger := log.WithFields(log.Fields{"key": key, "dry_run": dryRun})
+
+	alerts, err := ParseStoredRecord(data, time.Now().UTC())
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Warn("Fail to parse stored record")
+		result.Error = err.Error()
+		return result
+	}
+
+	if dryRun {
+		for _, alert := range alerts {
+			lib.WithCorrelation(logger, alert.CorrelationID).
+				WithField("rule", alert.Rule).Info("Would replay alert")
+		}
+		result.Alerts = alerts
+		return result
+	}
+
+	ids, err := Handler(cfg, alerts)
+	result.ReportIDs = ids
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to replay alerts")
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func getStoredRecord(client s3iface.S3API, bucket, key string) ([]byte, error) {
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, lib.WrapCode(lib.ErrCodeStoreGet, err, "Fail to get stored record s3://"+bucket+"/"+key)
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// HandleReplay is Lambda handler of replay mode (RECEPTOR_MODE=replay).
+// Failure of an object does not stop replay of others and is reported in the
+// result.
+func HandleReplay(ctx context.Context, req ReplayRequest) (ReplayResponse, error) {
+	log.WithField("request", req).Info("Start replay")
+	resp := ReplayResponse{DryRun: req.DryRun, Results: []ReplayResult{}}
+
+	cfg, err := buildConfig(ctx)
+	if err != nil {
+		return resp, err
+	}
+
+	bucket := req.Bucket
+	if bucket == "" {
+		bucket = lib.DebugBucket
+	}
+	if bucket == "" {
+		return resp, lib.NewConfigError("Bucket of stored records is not specified")
+	}
+
+	client := replayS3
+	if client == nil {
+		ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(cfg.Region)}))
+		client = s3.New(ssn)
+	}
+
+	for _, key := range req.Keys {
+		data, err := getStoredRecord(client, bucket, key)
+		if err != nil {
+			resp.Results = append(resp.Results, ReplayResult{Key: key, Error: err.Error()})
+			continue
+		}
+
+		resp.Results = append(resp.Results, Replay(*cfg, key, data, req.DryRun))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDispatcher struct {
+	alerts []lib.Alert
+}
+
+func (x *mockDispatcher) Dispatch(cfg Config, alert lib.Alert) (*lib.Report, error) {
+	x.alerts = append(x.alerts, alert)
+	report := lib.NewReport(lib.ReportID(fmt.Sprintf("report-%d", len(x.alerts))), alert)
+	return &report, nil
+}
+
+func mockAlertDispatcher() (*mockDispatcher, func()) {
+	orig := alertDispatcher
+	mock := &mockDispatcher{}
+	alertDispatcher = mock
+	return mock, func() { alertDispatcher = orig }
+}
+
+func TestReplayDryRun(t *testing.T) {
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+
+	result := Replay(Config{}, "dump/a.json", []byte(`{"name":"test","rule":"r1","key":"k1"}`), true)
+	assert.Equal(t, "", result.Error)
+	require.Equal(t, 1, len(result.Alerts))
+	assert.Equal(t, "r1", result.Alerts[0].Rule)
+	assert.NotEqual(t, "", result.Alerts[0].CorrelationID)
+	assert.Equal(t, 0, len(result.ReportIDs))
+	assert.Equal(t, 0, len(mock.alerts))
+}
+
+func TestReplayLive(t *testing.T) {
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+
+	result := Replay(Config{}, "dump/a.json", []byte(`{"name":"test","rule":"r1","key":"k1"}`), false)
+	assert.Equal(t, "", result.Error)
+	assert.Equal(t, []string{"report-1"}, result.ReportIDs)
+	assert.Equal(t, 0, len(result.Alerts))
+	require.Equal(t, 1, len(mock.alerts))
+	assert.Equal(t, "k1", mock.alerts[0].Key)
+}
+
+func TestReplayInvalidRecord(t *testing.T) {
+	mock, restore := mockAlertDispatcher()
+	defer restore()
+
+	result := Replay(Config{}, "dump/a.json", []byte(`{"name":`), false)
+	assert.Contains(t, result.Error, "Invalid")
+	assert.Equal(t, 0, len(mock.alerts))
+}
+
+func TestParseStoredRecord(t *testing.T) {
+	now := time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC)
+
+	// SNS event from DLQ keeps the original timestamp.
+	var sns events.SNSEventRecord
+	sns.EventSource = "aws:sns"
+	sns.SNS.Message = `{"name":"test","rule":"r1","key":"k1"}`
+	sns.SNS.Timestamp = now.Add(-time.Hour)
+	raw, err := json.Marshal(events.SNSEvent{Records: []events.SNSEventRecord{sns, sns}})
+	require.NoError(t, err)
+	alerts, err := ParseStoredRecord(raw, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(alerts))
+	assert.Equal(t, now.Add(-time.Hour), alerts[0].ReceivedAt)
+
+	// Kinesis event
+	var kinesis events.KinesisEventRecord
+	kinesis.EventSource = "aws:kinesis"
+	kinesis.Kinesis.Data = []byte(`{"name":"test","rule":"r2","key":"k2"}`)
+	kinesis.Kinesis.ApproximateArrivalTimestamp = events.SecondsEpochTime{Time: now.Add(-time.Minute)}
+	raw, err = json.Marshal(events.KinesisEvent{Records: []events.KinesisEventRecord{kinesis}})
+	require.NoError(t, err)
+	alerts, err = ParseStoredRecord(raw, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(alerts))
+	assert.Equal(t, "r2", alerts[0].Rule)
+	assert.Equal(t, now.Add(-time.Minute), alerts[0].ReceivedAt)
+
+	// Raw record dumped by lib.Dump as JSON string
+	raw, err = json.Marshal(`{"name":"test","rule":"r3","key":"k3"}`)
+	require.NoError(t, err)
+	alerts, err = ParseStoredRecord(raw, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(alerts))
+	assert.Equal(t, "r3", alerts[0].Rule)
+	assert.Equal(t, now, alerts[0].ReceivedAt)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookSecret is a shared secret to verify signatures of webhook requests.
+// It is loaded at cold start in webhook mode.
+var webhookSecret []byte
+
+// webhookSecretValues is a secret of WEBHOOK_SECRET_ARN.
+type webhookSecretValues struct {
+	Secret string `json:"secret"`
+}
+
+// loadWebhookSecret gets the shared secret from WEBHOOK_SECRET_ARN.
+func loadWebhookSecret() ([]byte, error) {
+	arn := os.Getenv("WEBHOOK_SECRET_ARN")
+	if arn == "" {
+		return nil, lib.NewConfigError("WEBHOOK_SECRET_ARN is not set")
+	}
+
+	var values webhookSecretValues
+	if err := lib.GetSecretValues(arn, &values); err != nil {
+		return nil, errors.Wrap(err, "Fail to get webhook secret")
+	}
+	if values.Secret == "" {
+		return nil, lib.NewConfigError("Webhook secret is empty")
+	}
+	return []byte(values.Secret), nil
+}
+
+// signatureHeader returns name of the header that has signature of requests.
+func signatureHeader() string {
+	if name := os.Getenv("WEBHOOK_SIGNATURE_HEADER"); name != "" {
+		return name
+	}
+	return lib.DefaultSignatureHeader
+}
+
+// headerValue looks up a header case-insensitively because API Gateway passes
+// headers as sent by the client.
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func webhookResponse(status int, body interface{}) events.APIGatewayProxyResponse {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		raw = []byte(`{}`)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(raw),
+	}
+}
+
+func webhookError(status int, msg string) events.APIGatewayProxyResponse {
+	return webhookResponse(status, map[string]string{"error": msg})
+}
+
+// HandleWebhook is Lambda handler of alerts sent by HTTP via API Gateway.
+// The signature of the raw body is verified before the body is parsed, and a
+// request with a missing or wrong signature is rejected with 401.
+func HandleWebhook(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return webhookError(http.StatusBadRequest, "Invalid base64 body"), nil
+		}
+		body = decoded
+	}
+
+	if err := lib.VerifySignature(webhookSecret, body, headerValue(req.Headers, signatureHeader())); err != nil {
+		if lib.ErrorCodeOf(err) != lib.ErrCodeInvalidSignature {
+			log.WithFields(lib.ErrorFields(err)).Error("Fail to verify signature")
+			return webhookError(http.StatusInternalServerError, "Internal error"), nil
+		}
+		log.WithFields(lib.ErrorFields(err)).WithField("source_ip", req.RequestContext.Identity.SourceIP).
+			Warn("Reject webhook request")
+		return webhookError(http.StatusUnauthorized, "Invalid signature"), nil
+	}
+
+	if lib.MaxAlertSize > 0 && len(body) > lib.MaxAlertSize {
+		err := lib.NewSizeLimitError("Webhook body", len(body), lib.MaxAlertSize)
+		return webhookError(http.StatusRequestEntityTooLarge, err.Error()), nil
+	}
+
+	cfg, err := buildConfig(ctx)
+	if err != nil {
+		log.WithFields(lib.ErrorFields(err)).Error("Fail to build config")
+		return webhookError(http.StatusInternalServerError, "Internal error"), nil
+	}
+
+	alert, err := parseAlert(body, time.Now())
+	if err != nil {
+		return webhookError(http.StatusBadRequest, "Invalid alert: "+err.Error()), nil
+	}
+
+	ids, err := Handler(*cfg, []lib.Alert{alert})
+	if err != nil {
+		log.WithFields(lib.ErrorFields(err)).Error("Fail to handle alerts")
+		return webhookError(http.StatusInternalServerError, "Internal error"), nil
+	}
+
+	return webhookResponse(http.StatusOK, ReceptorResponse{ReportIDs: ids}), nil
+}
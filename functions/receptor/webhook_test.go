@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/m-mizutani/AlertResponder/lib/harness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testWebhookBody = `{"name":"test","rule":"r1","key":"198.51.100.7"}`
+
+func setupWebhookTest() func() {
+	orig := webhookSecret
+	webhookSecret = []byte("shared-secret")
+	return func() { webhookSecret = orig }
+}
+
+func TestHandleWebhook(t *testing.T) {
+	defer setupWebhookTest()()
+	h := harness.New()
+	defer h.Close()
+
+	req := events.APIGatewayProxyRequest{
+		Body: testWebhookBody,
+		Headers: map[string]string{
+			// Header name is matched case-insensitively.
+			"x-alertresponder-signature": "sha256=" + lib.SignBody(webhookSecret, []byte(testWebhookBody)),
+		},
+	}
+	resp, err := HandleWebhook(h.Context("receptor"), req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body ReceptorResponse
+	require.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	require.Equal(t, 1, len(body.ReportIDs))
+
+	dispatched := h.Executions(harness.DispatchMachine)
+	require.Equal(t, 1, len(dispatched))
+	assert.Equal(t, "r1", dispatched[0].Report.Alert.Rule)
+
+	// Signature is verified over the decoded body.
+	req.IsBase64Encoded = true
+	req.Body = base64.StdEncoding.EncodeToString([]byte(testWebhookBody))
+	resp, err = HandleWebhook(h.Context("receptor"), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHandleWebhookRejectSignature(t *testing.T) {
+	defer setupWebhookTest()()
+	h := harness.New()
+	defer h.Close()
+
+	testCases := []struct {
+		title   string
+		headers map[string]string
+	}{
+		{"missing", nil},
+		{"invalid", map[string]string{
+			lib.DefaultSignatureHeader: lib.SignBody([]byte("other-secret"), []byte(testWebhookBody)),
+		}},
+		{"other header", map[string]string{
+			"X-Hub-Signature-256": lib.SignBody(webhookSecret, []byte(testWebhookBody)),
+		}},
+	}
+
+	for _, tc := range testCases {
+		req := events.APIGatewayProxyRequest{Body: testWebhookBody, Headers: tc.headers}
+		resp, err := HandleWebhook(h.Context("receptor"), req)
+		require.NoError(t, err, tc.title)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, tc.title)
+		assert.Contains(t, resp.Body, "Invalid signature", tc.title)
+	}
+
+	// Rejected requests are never parsed nor dispatched.
+	assert.Equal(t, 0, len(h.Executions(harness.DispatchMachine)))
+	assert.Equal(t, 0, len(h.Messages(harness.ReportNotification)))
+}
+
+func TestHandleWebhookInvalidAlert(t *testing.T) {
+	defer setupWebhookTest()()
+	h := harness.New()
+	defer h.Close()
+
+	body := `[1, 2, 3]`
+	req := events.APIGatewayProxyRequest{
+		Body:    body,
+		Headers: map[string]string{lib.DefaultSignatureHeader: lib.SignBody(webhookSecret, []byte(body))},
+	}
+	resp, err := HandleWebhook(h.Context("receptor"), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 0, len(h.Executions(harness.DispatchMachine)))
+}
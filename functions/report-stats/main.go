@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// defaultStatsWindow is time window of stats if start is not given.
+const defaultStatsWindow = 7 * 24 * time.Hour
+
+// now can be replaced for testing.
+var now = time.Now
+
+type parameters struct {
+	region      string
+	reportTable string
+}
+
+// statsRequest is an event of the handler. Reports of last 7 days are
+// aggregated if From is not set and To is now if not set. Top is size of
+// top-N lists, lib.DefaultStatsTopN if 0.
+type statsRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Top  int       `json:"top"`
+}
+
+func buildParameters(ctx context.Context) (*parameters, error) {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	params := parameters{
+		region:      arn.Region(),
+		reportTable: lib.ResolveTableName(os.Getenv("REPORT_TABLE")),
+	}
+	return &params, nil
+}
+
+// window returns time window of the request with defaults.
+func (x statsRequest) window() (time.Time, time.Time) {
+	to := x.To
+	if to.IsZero() {
+		to = now()
+	}
+	from := x.From
+	if from.IsZero() {
+		from = to.Add(-defaultStatsWindow)
+	}
+	return from, to
+}
+
+func (x statsRequest) top() int {
+	if x.Top <= 0 {
+		return lib.DefaultStatsTopN
+	}
+	return x.Top
+}
+
+// HandleReportStats is Lambda handler that returns stats of reports in the
+// requested time window.
+func HandleReportStats(ctx context.Context, req statsRequest) (lib.ReportStats, error) {
+	params, err := buildParameters(ctx)
+	if err != nil {
+		return lib.ReportStats{}, err
+	}
+
+	from, to := req.window()
+	stats, err := lib.QueryReportStats(params.reportTable, params.region, from, to, req.top())
+	if err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Error("Fail to compute report stats")
+		return lib.ReportStats{}, err
+	}
+
+	logger.WithField("from", from).WithField("to", to).WithField("total", stats.Total).Info("Computed report stats")
+	return stats, nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(HandleReportStats)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	arn, err := lib.NewArnFromContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Fail to extract region from ARN")
+	}
+
+	cfg := lib.SecurityHubConfig{
+		Region:     arn.Region(),
+		AccountID:  arn.AccountID(),
+		ProductArn: os.Getenv("SECURITYHUB_PRODUCT_ARN"),
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Security Hub")
+		if err := lib.PublishSecurityHub(nil, cfg, lib.RedactReport(*report, *rules)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+type serviceNowSecret struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// parseLevels parses mapping of severity and urgency/impact such as
+// "urgent=1/1,unclassified=2/3,safe=3/3".
+func parseLevels(s string) (map[lib.ReportSeverity]lib.ServiceNowLevel, error) {
+	levels := map[lib.ReportSeverity]lib.ServiceNowLevel{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, lib.NewConfigError(fmt.Sprintf("Invalid SERVICENOW_LEVELS: %s", item))
+		}
+		values := strings.SplitN(kv[1], "/", 2)
+		if len(values) != 2 || strings.TrimSpace(values[0]) == "" || strings.TrimSpace(values[1]) == "" {
+			return nil, lib.NewConfigError(fmt.Sprintf("Invalid SERVICENOW_LEVELS: %s", item))
+		}
+		levels[lib.ReportSeverity(strings.TrimSpace(kv[0]))] = lib.ServiceNowLevel{
+			Urgency: strings.TrimSpace(values[0]),
+			Impact:  strings.TrimSpace(values[1]),
+		}
+	}
+	return levels, nil
+}
+
+func buildConfig() (*lib.ServiceNowConfig, error) {
+	cfg := lib.ServiceNowConfig{
+		InstanceURL:     os.Getenv("SERVICENOW_URL"),
+		MinSeverity:     lib.ReportSeverity(os.Getenv("SERVICENOW_MIN_SEVERITY")),
+		AssignmentGroup: os.Getenv("SERVICENOW_ASSIGNMENT_GROUP"),
+		ReportURL:       os.Getenv("REPORT_URL"),
+	}
+
+	levels, err := parseLevels(os.Getenv("SERVICENOW_LEVELS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Levels = levels
+
+	var secret serviceNowSecret
+	if err := lib.GetSecretValues(os.Getenv("SERVICENOW_SECRET_ARN"), &secret); err != nil {
+		return nil, errors.Wrap(err, "Fail to get ServiceNow secret")
+	}
+	cfg.Username = secret.Username
+	cfg.Password = secret.Password
+	cfg.ClientID = secret.ClientID
+	cfg.ClientSecret = secret.ClientSecret
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to ServiceNow")
+		if err := lib.PublishServiceNow(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			logger.WithFields(lib.ErrorFields(err)).Error("Fail to publish report to ServiceNow")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// notificationTemplates are templates of messages loaded at cold start.
+var notificationTemplates *lib.NotificationTemplates
+
+type slackSecret struct {
+	WebhookURL string `json:"webhook_url"`
+	BotToken   string `json:"bot_token"`
+}
+
+func buildConfig() (*lib.SlackConfig, error) {
+	cfg := lib.SlackConfig{
+		WebhookURL: os.Getenv("SLACK_WEBHOOK_URL"),
+		ReportURL:  os.Getenv("REPORT_URL"),
+		Templates:  notificationTemplates,
+		Locale:     os.Getenv("NOTIFICATION_LOCALE"),
+
+		Channel:      os.Getenv("SLACK_CHANNEL"),
+		AttachReport: os.Getenv("SLACK_ATTACH_REPORT"),
+	}
+
+	if !lib.ValidLocale(cfg.Locale) {
+		return nil, lib.NewConfigError("Unknown NOTIFICATION_LOCALE: " + cfg.Locale)
+	}
+
+	if secretArn := os.Getenv("SLACK_SECRET_ARN"); secretArn != "" {
+		var secret slackSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get slack secret")
+		}
+		cfg.WebhookURL = secret.WebhookURL
+		cfg.BotToken = secret.BotToken
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Slack")
+		if err := lib.PublishSlack(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	var err error
+	if notificationTemplates, err = lib.ParseNotificationTemplates(os.Getenv("NOTIFICATION_TEMPLATES")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Fail to load notification templates")
+	}
+
+	lambda.Start(handleRequest)
+}
@@ -13,7 +13,7 @@ import (
 var logger = logrus.New()
 
 func handleRequest(ctx context.Context, page lib.ReportPage) error {
-	tableName := os.Getenv("REPORT_DATA")
+	tableName := lib.ResolveTableName(os.Getenv("REPORT_DATA"))
 	region := os.Getenv("AWS_REGION")
 
 	logger.WithFields(logrus.Fields{
@@ -23,9 +23,16 @@ func handleRequest(ctx context.Context, page lib.ReportPage) error {
 	}).Info("Submitted")
 
 	reportData := lib.NewReportComponent(page.ReportID)
-	reportData.SetPage(page)
+	if err := reportData.SetPage(page); err != nil {
+		return err
+	}
 
 	if err := reportData.Submit(tableName, region); err != nil {
+		// Retrying does not help a runaway inspector, so excess pages are dropped.
+		if errors.Cause(err) == lib.ErrPageLimitExceeded {
+			logger.WithFields(lib.ErrorFields(err)).Warn("Drop page over limit")
+			return nil
+		}
 		return errors.Wrap(err, "Fail to put report data")
 	}
 
@@ -35,5 +42,10 @@ func handleRequest(ctx context.Context, page lib.ReportPage) error {
 func main() {
 	logger.SetLevel(logrus.DebugLevel)
 	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
 	lambda.Start(handleRequest)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// notificationTemplates are templates of messages loaded at cold start.
+var notificationTemplates *lib.NotificationTemplates
+
+type teamsSecret struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+func buildConfig() (*lib.TeamsConfig, error) {
+	cfg := lib.TeamsConfig{
+		WebhookURL: os.Getenv("TEAMS_WEBHOOK_URL"),
+		ReportURL:  os.Getenv("REPORT_URL"),
+		Templates:  notificationTemplates,
+		Locale:     os.Getenv("NOTIFICATION_LOCALE"),
+	}
+
+	if !lib.ValidLocale(cfg.Locale) {
+		return nil, lib.NewConfigError("Unknown NOTIFICATION_LOCALE: " + cfg.Locale)
+	}
+
+	if secretArn := os.Getenv("TEAMS_SECRET_ARN"); secretArn != "" {
+		var secret teamsSecret
+		if err := lib.GetSecretValues(secretArn, &secret); err != nil {
+			return nil, errors.Wrap(err, "Fail to get teams secret")
+		}
+		cfg.WebhookURL = secret.WebhookURL
+	}
+
+	return &cfg, nil
+}
+
+func handleRequest(ctx context.Context, event events.SNSEvent) error {
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	rules, err := lib.ParseRedactionRules(os.Getenv("REDACTION_RULES"))
+	if err != nil {
+		return err
+	}
+
+	for _, record := range event.Records {
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		logger.WithFields(report.LogFields()).Info("Publish report to Teams")
+		if err := lib.PublishTeams(*cfg, lib.RedactReport(*report, *rules)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	if err := lib.CheckEnvInts(); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Invalid environment variable")
+	}
+
+	var err error
+	if notificationTemplates, err = lib.ParseNotificationTemplates(os.Getenv("NOTIFICATION_TEMPLATES")); err != nil {
+		logger.WithFields(lib.ErrorFields(err)).Fatal("Fail to load notification templates")
+	}
+
+	lambda.Start(handleRequest)
+}
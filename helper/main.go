@@ -75,6 +75,138 @@ func makeParameters() {
 		"ReviewerLambdaArn",
 		"InspectionDelay",
 		"ReviewDelay",
+		"StorageRoleArn",
+		"ExpectedAuthors",
+		"ExpectedAuthorsByRule",
+		"MaxInspectionWait",
+		"MergeStrategy",
+		"MergeHistoryCap",
+		"RenderText",
+		"TextMaxSize",
+		"ReportTemplateBucket",
+		"ReportTemplateKey",
+		"PrivateRemoteHosts",
+		"SlackWebhookURL",
+		"SlackSecretArn",
+		"SlackChannel",
+		"SlackAttachReport",
+		"ReportURL",
+		"MaxAlertSize",
+		"AlertSchema",
+		"StrictAlertFields",
+		"NotifyOnDedup",
+		"DedupFallback",
+		"EventBus",
+		"EventSource",
+		"EventDetailType",
+		"WebhookSecretArn",
+		"WebhookSignatureHeader",
+		"MaxPageSize",
+		"MaxPagesPerInspector",
+		"PageBucket",
+		"PageOffloadSize",
+		"ReportTTL",
+		"PublishRoutes",
+		"PublishRoutesBucket",
+		"PublishRoutesKey",
+		"ReportQueueURL",
+		"ReportQueueDeduplication",
+		"ResultStreamName",
+		"ResultStreamGzip",
+		"PagerDutyRoutingKey",
+		"PagerDutySecretArn",
+		"PagerDutyMinSeverity",
+		"DispatchMinSeverity",
+		"AutoCloseRule",
+		"RuleLabels",
+		"RuleNormalization",
+		"SecretCacheTTL",
+		"SeverityOverrides",
+		"ReplicaRegion",
+		"ReplicaReportTable",
+		"ReplicaReportData",
+		"ReplicaPageBucket",
+		"TeamsWebhookURL",
+		"TeamsSecretArn",
+		"EmailSender",
+		"EmailRecipients",
+		"EmailRecipientsUrgent",
+		"EmailRecipientsUnclassified",
+		"EmailRecipientsSafe",
+		"EmailTemplateBucket",
+		"EmailTemplateKey",
+		"JiraURL",
+		"JiraProject",
+		"JiraIssueType",
+		"JiraExternalIDField",
+		"JiraMinSeverity",
+		"JiraPriorities",
+		"JiraLabels",
+		"JiraSecretArn",
+		"GitHubRepo",
+		"GitHubAPIURL",
+		"GitHubToken",
+		"GitHubAppID",
+		"GitHubInstallationID",
+		"GitHubLabels",
+		"GitHubSecretArn",
+		"MISPURL",
+		"MISPApiKey",
+		"MISPSecretArn",
+		"MISPTags",
+		"MISPTLP",
+		"MISPDistribution",
+		"MISPIncludeInternal",
+		"MISPMinSeverity",
+		"OpenSearchEndpoint",
+		"OpenSearchIndex",
+		"OpenSearchSecretArn",
+		"OpenSearchTags",
+		"OpenSearchBulk",
+		"EnableSecurityHub",
+		"SecurityHubProductArn",
+		"OpsgenieSecretArn",
+		"OpsgenieRegion",
+		"OpsgenieResponders",
+		"ServiceNowURL",
+		"ServiceNowSecretArn",
+		"ServiceNowMinSeverity",
+		"ServiceNowLevels",
+		"ServiceNowAssignmentGroup",
+		"DatadogSecretArn",
+		"DatadogSite",
+		"DatadogTags",
+		"ChatworkSecretArn",
+		"ChatworkRoomID",
+		"ChatworkRoomIDUrgent",
+		"ChatworkRoomIDUnclassified",
+		"ChatworkRoomIDSafe",
+		"EnableTracing",
+		"EnableMetrics",
+		"CleanupSchedule",
+		"CleanupLimit",
+		"CleanupWait",
+		"DigestMaxSeverity",
+		"DigestWindow",
+		"DigestSchedule",
+		"PublishIdempotency",
+		"PublishIdempotencyTTL",
+		"AlertSuppression",
+		"TablePrefix",
+		"ReportStore",
+		"DebugBucket",
+		"ArchiveBucket",
+		"ArchiveHTML",
+		"ArchiveObservables",
+		"ObservableAllowDomains",
+		"ReportEnvelope",
+		"MaxMessageSize",
+		"SnsCompressThreshold",
+		"PresignExpiry",
+		"MetricsNamespace",
+		"RedactionRules",
+		"NotificationTemplates",
+		"NotificationLocale",
 	}
 
 	var items []string
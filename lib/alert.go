@@ -1,7 +1,16 @@
 package lib
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Attribute is element of alert
@@ -18,6 +27,10 @@ type TimeRange struct {
 	Last float64 `json:"last"`
 }
 
+// MaxAlertSize is limit of a raw alert record in bytes. Larger records are
+// rejected by Receptor.
+var MaxAlertSize = envInt("MAX_ALERT_SIZE", 1024*1024)
+
 // Alert is extranted data from KinesisStream
 type Alert struct {
 	Name        string `json:"name"`
@@ -25,8 +38,169 @@ type Alert struct {
 	Key         string `json:"key"`
 	Description string `json:"description"`
 
+	// AccountID is an identifier of AWS account (or other tenant) where the
+	// alert is detected. Alerts are grouped per account.
+	AccountID string `json:"account_id,omitempty"`
+
+	// Severity is a hint of the alert source, e.g. "safe" for noisy rules. It
+	// is compared with DispatchMinSeverity and does not decide severity of the
+	// report.
+	Severity ReportSeverity `json:"severity,omitempty"`
+
 	Timestamp TimeRange   `json:"timestamp"`
 	Attrs     []Attribute `json:"attrs"`
+
+	// ReceivedAt is set by Receptor when the alert arrived at the stream.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// CorrelationID identifies the alert in logs of all functions. It is kept
+	// if given by the alert source, otherwise derived by SetCorrelationID.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Warnings are set by Receptor, e.g. fields of the raw alert that are
+	// not known and ignored.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// DispatchMinSeverity is the lowest severity hint of alerts inspected by
+// inspectors, read from DISPATCH_MIN_SEVERITY. All alerts are inspected if it
+// is empty. Unknown value is rejected at cold start by
+// ParseDispatchMinSeverity.
+var DispatchMinSeverity, _ = ParseDispatchMinSeverity(os.Getenv("DISPATCH_MIN_SEVERITY"))
+
+// ParseDispatchMinSeverity parses value of DISPATCH_MIN_SEVERITY. Empty value
+// means no threshold and unknown severity is ConfigError.
+func ParseDispatchMinSeverity(name string) (ReportSeverity, error) {
+	if name == "" {
+		return "", nil
+	}
+	return ParseReportSeverity(name)
+}
+
+// ShouldDispatch returns false if severity hint of the alert is lower than
+// min. Alerts without a known hint are always dispatched.
+func (x *Alert) ShouldDispatch(min ReportSeverity) bool {
+	if min.Level() == 0 || x.Severity.Level() == 0 {
+		return true
+	}
+	return x.Severity.Level() >= min.Level()
+}
+
+// Fingerprint returns a hash of the alert identity and ingestion time. The
+// same record has the same fingerprint even if it is processed again.
+func (x *Alert) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%f\n%d", x.Name, x.Rule, x.Key, x.AccountID,
+		x.Timestamp.Init, x.ReceivedAt.UnixNano())
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// SetCorrelationID sets fingerprint of the alert to CorrelationID if it is
+// empty. It should be called after ReceivedAt is set.
+func (x *Alert) SetCorrelationID() {
+	if x.CorrelationID == "" {
+		x.CorrelationID = x.Fingerprint()
+	}
+}
+
+// RuleNormalization is how Alert.Normalize canonicalizes rule names so that
+// variants such as "Malware_Detected" and "malware-detected" are one rule in
+// AlertMap and routing. The zero value keeps rules as they are.
+type RuleNormalization struct {
+	Lowercase bool
+
+	// Separator replaces runs of spaces, "_", "-" and "." in rules. Leading
+	// and trailing separators are removed. Separators are kept if empty.
+	Separator string
+}
+
+// DefaultRuleNormalization lowercases rules and separates words by "-".
+var DefaultRuleNormalization = RuleNormalization{Lowercase: true, Separator: "-"}
+
+// ParseRuleNormalization parses normalization such as
+// "lowercase,separator=_", e.g. value of RULE_NORMALIZATION environment
+// variable. "default" means DefaultRuleNormalization and empty string means
+// no normalization.
+func ParseRuleNormalization(raw string) (RuleNormalization, error) {
+	var norm RuleNormalization
+	switch raw = strings.TrimSpace(raw); raw {
+	case "":
+		return norm, nil
+	case "default":
+		return DefaultRuleNormalization, nil
+	}
+
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		switch {
+		case kv[0] == "lowercase" && len(kv) == 1:
+			norm.Lowercase = true
+		case kv[0] == "separator" && len(kv) == 2 && len(kv[1]) == 1 && ruleSeparators.MatchString(kv[1]):
+			norm.Separator = kv[1]
+		default:
+			return RuleNormalization{}, NewConfigError(fmt.Sprintf("Invalid rule normalization: %s", item))
+		}
+	}
+	return norm, nil
+}
+
+var ruleSeparators = regexp.MustCompile(`[\s_.-]+`)
+
+// Apply returns the normalized rule.
+func (x RuleNormalization) Apply(rule string) string {
+	if x.Lowercase {
+		rule = strings.ToLower(rule)
+	}
+	if x.Separator != "" {
+		rule = ruleSeparators.ReplaceAllString(strings.TrimSpace(rule), x.Separator)
+		rule = strings.Trim(rule, x.Separator)
+	}
+	return rule
+}
+
+// AlertRuleNormalization is used by Alert.Normalize, read from
+// RULE_NORMALIZATION. Invalid value is regarded as no normalization, and
+// Receptor rejects it at start.
+var AlertRuleNormalization, _ = ParseRuleNormalization(os.Getenv("RULE_NORMALIZATION"))
+
+// Normalize canonicalizes Rule by AlertRuleNormalization. It should be called
+// before the alert is mapped to a report.
+func (x *Alert) Normalize() {
+	x.Rule = NormalizeRule(x.Rule)
+}
+
+// NormalizeRule canonicalizes the rule by AlertRuleNormalization. It is
+// idempotent, so a rule of a normalized alert can be normalized again.
+func NormalizeRule(rule string) string {
+	return AlertRuleNormalization.Apply(rule)
+}
+
+// NormalizeRulePattern canonicalizes a path.Match pattern of rules by
+// AlertRuleNormalization. A pattern with character class or escape is only
+// lowercased because separators in it have special meanings.
+func NormalizeRulePattern(pattern string) string {
+	if !strings.ContainsAny(pattern, `[\`) {
+		return NormalizeRule(pattern)
+	}
+	if AlertRuleNormalization.Lowercase {
+		return strings.ToLower(pattern)
+	}
+	return pattern
+}
+
+// normalizeRulePatterns normalizes keys of patterns. Values of patterns that
+// become the same are merged.
+func normalizeRulePatterns(patterns map[string][]string) map[string][]string {
+	normalized := make(map[string][]string, len(patterns))
+	for pattern, values := range patterns {
+		key := NormalizeRulePattern(pattern)
+		normalized[key] = append(normalized[key], values...)
+	}
+	return normalized
 }
 
 // Title returns string for Github issue title
@@ -70,3 +244,91 @@ func (x *Attribute) Match(context, attrType string) bool {
 
 	return false
 }
+
+// StrictAlertFields rejects alerts that have fields unknown to Alert, read
+// from STRICT_ALERT_FIELDS. Unknown fields are ignored with warnings by
+// default so that alert sources can add fields before Alert supports them.
+var StrictAlertFields = os.Getenv("STRICT_ALERT_FIELDS") == "true"
+
+// UnknownAlertFields returns sorted JSON paths of fields in the raw alert that
+// Alert does not have, e.g. "$.attrs[0].score". Names are matched case
+// insensitively as encoding/json does.
+func UnknownAlertFields(data []byte) ([]string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal alert")
+	}
+
+	var unknown []string
+	findUnknownFields("$", v, reflect.TypeOf(Alert{}), &unknown)
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+func findUnknownFields(path string, v interface{}, t reflect.Type, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Custom decoders such as time.Time accept their own format.
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range obj {
+			field, ok := jsonField(t, key)
+			if !ok {
+				*unknown = append(*unknown, path+"."+key)
+				continue
+			}
+			findUnknownFields(path+"."+key, value, field.Type, unknown)
+		}
+
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range list {
+			findUnknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), unknown)
+		}
+
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range obj {
+			findUnknownFields(path+"."+key, value, t.Elem(), unknown)
+		}
+	}
+}
+
+// jsonField returns the exported field of struct t decoded from JSON key.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
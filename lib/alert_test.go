@@ -2,9 +2,11 @@ package lib_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/m-mizutani/AlertResponder/lib"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAttrMatch(t *testing.T) {
@@ -42,3 +44,184 @@ func TestAddAttribute(t *testing.T) {
 	assert.Equal(t, 3, len(alert.Attrs))
 	assert.Equal(t, "value2", alert.Attrs[2].Value)
 }
+
+func TestAlertCorrelationID(t *testing.T) {
+	received := time.Date(2019, 1, 28, 3, 4, 5, 0, time.UTC)
+	alert := lib.Alert{Name: "test", Rule: "r1", Key: "k1", ReceivedAt: received}
+
+	alert.SetCorrelationID()
+	assert.Equal(t, 32, len(alert.CorrelationID))
+	assert.Equal(t, alert.Fingerprint(), alert.CorrelationID)
+
+	// Same alert record gets same ID, and another ingestion gets another one.
+	same := lib.Alert{Name: "test", Rule: "r1", Key: "k1", ReceivedAt: received}
+	assert.Equal(t, alert.Fingerprint(), same.Fingerprint())
+	same.ReceivedAt = received.Add(time.Second)
+	assert.NotEqual(t, alert.Fingerprint(), same.Fingerprint())
+
+	// ID given by the alert source is kept.
+	given := lib.Alert{Rule: "r1", CorrelationID: "upstream-id"}
+	given.SetCorrelationID()
+	assert.Equal(t, "upstream-id", given.CorrelationID)
+
+	report := lib.NewReport(lib.NewReportID(), alert)
+	assert.Equal(t, alert.CorrelationID, report.CorrelationID)
+	assert.Equal(t, alert.CorrelationID, report.LogFields()[lib.CorrelationKey])
+}
+
+func TestAlertShouldDispatch(t *testing.T) {
+	testCases := []struct {
+		sev      lib.ReportSeverity
+		min      lib.ReportSeverity
+		expected bool
+	}{
+		{lib.SevSafe, lib.SevUnclassified, false},
+		{lib.SevUnclassified, lib.SevUnclassified, true},
+		{lib.SevUrgent, lib.SevUnclassified, true},
+		{lib.SevUnclassified, lib.SevUrgent, false},
+		{"", lib.SevUrgent, true},     // No hint
+		{"high", lib.SevUrgent, true}, // Unknown hint
+		{lib.SevSafe, "", true},       // No threshold
+	}
+
+	for _, tc := range testCases {
+		alert := lib.Alert{Rule: "r1", Severity: tc.sev}
+		assert.Equal(t, tc.expected, alert.ShouldDispatch(tc.min), "%s >= %s", tc.sev, tc.min)
+	}
+}
+
+func TestParseDispatchMinSeverity(t *testing.T) {
+	for raw, expected := range map[string]lib.ReportSeverity{
+		"":         "",
+		"safe":     lib.SevSafe,
+		" Urgent ": lib.SevUrgent,
+	} {
+		sev, err := lib.ParseDispatchMinSeverity(raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, expected, sev, raw)
+	}
+
+	_, err := lib.ParseDispatchMinSeverity("critical")
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
+
+func TestUnknownAlertFields(t *testing.T) {
+	unknown, err := lib.UnknownAlertFields([]byte(`{
+		"Name": "test", "rule": "r1", "key": "k1",
+		"received_at": "2019-01-28T03:04:05Z",
+		"timestamp": {"init": 1, "zone": "UTC"},
+		"attrs": [{"type": "ipaddr", "value": "10.0.0.1"}, {"type": "domain", "tags": ["c2"]}],
+		"detector": {"version": 2}
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$.attrs[1].tags", "$.detector", "$.timestamp.zone"}, unknown)
+
+	unknown, err = lib.UnknownAlertFields([]byte(`{"name": "test"}`))
+	require.NoError(t, err)
+	assert.Empty(t, unknown)
+
+	_, err = lib.UnknownAlertFields([]byte(`{"name":`))
+	assert.Error(t, err)
+}
+
+func TestAlertNormalize(t *testing.T) {
+	orig := lib.AlertRuleNormalization
+	defer func() { lib.AlertRuleNormalization = orig }()
+	lib.AlertRuleNormalization = lib.DefaultRuleNormalization
+
+	for _, rule := range []string{
+		"Malware_Detected",
+		"malware-detected",
+		"Malware Detected",
+		" MALWARE.detected ",
+		"malware__-detected",
+	} {
+		alert := lib.Alert{Rule: rule}
+		alert.Normalize()
+		assert.Equal(t, "malware-detected", alert.Rule, rule)
+	}
+
+	// Rules are kept without normalization.
+	lib.AlertRuleNormalization = lib.RuleNormalization{}
+	alert := lib.Alert{Rule: "Malware_Detected"}
+	alert.Normalize()
+	assert.Equal(t, "Malware_Detected", alert.Rule)
+}
+
+func TestParseRuleNormalization(t *testing.T) {
+	norm, err := lib.ParseRuleNormalization("")
+	require.NoError(t, err)
+	assert.Equal(t, lib.RuleNormalization{}, norm)
+
+	norm, err = lib.ParseRuleNormalization("default")
+	require.NoError(t, err)
+	assert.Equal(t, lib.DefaultRuleNormalization, norm)
+
+	norm, err = lib.ParseRuleNormalization("lowercase, separator=_")
+	require.NoError(t, err)
+	assert.Equal(t, "malware_detected", norm.Apply("Malware Detected"))
+
+	norm, err = lib.ParseRuleNormalization("separator=.")
+	require.NoError(t, err)
+	assert.Equal(t, "Malware.Detected", norm.Apply("Malware_Detected"))
+
+	for _, raw := range []string{"upper", "separator=", "separator=/", "separator=--", "lowercase=true"} {
+		_, err := lib.ParseRuleNormalization(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestRuleNormalizationEndToEnd(t *testing.T) {
+	orig := lib.AlertRuleNormalization
+	defer func() { lib.AlertRuleNormalization = orig }()
+	lib.AlertRuleNormalization = lib.DefaultRuleNormalization
+
+	// Configuration is written with other variants of the rule.
+	routes, err := lib.ParsePublishRoutes(`{"routes": [{"name": "malware", "rules": ["Malware_*"], "actions": ["slack"]}], "default": ["sns"]}`)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.NoError(t, err)
+	overrides, err := lib.ParseSeverityOverrides(`[{"name": "force", "rules": ["MALWARE DETECTED"], "severity": "safe"}]`)
+	require.NoError(t, err)
+	labels, err := lib.ParseRuleLabels(`{"malware.*": ["malware"], "Malware_Detected": ["detected"]}`)
+	require.NoError(t, err)
+	authors, err := lib.ParseRuleAuthors(`{"MALWARE-*": ["sandbox"], "malware_detected": ["virustotal"]}`)
+	require.NoError(t, err)
+
+	alert := lib.Alert{Rule: "Malware Detected", Key: "k1"}
+	alert.Normalize()
+	require.Equal(t, "malware-detected", alert.Rule)
+	report := lib.NewReport("r1", alert)
+	report.Result.Severity = lib.SevUrgent
+
+	name, actions := router.Route(report)
+	assert.Equal(t, "malware", name)
+	assert.Equal(t, []string{"slack"}, actions)
+	require.NotNil(t, overrides.Apply(&report))
+	assert.Equal(t, lib.SevSafe, report.Result.Severity)
+	labels.Seed(&report)
+	assert.Equal(t, []string{"malware", "detected"}, report.Labels)
+	assert.Equal(t, []string{"sandbox", "virustotal"}, authors.Expect("Malware_Detected"))
+
+	// Keys of alert map and suppressions are the same for all variants.
+	key := lib.GenAlertKey("k1", "malware-detected", "")
+	assert.Equal(t, key, lib.GenAlertKey("k1", "Malware_Detected", ""))
+
+	table := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	defer mockSuppressionTables(table)()
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+	require.NoError(t, store.MarkFalsePositive("k1", "MALWARE_DETECTED"))
+	suppressed, err := store.IsSuppressed("k1", alert.Rule)
+	require.NoError(t, err)
+	assert.True(t, suppressed)
+	assert.Equal(t, "malware-detected", table.items[key].Rule)
+
+	require.NoError(t, store.AddSuppression("k1", "Malware.Detected", "scanner", 0))
+	suppressed, err = store.IsSuppressed("k1", alert.Rule)
+	require.NoError(t, err)
+	assert.True(t, suppressed)
+}
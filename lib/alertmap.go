@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// AlertMapName is name of the table mapping alert keys to reports.
+var AlertMapName = ResolveTableName(os.Getenv("ALERT_MAP"))
+
+// ErrReportNotFound is returned when no report is stored for the ID or no
+// active report is mapped to the alert key.
+var ErrReportNotFound = errors.New("Report is not found")
+
+// AlertRecord is an item of alert map. Alerts with same AlertID are grouped
+// into ReportID until TTL.
+type AlertRecord struct {
+	AlertID   string    `dynamo:"alert_id"`
+	AlertKey  string    `dynamo:"alert_key"`
+	Rule      string    `dynamo:"rule"`
+	AccountID string    `dynamo:"account_id"`
+	ReportID  ReportID  `dynamo:"report_id"`
+	AlertData []byte    `dynamo:"alert_data"`
+	Timestamp time.Time `dynamo:"timestamp"`
+	TTL       time.Time `dynamo:"ttl"`
+
+	// Occurrences is number of alerts grouped into ReportID.
+	Occurrences int `dynamo:"occurrences"`
+}
+
+// GenAlertKey generates an ID to group alerts. Alerts in different accounts
+// are never grouped even if key and rule are same. The rule is normalized by
+// NormalizeRule, so variants of a rule have the same ID.
+func GenAlertKey(alertID, rule, accountID string) string {
+	data := fmt.Sprintf("%s=====%s", alertID, NormalizeRule(rule))
+	if accountID != "" {
+		data = fmt.Sprintf("%s=====%s", data, accountID)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+// AlertMapTable is a table of alert map. GetAlertRecords returns records
+// including expired ones that are not deleted yet.
+type AlertMapTable interface {
+	GetAlertRecords(alertID string) ([]AlertRecord, error)
+	PutAlertRecord(record *AlertRecord) error
+}
+
+type dynamoAlertMap struct {
+	region    string
+	tableName string
+}
+
+func (x *dynamoAlertMap) GetAlertRecords(alertID string) ([]AlertRecord, error) {
+	if x.tableName == "" {
+		return nil, NewConfigError("Alert map is not configured")
+	}
+
+	var records []AlertRecord
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Get("alert_id", alertID).All(&records); err != nil {
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to get alert map from %s in %s", x.tableName, x.region))
+	}
+	return records, nil
+}
+
+func (x *dynamoAlertMap) PutAlertRecord(record *AlertRecord) error {
+	if x.tableName == "" {
+		return NewConfigError("Alert map is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Put(record).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put alert map to %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+// OpenAlertMap returns AlertMapTable of DynamoDB. It can be replaced for
+// testing.
+var OpenAlertMap = func(region, tableName string) AlertMapTable {
+	return &dynamoAlertMap{region: region, tableName: tableName}
+}
+
+// ReportCreator writes a mapping of a new report and the initial report item
+// together. Neither is stored if it fails.
+type ReportCreator interface {
+	CreateReport(mapping *AlertRecord, report *ReportRecord) error
+}
+
+type dynamoReportCreator struct {
+	region      string
+	alertMap    string
+	reportTable string
+}
+
+func (x *dynamoReportCreator) CreateReport(mapping *AlertRecord, report *ReportRecord) error {
+	if x.alertMap == "" || x.reportTable == "" {
+		return NewConfigError("Alert map or report table is not configured")
+	}
+	return CreateReportTx(NewStorageDB(x.region).Client(), x.alertMap, x.reportTable, mapping, report)
+}
+
+// OpenReportCreator returns ReportCreator of DynamoDB. It can be replaced for
+// testing.
+var OpenReportCreator = func(region, alertMap, reportTable string) ReportCreator {
+	return &dynamoReportCreator{region: region, alertMap: alertMap, reportTable: reportTable}
+}
+
+// CreateReportTx puts the alert mapping and the initial report item in one
+// TransactWriteItems call, so that a mapping never points at a nonexistent
+// report. The report item must not exist yet.
+func CreateReportTx(client dynamodbiface.DynamoDBAPI, alertMap, reportTable string, mapping *AlertRecord, report *ReportRecord) (err error) {
+	span := StartTrace("CreateReportTx")
+	defer func() { span.End(err) }()
+
+	mappingItem, err := dynamo.MarshalItem(mapping)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal alert record")
+	}
+	reportItem, err := dynamo.MarshalItem(report)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal report record")
+	}
+
+	_, err = client.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				TableName: aws.String(alertMap),
+				Item:      mappingItem,
+			}},
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(reportTable),
+				Item:                reportItem,
+				ConditionExpression: aws.String("attribute_not_exists(report_id)"),
+			}},
+		},
+	})
+	if err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to create report %s with alert map", report.ReportID))
+	}
+	return nil
+}
+
+// LatestReportForKey returns the compiled report that alerts of key and rule
+// are currently grouped into. A mapping is active until its TTL, i.e. within
+// the dedup window of receptor. Only alerts without account ID can be looked
+// up. ErrReportNotFound is returned if no mapping is active or the report is
+// not compiled yet.
+func LatestReportForKey(tableName, region, key, rule string) (report *Report, err error) {
+	span := StartTrace("LatestReportForKey")
+	defer func() { span.End(err) }()
+
+	records, err := OpenAlertMap(region, AlertMapName).GetAlertRecords(GenAlertKey(key, rule, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var active *AlertRecord
+	for i := range records {
+		if !records[i].TTL.After(now) {
+			continue
+		}
+		if active == nil || records[i].Timestamp.After(active.Timestamp) {
+			active = &records[i]
+		}
+	}
+	if active == nil {
+		return nil, ErrReportNotFound
+	}
+
+	record, err := OpenReportTable(region, tableName, "").GetReport(active.ReportID)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Report()
+}
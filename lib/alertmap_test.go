@@ -0,0 +1,193 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAlertMap struct {
+	records []lib.AlertRecord
+}
+
+func (x *mockAlertMap) GetAlertRecords(alertID string) ([]lib.AlertRecord, error) {
+	var records []lib.AlertRecord
+	for _, r := range x.records {
+		if r.AlertID == alertID {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (x *mockAlertMap) PutAlertRecord(record *lib.AlertRecord) error {
+	x.records = append(x.records, *record)
+	return nil
+}
+
+func mockAlertMapTable(alertMap *mockAlertMap) func() {
+	orig := lib.OpenAlertMap
+	lib.OpenAlertMap = func(region, tableName string) lib.AlertMapTable {
+		return alertMap
+	}
+	return func() { lib.OpenAlertMap = orig }
+}
+
+func TestGenAlertKeyAccountIsolation(t *testing.T) {
+	k1 := lib.GenAlertKey("10.0.0.1", "rule1", "111111111111")
+	k2 := lib.GenAlertKey("10.0.0.1", "rule1", "222222222222")
+	assert.NotEqual(t, k1, k2)
+	assert.Equal(t, k1, lib.GenAlertKey("10.0.0.1", "rule1", "111111111111"))
+
+	// Without account, the key must be compatible with existing records,
+	// i.e. SHA-256 of "10.0.0.1=====rule1".
+	assert.Equal(t, "b1c83894eada14667873b635d7be5ed88878ec4c32bdb7901d7c4b6f50cf280f", lib.GenAlertKey("10.0.0.1", "rule1", ""))
+	assert.NotEqual(t, k1, lib.GenAlertKey("10.0.0.1", "rule1", ""))
+	assert.NotEqual(t, k1, lib.GenAlertKey("10.0.0.1", "rule2", "111111111111"))
+}
+
+func alertMapFixture(t *testing.T, ttl time.Time) (*mockAlertMap, *mockReportTable, lib.Report) {
+	report := loadFixtureReport(t)
+	record, err := lib.NewReportRecord(report, "us-east-1")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	alertMap := &mockAlertMap{records: []lib.AlertRecord{
+		{
+			AlertID:   lib.GenAlertKey("198.51.100.7", "rule1", ""),
+			AlertKey:  "198.51.100.7",
+			Rule:      "rule1",
+			ReportID:  report.ID,
+			Timestamp: now,
+			TTL:       ttl,
+		},
+	}}
+	return alertMap, &mockReportTable{reports: []*lib.ReportRecord{record}}, report
+}
+
+func TestLatestReportForKey(t *testing.T) {
+	alertMap, table, report := alertMapFixture(t, time.Now().UTC().Add(time.Hour))
+	defer mockAlertMapTable(alertMap)()
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	found, err := lib.LatestReportForKey("reports", "us-east-1", "198.51.100.7", "rule1")
+	require.NoError(t, err)
+	assert.Equal(t, report.ID, found.ID)
+	assert.Equal(t, report.Result.Severity, found.Result.Severity)
+
+	// Other rule is not mapped.
+	_, err = lib.LatestReportForKey("reports", "us-east-1", "198.51.100.7", "rule2")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+
+	// Mapped, but not compiled yet.
+	table.reports = nil
+	_, err = lib.LatestReportForKey("reports", "us-east-1", "198.51.100.7", "rule1")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+}
+
+func TestLatestReportForKeyExpired(t *testing.T) {
+	alertMap, table, _ := alertMapFixture(t, time.Now().UTC().Add(-time.Second))
+	defer mockAlertMapTable(alertMap)()
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	_, err := lib.LatestReportForKey("reports", "us-east-1", "198.51.100.7", "rule1")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+}
+
+// mockTxDynamoDB applies TransactWriteItems to in-memory tables all or
+// nothing. Put of the report table is canceled if the report exists.
+type mockTxDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	tables map[string][]map[string]*dynamodb.AttributeValue
+	fail   bool
+}
+
+func (x *mockTxDynamoDB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if x.fail {
+		return nil, awserr.New("InternalServerError", "simulated failure", nil)
+	}
+
+	for _, item := range input.TransactItems {
+		if aws.StringValue(item.Put.ConditionExpression) == "" {
+			continue
+		}
+		for _, stored := range x.tables[aws.StringValue(item.Put.TableName)] {
+			if aws.StringValue(stored["report_id"].S) == aws.StringValue(item.Put.Item["report_id"].S) {
+				return nil, awserr.New("TransactionCanceledException", "Transaction cancelled", nil)
+			}
+		}
+	}
+
+	if x.tables == nil {
+		x.tables = map[string][]map[string]*dynamodb.AttributeValue{}
+	}
+	for _, item := range input.TransactItems {
+		name := aws.StringValue(item.Put.TableName)
+		x.tables[name] = append(x.tables[name], item.Put.Item)
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func txFixture(t *testing.T) (*lib.AlertRecord, *lib.ReportRecord) {
+	report := lib.NewReport(lib.NewReportID(), lib.Alert{Name: "test", Rule: "r1", Key: "k1"})
+	report.Status = lib.StatusNew
+	mapping := &lib.AlertRecord{
+		AlertID:   lib.GenAlertKey("k1", "r1", ""),
+		AlertKey:  "k1",
+		Rule:      "r1",
+		ReportID:  report.ID,
+		Timestamp: time.Now().UTC(),
+	}
+	record, err := lib.NewReportRecord(report, "ap-northeast-1")
+	require.NoError(t, err)
+	return mapping, record
+}
+
+func TestCreateReportTx(t *testing.T) {
+	client := &mockTxDynamoDB{}
+	mapping, record := txFixture(t)
+
+	require.NoError(t, lib.CreateReportTx(client, "alert-map", "report-table", mapping, record))
+	require.Equal(t, 1, len(client.tables["alert-map"]))
+	require.Equal(t, 1, len(client.tables["report-table"]))
+
+	var storedMapping lib.AlertRecord
+	require.NoError(t, dynamo.UnmarshalItem(client.tables["alert-map"][0], &storedMapping))
+	var storedReport lib.ReportRecord
+	require.NoError(t, dynamo.UnmarshalItem(client.tables["report-table"][0], &storedReport))
+	assert.Equal(t, storedReport.ReportID, storedMapping.ReportID)
+	assert.Equal(t, mapping.AlertID, storedMapping.AlertID)
+
+	var report lib.Report
+	require.NoError(t, json.Unmarshal(storedReport.Data, &report))
+	assert.True(t, report.IsNew())
+}
+
+func TestCreateReportTxFailure(t *testing.T) {
+	client := &mockTxDynamoDB{fail: true}
+	mapping, record := txFixture(t)
+
+	err := lib.CreateReportTx(client, "alert-map", "report-table", mapping, record)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeStorePut, lib.ErrorCodeOf(err))
+	assert.Equal(t, 0, len(client.tables["alert-map"]))
+	assert.Equal(t, 0, len(client.tables["report-table"]))
+
+	// Existing report cancels the transaction and the mapping is not stored.
+	client.fail = false
+	require.NoError(t, lib.CreateReportTx(client, "alert-map", "report-table", mapping, record))
+	other := *mapping
+	other.AlertID = lib.GenAlertKey("k2", "r1", "")
+	require.Error(t, lib.CreateReportTx(client, "alert-map", "report-table", &other, record))
+	assert.Equal(t, 1, len(client.tables["alert-map"]))
+	assert.Equal(t, 1, len(client.tables["report-table"]))
+}
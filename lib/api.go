@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// APISchemaVersion is version of APIResponse. It is changed when fields of
+// the envelope or the report are changed incompatibly.
+const APISchemaVersion = "1"
+
+// APIResponse is an envelope of a report served over HTTP. Content is the
+// serialized report and ContentHash is SHA256 of it, so that it can be used
+// as ETag.
+type APIResponse struct {
+	ReportID      ReportID        `json:"report_id"`
+	Status        ReportStatus    `json:"status"`
+	GeneratedAt   time.Time       `json:"generated_at"`
+	SchemaVersion string          `json:"schema_version"`
+	ContentHash   string          `json:"content_hash"`
+	Content       json.RawMessage `json:"content"`
+}
+
+// ETag returns ContentHash as a strong entity tag of HTTP. It does not depend
+// on GeneratedAt, so the same report has the same tag.
+func (x *APIResponse) ETag() string {
+	return `"` + x.ContentHash + `"`
+}
+
+// ToAPIResponse wraps the report in APIResponse generated now.
+func ToAPIResponse(report Report) (*APIResponse, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report for API response")
+	}
+
+	return &APIResponse{
+		ReportID:      report.ID,
+		Status:        report.Status,
+		GeneratedAt:   time.Now().UTC(),
+		SchemaVersion: APISchemaVersion,
+		ContentHash:   contentHash(data),
+		Content:       data,
+	}, nil
+}
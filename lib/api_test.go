@@ -0,0 +1,50 @@
+package lib_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToAPIResponse(t *testing.T) {
+	report := loadFixtureReport(t)
+	resp, err := lib.ToAPIResponse(report)
+	require.NoError(t, err)
+
+	assert.Equal(t, report.ID, resp.ReportID)
+	assert.Equal(t, report.Status, resp.Status)
+	assert.Equal(t, lib.APISchemaVersion, resp.SchemaVersion)
+	assert.WithinDuration(t, time.Now(), resp.GeneratedAt, time.Minute)
+
+	sum := sha256.Sum256(resp.Content)
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.ContentHash)
+	assert.Equal(t, `"`+resp.ContentHash+`"`, resp.ETag())
+
+	// Embedded content is the report itself.
+	expected, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(resp.Content))
+
+	raw, err := json.Marshal(resp)
+	require.NoError(t, err)
+	var envelope map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(raw, &envelope))
+	for _, key := range []string{"report_id", "status", "generated_at", "schema_version", "content_hash", "content"} {
+		assert.Contains(t, envelope, key)
+	}
+
+	// Hash is stable for the same report and changes with content.
+	again, err := lib.ToAPIResponse(report)
+	require.NoError(t, err)
+	assert.Equal(t, resp.ETag(), again.ETag())
+	report.Result.Reason = "changed"
+	changed, err := lib.ToAPIResponse(report)
+	require.NoError(t, err)
+	assert.NotEqual(t, resp.ContentHash, changed.ContentHash)
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+var (
+	// ArchiveBucket is S3 bucket to archive compiled reports. Archiving is
+	// disabled if it is empty.
+	ArchiveBucket = os.Getenv("ARCHIVE_BUCKET")
+
+	// ArchiveHTML enables writing report.html next to report.json.
+	ArchiveHTML = os.Getenv("ARCHIVE_HTML") == "true"
+
+	// ArchiveObservables enables writing observables.csv next to report.json.
+	ArchiveObservables = os.Getenv("ARCHIVE_OBSERVABLES") == "true"
+)
+
+// ArchiveKey returns S3 key of the archived report file, e.g. "report.json".
+func ArchiveKey(reportID ReportID, name string) string {
+	return fmt.Sprintf("reports/%s/%s", reportID, name)
+}
+
+func putArchive(client s3iface.S3API, bucket, key, contentType string, data []byte) error {
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return WrapCode(ErrCodeStorePut, err, fmt.Sprintf("Fail to archive s3://%s/%s", bucket, key))
+	}
+	return nil
+}
+
+// ArchiveReport writes the report as JSON to the bucket. If withHTML is true,
+// HTML rendering by RenderHTML is also written to the same directory. Keys of
+// written objects are returned. A client of AWS_REGION is created if client is
+// nil.
+func ArchiveReport(client s3iface.S3API, bucket string, report Report, withHTML bool) (keys []string, err error) {
+	span := StartTrace("ArchiveReport")
+	defer func() { span.End(err) }()
+
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report for archive")
+	}
+
+	key := ArchiveKey(report.ID, "report.json")
+	if err = putArchive(client, bucket, key, "application/json", data); err != nil {
+		return nil, err
+	}
+	keys = append(keys, key)
+
+	if withHTML {
+		html, err := RenderHTML(report)
+		if err != nil {
+			return keys, err
+		}
+
+		key := ArchiveKey(report.ID, "report.html")
+		if err := putArchive(client, bucket, key, "text/html; charset=UTF-8", []byte(html)); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ArchiveObservablesCSV writes observables of the report by ObservablesCSV to
+// the same directory as ArchiveReport. Key of the written object is returned.
+// A client of AWS_REGION is created if client is nil.
+func ArchiveObservablesCSV(client s3iface.S3API, bucket string, report Report, opts CSVOptions) (string, error) {
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ObservablesCSV(report, buf, opts); err != nil {
+		return "", err
+	}
+
+	key := ArchiveKey(report.ID, "observables.csv")
+	if err := putArchive(client, bucket, key, "text/csv; charset=UTF-8", buf.Bytes()); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ExportS3 is S3 client used by ExportReports. A client of the region is
+// created if nil.
+var ExportS3 s3iface.S3API
+
+// exportWindow is length of a query by ExportReports. The range is queried by
+// windows so that only reports in a window are in memory at once.
+const exportWindow = 24 * time.Hour
+
+// ExportReports writes reports received between from and to into the bucket
+// as "<prefix>/<report ID>.json". Reports are queried by received time on
+// severity index of the report table, and reports stored without severity
+// are exported as well. Number of exported reports is returned and it is
+// also returned with an error for reports exported before failure.
+func ExportReports(tableName, region string, from, to time.Time, bucket, prefix string) (count int, err error) {
+	span := StartTrace("ExportReports")
+	defer func() { span.End(err) }()
+
+	if bucket == "" {
+		return 0, NewConfigError("Bucket to export reports is not configured")
+	}
+	if to.Before(from) {
+		return 0, NewConfigError("End of range is before start")
+	}
+
+	client := ExportS3
+	if client == nil {
+		client = s3.New(newSession(region))
+	}
+	table := OpenReportTable(region, tableName, "")
+
+	// Both ends of a query are inclusive, so the next window starts just
+	// after the end of the previous window.
+	for start := from; !start.After(to); {
+		end := start.Add(exportWindow - time.Nanosecond)
+		if end.After(to) {
+			end = to
+		}
+
+		for _, sev := range severityOrder {
+			n, err := exportRecords(client, table, sev, start, end, bucket, prefix)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+
+		start = end.Add(time.Nanosecond)
+	}
+
+	// Reports stored without severity are not in the index and are found by
+	// a scan, so they are queried once for the whole range.
+	n, err := exportRecords(client, table, "", from, to, bucket, prefix)
+	count += n
+	if err != nil {
+		return count, err
+	}
+
+	Logger.WithFields(map[string]interface{}{
+		"from": from, "to": to, "bucket": bucket, "prefix": prefix, "count": count,
+	}).Info("Exported reports")
+	return count, nil
+}
+
+// exportRecords writes reports of the severity received between from and to.
+// Number of exported reports is returned.
+func exportRecords(client s3iface.S3API, table ReportTable, severity ReportSeverity, from, to time.Time, bucket, prefix string) (int, error) {
+	records, err := table.QueryReports(severity, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, record := range records {
+		key := path.Join(prefix, string(record.ReportID)+".json")
+		if err := putArchive(client, bucket, key, "application/json", record.Data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,125 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exportFixture(t *testing.T, base time.Time) *mockReportTable {
+	table := &mockReportTable{}
+	for _, r := range []struct {
+		id       lib.ReportID
+		severity lib.ReportSeverity
+		offset   time.Duration
+	}{
+		{"r1", lib.SevUrgent, time.Hour},
+		// Just at the boundary of the first and second windows.
+		{"r2", lib.SevSafe, 24 * time.Hour},
+		{"r3", lib.SevUnclassified, 50 * time.Hour},
+		{"r4", lib.SevUrgent, 100 * time.Hour},
+	} {
+		report := lib.Report{ID: r.id, ReceivedAt: base.Add(r.offset)}
+		report.Result.Severity = r.severity
+		record, err := lib.NewReportRecord(report, "us-east-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+	return table
+}
+
+func TestExportReports(t *testing.T) {
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": exportFixture(t, base)})()
+
+	storage := &mockS3{}
+	lib.ExportS3 = storage
+	defer func() { lib.ExportS3 = nil }()
+
+	count, err := lib.ExportReports("reports", "us-east-1", base, base.Add(72*time.Hour), "audit", "2019/01")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	require.Equal(t, 3, len(storage.puts))
+
+	var keys []string
+	for _, put := range storage.puts {
+		keys = append(keys, aws.StringValue(put.Key))
+	}
+	assert.ElementsMatch(t, []string{"2019/01/r1.json", "2019/01/r2.json", "2019/01/r3.json"}, keys)
+
+	var report lib.Report
+	require.NoError(t, json.Unmarshal([]byte(storage.objects["audit/2019/01/r3.json"]), &report))
+	assert.Equal(t, lib.ReportID("r3"), report.ID)
+	assert.Equal(t, lib.SevUnclassified, report.Result.Severity)
+}
+
+func TestExportReportsEmptyRange(t *testing.T) {
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": exportFixture(t, base)})()
+
+	storage := &mockS3{}
+	lib.ExportS3 = storage
+	defer func() { lib.ExportS3 = nil }()
+
+	from := base.Add(200 * time.Hour)
+	count, err := lib.ExportReports("reports", "us-east-1", from, from.Add(48*time.Hour), "audit", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	count, err = lib.ExportReports("reports", "us-east-1", from, from, "audit", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Empty(t, storage.puts)
+
+	_, err = lib.ExportReports("reports", "us-east-1", from, base, "audit", "")
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+func TestExportReportsQueryFailure(t *testing.T) {
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	table := exportFixture(t, base)
+	table.fail = true
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	lib.ExportS3 = &mockS3{}
+	defer func() { lib.ExportS3 = nil }()
+
+	count, err := lib.ExportReports("reports", "us-east-1", base, base.Add(time.Hour), "audit", "")
+	require.Error(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestExportReportsWithoutSeverity(t *testing.T) {
+	table := lib.NewMemoryReportTable()
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable {
+		assert.Equal(t, "reports", reportTable)
+		return table
+	}
+	defer func() { lib.OpenReportTable = orig }()
+
+	storage := &mockS3{}
+	lib.ExportS3 = storage
+	defer func() { lib.ExportS3 = nil }()
+
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	record, err := lib.NewReportRecord(lib.Report{ID: "indexed", ReceivedAt: base.Add(time.Hour)}, "us-east-1")
+	require.NoError(t, err)
+	require.NoError(t, table.PutReport(record))
+	require.NoError(t, table.PutReport(&lib.ReportRecord{
+		ReportID: "legacy",
+		Data:     []byte(`{"report_id":"legacy","received_at":"2019-01-29T12:00:00Z"}`),
+	}))
+
+	count, err := lib.ExportReports("reports", "us-east-1", base, base.Add(72*time.Hour), "audit", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Contains(t, storage.objects, "audit/legacy.json")
+	assert.Contains(t, storage.objects, "audit/indexed.json")
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// DefaultASOwnerCacheTTL is retention of cached AS owners if ASOwnerCache has
+// no TTL. Allocation of addresses rarely changes within it.
+const DefaultASOwnerCacheTTL = 7 * 24 * time.Hour
+
+// ASOwnerRecord is an item of AS owner cache table.
+type ASOwnerRecord struct {
+	// Addr is an IP address or a CIDR block in canonical form, e.g.
+	// "203.0.113.0/24".
+	Addr      string    `dynamo:"addr"`
+	ASOwner   string    `dynamo:"as_owner"`
+	Timestamp time.Time `dynamo:"timestamp"`
+	TTL       time.Time `dynamo:"ttl"`
+}
+
+// ASOwnerCacheTable is a table of AS owners. GetASOwner returns nil without
+// error if the address is not cached.
+type ASOwnerCacheTable interface {
+	GetASOwner(addr string) (*ASOwnerRecord, error)
+	PutASOwner(record *ASOwnerRecord) error
+}
+
+type dynamoASOwnerCache struct {
+	region    string
+	tableName string
+}
+
+func (x *dynamoASOwnerCache) GetASOwner(addr string) (*ASOwnerRecord, error) {
+	var record ASOwnerRecord
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Get("addr", addr).One(&record); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to get AS owner from %s in %s", x.tableName, x.region))
+	}
+	return &record, nil
+}
+
+func (x *dynamoASOwnerCache) PutASOwner(record *ASOwnerRecord) error {
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Put(record).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put AS owner to %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+// OpenASOwnerCache returns ASOwnerCacheTable of DynamoDB. It can be replaced
+// for testing.
+var OpenASOwnerCache = func(region, tableName string) ASOwnerCacheTable {
+	return &dynamoASOwnerCache{region: region, tableName: tableName}
+}
+
+// ASOwnerLookup returns owner of AS that the IP address or CIDR block belongs
+// to, e.g. by an external API.
+type ASOwnerLookup func(addr string) (string, error)
+
+// ASOwnerCache looks up AS owners through a DynamoDB table shared by
+// invocations of inspectors. Lookup is called on cache miss and its result is
+// written to the table. Only Lookup is used if Table is empty.
+type ASOwnerCache struct {
+	Table  string
+	Region string
+
+	// TTL is retention of cached owners. DefaultASOwnerCacheTTL is used if 0.
+	TTL time.Duration
+
+	Lookup ASOwnerLookup
+}
+
+// NewASOwnerCache returns ASOwnerCache of AS_OWNER_CACHE_TABLE with
+// AS_OWNER_CACHE_TTL, e.g. "72h". Invalid TTL is ConfigError.
+func NewASOwnerCache(region string, lookup ASOwnerLookup) (*ASOwnerCache, error) {
+	cache := &ASOwnerCache{
+		Table:  ResolveTableName(os.Getenv("AS_OWNER_CACHE_TABLE")),
+		Region: region,
+		Lookup: lookup,
+	}
+	if v := os.Getenv("AS_OWNER_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, NewConfigError("Invalid AS_OWNER_CACHE_TTL: " + v)
+		}
+		cache.TTL = ttl
+	}
+	return cache, nil
+}
+
+// canonicalAddr returns canonical form of an IP address or a CIDR block so
+// that notations of the same address share a cache item.
+func canonicalAddr(addr string) (string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String(), nil
+	}
+	if _, network, err := net.ParseCIDR(addr); err == nil {
+		return network.String(), nil
+	}
+	return "", WrapCode(ErrCodeValidation, errors.New("Invalid IP address or CIDR: "+addr), "Fail to look up AS owner")
+}
+
+// ASOwner returns AS owner of the IP address or CIDR block. Errors of the
+// cache table are logged and the upstream lookup is used instead. An empty
+// owner is not cached.
+func (x *ASOwnerCache) ASOwner(addr string) (string, error) {
+	key, err := canonicalAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if x.Table == "" {
+		return x.Lookup(key)
+	}
+
+	logger := Logger.WithField("addr", key)
+	table := OpenASOwnerCache(x.Region, x.Table)
+	now := time.Now().UTC()
+	record, err := table.GetASOwner(key)
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Warn("Fail to get cached AS owner, look up upstream")
+	} else if record != nil && record.TTL.After(now) {
+		return record.ASOwner, nil
+	}
+
+	owner, err := x.Lookup(key)
+	if err != nil || owner == "" {
+		return owner, err
+	}
+
+	ttl := x.TTL
+	if ttl <= 0 {
+		ttl = DefaultASOwnerCacheTTL
+	}
+	record = &ASOwnerRecord{Addr: key, ASOwner: owner, Timestamp: now, TTL: now.Add(ttl)}
+	if err := table.PutASOwner(record); err != nil {
+		logger.WithFields(ErrorFields(err)).Warn("Fail to cache AS owner")
+	}
+	return owner, nil
+}
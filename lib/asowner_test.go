@@ -0,0 +1,116 @@
+package lib_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockASOwnerCache struct {
+	records map[string]lib.ASOwnerRecord
+	fail    bool
+}
+
+func (x *mockASOwnerCache) GetASOwner(addr string) (*lib.ASOwnerRecord, error) {
+	if x.fail {
+		return nil, errors.New("get AS owner failed")
+	}
+	record, ok := x.records[addr]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (x *mockASOwnerCache) PutASOwner(record *lib.ASOwnerRecord) error {
+	if x.fail {
+		return errors.New("put AS owner failed")
+	}
+	x.records[record.Addr] = *record
+	return nil
+}
+
+func mockASOwnerCacheTable(table *mockASOwnerCache) func() {
+	orig := lib.OpenASOwnerCache
+	lib.OpenASOwnerCache = func(region, tableName string) lib.ASOwnerCacheTable {
+		return table
+	}
+	return func() { lib.OpenASOwnerCache = orig }
+}
+
+// countingLookup returns owner of AS and records looked up addresses.
+func countingLookup(looked *[]string) lib.ASOwnerLookup {
+	return func(addr string) (string, error) {
+		*looked = append(*looked, addr)
+		return "Example Networks", nil
+	}
+}
+
+func TestASOwnerCacheMissAndHit(t *testing.T) {
+	table := &mockASOwnerCache{records: map[string]lib.ASOwnerRecord{}}
+	defer mockASOwnerCacheTable(table)()
+
+	var looked []string
+	cache := lib.ASOwnerCache{Table: "as-owner", Region: "ap-northeast-1", Lookup: countingLookup(&looked)}
+
+	// Miss falls back to upstream and writes the owner.
+	owner, err := cache.ASOwner("198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "Example Networks", owner)
+	assert.Equal(t, []string{"198.51.100.7"}, looked)
+	require.Contains(t, table.records, "198.51.100.7")
+	assert.WithinDuration(t, time.Now().Add(lib.DefaultASOwnerCacheTTL), table.records["198.51.100.7"].TTL, time.Minute)
+
+	// Hit does not call upstream.
+	owner, err = cache.ASOwner("198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "Example Networks", owner)
+	assert.Equal(t, 1, len(looked))
+
+	// CIDR is cached by canonical network.
+	_, err = cache.ASOwner("203.0.113.9/24")
+	require.NoError(t, err)
+	assert.Contains(t, table.records, "203.0.113.0/24")
+
+	_, err = cache.ASOwner("not-an-ip")
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err))
+}
+
+func TestASOwnerCacheExpired(t *testing.T) {
+	table := &mockASOwnerCache{records: map[string]lib.ASOwnerRecord{
+		"198.51.100.7": {Addr: "198.51.100.7", ASOwner: "Old Networks", TTL: time.Now().Add(-time.Hour)},
+	}}
+	defer mockASOwnerCacheTable(table)()
+
+	var looked []string
+	cache := lib.ASOwnerCache{Table: "as-owner", Region: "ap-northeast-1", TTL: time.Hour, Lookup: countingLookup(&looked)}
+	owner, err := cache.ASOwner("198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "Example Networks", owner)
+	assert.Equal(t, 1, len(looked))
+	assert.Equal(t, "Example Networks", table.records["198.51.100.7"].ASOwner)
+	assert.True(t, table.records["198.51.100.7"].TTL.Before(time.Now().Add(time.Hour+time.Minute)))
+}
+
+func TestASOwnerCacheUnavailable(t *testing.T) {
+	table := &mockASOwnerCache{records: map[string]lib.ASOwnerRecord{}, fail: true}
+	defer mockASOwnerCacheTable(table)()
+
+	var looked []string
+	cache := lib.ASOwnerCache{Table: "as-owner", Region: "ap-northeast-1", Lookup: countingLookup(&looked)}
+	owner, err := cache.ASOwner("198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "Example Networks", owner)
+	assert.Equal(t, 1, len(looked))
+
+	// Upstream error is returned and nothing is cached.
+	table.fail = false
+	cache.Lookup = func(addr string) (string, error) { return "", errors.New("upstream down") }
+	_, err = cache.ASOwner("192.0.2.1")
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(table.records))
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RuleAuthors maps patterns of alert rule to names of inspectors expected to
+// submit pages of reports, e.g. {"malware-*": ["virustotal", "sandbox"]}.
+// Pattern syntax is the same as path.Match.
+type RuleAuthors map[string][]string
+
+// ParseRuleAuthors parses JSON of RuleAuthors, e.g. value of
+// EXPECTED_AUTHORS_BY_RULE environment variable. Empty string means no
+// expectations. Patterns are normalized by NormalizeRulePattern.
+func ParseRuleAuthors(raw string) (RuleAuthors, error) {
+	if strings.TrimSpace(raw) == "" {
+		return RuleAuthors{}, nil
+	}
+
+	var authors RuleAuthors
+	if err := json.Unmarshal([]byte(raw), &authors); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid rule authors").Error())
+	}
+	for pattern := range authors {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, NewConfigError(fmt.Sprintf("Invalid rule pattern of authors: %s", pattern))
+		}
+	}
+	return RuleAuthors(normalizeRulePatterns(authors)), nil
+}
+
+// Expect returns sorted and deduplicated authors of all patterns matching the
+// rule. Nil is returned if no pattern matches.
+func (x RuleAuthors) Expect(rule string) []string {
+	rule = NormalizeRule(rule)
+	var authors []string
+	for pattern, names := range x {
+		if ok, _ := path.Match(pattern, rule); !ok {
+			continue
+		}
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" && !stringsContain(authors, name) {
+				authors = append(authors, name)
+			}
+		}
+	}
+	sort.Strings(authors)
+	return authors
+}
+
+// MissingAuthors returns expected authors of the report that are not
+// contributors of the report in order of ExpectedAuthors.
+func (x *Report) MissingAuthors() []string {
+	var missing []string
+	for _, author := range x.ExpectedAuthors {
+		if !stringsContain(x.ContributedBy, author) {
+			missing = append(missing, author)
+		}
+	}
+	return missing
+}
+
+// IsReportComplete returns true if all expected authors of the report
+// contributed to it. A report without expected authors is complete.
+func IsReportComplete(report Report) bool {
+	return len(report.MissingAuthors()) == 0
+}
@@ -0,0 +1,62 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleAuthorsExpect(t *testing.T) {
+	authors, err := lib.ParseRuleAuthors(`{
+		"malware-*": ["virustotal", "sandbox"],
+		"malware-download": ["sandbox", "whois"],
+		"port-scan": ["whois"]
+	}`)
+	require.NoError(t, err)
+
+	// Authors of all matched patterns are sorted and deduplicated.
+	assert.Equal(t, []string{"sandbox", "virustotal", "whois"}, authors.Expect("malware-download"))
+	assert.Equal(t, []string{"whois"}, authors.Expect("port-scan"))
+	assert.Nil(t, authors.Expect("brute-force"))
+}
+
+func TestParseRuleAuthors(t *testing.T) {
+	authors, err := lib.ParseRuleAuthors(" ")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(authors))
+
+	for _, raw := range []string{`{"x": "whois"}`, `{"[x": ["whois"]}`} {
+		_, err := lib.ParseRuleAuthors(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestIsReportComplete(t *testing.T) {
+	testCases := []struct {
+		title       string
+		contributed []string
+		missing     []string
+	}{
+		{"all", []string{"blue", "magic", "orange"}, nil},
+		{"some", []string{"blue"}, []string{"orange", "magic"}},
+		{"none", nil, []string{"blue", "orange", "magic"}},
+		// Contributors that are not expected do not matter.
+		{"extra", []string{"blue", "green", "magic", "orange"}, nil},
+	}
+
+	for _, tc := range testCases {
+		report := lib.Report{
+			ExpectedAuthors: []string{"blue", "orange", "magic"},
+			ContributedBy:   tc.contributed,
+		}
+		assert.Equal(t, tc.missing, report.MissingAuthors(), tc.title)
+		assert.Equal(t, len(tc.missing) == 0, lib.IsReportComplete(report), tc.title)
+	}
+
+	// A report without expectation is complete.
+	assert.True(t, lib.IsReportComplete(lib.Report{}))
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AutoClosedReason is prefix of ReportResult.Reason of auto-closed reports.
+const AutoClosedReason = "auto-closed"
+
+// AutoCloseRule closes compiled reports without review if their severity is
+// lower than Below and no remote host has risk score over MaxRisk. Urgent
+// reports and reports of unknown severity are never closed.
+type AutoCloseRule struct {
+	Below   ReportSeverity
+	MaxRisk int
+}
+
+// ParseAutoCloseRule parses a rule such as "below=unclassified,max_risk=0",
+// e.g. value of AUTO_CLOSE_RULE environment variable. Nil is returned for
+// empty string and means that auto-close is disabled.
+func ParseAutoCloseRule(raw string) (*AutoCloseRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var rule AutoCloseRule
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, NewConfigError(fmt.Sprintf("Invalid auto-close rule: %s", item))
+		}
+
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "below":
+			rule.Below = ReportSeverity(strings.ToLower(value))
+			if rule.Below.Level() == 0 {
+				return nil, NewConfigError(fmt.Sprintf("Invalid severity of auto-close rule: %s", item))
+			}
+		case "max_risk":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, NewConfigError(fmt.Sprintf("Invalid max_risk of auto-close rule: %s", item))
+			}
+			rule.MaxRisk = n
+		default:
+			return nil, NewConfigError(fmt.Sprintf("Unknown key of auto-close rule: %s", item))
+		}
+	}
+
+	if rule.Below == "" {
+		return nil, NewConfigError("Auto-close rule requires 'below' severity")
+	}
+	return &rule, nil
+}
+
+// autoCloseSeverity returns severity of the compiled report. The severity hint
+// of the alert is used if the report has not been reviewed yet.
+func autoCloseSeverity(report Report) ReportSeverity {
+	if report.Result.Severity != "" {
+		return report.Result.Severity
+	}
+	return report.Alert.Severity
+}
+
+// Apply closes the report and records the reason if it matches the rule.
+// True is returned if the report is closed.
+func (x *AutoCloseRule) Apply(report *Report) bool {
+	sev := autoCloseSeverity(*report)
+	if sev.Level() == 0 || sev == SevUrgent || sev.Level() >= x.Below.Level() {
+		return false
+	}
+
+	for _, host := range report.Content.OpponentHosts {
+		if host.RiskScore() > x.MaxRisk {
+			return false
+		}
+	}
+
+	report.Status = StatusClosed
+	report.Result = ReportResult{
+		Severity: sev,
+		Reason:   fmt.Sprintf("%s: severity %s is below %s without IOC hits", AutoClosedReason, sev, x.Below),
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAutoCloseRule(t *testing.T) {
+	rule, err := lib.ParseAutoCloseRule("")
+	require.NoError(t, err)
+	assert.Nil(t, rule)
+
+	rule, err = lib.ParseAutoCloseRule("below=Unclassified, max_risk=5")
+	require.NoError(t, err)
+	assert.Equal(t, lib.AutoCloseRule{Below: lib.SevUnclassified, MaxRisk: 5}, *rule)
+
+	for _, raw := range []string{
+		"max_risk=0",
+		"below=critical",
+		"below=safe,max_risk=-1",
+		"below",
+		"severity=safe",
+	} {
+		_, err := lib.ParseAutoCloseRule(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestAutoCloseRuleClosed(t *testing.T) {
+	rule := lib.AutoCloseRule{Below: lib.SevUnclassified}
+	report := lib.Report{ID: "r1", Status: lib.StatusNew}
+	report.Alert.Severity = lib.SevSafe
+	report.Content.OpponentHosts = map[string]lib.ReportOpponentHost{
+		"203.0.113.9": {ID: "203.0.113.9", Country: []string{"US"}},
+	}
+
+	require.True(t, rule.Apply(&report))
+	assert.True(t, report.IsClosed())
+	assert.Equal(t, lib.SevSafe, report.Result.Severity)
+	assert.Equal(t, "auto-closed: severity safe is below unclassified without IOC hits", report.Result.Reason)
+}
+
+func TestAutoCloseRuleReviewRequired(t *testing.T) {
+	rule := lib.AutoCloseRule{Below: lib.SevUnclassified}
+
+	// IOC hits
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusNew
+	report.Result = lib.ReportResult{Severity: lib.SevSafe}
+	assert.False(t, rule.Apply(&report))
+	assert.True(t, report.IsNew())
+
+	// Tolerated by max_risk
+	lenient := lib.AutoCloseRule{Below: lib.SevUnclassified, MaxRisk: 50}
+	assert.True(t, lenient.Apply(&report))
+
+	// Severity is not below the threshold or unknown
+	for _, sev := range []lib.ReportSeverity{lib.SevUnclassified, lib.SevUrgent, ""} {
+		report := lib.Report{ID: "r1", Status: lib.StatusNew}
+		report.Alert.Severity = sev
+		assert.False(t, rule.Apply(&report), sev)
+		assert.False(t, lenient.Apply(&report), sev)
+		assert.True(t, report.IsNew())
+	}
+
+	// Urgent is never closed even by the widest rule
+	widest := lib.AutoCloseRule{Below: lib.SevUrgent, MaxRisk: 100}
+	report = lib.Report{ID: "r1", Status: lib.StatusNew}
+	report.Result.Severity = lib.SevUrgent
+	assert.False(t, widest.Apply(&report))
+}
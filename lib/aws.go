@@ -1,19 +1,34 @@
 package lib
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
-	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/guregu/dynamo"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -36,6 +51,11 @@ func (x Arn) Region() string {
 	return x.args[3]
 }
 
+// AccountID returns AWS account ID
+func (x Arn) AccountID() string {
+	return x.args[4]
+}
+
 // FuncName returns AWS function name of lambda
 func (x Arn) FuncName() string {
 	return x.args[6]
@@ -58,54 +78,490 @@ func NewArn(arn string) Arn {
 	return obj
 }
 
+// envIntKeys are environment variables read by envInt. They are validated by
+// CheckEnvInts.
+var envIntKeys []string
+
+// envInt reads an integer environment variable. defaultValue is used if it is
+// not set, and also if it is invalid with warning.
+func envInt(key string, defaultValue int) int {
+	envIntKeys = append(envIntKeys, key)
+
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		Logger.WithError(err).WithField("key", key).Warn("Invalid " + key + ", use default")
+		return defaultValue
+	}
+	return v
+}
+
+// CheckEnvInts returns ConfigError if any integer environment variable read
+// by lib, e.g. MAX_ALERT_SIZE, is invalid. Functions call it at cold start
+// instead of running with defaults.
+func CheckEnvInts() error {
+	var invalid []string
+	for _, key := range envIntKeys {
+		if raw := os.Getenv(key); raw != "" {
+			if _, err := strconv.Atoi(raw); err != nil {
+				invalid = append(invalid, key+"="+raw)
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		return NewConfigError("Invalid integer of " + strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// StorageRoleArn is IAM role ARN that is assumed to access storage (DynamoDB
+// tables) in another account. Empty means that own credentials are used.
+var StorageRoleArn = os.Getenv("STORAGE_ROLE_ARN")
+
+// TablePrefix is prepended to table names by ResolveTableName so that
+// tenants of a multi-tenant deployment have own tables. It can be replaced
+// for testing.
+var TablePrefix = os.Getenv("TABLE_PREFIX")
+
+// ResolveTableName returns physical name of a table from the logical name in
+// environment variables of functions. The name is returned as it is if it
+// already has TablePrefix, and empty name stays empty for disabled tables.
+func ResolveTableName(logical string) string {
+	if logical == "" || TablePrefix == "" || strings.HasPrefix(logical, TablePrefix) {
+		return logical
+	}
+	return TablePrefix + logical
+}
+
+// NewStorageConfig returns aws.Config for storage access. If roleArn is not
+// empty, credentials are retrieved by AssumeRole via client and refreshed when
+// they expire.
+func NewStorageConfig(region, roleArn string, client stscreds.AssumeRoler) *aws.Config {
+	cfg := &aws.Config{Region: aws.String(region)}
+	if roleArn != "" {
+		cfg.Credentials = stscreds.NewCredentialsWithClient(client, roleArn)
+	}
+	return cfg
+}
+
+// NewStorageDB returns DynamoDB client for storage functions.
+func NewStorageDB(region string) *dynamo.DB {
+	ssn := session.New()
+	TraceHandlers(&ssn.Handlers)
+
+	var client stscreds.AssumeRoler
+	if StorageRoleArn != "" {
+		client = sts.New(ssn, &aws.Config{Region: aws.String(region)})
+	}
+
+	return dynamo.New(ssn, NewStorageConfig(region, StorageRoleArn, client))
+}
+
+var (
+	// SFNClient and SNSClient are clients used by ExecDelayMachine and
+	// PublishSnsMessage. A client of the region is created if nil.
+	SFNClient sfniface.SFNAPI
+	SNSClient snsiface.SNSAPI
+)
+
+// ExecDelayMachine starts an execution of the state machine for the report
+// without delay. Use ExecDelayMachineWithOptions to wait before processing.
 func ExecDelayMachine(stateMachineARN string, region string, report Report) error {
-	data, err := json.Marshal(report)
+	_, err := ExecDelayMachineWithOptions(stateMachineARN, region, report, DelayOptions{})
+	return err
+}
+
+// ValidateSnsTopicArn checks format of SNS topic ARN and that the topic is in
+// the region. *ConfigError is returned if the ARN is invalid.
+func ValidateSnsTopicArn(topicArn, region string) error {
+	// sample: arn:aws:sns:ap-northeast-1:1234567890:mytopic
+	if topicArn == "" {
+		return NewConfigError("SNS topic ARN is not configured")
+	}
+
+	arn := strings.Split(topicArn, ":")
+	if len(arn) != 6 || arn[0] != "arn" || !strings.HasPrefix(arn[1], "aws") {
+		return NewConfigError(fmt.Sprintf("Invalid SNS topic ARN format: %s", topicArn))
+	}
+	if arn[2] != "sns" {
+		return NewConfigError(fmt.Sprintf("Not SNS topic ARN (service is %s): %s", arn[2], topicArn))
+	}
+	if arn[3] != region {
+		return NewConfigError(fmt.Sprintf("SNS topic is not in %s: %s", region, topicArn))
+	}
+	if !snsAccountPattern.MatchString(arn[4]) {
+		return NewConfigError(fmt.Sprintf("Invalid account ID in SNS topic ARN: %s", topicArn))
+	}
+	if !snsTopicPattern.MatchString(arn[5]) {
+		return NewConfigError(fmt.Sprintf("Invalid topic name in SNS topic ARN: %s", topicArn))
+	}
+
+	return nil
+}
+
+var (
+	snsAccountPattern = regexp.MustCompile(`^[0-9]+$`)
+	snsTopicPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}(\.fifo)?$`)
+)
+
+// SnsMaxMessageSize is limit of a SNS message including message attributes.
+const SnsMaxMessageSize = 256 * 1024
+
+// SnsRetry is retry policy of SNS publish for throttling and 5xx errors. Wait
+// is doubled for each retry with jitter.
+var SnsRetry = HTTPRetry{MaxRetry: 3, Wait: 200 * time.Millisecond}
+
+// SnsCompressThreshold is size of a serialized report in bytes over which
+// PublishSnsMessage compresses the report.
+var SnsCompressThreshold = envInt("SNS_COMPRESS_THRESHOLD", DefaultMaxMessageSize)
+
+// SnsContentEncoding is encoding of a compressed report, and value of
+// "content_encoding" message attribute of it.
+const SnsContentEncoding = "gzip+base64"
+
+// CompressedReportType is value of "type" field of CompressedReport.
+const CompressedReportType = "compressed_report"
+
+// CompressedReport is a message of a report compressed by PublishSnsMessage.
+// Data is the serialized report encoded by Encoding. UnmarshalReportMessage
+// decodes it.
+type CompressedReport struct {
+	Type     string   `json:"type"`
+	ReportID ReportID `json:"report_id"`
+	Encoding string   `json:"encoding"`
+	Data     string   `json:"data"`
+}
+
+// PublishSnsMessage publishes data as JSON and returns MessageId. A Report is
+// published with message attributes of ReportMessageAttributes so that
+// subscriptions can filter reports by filter policy. A message larger than
+// SnsMaxMessageSize is rejected by *SizeLimitError.
+//
+// A Report larger than SnsCompressThreshold is gzipped, encoded by base64 and
+// published as CompressedReport. If it is still too large, ReportEnvelope
+// is published instead. The full report is stored in ArchiveBucket for the
+// envelope if configured, otherwise the envelope has only summary and report
+// ID.
+func PublishSnsMessage(ctx context.Context, topicArn, region string, data interface{}) (string, error) {
+	var report *Report
+	switch v := data.(type) {
+	case Report:
+		report = &v
+	case *Report:
+		report = v
+	}
+	if report == nil {
+		return publishSnsMessage(ctx, topicArn, region, data, nil, NotificationText{})
+	}
+
+	raw, err := json.Marshal(report)
 	if err != nil {
-		return errors.Wrap(err, "Fail to marshal report data")
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
 	}
 
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
-	svc := sfn.New(ssn)
+	logger := Logger.WithFields(report.LogFields()).WithField("size", len(raw))
+	if len(raw) <= SnsCompressThreshold {
+		msgID, err := publishSnsBody(ctx, topicArn, region, string(raw), ReportMessageAttributes(*report), NotificationText{})
+		if _, tooLarge := errors.Cause(err).(*SizeLimitError); !tooLarge {
+			return msgID, err
+		}
+	}
 
-	input := sfn.StartExecutionInput{
-		Input:           aws.String(string(data)),
-		StateMachineArn: aws.String(stateMachineARN),
+	encoded, err := gzipBase64(raw)
+	if err != nil {
+		return "", err
 	}
-	resp, err := svc.StartExecution(&input)
+	body, err := json.Marshal(CompressedReport{
+		Type:     CompressedReportType,
+		ReportID: report.ID,
+		Encoding: SnsContentEncoding,
+		Data:     encoded,
+	})
 	if err != nil {
-		return err
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal compressed report")
+	}
+	attrs := ReportMessageAttributes(*report)
+	attrs["content_encoding"] = SnsContentEncoding
+	logger.WithField("compressed", len(body)).Info("Publish compressed report")
+	msgID, err := publishSnsBody(ctx, topicArn, region, string(body), attrs, NotificationText{})
+	if _, tooLarge := errors.Cause(err).(*SizeLimitError); !tooLarge {
+		return msgID, err
 	}
 
-	Logger.WithField("response", resp).Info("Done startExecution")
+	if ArchiveBucket != "" {
+		logger.WithFields(ErrorFields(err)).Warn("Report is too large for SNS, publish envelope")
+		cfg := ReportPublishConfig{Region: region, Bucket: ArchiveBucket, AlwaysEnvelope: true, S3: EnvelopeS3}
+		msg, attrs, err := reportMessage(cfg, *report)
+		if err != nil {
+			return "", err
+		}
+		return publishSnsMessage(ctx, topicArn, region, msg, attrs, NotificationText{})
+	}
 
-	return nil
+	logger.WithFields(ErrorFields(err)).Warn("Report is too large for SNS, publish summary")
+	attrs = ReportMessageAttributes(*report)
+	attrs["envelope"] = "true"
+	return publishSnsMessage(ctx, topicArn, region, NewReportEnvelope(*report, len(raw), "", ""), attrs, NotificationText{})
+}
+
+// gzipBase64 compresses data by gzip and encodes it by standard base64.
+func gzipBase64(data []byte) (string, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return "", errors.Wrap(err, "Fail to compress report data")
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "Fail to compress report data")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
-func PublishSnsMessage(topicArn, region string, data interface{}) error {
+// gunzipBase64 decodes data encoded by gzipBase64.
+func gunzipBase64(data string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to decode base64 of report data")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to decompress report data")
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to decompress report data")
+	}
+	return raw, nil
+}
+
+// PublishSnsMessageWithAttributes publishes data as JSON with string message
+// attributes and returns MessageId. Names and values are sanitized by SNS
+// constraints and empty attributes are omitted.
+func PublishSnsMessageWithAttributes(ctx context.Context, topicArn, region string, data interface{}, attrs map[string]string) (string, error) {
+	return publishSnsMessage(ctx, topicArn, region, data, attrs, NotificationText{})
+}
+
+// snsMaxSubjectLen is limit of subject of SNS message.
+const snsMaxSubjectLen = 100
+
+// snsSubject returns title as subject of SNS message. Subject must be ASCII
+// without control characters.
+func snsSubject(title string) string {
+	subject := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		if r > 0x7e {
+			return '?'
+		}
+		return r
+	}, title)
+	return templateTruncate(snsMaxSubjectLen, strings.TrimSpace(subject))
+}
+
+// publishSnsMessage publishes data as JSON. If text has title, it is subject
+// of the message. If text has body, email subscriptions receive the body
+// instead of JSON.
+func publishSnsMessage(ctx context.Context, topicArn, region string, data interface{}, attrs map[string]string, text NotificationText) (string, error) {
 	msg, err := json.Marshal(data)
 	if err != nil {
-		return errors.Wrap(err, "Fail to marshal report data")
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
 	}
+	return publishSnsBody(ctx, topicArn, region, string(msg), attrs, text)
+}
 
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
-	snsService := sns.New(ssn)
+// publishSnsBody publishes msg as it is. Throttling and 5xx errors are retried
+// by SnsRetry until ctx is canceled.
+func publishSnsBody(ctx context.Context, topicArn, region, msg string, attrs map[string]string, text NotificationText) (msgID string, err error) {
+	span := StartTrace("PublishSnsMessage")
+	defer func() { span.End(err) }()
 
-	resp, err := snsService.Publish(&sns.PublishInput{
-		Message:  aws.String(string(msg)),
+	if err := ValidateSnsTopicArn(topicArn, region); err != nil {
+		return "", err
+	}
+
+	snsService := SNSClient
+	if snsService == nil {
+		snsService = sns.New(newSession(region))
+	}
+
+	input := &sns.PublishInput{
+		Message:  aws.String(msg),
 		TopicArn: aws.String(topicArn),
-	})
+	}
+	if subject := snsSubject(text.Title); subject != "" {
+		input.Subject = aws.String(subject)
+	}
+	if text.Body != "" {
+		structured, err := json.Marshal(map[string]string{
+			"default": msg,
+			"email":   text.Body,
+		})
+		if err != nil {
+			return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal message structure")
+		}
+		input.Message = aws.String(string(structured))
+		input.MessageStructure = aws.String("json")
+	}
+	for name, value := range attrs {
+		name, value = sanitizeSnsAttrName(name), sanitizeSnsAttrValue(value)
+		if name == "" || value == "" {
+			continue
+		}
+		if input.MessageAttributes == nil {
+			input.MessageAttributes = map[string]*sns.MessageAttributeValue{}
+		}
+		input.MessageAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
 
-	Logger.WithField("response", resp).Info("Done SNS Publish")
+	if size := snsMessageSize(input); size > SnsMaxMessageSize {
+		return "", NewSizeLimitError("SNS message", size, SnsMaxMessageSize)
+	}
 
-	if err != nil {
-		return errors.Wrap(err, "Fail to publish report")
+	wait := SnsRetry.Wait
+	for i := 0; ; i++ {
+		resp, err := snsService.PublishWithContext(ctx, input)
+		if err == nil {
+			msgID = aws.StringValue(resp.MessageId)
+			Logger.WithField("message_id", msgID).WithField("topic", topicArn).Info("Done SNS Publish")
+			return msgID, nil
+		}
+
+		if !retryableStoreError(err) {
+			return "", WrapCode(ErrCodePublish, err, "Fail to publish report")
+		}
+		if i >= SnsRetry.MaxRetry {
+			// ErrCodeThrottled is used if it is still throttled.
+			return "", WrapStoreError(ErrCodePublish, err, fmt.Sprintf("Fail to publish report after %d attempts", i+1))
+		}
+
+		Logger.WithError(err).WithField("retry", i+1).Warn("SNS publish failed, retrying")
+		select {
+		case <-ctx.Done():
+			return "", WrapCode(ErrCodePublish, ctx.Err(), "SNS publish is canceled")
+		case <-time.After(withJitter(wait)):
+		}
+		wait *= 2
 	}
+}
 
-	return nil
+// snsMessageSize returns size of the message that SNS counts for the limit,
+// i.e. the message body and names, types and values of attributes.
+func snsMessageSize(input *sns.PublishInput) int {
+	size := len(aws.StringValue(input.Message))
+	for name, attr := range input.MessageAttributes {
+		size += len(name) + len(aws.StringValue(attr.DataType)) + len(aws.StringValue(attr.StringValue))
+	}
+	return size
+}
+
+// withJitter returns a random duration from half of wait to wait so that
+// retries of concurrent functions are spread.
+func withJitter(wait time.Duration) time.Duration {
+	if wait <= 1 {
+		return wait
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
+
+// ReportMessageAttributes returns SNS message attributes of the report for
+// filter policies, e.g. {"severity": ["urgent"]}.
+func ReportMessageAttributes(report Report) map[string]string {
+	severity := report.Result.Severity
+	if severity == "" {
+		severity = SevUnclassified
+	}
+
+	return map[string]string{
+		"severity":  string(severity),
+		"rule":      report.Alert.Rule,
+		"status":    string(report.Status),
+		"tenant":    report.AccountID,
+		"report_id": string(report.ID),
+
+		// escalated_from is set only for escalated reports.
+		"escalated_from": string(report.EscalatedFrom),
+	}
+}
+
+// maxSnsAttrValue is upper limit of an attribute value in bytes. SNS limits
+// only total size of a message, but attributes are for filtering and should
+// be small.
+const maxSnsAttrValue = 256
+
+var (
+	snsAttrNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+	snsAttrNameDots    = regexp.MustCompile(`\.{2,}`)
+)
+
+// sanitizeSnsAttrName replaces characters that are not allowed in a name of
+// message attribute. Names must not start or end with a period or have
+// consecutive periods, and "AWS." and "Amazon." prefixes are reserved.
+func sanitizeSnsAttrName(name string) string {
+	name = snsAttrNameInvalid.ReplaceAllString(name, "_")
+	name = snsAttrNameDots.ReplaceAllString(name, ".")
+	name = strings.Trim(name, ".")
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon.") {
+		name = "_" + name
+	}
+	if len(name) > 256 {
+		name = name[:256]
+	}
+	return name
+}
+
+// sanitizeSnsAttrValue removes characters that are not allowed by SNS (valid
+// XML characters) and truncates the value at a rune boundary.
+func sanitizeSnsAttrValue(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		valid := r == '\t' || r == '\n' || r == '\r' ||
+			(0x20 <= r && r <= 0xD7FF) || (0xE000 <= r && r <= 0xFFFD) || (0x10000 <= r && r <= 0x10FFFF)
+		if r == utf8.RuneError || !valid {
+			continue
+		}
+		if b.Len()+utf8.RuneLen(r) > maxSnsAttrValue {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// SecretsManagerClient is a client used by GetSecretValues. A client of the
+// region of the secret is created if nil.
+var SecretsManagerClient secretsmanageriface.SecretsManagerAPI
+
+// SecretCacheTTL is how long GetSecretValues reuses a secret fetched by a warm
+// Lambda container, SECRET_CACHE_TTL in seconds. A secret is fetched every
+// time if 0.
+var SecretCacheTTL = time.Duration(envInt("SECRET_CACHE_TTL", 300)) * time.Second
+
+type cachedSecret struct {
+	value     string
+	expiresAt time.Time
+}
+
+var (
+	secretCacheMutex sync.Mutex
+	secretCache      = map[string]cachedSecret{}
+)
+
+// ClearSecretCache drops secrets cached by GetSecretValues, e.g. for testing.
+func ClearSecretCache() {
+	secretCacheMutex.Lock()
+	defer secretCacheMutex.Unlock()
+	secretCache = map[string]cachedSecret{}
 }
 
 func GetSecretValues(secretArn string, values interface{}) error {
@@ -116,21 +572,34 @@ func GetSecretValues(secretArn string, values interface{}) error {
 	}
 	region := arn[3]
 
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
-	mgr := secretsmanager.New(ssn)
+	secretCacheMutex.Lock()
+	defer secretCacheMutex.Unlock()
 
-	result, err := mgr.GetSecretValue(&secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretArn),
-	})
+	now := time.Now()
+	cached, ok := secretCache[secretArn]
+	if !ok || !now.Before(cached.expiresAt) {
+		client := SecretsManagerClient
+		if client == nil {
+			client = secretsmanager.New(newSession(region))
+		}
 
-	if err != nil {
-		return errors.Wrap(err, "Fail to retrieve secret values")
+		result, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(secretArn),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Fail to retrieve secret values")
+		}
+
+		cached = cachedSecret{
+			value:     aws.StringValue(result.SecretString),
+			expiresAt: now.Add(SecretCacheTTL),
+		}
+		if SecretCacheTTL > 0 {
+			secretCache[secretArn] = cached
+		}
 	}
 
-	err = json.Unmarshal([]byte(*result.SecretString), values)
-	if err != nil {
+	if err := json.Unmarshal([]byte(cached.value), values); err != nil {
 		return errors.Wrap(err, "Fail to parse secret values as JSON")
 	}
 
@@ -143,9 +612,7 @@ func GetPhysicalResourceId(region, stackName, logicalId string) (string, error)
 		"region":    region,
 	}).Info("Try to get CFn resources")
 
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
+	ssn := newSession(region)
 	client := cloudformation.New(ssn)
 
 	resp, err := client.DescribeStackResources(&cloudformation.DescribeStackResourcesInput{
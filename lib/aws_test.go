@@ -1,10 +1,30 @@
 package lib_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLambdaArn(t *testing.T) {
@@ -14,3 +34,509 @@ func TestLambdaArn(t *testing.T) {
 	assert.Equal(t, arn.Region(), "ap-northeast-1")
 	assert.Equal(t, arn.FuncName(), "mizutani-test")
 }
+
+func TestValidateSnsTopicArn(t *testing.T) {
+	region := "ap-northeast-1"
+	valid := []string{
+		"arn:aws:sns:ap-northeast-1:1234567890:mytopic",
+		"arn:aws:sns:ap-northeast-1:123456789012:my-topic_01",
+		"arn:aws:sns:ap-northeast-1:123456789012:mytopic.fifo",
+	}
+	for _, arn := range valid {
+		assert.NoError(t, lib.ValidateSnsTopicArn(arn, region), arn)
+	}
+
+	malformed := []string{
+		"",
+		"mytopic",
+		"arn:aws:sns:ap-northeast-1:1234567890",
+		"arn:aws:sns:ap-northeast-1:1234567890:mytopic:extra",
+		"arm:aws:sns:ap-northeast-1:1234567890:mytopic",
+		"arn:aws:sqs:ap-northeast-1:1234567890:mytopic",
+		"arn:aws:sns:us-east-1:1234567890:mytopic",
+		"arn:aws:sns:ap-northeast-1:account:mytopic",
+		"arn:aws:sns:ap-northeast-1:1234567890:my topic",
+		"arn:aws:sns:ap-northeast-1:1234567890:",
+	}
+	for _, arn := range malformed {
+		err := lib.ValidateSnsTopicArn(arn, region)
+		require.Error(t, err, arn)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, arn)
+	}
+}
+
+func TestPublishSnsMessageInvalidArn(t *testing.T) {
+	_, err := lib.PublishSnsMessage(context.Background(), "", "ap-northeast-1", map[string]string{"a": "b"})
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+type mockSNS struct {
+	snsiface.SNSAPI
+	inputs []*sns.PublishInput
+
+	// err is returned by GetTopicAttributes and topics are its requests.
+	err    error
+	topics []string
+
+	// publishErrs are returned by Publish in order before it succeeds.
+	publishErrs []error
+}
+
+func (x *mockSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	return x.Publish(input)
+}
+
+func (x *mockSNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	x.inputs = append(x.inputs, input)
+	if len(x.publishErrs) > 0 {
+		err := x.publishErrs[0]
+		x.publishErrs = x.publishErrs[1:]
+		return nil, err
+	}
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("msg-%d", len(x.inputs)))}, nil
+}
+
+func TestPublishSnsMessageReportAttributes(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+
+	topicArn := "arn:aws:sns:ap-northeast-1:1234567890:reports"
+	report := loadFixtureReport(t)
+	report.AccountID = "123456789012"
+	msgID, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", report)
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", msgID)
+	_, err = lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", &report)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(client.inputs))
+
+	expected := map[string]*sns.MessageAttributeValue{
+		"severity":  {DataType: aws.String("String"), StringValue: aws.String(string(report.Result.Severity))},
+		"rule":      {DataType: aws.String("String"), StringValue: aws.String(report.Alert.Rule)},
+		"status":    {DataType: aws.String("String"), StringValue: aws.String(string(report.Status))},
+		"tenant":    {DataType: aws.String("String"), StringValue: aws.String("123456789012")},
+		"report_id": {DataType: aws.String("String"), StringValue: aws.String(string(report.ID))},
+	}
+	assert.Equal(t, expected, client.inputs[0].MessageAttributes)
+	assert.Equal(t, expected, client.inputs[1].MessageAttributes)
+
+	// Other payloads have no attributes.
+	_, err = lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", map[string]string{"a": "b"})
+	require.NoError(t, err)
+	assert.Nil(t, client.inputs[2].MessageAttributes)
+}
+
+func TestPublishSnsMessageSanitizeAttributes(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+
+	attrs := map[string]string{
+		"rule":         "bad\x00rule\ufffe ",
+		"long":         strings.Repeat("あ", 100),
+		"AWS.reserved": "v",
+		"a b..c.":      "v",
+		"empty":        " ",
+	}
+	_, err := lib.PublishSnsMessageWithAttributes(context.Background(), "arn:aws:sns:ap-northeast-1:1234567890:reports", "ap-northeast-1", "data", attrs)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(client.inputs))
+
+	got := map[string]string{}
+	for name, v := range client.inputs[0].MessageAttributes {
+		got[name] = aws.StringValue(v.StringValue)
+	}
+	assert.Equal(t, "badrule", got["rule"])
+	assert.Equal(t, strings.Repeat("あ", 85), got["long"])
+	assert.Equal(t, "v", got["_AWS.reserved"])
+	assert.Equal(t, "v", got["a_b.c"])
+	assert.NotContains(t, got, "empty")
+	assert.Equal(t, 4, len(got))
+}
+
+type mockAssumeRoler struct {
+	roleArn    string
+	calls      int
+	expiration time.Time
+}
+
+func (x *mockAssumeRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	x.calls++
+	x.roleArn = aws.StringValue(input.RoleArn)
+
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String(fmt.Sprintf("AKID%d", x.calls)),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(x.expiration),
+		},
+	}, nil
+}
+
+func TestStorageConfigWithoutRole(t *testing.T) {
+	client := &mockAssumeRoler{}
+	cfg := lib.NewStorageConfig("ap-northeast-1", "", client)
+
+	assert.Equal(t, "ap-northeast-1", aws.StringValue(cfg.Region))
+	assert.Nil(t, cfg.Credentials)
+	assert.Equal(t, 0, client.calls)
+}
+
+func TestStorageConfigAssumeRole(t *testing.T) {
+	roleArn := "arn:aws:iam::1234567890:role/storage"
+	client := &mockAssumeRoler{expiration: time.Now().Add(time.Hour)}
+	cfg := lib.NewStorageConfig("ap-northeast-1", roleArn, client)
+	require.NotNil(t, cfg.Credentials)
+
+	v, err := cfg.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID1", v.AccessKeyID)
+	assert.Equal(t, roleArn, client.roleArn)
+
+	// Valid credentials are cached
+	v, err = cfg.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID1", v.AccessKeyID)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestStorageConfigRefreshCredentials(t *testing.T) {
+	client := &mockAssumeRoler{expiration: time.Now().Add(-time.Minute)}
+	cfg := lib.NewStorageConfig("ap-northeast-1", "arn:aws:iam::1234567890:role/storage", client)
+
+	v, err := cfg.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID1", v.AccessKeyID)
+
+	// Expired credentials are retrieved again
+	v, err = cfg.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "AKID2", v.AccessKeyID)
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestResolveTableName(t *testing.T) {
+	orig := lib.TablePrefix
+	defer func() { lib.TablePrefix = orig }()
+
+	lib.TablePrefix = ""
+	assert.Equal(t, "reports", lib.ResolveTableName("reports"))
+
+	lib.TablePrefix = "tenant-a-"
+	assert.Equal(t, "tenant-a-reports", lib.ResolveTableName("reports"))
+	assert.Equal(t, "tenant-a-reports", lib.ResolveTableName("tenant-a-reports"))
+	assert.Equal(t, "", lib.ResolveTableName(""))
+}
+
+// fastSnsRetry shortens waits of SnsRetry for tests.
+func fastSnsRetry() func() {
+	orig := lib.SnsRetry
+	lib.SnsRetry = lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond}
+	return func() { lib.SnsRetry = orig }
+}
+
+func TestPublishSnsMessageTooLarge(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+
+	topicArn := "arn:aws:sns:ap-northeast-1:1234567890:reports"
+	_, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", strings.Repeat("x", lib.SnsMaxMessageSize))
+	require.Error(t, err)
+	sizeErr, ok := err.(*lib.SizeLimitError)
+	require.True(t, ok)
+	assert.Equal(t, lib.SnsMaxMessageSize+2, sizeErr.Size)
+	assert.Equal(t, lib.ErrCodeTooLarge, lib.ErrorCodeOf(err))
+	assert.Equal(t, 0, len(client.inputs))
+
+	// A report is published as an envelope if the bucket is configured.
+	storage := &envelopeS3{}
+	origBucket := lib.ArchiveBucket
+	lib.ArchiveBucket, lib.EnvelopeS3 = "archive-bucket", storage
+	defer func() { lib.ArchiveBucket, lib.EnvelopeS3 = origBucket, nil }()
+
+	report := loadFixtureReport(t)
+	report.Result.Reason = incompressibleText(t, lib.SnsMaxMessageSize*2)
+	msgID, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", report)
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", msgID)
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, "true", aws.StringValue(client.inputs[0].MessageAttributes["envelope"].StringValue))
+	assert.NotEmpty(t, storage.puts)
+}
+
+// incompressibleText returns random text of n bytes that gzip can hardly
+// compress.
+func incompressibleText(t *testing.T, n int) string {
+	data := make([]byte, n*3/4)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// snsAttr returns value of the message attribute.
+func snsAttr(input *sns.PublishInput, name string) string {
+	if attr, ok := input.MessageAttributes[name]; ok {
+		return aws.StringValue(attr.StringValue)
+	}
+	return ""
+}
+
+func TestPublishSnsMessageCompressReport(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+	topicArn := "arn:aws:sns:ap-northeast-1:1234567890:reports"
+
+	// A report under the threshold is published as plain JSON.
+	report := loadFixtureReport(t)
+	_, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", report)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, "", snsAttr(client.inputs[0], "content_encoding"))
+	var plain lib.Report
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(client.inputs[0].Message)), &plain))
+	assert.Equal(t, report.ID, plain.ID)
+
+	// A large report is gzipped and encoded by base64.
+	report.Result.Reason = strings.Repeat("x", lib.SnsMaxMessageSize)
+	_, err = lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", report)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(client.inputs))
+	input := client.inputs[1]
+	assert.Equal(t, lib.SnsContentEncoding, snsAttr(input, "content_encoding"))
+	assert.Equal(t, string(report.ID), snsAttr(input, "report_id"))
+
+	var body lib.CompressedReport
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(input.Message)), &body))
+	assert.Equal(t, lib.CompressedReportType, body.Type)
+	assert.Equal(t, lib.SnsContentEncoding, body.Encoding)
+	assert.Equal(t, report.ID, body.ReportID)
+
+	compressed, err := base64.StdEncoding.DecodeString(body.Data)
+	require.NoError(t, err)
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	var decoded lib.Report
+	require.NoError(t, json.NewDecoder(r).Decode(&decoded))
+	assert.Equal(t, report.ID, decoded.ID)
+	assert.Equal(t, report.Result.Reason, decoded.Result.Reason)
+}
+
+func TestPublishSnsMessageReportSummary(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+	origBucket := lib.ArchiveBucket
+	lib.ArchiveBucket = ""
+	defer func() { lib.ArchiveBucket = origBucket }()
+
+	// Without the bucket, a report too large even if compressed falls back
+	// to its summary and report ID.
+	report := loadFixtureReport(t)
+	report.Result.Reason = incompressibleText(t, lib.SnsMaxMessageSize*2)
+	msgID, err := lib.PublishSnsMessage(context.Background(), "arn:aws:sns:ap-northeast-1:1234567890:reports", "ap-northeast-1", report)
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", msgID)
+	require.Equal(t, 1, len(client.inputs))
+
+	input := client.inputs[0]
+	assert.Equal(t, "true", snsAttr(input, "envelope"))
+	assert.Equal(t, "", snsAttr(input, "content_encoding"))
+	var envelope lib.ReportEnvelope
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(input.Message)), &envelope))
+	assert.Equal(t, lib.ReportEnvelopeType, envelope.Type)
+	assert.Equal(t, report.ID, envelope.ReportID)
+	assert.Equal(t, report.OneLineSummary(), envelope.Summary)
+	assert.Equal(t, "", envelope.S3URL)
+	assert.NotContains(t, aws.StringValue(input.Message), "s3_url")
+}
+
+func TestPublishSnsMessageRoundTrip(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+	origBucket, origTable, origBackend := lib.ArchiveBucket, lib.EnvelopeReportTable, lib.ReportStoreBackend
+	lib.ArchiveBucket, lib.EnvelopeReportTable, lib.ReportStoreBackend = "", "reports", "memory"
+	defer func() {
+		lib.ArchiveBucket, lib.EnvelopeReportTable, lib.ReportStoreBackend = origBucket, origTable, origBackend
+	}()
+	topicArn := "arn:aws:sns:ap-northeast-1:1234567890:reports"
+
+	testCases := []struct {
+		name     string
+		reason   string
+		encoding string
+		envelope string
+	}{
+		{"plain", "small", "", ""},
+		{"compressed", strings.Repeat("x", lib.SnsMaxMessageSize), lib.SnsContentEncoding, ""},
+		{"summary", incompressibleText(t, lib.SnsMaxMessageSize*2), "", "true"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			report := loadFixtureReport(t)
+			report.ID = lib.NewReportID()
+			report.Result.Reason = tc.reason
+			require.NoError(t, lib.SaveReport("reports", "ap-northeast-1", report))
+
+			n := len(client.inputs)
+			_, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", report)
+			require.NoError(t, err)
+			require.Equal(t, n+1, len(client.inputs))
+			input := client.inputs[n]
+			assert.Equal(t, tc.encoding, snsAttr(input, "content_encoding"))
+			assert.Equal(t, tc.envelope, snsAttr(input, "envelope"))
+
+			decoded, err := lib.UnmarshalReportMessage(aws.StringValue(input.Message))
+			require.NoError(t, err)
+			assert.Equal(t, report.ID, decoded.ID)
+			assert.Equal(t, report.Result.Reason, decoded.Result.Reason)
+			assert.Equal(t, report.Alert.Rule, decoded.Alert.Rule)
+		})
+	}
+}
+
+func TestUnmarshalReportMessageSummaryWithoutTable(t *testing.T) {
+	origTable := lib.EnvelopeReportTable
+	lib.EnvelopeReportTable = ""
+	defer func() { lib.EnvelopeReportTable = origTable }()
+
+	envelope := lib.NewReportEnvelope(loadFixtureReport(t), 1024, "", "")
+	raw, err := json.Marshal(envelope)
+	require.NoError(t, err)
+
+	_, err = lib.UnmarshalReportMessage(string(raw))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err))
+	assert.False(t, lib.IsRetryable(err))
+
+	// Invalid S3 URL is not retried, too.
+	envelope.S3URL = "https://example.com/report.json"
+	raw, err = json.Marshal(envelope)
+	require.NoError(t, err)
+	_, err = lib.UnmarshalReportMessage(string(raw))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err))
+}
+
+func TestPublishSnsMessageThrottledThenSuccess(t *testing.T) {
+	defer fastSnsRetry()()
+	client := &mockSNS{publishErrs: []error{
+		awserr.New("Throttled", "Rate exceeded", nil),
+		awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "req-1"),
+	}}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+
+	msgID, err := lib.PublishSnsMessage(context.Background(), "arn:aws:sns:ap-northeast-1:1234567890:tasks", "ap-northeast-1", lib.Task{ReportID: "r1"})
+	require.NoError(t, err)
+	assert.Equal(t, "msg-3", msgID)
+	assert.Equal(t, 3, len(client.inputs))
+}
+
+func TestPublishSnsMessageHardFailure(t *testing.T) {
+	defer fastSnsRetry()()
+	topicArn := "arn:aws:sns:ap-northeast-1:1234567890:tasks"
+
+	// Errors other than throttling and 5xx are not retried.
+	client := &mockSNS{publishErrs: []error{awserr.New("AuthorizationError", "denied", nil)}}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+	_, err := lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", "data")
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Equal(t, 1, len(client.inputs))
+
+	// Retries are bounded.
+	throttled := awserr.New("Throttled", "Rate exceeded", nil)
+	client = &mockSNS{publishErrs: []error{throttled, throttled, throttled, throttled}}
+	lib.SNSClient = client
+	_, err = lib.PublishSnsMessage(context.Background(), topicArn, "ap-northeast-1", "data")
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeThrottled, lib.ErrorCodeOf(err))
+	assert.Equal(t, 3, len(client.inputs))
+
+	// Canceled context stops retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client = &mockSNS{publishErrs: []error{throttled}}
+	lib.SNSClient = client
+	_, err = lib.PublishSnsMessage(ctx, topicArn, "ap-northeast-1", "data")
+	require.Error(t, err)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.Equal(t, 1, len(client.inputs))
+}
+
+type mockSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	calls int
+}
+
+func (x *mockSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	x.calls++
+	return &secretsmanager.GetSecretValueOutput{
+		SecretString: aws.String(fmt.Sprintf(`{"token":"t%d"}`, x.calls)),
+	}, nil
+}
+
+func TestGetSecretValuesCache(t *testing.T) {
+	client := &mockSecretsManager{}
+	origTTL := lib.SecretCacheTTL
+	lib.SecretsManagerClient = client
+	lib.ClearSecretCache()
+	defer func() {
+		lib.SecretsManagerClient, lib.SecretCacheTTL = nil, origTTL
+		lib.ClearSecretCache()
+	}()
+
+	type secret struct {
+		Token string `json:"token"`
+	}
+	arn := "arn:aws:secretsmanager:ap-northeast-1:1234567890:secret:mytest"
+
+	// A secret is fetched once while it is cached.
+	lib.SecretCacheTTL = time.Minute
+	for i := 0; i < 3; i++ {
+		var v secret
+		require.NoError(t, lib.GetSecretValues(arn, &v))
+		assert.Equal(t, "t1", v.Token)
+	}
+	assert.Equal(t, 1, client.calls)
+
+	// A secret is fetched every time if the cache is disabled.
+	lib.SecretCacheTTL = 0
+	lib.ClearSecretCache()
+	for i := 2; i <= 3; i++ {
+		var v secret
+		require.NoError(t, lib.GetSecretValues(arn, &v))
+		assert.Equal(t, fmt.Sprintf("t%d", i), v.Token)
+	}
+	assert.Equal(t, 3, client.calls)
+}
+
+func TestCheckEnvInts(t *testing.T) {
+	orig, ok := os.LookupEnv("MAX_ALERT_SIZE")
+	defer func() {
+		if ok {
+			os.Setenv("MAX_ALERT_SIZE", orig)
+		} else {
+			os.Unsetenv("MAX_ALERT_SIZE")
+		}
+	}()
+
+	os.Setenv("MAX_ALERT_SIZE", "2048")
+	assert.NoError(t, lib.CheckEnvInts())
+
+	os.Setenv("MAX_ALERT_SIZE", "1MB")
+	err := lib.CheckEnvInts()
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "MAX_ALERT_SIZE=1MB")
+}
@@ -0,0 +1,36 @@
+package lib
+
+// catalogEN is English messages of notifications. Keys must cover all
+// messages used by default templates because other catalogs fall back to it.
+const catalogEN = `{
+  "severity.urgent": "URGENT",
+  "severity.unclassified": "UNCLASSIFIED",
+  "severity.safe": "SAFE",
+  "report": "Report",
+  "report_id": "Report ID",
+  "rule": "Rule",
+  "key": "Key",
+  "status": "Status",
+  "reason": "Reason",
+  "remote_hosts": "Remote Hosts",
+  "local_hosts": "Local Hosts",
+  "timeline": "Timeline",
+  "warnings": "Warnings",
+  "host": "Host",
+  "ip_address": "IP Address",
+  "country": "Country",
+  "as_owner": "AS Owner",
+  "malware": "Malware",
+  "domains": "Domains",
+  "urls": "URLs",
+  "user": "User",
+  "owner": "Owner",
+  "os": "OS",
+  "hostname": "Hostname",
+  "count.remote_hosts": "Remote hosts",
+  "count.local_hosts": "Local hosts",
+  "count.users": "Users",
+  "count.malicious_hashes": "Malicious hashes",
+  "top_indicators": "Top indicators",
+  "full_report": "Full report"
+}`
@@ -0,0 +1,35 @@
+package lib
+
+// catalogJA is Japanese messages of notifications.
+const catalogJA = `{
+  "severity.urgent": "緊急",
+  "severity.unclassified": "未分類",
+  "severity.safe": "安全",
+  "report": "レポート",
+  "report_id": "レポートID",
+  "rule": "ルール",
+  "key": "キー",
+  "status": "ステータス",
+  "reason": "理由",
+  "remote_hosts": "リモートホスト",
+  "local_hosts": "ローカルホスト",
+  "timeline": "タイムライン",
+  "warnings": "警告",
+  "host": "ホスト",
+  "ip_address": "IPアドレス",
+  "country": "国",
+  "as_owner": "AS所有者",
+  "malware": "マルウェア",
+  "domains": "ドメイン",
+  "urls": "URL",
+  "user": "ユーザー",
+  "owner": "所有者",
+  "os": "OS",
+  "hostname": "ホスト名",
+  "count.remote_hosts": "リモートホスト",
+  "count.local_hosts": "ローカルホスト",
+  "count.users": "ユーザー",
+  "count.malicious_hashes": "不正なハッシュ",
+  "top_indicators": "主な痕跡",
+  "full_report": "レポート全文"
+}`
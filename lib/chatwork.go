@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultChatworkAPIURL is endpoint of Chatwork API v2.
+const DefaultChatworkAPIURL = "https://api.chatwork.com/v2"
+
+// Limits of Chatwork message. The API rejects a body longer than 65535
+// characters.
+const (
+	chatworkMaxBodyLen    = 65535
+	chatworkMaxTitleLen   = 1000
+	chatworkMaxIndicators = 5
+)
+
+// ChatworkConfig is configuration of PublishChatwork.
+type ChatworkConfig struct {
+	APIToken string
+
+	// APIURL overrides DefaultChatworkAPIURL, e.g. for tests.
+	APIURL string
+
+	// RoomID is a room where reports are posted.
+	RoomID string
+
+	// SeverityRooms overrides RoomID for reports of the severity.
+	SeverityRooms map[ReportSeverity]string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report. If it is empty, S3 URI of the report
+	// in ArchiveBucket is linked instead.
+	ReportURL     string
+	ArchiveBucket string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+// Room returns ID of the room for the report.
+func (x *ChatworkConfig) Room(report Report) string {
+	if room := x.SeverityRooms[report.Result.Severity]; room != "" {
+		return room
+	}
+	return x.RoomID
+}
+
+func (x *ChatworkConfig) apiURL() string {
+	if x.APIURL != "" {
+		return strings.TrimRight(x.APIURL, "/")
+	}
+	return DefaultChatworkAPIURL
+}
+
+func (x *ChatworkConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+func chatworkLink(cfg ChatworkConfig, report Report) string {
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		return link
+	}
+	if cfg.ArchiveBucket != "" {
+		return fmt.Sprintf("s3://%s/%s", cfg.ArchiveBucket, ArchiveKey(report.ID, "report.json"))
+	}
+	return ""
+}
+
+// NewChatworkMessage builds a message body of the report with [info] and
+// [title] tags. Severity is emphasized at the head of the title. If the body
+// exceeds Chatwork limit, content of the info block is truncated and the
+// closing tag is kept.
+func NewChatworkMessage(cfg ChatworkConfig, report Report) string {
+	title := templateTruncate(chatworkMaxTitleLen, fmt.Sprintf("【%s】%s", severityLabel(report), report.Alert.Title()))
+
+	lines := []string{
+		"Report ID: " + string(report.ID),
+		"Rule: " + report.Alert.Rule,
+		"Key: " + report.Alert.Key,
+	}
+	if report.AccountID != "" {
+		lines = append(lines, "Account: "+report.AccountID)
+	}
+	if report.Result.Reason != "" {
+		lines = append(lines, "Reason: "+report.Result.Reason)
+	}
+	if link := chatworkLink(cfg, report); link != "" {
+		lines = append(lines, "Report: "+link)
+	}
+	if indicators := report.TopIndicators(chatworkMaxIndicators); len(indicators) > 0 {
+		lines = append(lines, "", "Top indicators:")
+		for _, indicator := range indicators {
+			lines = append(lines, "- "+indicator)
+		}
+	}
+	if report.Alert.Description != "" {
+		lines = append(lines, "", report.Alert.Description)
+	}
+
+	head := "[info][title]" + title + "[/title]"
+	tail := "[/info]"
+	body := strings.Join(lines, "\n")
+	if room := chatworkMaxBodyLen - len([]rune(head+tail)); len([]rune(body)) > room {
+		Logger.WithFields(report.LogFields()).Warn("Chatwork message exceeds limit, truncated")
+		body = templateTruncate(room, body)
+	}
+
+	return head + body + tail
+}
+
+// chatworkError maps a rejected API token to ErrCodeInvalidConfig so that it
+// is not retried as a publish failure.
+func chatworkError(err error, msg string) error {
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusUnauthorized {
+		return WrapCode(ErrCodeInvalidConfig, err, msg)
+	}
+	return WrapCode(ErrCodePublish, err, msg)
+}
+
+// PublishChatwork posts the report to the Chatwork room for severity of the
+// report. A request limited by rate is retried after reset time of
+// X-RateLimit-Reset header.
+func PublishChatwork(cfg ChatworkConfig, report Report) error {
+	if cfg.APIToken == "" {
+		return NewConfigError("Chatwork API token is not configured")
+	}
+	room := cfg.Room(report)
+	if room == "" {
+		return NewConfigError("Chatwork room is not configured")
+	}
+
+	form := url.Values{}
+	form.Set("body", NewChatworkMessage(cfg, report))
+
+	header := http.Header{}
+	header.Set("X-ChatWorkToken", cfg.APIToken)
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	endpoint := cfg.apiURL() + "/rooms/" + url.PathEscape(room) + "/messages"
+	resp, err := sendHTTPRequest(cfg.Client, http.MethodPost, endpoint, header, []byte(form.Encode()), cfg.retry())
+	if err != nil {
+		return chatworkError(err, "Fail to post Chatwork message")
+	}
+
+	var posted struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal(resp, &posted); err != nil {
+		return errors.Wrap(err, "Invalid response of Chatwork")
+	}
+
+	Logger.WithFields(report.LogFields()).WithField("room", room).WithField("message_id", posted.MessageID).Info("Posted Chatwork message")
+	return nil
+}
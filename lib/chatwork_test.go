@@ -0,0 +1,169 @@
+package lib_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockChatwork is a minimum Chatwork messages API server for tests.
+type mockChatwork struct {
+	srv      *httptest.Server
+	rooms    []string
+	bodies   []string
+	tokens   []string
+	requests int
+
+	// rateLimit is number of following 429 responses.
+	rateLimit int
+}
+
+func newMockChatwork(t *testing.T) *mockChatwork {
+	x := &mockChatwork{}
+	x.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.requests++
+		if x.rateLimit > 0 {
+			x.rateLimit--
+			w.Header().Set("X-RateLimit-Limit", "300")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Unix()))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":["Rate limit exceeded"]}`))
+			return
+		}
+
+		require.NoError(t, r.ParseForm())
+		parts := strings.Split(r.URL.Path, "/")
+		if r.Method != http.MethodPost || len(parts) != 4 || parts[1] != "rooms" || parts[3] != "messages" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-ChatWorkToken") != "valid-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":["Invalid API token"]}`))
+			return
+		}
+
+		x.rooms = append(x.rooms, parts[2])
+		x.bodies = append(x.bodies, r.PostForm.Get("body"))
+		w.Write([]byte(fmt.Sprintf(`{"message_id":"%d"}`, len(x.bodies))))
+	}))
+	return x
+}
+
+func chatworkTestConfig(srv *httptest.Server) lib.ChatworkConfig {
+	return lib.ChatworkConfig{
+		APIToken: "valid-token",
+		APIURL:   srv.URL,
+		RoomID:   "1000",
+		SeverityRooms: map[lib.ReportSeverity]string{
+			lib.SevUrgent: "2000",
+		},
+		ReportURL: "https://reports.example.com/{report_id}",
+		Retry:     lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+}
+
+func TestNewChatworkMessage(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Result.Reason = "Known malicious host"
+	cfg := lib.ChatworkConfig{ReportURL: "https://reports.example.com/{report_id}"}
+
+	msg := lib.NewChatworkMessage(cfg, report)
+	assert.True(t, strings.HasPrefix(msg, "[info][title]【URGENT】"+report.Alert.Title()+"[/title]"))
+	assert.True(t, strings.HasSuffix(msg, "[/info]"))
+	assert.Contains(t, msg, "Report ID: "+string(report.ID)+"\n")
+	assert.Contains(t, msg, "Rule: "+report.Alert.Rule+"\n")
+	assert.Contains(t, msg, "Reason: Known malicious host\n")
+	assert.Contains(t, msg, "Report: https://reports.example.com/"+string(report.ID))
+	assert.Contains(t, msg, "Top indicators:\n- ")
+	assert.Equal(t, 1, strings.Count(msg, "[info]"))
+
+	report.Result.Severity = ""
+	assert.Contains(t, lib.NewChatworkMessage(cfg, report), "【UNCLASSIFIED】")
+
+	// Archived report is linked without ReportURL.
+	cfg = lib.ChatworkConfig{ArchiveBucket: "archive-bucket"}
+	assert.Contains(t, lib.NewChatworkMessage(cfg, report),
+		"Report: s3://archive-bucket/"+lib.ArchiveKey(report.ID, "report.json"))
+}
+
+func TestNewChatworkMessageTruncated(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Alert.Description = strings.Repeat("不審な通信", 20000)
+
+	msg := lib.NewChatworkMessage(lib.ChatworkConfig{}, report)
+	assert.True(t, utf8.ValidString(msg))
+	assert.Equal(t, 65535, utf8.RuneCountInString(msg))
+	assert.True(t, strings.HasSuffix(msg, "...[/info]"))
+	assert.Contains(t, msg, "Report ID: "+string(report.ID))
+}
+
+func TestPublishChatwork(t *testing.T) {
+	mock := newMockChatwork(t)
+	defer mock.srv.Close()
+	cfg := chatworkTestConfig(mock.srv)
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishChatwork(cfg, report))
+
+	report.Result.Severity = lib.SevSafe
+	require.NoError(t, lib.PublishChatwork(cfg, report))
+
+	// Urgent report goes to the severity room, others to the default room.
+	assert.Equal(t, []string{"2000", "1000"}, mock.rooms)
+	require.Equal(t, 2, len(mock.bodies))
+	assert.Equal(t, lib.NewChatworkMessage(cfg, loadFixtureReport(t)), mock.bodies[0])
+	assert.Contains(t, mock.bodies[1], "【SAFE】")
+}
+
+func TestPublishChatworkRateLimit(t *testing.T) {
+	mock := newMockChatwork(t)
+	defer mock.srv.Close()
+	cfg := chatworkTestConfig(mock.srv)
+
+	// Wait by backoff is long, so retries must follow X-RateLimit-Reset.
+	cfg.Retry.Wait = time.Hour
+	mock.rateLimit = 2
+
+	start := time.Now()
+	require.NoError(t, lib.PublishChatwork(cfg, loadFixtureReport(t)))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, 3, mock.requests)
+	assert.Equal(t, 1, len(mock.bodies))
+
+	cfg.Retry.Wait = time.Millisecond
+	mock.rateLimit = 3
+	err := lib.PublishChatwork(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+}
+
+func TestPublishChatworkConfigError(t *testing.T) {
+	mock := newMockChatwork(t)
+	defer mock.srv.Close()
+	cfg := chatworkTestConfig(mock.srv)
+	report := loadFixtureReport(t)
+
+	cfg.APIToken = "revoked-token"
+	err := lib.PublishChatwork(cfg, report)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+
+	_, ok := lib.PublishChatwork(lib.ChatworkConfig{}, report).(*lib.ConfigError)
+	assert.True(t, ok)
+
+	cfg.APIToken = "valid-token"
+	cfg.RoomID, cfg.SeverityRooms = "", nil
+	_, ok = lib.PublishChatwork(cfg, report).(*lib.ConfigError)
+	assert.True(t, ok)
+	assert.Empty(t, mock.bodies)
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8",     // RFC1918
+		"172.16.0.0/12",  // RFC1918
+		"192.168.0.0/16", // RFC1918
+		"100.64.0.0/10",  // RFC6598 (Carrier-grade NAT)
+		"127.0.0.0/8",    // Loopback
+		"169.254.0.0/16", // Link local
+		"::1/128",        // IPv6 loopback
+		"fc00::/7",       // IPv6 unique local address
+		"fe80::/10",      // IPv6 link local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// IsPrivateIP returns true if addr is a private, loopback or link local
+// address. It returns false for invalid address.
+func IsPrivateIP(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyHost splits IP addresses of the remote host into public and private
+// ones. Invalid addresses are regarded as public to keep them in the report.
+func ClassifyHost(host ReportOpponentHost) (public, private []string) {
+	for _, addr := range host.IPAddr {
+		if IsPrivateIP(addr) {
+			private = append(private, addr)
+		} else {
+			public = append(public, addr)
+		}
+	}
+	return
+}
+
+// FilterPrivateHosts finds private IP addresses in remote hosts and returns
+// warnings for them. If move is true, the addresses are moved to local hosts:
+// a remote host having only private addresses is converted to a local host.
+func FilterPrivateHosts(c *ReportContent, move bool) []string {
+	var warnings []string
+	if c.AlliedHosts == nil {
+		c.AlliedHosts = map[string]ReportAlliedHost{}
+	}
+
+	var ids []string
+	for id := range c.OpponentHosts {
+		ids = append(ids, id)
+	}
+
+	for _, id := range sortedKeys(ids) {
+		host := c.OpponentHosts[id]
+		public, private := ClassifyHost(host)
+		if len(private) == 0 {
+			continue
+		}
+
+		warnings = append(warnings, fmt.Sprintf("Private IP address in remote host %s: %s",
+			id, strings.Join(private, ", ")))
+		if !move {
+			continue
+		}
+
+		allied := ReportAlliedHost{
+			ID:        id,
+			AccountID: host.AccountID,
+			IPAddr:    private,
+		}
+		if len(public) == 0 {
+			delete(c.OpponentHosts, id)
+		} else {
+			host.IPAddr = public
+			c.OpponentHosts[id] = host
+			allied.ID = private[0]
+		}
+
+		local := c.AlliedHosts[allied.ID]
+		local.Merge(allied)
+		c.AlliedHosts[allied.ID] = local
+	}
+
+	return warnings
+}
@@ -0,0 +1,31 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, addr := range []string{
+		"10.0.0.1", "172.16.5.4", "172.31.255.255", "192.168.0.1",
+		"100.64.0.1", "127.0.0.1", "169.254.169.254", "::1", "fd00::1", "fe80::1",
+	} {
+		assert.True(t, lib.IsPrivateIP(addr), addr)
+	}
+
+	for _, addr := range []string{
+		"8.8.8.8", "172.32.0.1", "198.51.100.7", "2001:db8::1", "", "not-an-ip",
+	} {
+		assert.False(t, lib.IsPrivateIP(addr), addr)
+	}
+}
+
+func TestClassifyHost(t *testing.T) {
+	public, private := lib.ClassifyHost(lib.ReportOpponentHost{
+		IPAddr: []string{"203.0.113.5", "10.2.3.4", "192.168.1.1", "8.8.4.4"},
+	})
+	assert.Equal(t, []string{"203.0.113.5", "8.8.4.4"}, public)
+	assert.Equal(t, []string{"10.2.3.4", "192.168.1.1"}, private)
+}
@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCleanupLimit is max number of reports cleaned up by a run of
+// CleanupReports if Limit is not set.
+const DefaultCleanupLimit = 100
+
+// CleanupOption is configuration of CleanupReports.
+type CleanupOption struct {
+	ReportTable string
+	ReportData  string
+	Region      string
+
+	// OpenSearch is set to delete documents of the reports from the index.
+	OpenSearch *OpenSearchConfig
+
+	// Limit is max number of reports cleaned up by a run. DefaultCleanupLimit
+	// is used if 0.
+	Limit int
+
+	// Wait is interval between delete requests to limit consumption of write
+	// capacity.
+	Wait time.Duration
+
+	// Now is current time to decide expiration. time.Now is used if zero.
+	Now time.Time
+}
+
+// CleanupResult is summary of CleanupReports.
+type CleanupResult struct {
+	Reports    []ReportID `json:"reports"`
+	Components int        `json:"components"`
+	Documents  int        `json:"documents"`
+	Links      int        `json:"links"`
+
+	// Remaining is true if Limit is reached and more reports remain.
+	Remaining bool `json:"remaining"`
+}
+
+type reportCleaner struct {
+	opt    CleanupOption
+	table  ReportTable
+	store  ReportStore
+	result *CleanupResult
+}
+
+// wait sleeps between delete requests.
+func (x *reportCleaner) wait() {
+	if x.opt.Wait > 0 {
+		time.Sleep(x.opt.Wait)
+	}
+}
+
+// CleanupReports removes artifacts of expired reports that DynamoDB TTL does
+// not delete yet and of tombstones of merged reports: components (pages and
+// comments), documents in OpenSearch and parent/child links of other reports.
+// Records of expired reports are deleted at last, so a report failed in a run
+// is found again by the next run. Tombstones are kept to redirect to the
+// merged report until they expire. It is safe to run repeatedly.
+func CleanupReports(opt CleanupOption) (result *CleanupResult, err error) {
+	span := StartTrace("CleanupReports")
+	defer func() { span.End(err) }()
+
+	if opt.Now.IsZero() {
+		opt.Now = time.Now()
+	}
+	if opt.Limit <= 0 {
+		opt.Limit = DefaultCleanupLimit
+	}
+
+	cleaner := &reportCleaner{
+		opt:    opt,
+		table:  OpenReportTable(opt.Region, opt.ReportTable, opt.ReportData),
+		store:  OpenReportStore(opt.Region, opt.ReportTable, opt.ReportData),
+		result: &CleanupResult{Reports: []ReportID{}},
+	}
+
+	// Reports stored without severity are also scanned.
+	for _, sev := range searchSeverities("") {
+		records, err := cleaner.table.QueryReports(sev, time.Time{}, opt.Now)
+		if err != nil {
+			return cleaner.result, err
+		}
+
+		for _, record := range records {
+			report, err := record.Report()
+			if err != nil {
+				return cleaner.result, err
+			}
+
+			expired := !record.TimeToLive.IsZero() && record.TimeToLive.Before(opt.Now)
+			if !expired && report.MergedInto == nil {
+				continue
+			}
+
+			if len(cleaner.result.Reports) >= opt.Limit {
+				cleaner.result.Remaining = true
+				return cleaner.result, nil
+			}
+
+			changed, err := cleaner.cleanup(record, *report, expired)
+			if err != nil {
+				return cleaner.result, errors.Wrapf(err, "Fail to clean up report %s", report.ID)
+			}
+			// Tombstones cleaned up by previous runs are not counted.
+			if changed {
+				cleaner.result.Reports = append(cleaner.result.Reports, report.ID)
+			}
+		}
+	}
+
+	Logger.WithField("result", cleaner.result).Info("Cleaned up reports")
+	return cleaner.result, nil
+}
+
+// cleanup removes artifacts of the report. True is returned if anything is
+// removed.
+func (x *reportCleaner) cleanup(record ReportRecord, report Report, expired bool) (bool, error) {
+	linked, err := x.unlink(&report)
+	if err != nil {
+		return false, err
+	}
+	changed := linked || expired
+
+	if x.opt.OpenSearch != nil {
+		deleted, err := DeleteOpenSearchDocument(*x.opt.OpenSearch, report.ID)
+		if err != nil {
+			return false, err
+		}
+		if deleted {
+			x.result.Documents++
+			changed = true
+		}
+	}
+
+	var components []ReportComponent
+	err = retryStore("GetComponents", func() error {
+		var getErr error
+		components, getErr = x.table.GetComponents(report.ID)
+		return getErr
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, c := range components {
+		x.wait()
+		if err := retryStore("DeleteComponent", func() error {
+			return x.table.DeleteComponent(c.ReportID, c.DataID)
+		}); err != nil {
+			return false, err
+		}
+		x.result.Components++
+		changed = true
+	}
+
+	if expired {
+		x.wait()
+		err := retryStore("DeleteReport", func() error {
+			return x.table.DeleteReport(report.ID)
+		})
+		return changed, err
+	}
+
+	// The tombstone is saved without links but keeps its expiration.
+	if linked {
+		updated, err := NewReportRecord(report, record.SourceRegion)
+		if err != nil {
+			return false, err
+		}
+		updated.TimeToLive = record.TimeToLive
+		if err := x.table.PutReport(updated); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// unlink removes links between the report and its parent and children in
+// the report table. True is returned if the report has any link.
+func (x *reportCleaner) unlink(report *Report) (bool, error) {
+	linked := false
+
+	if report.ParentID != nil {
+		parentID := *report.ParentID
+		parent, err := x.store.GetReport(parentID)
+		if err != nil && err != ErrReportNotFound {
+			return false, err
+		}
+		x.wait()
+		if err := x.table.UnlinkReport(parentID, report.ID); err != nil {
+			return false, errors.Wrapf(err, "Fail to unlink parent report %s", parentID)
+		}
+		if parent != nil && parent.Unlink(report) {
+			x.result.Links++
+		}
+		report.ParentID = nil
+		linked = true
+	}
+
+	childIDs := append([]ReportID{}, report.ChildIDs...)
+	for _, childID := range childIDs {
+		child, err := x.store.GetReport(childID)
+		if err != nil && err != ErrReportNotFound {
+			return false, err
+		}
+		x.wait()
+		if err := x.table.UnlinkReport(report.ID, childID); err != nil {
+			return false, errors.Wrapf(err, "Fail to unlink child report %s", childID)
+		}
+		if child != nil && report.Unlink(child) {
+			x.result.Links++
+		}
+		linked = true
+	}
+	report.ChildIDs = nil
+
+	return linked, nil
+}
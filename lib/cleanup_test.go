@@ -0,0 +1,187 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cleanupFixture(t *testing.T) (*lib.MemoryReportTable, func()) {
+	table := lib.NewMemoryReportTable()
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable {
+		return table
+	}
+	return table, func() { lib.OpenReportTable = orig }
+}
+
+func putCleanupReport(t *testing.T, table lib.ReportTable, report lib.Report, ttl time.Time, pages int) {
+	record, err := lib.NewReportRecord(report, "us-east-1")
+	require.NoError(t, err)
+	record.TimeToLive = ttl
+	require.NoError(t, table.PutReport(record))
+
+	for i := 0; i < pages; i++ {
+		component := lib.NewReportComponent(report.ID)
+		require.NoError(t, component.SetPage(lib.ReportPage{ReportID: report.ID, Author: "inspector"}))
+		require.NoError(t, table.PutComponent(component))
+	}
+}
+
+func TestCleanupReports(t *testing.T) {
+	table, restore := cleanupFixture(t)
+	defer restore()
+	search := newMockOpenSearch(t)
+	defer search.srv.Close()
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(24*time.Hour)
+
+	// expired is a child of parent and a parent of child.
+	parentID, expiredID := lib.ReportID("parent"), lib.ReportID("expired")
+	parent := lib.Report{ID: "parent", ReceivedAt: now.Add(-72 * time.Hour), ChildIDs: []lib.ReportID{"expired", "other"}}
+	expired := lib.Report{ID: "expired", ReceivedAt: now.Add(-48 * time.Hour), ParentID: &parentID, ChildIDs: []lib.ReportID{"child"}}
+	child := lib.Report{ID: "child", ReceivedAt: now.Add(-24 * time.Hour), ParentID: &expiredID}
+	active := lib.Report{ID: "active", ReceivedAt: now.Add(-24 * time.Hour)}
+	putCleanupReport(t, table, parent, future, 1)
+	putCleanupReport(t, table, expired, past, 2)
+	putCleanupReport(t, table, child, future, 1)
+	putCleanupReport(t, table, active, future, 1)
+
+	opt := lib.CleanupOption{
+		Region: "us-east-1",
+		Now:    now,
+		OpenSearch: &lib.OpenSearchConfig{
+			Endpoint: search.srv.URL,
+			Username: "user",
+			Password: "pass",
+		},
+	}
+	for _, report := range []lib.Report{expired, active} {
+		require.NoError(t, lib.PublishOpenSearch(*opt.OpenSearch, report))
+	}
+
+	result, err := lib.CleanupReports(opt)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"expired"}, result.Reports)
+	assert.Equal(t, 2, result.Components)
+	assert.Equal(t, 1, result.Documents)
+	assert.Equal(t, 2, result.Links)
+	assert.False(t, result.Remaining)
+
+	// Record, components and document of the expired report are removed.
+	_, err = table.GetReport("expired")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+	components, err := table.GetComponents("expired")
+	require.NoError(t, err)
+	assert.Empty(t, components)
+	assert.NotContains(t, search.docs, "expired")
+	assert.Contains(t, search.docs, "active")
+
+	// Links of other reports to the expired report are removed.
+	store := lib.OpenReportStore("us-east-1", "", "")
+	storedParent, err := store.GetReport("parent")
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"other"}, storedParent.ChildIDs)
+	storedChild, err := store.GetReport("child")
+	require.NoError(t, err)
+	assert.Nil(t, storedChild.ParentID)
+
+	// Other reports are kept.
+	for _, id := range []lib.ReportID{"parent", "child", "active"} {
+		components, err := table.GetComponents(id)
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(components))
+	}
+
+	// Next run has nothing to do.
+	result, err = lib.CleanupReports(opt)
+	require.NoError(t, err)
+	assert.Empty(t, result.Reports)
+	assert.Equal(t, 0, result.Components+result.Documents+result.Links)
+}
+
+func TestCleanupReportsTombstone(t *testing.T) {
+	table, restore := cleanupFixture(t)
+	defer restore()
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	ttl := now.Add(24 * time.Hour)
+
+	primaryID, tombstoneID := lib.ReportID("primary"), lib.ReportID("tombstone")
+	primary := lib.Report{ID: "primary", ReceivedAt: now.Add(-time.Hour), MergedFrom: []lib.ReportID{"tombstone"}}
+	tombstone := lib.Report{ID: "tombstone", ReceivedAt: now.Add(-time.Hour), MergedInto: &primaryID, Status: lib.StatusClosed}
+	child := lib.Report{ID: "child", ReceivedAt: now.Add(-time.Hour), ParentID: &tombstoneID}
+	tombstone.ChildIDs = []lib.ReportID{"child"}
+	putCleanupReport(t, table, primary, ttl, 2)
+	putCleanupReport(t, table, tombstone, ttl, 2)
+	putCleanupReport(t, table, child, ttl, 0)
+
+	result, err := lib.CleanupReports(lib.CleanupOption{Region: "us-east-1", Now: now})
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"tombstone"}, result.Reports)
+	assert.Equal(t, 2, result.Components)
+	assert.Equal(t, 1, result.Links)
+
+	// Tombstone is kept without links and with the same expiration.
+	record, err := table.GetReport("tombstone")
+	require.NoError(t, err)
+	assert.Equal(t, ttl, record.TimeToLive)
+	stored, err := lib.OpenReportStore("us-east-1", "", "").GetReport("tombstone")
+	require.NoError(t, err)
+	assert.Equal(t, primaryID, *stored.MergedInto)
+	assert.Empty(t, stored.ChildIDs)
+
+	components, err := table.GetComponents("primary")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(components))
+
+	// Cleaned tombstone is not counted again.
+	result, err = lib.CleanupReports(lib.CleanupOption{Region: "us-east-1", Now: now})
+	require.NoError(t, err)
+	assert.Empty(t, result.Reports)
+}
+
+func TestCleanupReportsLimit(t *testing.T) {
+	table, restore := cleanupFixture(t)
+	defer restore()
+
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range []lib.ReportID{"r1", "r2", "r3"} {
+		putCleanupReport(t, table, lib.Report{ID: id, ReceivedAt: now.Add(-48 * time.Hour)}, now.Add(-time.Hour), 1)
+	}
+
+	opt := lib.CleanupOption{Region: "us-east-1", Now: now, Limit: 2, Wait: time.Millisecond}
+	result, err := lib.CleanupReports(opt)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(result.Reports))
+	assert.True(t, result.Remaining)
+
+	result, err = lib.CleanupReports(opt)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(result.Reports))
+	assert.False(t, result.Remaining)
+}
+
+func TestCleanupReportsWithoutSeverity(t *testing.T) {
+	table, restore := cleanupFixture(t)
+	defer restore()
+
+	// The record is stored before the severity index.
+	now := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	record, err := lib.NewReportRecord(lib.Report{ID: "legacy", ReceivedAt: now.Add(-48 * time.Hour)}, "us-east-1")
+	require.NoError(t, err)
+	record.Severity = ""
+	record.TimeToLive = now.Add(-time.Hour)
+	require.NoError(t, table.PutReport(record))
+
+	result, err := lib.CleanupReports(lib.CleanupOption{Region: "us-east-1", Now: now})
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"legacy"}, result.Reports)
+
+	_, err = table.GetReport("legacy")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+}
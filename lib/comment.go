@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Comment is an annotation of a report by an analyst.
+type Comment struct {
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// commentDataPrefix is prefix of DataID for components storing a comment
+// instead of a page.
+const commentDataPrefix = "comment:"
+
+// NewCommentComponent is a constructor of ReportComponent that stores the
+// comment. Timestamp is set to current time if it is empty.
+func NewCommentComponent(reportID ReportID, comment Comment) (*ReportComponent, error) {
+	if comment.Author == "" || comment.Text == "" {
+		return nil, errors.New("Author and text of comment are required")
+	}
+	if comment.Timestamp.IsZero() {
+		comment.Timestamp = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(&comment)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal comment")
+	}
+
+	component := NewReportComponent(reportID)
+	component.DataID = commentDataPrefix + component.DataID
+	component.Data = data
+	component.SubmittedAt = time.Now().UTC()
+	component.TimeToLive = component.SubmittedAt.Add(ReportTTL.Max())
+	return component, nil
+}
+
+// IsComment returns true if the component has a comment instead of a page.
+func (x *ReportComponent) IsComment() bool {
+	return strings.HasPrefix(x.DataID, commentDataPrefix)
+}
+
+// Comment returns deserialized comment. nil is returned if the component is
+// not a comment.
+func (x *ReportComponent) Comment() *Comment {
+	if !x.IsComment() {
+		return nil
+	}
+
+	var comment Comment
+	if err := json.Unmarshal(x.Data, &comment); err != nil {
+		log.Println("Invalid comment data format", string(x.Data))
+		return nil
+	}
+	return &comment
+}
+
+// AddComment stores the comment of the report into report data table.
+func AddComment(tableName, region string, id ReportID, c Comment) (err error) {
+	span := StartTrace("AddComment")
+	defer func() { span.End(err) }()
+
+	component, err := NewCommentComponent(id, c)
+	if err != nil {
+		return err
+	}
+
+	return OpenReportTable(region, "", tableName).PutComponent(component)
+}
+
+// FetchComments returns comments of the report in chronological order.
+func FetchComments(tableName, region string, id ReportID) (comments []Comment, err error) {
+	span := StartTrace("FetchComments")
+	defer func() { span.End(err) }()
+
+	components, err := OpenReportTable(region, "", tableName).GetComponents(id)
+	if err != nil {
+		return nil, err
+	}
+
+	comments = []Comment{}
+	for _, component := range components {
+		if comment := component.Comment(); comment != nil {
+			comments = append(comments, *comment)
+		}
+	}
+
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].Timestamp.Before(comments[j].Timestamp)
+	})
+	return comments, nil
+}
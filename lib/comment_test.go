@@ -0,0 +1,73 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddAndFetchComments(t *testing.T) {
+	table := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	id := lib.ReportID("report-1")
+	t1 := time.Date(2019, 1, 28, 1, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	require.NoError(t, lib.AddComment("report-data", "ap-northeast-1", id,
+		lib.Comment{Author: "bob", Text: "Confirmed with the owner", Timestamp: t2}))
+	require.NoError(t, lib.AddComment("report-data", "ap-northeast-1", id,
+		lib.Comment{Author: "alice", Text: "Looking into it", Timestamp: t1}))
+	require.NoError(t, lib.AddComment("report-data", "ap-northeast-1", "report-2",
+		lib.Comment{Author: "alice", Text: "Other report"}))
+	require.Equal(t, 3, len(table.components))
+	assert.True(t, table.components[0].IsComment())
+
+	comments, err := lib.FetchComments("report-data", "ap-northeast-1", id)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(comments))
+	assert.Equal(t, "alice", comments[0].Author)
+	assert.Equal(t, "Looking into it", comments[0].Text)
+	assert.Equal(t, t1, comments[0].Timestamp)
+	assert.Equal(t, "bob", comments[1].Author)
+}
+
+func TestAddCommentRequiresAuthorAndText(t *testing.T) {
+	table := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	assert.Error(t, lib.AddComment("report-data", "ap-northeast-1", "report-1", lib.Comment{Text: "no author"}))
+	assert.Error(t, lib.AddComment("report-data", "ap-northeast-1", "report-1", lib.Comment{Author: "alice"}))
+	assert.Equal(t, 0, len(table.components))
+}
+
+func TestFetchReportPagesSkipsComments(t *testing.T) {
+	id := lib.ReportID("report-1")
+	page := lib.NewReportPage()
+	page.Author = "inspector-a"
+	component := lib.NewReportComponent(id)
+	require.NoError(t, component.SetPage(page))
+
+	table := &mockReportTable{components: []*lib.ReportComponent{component}}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	require.NoError(t, lib.AddComment("report-data", "ap-northeast-1", id,
+		lib.Comment{Author: "alice", Text: "Looking into it"}))
+
+	pages, err := lib.FetchReportPages("report-data", "ap-northeast-1", id)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "inspector-a", pages[0].Author)
+	assert.Nil(t, component.Comment())
+}
+
+func TestRenderMarkDownComments(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Comments = []lib.Comment{
+		{Author: "alice", Text: "Looking into it", Timestamp: time.Date(2019, 1, 28, 1, 0, 0, 0, time.UTC)},
+	}
+	assert.Contains(t, lib.RenderMarkDown(report), "2019-01-28 01:00:00 alice: Looking into it")
+}
@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Sites of Datadog by short name. A full domain such as "us3.datadoghq.com"
+// can be set as DatadogConfig.Site as well.
+var datadogSites = map[string]string{
+	"us":  "datadoghq.com",
+	"us3": "us3.datadoghq.com",
+	"us5": "us5.datadoghq.com",
+	"eu":  "datadoghq.eu",
+	"ap1": "ap1.datadoghq.com",
+}
+
+// Limits of Datadog event fields. Longer values are truncated.
+const (
+	datadogMaxTitle = 100
+	datadogMaxText  = 4000
+	datadogMaxTag   = 200
+)
+
+// DatadogConfig is configuration of PublishDatadog.
+type DatadogConfig struct {
+	APIKey string
+	AppKey string
+
+	// Site is "us" (default), "us3", "us5", "eu", "ap1" or domain of the site.
+	// APIURL overrides it if set.
+	Site   string
+	APIURL string
+
+	// Tags are added to all events, e.g. "env:prod".
+	Tags []string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report. If it is empty, S3 URI of the report
+	// in ArchiveBucket is linked instead.
+	ReportURL     string
+	ArchiveBucket string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+func (x *DatadogConfig) apiURL() (string, error) {
+	if x.APIURL != "" {
+		return strings.TrimRight(x.APIURL, "/"), nil
+	}
+
+	site := strings.ToLower(x.Site)
+	if site == "" {
+		site = "us"
+	}
+	if domain, ok := datadogSites[site]; ok {
+		site = domain
+	} else if !strings.Contains(site, ".") {
+		return "", NewConfigError(fmt.Sprintf("Unknown Datadog site: %s", x.Site))
+	}
+	return "https://api." + site, nil
+}
+
+func (x *DatadogConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+// DatadogEvent is a request body of Events API. Only fields used by
+// NewDatadogEvent are defined.
+type DatadogEvent struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Tags           []string `json:"tags"`
+	AlertType      string   `json:"alert_type"`
+	Priority       string   `json:"priority"`
+	AggregationKey string   `json:"aggregation_key"`
+	SourceTypeName string   `json:"source_type_name,omitempty"`
+}
+
+// datadogTransitions are names of lifecycle transitions by report status.
+var datadogTransitions = map[ReportStatus]string{
+	StatusNew:       "created",
+	StatusOngoing:   "compiled",
+	StatusPublished: "published",
+	StatusClosed:    "closed",
+}
+
+// DatadogAggregationKey returns aggregation_key of events of the report. It
+// is same for recompiled reports so that the events are grouped.
+func DatadogAggregationKey(report Report) string {
+	return string(report.ID)
+}
+
+// datadogTag normalizes a tag as Datadog does: lower case without spaces.
+func datadogTag(tag string) string {
+	tag = strings.ToLower(strings.Join(strings.Fields(tag), "_"))
+	if len(tag) > datadogMaxTag {
+		tag = tag[:datadogMaxTag]
+	}
+	return tag
+}
+
+func datadogAlertType(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "error"
+	case SevSafe:
+		return "info"
+	default:
+		return "warning"
+	}
+}
+
+func datadogLink(cfg DatadogConfig, report Report) string {
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		return link
+	}
+	if cfg.ArchiveBucket != "" {
+		return fmt.Sprintf("s3://%s/%s", cfg.ArchiveBucket, ArchiveKey(report.ID, "report.json"))
+	}
+	return ""
+}
+
+// NewDatadogEvent builds an event of the lifecycle transition of the report.
+func NewDatadogEvent(cfg DatadogConfig, report Report) DatadogEvent {
+	transition, ok := datadogTransitions[report.Status]
+	if !ok {
+		transition = "updated"
+	}
+
+	rule := report.Alert.Rule
+	if rule == "" {
+		rule = report.Alert.Name
+	}
+	title := fmt.Sprintf("[%s] %s report %s", severityLabel(report), rule, transition)
+
+	lines := []string{
+		report.OneLineSummary(),
+		"",
+		fmt.Sprintf("- Remote hosts: %d", len(report.Content.OpponentHosts)),
+		fmt.Sprintf("- Local hosts: %d", len(report.Content.AlliedHosts)),
+		fmt.Sprintf("- Users: %d", len(report.Content.SubjectUsers)),
+		fmt.Sprintf("- Malicious hashes: %d", len(report.Content.MaliciousHashes())),
+		fmt.Sprintf("- Warnings: %d", len(report.Warnings)),
+	}
+	if report.Result.Reason != "" {
+		lines = append(lines, "", "Reason: "+report.Result.Reason)
+	}
+	if link := datadogLink(cfg, report); link != "" {
+		lines = append(lines, "", fmt.Sprintf("[Full report](%s)", link))
+	}
+	// Text between "%%%" is rendered as Markdown.
+	const markdownOpen, markdownClose = "%%% \n", "\n %%%"
+	text := truncateText(strings.Join(lines, "\n"), datadogMaxText-len(markdownOpen)-len(markdownClose))
+
+	severity := report.Result.Severity
+	if severity == "" {
+		severity = SevUnclassified
+	}
+
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range append(append(append([]string{}, cfg.Tags...), report.Labels...),
+		"source:alertresponder",
+		"rule:"+report.Alert.Rule,
+		"severity:"+string(severity),
+		"status:"+string(report.Status),
+	) {
+		if tag = datadogTag(tag); tag != "" && !strings.HasSuffix(tag, ":") && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	priority := "normal"
+	if severity == SevSafe {
+		priority = "low"
+	}
+
+	return DatadogEvent{
+		Title:          truncateText(title, datadogMaxTitle),
+		Text:           markdownOpen + text + markdownClose,
+		Tags:           tags,
+		AlertType:      datadogAlertType(severity),
+		Priority:       priority,
+		AggregationKey: DatadogAggregationKey(report),
+	}
+}
+
+// PublishDatadog posts an event of the report to Events API. Transient
+// failures are retried by cfg.Retry.
+func PublishDatadog(cfg DatadogConfig, report Report) error {
+	if cfg.APIKey == "" {
+		return NewConfigError("Datadog API key is not configured")
+	}
+	apiURL, err := cfg.apiURL()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(NewDatadogEvent(cfg, report))
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal Datadog event")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("DD-API-KEY", cfg.APIKey)
+	if cfg.AppKey != "" {
+		header.Set("DD-APPLICATION-KEY", cfg.AppKey)
+	}
+
+	if _, err := sendHTTPRequest(cfg.Client, http.MethodPost, apiURL+"/api/v1/events", header, body, cfg.retry()); err != nil {
+		if httpErr, ok := err.(*HTTPError); ok &&
+			(httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden) {
+			return WrapCode(ErrCodeInvalidConfig, err, "Datadog API key is rejected")
+		}
+		return WrapCode(ErrCodePublish, err, "Fail to post Datadog event")
+	}
+
+	Logger.WithFields(report.LogFields()).Info("Posted Datadog event")
+	return nil
+}
@@ -0,0 +1,147 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockDatadog is a minimum Datadog Events API server for tests.
+type mockDatadog struct {
+	srv         *httptest.Server
+	events      []lib.DatadogEvent
+	apiKeys     []string
+	unavailable int
+}
+
+func newMockDatadog(t *testing.T) *mockDatadog {
+	x := &mockDatadog{}
+	x.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.apiKeys = append(x.apiKeys, r.Header.Get("DD-API-KEY"))
+		if x.unavailable > 0 {
+			x.unavailable--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("DD-API-KEY") != "test-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/api/v1/events" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var event lib.DatadogEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		x.events = append(x.events, event)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	return x
+}
+
+func (x *mockDatadog) config() lib.DatadogConfig {
+	return lib.DatadogConfig{
+		APIKey:    "test-key",
+		APIURL:    x.srv.URL,
+		Tags:      []string{"env:prod"},
+		ReportURL: "https://reports.example.com/{report_id}",
+		Retry:     lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+}
+
+func TestDatadogEvent(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.AddLabel("C2")
+
+	event := lib.NewDatadogEvent(lib.DatadogConfig{Tags: []string{"env:prod"}, ReportURL: "https://reports.example.com/{report_id}"}, report)
+	assert.Equal(t, "[URGENT] malware-detected report published", event.Title)
+	assert.Equal(t, "error", event.AlertType)
+	assert.Equal(t, "normal", event.Priority)
+	assert.Equal(t, string(report.ID), event.AggregationKey)
+	assert.Equal(t, []string{
+		"env:prod",
+		"c2",
+		"source:alertresponder",
+		"rule:malware-detected",
+		"severity:urgent",
+		"status:published",
+	}, event.Tags)
+
+	assert.True(t, strings.HasPrefix(event.Text, "%%% \n"))
+	assert.True(t, strings.HasSuffix(event.Text, "\n %%%"))
+	assert.Contains(t, event.Text, report.OneLineSummary())
+	assert.Contains(t, event.Text, "- Remote hosts: 2")
+	assert.Contains(t, event.Text, "- Local hosts: 1")
+	assert.Contains(t, event.Text, "[Full report](https://reports.example.com/"+string(report.ID)+")")
+}
+
+func TestDatadogEventArchiveLinkAndLimits(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Alert.Rule = strings.Repeat("n", 200)
+	report.Result.Reason = strings.Repeat("r", 5000)
+	report.Result.Severity = lib.SevSafe
+
+	event := lib.NewDatadogEvent(lib.DatadogConfig{ArchiveBucket: "archive"}, report)
+	assert.Equal(t, 100, len(event.Title))
+	for _, tag := range event.Tags {
+		assert.True(t, len(tag) <= 200, tag)
+	}
+	assert.Equal(t, 4000, len(event.Text))
+	assert.Equal(t, "info", event.AlertType)
+	assert.Equal(t, "low", event.Priority)
+
+	report.Result.Reason = ""
+	event = lib.NewDatadogEvent(lib.DatadogConfig{ArchiveBucket: "archive"}, report)
+	assert.Contains(t, event.Text, "s3://archive/"+lib.ArchiveKey(report.ID, "report.json"))
+}
+
+func TestPublishDatadogRecompile(t *testing.T) {
+	dd := newMockDatadog(t)
+	defer dd.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusOngoing
+	require.NoError(t, lib.PublishDatadog(dd.config(), report))
+
+	// Transient failure is retried.
+	dd.unavailable = 1
+	report.Status = lib.StatusPublished
+	report.Result.Severity = lib.SevUnclassified
+	require.NoError(t, lib.PublishDatadog(dd.config(), report))
+
+	require.Equal(t, 2, len(dd.events))
+	assert.Equal(t, dd.events[0].AggregationKey, dd.events[1].AggregationKey)
+	assert.Contains(t, dd.events[0].Title, "report compiled")
+	assert.Contains(t, dd.events[1].Title, "[UNCLASSIFIED]")
+	assert.Contains(t, dd.events[1].Tags, "severity:unclassified")
+	assert.Equal(t, "warning", dd.events[1].AlertType)
+}
+
+func TestPublishDatadogInvalidConfig(t *testing.T) {
+	dd := newMockDatadog(t)
+	defer dd.srv.Close()
+
+	cfg := dd.config()
+	cfg.APIKey = "wrong"
+	err := lib.PublishDatadog(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+
+	cfg = dd.config()
+	cfg.APIURL = ""
+	cfg.Site = "moon"
+	_, ok := lib.PublishDatadog(cfg, loadFixtureReport(t)).(*lib.ConfigError)
+	assert.True(t, ok)
+
+	_, ok = lib.PublishDatadog(lib.DatadogConfig{}, loadFixtureReport(t)).(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+// MaxExecutionDelay is upper limit of delay of a delay machine. An execution
+// of Step Functions standard workflow can not run longer than one year.
+const MaxExecutionDelay = 365 * 24 * time.Hour
+
+// DelayInputField is a field of execution input that has delay in seconds.
+// Wait state of delay machines refers it by SecondsPath.
+const DelayInputField = "delay_seconds"
+
+// DelayOptions is options of an execution of delay machine.
+type DelayOptions struct {
+	// Delay is wait before the machine processes the report. It is truncated
+	// to seconds.
+	Delay time.Duration
+
+	// Input is extra fields merged into the execution input, e.g. approval
+	// window of containment. Fields of the report and DelayInputField can not
+	// be overwritten.
+	Input map[string]interface{}
+}
+
+// ValidateExecutionDelay checks that delay is within limits of Step Functions.
+// *ConfigError is returned if it is not.
+func ValidateExecutionDelay(delay time.Duration) error {
+	if delay < 0 || delay > MaxExecutionDelay {
+		return NewConfigError(fmt.Sprintf("Delay of execution must be from 0 to %s: %s", MaxExecutionDelay, delay))
+	}
+	return nil
+}
+
+// ParseExecutionDelay parses delay in seconds, e.g. "300", or in duration,
+// e.g. "10m". Empty string means no delay.
+func ParseExecutionDelay(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+
+	delay, err := time.ParseDuration(raw)
+	if err != nil {
+		sec, convErr := strconv.ParseInt(raw, 10, 64)
+		if convErr != nil {
+			return 0, NewConfigError("Invalid delay of execution: " + raw)
+		}
+		delay = time.Duration(sec) * time.Second
+	}
+
+	if err := ValidateExecutionDelay(delay); err != nil {
+		return 0, err
+	}
+	return delay, nil
+}
+
+// ExecutionInput renders input of delay machine, that is the report with
+// DelayInputField and extra fields of opts.
+func ExecutionInput(report Report, opts DelayOptions) ([]byte, error) {
+	if err := ValidateExecutionDelay(opts.Delay); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
+	}
+	var input map[string]json.RawMessage
+	if err := json.Unmarshal(data, &input); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal report data")
+	}
+
+	for key, value := range opts.Input {
+		if _, ok := input[key]; ok || key == DelayInputField {
+			return nil, NewConfigError("Extra input field conflicts with report: " + key)
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal extra input field "+key)
+		}
+		input[key] = raw
+	}
+	input[DelayInputField] = json.RawMessage(strconv.FormatInt(int64(opts.Delay/time.Second), 10))
+
+	data, err = json.Marshal(input)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal execution input")
+	}
+	return data, nil
+}
+
+// ExecDelayMachineWithOptions starts an execution of the state machine for the
+// report and returns ARN of the execution.
+func ExecDelayMachineWithOptions(stateMachineARN string, region string, report Report, opts DelayOptions) (string, error) {
+	data, err := ExecutionInput(report, opts)
+	if err != nil {
+		return "", err
+	}
+
+	svc := SFNClient
+	if svc == nil {
+		svc = sfn.New(newSession(region))
+	}
+
+	input := sfn.StartExecutionInput{
+		Input:           aws.String(string(data)),
+		StateMachineArn: aws.String(stateMachineARN),
+	}
+	resp, err := svc.StartExecution(&input)
+	if err != nil {
+		return "", WrapCode(ErrCodeDispatch, err, "Fail to start execution")
+	}
+
+	execArn := aws.StringValue(resp.ExecutionArn)
+	Logger.WithFields(report.LogFields()).WithField("execution_arn", execArn).
+		WithField("delay", opts.Delay.String()).Debug("Done startExecution")
+	return execArn, nil
+}
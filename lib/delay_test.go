@@ -0,0 +1,124 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSFN struct {
+	sfniface.SFNAPI
+	inputs []*sfn.StartExecutionInput
+}
+
+func (x *mockSFN) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	x.inputs = append(x.inputs, input)
+	return &sfn.StartExecutionOutput{
+		ExecutionArn: aws.String("arn:aws:states:ap-northeast-1:1234567890:execution:review:exec-1"),
+	}, nil
+}
+
+func TestExecutionInputDelay(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Rule: "port-scan"})
+
+	for _, tc := range []struct {
+		delay    time.Duration
+		expected float64
+	}{
+		{0, 0},
+		{10 * time.Minute, 600},
+		{1500 * time.Millisecond, 1},
+		{lib.MaxExecutionDelay, 365 * 24 * 3600},
+	} {
+		data, err := lib.ExecutionInput(report, lib.DelayOptions{Delay: tc.delay})
+		require.NoError(t, err, tc.delay)
+
+		var input map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &input))
+		assert.Equal(t, tc.expected, input[lib.DelayInputField], tc.delay)
+		assert.Equal(t, "r1", input["report_id"], tc.delay)
+
+		// The input is still a report for the machine.
+		var decoded lib.Report
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, report.ID, decoded.ID)
+		assert.Equal(t, "port-scan", decoded.Alert.Rule)
+	}
+
+	for _, delay := range []time.Duration{-time.Second, lib.MaxExecutionDelay + time.Second} {
+		_, err := lib.ExecutionInput(report, lib.DelayOptions{Delay: delay})
+		require.Error(t, err, delay)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, delay)
+	}
+}
+
+func TestExecutionInputExtraFields(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Rule: "port-scan"})
+	data, err := lib.ExecutionInput(report, lib.DelayOptions{
+		Delay: 30 * time.Minute,
+		Input: map[string]interface{}{"approval_window": 1800, "approvers": []string{"soc"}},
+	})
+	require.NoError(t, err)
+
+	var input map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &input))
+	assert.Equal(t, float64(1800), input["delay_seconds"])
+	assert.Equal(t, float64(1800), input["approval_window"])
+	assert.Equal(t, []interface{}{"soc"}, input["approvers"])
+
+	// Fields of the report and the delay can not be overwritten.
+	for _, key := range []string{"report_id", lib.DelayInputField} {
+		_, err := lib.ExecutionInput(report, lib.DelayOptions{Input: map[string]interface{}{key: "x"}})
+		require.Error(t, err, key)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, key)
+	}
+}
+
+func TestParseExecutionDelay(t *testing.T) {
+	for raw, expected := range map[string]time.Duration{
+		"":    0,
+		"0":   0,
+		"300": 5 * time.Minute,
+		"10m": 10 * time.Minute,
+	} {
+		delay, err := lib.ParseExecutionDelay(raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, expected, delay, raw)
+	}
+
+	for _, raw := range []string{"-1", "ten", "9000h"} {
+		_, err := lib.ParseExecutionDelay(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestExecDelayMachineWithOptions(t *testing.T) {
+	client := &mockSFN{}
+	lib.SFNClient = client
+	defer func() { lib.SFNClient = nil }()
+
+	machine := "arn:aws:states:ap-northeast-1:1234567890:stateMachine:review"
+	report := lib.NewReport("r1", lib.Alert{Rule: "port-scan"})
+	execArn, err := lib.ExecDelayMachineWithOptions(machine, "ap-northeast-1", report, lib.DelayOptions{Delay: 10 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, "arn:aws:states:ap-northeast-1:1234567890:execution:review:exec-1", execArn)
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, machine, aws.StringValue(client.inputs[0].StateMachineArn))
+	assert.Contains(t, aws.StringValue(client.inputs[0].Input), `"delay_seconds":600`)
+
+	// Invalid delay does not start execution.
+	_, err = lib.ExecDelayMachineWithOptions(machine, "ap-northeast-1", report, lib.DelayOptions{Delay: -time.Minute})
+	require.Error(t, err)
+	assert.Equal(t, 1, len(client.inputs))
+}
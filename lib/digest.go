@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	lambdaService "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+)
+
+// DigestRule is alert rule of digest reports. A route of PublishRoutes with
+// this rule chooses destinations of digests.
+const DigestRule = "alert-responder-digest"
+
+// DefaultDigestWindow is time span of a digest if DigestConfig has no Window.
+const DefaultDigestWindow = time.Hour
+
+// DigestWindowIndex is name of index of the digest table to query entries by
+// window.
+const DigestWindowIndex = "window-index"
+
+// digestRetention is how long an entry is kept after its window if it is not
+// assembled, e.g. the assembler failed.
+const digestRetention = 7 * 24 * time.Hour
+
+// digestMaxSummaryLen is limit of one-line summary of a report in a digest.
+const digestMaxSummaryLen = 120
+
+// DigestEntry is an item of pending digest table. A report has one entry at
+// most and it is removed when the report is escalated out of digest.
+type DigestEntry struct {
+	ReportID   ReportID       `dynamo:"report_id" json:"report_id"`
+	Window     time.Time      `dynamo:"window" json:"window"`
+	Rule       string         `dynamo:"rule" json:"rule"`
+	Severity   ReportSeverity `dynamo:"severity" json:"severity"`
+	Summary    string         `dynamo:"summary" json:"summary"`
+	ReceivedAt time.Time      `dynamo:"received_at" json:"received_at"`
+	TTL        time.Time      `dynamo:"ttl" json:"-"`
+}
+
+// NewDigestEntry returns an entry of the report in the window.
+func NewDigestEntry(report Report, window time.Time, size time.Duration) DigestEntry {
+	severity := report.Result.Severity
+	if severity == "" {
+		severity = SevUnclassified
+	}
+
+	return DigestEntry{
+		ReportID:   report.ID,
+		Window:     window.UTC(),
+		Rule:       statsRuleName(report.Alert),
+		Severity:   severity,
+		Summary:    digestSummary(report),
+		ReceivedAt: report.ReceivedAt.UTC(),
+		TTL:        window.UTC().Add(size + digestRetention),
+	}
+}
+
+// digestSummary returns title of the alert in one line.
+func digestSummary(report Report) string {
+	summary := strings.Join(strings.Fields(report.Alert.Title()), " ")
+	if report.Alert.Key != "" {
+		summary += " (" + report.Alert.Key + ")"
+	}
+	return templateTruncate(digestMaxSummaryLen, summary)
+}
+
+// DigestTable is a table of pending digest entries.
+type DigestTable interface {
+	PutEntry(entry *DigestEntry) error
+	GetEntries(window time.Time) ([]DigestEntry, error)
+	DeleteEntry(reportID ReportID) error
+}
+
+type dynamoDigestTable struct {
+	region    string
+	tableName string
+}
+
+func (x *dynamoDigestTable) PutEntry(entry *DigestEntry) error {
+	if x.tableName == "" {
+		return NewConfigError("Digest table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Put(entry).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put digest entry to %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+func (x *dynamoDigestTable) GetEntries(window time.Time) ([]DigestEntry, error) {
+	if x.tableName == "" {
+		return nil, NewConfigError("Digest table is not configured")
+	}
+
+	var entries []DigestEntry
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Get("window", window.UTC()).Index(DigestWindowIndex).All(&entries); err != nil {
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to query digest entries from %s in %s", x.tableName, x.region))
+	}
+	return entries, nil
+}
+
+func (x *dynamoDigestTable) DeleteEntry(reportID ReportID) error {
+	if x.tableName == "" {
+		return NewConfigError("Digest table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Delete("report_id", reportID).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to delete digest entry from %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+// OpenDigestTable returns DigestTable of DynamoDB. It can be replaced for
+// testing.
+var OpenDigestTable = func(region, tableName string) DigestTable {
+	return &dynamoDigestTable{region: region, tableName: tableName}
+}
+
+// DigestConfig is configuration of digest mode.
+type DigestConfig struct {
+	Table  string
+	Region string
+
+	// Window is time span of a digest. DefaultDigestWindow is used if 0.
+	Window time.Duration
+
+	// MaxSeverity is the highest severity of digested reports. Reports of
+	// unknown severity are never digested.
+	MaxSeverity ReportSeverity
+}
+
+func (x *DigestConfig) window() time.Duration {
+	if x.Window <= 0 {
+		return DefaultDigestWindow
+	}
+	return x.Window
+}
+
+// WindowOf returns start of the window including t.
+func (x *DigestConfig) WindowOf(t time.Time) time.Time {
+	return t.UTC().Truncate(x.window())
+}
+
+// Digested returns true if the report should be held for digest instead of
+// being published immediately. Digest reports themselves are not digested.
+func (x *DigestConfig) Digested(report Report) bool {
+	if report.Alert.Rule == DigestRule {
+		return false
+	}
+	level := report.Result.Severity.Level()
+	return level > 0 && level <= x.MaxSeverity.Level()
+}
+
+// AddToDigest appends the report to the digest of the window including now.
+// The entry of the report is replaced if it exists.
+func AddToDigest(cfg DigestConfig, report Report, now time.Time) error {
+	entry := NewDigestEntry(report, cfg.WindowOf(now), cfg.window())
+	table := OpenDigestTable(cfg.Region, cfg.Table)
+	return retryStore("PutDigestEntry", func() error {
+		return table.PutEntry(&entry)
+	})
+}
+
+// RemoveFromDigest removes the report from pending digest, e.g. when the
+// report is escalated out of digest severities. It is not an error that the
+// report is not in digest.
+func RemoveFromDigest(cfg DigestConfig, reportID ReportID) error {
+	table := OpenDigestTable(cfg.Region, cfg.Table)
+	return retryStore("DeleteDigestEntry", func() error {
+		return table.DeleteEntry(reportID)
+	})
+}
+
+// Digest is a summary of reports held in a window.
+type Digest struct {
+	Window time.Time `json:"window"`
+	End    time.Time `json:"end"`
+
+	// ByRule is numbers of reports by alert rule, largest first.
+	ByRule []StatsCount `json:"by_rule"`
+
+	// Entries are sorted by received time of reports.
+	Entries []DigestEntry `json:"entries"`
+}
+
+// NewDigest assembles entries of the window into a digest.
+func NewDigest(window time.Time, size time.Duration, entries []DigestEntry) Digest {
+	sorted := append([]DigestEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].ReceivedAt.Equal(sorted[j].ReceivedAt) {
+			return sorted[i].ReceivedAt.Before(sorted[j].ReceivedAt)
+		}
+		return sorted[i].ReportID < sorted[j].ReportID
+	})
+
+	rules := map[string]int{}
+	for _, entry := range sorted {
+		rules[entry.Rule]++
+	}
+
+	return Digest{
+		Window:  window.UTC(),
+		End:     window.UTC().Add(size),
+		ByRule:  topStatsCounts(rules, 0),
+		Entries: sorted,
+	}
+}
+
+// AssembleDigest builds a digest of entries in the window.
+func AssembleDigest(cfg DigestConfig, window time.Time) (*Digest, error) {
+	table := OpenDigestTable(cfg.Region, cfg.Table)
+
+	var entries []DigestEntry
+	err := retryStore("GetDigestEntries", func() error {
+		var getErr error
+		entries, getErr = table.GetEntries(window)
+		return getErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := NewDigest(window, cfg.window(), entries)
+	return &digest, nil
+}
+
+// ClearDigest deletes entries of the published digest.
+func ClearDigest(cfg DigestConfig, digest Digest) error {
+	for _, entry := range digest.Entries {
+		if err := RemoveFromDigest(cfg, entry.ReportID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DigestLinks is destinations of links to reports in a digest. ReportURL is
+// a template of link to the full report, and S3 URI of the report in
+// ArchiveBucket is linked if it is empty.
+type DigestLinks struct {
+	ReportURL     string
+	ArchiveBucket string
+}
+
+func (x DigestLinks) link(reportID ReportID) string {
+	if link := reportLink(x.ReportURL, Report{ID: reportID}); link != "" {
+		return link
+	}
+	if x.ArchiveBucket != "" {
+		return fmt.Sprintf("s3://%s/%s", x.ArchiveBucket, ArchiveKey(reportID, "report.json"))
+	}
+	return ""
+}
+
+// digestCell escapes a value in a cell of Markdown table.
+func digestCell(s string) string {
+	return strings.Replace(s, "|", "\\|", -1)
+}
+
+// Markdown renders the digest with counts by rule and a table of reports.
+func (x Digest) Markdown(links DigestLinks) string {
+	lines := []string{
+		fmt.Sprintf("# Digest of %d report(s)", len(x.Entries)),
+		"",
+		fmt.Sprintf("%s - %s", x.Window.Format("2006-01-02 15:04"), x.End.Format("2006-01-02 15:04 MST")),
+		"",
+		"## Rules",
+		"",
+		"| Rule | Reports |",
+		"|------|---------|",
+	}
+	for _, count := range x.ByRule {
+		lines = append(lines, fmt.Sprintf("| %s | %d |", digestCell(count.Name), count.Count))
+	}
+
+	lines = append(lines, "", "## Reports", "",
+		"| Report ID | Severity | Summary | Link |",
+		"|-----------|----------|---------|------|")
+	for _, entry := range x.Entries {
+		lines = append(lines, fmt.Sprintf("| %s | %s | %s | %s |",
+			entry.ReportID, entry.Severity, digestCell(entry.Summary), links.link(entry.ReportID)))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Report returns a report of the digest to be published by PublishRouter.
+// Its rule is DigestRule and its severity is the highest one of the entries.
+// ID of the report is same for the window.
+func (x Digest) Report(links DigestLinks) Report {
+	var severity ReportSeverity
+	for _, entry := range x.Entries {
+		if entry.Severity.Level() > severity.Level() {
+			severity = entry.Severity
+		}
+	}
+
+	window := x.Window.Format("2006-01-02T15:04:05Z")
+	alert := Alert{
+		Name:        "Digest",
+		Rule:        DigestRule,
+		Key:         window,
+		Description: fmt.Sprintf("%d report(s) from %s", len(x.Entries), window),
+		ReceivedAt:  x.End,
+	}
+
+	report := NewReport(ReportID("digest-"+x.Window.Format("20060102T150405Z")), alert)
+	report.Status = StatusPublished
+	report.Result = ReportResult{
+		Severity: severity,
+		Reason:   fmt.Sprintf("Digest of reports received between %s and %s", window, x.End.Format("2006-01-02T15:04:05Z")),
+	}
+	report.Text = x.Markdown(links)
+	return report
+}
+
+// LambdaClient is a client used by PublishDigest. A client of the region is
+// created if nil.
+var LambdaClient lambdaiface.LambdaAPI
+
+// PublishDigest invokes the publisher function with the digest report, so
+// that the digest is published through PublishRouter as other reports.
+func PublishDigest(funcName, region string, report Report) (err error) {
+	span := StartTrace("PublishDigest")
+	defer func() { span.End(err) }()
+
+	if funcName == "" {
+		return NewConfigError("Publisher function is not configured")
+	}
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal digest report")
+	}
+
+	client := LambdaClient
+	if client == nil {
+		client = lambdaService.New(newSession(region))
+	}
+
+	resp, err := client.Invoke(&lambdaService.InvokeInput{
+		FunctionName: aws.String(funcName),
+		Payload:      payload,
+	})
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to invoke publisher")
+	}
+	if resp.FunctionError != nil {
+		return WrapCode(ErrCodePublish, errors.New(string(resp.Payload)),
+			fmt.Sprintf("Publisher failed to publish digest: %s", aws.StringValue(resp.FunctionError)))
+	}
+
+	Logger.WithFields(report.LogFields()).WithField("function", funcName).Info("Published digest")
+	return nil
+}
@@ -0,0 +1,211 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDigestTable struct {
+	entries map[lib.ReportID]lib.DigestEntry
+}
+
+func (x *mockDigestTable) PutEntry(entry *lib.DigestEntry) error {
+	x.entries[entry.ReportID] = *entry
+	return nil
+}
+
+func (x *mockDigestTable) GetEntries(window time.Time) ([]lib.DigestEntry, error) {
+	var entries []lib.DigestEntry
+	for _, entry := range x.entries {
+		if entry.Window.Equal(window) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (x *mockDigestTable) DeleteEntry(reportID lib.ReportID) error {
+	delete(x.entries, reportID)
+	return nil
+}
+
+func mockDigestTables(table *mockDigestTable) func() {
+	orig := lib.OpenDigestTable
+	lib.OpenDigestTable = func(region, tableName string) lib.DigestTable {
+		return table
+	}
+	return func() { lib.OpenDigestTable = orig }
+}
+
+type mockLambda struct {
+	lambdaiface.LambdaAPI
+	inputs        []*lambda.InvokeInput
+	functionError string
+}
+
+func (x *mockLambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	x.inputs = append(x.inputs, input)
+	if x.functionError != "" {
+		return &lambda.InvokeOutput{
+			FunctionError: aws.String(x.functionError),
+			Payload:       []byte(`{"errorMessage":"boom"}`),
+		}, nil
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200)}, nil
+}
+
+var testDigestWindow = time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+
+func loadDigestEntries(t *testing.T) []lib.DigestEntry {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "digest_entries.json"))
+	require.NoError(t, err)
+
+	var entries []lib.DigestEntry
+	require.NoError(t, json.Unmarshal(raw, &entries))
+	return entries
+}
+
+func TestNewDigest(t *testing.T) {
+	digest := lib.NewDigest(testDigestWindow, time.Hour, loadDigestEntries(t))
+	assert.Equal(t, testDigestWindow.Add(time.Hour), digest.End)
+	assert.Equal(t, []lib.StatsCount{{Name: "port-scan", Count: 2}, {Name: "brute-force", Count: 1}}, digest.ByRule)
+
+	// Entries are sorted by received time.
+	require.Equal(t, 3, len(digest.Entries))
+	assert.Equal(t, lib.ReportID("a1e9d0b3-9c4d-4b66-8e09-2b1c0d3e4f59"), digest.Entries[0].ReportID)
+	assert.Equal(t, lib.ReportID("c3a1f2d5-1e6f-4d88-a01b-4d3e2f5a6b7c"), digest.Entries[2].ReportID)
+
+	links := lib.DigestLinks{ReportURL: "https://example.com/reports/{report_id}"}
+	assertGolden(t, "digest.md", digest.Markdown(links))
+}
+
+func TestDigestMarkdownArchiveLink(t *testing.T) {
+	digest := lib.NewDigest(testDigestWindow, time.Hour, loadDigestEntries(t))
+	md := digest.Markdown(lib.DigestLinks{ArchiveBucket: "archive-bucket"})
+	assert.Contains(t, md, "s3://archive-bucket/"+lib.ArchiveKey("a1e9d0b3-9c4d-4b66-8e09-2b1c0d3e4f59", "report.json"))
+}
+
+func TestDigestReport(t *testing.T) {
+	digest := lib.NewDigest(testDigestWindow, time.Hour, loadDigestEntries(t))
+	links := lib.DigestLinks{ReportURL: "https://example.com/reports/{report_id}"}
+	report := digest.Report(links)
+
+	assert.Equal(t, lib.ReportID("digest-20261015T100000Z"), report.ID)
+	assert.Equal(t, lib.DigestRule, report.Alert.Rule)
+	assert.Equal(t, lib.SevUnclassified, report.Result.Severity)
+	assert.Equal(t, lib.StatusPublished, report.Status)
+	assert.Equal(t, digest.Markdown(links), report.Text)
+
+	// Digest report is routed by its rule.
+	routes, err := lib.ParsePublishRoutes(`{"routes": [{"name": "digest", "rules": ["` + lib.DigestRule + `"], "actions": ["slack"]}], "default": ["sns"]}`)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.NoError(t, err)
+	name, _ := router.Route(report)
+	assert.Equal(t, "digest", name)
+
+	cfg := lib.DigestConfig{MaxSeverity: lib.SevUnclassified}
+	assert.False(t, cfg.Digested(report))
+}
+
+func TestDigestConfigDigested(t *testing.T) {
+	cfg := lib.DigestConfig{MaxSeverity: lib.SevSafe}
+	testCases := []struct {
+		sev      lib.ReportSeverity
+		digested bool
+	}{
+		{lib.SevSafe, true},
+		{lib.SevUnclassified, false},
+		{lib.SevUrgent, false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		report := lib.Report{}
+		report.Result.Severity = tc.sev
+		assert.Equal(t, tc.digested, cfg.Digested(report), string(tc.sev))
+	}
+
+	// No report is digested without MaxSeverity.
+	report := lib.Report{}
+	report.Result.Severity = lib.SevSafe
+	assert.False(t, (&lib.DigestConfig{}).Digested(report))
+
+	assert.Equal(t, testDigestWindow, cfg.WindowOf(testDigestWindow.Add(59*time.Minute)))
+	cfg.Window = 15 * time.Minute
+	assert.Equal(t, testDigestWindow.Add(45*time.Minute), cfg.WindowOf(testDigestWindow.Add(59*time.Minute)))
+}
+
+func TestAssembleDigest(t *testing.T) {
+	table := &mockDigestTable{entries: map[lib.ReportID]lib.DigestEntry{}}
+	defer mockDigestTables(table)()
+	cfg := lib.DigestConfig{Table: "digest", Region: "us-east-1", MaxSeverity: lib.SevSafe}
+
+	now := testDigestWindow.Add(30 * time.Minute)
+	for i, id := range []lib.ReportID{"r1", "r2", "r3"} {
+		report := loadFixtureReport(t)
+		report.ID = id
+		report.Result.Severity = lib.SevSafe
+		report.ReceivedAt = testDigestWindow.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, lib.AddToDigest(cfg, report, now))
+	}
+	// Report in the next window is not included.
+	next := loadFixtureReport(t)
+	next.ID = "r4"
+	require.NoError(t, lib.AddToDigest(cfg, next, now.Add(time.Hour)))
+
+	// r2 is escalated out of digest in the window.
+	require.NoError(t, lib.RemoveFromDigest(cfg, "r2"))
+
+	digest, err := lib.AssembleDigest(cfg, testDigestWindow)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(digest.Entries))
+	assert.Equal(t, lib.ReportID("r1"), digest.Entries[0].ReportID)
+	assert.Equal(t, lib.ReportID("r3"), digest.Entries[1].ReportID)
+	assert.Equal(t, lib.SevSafe, digest.Entries[0].Severity)
+	assert.NotContains(t, digest.Entries[0].Summary, "\n")
+	assert.True(t, digest.Entries[0].TTL.After(digest.End))
+
+	require.NoError(t, lib.ClearDigest(cfg, *digest))
+	assert.Equal(t, 1, len(table.entries))
+	_, ok := table.entries["r4"]
+	assert.True(t, ok)
+
+	// Removing a report not in digest is not an error.
+	require.NoError(t, lib.RemoveFromDigest(cfg, "r5"))
+}
+
+func TestPublishDigest(t *testing.T) {
+	client := &mockLambda{}
+	lib.LambdaClient = client
+	defer func() { lib.LambdaClient = nil }()
+
+	digest := lib.NewDigest(testDigestWindow, time.Hour, loadDigestEntries(t))
+	report := digest.Report(lib.DigestLinks{})
+	require.NoError(t, lib.PublishDigest("publisher", "us-east-1", report))
+
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, "publisher", aws.StringValue(client.inputs[0].FunctionName))
+	var invoked lib.Report
+	require.NoError(t, json.Unmarshal(client.inputs[0].Payload, &invoked))
+	assert.Equal(t, report.ID, invoked.ID)
+
+	client.functionError = "Unhandled"
+	err := lib.PublishDigest("publisher", "us-east-1", report)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "boom")
+
+	_, ok := lib.PublishDigest("", "us-east-1", report).(*lib.ConfigError)
+	assert.True(t, ok)
+}
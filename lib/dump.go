@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DebugBucket is S3 bucket to store dumped objects. Dump writes only logs
+	// if it is empty.
+	DebugBucket = os.Getenv("DEBUG_BUCKET")
+
+	// DebugS3 is S3 client for DebugBucket. A client of AWS_REGION is created
+	// if nil.
+	DebugS3 s3iface.S3API
+)
+
+// dumpKey returns an S3 key for the object. Keys are prefixed by date to find
+// dumps of an incident easily.
+func dumpKey(name string, now time.Time) string {
+	return fmt.Sprintf("dump/%s/%s-%s-%s.json",
+		now.Format("2006/01/02"), now.Format("150405.000000"), name, NewUUID())
+}
+
+// Dump writes the object to debug log. If DebugBucket is set, the object is
+// also written to the bucket as JSON and the key is returned to reproduce the
+// issue from real payload. Empty key is returned if DebugBucket is not set.
+func Dump(name string, obj interface{}) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal dump: "+name)
+	}
+
+	if DebugBucket == "" {
+		Logger.WithField("name", name).WithField("data", string(data)).Debug("Dump")
+		return "", nil
+	}
+
+	client := DebugS3
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	key := dumpKey(name, time.Now().UTC())
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(DebugBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Fail to put dump to s3://%s/%s", DebugBucket, key)
+	}
+
+	Logger.WithFields(map[string]interface{}{
+		"name":   name,
+		"bucket": DebugBucket,
+		"key":    key,
+		"size":   len(data),
+	}).Debug("Dump to S3")
+	return key, nil
+}
@@ -0,0 +1,48 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpToS3(t *testing.T) {
+	defer func(bucket string) { lib.DebugBucket = bucket }(lib.DebugBucket)
+	defer func() { lib.DebugS3 = nil }()
+
+	client := &mockS3{}
+	lib.DebugBucket = "debug-bucket"
+	lib.DebugS3 = client
+
+	report := loadFixtureReport(t)
+	key, err := lib.Dump("report", report)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^dump/\d{4}/\d{2}/\d{2}/\d{6}\.\d{6}-report-.+\.json$`), key)
+
+	require.Equal(t, 1, len(client.puts))
+	assert.Equal(t, "debug-bucket", aws.StringValue(client.puts[0].Bucket))
+	assert.Equal(t, key, aws.StringValue(client.puts[0].Key))
+	assert.Equal(t, "application/json", aws.StringValue(client.puts[0].ContentType))
+
+	var dumped lib.Report
+	require.NoError(t, json.Unmarshal([]byte(client.objects["debug-bucket/"+key]), &dumped))
+	assert.Equal(t, report.ID, dumped.ID)
+}
+
+func TestDumpWithoutBucket(t *testing.T) {
+	defer func(bucket string) { lib.DebugBucket = bucket }(lib.DebugBucket)
+	client := &mockS3{}
+	lib.DebugBucket = ""
+	lib.DebugS3 = client
+	defer func() { lib.DebugS3 = nil }()
+
+	key, err := lib.Dump("report", loadFixtureReport(t))
+	require.NoError(t, err)
+	assert.Equal(t, "", key)
+	assert.Equal(t, 0, len(client.puts))
+}
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/pkg/errors"
+)
+
+// EmailConfig is configuration of PublishEmail.
+type EmailConfig struct {
+	Region     string
+	Sender     string
+	Recipients []string
+
+	// SeverityRecipients overrides Recipients for reports of the severity.
+	SeverityRecipients map[ReportSeverity][]string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	// TemplateBucket and TemplateKey specify S3 object of html/template that
+	// overrides the default HTML body.
+	TemplateBucket string
+	TemplateKey    string
+
+	// Templates renders subject and HTML body. The HTML template in S3 takes
+	// precedence over the body. Default templates are used if nil.
+	Templates *NotificationTemplates
+
+	// Locale is locale of subject and HTML body. Empty means DefaultLocale.
+	Locale string
+
+	// SES and S3 clients. They are created for Region if nil.
+	SES sesiface.SESAPI
+	S3  s3iface.S3API
+}
+
+// recipients returns destinations of the report.
+func (x *EmailConfig) recipients(report Report) []string {
+	if rcpt := x.SeverityRecipients[report.Result.Severity]; len(rcpt) > 0 {
+		return rcpt
+	}
+	return x.Recipients
+}
+
+const defaultEmailTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>{{.Subject}}</title></head>
+<body style="font-family: sans-serif; color: #333333;">
+<div style="background-color: {{.Color}}; color: #ffffff; padding: 12px;">
+  <h2 style="margin: 0;">{{.Severity}}: {{.Title}}</h2>
+</div>
+<table cellpadding="4">
+  <tr><th align="left">{{.T "report_id"}}</th><td>{{.Report.ID}}</td></tr>
+  <tr><th align="left">{{.T "rule"}}</th><td>{{.Report.Alert.Rule}}</td></tr>
+  <tr><th align="left">{{.T "key"}}</th><td>{{.Report.Alert.Key}}</td></tr>
+  <tr><th align="left">{{.T "status"}}</th><td>{{.Report.Status}}</td></tr>
+  {{- if .Report.Result.Reason}}
+  <tr><th align="left">{{.T "reason"}}</th><td>{{.Report.Result.Reason}}</td></tr>
+  {{- end}}
+</table>
+{{- if .RemoteHosts}}
+<h3>{{.T "remote_hosts"}}</h3>
+<table border="1" cellpadding="4" style="border-collapse: collapse;">
+  <tr><th>ID</th><th>{{.T "ip_address"}}</th><th>{{.T "country"}}</th><th>{{.T "as_owner"}}</th><th>{{.T "malware"}}</th><th>{{.T "domains"}}</th><th>{{.T "urls"}}</th></tr>
+  {{- range .RemoteHosts}}
+  <tr><td>{{.ID}}</td><td>{{join .IPAddr}}</td><td>{{join .Country}}</td><td>{{join .ASOwner}}</td><td>{{len .RelatedMalware}}</td><td>{{len .RelatedDomains}}</td><td>{{len .RelatedURLs}}</td></tr>
+  {{- end}}
+</table>
+{{- end}}
+{{- if .LocalHosts}}
+<h3>{{.T "local_hosts"}}</h3>
+<table border="1" cellpadding="4" style="border-collapse: collapse;">
+  <tr><th>ID</th><th>{{.T "user"}}</th><th>{{.T "owner"}}</th><th>{{.T "os"}}</th><th>{{.T "ip_address"}}</th><th>{{.T "hostname"}}</th></tr>
+  {{- range .LocalHosts}}
+  <tr><td>{{.ID}}</td><td>{{join .UserName}}</td><td>{{join .Owner}}</td><td>{{join .OS}}</td><td>{{join .IPAddr}}</td><td>{{join .HostName}}</td></tr>
+  {{- end}}
+</table>
+{{- end}}
+{{- if .Timeline}}
+<h3>{{.T "timeline"}}</h3>
+<ul>
+  {{- range .Timeline}}
+  <li>{{.Time.Format "2006-01-02 15:04:05"}} {{.Description}}</li>
+  {{- end}}
+</ul>
+{{- end}}
+{{- if .Report.Warnings}}
+<h3>{{.T "warnings"}}</h3>
+<ul>
+  {{- range .Report.Warnings}}
+  <li>{{.}}</li>
+  {{- end}}
+</ul>
+{{- end}}
+{{- if .ReportURL}}
+<p><a href="{{.ReportURL}}">{{.T "full_report"}}</a></p>
+{{- end}}
+</body>
+</html>
+`
+
+var emailFuncs = template.FuncMap{
+	"join": func(items []string) string { return strings.Join(items, ", ") },
+}
+
+// ParseEmailTemplate parses html/template for email body. Function "join"
+// is available in addition to builtin ones.
+func ParseEmailTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("email").Funcs(emailFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to parse email template")
+	}
+	return tmpl, nil
+}
+
+// LoadEmailTemplate reads html/template from S3 object.
+func LoadEmailTemplate(client s3iface.S3API, bucket, key string) (*template.Template, error) {
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get email template s3://%s/%s", bucket, key)
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read email template")
+	}
+
+	return ParseEmailTemplate(string(raw))
+}
+
+// EmailSubject returns subject of email for the report by the default
+// template.
+func EmailSubject(report Report) string {
+	return fmt.Sprintf("[%s] %s: %s", severityLabel(report), report.Alert.Rule, report.Alert.Key)
+}
+
+// RenderEmailHTML renders HTML body of the report by the template. Dot of the
+// template is NotificationData. The default template is used if tmpl is nil.
+func RenderEmailHTML(tmpl *template.Template, report Report, reportURL string) (string, error) {
+	if tmpl == nil {
+		var err error
+		if tmpl, err = ParseEmailTemplate(defaultEmailTemplate); err != nil {
+			return "", err
+		}
+	}
+
+	data := NewNotificationData(report, reportURL)
+	data.Subject = EmailSubject(report)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "Fail to render email")
+	}
+	return buf.String(), nil
+}
+
+func writeEmailPart(w *multipart.Writer, contentType, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// BuildEmailMessage builds a raw MIME message with plain text (Markdown) and
+// HTML alternatives.
+func BuildEmailMessage(sender string, recipients []string, report Report, html string) ([]byte, error) {
+	return buildEmailMessage(sender, recipients, EmailSubject(report), report, html)
+}
+
+func buildEmailMessage(sender string, recipients []string, subject string, report Report, html string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", sender)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	w := multipart.NewWriter(&buf)
+	// Boundary is fixed per report to keep the message reproducible.
+	if err := w.SetBoundary("alert-responder-" + string(report.ID)); err != nil {
+		return nil, errors.Wrap(err, "Fail to set MIME boundary")
+	}
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", w.Boundary())
+
+	if err := writeEmailPart(w, "text/plain; charset=UTF-8", RenderMarkDown(report)); err != nil {
+		return nil, errors.Wrap(err, "Fail to write plain text part")
+	}
+	if err := writeEmailPart(w, "text/html; charset=UTF-8", html); err != nil {
+		return nil, errors.Wrap(err, "Fail to write HTML part")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "Fail to close MIME message")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// PublishEmail sends the report by SES as a multipart email.
+func PublishEmail(cfg EmailConfig, report Report) error {
+	recipients := cfg.recipients(report)
+	if cfg.Sender == "" || len(recipients) == 0 {
+		return NewConfigError("Email sender and recipients are not configured")
+	}
+
+	text := cfg.Templates.Render(NotifyEmail, report, cfg.ReportURL, cfg.Locale)
+	html := text.Body
+	if cfg.TemplateBucket != "" && cfg.TemplateKey != "" {
+		client := cfg.S3
+		if client == nil {
+			client = s3.New(newSession(cfg.Region))
+		}
+
+		tmpl, err := LoadEmailTemplate(client, cfg.TemplateBucket, cfg.TemplateKey)
+		if err != nil {
+			return err
+		}
+		if html, err = RenderEmailHTML(tmpl, report, cfg.ReportURL); err != nil {
+			return err
+		}
+	}
+
+	msg, err := buildEmailMessage(cfg.Sender, recipients, text.Title, report, html)
+	if err != nil {
+		return err
+	}
+
+	client := cfg.SES
+	if client == nil {
+		client = ses.New(newSession(cfg.Region))
+	}
+
+	resp, err := client.SendRawEmail(&ses.SendRawEmailInput{
+		Source:       aws.String(cfg.Sender),
+		Destinations: aws.StringSlice(recipients),
+		RawMessage:   &ses.RawMessage{Data: msg},
+	})
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to send email")
+	}
+
+	Logger.WithField("response", resp).Info("Done SES SendRawEmail")
+	return nil
+}
@@ -0,0 +1,176 @@
+package lib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSES struct {
+	sesiface.SESAPI
+	inputs []*ses.SendRawEmailInput
+}
+
+func (x *mockSES) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	x.inputs = append(x.inputs, input)
+	return &ses.SendRawEmailOutput{MessageId: aws.String("test-message")}, nil
+}
+
+type mockS3 struct {
+	s3iface.S3API
+	objects map[string]string
+	puts    []*s3.PutObjectInput
+	deletes []*s3.DeleteObjectInput
+}
+
+func (x *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if x.objects == nil {
+		x.objects = map[string]string{}
+	}
+	x.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = string(data)
+	x.puts = append(x.puts, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (x *mockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(x.objects, aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key))
+	x.deletes = append(x.deletes, input)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (x *mockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data := x.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(data))}, nil
+}
+
+// readEmailParts parses raw message and returns decoded bodies by content type.
+func readEmailParts(t *testing.T, raw []byte) (*mail.Message, map[string]string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	require.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// NextPart decodes quoted-printable body. Line breaks of text parts
+		// are CRLF in the message.
+		body, err := ioutil.ReadAll(part)
+		require.NoError(t, err)
+		parts[part.Header.Get("Content-Type")] = strings.Replace(string(body), "\r\n", "\n", -1)
+	}
+
+	return msg, parts
+}
+
+func TestEmailHTMLGolden(t *testing.T) {
+	html, err := lib.RenderEmailHTML(nil, loadFixtureReport(t), "https://reports.example.com/{report_id}.json")
+	require.NoError(t, err)
+	assertGolden(t, "email.html", html)
+}
+
+func TestPublishEmail(t *testing.T) {
+	report := loadFixtureReport(t)
+	client := &mockSES{}
+	cfg := lib.EmailConfig{
+		Sender:     "alert@example.com",
+		Recipients: []string{"soc@example.com", "ops@example.com"},
+		SES:        client,
+	}
+
+	require.NoError(t, lib.PublishEmail(cfg, report))
+	require.Equal(t, 1, len(client.inputs))
+
+	input := client.inputs[0]
+	assert.Equal(t, "alert@example.com", aws.StringValue(input.Source))
+	assert.Equal(t, []string{"soc@example.com", "ops@example.com"}, aws.StringValueSlice(input.Destinations))
+	require.NotNil(t, input.RawMessage)
+
+	msg, parts := readEmailParts(t, input.RawMessage.Data)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, lib.EmailSubject(report), subject)
+	assert.Contains(t, subject, report.Alert.Rule)
+	assert.Contains(t, subject, report.Alert.Key)
+	assert.Contains(t, subject, strings.ToUpper(string(report.Result.Severity)))
+
+	require.Equal(t, 2, len(parts))
+	assert.Equal(t, lib.RenderMarkDown(report), parts["text/plain; charset=UTF-8"])
+	html, err := lib.RenderEmailHTML(nil, report, "")
+	require.NoError(t, err)
+	assert.Equal(t, html, parts["text/html; charset=UTF-8"])
+}
+
+func TestPublishEmailSeverityRecipients(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevUrgent
+	client := &mockSES{}
+	cfg := lib.EmailConfig{
+		Sender:     "alert@example.com",
+		Recipients: []string{"soc@example.com"},
+		SeverityRecipients: map[lib.ReportSeverity][]string{
+			lib.SevUrgent: {"oncall@example.com"},
+		},
+		SES: client,
+	}
+
+	require.NoError(t, lib.PublishEmail(cfg, report))
+	report.Result.Severity = lib.SevSafe
+	require.NoError(t, lib.PublishEmail(cfg, report))
+
+	require.Equal(t, 2, len(client.inputs))
+	assert.Equal(t, []string{"oncall@example.com"}, aws.StringValueSlice(client.inputs[0].Destinations))
+	assert.Equal(t, []string{"soc@example.com"}, aws.StringValueSlice(client.inputs[1].Destinations))
+}
+
+func TestPublishEmailTemplateFromS3(t *testing.T) {
+	client := &mockSES{}
+	cfg := lib.EmailConfig{
+		Sender:         "alert@example.com",
+		Recipients:     []string{"soc@example.com"},
+		TemplateBucket: "templates",
+		TemplateKey:    "email.html",
+		SES:            client,
+		S3: &mockS3{objects: map[string]string{
+			"templates/email.html": "<p>{{.Severity}} {{.Report.ID}}</p>",
+		}},
+	}
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishEmail(cfg, report))
+	require.Equal(t, 1, len(client.inputs))
+
+	_, parts := readEmailParts(t, client.inputs[0].RawMessage.Data)
+	assert.Equal(t, "<p>"+strings.ToUpper(string(report.Result.Severity))+" "+string(report.ID)+"</p>",
+		parts["text/html; charset=UTF-8"])
+}
+
+func TestPublishEmailNoRecipient(t *testing.T) {
+	err := lib.PublishEmail(lib.EmailConfig{Sender: "alert@example.com", SES: &mockSES{}}, loadFixtureReport(t))
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
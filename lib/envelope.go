@@ -0,0 +1,310 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxMessageSize is threshold of a serialized report to be published
+// as it is. SNS limits a message to 256KB including attributes, so some room
+// is left for them.
+const DefaultMaxMessageSize = 250 * 1024
+
+// ReportEnvelopeType is value of "type" field of ReportEnvelope. Report has
+// no "type" field, so subscribers can distinguish envelopes by it.
+const ReportEnvelopeType = "report_envelope"
+
+// ReportEnvelope is a compact message published instead of a report that is
+// too large for SNS. The full report is stored in S3 by ArchiveReport.
+type ReportEnvelope struct {
+	Type            string         `json:"type"`
+	ReportID        ReportID       `json:"report_id"`
+	Severity        ReportSeverity `json:"severity"`
+	Status          ReportStatus   `json:"status"`
+	Rule            string         `json:"rule"`
+	Summary         string         `json:"summary"`
+	RemoteHosts     int            `json:"remote_hosts"`
+	LocalHosts      int            `json:"local_hosts"`
+	Users           int            `json:"users"`
+	MaliciousHashes int            `json:"malicious_hashes"`
+	TopIndicators   []string       `json:"top_indicators"`
+
+	// Size is length of the serialized full report in bytes.
+	Size int `json:"size"`
+
+	// S3URL is location of the full report, e.g. s3://bucket/reports/xxx/report.json
+	// It is empty if the full report is not stored. Subscribers get the
+	// report from the report table by ReportID then.
+	S3URL string `json:"s3_url,omitempty"`
+	// PresignedURL is a link to download the full report without AWS
+	// credentials. It is empty if presigning is disabled.
+	PresignedURL string `json:"presigned_url,omitempty"`
+}
+
+// envelopeMaxIndicators is number of indicators in an envelope.
+const envelopeMaxIndicators = 5
+
+// NewReportEnvelope builds an envelope of the report stored at s3URL.
+func NewReportEnvelope(report Report, size int, s3URL, presignedURL string) ReportEnvelope {
+	indicators := report.TopIndicators(envelopeMaxIndicators)
+	if indicators == nil {
+		indicators = []string{}
+	}
+
+	return ReportEnvelope{
+		Type:            ReportEnvelopeType,
+		ReportID:        report.ID,
+		Severity:        report.Result.Severity,
+		Status:          report.Status,
+		Rule:            report.Alert.Rule,
+		Summary:         report.OneLineSummary(),
+		RemoteHosts:     len(report.Content.OpponentHosts),
+		LocalHosts:      len(report.Content.AlliedHosts),
+		Users:           len(report.Content.SubjectUsers),
+		MaliciousHashes: len(report.Content.MaliciousHashes()),
+		TopIndicators:   indicators,
+		Size:            size,
+		S3URL:           s3URL,
+		PresignedURL:    presignedURL,
+	}
+}
+
+// ReportPublishConfig is configuration of PublishReport.
+type ReportPublishConfig struct {
+	TopicArn string
+	Region   string
+
+	// MaxMessageSize is threshold of serialized report in bytes. A larger
+	// report is published as an envelope. DefaultMaxMessageSize is used if 0.
+	MaxMessageSize int
+
+	// AlwaysEnvelope publishes an envelope for all reports regardless of size.
+	AlwaysEnvelope bool
+
+	// Bucket is S3 bucket to store full reports for envelopes.
+	Bucket string
+
+	// PresignExpiry is lifetime of presigned URL in envelopes. No URL is
+	// presigned if 0.
+	PresignExpiry time.Duration
+
+	// S3 is a client for Bucket. A client of Region is created if nil.
+	S3 s3iface.S3API
+
+	// Templates renders subject and message for email subscriptions. Other
+	// subscriptions receive the report in JSON. Default templates are used if
+	// nil.
+	Templates *NotificationTemplates
+
+	// Locale is locale of Templates. Empty means DefaultLocale.
+	Locale string
+
+	// ReportURL is a template of link to the full report for Templates.
+	ReportURL string
+
+	// Attributes are added to message attributes of the report, e.g.
+	// RoutedAttributes.
+	Attributes map[string]string
+}
+
+// PublishReport publishes the report to SNS topic. If the serialized report
+// exceeds MaxMessageSize or AlwaysEnvelope is set, the report is uploaded to
+// Bucket and an envelope is published instead. Failure of the upload is
+// returned as an error and nothing is published, because the oversized report
+// can not be published anyway.
+func PublishReport(cfg ReportPublishConfig, report Report) error {
+	msg, attrs, err := reportMessage(cfg, report)
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Attributes {
+		attrs[k] = v
+	}
+	text := cfg.Templates.Render(NotifySNS, report, cfg.ReportURL, cfg.Locale)
+	_, err = publishSnsMessage(context.Background(), cfg.TopicArn, cfg.Region, msg, attrs, text)
+	return err
+}
+
+// reportMessage returns the report, or its envelope if the report is
+// oversized, and message attributes for it. TopicArn of cfg is not used.
+func reportMessage(cfg ReportPublishConfig, report Report) (interface{}, map[string]string, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report")
+	}
+
+	maxSize := cfg.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	if !cfg.AlwaysEnvelope && len(data) <= maxSize {
+		return report, ReportMessageAttributes(report), nil
+	}
+
+	if cfg.Bucket == "" {
+		return nil, nil, NewConfigError(fmt.Sprintf("Bucket for report envelope is not configured, report size is %d bytes", len(data)))
+	}
+
+	client := cfg.S3
+	if client == nil {
+		client = s3.New(newSession(cfg.Region))
+	}
+
+	keys, err := ArchiveReport(client, cfg.Bucket, report, false)
+	if err != nil {
+		Logger.WithFields(report.LogFields()).WithFields(ErrorFields(err)).Error("Fail to upload report for envelope, not published")
+		return nil, nil, WrapCode(ErrCodePublish, err, "Fail to upload report for envelope")
+	}
+
+	var presigned string
+	if cfg.PresignExpiry > 0 {
+		req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(cfg.Bucket),
+			Key:    aws.String(keys[0]),
+		})
+		if presigned, err = req.Presign(cfg.PresignExpiry); err != nil {
+			return nil, nil, WrapCode(ErrCodePublish, err, "Fail to presign URL of report")
+		}
+	}
+
+	envelope := NewReportEnvelope(report, len(data), fmt.Sprintf("s3://%s/%s", cfg.Bucket, keys[0]), presigned)
+	attrs := ReportMessageAttributes(report)
+	attrs["envelope"] = "true"
+
+	Logger.WithFields(report.LogFields()).WithField("size", len(data)).Info("Publish report envelope")
+	return envelope, attrs, nil
+}
+
+// EnvelopeS3 is S3 client to fetch full reports of envelopes, and to upload
+// them by PublishSnsMessage. A client of the region is created if nil.
+var EnvelopeS3 s3iface.S3API
+
+// EnvelopeReportTable is the report table to load full reports of envelopes
+// without S3 URL.
+var EnvelopeReportTable = ResolveTableName(os.Getenv("REPORT_TABLE"))
+
+// UnmarshalReportMessage decodes a message published by PublishReport or
+// PublishSnsMessage. A compressed report is decompressed. If the message is
+// an envelope, the full report is fetched from S3, or from
+// EnvelopeReportTable if the envelope has no S3 URL.
+func UnmarshalReportMessage(msg string) (Report, error) {
+	var head struct {
+		Type     string   `json:"type"`
+		ReportID ReportID `json:"report_id"`
+		S3URL    string   `json:"s3_url"`
+	}
+	if err := json.Unmarshal([]byte(msg), &head); err != nil {
+		return Report{}, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal report")
+	}
+
+	switch head.Type {
+	case CompressedReportType:
+		var compressed CompressedReport
+		if err := json.Unmarshal([]byte(msg), &compressed); err != nil {
+			return Report{}, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal compressed report")
+		}
+		if compressed.Encoding != SnsContentEncoding {
+			return Report{}, NewCodedError(ErrCodeValidation, "Unsupported encoding of compressed report: "+compressed.Encoding)
+		}
+		data, err := gunzipBase64(compressed.Data)
+		if err != nil {
+			return Report{}, WrapCode(ErrCodeMarshal, err, "Fail to decode compressed report")
+		}
+		return unmarshalReport(data, "Fail to unmarshal compressed report")
+
+	case ReportEnvelopeType:
+		if head.S3URL == "" {
+			return loadEnvelopeReport(head.ReportID)
+		}
+		return fetchEnvelopeReport(head.S3URL)
+
+	default:
+		return unmarshalReport([]byte(msg), "Fail to unmarshal report")
+	}
+}
+
+// DecodeReportRecord decodes a report of the SNS record by
+// UnmarshalReportMessage. A message that can not be decoded by retry is logged
+// and dropped, and false is returned without error then. Other errors are
+// returned so that the record is retried.
+func DecodeReportRecord(logger logrus.FieldLogger, record events.SNSEventRecord) (*Report, bool, error) {
+	report, err := UnmarshalReportMessage(record.SNS.Message)
+	if err != nil {
+		if !IsRetryable(err) {
+			logger.WithField("message_id", record.SNS.MessageID).WithFields(ErrorFields(err)).Error("Drop invalid report message")
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &report, true, nil
+}
+
+func unmarshalReport(data []byte, msg string) (Report, error) {
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, WrapCode(ErrCodeMarshal, err, msg)
+	}
+	report.EnsureMaps()
+	return report, nil
+}
+
+// loadEnvelopeReport loads the full report of an envelope without S3 URL
+// from EnvelopeReportTable.
+func loadEnvelopeReport(reportID ReportID) (Report, error) {
+	if reportID == "" {
+		return Report{}, NewCodedError(ErrCodeValidation, "Report envelope has neither S3 URL nor report ID")
+	}
+	if EnvelopeReportTable == "" {
+		return Report{}, NewCodedError(ErrCodeValidation, fmt.Sprintf("Report envelope of %s has no S3 URL and report table is not configured", reportID))
+	}
+
+	report, err := LoadReport(EnvelopeReportTable, os.Getenv("AWS_REGION"), reportID)
+	if err == ErrReportNotFound {
+		return Report{}, WrapCode(ErrCodeValidation, err, fmt.Sprintf("Report of envelope %s is not in %s", reportID, EnvelopeReportTable))
+	}
+	if err != nil {
+		return Report{}, errors.Wrap(err, "Fail to load report of envelope")
+	}
+	return *report, nil
+}
+
+// fetchEnvelopeReport gets the full report of an envelope from S3.
+func fetchEnvelopeReport(s3URL string) (Report, error) {
+	path := strings.TrimPrefix(s3URL, "s3://")
+	parts := strings.SplitN(path, "/", 2)
+	if path == s3URL || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Report{}, NewCodedError(ErrCodeValidation, "Invalid S3 URL in report envelope: "+s3URL)
+	}
+
+	client := EnvelopeS3
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(parts[0]),
+		Key:    aws.String(parts[1]),
+	})
+	if err != nil {
+		return Report{}, WrapStoreError(ErrCodeStoreGet, err, "Fail to get report of envelope from "+s3URL)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Report{}, errors.Wrap(err, "Fail to read report of envelope")
+	}
+	return unmarshalReport(data, "Fail to unmarshal report of envelope")
+}
@@ -0,0 +1,225 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// envelopeS3 is mockS3 that presigns URLs without network access and can
+// fail uploads.
+type envelopeS3 struct {
+	mockS3
+	failPut bool
+}
+
+func (x *envelopeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if x.failPut {
+		return nil, errors.New("AccessDenied")
+	}
+	return x.mockS3.PutObject(input)
+}
+
+func (x *envelopeS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-northeast-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	return s3.New(sess).GetObjectRequest(input)
+}
+
+const envelopeTopic = "arn:aws:sns:ap-northeast-1:1234567890:reports"
+
+func setupEnvelopeTest(t *testing.T) (*mockSNS, *envelopeS3, lib.ReportPublishConfig) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	storage := &envelopeS3{}
+
+	return client, storage, lib.ReportPublishConfig{
+		TopicArn: envelopeTopic,
+		Region:   "ap-northeast-1",
+		Bucket:   "archive-bucket",
+		S3:       storage,
+	}
+}
+
+func TestPublishReportSmall(t *testing.T) {
+	client, storage, cfg := setupEnvelopeTest(t)
+	defer func() { lib.SNSClient = nil }()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishReport(cfg, report))
+
+	require.Equal(t, 1, len(client.inputs))
+	var published lib.Report
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(client.inputs[0].Message)), &published))
+	assert.Equal(t, report.ID, published.ID)
+	assert.Equal(t, len(report.Content.OpponentHosts), len(published.Content.OpponentHosts))
+	assert.NotContains(t, client.inputs[0].MessageAttributes, "envelope")
+	assert.Empty(t, storage.puts)
+}
+
+func TestPublishReportAttributes(t *testing.T) {
+	client, _, cfg := setupEnvelopeTest(t)
+	defer func() { lib.SNSClient = nil }()
+
+	cfg.Attributes = map[string]string{"routed_slack": "true"}
+	require.NoError(t, lib.PublishReport(cfg, loadFixtureReport(t)))
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, "true", snsAttr(client.inputs[0], "routed_slack"))
+	assert.Equal(t, "urgent", snsAttr(client.inputs[0], "severity"))
+}
+
+func TestPublishReportEnvelope(t *testing.T) {
+	client, storage, cfg := setupEnvelopeTest(t)
+	defer func() { lib.SNSClient = nil }()
+
+	cfg.MaxMessageSize = 100
+	cfg.PresignExpiry = time.Hour
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishReport(cfg, report))
+
+	key := "reports/5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e/report.json"
+	require.Equal(t, 1, len(storage.puts))
+	assert.Equal(t, key, aws.StringValue(storage.puts[0].Key))
+
+	require.Equal(t, 1, len(client.inputs))
+	msg := aws.StringValue(client.inputs[0].Message)
+	var envelope lib.ReportEnvelope
+	require.NoError(t, json.Unmarshal([]byte(msg), &envelope))
+	assert.Equal(t, lib.ReportEnvelopeType, envelope.Type)
+	assert.Equal(t, report.ID, envelope.ReportID)
+	assert.Equal(t, lib.SevUrgent, envelope.Severity)
+	assert.Equal(t, 2, envelope.RemoteHosts)
+	assert.Equal(t, 1, envelope.MaliciousHashes)
+	assert.Equal(t, "198.51.100.7 (RU): 1 malicious hash, 1 domain, 1 URL", envelope.TopIndicators[0])
+	assert.Equal(t, "s3://archive-bucket/"+key, envelope.S3URL)
+	assert.Contains(t, envelope.PresignedURL, "X-Amz-Signature=")
+	assert.Contains(t, envelope.PresignedURL, key)
+	assert.Equal(t, len(storage.objects["archive-bucket/"+key]), envelope.Size)
+	assert.True(t, len(msg) < envelope.Size)
+
+	attrs := client.inputs[0].MessageAttributes
+	assert.Equal(t, &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("true")}, attrs["envelope"])
+	assert.Equal(t, "urgent", aws.StringValue(attrs["severity"].StringValue))
+
+	// Subscribers get the full report from S3.
+	lib.EnvelopeS3 = storage
+	defer func() { lib.EnvelopeS3 = nil }()
+	resolved, err := lib.UnmarshalReportMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, report.ID, resolved.ID)
+	assert.Equal(t, report.Content.OpponentHosts, resolved.Content.OpponentHosts)
+}
+
+func TestPublishReportAlwaysEnvelope(t *testing.T) {
+	client, storage, cfg := setupEnvelopeTest(t)
+	defer func() { lib.SNSClient = nil }()
+
+	cfg.AlwaysEnvelope = true
+	require.NoError(t, lib.PublishReport(cfg, loadFixtureReport(t)))
+	assert.Equal(t, 1, len(storage.puts))
+	require.Equal(t, 1, len(client.inputs))
+	assert.Contains(t, aws.StringValue(client.inputs[0].Message), `"type":"report_envelope"`)
+	assert.NotContains(t, aws.StringValue(client.inputs[0].Message), "presigned_url")
+}
+
+func TestPublishReportUploadFailure(t *testing.T) {
+	client, storage, cfg := setupEnvelopeTest(t)
+	defer func() { lib.SNSClient = nil }()
+
+	// Oversized report must not be published when upload fails.
+	cfg.MaxMessageSize = 100
+	storage.failPut = true
+	err := lib.PublishReport(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "AccessDenied")
+	assert.Empty(t, client.inputs)
+
+	// No bucket is misconfiguration.
+	cfg.Bucket = ""
+	err = lib.PublishReport(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+	assert.Empty(t, client.inputs)
+}
+
+func TestUnmarshalReportMessage(t *testing.T) {
+	report := loadFixtureReport(t)
+	raw, err := json.Marshal(report)
+	require.NoError(t, err)
+
+	parsed, err := lib.UnmarshalReportMessage(string(raw))
+	require.NoError(t, err)
+	assert.Equal(t, report.ID, parsed.ID)
+
+	_, err = lib.UnmarshalReportMessage("not json")
+	assert.Error(t, err)
+
+	for _, url := range []string{"https://example.com/report.json", "s3://bucket", "s3:///key"} {
+		msg := `{"type":"report_envelope","s3_url":"` + url + `"}`
+		_, err = lib.UnmarshalReportMessage(msg)
+		require.Error(t, err, url)
+		assert.True(t, strings.Contains(err.Error(), "Invalid S3 URL"), url)
+	}
+
+	// An envelope without S3 URL needs report ID.
+	_, err = lib.UnmarshalReportMessage(`{"type":"report_envelope","s3_url":""}`)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err))
+}
+
+// failingGetS3 is mockS3 that fails GetObject by a retryable error.
+type failingGetS3 struct {
+	mockS3
+}
+
+func (x *failingGetS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestDecodeReportRecord(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	record := func(msg string) events.SNSEventRecord {
+		return events.SNSEventRecord{SNS: events.SNSEntity{MessageID: "m1", Message: msg}}
+	}
+
+	report := loadFixtureReport(t)
+	raw, err := json.Marshal(report)
+	require.NoError(t, err)
+	decoded, ok, err := lib.DecodeReportRecord(logger, record(string(raw)))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, report.ID, decoded.ID)
+
+	// A broken message is dropped without error.
+	decoded, ok, err = lib.DecodeReportRecord(logger, record("{broken"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, decoded)
+
+	// Failure to fetch the report is returned to retry the record.
+	lib.EnvelopeS3 = &failingGetS3{}
+	defer func() { lib.EnvelopeS3 = nil }()
+	_, ok, err = lib.DecodeReportRecord(logger, record(`{"type":"report_envelope","s3_url":"s3://bucket/key"}`))
+	require.Error(t, err)
+	assert.False(t, ok)
+	assert.True(t, lib.IsRetryable(err))
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryableError means that the procedure is not completed yet and should be
+// retried later by the caller. It must not be wrapped when returned from a
+// Lambda handler because a state machine catches the error by type name.
+type RetryableError struct {
+	msg string
+}
+
+// NewRetryableError is a constructor of RetryableError
+func NewRetryableError(msg string) *RetryableError {
+	return &RetryableError{msg: msg}
+}
+
+func (x *RetryableError) Error() string {
+	return x.msg
+}
+
+// ConfigError means that the function is misconfigured, e.g. invalid ARN is
+// set to environment variable. It should not be retried.
+type ConfigError struct {
+	msg string
+}
+
+// NewConfigError is a constructor of ConfigError
+func NewConfigError(msg string) *ConfigError {
+	return &ConfigError{msg: msg}
+}
+
+func (x *ConfigError) Error() string {
+	return x.msg
+}
+
+// SizeLimitError means that input data is larger than the limit and is
+// rejected without processing.
+type SizeLimitError struct {
+	Target string
+	Size   int
+	Limit  int
+}
+
+// NewSizeLimitError is a constructor of SizeLimitError
+func NewSizeLimitError(target string, size, limit int) *SizeLimitError {
+	return &SizeLimitError{Target: target, Size: size, Limit: limit}
+}
+
+func (x *SizeLimitError) Error() string {
+	return fmt.Sprintf("%s is too large: %d bytes (limit %d bytes)", x.Target, x.Size, x.Limit)
+}
+
+// ErrorCode is a stable identifier of failure for log analysis.
+type ErrorCode string
+
+const (
+	ErrCodeUnknown          ErrorCode = "E_UNKNOWN"
+	ErrCodeInvalidConfig    ErrorCode = "E_INVALID_CONFIG"
+	ErrCodeInvalidAlert     ErrorCode = "E_INVALID_ALERT"
+	ErrCodeInvalidSignature ErrorCode = "E_INVALID_SIGNATURE"
+	ErrCodeValidation       ErrorCode = "E_VALIDATION"
+	ErrCodeMarshal          ErrorCode = "E_MARSHAL"
+	ErrCodeTooLarge         ErrorCode = "E_TOO_LARGE"
+	ErrCodePageLimit        ErrorCode = "E_PAGE_LIMIT"
+	ErrCodeStoreGet         ErrorCode = "E_STORE_GET"
+	ErrCodeStorePut         ErrorCode = "E_STORE_PUT"
+	ErrCodeThrottled        ErrorCode = "E_THROTTLED"
+	ErrCodePublish          ErrorCode = "E_PUBLISH"
+	ErrCodeDispatch         ErrorCode = "E_DISPATCH"
+)
+
+// permanentCodes are codes of failures that never succeed by retry because
+// input or configuration is wrong.
+var permanentCodes = map[ErrorCode]bool{
+	ErrCodeInvalidConfig:    true,
+	ErrCodeInvalidAlert:     true,
+	ErrCodeInvalidSignature: true,
+	ErrCodeValidation:       true,
+	ErrCodeMarshal:          true,
+	ErrCodeTooLarge:         true,
+	ErrCodePageLimit:        true,
+}
+
+// Retryable returns true if a failure of the code may succeed by retry.
+// ErrCodeUnknown is retryable because the cause is not known.
+func (x ErrorCode) Retryable() bool {
+	return !permanentCodes[x]
+}
+
+// CodedError is an error with ErrorCode. It can be wrapped by errors.Wrap and
+// the code is still available by ErrorCodeOf. errors.As of the standard
+// library also extracts it unless it is wrapped by errors.Wrap.
+type CodedError struct {
+	Code  ErrorCode
+	msg   string
+	cause error
+}
+
+// NewCodedError is a constructor of CodedError without cause.
+func NewCodedError(code ErrorCode, msg string) *CodedError {
+	return &CodedError{Code: code, msg: msg}
+}
+
+// WrapCode wraps err with message and code.
+func WrapCode(code ErrorCode, err error, msg string) *CodedError {
+	return &CodedError{Code: code, msg: msg, cause: err}
+}
+
+func (x *CodedError) Error() string {
+	if x.cause == nil {
+		return x.msg
+	}
+	return x.msg + ": " + x.cause.Error()
+}
+
+// Cause returns the wrapped error for errors.Cause.
+func (x *CodedError) Cause() error {
+	return x.cause
+}
+
+// Unwrap returns the wrapped error for errors.Is and errors.As of the standard
+// library.
+func (x *CodedError) Unwrap() error {
+	return x.cause
+}
+
+var throttlingCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"RequestLimitExceeded":                   true,
+	"Throttling":                             true,
+	"Throttled":                              true,
+}
+
+// WrapStoreError wraps error of storage access. ErrCodeThrottled is used
+// instead of code if the request is throttled.
+func WrapStoreError(code ErrorCode, err error, msg string) *CodedError {
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok && throttlingCodes[awsErr.Code()] {
+		code = ErrCodeThrottled
+	}
+	return WrapCode(code, err, msg)
+}
+
+// ErrorCodeOf returns code of the outermost coded error in the chain of err
+// followed by Cause of github.com/pkg/errors and Unwrap of the standard library.
+// ErrCodeUnknown is returned if no code is found.
+func ErrorCodeOf(err error) ErrorCode {
+	for err != nil {
+		switch e := err.(type) {
+		case *CodedError:
+			return e.Code
+		case *ConfigError:
+			return ErrCodeInvalidConfig
+		case *SizeLimitError:
+			return ErrCodeTooLarge
+		case *SchemaError:
+			return ErrCodeValidation
+		}
+
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return ErrCodeUnknown
+		}
+	}
+
+	return ErrCodeUnknown
+}
+
+// IsRetryable returns true if err does not have a code of permanent failure.
+func IsRetryable(err error) bool {
+	return ErrorCodeOf(err).Retryable()
+}
+
+// ErrorFields returns log fields of the error including the code.
+func ErrorFields(err error) logrus.Fields {
+	return logrus.Fields{
+		"error":      err.Error(),
+		"error_code": ErrorCodeOf(err),
+	}
+}
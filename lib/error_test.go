@@ -0,0 +1,116 @@
+package lib_test
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	base := errors.New("boom")
+	err := lib.WrapCode(lib.ErrCodePublish, base, "Fail to publish")
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Equal(t, "Fail to publish: boom", err.Error())
+	assert.Equal(t, base, errors.Cause(err))
+
+	// Code is kept through errors.Wrap
+	wrapped := errors.Wrap(err, "Fail to handle alert")
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(wrapped))
+
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(lib.NewConfigError("no ARN")))
+	assert.Equal(t, lib.ErrCodeTooLarge, lib.ErrorCodeOf(lib.NewSizeLimitError("page", 2, 1)))
+	assert.Equal(t, lib.ErrCodeUnknown, lib.ErrorCodeOf(base))
+	assert.Equal(t, lib.ErrCodeUnknown, lib.ErrorCodeOf(nil))
+}
+
+func TestWrapStoreError(t *testing.T) {
+	err := lib.WrapStoreError(lib.ErrCodeStorePut, errors.New("connection reset"), "Fail to put")
+	assert.Equal(t, lib.ErrCodeStorePut, lib.ErrorCodeOf(err))
+
+	throttled := awserr.New("ProvisionedThroughputExceededException", "slow down", nil)
+	err = lib.WrapStoreError(lib.ErrCodeStorePut, throttled, "Fail to put")
+	assert.Equal(t, lib.ErrCodeThrottled, lib.ErrorCodeOf(err))
+}
+
+func TestErrorFields(t *testing.T) {
+	err := errors.Wrap(lib.NewCodedError(lib.ErrCodeInvalidAlert, "no key"), "Fail")
+	fields := lib.ErrorFields(err)
+	assert.Equal(t, lib.ErrCodeInvalidAlert, fields["error_code"])
+	assert.Equal(t, "Fail: no key", fields["error"])
+}
+
+func TestPublishSnsMessageErrorCode(t *testing.T) {
+	_, err := lib.PublishSnsMessage(context.Background(), "arn:aws:sqs:ap-northeast-1:1234567890:q", "ap-northeast-1", "data")
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
+
+func TestErrorCodeOfWrappedChain(t *testing.T) {
+	base := errors.New("boom")
+	err := errors.Wrapf(errors.WithMessage(lib.WrapCode(lib.ErrCodeDispatch, base, "Fail to start execution"), "dispatch"), "Fail to handle %s", "r1")
+	assert.Equal(t, lib.ErrCodeDispatch, lib.ErrorCodeOf(err))
+	assert.Equal(t, base, errors.Cause(err))
+	assert.Equal(t, "Fail to handle r1: dispatch: Fail to start execution: boom", err.Error())
+
+	// The outermost code is used.
+	err = errors.Wrap(lib.WrapCode(lib.ErrCodePublish, lib.NewConfigError("no topic"), "Fail to publish"), "Fail")
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+
+	throttled := awserr.New("ThrottlingException", "slow down", nil)
+	err = errors.Wrap(lib.WrapStoreError(lib.ErrCodeStoreGet, errors.Wrap(throttled, "query"), "Fail to get"), "Fail")
+	assert.Equal(t, lib.ErrCodeThrottled, lib.ErrorCodeOf(err))
+	assert.Equal(t, throttled, errors.Cause(err))
+}
+
+func TestErrorsAsCodedError(t *testing.T) {
+	base := errors.New("boom")
+	var coded *lib.CodedError
+
+	// Returned directly
+	require.True(t, stderrors.As(lib.WrapCode(lib.ErrCodeDispatch, base, "Fail to start execution"), &coded))
+	assert.Equal(t, lib.ErrCodeDispatch, coded.Code)
+
+	// Wrapped by fmt.Errorf
+	err := fmt.Errorf("Fail to handle: %w", lib.WrapCode(lib.ErrCodePublish, base, "Fail to publish"))
+	require.True(t, stderrors.As(err, &coded))
+	assert.Equal(t, lib.ErrCodePublish, coded.Code)
+	assert.True(t, stderrors.Is(err, base))
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+
+	throttled := awserr.New("ThrottlingException", "slow down", nil)
+	require.True(t, stderrors.As(lib.WrapStoreError(lib.ErrCodeStoreGet, throttled, "Fail to get"), &coded))
+	assert.Equal(t, lib.ErrCodeThrottled, coded.Code)
+}
+
+func TestErrorCodeOfLibErrors(t *testing.T) {
+	_, err := lib.UnmarshalReportMessage("{broken")
+	assert.Equal(t, lib.ErrCodeMarshal, lib.ErrorCodeOf(err))
+	assert.False(t, lib.IsRetryable(err))
+
+	schema, err := lib.ParseJSONSchema(`{"type": "object", "required": ["rule"]}`)
+	require.NoError(t, err)
+	err = schema.Validate([]byte(`{}`))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(errors.Wrap(err, "Invalid alert")))
+	assert.Equal(t, lib.ErrCodeMarshal, lib.ErrorCodeOf(schema.Validate([]byte(`{`))))
+}
+
+func TestErrorCodeRetryable(t *testing.T) {
+	for _, code := range []lib.ErrorCode{lib.ErrCodeStoreGet, lib.ErrCodeStorePut, lib.ErrCodeThrottled,
+		lib.ErrCodePublish, lib.ErrCodeDispatch, lib.ErrCodeUnknown} {
+		assert.True(t, code.Retryable(), string(code))
+	}
+	for _, code := range []lib.ErrorCode{lib.ErrCodeInvalidConfig, lib.ErrCodeInvalidAlert, lib.ErrCodeValidation,
+		lib.ErrCodeMarshal, lib.ErrCodeTooLarge, lib.ErrCodePageLimit} {
+		assert.False(t, code.Retryable(), string(code))
+	}
+
+	assert.False(t, lib.IsRetryable(errors.Wrap(lib.NewConfigError("no ARN"), "Fail")))
+	assert.True(t, lib.IsRetryable(errors.New("connection reset")))
+}
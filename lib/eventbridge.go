@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/pkg/errors"
+)
+
+// eventBridgeMaxEntrySize is limit of an entry of PutEvents including source
+// and detail type.
+const eventBridgeMaxEntrySize = 256 * 1024
+
+// EventBridgeEntry is an entry of PutEvents request.
+type EventBridgeEntry struct {
+	EventBusName string `json:"EventBusName,omitempty"`
+	Source       string `json:"Source"`
+	DetailType   string `json:"DetailType"`
+	Detail       string `json:"Detail"`
+	Time         int64  `json:"Time,omitempty"`
+}
+
+// EventBridgePutEventsInput is a request of PutEvents.
+type EventBridgePutEventsInput struct {
+	Entries []EventBridgeEntry `json:"Entries"`
+}
+
+// EventBridgePutEventsOutput is a response of PutEvents.
+type EventBridgePutEventsOutput struct {
+	FailedEntryCount int                      `json:"FailedEntryCount"`
+	Entries          []EventBridgeResultEntry `json:"Entries"`
+}
+
+// EventBridgeResultEntry is a result of an entry. ErrorCode is set if the
+// entry failed.
+type EventBridgeResultEntry struct {
+	EventID      string `json:"EventId,omitempty"`
+	ErrorCode    string `json:"ErrorCode,omitempty"`
+	ErrorMessage string `json:"ErrorMessage,omitempty"`
+}
+
+// EventBridgeAPI is a client of PutEvents. AWS SDK of this module predates
+// EventBridge and custom event buses, so API is called with a signed HTTP
+// request by default.
+type EventBridgeAPI interface {
+	PutEvents(input *EventBridgePutEventsInput) (*EventBridgePutEventsOutput, error)
+}
+
+// EventBridgeClient is a client used by PublishEventBridge. A client of the
+// region is created if nil.
+var EventBridgeClient EventBridgeAPI
+
+type eventBridgeClient struct {
+	region string
+	signer *v4.Signer
+	client *http.Client
+}
+
+func newEventBridgeClient(region string) *eventBridgeClient {
+	return &eventBridgeClient{
+		region: region,
+		signer: v4.NewSigner(newSession(region).Config.Credentials),
+	}
+}
+
+func (x *eventBridgeClient) PutEvents(input *EventBridgePutEventsInput) (*EventBridgePutEventsOutput, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal PutEvents request")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-amz-json-1.1")
+	header.Set("X-Amz-Target", "AWSEvents.PutEvents")
+
+	endpoint := fmt.Sprintf("https://events.%s.amazonaws.com/", x.region)
+	sign := func(req *http.Request, body []byte) error {
+		_, err := x.signer.Sign(req, bytes.NewReader(body), "events", x.region, time.Now())
+		return err
+	}
+
+	raw, err := sendSignedHTTPRequest(x.client, http.MethodPost, endpoint, header, body, DefaultHTTPRetry, sign)
+	if err != nil {
+		return nil, err
+	}
+
+	var output EventBridgePutEventsOutput
+	if err := json.Unmarshal(raw, &output); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal PutEvents response")
+	}
+	return &output, nil
+}
+
+// PublishEventBridge puts the report as detail of an event to the event bus.
+// The default bus is used if busName is empty.
+func PublishEventBridge(busName, source, detailType string, report Report, region string) (err error) {
+	span := StartTrace("PublishEventBridge")
+	defer func() { span.End(err) }()
+
+	if source == "" || detailType == "" {
+		return NewConfigError("Source and detail type of EventBridge event are required")
+	}
+
+	detail, err := json.Marshal(report)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
+	}
+	if size := len(source) + len(detailType) + len(detail); size > eventBridgeMaxEntrySize {
+		return WrapCode(ErrCodePublish, fmt.Errorf("%d bytes", size),
+			fmt.Sprintf("Report %s exceeds EventBridge entry limit", report.ID))
+	}
+
+	client := EventBridgeClient
+	if client == nil {
+		client = newEventBridgeClient(region)
+	}
+
+	input := &EventBridgePutEventsInput{
+		Entries: []EventBridgeEntry{{
+			EventBusName: busName,
+			Source:       source,
+			DetailType:   detailType,
+			Detail:       string(detail),
+			Time:         time.Now().Unix(),
+		}},
+	}
+
+	resp, err := client.PutEvents(input)
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to put report to EventBridge")
+	}
+
+	if resp.FailedEntryCount > 0 {
+		var msgs []string
+		for _, entry := range resp.Entries {
+			if entry.ErrorCode != "" {
+				msgs = append(msgs, entry.ErrorCode+" "+entry.ErrorMessage)
+			}
+		}
+		return WrapCode(ErrCodePublish, errors.New(strings.Join(msgs, "; ")), "Fail to put report to EventBridge")
+	}
+
+	Logger.WithFields(report.LogFields()).WithField("bus", busName).Info("Put report to EventBridge")
+	return nil
+}
@@ -0,0 +1,90 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockEventBridge struct {
+	inputs []*lib.EventBridgePutEventsInput
+	output lib.EventBridgePutEventsOutput
+	err    error
+}
+
+func (x *mockEventBridge) PutEvents(input *lib.EventBridgePutEventsInput) (*lib.EventBridgePutEventsOutput, error) {
+	x.inputs = append(x.inputs, input)
+	return &x.output, x.err
+}
+
+func TestPublishEventBridge(t *testing.T) {
+	client := &mockEventBridge{}
+	lib.EventBridgeClient = client
+	defer func() { lib.EventBridgeClient = nil }()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishEventBridge("security-bus", "alert-responder", "Report Published", report, "us-east-1"))
+
+	require.Equal(t, 1, len(client.inputs))
+	require.Equal(t, 1, len(client.inputs[0].Entries))
+	entry := client.inputs[0].Entries[0]
+	assert.Equal(t, "security-bus", entry.EventBusName)
+	assert.Equal(t, "alert-responder", entry.Source)
+	assert.Equal(t, "Report Published", entry.DetailType)
+	assert.NotZero(t, entry.Time)
+
+	var detail lib.Report
+	require.NoError(t, json.Unmarshal([]byte(entry.Detail), &detail))
+	assert.Equal(t, report.ID, detail.ID)
+	assert.Equal(t, report.Result.Severity, detail.Result.Severity)
+
+	// Request body has field names of PutEvents API.
+	raw, err := json.Marshal(client.inputs[0])
+	require.NoError(t, err)
+	var body map[string][]map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &body))
+	assert.Contains(t, body["Entries"][0], "EventBusName")
+	assert.Contains(t, body["Entries"][0], "DetailType")
+	assert.Contains(t, body["Entries"][0], "Detail")
+
+	// The default bus is used without bus name.
+	require.NoError(t, lib.PublishEventBridge("", "alert-responder", "Report Published", report, "us-east-1"))
+	raw, err = json.Marshal(client.inputs[1])
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "EventBusName")
+}
+
+func TestPublishEventBridgeFailure(t *testing.T) {
+	client := &mockEventBridge{}
+	lib.EventBridgeClient = client
+	defer func() { lib.EventBridgeClient = nil }()
+
+	report := loadFixtureReport(t)
+	client.output.FailedEntryCount = 1
+	client.output.Entries = []lib.EventBridgeResultEntry{
+		{ErrorCode: "InternalException", ErrorMessage: "internal error"},
+	}
+	err := lib.PublishEventBridge("security-bus", "alert-responder", "Report", report, "us-east-1")
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "InternalException")
+
+	client.output = lib.EventBridgePutEventsOutput{}
+	client.err = errors.New("AccessDeniedException")
+	err = lib.PublishEventBridge("security-bus", "alert-responder", "Report", report, "us-east-1")
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+
+	_, ok := lib.PublishEventBridge("security-bus", "", "Report", report, "us-east-1").(*lib.ConfigError)
+	assert.True(t, ok)
+
+	// Oversized report is not put.
+	report.Alert.Description = strings.Repeat("x", 300*1024)
+	err = lib.PublishEventBridge("security-bus", "alert-responder", "Report", report, "us-east-1")
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Equal(t, 3, len(client.inputs))
+}
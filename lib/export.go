@@ -0,0 +1,503 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExportOptions is options of ToJSON and ToCSV.
+type ExportOptions struct {
+	// Fields is an allowlist of field paths to export, e.g.
+	// "remote_hosts.ipaddr" or "severity". A path selects the field and all
+	// fields under it. Unlisted fields are omitted. All fields are exported
+	// if empty.
+	Fields []string
+}
+
+// exportReport is a flat view of a report for external sharing. Its JSON
+// names are field paths of ExportOptions.Fields.
+type exportReport struct {
+	ReportID    ReportID           `json:"report_id"`
+	Status      ReportStatus       `json:"status"`
+	ReceivedAt  time.Time          `json:"received_at"`
+	AccountID   string             `json:"account_id"`
+	Rule        string             `json:"rule"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Severity    ReportSeverity     `json:"severity"`
+	Reason      string             `json:"reason"`
+	Summary     string             `json:"summary"`
+	Warnings    []string           `json:"warnings"`
+	RemoteHosts []exportRemoteHost `json:"remote_hosts"`
+	LocalHosts  []ReportAlliedHost `json:"local_hosts"`
+	Users       []ReportUser       `json:"users"`
+}
+
+// exportRemoteHost is a remote host with its RiskScore.
+type exportRemoteHost struct {
+	ReportOpponentHost
+	RiskScore int `json:"risk_score"`
+}
+
+// exportSections are fields of exportReport exported as a CSV row per item.
+var exportSections = []string{"remote_hosts", "local_hosts", "users"}
+
+func newExportReport(r Report) exportReport {
+	v := exportReport{
+		ReportID:    r.ID,
+		Status:      r.Status,
+		ReceivedAt:  r.ReceivedAt,
+		AccountID:   r.AccountID,
+		Rule:        r.Alert.Rule,
+		Name:        r.Alert.Name,
+		Description: r.Alert.Description,
+		Severity:    r.Result.Severity,
+		Reason:      r.Result.Reason,
+		Summary:     r.OneLineSummary(),
+		Warnings:    append([]string{}, r.Warnings...),
+		RemoteHosts: []exportRemoteHost{},
+		LocalHosts:  []ReportAlliedHost{},
+		Users:       []ReportUser{},
+	}
+
+	for _, ind := range rankOpponentHosts(r.Content) {
+		v.RemoteHosts = append(v.RemoteHosts, exportRemoteHost{ReportOpponentHost: ind.host, RiskScore: ind.risk})
+	}
+
+	var keys []string
+	for k := range r.Content.AlliedHosts {
+		keys = append(keys, k)
+	}
+	for _, k := range sortedKeys(keys) {
+		v.LocalHosts = append(v.LocalHosts, r.Content.AlliedHosts[k])
+	}
+
+	keys = nil
+	for k := range r.Content.SubjectUsers {
+		keys = append(keys, k)
+	}
+	for _, k := range sortedKeys(keys) {
+		v.Users = append(v.Users, r.Content.SubjectUsers[k])
+	}
+
+	return v
+}
+
+// exportField is a node of field path tree. A node without children selects
+// the whole field.
+type exportField map[string]exportField
+
+func newExportField(paths []string) exportField {
+	root := exportField{}
+	for _, path := range paths {
+		names := strings.Split(path, ".")
+		node := root
+		for i, name := range names {
+			child, ok := node[name]
+			if ok && len(child) == 0 {
+				break // The field is already selected entirely.
+			}
+			if i == len(names)-1 {
+				node[name] = exportField{}
+				break
+			}
+			if !ok {
+				child = exportField{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return root
+}
+
+// filter returns only selected fields of v. Lists are filtered item by item.
+// false is returned if v has no field to select, e.g. v is a string.
+func (x exportField) filter(v interface{}) (interface{}, bool) {
+	if len(x) == 0 {
+		return v, true
+	}
+
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for name, child := range x {
+			if fv, ok := child.filter(obj[name]); ok && obj[name] != nil {
+				result[name] = fv
+			}
+		}
+		return result, true
+
+	case []interface{}:
+		result := []interface{}{}
+		for _, item := range obj {
+			if fv, ok := x.filter(item); ok {
+				result = append(result, fv)
+			}
+		}
+		return result, true
+
+	default:
+		return nil, false
+	}
+}
+
+// exportView returns the report as generic JSON values with only allowlisted
+// fields.
+func exportView(r Report, opts ExportOptions) (map[string]interface{}, error) {
+	raw, err := json.Marshal(newExportReport(r))
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report for export")
+	}
+
+	var view map[string]interface{}
+	if err := json.Unmarshal(raw, &view); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal report for export")
+	}
+
+	if len(opts.Fields) == 0 {
+		return view, nil
+	}
+	filtered, _ := newExportField(opts.Fields).filter(view)
+	return filtered.(map[string]interface{}), nil
+}
+
+// ToJSON exports the report as a JSON object. Remote hosts are ordered by
+// risk score descending, and local hosts and users are ordered by ID.
+func ToJSON(r Report, opts ExportOptions) ([]byte, error) {
+	view, err := exportView(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(view)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal exported report")
+	}
+	return data, nil
+}
+
+// flattenExport collects scalar values of v by field path. Values in lists
+// are collected into the same path.
+func flattenExport(prefix string, v interface{}, out map[string][]string) {
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		for name, fv := range obj {
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			flattenExport(path, fv, out)
+		}
+
+	case []interface{}:
+		if _, ok := out[prefix]; !ok {
+			out[prefix] = nil
+		}
+		for _, item := range obj {
+			flattenExport(prefix, item, out)
+		}
+
+	case string:
+		out[prefix] = append(out[prefix], obj)
+	case float64:
+		out[prefix] = append(out[prefix], strconv.FormatFloat(obj, 'f', -1, 64))
+	case bool:
+		out[prefix] = append(out[prefix], strconv.FormatBool(obj))
+	case nil:
+		if _, ok := out[prefix]; !ok {
+			out[prefix] = nil
+		}
+	}
+}
+
+// ToCSV exports the report as CSV with a header row of field paths. Each
+// remote host, local host and user is a row, and report level fields are
+// repeated in all rows. Multiple values in a cell are joined by ";". A single
+// row is written if no host or user field is exported.
+func ToCSV(r Report, opts ExportOptions) ([]byte, error) {
+	view, err := exportView(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	top := map[string][]string{}
+	var rows []map[string][]string
+	columns := map[string]bool{}
+	hasSection := false
+
+	for name, v := range view {
+		if !isExportSection(name) {
+			flattenExport(name, v, top)
+		}
+	}
+	for _, name := range exportSections {
+		v, ok := view[name]
+		if !ok {
+			continue
+		}
+
+		hasSection = true
+		items, _ := v.([]interface{})
+		for _, item := range items {
+			row := map[string][]string{}
+			flattenExport(name, item, row)
+			for path := range row {
+				columns[path] = true
+			}
+			rows = append(rows, row)
+		}
+	}
+	for path := range top {
+		columns[path] = true
+	}
+	if !hasSection {
+		rows = append(rows, map[string][]string{})
+	}
+
+	// Allowlisted fields are columns even if no value exists.
+	for _, path := range opts.Fields {
+		covered := false
+		for col := range columns {
+			if col == path || strings.HasPrefix(col, path+".") {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			columns[path] = true
+		}
+	}
+
+	header := exportColumns(columns, opts.Fields)
+
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	if err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "Fail to write CSV header")
+	}
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, col := range header {
+			values, ok := row[col]
+			if !ok {
+				values = top[col]
+			}
+			record[i] = strings.Join(values, ";")
+		}
+		if err := w.Write(record); err != nil {
+			return nil, errors.Wrap(err, "Fail to write CSV row")
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, errors.Wrap(err, "Fail to write CSV")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func isExportSection(name string) bool {
+	for _, s := range exportSections {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exportColumns orders columns by the allowlist if given. Otherwise report
+// level fields come first and then fields of each section.
+func exportColumns(columns map[string]bool, fields []string) []string {
+	rank := func(col string) int {
+		for i, path := range fields {
+			if col == path || strings.HasPrefix(col, path+".") {
+				return i
+			}
+		}
+		root := strings.SplitN(col, ".", 2)[0]
+		for i, s := range exportSections {
+			if s == root {
+				return len(fields) + i + 1
+			}
+		}
+		return len(fields)
+	}
+
+	var result []string
+	for col := range columns {
+		result = append(result, col)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ri, rj := rank(result[i]), rank(result[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// Observable is an indicator to be blocked, e.g. IP address, domain, URL or
+// hash of malware.
+type Observable struct {
+	Type      string
+	Value     string
+	FirstSeen time.Time
+	Source    string
+}
+
+// ReportObservables returns remote IP addresses, related domains and URLs and
+// malicious hashes of the report. Observables are deduplicated by type and
+// value with the earliest FirstSeen.
+func ReportObservables(r Report) []Observable {
+	var result []Observable
+	index := map[string]int{}
+	add := func(obs Observable) {
+		if obs.Value == "" {
+			return
+		}
+		key := obs.Type + "|" + obs.Value
+		if i, ok := index[key]; ok {
+			if !obs.FirstSeen.IsZero() && (result[i].FirstSeen.IsZero() || obs.FirstSeen.Before(result[i].FirstSeen)) {
+				result[i].FirstSeen = obs.FirstSeen
+			}
+			return
+		}
+		index[key] = len(result)
+		result = append(result, obs)
+	}
+
+	var ids []string
+	for id := range r.Content.OpponentHosts {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedKeys(ids) {
+		host := r.Content.OpponentHosts[id]
+		for _, addr := range host.IPAddr {
+			add(Observable{Type: "ipaddr", Value: addr})
+		}
+		for _, d := range host.RelatedDomains {
+			add(Observable{Type: "domain", Value: d.Name, FirstSeen: d.Timestamp, Source: d.Source})
+		}
+		for _, u := range host.RelatedURLs {
+			add(Observable{Type: "url", Value: u.URL, FirstSeen: u.Timestamp, Source: u.Source})
+		}
+		for _, m := range host.RelatedMalware {
+			for _, scan := range m.Scans {
+				if scan.Positive {
+					add(Observable{Type: "sha256", Value: m.SHA256, FirstSeen: m.Timestamp, Source: scan.Source})
+					break
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// CSVOptions is options of ObservablesCSV.
+type CSVOptions struct {
+	// Types restricts observables to the types, e.g. "ipaddr", "domain",
+	// "url" and "sha256". All types are written if empty.
+	Types []string
+
+	// ExcludePrivateIPs drops private IP addresses (see IsPrivateIP).
+	ExcludePrivateIPs bool
+
+	// AllowDomains are own domains that must not be blocked. The domains,
+	// their subdomains and URLs of them are dropped.
+	AllowDomains []string
+
+	// Header writes a header row before observables.
+	Header bool
+}
+
+// ObservablesCSVHeader is the header row of ObservablesCSV.
+var ObservablesCSVHeader = []string{"type", "value", "first_seen", "source", "report_id", "severity"}
+
+func (x CSVOptions) allowedDomain(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range x.AllowDomains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x CSVOptions) accept(obs Observable) bool {
+	if len(x.Types) > 0 {
+		found := false
+		for _, t := range x.Types {
+			if t == obs.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch obs.Type {
+	case "ipaddr":
+		return !(x.ExcludePrivateIPs && IsPrivateIP(obs.Value))
+	case "domain":
+		return !x.allowedDomain(obs.Value)
+	case "url":
+		u, err := url.Parse(obs.Value)
+		if err != nil {
+			return true
+		}
+		host := u.Hostname()
+		if x.ExcludePrivateIPs && IsPrivateIP(host) {
+			return false
+		}
+		return !x.allowedDomain(host)
+	}
+	return true
+}
+
+// ObservablesCSV writes observables of the report (see ReportObservables) to
+// w as RFC 4180 CSV, one row per observable with columns of
+// ObservablesCSVHeader. first_seen is RFC 3339 or empty if unknown.
+func ObservablesCSV(r Report, w io.Writer, opts CSVOptions) error {
+	cw := csv.NewWriter(w)
+	if opts.Header {
+		if err := cw.Write(ObservablesCSVHeader); err != nil {
+			return errors.Wrap(err, "Fail to write CSV header")
+		}
+	}
+
+	for _, obs := range ReportObservables(r) {
+		if !opts.accept(obs) {
+			continue
+		}
+
+		var firstSeen string
+		if !obs.FirstSeen.IsZero() {
+			firstSeen = obs.FirstSeen.UTC().Format(time.RFC3339)
+		}
+		row := []string{obs.Type, obs.Value, firstSeen, obs.Source, string(r.ID), string(r.Result.Severity)}
+		if err := cw.Write(row); err != nil {
+			return errors.Wrap(err, "Fail to write CSV row")
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.Wrap(err, "Fail to write CSV")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package lib_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readExportCSV(t *testing.T, data []byte) [][]string {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	require.NoError(t, err)
+	return records
+}
+
+func TestToJSONAllFields(t *testing.T) {
+	report := loadFixtureReport(t)
+	data, err := lib.ToJSON(report, lib.ExportOptions{})
+	require.NoError(t, err)
+
+	var v map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &v))
+	assert.Equal(t, string(report.ID), v["report_id"])
+	assert.Equal(t, "urgent", v["severity"])
+	assert.Equal(t, 2, len(v["remote_hosts"].([]interface{})))
+	assert.Equal(t, 1, len(v["local_hosts"].([]interface{})))
+	assert.Contains(t, string(data), "Example Hosting")
+	assert.Contains(t, string(data), "alice")
+}
+
+func TestToJSONAllowlist(t *testing.T) {
+	report := loadFixtureReport(t)
+	opts := lib.ExportOptions{Fields: []string{"remote_hosts.ipaddr", "remote_hosts.country"}}
+	data, err := lib.ToJSON(report, opts)
+	require.NoError(t, err)
+
+	var v map[string][]map[string][]string
+	require.NoError(t, json.Unmarshal(data, &v))
+	assert.Equal(t, map[string][]map[string][]string{
+		"remote_hosts": {
+			{"ipaddr": {"198.51.100.7"}, "country": {"RU"}},
+			{"ipaddr": {"203.0.113.9"}, "country": {"US"}},
+		},
+	}, v)
+
+	for _, s := range []string{"Example Hosting", "bad.example.com", "alice", "10.1.2.3", string(report.ID)} {
+		assert.NotContains(t, string(data), s)
+	}
+}
+
+func TestToJSONAllowlistNested(t *testing.T) {
+	report := loadFixtureReport(t)
+	opts := lib.ExportOptions{Fields: []string{
+		"severity",
+		"remote_hosts.related_malware.sha256",
+		"severity.unknown", // Nothing under a scalar field.
+		"no_such_field",
+	}}
+	data, err := lib.ToJSON(report, opts)
+	require.NoError(t, err)
+
+	var v map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &v))
+	assert.Equal(t, 2, len(v))
+	assert.Equal(t, "urgent", v["severity"])
+	hosts := v["remote_hosts"].([]interface{})
+	require.Equal(t, 2, len(hosts))
+	assert.Equal(t, map[string]interface{}{
+		"related_malware": []interface{}{
+			map[string]interface{}{"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+	}, hosts[0])
+	assert.NotContains(t, string(data), "VendorA")
+}
+
+func TestToCSVAllowlist(t *testing.T) {
+	report := loadFixtureReport(t)
+	opts := lib.ExportOptions{Fields: []string{"report_id", "remote_hosts.ipaddr", "remote_hosts.country"}}
+	data, err := lib.ToCSV(report, opts)
+	require.NoError(t, err)
+
+	id := string(report.ID)
+	assert.Equal(t, [][]string{
+		{"report_id", "remote_hosts.ipaddr", "remote_hosts.country"},
+		{id, "198.51.100.7", "RU"},
+		{id, "203.0.113.9", "US"},
+	}, readExportCSV(t, data))
+}
+
+func TestToCSVAllFields(t *testing.T) {
+	report := loadFixtureReport(t)
+	data, err := lib.ToCSV(report, lib.ExportOptions{})
+	require.NoError(t, err)
+
+	records := readExportCSV(t, data)
+	require.Equal(t, 5, len(records)) // Header, 2 remote hosts, 1 local host and 1 user.
+	header := records[0]
+	assert.Equal(t, "account_id", header[0])
+	assert.Contains(t, header, "remote_hosts.as_owner")
+	assert.Contains(t, header, "remote_hosts.related_malware.scans.vendor")
+	assert.Contains(t, header, "local_hosts.hostname")
+	assert.Contains(t, header, "users.activities.service_name")
+	assert.Contains(t, string(data), "VendorA;VendorB")
+}
+
+func TestToCSVReportFieldsOnly(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Alert.Description = `Connection to "bad", known C2`
+	opts := lib.ExportOptions{Fields: []string{"severity", "description"}}
+	data, err := lib.ToCSV(report, opts)
+	require.NoError(t, err)
+
+	assert.Equal(t, "severity,description\nurgent,\"Connection to \"\"bad\"\", known C2\"\n", string(data))
+}
+
+func TestToCSVEmptyReport(t *testing.T) {
+	opts := lib.ExportOptions{Fields: []string{"remote_hosts.ipaddr"}}
+	data, err := lib.ToCSV(lib.Report{ID: "empty"}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "remote_hosts.ipaddr\n", string(data))
+}
+
+func TestObservablesCSV(t *testing.T) {
+	report := loadFixtureReport(t)
+	buf := &bytes.Buffer{}
+	require.NoError(t, lib.ObservablesCSV(report, buf, lib.CSVOptions{Header: true}))
+
+	id := string(report.ID)
+	assert.Equal(t, strings.Join([]string{
+		"type,value,first_seen,source,report_id,severity",
+		"ipaddr,198.51.100.7,,," + id + ",urgent",
+		"domain,bad.example.com,2019-01-26T00:00:00Z,VirusTotal," + id + ",urgent",
+		"url,http://bad.example.com/payload,2019-01-26T00:00:00Z,VirusTotal," + id + ",urgent",
+		"sha256,e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855,2019-01-27T10:00:00Z,VirusTotal," + id + ",urgent",
+		"ipaddr,203.0.113.9,,," + id + ",urgent",
+	}, "\n")+"\n", buf.String())
+}
+
+func TestObservablesCSVEscape(t *testing.T) {
+	report := lib.Report{ID: "r1", Content: lib.ReportContent{
+		OpponentHosts: map[string]lib.ReportOpponentHost{
+			"198.51.100.7": {
+				ID: "198.51.100.7",
+				RelatedURLs: []lib.ReportURL{
+					{URL: `http://x.example.net/a,b?q="c"`, Source: "Feed, Inc."},
+				},
+			},
+		},
+	}}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, lib.ObservablesCSV(report, buf, lib.CSVOptions{}))
+	assert.Equal(t, `url,"http://x.example.net/a,b?q=""c""",,"Feed, Inc.",r1,`+"\n", buf.String())
+
+	records := readExportCSV(t, buf.Bytes())
+	assert.Equal(t, `http://x.example.net/a,b?q="c"`, records[0][1])
+	assert.Equal(t, "Feed, Inc.", records[0][3])
+}
+
+func TestObservablesCSVFilter(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Content.OpponentHosts["10.0.0.5"] = lib.ReportOpponentHost{
+		ID:     "10.0.0.5",
+		IPAddr: []string{"10.0.0.5"},
+		RelatedURLs: []lib.ReportURL{
+			{URL: "http://10.0.0.5/admin"},
+			{URL: "https://login.corp.example.org/"},
+			{URL: "https://evil.example.net/"},
+		},
+	}
+
+	// Restrict types
+	buf := &bytes.Buffer{}
+	require.NoError(t, lib.ObservablesCSV(report, buf, lib.CSVOptions{Types: []string{"ipaddr"}}))
+	var values []string
+	for _, row := range readExportCSV(t, buf.Bytes()) {
+		assert.Equal(t, "ipaddr", row[0])
+		values = append(values, row[1])
+	}
+	assert.Equal(t, []string{"10.0.0.5", "198.51.100.7", "203.0.113.9"}, values)
+
+	// Exclude private IP addresses and own domains
+	buf.Reset()
+	opts := lib.CSVOptions{
+		Types:             []string{"ipaddr", "domain", "url"},
+		ExcludePrivateIPs: true,
+		AllowDomains:      []string{"Example.com", "corp.example.org."},
+	}
+	require.NoError(t, lib.ObservablesCSV(report, buf, opts))
+	values = nil
+	for _, row := range readExportCSV(t, buf.Bytes()) {
+		values = append(values, row[1])
+	}
+	assert.Equal(t, []string{"https://evil.example.net/", "198.51.100.7", "203.0.113.9"}, values)
+}
+
+func TestObservablesCSVEmptyReport(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, lib.ObservablesCSV(lib.Report{ID: "empty"}, buf, lib.CSVOptions{Header: true}))
+	assert.Equal(t, "type,value,first_seen,source,report_id,severity\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, lib.ObservablesCSV(lib.Report{ID: "empty"}, buf, lib.CSVOptions{}))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestArchiveObservablesCSV(t *testing.T) {
+	client := &mockS3{}
+	report := loadFixtureReport(t)
+
+	key, err := lib.ArchiveObservablesCSV(client, "archive-bucket", report, lib.CSVOptions{Header: true})
+	require.NoError(t, err)
+	assert.Equal(t, "reports/5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e/observables.csv", key)
+	assert.Equal(t, "text/csv; charset=UTF-8", aws.StringValue(client.puts[0].ContentType))
+	assert.True(t, strings.HasPrefix(client.objects["archive-bucket/"+key], "type,value,"))
+	assert.Contains(t, client.objects["archive-bucket/"+key], "domain,bad.example.com,")
+}
+
+func TestExportRiskScore(t *testing.T) {
+	report := loadFixtureReport(t)
+	// Add a host that ranks higher than others though its ID is larger.
+	report.Content.OpponentHosts["203.0.113.200"] = lib.ReportOpponentHost{
+		ID: "203.0.113.200",
+		RelatedMalware: []lib.ReportMalware{
+			{SHA256: "aa", Scans: []lib.ReportMalwareScan{{Vendor: "VendorA", Positive: true}}},
+		},
+	}
+
+	opts := lib.ExportOptions{Fields: []string{"remote_hosts.id", "remote_hosts.risk_score"}}
+	data, err := lib.ToCSV(report, opts)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"remote_hosts.id", "remote_hosts.risk_score"},
+		{"203.0.113.200", "46"},
+		{"198.51.100.7", "32"},
+		{"203.0.113.9", "0"},
+	}, readExportCSV(t, data))
+
+	data, err = lib.ToJSON(report, opts)
+	require.NoError(t, err)
+	assert.Equal(t, `{"remote_hosts":[{"id":"203.0.113.200","risk_score":46},{"id":"198.51.100.7","risk_score":32},{"id":"203.0.113.9","risk_score":0}]}`, string(data))
+}
@@ -0,0 +1,385 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// TextSearchOption is configuration of SearchReportText. The OpenSearch index
+// is queried if OpenSearch is set, otherwise reports in the report table are
+// scanned and filtered.
+type TextSearchOption struct {
+	OpenSearch *OpenSearchConfig
+
+	TableName string
+	Region    string
+
+	// From and To are range of received time. To is now and From is
+	// DefaultTextSearchPeriod before To if they are zero.
+	From time.Time
+	To   time.Time
+
+	// Limit is max number of hits. DefaultTextSearchLimit is used if zero.
+	Limit int
+}
+
+const (
+	DefaultTextSearchPeriod = 30 * 24 * time.Hour
+	DefaultTextSearchLimit  = 100
+)
+
+// Length of text around the matched term in highlights.
+const textSnippetContext = 40
+
+// TextSearchHit is a report matching the query. Highlights are fields and
+// snippets of the report that matched terms of the query.
+type TextSearchHit struct {
+	ReportID   ReportID  `json:"report_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Highlights []string  `json:"highlights"`
+}
+
+// TextTerm is a term of a query. Field is empty for a term matching any
+// content of the report.
+type TextTerm struct {
+	Field string
+	Value string
+}
+
+// textSearchFields are fields available as "field:value" in queries.
+var textSearchFields = map[string]bool{
+	"host":   true, // ID, IP address or hostname of remote and local hosts
+	"ip":     true,
+	"domain": true,
+	"url":    true,
+	"hash":   true,
+	"user":   true,
+}
+
+// textSearchObservables maps fields to types of observables.
+var textSearchObservables = map[string]string{
+	"domain": "domain",
+	"url":    "url",
+	"hash":   "sha256",
+}
+
+// ParseTextQuery splits a query into terms by spaces. A term with a known
+// field prefix such as "host:192.0.2.1" is scoped to the field, and others
+// (including URLs like "http://...") match any content.
+func ParseTextQuery(query string) ([]TextTerm, error) {
+	var terms []TextTerm
+	for _, token := range strings.Fields(query) {
+		term := TextTerm{Value: token}
+		if kv := strings.SplitN(token, ":", 2); len(kv) == 2 && textSearchFields[strings.ToLower(kv[0])] {
+			term = TextTerm{Field: strings.ToLower(kv[0]), Value: kv[1]}
+		}
+		if term.Value == "" {
+			return nil, NewConfigError(fmt.Sprintf("Empty value of search term: %s", token))
+		}
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 0 {
+		return nil, NewConfigError("Search query is empty")
+	}
+	return terms, nil
+}
+
+// textSnippet returns text around the first case-insensitive match of term.
+func textSnippet(text, term string) (string, bool) {
+	idx := strings.Index(strings.ToLower(text), strings.ToLower(term))
+	if idx < 0 || idx+len(term) > len(text) {
+		return "", false
+	}
+
+	start, end := idx-textSnippetContext, idx+len(term)+textSnippetContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	snippet := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(text) {
+		snippet += "..."
+	}
+	return snippet, true
+}
+
+// match returns highlights of the term in the document. No highlight means
+// that the term does not match.
+func (x TextTerm) match(doc OpenSearchDocument) []string {
+	var highlights []string
+	add := func(field, value string) {
+		h := field + ": " + value
+		if !stringsContain(highlights, h) {
+			highlights = append(highlights, h)
+		}
+	}
+
+	if x.Field == "host" || x.Field == "ip" || x.Field == "" {
+		for _, h := range doc.RemoteHosts {
+			if stringsContain(h.IPAddr, x.Value) || (x.Field != "ip" && h.ID == x.Value) {
+				add("remote_hosts", h.ID)
+			}
+		}
+		for _, h := range doc.LocalHosts {
+			if stringsContain(h.IPAddr, x.Value) ||
+				(x.Field != "ip" && (h.ID == x.Value || stringsContain(h.HostName, x.Value))) {
+				add("local_hosts", h.ID)
+			}
+		}
+	}
+
+	if x.Field == "user" || x.Field == "" {
+		if stringsContain(doc.Users, x.Value) {
+			add("users", x.Value)
+		}
+		for _, h := range doc.LocalHosts {
+			if stringsContain(h.UserName, x.Value) {
+				add("local_hosts", h.ID)
+			}
+		}
+	}
+
+	obsType := textSearchObservables[x.Field]
+	if obsType != "" || x.Field == "" {
+		for _, obs := range doc.Observables {
+			if obs.Value == x.Value && (obsType == "" || obs.Type == obsType) {
+				add("observables."+obs.Type, obs.Value)
+			}
+		}
+	}
+
+	if x.Field == "" {
+		texts := []struct {
+			field string
+			value []string
+		}{
+			{"alert_name", []string{doc.AlertName}},
+			{"description", []string{doc.Description}},
+			{"reason", []string{doc.Reason}},
+			{"summary", []string{doc.Summary}},
+			{"comments", doc.Comments},
+			{"warnings", doc.Warnings},
+			{"text", []string{doc.Text}},
+		}
+		for _, t := range texts {
+			for _, v := range t.value {
+				if snippet, ok := textSnippet(v, x.Value); ok {
+					add(t.field, snippet)
+				}
+			}
+		}
+	}
+
+	return highlights
+}
+
+// matchTextTerms returns highlights if the document matches all terms.
+func matchTextTerms(doc OpenSearchDocument, terms []TextTerm) ([]string, bool) {
+	highlights := []string{}
+	for _, term := range terms {
+		h := term.match(doc)
+		if len(h) == 0 {
+			return nil, false
+		}
+		highlights = append(highlights, h...)
+	}
+	return highlights, true
+}
+
+// MatchReportText returns highlights of the report if it matches all terms.
+func MatchReportText(report Report, terms []TextTerm) ([]string, bool) {
+	return matchTextTerms(NewOpenSearchDocument(report, nil, time.Time{}), terms)
+}
+
+type searchObject map[string]interface{}
+
+func nestedQuery(path string, query searchObject) searchObject {
+	return searchObject{"nested": searchObject{"path": path, "query": query}}
+}
+
+func anyQuery(queries ...searchObject) searchObject {
+	return searchObject{"bool": searchObject{"should": queries, "minimum_should_match": 1}}
+}
+
+func termQuery(field, value string) searchObject {
+	return searchObject{"term": searchObject{field: value}}
+}
+
+// openSearchQuery converts the term to a query of the index mapping.
+func (x TextTerm) openSearchQuery() searchObject {
+	switch x.Field {
+	case "host":
+		return anyQuery(
+			nestedQuery("remote_hosts", anyQuery(termQuery("remote_hosts.id", x.Value), termQuery("remote_hosts.ipaddr", x.Value))),
+			nestedQuery("local_hosts", anyQuery(termQuery("local_hosts.id", x.Value), termQuery("local_hosts.ipaddr", x.Value),
+				termQuery("local_hosts.hostname", x.Value))),
+		)
+	case "ip":
+		return anyQuery(
+			nestedQuery("remote_hosts", termQuery("remote_hosts.ipaddr", x.Value)),
+			nestedQuery("local_hosts", termQuery("local_hosts.ipaddr", x.Value)),
+		)
+	case "domain", "url", "hash":
+		return nestedQuery("observables", searchObject{"bool": searchObject{"filter": []searchObject{
+			termQuery("observables.type", textSearchObservables[x.Field]), termQuery("observables.value", x.Value),
+		}}})
+	case "user":
+		return anyQuery(
+			termQuery("users", x.Value),
+			nestedQuery("local_hosts", termQuery("local_hosts.username", x.Value)),
+		)
+	default:
+		return anyQuery(
+			searchObject{"multi_match": searchObject{
+				"query":  x.Value,
+				"type":   "phrase",
+				"fields": []string{"alert_name", "description", "reason", "summary", "comments", "warnings", "text"},
+			}},
+			termQuery("users", x.Value),
+			nestedQuery("observables", termQuery("observables.value", x.Value)),
+			nestedQuery("remote_hosts", anyQuery(termQuery("remote_hosts.id", x.Value), termQuery("remote_hosts.ipaddr", x.Value))),
+			nestedQuery("local_hosts", anyQuery(termQuery("local_hosts.id", x.Value), termQuery("local_hosts.ipaddr", x.Value),
+				termQuery("local_hosts.hostname", x.Value), termQuery("local_hosts.username", x.Value))),
+		)
+	}
+}
+
+// NewOpenSearchTextQuery builds a search request body of the index. All
+// terms must match, and hits are sorted by received time, newest first.
+func NewOpenSearchTextQuery(terms []TextTerm, from, to time.Time, limit int) map[string]interface{} {
+	var must []searchObject
+	for _, term := range terms {
+		must = append(must, term.openSearchQuery())
+	}
+
+	return searchObject{
+		"size": limit,
+		"query": searchObject{"bool": searchObject{
+			"must": must,
+			"filter": []searchObject{{"range": searchObject{"received_at": searchObject{
+				"gte": from.UTC().Format(time.RFC3339),
+				"lte": to.UTC().Format(time.RFC3339),
+			}}}},
+		}},
+		"sort": []searchObject{{"received_at": "desc"}},
+	}
+}
+
+func searchOpenSearchText(cfg OpenSearchConfig, terms []TextTerm, from, to time.Time, limit int) ([]TextSearchHit, error) {
+	client, err := newOpenSearchClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(NewOpenSearchTextQuery(terms, from, to, limit))
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal OpenSearch query")
+	}
+
+	raw, err := client.request(http.MethodPost, "/"+url.PathEscape(client.cfg.Index)+"/_search", "application/json", body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to search OpenSearch index")
+	}
+
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				Source OpenSearchDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal OpenSearch search response")
+	}
+
+	hits := []TextSearchHit{}
+	for _, h := range resp.Hits.Hits {
+		// Highlights are made from the document in the same way as scanning.
+		// The index has already decided that the document matches.
+		highlights, _ := matchTextTerms(h.Source, terms)
+		if highlights == nil {
+			highlights = []string{}
+		}
+		hits = append(hits, TextSearchHit{
+			ReportID:   h.Source.ReportID,
+			ReceivedAt: h.Source.ReceivedAt,
+			Highlights: highlights,
+		})
+	}
+	return hits, nil
+}
+
+func scanReportText(opt TextSearchOption, terms []TextTerm, from, to time.Time, limit int) ([]TextSearchHit, error) {
+	reports, err := SearchReports(opt.TableName, opt.Region, "", from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := []TextSearchHit{}
+	for _, report := range reports {
+		if len(hits) >= limit {
+			break
+		}
+		if highlights, ok := MatchReportText(report, terms); ok {
+			hits = append(hits, TextSearchHit{
+				ReportID:   report.ID,
+				ReceivedAt: report.ReceivedAt,
+				Highlights: highlights,
+			})
+		}
+	}
+	return hits, nil
+}
+
+// SearchReportText returns reports matching all terms of the query, e.g.
+// "host:192.0.2.1 phishing". Hits are sorted by received time, newest first.
+func SearchReportText(opt TextSearchOption, query string) (hits []TextSearchHit, err error) {
+	span := StartTrace("SearchReportText")
+	defer func() { span.End(err) }()
+
+	terms, err := ParseTextQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	to := opt.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	from := opt.From
+	if from.IsZero() {
+		from = to.Add(-DefaultTextSearchPeriod)
+	}
+	if to.Before(from) {
+		return nil, NewConfigError("End of range is before start")
+	}
+	limit := opt.Limit
+	if limit <= 0 {
+		limit = DefaultTextSearchLimit
+	}
+
+	if opt.OpenSearch != nil && opt.OpenSearch.Endpoint != "" {
+		return searchOpenSearchText(*opt.OpenSearch, terms, from, to, limit)
+	}
+	return scanReportText(opt, terms, from, to, limit)
+}
@@ -0,0 +1,126 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTextQuery(t *testing.T) {
+	terms, err := lib.ParseTextQuery("host:198.51.100.7  Outbound http://bad.example.com/payload USER:alice")
+	require.NoError(t, err)
+	assert.Equal(t, []lib.TextTerm{
+		{Field: "host", Value: "198.51.100.7"},
+		{Value: "Outbound"},
+		{Value: "http://bad.example.com/payload"},
+		{Field: "user", Value: "alice"},
+	}, terms)
+
+	for _, q := range []string{"", "   ", "host:"} {
+		_, err := lib.ParseTextQuery(q)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, q)
+	}
+}
+
+func TestMatchReportText(t *testing.T) {
+	report := loadFixtureReport(t)
+
+	testCases := []struct {
+		query      string
+		match      bool
+		highlights []string
+	}{
+		{"host:198.51.100.7", true, []string{"remote_hosts: 198.51.100.7"}},
+		{"host:web-01", true, []string{"local_hosts: i-0123456789"}},
+		{"ip:web-01", false, nil},
+		{"domain:bad.example.com", true, []string{"observables.domain: bad.example.com"}},
+		{"hash:bad.example.com", false, nil},
+		{"user:alice", true, []string{"users: alice", "local_hosts: i-0123456789"}},
+		{"KNOWN", true, []string{"description: Outbound connection to known malicious host"}},
+		{"host:198.51.100.7 known", true, []string{
+			"remote_hosts: 198.51.100.7",
+			"description: Outbound connection to known malicious host",
+		}},
+		{"host:198.51.100.7 benign", false, nil},
+	}
+
+	for _, tc := range testCases {
+		terms, err := lib.ParseTextQuery(tc.query)
+		require.NoError(t, err)
+		highlights, ok := lib.MatchReportText(report, terms)
+		assert.Equal(t, tc.match, ok, tc.query)
+		if tc.match {
+			assert.Equal(t, tc.highlights, highlights, tc.query)
+		}
+	}
+}
+
+func TestSearchReportTextScan(t *testing.T) {
+	fixture := loadFixtureReport(t)
+	other := lib.Report{ID: "port-scan", ReceivedAt: fixture.ReceivedAt.Add(-time.Hour),
+		Alert: lib.Alert{Description: "Port scan from 203.0.113.50"}}
+
+	table := &mockReportTable{}
+	for _, report := range []lib.Report{fixture, other} {
+		record, err := lib.NewReportRecord(report, "ap-northeast-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	opt := lib.TextSearchOption{
+		TableName: "reports",
+		Region:    "ap-northeast-1",
+		From:      fixture.ReceivedAt.Add(-24 * time.Hour),
+		To:        fixture.ReceivedAt,
+	}
+	hits, err := lib.SearchReportText(opt, "host:198.51.100.7")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(hits))
+	assert.Equal(t, fixture.ID, hits[0].ReportID)
+
+	hits, err = lib.SearchReportText(opt, "203.0.113.50")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(hits))
+	assert.Equal(t, lib.ReportID("port-scan"), hits[0].ReportID)
+	assert.Equal(t, []string{"description: Port scan from 203.0.113.50"}, hits[0].Highlights)
+
+	hits, err = lib.SearchReportText(opt, "port-scan")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(hits))
+}
+
+func TestSearchReportTextOpenSearch(t *testing.T) {
+	search := newMockOpenSearch(t)
+	defer search.srv.Close()
+
+	cfg := lib.OpenSearchConfig{Endpoint: search.srv.URL, Username: "user", Password: "pass"}
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishOpenSearch(cfg, report))
+
+	opt := lib.TextSearchOption{
+		OpenSearch: &cfg,
+		From:       report.ReceivedAt.Add(-time.Hour),
+		To:         report.ReceivedAt,
+		Limit:      10,
+	}
+	hits, err := lib.SearchReportText(opt, "host:198.51.100.7")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(hits))
+	assert.Equal(t, report.ID, hits[0].ReportID)
+	assert.Equal(t, []string{"remote_hosts: 198.51.100.7"}, hits[0].Highlights)
+
+	require.Equal(t, 1, len(search.searches))
+	query := search.searches[0]
+	assert.Equal(t, float64(10), query["size"])
+	raw, err := json.Marshal(query["query"])
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"path":"remote_hosts"`)
+	assert.Contains(t, string(raw), `{"term":{"remote_hosts.ipaddr":"198.51.100.7"}}`)
+	assert.Contains(t, string(raw), `"gte":"2019-01-28T02:04:05Z"`)
+}
@@ -0,0 +1,85 @@
+package lib
+
+import "strings"
+
+// countryAliases maps ISO 3166-1 alpha-3 codes and common names that
+// inspectors report to alpha-2 codes. Keys are upper case.
+var countryAliases = map[string]string{
+	"USA":                      "US",
+	"UNITED STATES":            "US",
+	"UNITED STATES OF AMERICA": "US",
+	"RUS":                      "RU",
+	"RUSSIA":                   "RU",
+	"RUSSIAN FEDERATION":       "RU",
+	"CHN":                      "CN",
+	"CHINA":                    "CN",
+	"JPN":                      "JP",
+	"JAPAN":                    "JP",
+	"GBR":                      "GB",
+	"UK":                       "GB",
+	"UNITED KINGDOM":           "GB",
+	"DEU":                      "DE",
+	"GERMANY":                  "DE",
+	"FRA":                      "FR",
+	"FRANCE":                   "FR",
+	"NLD":                      "NL",
+	"NETHERLANDS":              "NL",
+	"KOR":                      "KR",
+	"SOUTH KOREA":              "KR",
+	"PRK":                      "KP",
+	"NORTH KOREA":              "KP",
+	"IRN":                      "IR",
+	"IRAN":                     "IR",
+	"IND":                      "IN",
+	"INDIA":                    "IN",
+	"BRA":                      "BR",
+	"BRAZIL":                   "BR",
+	"UKR":                      "UA",
+	"UKRAINE":                  "UA",
+	"SGP":                      "SG",
+	"SINGAPORE":                "SG",
+	"CAN":                      "CA",
+	"CANADA":                   "CA",
+	"AUS":                      "AU",
+	"AUSTRALIA":                "AU",
+}
+
+// NormalizeCountry returns ISO 3166-1 alpha-2 code of the country, e.g. "US"
+// for "us", "USA" and "United States". Empty string is returned if the value
+// is neither an alpha-2 code nor a known alias.
+func NormalizeCountry(country string) string {
+	s := strings.ToUpper(strings.TrimSpace(country))
+	if code, ok := countryAliases[s]; ok {
+		return code
+	}
+	if len(s) != 2 || s[0] < 'A' || s[0] > 'Z' || s[1] < 'A' || s[1] > 'Z' {
+		return ""
+	}
+	return s
+}
+
+// CountryCounts returns number of hosts by normalized country code. Remote
+// and local hosts are both counted, and a host with several addresses in a
+// country is counted once.
+func (x *ReportContent) CountryCounts() map[string]int {
+	counts := map[string]int{}
+	count := func(countries []string) {
+		seen := map[string]bool{}
+		for _, c := range countries {
+			code := NormalizeCountry(c)
+			if code == "" || seen[code] {
+				continue
+			}
+			seen[code] = true
+			counts[code]++
+		}
+	}
+
+	for _, host := range x.OpponentHosts {
+		count(host.Countries())
+	}
+	for _, host := range x.AlliedHosts {
+		count(host.Country)
+	}
+	return counts
+}
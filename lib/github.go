@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GitHubConfig is configuration of PublishGitHub. Either Token or GitHub App
+// credential (AppID, InstallationID and PrivateKey) is required.
+type GitHubConfig struct {
+	// APIURL is endpoint of GitHub API. https://api.github.com is used by
+	// default.
+	APIURL string
+	Owner  string
+	Repo   string
+
+	Token string
+
+	AppID          string
+	InstallationID string
+	PrivateKey     string // PEM encoded RSA private key of GitHub App
+
+	Labels []string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+const githubDefaultAPIURL = "https://api.github.com"
+
+type githubIssue struct {
+	Number int    `json:"number"`
+	State  string `json:"state"`
+	Body   string `json:"body"`
+}
+
+type githubClient struct {
+	cfg   GitHubConfig
+	token string
+}
+
+// GitHubMarker returns a hidden marker in issue body to find the issue of the
+// report.
+func GitHubMarker(report Report) string {
+	return fmt.Sprintf("<!-- alert-responder:report_id=%s -->", report.ID)
+}
+
+// GitHubIssueTitle returns title of the issue of the report.
+func GitHubIssueTitle(report Report) string {
+	return fmt.Sprintf("[%s] %s — %s", severityLabel(report), report.Alert.Rule, report.Alert.Key)
+}
+
+func (x *GitHubConfig) apiURL() string {
+	if x.APIURL == "" {
+		return githubDefaultAPIURL
+	}
+	return strings.TrimRight(x.APIURL, "/")
+}
+
+func (x *GitHubConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+func githubHeader(auth string) http.Header {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	header.Set("Content-Type", "application/json")
+	header.Set("Authorization", auth)
+	return header
+}
+
+// githubAppJWT creates JWT of GitHub App signed by RS256.
+func githubAppJWT(appID, privateKey string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", NewConfigError("Invalid PEM of GitHub App private key")
+	}
+
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return "", NewConfigError("GitHub App private key is not RSA")
+		}
+		key = rsaKey
+	} else {
+		return "", NewConfigError("Fail to parse GitHub App private key")
+	}
+
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// iat is shifted to allow clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to marshal JWT claims")
+	}
+
+	signingInput := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to sign JWT")
+	}
+
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+func newGitHubClient(cfg GitHubConfig) (*githubClient, error) {
+	if cfg.Owner == "" || cfg.Repo == "" {
+		return nil, NewConfigError("GitHub repository is not configured")
+	}
+
+	if cfg.Token != "" {
+		return &githubClient{cfg: cfg, token: cfg.Token}, nil
+	}
+	if cfg.AppID == "" || cfg.InstallationID == "" || cfg.PrivateKey == "" {
+		return nil, NewConfigError("GitHub token or App credential is required")
+	}
+
+	jwt, err := githubAppJWT(cfg.AppID, cfg.PrivateKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/app/installations/%s/access_tokens", cfg.apiURL(), url.PathEscape(cfg.InstallationID))
+	resp, err := sendHTTPRequest(cfg.Client, http.MethodPost, endpoint, githubHeader("Bearer "+jwt), nil, cfg.retry())
+	if err != nil {
+		return nil, githubError(err, "Fail to get GitHub App installation token")
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(resp, &token); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal installation token")
+	}
+
+	return &githubClient{cfg: cfg, token: token.Token}, nil
+}
+
+func githubError(err error, msg string) error {
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusUnauthorized {
+		return WrapCode(ErrCodeInvalidConfig, err, msg)
+	}
+	return WrapCode(ErrCodePublish, err, msg)
+}
+
+func (x *githubClient) request(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to marshal GitHub request")
+		}
+		body = raw
+	}
+
+	resp, err := sendHTTPRequest(x.cfg.Client, method, x.cfg.apiURL()+path, githubHeader("token "+x.token), body, x.cfg.retry())
+	if err != nil {
+		return githubError(err, fmt.Sprintf("Fail to %s %s", method, path))
+	}
+
+	if out != nil && len(resp) > 0 {
+		if err := json.Unmarshal(resp, out); err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to unmarshal GitHub response")
+		}
+	}
+	return nil
+}
+
+func (x *githubClient) repoPath() string {
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(x.cfg.Owner), url.PathEscape(x.cfg.Repo))
+}
+
+// findIssue returns open issue that has marker of the report.
+func (x *githubClient) findIssue(report Report) (*githubIssue, error) {
+	q := fmt.Sprintf(`repo:%s/%s is:issue is:open in:body "%s"`, x.cfg.Owner, x.cfg.Repo, report.ID)
+	var resp struct {
+		Items []githubIssue `json:"items"`
+	}
+	if err := x.request(http.MethodGet, "/search/issues?q="+url.QueryEscape(q), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	// Search matches words, then the marker is checked exactly.
+	marker := GitHubMarker(report)
+	for _, issue := range resp.Items {
+		if strings.Contains(issue.Body, marker) {
+			issue := issue
+			return &issue, nil
+		}
+	}
+	return nil, nil
+}
+
+func githubBody(cfg GitHubConfig, report Report) string {
+	body := RenderMarkDown(report)
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		body += fmt.Sprintf("\n\n[Full report](%s)", link)
+	}
+	return body
+}
+
+func (x *githubClient) createIssue(report Report) error {
+	labels := append([]string{"alert-responder"}, x.cfg.Labels...)
+	if report.Result.Severity != "" {
+		labels = append(labels, "severity:"+string(report.Result.Severity))
+	}
+
+	issue := map[string]interface{}{
+		"title":  GitHubIssueTitle(report),
+		"body":   githubBody(x.cfg, report) + "\n\n" + GitHubMarker(report),
+		"labels": labels,
+	}
+	var created githubIssue
+	if err := x.request(http.MethodPost, x.repoPath()+"/issues", issue, &created); err != nil {
+		return err
+	}
+
+	Logger.WithField("issue", created.Number).Info("Created GitHub issue")
+	return nil
+}
+
+func (x *githubClient) comment(number int, body string) error {
+	path := fmt.Sprintf("%s/issues/%d/comments", x.repoPath(), number)
+	return x.request(http.MethodPost, path, map[string]string{"body": body}, nil)
+}
+
+func (x *githubClient) closeIssue(number int) error {
+	path := fmt.Sprintf("%s/issues/%d", x.repoPath(), number)
+	return x.request(http.MethodPatch, path, map[string]string{"state": "closed", "state_reason": "completed"}, nil)
+}
+
+// PublishGitHub creates an issue of the report in the repository. If an open
+// issue of the report exists, a comment with the latest report is added
+// instead, and the issue is closed when the report is closed.
+func PublishGitHub(cfg GitHubConfig, report Report) error {
+	client, err := newGitHubClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	issue, err := client.findIssue(report)
+	if err != nil {
+		return err
+	}
+
+	if issue == nil {
+		if report.IsClosed() {
+			Logger.WithFields(report.LogFields()).Info("No open issue of closed report")
+			return nil
+		}
+		return client.createIssue(report)
+	}
+
+	if err := client.comment(issue.Number, "Report is updated.\n\n"+githubBody(cfg, report)); err != nil {
+		return err
+	}
+	if report.IsClosed() {
+		if err := client.closeIssue(issue.Number); err != nil {
+			return err
+		}
+		Logger.WithField("issue", issue.Number).Info("Closed GitHub issue")
+	}
+	return nil
+}
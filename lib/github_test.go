@@ -0,0 +1,211 @@
+package lib_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockGitHubIssue struct {
+	Title    string
+	Body     string
+	Labels   []string
+	State    string
+	Comments []string
+}
+
+// mockGitHub is a minimum GitHub REST API server for tests.
+type mockGitHub struct {
+	t         *testing.T
+	srv       *httptest.Server
+	issues    []*mockGitHubIssue
+	auth      []string
+	rateLimit int
+}
+
+func newMockGitHub(t *testing.T) *mockGitHub {
+	x := &mockGitHub{t: t}
+	x.srv = httptest.NewServer(http.HandlerFunc(x.handle))
+	return x
+}
+
+var githubIssuePath = regexp.MustCompile(`^/repos/sec/triage/issues/(\d+)(/comments)?$`)
+
+func (x *mockGitHub) handle(w http.ResponseWriter, r *http.Request) {
+	x.auth = append(x.auth, r.Header.Get("Authorization"))
+
+	if r.URL.Path == "/app/installations/42/access_tokens" && r.Method == http.MethodPost {
+		assert.True(x.t, strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "))
+		json.NewEncoder(w).Encode(map[string]string{"token": "installation-token"})
+		return
+	}
+
+	// Secondary rate limit
+	if x.rateLimit > 0 {
+		x.rateLimit--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message":"You have exceeded a secondary rate limit"}`))
+		return
+	}
+
+	var in map[string]interface{}
+	if r.Body != nil && r.ContentLength != 0 {
+		json.NewDecoder(r.Body).Decode(&in)
+	}
+
+	switch {
+	case r.URL.Path == "/search/issues" && r.Method == http.MethodGet:
+		q := r.URL.Query().Get("q")
+		assert.Contains(x.t, q, "repo:sec/triage")
+		assert.Contains(x.t, q, "is:open")
+		items := []map[string]interface{}{}
+		for i, issue := range x.issues {
+			m := regexp.MustCompile(`"([^"]+)"`).FindStringSubmatch(q)
+			if issue.State == "open" && m != nil && strings.Contains(issue.Body, m[1]) {
+				items = append(items, map[string]interface{}{"number": i + 1, "state": issue.State, "body": issue.Body})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case r.URL.Path == "/repos/sec/triage/issues" && r.Method == http.MethodPost:
+		issue := &mockGitHubIssue{
+			Title: in["title"].(string),
+			Body:  in["body"].(string),
+			State: "open",
+		}
+		for _, l := range in["labels"].([]interface{}) {
+			issue.Labels = append(issue.Labels, l.(string))
+		}
+		x.issues = append(x.issues, issue)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"number": len(x.issues)})
+
+	default:
+		m := githubIssuePath.FindStringSubmatch(r.URL.Path)
+		var n int
+		if m != nil {
+			fmt.Sscanf(m[1], "%d", &n)
+		}
+		if n < 1 || n > len(x.issues) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		issue := x.issues[n-1]
+
+		switch {
+		case m[2] == "/comments" && r.Method == http.MethodPost:
+			issue.Comments = append(issue.Comments, in["body"].(string))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case m[2] == "" && r.Method == http.MethodPatch:
+			issue.State = in["state"].(string)
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (x *mockGitHub) config() lib.GitHubConfig {
+	return lib.GitHubConfig{
+		APIURL: x.srv.URL,
+		Owner:  "sec",
+		Repo:   "triage",
+		Token:  "test-token",
+		Labels: []string{"triage"},
+		Retry:  lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+}
+
+func TestPublishGitHubCreate(t *testing.T) {
+	gh := newMockGitHub(t)
+	defer gh.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+
+	require.Equal(t, 1, len(gh.issues))
+	issue := gh.issues[0]
+	assert.Equal(t, "[URGENT] malware-detected — 10.1.2.3", issue.Title)
+	assert.Contains(t, issue.Body, lib.RenderMarkDown(report))
+	assert.Contains(t, issue.Body, lib.GitHubMarker(report))
+	assert.Equal(t, []string{"alert-responder", "triage", "severity:urgent"}, issue.Labels)
+	assert.Equal(t, "token test-token", gh.auth[0])
+}
+
+func TestPublishGitHubCommentOnExisting(t *testing.T) {
+	gh := newMockGitHub(t)
+	defer gh.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+
+	// Recompiled report is posted as a comment even under secondary rate limit.
+	gh.rateLimit = 1
+	report.Result.Reason = "Confirmed C2 communication"
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+
+	require.Equal(t, 1, len(gh.issues))
+	require.Equal(t, 1, len(gh.issues[0].Comments))
+	assert.Contains(t, gh.issues[0].Comments[0], "Confirmed C2 communication")
+	assert.Equal(t, "open", gh.issues[0].State)
+}
+
+func TestPublishGitHubClose(t *testing.T) {
+	gh := newMockGitHub(t)
+	defer gh.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+
+	report.Status = lib.StatusClosed
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+	require.Equal(t, 1, len(gh.issues))
+	assert.Equal(t, "closed", gh.issues[0].State)
+	assert.Equal(t, 1, len(gh.issues[0].Comments))
+
+	// Closed issue is not found anymore and no new issue is opened.
+	require.NoError(t, lib.PublishGitHub(gh.config(), report))
+	assert.Equal(t, 1, len(gh.issues))
+}
+
+func TestPublishGitHubAppCredential(t *testing.T) {
+	gh := newMockGitHub(t)
+	defer gh.srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	cfg := gh.config()
+	cfg.Token = ""
+	cfg.AppID = "1234"
+	cfg.InstallationID = "42"
+	cfg.PrivateKey = string(keyPEM)
+	require.NoError(t, lib.PublishGitHub(cfg, loadFixtureReport(t)))
+
+	require.Equal(t, 1, len(gh.issues))
+	assert.Equal(t, "token installation-token", gh.auth[len(gh.auth)-1])
+}
+
+func TestPublishGitHubNoCredential(t *testing.T) {
+	cfg := lib.GitHubConfig{Owner: "sec", Repo: "triage"}
+	err := lib.PublishGitHub(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
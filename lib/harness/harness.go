@@ -0,0 +1,251 @@
+// Package harness runs Lambda handlers of AlertResponder in `go test` without
+// AWS. It replaces storage, Step Functions and SNS used through lib with
+// in-memory fakes and provides Lambda context and environment variables that
+// handlers expect.
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+)
+
+const (
+	Region    = "us-east-1"
+	AccountID = "123456789012"
+
+	AlertMapName = "alert-map"
+	ReportData   = "report-data"
+	ReportTable  = "report-table"
+)
+
+var (
+	DispatchMachine    = fmt.Sprintf("arn:aws:states:%s:%s:stateMachine:dispatch", Region, AccountID)
+	ReviewMachine      = fmt.Sprintf("arn:aws:states:%s:%s:stateMachine:review", Region, AccountID)
+	ReportNotification = fmt.Sprintf("arn:aws:sns:%s:%s:report-notification", Region, AccountID)
+)
+
+// Execution is a started execution of state machine.
+type Execution struct {
+	StateMachineArn string
+	Report          lib.Report
+
+	// Input is the raw execution input including delay and extra fields.
+	Input string
+}
+
+// Message is a published SNS message.
+type Message struct {
+	TopicArn   string
+	Data       []byte
+	Attributes map[string]string
+}
+
+// Harness has in-memory AWS services. It is installed by New and must be
+// uninstalled by Close. Harnesses must not be used in parallel because lib
+// has the services as package variables.
+type Harness struct {
+	Reports *ReportStore
+	Alerts  *AlertStore
+
+	mu         sync.Mutex
+	executions []Execution
+	messages   []Message
+
+	restore []func()
+}
+
+// New installs a harness. Environment variables of table names, state
+// machines and topic are set to resources of the harness.
+func New() *Harness {
+	x := &Harness{
+		Reports: NewReportStore(),
+		Alerts:  NewAlertStore(),
+	}
+
+	origReportTable, origAlertMap := lib.OpenReportTable, lib.OpenAlertMap
+	origSFN, origSNS := lib.SFNClient, lib.SNSClient
+	origAlertMapName := lib.AlertMapName
+	x.restore = append(x.restore, func() {
+		lib.OpenReportTable, lib.OpenAlertMap = origReportTable, origAlertMap
+		lib.SFNClient, lib.SNSClient = origSFN, origSNS
+		lib.AlertMapName = origAlertMapName
+	})
+
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable {
+		return x.Reports
+	}
+	lib.OpenAlertMap = func(region, tableName string) lib.AlertMapTable {
+		return x.Alerts
+	}
+	lib.SFNClient = &fakeSFN{h: x}
+	lib.SNSClient = &fakeSNS{h: x}
+	lib.AlertMapName = AlertMapName
+
+	x.setenv("ALERT_MAP", AlertMapName)
+	x.setenv("REPORT_DATA", ReportData)
+	x.setenv("REPORT_TABLE", ReportTable)
+	x.setenv("DISPATCH_MACHINE", DispatchMachine)
+	x.setenv("REVIEW_MACHINE", ReviewMachine)
+	x.setenv("REPORT_NOTIFICATION", ReportNotification)
+	x.setenv("AWS_REGION", Region)
+
+	return x
+}
+
+func (x *Harness) setenv(key, value string) {
+	orig, ok := os.LookupEnv(key)
+	x.restore = append(x.restore, func() {
+		if ok {
+			os.Setenv(key, orig)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	os.Setenv(key, value)
+}
+
+// Setenv sets an environment variable until Close.
+func (x *Harness) Setenv(key, value string) {
+	x.setenv(key, value)
+}
+
+// Close uninstalls the harness and restores environment variables.
+func (x *Harness) Close() {
+	for i := len(x.restore) - 1; i >= 0; i-- {
+		x.restore[i]()
+	}
+	x.restore = nil
+}
+
+// Context returns a context of Lambda function invocation.
+func (x *Harness) Context(funcName string) context.Context {
+	return lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{
+		AwsRequestID:       lib.NewUUID(),
+		InvokedFunctionArn: fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", Region, AccountID, funcName),
+	})
+}
+
+// SNSEvent returns an SNS event that has each object as a message, e.g.
+// alerts for Receptor.
+func (x *Harness) SNSEvent(objects ...interface{}) (events.SNSEvent, error) {
+	var event events.SNSEvent
+	for _, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return event, errors.Wrap(err, "Fail to marshal SNS message")
+		}
+
+		var record events.SNSEventRecord
+		record.EventSource = "aws:sns"
+		record.SNS.TopicArn = fmt.Sprintf("arn:aws:sns:%s:%s:alert-notification", Region, AccountID)
+		record.SNS.MessageID = lib.NewUUID()
+		record.SNS.Message = string(data)
+		record.SNS.Timestamp = time.Now().UTC()
+		event.Records = append(event.Records, record)
+	}
+	return event, nil
+}
+
+// SubmitPage stores a page of the report as an inspector does.
+func (x *Harness) SubmitPage(reportID lib.ReportID, page lib.ReportPage) error {
+	page.ReportID = reportID
+	component := lib.NewReportComponent(reportID)
+	if err := component.SetPage(page); err != nil {
+		return err
+	}
+	return component.Submit(ReportData, Region)
+}
+
+// Executions returns started executions of the state machine in order.
+func (x *Harness) Executions(stateMachineArn string) []Execution {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var result []Execution
+	for _, e := range x.executions {
+		if e.StateMachineArn == stateMachineArn {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Messages returns published messages to the topic in order.
+func (x *Harness) Messages(topicArn string) []Message {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var result []Message
+	for _, m := range x.messages {
+		if m.TopicArn == topicArn {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+type fakeSFN struct {
+	sfniface.SFNAPI
+	h *Harness
+}
+
+func (x *fakeSFN) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	var report lib.Report
+	if err := json.Unmarshal([]byte(aws.StringValue(input.Input)), &report); err != nil {
+		return nil, errors.Wrap(err, "Invalid input of execution")
+	}
+
+	x.h.mu.Lock()
+	defer x.h.mu.Unlock()
+	x.h.executions = append(x.h.executions, Execution{
+		StateMachineArn: aws.StringValue(input.StateMachineArn),
+		Report:          report,
+		Input:           aws.StringValue(input.Input),
+	})
+
+	now := time.Now().UTC()
+	return &sfn.StartExecutionOutput{
+		ExecutionArn: aws.String(fmt.Sprintf("%s:%s", aws.StringValue(input.StateMachineArn), lib.NewUUID())),
+		StartDate:    &now,
+	}, nil
+}
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	h *Harness
+}
+
+func (x *fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	return x.Publish(input)
+}
+
+func (x *fakeSNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	x.h.mu.Lock()
+	defer x.h.mu.Unlock()
+	msg := Message{
+		TopicArn:   aws.StringValue(input.TopicArn),
+		Data:       []byte(aws.StringValue(input.Message)),
+		Attributes: map[string]string{},
+	}
+	for name, attr := range input.MessageAttributes {
+		msg.Attributes[name] = aws.StringValue(attr.StringValue)
+	}
+	x.h.messages = append(x.h.messages, msg)
+
+	return &sns.PublishOutput{MessageId: aws.String(lib.NewUUID())}, nil
+}
@@ -0,0 +1,53 @@
+package harness
+
+import (
+	"sync"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+)
+
+// ReportStore is an in-memory lib.ReportTable. All tables of report and
+// report data are stored in one store regardless of name and region.
+type ReportStore = lib.MemoryReportTable
+
+func NewReportStore() *ReportStore {
+	return lib.NewMemoryReportTable()
+}
+
+// AlertStore is an in-memory lib.AlertMapTable.
+type AlertStore struct {
+	// Err is returned by all methods if not nil to simulate unavailable
+	// table.
+	Err error
+
+	mu      sync.Mutex
+	records map[string]lib.AlertRecord
+}
+
+func NewAlertStore() *AlertStore {
+	return &AlertStore{records: map[string]lib.AlertRecord{}}
+}
+
+func (x *AlertStore) GetAlertRecords(alertID string) ([]lib.AlertRecord, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.Err != nil {
+		return nil, x.Err
+	}
+	if r, ok := x.records[alertID]; ok {
+		return []lib.AlertRecord{r}, nil
+	}
+	return nil, nil
+}
+
+func (x *AlertStore) PutAlertRecord(record *lib.AlertRecord) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.Err != nil {
+		return x.Err
+	}
+	x.records[record.AlertID] = *record
+	return nil
+}
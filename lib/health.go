@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/pkg/errors"
+)
+
+// HealthCheckTimeout is limit of each probe. A probe exceeding it is reported
+// as unhealthy without waiting for the result.
+var HealthCheckTimeout = 3 * time.Second
+
+// HealthProbe is a check of a dependency, e.g. DynamoDB table or SNS topic.
+type HealthProbe struct {
+	Name  string
+	Check func() error
+}
+
+// DependencyStatus is a result of HealthProbe.
+type DependencyStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Elapsed   float64   `json:"elapsed_ms"`
+}
+
+// HealthStatus is a result of CheckHealth. Healthy is true only if all
+// dependencies are healthy.
+type HealthStatus struct {
+	Healthy      bool               `json:"healthy"`
+	CheckedAt    time.Time          `json:"checked_at"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+func runProbe(probe HealthProbe) DependencyStatus {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- probe.Check() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(HealthCheckTimeout):
+		err = errors.Errorf("Timeout after %s", HealthCheckTimeout)
+	}
+
+	status := DependencyStatus{
+		Name:    probe.Name,
+		Healthy: err == nil,
+		Elapsed: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		status.Error = err.Error()
+		status.ErrorCode = ErrorCodeOf(err)
+	}
+	return status
+}
+
+// CheckHealth runs probes concurrently and returns status of each dependency
+// in order of probes.
+func CheckHealth(probes []HealthProbe) HealthStatus {
+	status := HealthStatus{
+		Healthy:      true,
+		CheckedAt:    time.Now().UTC(),
+		Dependencies: make([]DependencyStatus, len(probes)),
+	}
+
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status.Dependencies[i] = runProbe(probes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, dep := range status.Dependencies {
+		if !dep.Healthy {
+			status.Healthy = false
+		}
+	}
+
+	return status
+}
+
+// healthCheckKey is a hash key that never exists in tables.
+const healthCheckKey = "alert-responder-health-check"
+
+// NewTableProbe returns a probe that queries the table by a dummy hash key.
+// It requires only read permission and consumes minimum capacity.
+func NewTableProbe(region, tableName, hashKey string) HealthProbe {
+	return HealthProbe{
+		Name: "dynamodb:" + tableName,
+		Check: func() error {
+			if tableName == "" {
+				return NewConfigError("Table name is not set")
+			}
+
+			var items []map[string]interface{}
+			table := NewStorageDB(region).Table(tableName)
+			if err := table.Get(hashKey, healthCheckKey).Limit(1).All(&items); err != nil {
+				return WrapStoreError(ErrCodeStoreGet, err, "Fail to query table")
+			}
+			return nil
+		},
+	}
+}
+
+// NewTopicProbe returns a probe that gets attributes of the SNS topic. A client
+// for region is created if client is nil.
+func NewTopicProbe(client snsiface.SNSAPI, region, topicArn string) HealthProbe {
+	return HealthProbe{
+		Name: "sns:" + topicArn,
+		Check: func() error {
+			if err := ValidateSnsTopicArn(topicArn, region); err != nil {
+				return err
+			}
+
+			c := client
+			if c == nil {
+				c = sns.New(newSession(region))
+			}
+			_, err := c.GetTopicAttributes(&sns.GetTopicAttributesInput{
+				TopicArn: aws.String(topicArn),
+			})
+			if err != nil {
+				return WrapCode(ErrCodePublish, err, "Fail to get topic attributes")
+			}
+			return nil
+		},
+	}
+}
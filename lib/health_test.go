@@ -0,0 +1,94 @@
+package lib_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (x *mockSNS) GetTopicAttributes(input *sns.GetTopicAttributesInput) (*sns.GetTopicAttributesOutput, error) {
+	x.topics = append(x.topics, aws.StringValue(input.TopicArn))
+	if x.err != nil {
+		return nil, x.err
+	}
+	return &sns.GetTopicAttributesOutput{}, nil
+}
+
+func TestCheckHealthAllHealthy(t *testing.T) {
+	status := lib.CheckHealth([]lib.HealthProbe{
+		{Name: "table", Check: func() error { return nil }},
+		{Name: "topic", Check: func() error { return nil }},
+	})
+
+	assert.True(t, status.Healthy)
+	require.Equal(t, 2, len(status.Dependencies))
+	assert.Equal(t, "table", status.Dependencies[0].Name)
+	assert.Equal(t, "topic", status.Dependencies[1].Name)
+	for _, dep := range status.Dependencies {
+		assert.True(t, dep.Healthy)
+		assert.Equal(t, "", dep.Error)
+	}
+}
+
+func TestCheckHealthUnhealthy(t *testing.T) {
+	status := lib.CheckHealth([]lib.HealthProbe{
+		{Name: "table", Check: func() error { return nil }},
+		{Name: "topic", Check: func() error {
+			return lib.WrapCode(lib.ErrCodePublish, errors.New("AccessDenied"), "Fail to get topic attributes")
+		}},
+	})
+
+	assert.False(t, status.Healthy)
+	require.Equal(t, 2, len(status.Dependencies))
+	assert.True(t, status.Dependencies[0].Healthy)
+	assert.False(t, status.Dependencies[1].Healthy)
+	assert.Contains(t, status.Dependencies[1].Error, "AccessDenied")
+	assert.Equal(t, lib.ErrCodePublish, status.Dependencies[1].ErrorCode)
+}
+
+func TestCheckHealthTimeout(t *testing.T) {
+	defer func(v time.Duration) { lib.HealthCheckTimeout = v }(lib.HealthCheckTimeout)
+	lib.HealthCheckTimeout = 10 * time.Millisecond
+
+	block := make(chan struct{})
+	defer close(block)
+
+	status := lib.CheckHealth([]lib.HealthProbe{
+		{Name: "slow", Check: func() error { <-block; return nil }},
+	})
+
+	assert.False(t, status.Healthy)
+	require.Equal(t, 1, len(status.Dependencies))
+	assert.Contains(t, status.Dependencies[0].Error, "Timeout")
+}
+
+func TestTopicProbe(t *testing.T) {
+	topicArn := "arn:aws:sns:ap-northeast-1:123456789012:reports"
+
+	client := &mockSNS{}
+	probe := lib.NewTopicProbe(client, "ap-northeast-1", topicArn)
+	assert.NoError(t, probe.Check())
+	assert.Equal(t, []string{topicArn}, client.topics)
+
+	client = &mockSNS{err: awserr.New("NotFound", "Topic does not exist", nil)}
+	probe = lib.NewTopicProbe(client, "ap-northeast-1", topicArn)
+	err := probe.Check()
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+}
+
+func TestTopicProbeInvalidArn(t *testing.T) {
+	client := &mockSNS{}
+	probe := lib.NewTopicProbe(client, "ap-northeast-1", "")
+	err := probe.Check()
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+	assert.Equal(t, 0, len(client.topics))
+}
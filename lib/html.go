@@ -0,0 +1,224 @@
+package lib
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHTMLTemplate is a self-contained page of the report for archive.
+// Tables of class "sortable" can be sorted by clicking a header if script is
+// enabled and the page is still readable without it.
+const defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>{{.Severity}}: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; color: #333333; margin: 0 auto; max-width: 1200px; padding: 0 16px; }
+header { color: #ffffff; padding: 12px 16px; margin: 16px 0; }
+header h1 { margin: 0; font-size: 1.4em; }
+header p { margin: 4px 0 0 0; }
+table { border-collapse: collapse; margin: 8px 0; }
+th, td { border: 1px solid #cccccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background-color: #f4f4f4; }
+table.sortable th { cursor: pointer; }
+details { border: 1px solid #dddddd; margin: 8px 0; padding: 4px 8px; }
+summary { font-weight: bold; cursor: pointer; }
+code { word-break: break-all; }
+.positive { color: #d50200; font-weight: bold; }
+</style>
+</head>
+<body>
+<header style="background-color: {{.Color}};">
+  <h1>{{.Severity}}: {{.Title}}</h1>
+  <p>{{.Summary}}</p>
+</header>
+<table>
+  <tr><th>Report ID</th><td>{{.Report.ID}}</td></tr>
+  <tr><th>Rule</th><td>{{.Report.Alert.Rule}}</td></tr>
+  <tr><th>Key</th><td>{{.Report.Alert.Key}}</td></tr>
+  <tr><th>Status</th><td>{{.Report.Status}}</td></tr>
+  {{- if .Report.Result.Reason}}
+  <tr><th>Reason</th><td>{{.Report.Result.Reason}}</td></tr>
+  {{- end}}
+  {{- if not .Report.ReceivedAt.IsZero}}
+  <tr><th>Received At</th><td>{{datetime .Report.ReceivedAt}}</td></tr>
+  {{- end}}
+</table>
+{{- if .RemoteHosts}}
+<h2>Remote Hosts</h2>
+{{- range .RemoteHosts}}
+<details open>
+  <summary>{{.ID}}</summary>
+  <table>
+    <tr><th>IP Address</th><td>{{join .IPAddr}}</td></tr>
+    <tr><th>Country</th><td>{{join .Country}}</td></tr>
+    <tr><th>AS Owner</th><td>{{join .ASOwner}}</td></tr>
+  </table>
+  {{- range .RelatedMalware}}
+  <h4>Malware <code>{{.SHA256}}</code> ({{.Relation}})</h4>
+  <table class="sortable">
+    <thead><tr><th>Vendor</th><th>Name</th><th>Detected</th><th>Source</th></tr></thead>
+    <tbody>
+    {{- range .Scans}}
+    <tr><td>{{.Vendor}}</td><td>{{.Name}}</td><td{{if .Positive}} class="positive"{{end}}>{{if .Positive}}yes{{else}}no{{end}}</td><td>{{.Source}}</td></tr>
+    {{- end}}
+    </tbody>
+  </table>
+  {{- end}}
+  {{- if .RelatedDomains}}
+  <h4>Related Domains</h4>
+  <ul>
+    {{- range .RelatedDomains}}
+    <li><code>{{.Name}}</code> ({{.Source}})</li>
+    {{- end}}
+  </ul>
+  {{- end}}
+  {{- if .RelatedURLs}}
+  <h4>Related URLs</h4>
+  <ul>
+    {{- range .RelatedURLs}}
+    <li><code>{{.URL}}</code> ({{.Source}})</li>
+    {{- end}}
+  </ul>
+  {{- end}}
+</details>
+{{- end}}
+{{- end}}
+{{- if .LocalHosts}}
+<h2>Local Hosts</h2>
+{{- range .LocalHosts}}
+<details open>
+  <summary>{{.ID}}</summary>
+  <table>
+    <tr><th>User</th><td>{{join .UserName}}</td></tr>
+    <tr><th>Owner</th><td>{{join .Owner}}</td></tr>
+    <tr><th>OS</th><td>{{join .OS}}</td></tr>
+    <tr><th>IP Address</th><td>{{join .IPAddr}}</td></tr>
+    <tr><th>Hostname</th><td>{{join .HostName}}</td></tr>
+    <tr><th>Software</th><td>{{join .Software}}</td></tr>
+  </table>
+  {{- if .Activities}}
+  {{- template "activities" .Activities}}
+  {{- end}}
+</details>
+{{- end}}
+{{- end}}
+{{- if .Users}}
+<h2>Users</h2>
+{{- range .Users}}
+<details open>
+  <summary>{{.UserName}}</summary>
+  {{- if .Activities}}
+  {{- template "activities" .Activities}}
+  {{- end}}
+</details>
+{{- end}}
+{{- end}}
+{{- if .Timeline}}
+<h2>Timeline</h2>
+<table>
+  {{- range .Timeline}}
+  <tr><td>{{datetime .Time}}</td><td>{{.Description}}</td></tr>
+  {{- end}}
+</table>
+{{- end}}
+{{- if .Report.Warnings}}
+<h2>Warnings</h2>
+<ul>
+  {{- range .Report.Warnings}}
+  <li>{{.}}</li>
+  {{- end}}
+</ul>
+{{- end}}
+{{- if .Report.Comments}}
+<h2>Comments</h2>
+<ul>
+  {{- range .Report.Comments}}
+  <li>{{datetime .Timestamp}} {{.Author}}: {{.Text}}</li>
+  {{- end}}
+</ul>
+{{- end}}
+<script>
+document.querySelectorAll("table.sortable").forEach(function (table) {
+  table.querySelectorAll("th").forEach(function (th, col) {
+    th.addEventListener("click", function () {
+      var tbody = table.tBodies[0];
+      var asc = th.getAttribute("data-order") !== "asc";
+      var rows = Array.prototype.slice.call(tbody.rows);
+      rows.sort(function (a, b) {
+        var x = a.cells[col].textContent, y = b.cells[col].textContent;
+        return asc ? x.localeCompare(y) : y.localeCompare(x);
+      });
+      rows.forEach(function (row) { tbody.appendChild(row); });
+      th.setAttribute("data-order", asc ? "asc" : "desc");
+    });
+  });
+});
+</script>
+</body>
+</html>
+{{- define "activities"}}
+  <table class="sortable">
+    <thead><tr><th>Service</th><th>Action</th><th>Target</th><th>Principal</th><th>Remote Address</th><th>Last Seen</th></tr></thead>
+    <tbody>
+    {{- range .}}
+    <tr><td>{{.ServiceName}}</td><td>{{.Action}}</td><td>{{.Target}}</td><td>{{.Principal}}</td><td>{{.RemoteAddr}}</td><td>{{datetime .LastSeen}}</td></tr>
+    {{- end}}
+    </tbody>
+  </table>
+{{- end}}
+`
+
+var htmlTemplate = template.Must(template.New("report").Funcs(emailFuncs).Funcs(template.FuncMap{
+	"datetime": reportFuncs["datetime"],
+}).Parse(defaultHTMLTemplate))
+
+type htmlData struct {
+	Report      Report
+	Title       string
+	Severity    string
+	Color       string
+	Summary     string
+	RemoteHosts []ReportOpponentHost
+	LocalHosts  []ReportAlliedHost
+	Users       []ReportUser
+	Timeline    []TimelineEvent
+}
+
+// RenderHTML renders the report as a single HTML page without external
+// resources. All fields of the report are escaped by html/template because
+// they may have strings controlled by attackers.
+func RenderHTML(report Report) (string, error) {
+	data := htmlData{
+		Report:   report,
+		Title:    report.Alert.Title(),
+		Severity: severityLabel(report),
+		Color:    severityColor(report.Result.Severity),
+		Summary:  report.OneLineSummary(),
+		Users:    sortUsers(report.Content.SubjectUsers),
+		Timeline: report.Timeline(),
+	}
+
+	var remoteIDs, localIDs []string
+	for id := range report.Content.OpponentHosts {
+		remoteIDs = append(remoteIDs, id)
+	}
+	for _, id := range sortedKeys(remoteIDs) {
+		data.RemoteHosts = append(data.RemoteHosts, report.Content.OpponentHosts[id])
+	}
+	for id := range report.Content.AlliedHosts {
+		localIDs = append(localIDs, id)
+	}
+	for _, id := range sortedKeys(localIDs) {
+		data.LocalHosts = append(data.LocalHosts, report.Content.AlliedHosts[id])
+	}
+
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "Fail to render HTML report")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,87 @@
+package lib_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderHTML(t *testing.T) {
+	report := loadFixtureReport(t)
+	html, err := lib.RenderHTML(report)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(html, "<!DOCTYPE html>"))
+	assert.Contains(t, html, "URGENT: Suspicious Outbound: Outbound connection to known malicious host")
+	assert.Contains(t, html, "background-color: #d50200")
+	assert.Contains(t, html, "<summary>198.51.100.7</summary>")
+	assert.Contains(t, html, "<summary>i-0123456789</summary>")
+	assert.Contains(t, html, "<td>VendorA</td><td>Trojan.Gen</td><td class=\"positive\">yes</td>")
+	assert.Contains(t, html, "<td>AWS Console</td><td>ConsoleLogin</td>")
+	assert.Contains(t, html, "2019-01-28 03:04:05</td><td>Alert received")
+	assert.Contains(t, html, "No result from inspector: sandbox")
+
+	// Page must be self-contained.
+	assert.NotContains(t, html, "<link")
+	assert.NotContains(t, html, "src=")
+}
+
+func TestRenderHTMLGolden(t *testing.T) {
+	html, err := lib.RenderHTML(loadFullReport(t))
+	require.NoError(t, err)
+	assertGolden(t, "report_full.html", html)
+
+	html, err = lib.RenderHTML(emptyReport())
+	require.NoError(t, err)
+	assertGolden(t, "report_empty.html", html)
+}
+
+func TestRenderHTMLEscape(t *testing.T) {
+	payload := `<script>alert(1)</script>`
+
+	report := loadFixtureReport(t)
+	report.Alert.Key = payload
+	host := report.Content.OpponentHosts["198.51.100.7"]
+	host.ID = payload
+	host.RelatedURLs[0].URL = `javascript:alert(1)//"><script>alert(2)</script>`
+	host.RelatedDomains[0].Name = `"><img src=x onerror=alert(3)>`
+	report.Content.OpponentHosts[payload] = host
+	allied := report.Content.AlliedHosts["i-0123456789"]
+	allied.Activities[0].Target = payload
+	report.Content.AlliedHosts[payload] = allied
+	report.Comments = []lib.Comment{{Author: payload, Text: payload}}
+
+	html, err := lib.RenderHTML(report)
+	require.NoError(t, err)
+
+	// Only the sort script of the template is allowed.
+	assert.Equal(t, 1, strings.Count(html, "<script>"))
+	assert.NotContains(t, html, "alert(1)</script>")
+	assert.NotContains(t, html, "<img")
+	assert.NotContains(t, html, `href="javascript:`)
+	assert.Contains(t, html, "<summary>&lt;script&gt;alert(1)&lt;/script&gt;</summary>")
+	assert.Contains(t, html, "&lt;script&gt;alert(2)&lt;/script&gt;")
+	assert.Contains(t, html, "&lt;img src=x onerror=alert(3)&gt;")
+}
+
+func TestArchiveReport(t *testing.T) {
+	client := &mockS3{}
+	report := loadFixtureReport(t)
+
+	keys, err := lib.ArchiveReport(client, "archive-bucket", report, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reports/5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e/report.json"}, keys)
+	assert.Contains(t, client.objects["archive-bucket/"+keys[0]], `"report_id":"5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e"`)
+
+	client = &mockS3{}
+	keys, err = lib.ArchiveReport(client, "archive-bucket", report, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(keys))
+	assert.Equal(t, "reports/5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e/report.html", keys[1])
+	assert.Equal(t, "text/html; charset=UTF-8", aws.StringValue(client.puts[1].ContentType))
+	assert.True(t, strings.HasPrefix(client.objects["archive-bucket/"+keys[1]], "<!DOCTYPE html>"))
+}
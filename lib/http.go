@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPRetry is a retry policy for requests to external services. Wait is
+// doubled for each retry unless the server specifies Retry-After.
+type HTTPRetry struct {
+	MaxRetry int
+	Wait     time.Duration
+}
+
+// DefaultHTTPRetry is used by publishers when retry policy is not configured.
+var DefaultHTTPRetry = HTTPRetry{MaxRetry: 3, Wait: time.Second}
+
+// HTTPError is returned when an external service responds with error status.
+type HTTPError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (x *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP error %d: %s", x.StatusCode, string(x.Body))
+}
+
+// maxRetryAfter is upper limit of wait specified by a server not to exceed
+// timeout of Lambda function.
+const maxRetryAfter = 60 * time.Second
+
+// retryable returns true for 429, 5xx and rate limited 403. Some services
+// such as GitHub respond 403 with Retry-After for secondary rate limit.
+func retryable(resp *http.Response) bool {
+	code := resp.StatusCode
+	if code == http.StatusForbidden {
+		return resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0"
+	}
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func retryAfter(resp *http.Response, wait time.Duration) time.Duration {
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil {
+			wait = time.Duration(sec) * time.Second
+		}
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			wait = time.Until(time.Unix(reset, 0))
+		}
+	}
+
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// sendHTTPRequest sends a request and retries it for network errors, 429, 5xx
+// and rate limited responses. It returns body of 2xx response or an error.
+func sendHTTPRequest(client *http.Client, method, url string, header http.Header, body []byte, retry HTTPRetry) ([]byte, error) {
+	return sendSignedHTTPRequest(client, method, url, header, body, retry, nil)
+}
+
+// httpSigner adds authentication to a request, e.g. AWS SigV4 signature. It is
+// called for each attempt because signature has a timestamp.
+type httpSigner func(req *http.Request, body []byte) error
+
+// sendSignedHTTPRequest is sendHTTPRequest with signing requests by sign if
+// not nil.
+func sendSignedHTTPRequest(client *http.Client, method, url string, header http.Header, body []byte, retry HTTPRetry, sign httpSigner) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	wait := retry.Wait
+	for i := 0; ; i++ {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to create HTTP request")
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if sign != nil {
+			if err := sign(req, body); err != nil {
+				return nil, errors.Wrap(err, "Fail to sign HTTP request")
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if i >= retry.MaxRetry {
+				return nil, errors.Wrapf(err, "Fail to send HTTP request to %s", req.URL.Host)
+			}
+			Logger.WithError(err).WithField("retry", i+1).Warn("HTTP request failed, retrying")
+			time.Sleep(wait)
+			wait *= 2
+			continue
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to read HTTP response")
+		}
+
+		if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+			return respBody, nil
+		}
+
+		httpErr := &HTTPError{StatusCode: resp.StatusCode, Body: respBody}
+		if !retryable(resp) || i >= retry.MaxRetry {
+			return nil, httpErr
+		}
+
+		Logger.WithError(httpErr).WithField("retry", i+1).Warn("HTTP request failed, retrying")
+		time.Sleep(retryAfter(resp, wait))
+		wait *= 2
+	}
+}
+
+// postJSON is a shortcut of sendHTTPRequest for JSON API.
+func postJSON(client *http.Client, url string, header http.Header, body []byte, retry HTTPRetry) ([]byte, error) {
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("Content-Type", "application/json")
+	return sendHTTPRequest(client, http.MethodPost, url, h, body, retry)
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// DefaultLocale is locale of notifications if no locale is selected, and
+// fallback of messages missing in other catalogs.
+const DefaultLocale = "en"
+
+// messageCatalogs are messages of notifications by locale. Catalogs are JSON
+// embedded in catalog_*.go.
+var messageCatalogs = map[string]map[string]string{
+	"en": mustParseCatalog(catalogEN),
+	"ja": mustParseCatalog(catalogJA),
+}
+
+func mustParseCatalog(raw string) map[string]string {
+	var messages map[string]string
+	if err := json.Unmarshal([]byte(raw), &messages); err != nil {
+		panic(err)
+	}
+	return messages
+}
+
+// Locales returns locales that have a message catalog.
+func Locales() []string {
+	var locales []string
+	for locale := range messageCatalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// ValidLocale returns true if the locale has a message catalog. Empty locale
+// is valid and means DefaultLocale.
+func ValidLocale(locale string) bool {
+	if locale == "" {
+		return true
+	}
+	_, ok := messageCatalogs[locale]
+	return ok
+}
+
+// Translate returns message of the key in the locale. A message missing in
+// the locale is taken from DefaultLocale with a warning, and the key itself is
+// returned if DefaultLocale also does not have it.
+func Translate(locale, key string) string {
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	if msg, ok := messageCatalogs[locale][key]; ok {
+		return msg
+	}
+
+	msg, ok := messageCatalogs[DefaultLocale][key]
+	if !ok {
+		msg = key
+	}
+	Logger.WithField("locale", locale).WithField("key", key).Warn("Message is not in catalog, fallback to " + DefaultLocale)
+	return msg
+}
+
+// localizedSeverity returns name of severity of the report in the locale.
+// Unknown severity is not translated.
+func localizedSeverity(report Report, locale string) string {
+	sev := report.Result.Severity
+	if sev == "" {
+		sev = SevUnclassified
+	}
+	if _, ok := messageCatalogs[DefaultLocale]["severity."+string(sev)]; !ok {
+		return severityLabel(report)
+	}
+	return Translate(locale, "severity."+string(sev))
+}
+
+type localeKey struct{}
+
+// WithLocale returns a context in which publishers render notifications in
+// the locale.
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// LocaleFromContext returns the locale set by WithLocale. Empty string is
+// returned if no locale is set.
+func LocaleFromContext(ctx context.Context) string {
+	locale, _ := ctx.Value(localeKey{}).(string)
+	return locale
+}
@@ -0,0 +1,105 @@
+package lib_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splitHeading splits mrkdwn text of Slack into its bold heading line and the
+// rest.
+func splitHeading(text string) (string, string) {
+	parts := strings.SplitN(text, "\n", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func TestSlackMessageLocales(t *testing.T) {
+	report := loadFullReport(t)
+	en := lib.NewSlackMessage(lib.SlackConfig{ReportURL: "https://example.com/{report_id}"}, report)
+	ja := lib.NewSlackMessage(lib.SlackConfig{ReportURL: "https://example.com/{report_id}", Locale: "ja"}, report)
+
+	enBlocks, jaBlocks := en.Attachments[0].Blocks, ja.Attachments[0].Blocks
+	require.Equal(t, len(enBlocks), len(jaBlocks))
+	assert.Contains(t, enBlocks[0].Text.Text, "[URGENT]")
+	assert.Contains(t, jaBlocks[0].Text.Text, "[緊急]")
+
+	require.Equal(t, 4, len(jaBlocks[1].Fields))
+	for i := range enBlocks[1].Fields {
+		enHead, enValue := splitHeading(enBlocks[1].Fields[i].Text)
+		jaHead, jaValue := splitHeading(jaBlocks[1].Fields[i].Text)
+		assert.NotEqual(t, enHead, jaHead)
+		assert.Equal(t, enValue, jaValue)
+	}
+
+	// Indicators are not translated.
+	enHead, enValue := splitHeading(enBlocks[2].Text.Text)
+	jaHead, jaValue := splitHeading(jaBlocks[2].Text.Text)
+	assert.Equal(t, "*Top indicators*", enHead)
+	assert.Equal(t, "*主な痕跡*", jaHead)
+	assert.Equal(t, enValue, jaValue)
+	assert.Contains(t, jaValue, "198.51.100.7")
+}
+
+func TestEmailLocales(t *testing.T) {
+	report := loadFullReport(t)
+	var templates *lib.NotificationTemplates
+	en := templates.Render(lib.NotifyEmail, report, "", "en")
+	ja := templates.Render(lib.NotifyEmail, report, "", "ja")
+
+	assert.Equal(t, lib.EmailSubject(report), en.Title)
+	assert.Equal(t, strings.Replace(en.Title, "URGENT", "緊急", 1), ja.Title)
+
+	assert.Contains(t, en.Body, "<h3>Remote Hosts</h3>")
+	assert.Contains(t, ja.Body, "<h3>リモートホスト</h3>")
+	assert.NotContains(t, ja.Body, "Remote Hosts")
+	for _, value := range []string{"198.51.100.7", "203.0.113.9", string(report.ID), report.Alert.Key} {
+		assert.Contains(t, en.Body, value)
+		assert.Contains(t, ja.Body, value)
+	}
+
+	// Empty locale is English.
+	assert.Equal(t, en, templates.Render(lib.NotifyEmail, report, "", ""))
+}
+
+func TestTranslateFallback(t *testing.T) {
+	assert.Equal(t, "Rule", lib.Translate("", "rule"))
+	assert.Equal(t, "ルール", lib.Translate("ja", "rule"))
+	// Unknown locale and missing message fall back to English.
+	assert.Equal(t, "Rule", lib.Translate("fr", "rule"))
+	assert.Equal(t, "no_such_key", lib.Translate("ja", "no_such_key"))
+
+	assert.Equal(t, []string{"en", "ja"}, lib.Locales())
+	assert.True(t, lib.ValidLocale(""))
+	assert.False(t, lib.ValidLocale("fr"))
+}
+
+func TestPublishRouterLocales(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(`{"default": ["sns", "slack"], "locales": {"slack": "ja"}}`)
+	require.NoError(t, err)
+
+	locales := map[string]string{}
+	publishers := map[string]lib.Publisher{}
+	for _, name := range []string{"sns", "slack"} {
+		action := name
+		publishers[action] = func(ctx context.Context, report lib.Report) error {
+			locales[action] = lib.LocaleFromContext(ctx)
+			return nil
+		}
+	}
+	router, err := lib.NewPublishRouter(routes, publishers)
+	require.NoError(t, err)
+	_, err = router.PublishReport(context.Background(), loadFixtureReport(t))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"sns": "", "slack": "ja"}, locales)
+
+	_, err = lib.ParsePublishRoutes(`{"default": ["slack"], "locales": {"slack": "fr"}}`)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// DefaultIdempotencyTTL is retention of idempotency markers if
+// IdempotencyConfig has no TTL. Retries of Step Functions finish far earlier.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// NativeDedupActions are publish actions of which destination deduplicates
+// deliveries by itself, e.g. dedup_key of PagerDuty. Idempotency markers are
+// advisory for them and failure to check a marker does not block publishing.
+var NativeDedupActions = map[string]bool{
+	PublishActionPagerDuty: true,
+}
+
+// IdempotencyMarker is an item of idempotency table. It is written after a
+// publish action succeeds, and the action is skipped while the marker exists.
+type IdempotencyMarker struct {
+	Key         string    `dynamo:"idempotency_key"`
+	ReportID    ReportID  `dynamo:"report_id"`
+	Action      string    `dynamo:"action"`
+	ContentHash string    `dynamo:"content_hash"`
+	Timestamp   time.Time `dynamo:"timestamp"`
+	TTL         time.Time `dynamo:"ttl"`
+}
+
+// NewIdempotencyMarker returns a marker of the report published by the
+// action. The key consists of report ID, action and hash of the report, so
+// that an updated or escalated report is published again.
+func NewIdempotencyMarker(report Report, action string, ttl time.Duration) (*IdempotencyMarker, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report for idempotency key")
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+
+	hash := contentHash(data)
+	now := time.Now().UTC()
+	return &IdempotencyMarker{
+		Key:         fmt.Sprintf("%s/%s/%s", report.ID, action, hash),
+		ReportID:    report.ID,
+		Action:      action,
+		ContentHash: hash,
+		Timestamp:   now,
+		TTL:         now.Add(ttl),
+	}, nil
+}
+
+// IdempotencyTable is a table of idempotency markers. HasMarker returns false
+// for an expired marker that is not deleted yet.
+type IdempotencyTable interface {
+	HasMarker(key string) (bool, error)
+	PutMarker(marker *IdempotencyMarker) error
+}
+
+type dynamoIdempotencyTable struct {
+	region    string
+	tableName string
+}
+
+func (x *dynamoIdempotencyTable) HasMarker(key string) (bool, error) {
+	if x.tableName == "" {
+		return false, NewConfigError("Idempotency table is not configured")
+	}
+
+	var marker IdempotencyMarker
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Get("idempotency_key", key).Consistent(true).One(&marker); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+		return false, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to get idempotency marker from %s in %s", x.tableName, x.region))
+	}
+	return marker.TTL.After(time.Now().UTC()), nil
+}
+
+// PutMarker writes the marker only if it does not exist or is expired. A
+// marker written by a concurrent run is not an error.
+func (x *dynamoIdempotencyTable) PutMarker(marker *IdempotencyMarker) error {
+	if x.tableName == "" {
+		return NewConfigError("Idempotency table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.tableName)
+	err := table.Put(marker).If("attribute_not_exists($) OR $ < ?", "idempotency_key", "ttl", time.Now().UTC()).Run()
+	if err != nil {
+		if awsErr, ok := errors.Cause(err).(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put idempotency marker to %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+// OpenIdempotencyTable returns IdempotencyTable of DynamoDB. It can be
+// replaced for testing.
+var OpenIdempotencyTable = func(region, tableName string) IdempotencyTable {
+	return &dynamoIdempotencyTable{region: region, tableName: tableName}
+}
+
+// IdempotencyConfig is configuration of idempotency markers of PublishRouter.
+type IdempotencyConfig struct {
+	Table  string
+	Region string
+
+	// TTL is retention of markers. DefaultIdempotencyTTL is used if 0.
+	TTL time.Duration
+}
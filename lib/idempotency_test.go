@@ -0,0 +1,113 @@
+package lib_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockIdempotencyTable struct {
+	markers map[string]lib.IdempotencyMarker
+	fail    bool
+}
+
+func (x *mockIdempotencyTable) HasMarker(key string) (bool, error) {
+	if x.fail {
+		return false, errors.New("get marker failed")
+	}
+	marker, ok := x.markers[key]
+	return ok && marker.TTL.After(time.Now()), nil
+}
+
+func (x *mockIdempotencyTable) PutMarker(marker *lib.IdempotencyMarker) error {
+	if x.fail {
+		return errors.New("put marker failed")
+	}
+	x.markers[marker.Key] = *marker
+	return nil
+}
+
+func mockIdempotencyTables(table *mockIdempotencyTable) func() {
+	orig := lib.OpenIdempotencyTable
+	lib.OpenIdempotencyTable = func(region, tableName string) lib.IdempotencyTable {
+		return table
+	}
+	return func() { lib.OpenIdempotencyTable = orig }
+}
+
+func idempotentRouter(t *testing.T, invoked *[]string, failing ...string) *lib.PublishRouter {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	router, err := lib.NewPublishRouter(routes, fakePublishers(invoked, failing...))
+	require.NoError(t, err)
+	router.EnableIdempotency(lib.IdempotencyConfig{Table: "idempotency", Region: "ap-northeast-1"})
+	return router
+}
+
+func TestPublishRouterRetryAfterPartialSuccess(t *testing.T) {
+	table := &mockIdempotencyTable{markers: map[string]lib.IdempotencyMarker{}}
+	defer mockIdempotencyTables(table)()
+
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "c2"
+
+	// The first run fails at PagerDuty after Slack and SNS delivered.
+	var invoked []string
+	_, err := idempotentRouter(t, &invoked, "pagerduty").PublishReport(context.Background(), report)
+	require.Error(t, err)
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, invoked)
+	assert.Equal(t, 2, len(table.markers))
+
+	// The retry invokes only the failed action.
+	invoked = nil
+	outcome, err := idempotentRouter(t, &invoked).PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pagerduty"}, invoked)
+	assert.Equal(t, []string{"slack", "sns"}, outcome.Skipped())
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, outcome.Succeeded())
+	assert.Equal(t, 3, len(table.markers))
+
+	// An updated report is published again.
+	invoked = nil
+	report.Result.Severity = lib.SevUrgent
+	report.Text = "updated"
+	outcome, err = idempotentRouter(t, &invoked).PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, invoked)
+	assert.Equal(t, 0, len(outcome.Skipped()))
+}
+
+func TestPublishRouterIdempotencyUnavailable(t *testing.T) {
+	table := &mockIdempotencyTable{markers: map[string]lib.IdempotencyMarker{}, fail: true}
+	defer mockIdempotencyTables(table)()
+
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "c2"
+
+	// PagerDuty dedups natively and is published without the marker.
+	var invoked []string
+	outcome, err := idempotentRouter(t, &invoked).PublishReport(context.Background(), report)
+	require.Error(t, err)
+	assert.Equal(t, []string{"pagerduty"}, invoked)
+	assert.Equal(t, []string{"pagerduty"}, outcome.Succeeded())
+	assert.Equal(t, []string{"slack", "sns"}, outcome.Failed())
+}
+
+func TestNewIdempotencyMarker(t *testing.T) {
+	report := loadFixtureReport(t)
+	m1, err := lib.NewIdempotencyMarker(report, "slack", 0)
+	require.NoError(t, err)
+	m2, err := lib.NewIdempotencyMarker(report, "sns", time.Hour)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, m1.Key, m2.Key)
+	assert.Equal(t, m1.ContentHash, m2.ContentHash)
+	assert.Equal(t, report.ID, m1.ReportID)
+	assert.WithinDuration(t, m1.Timestamp.Add(lib.DefaultIdempotencyTTL), m1.TTL, time.Second)
+	assert.WithinDuration(t, m2.Timestamp.Add(time.Hour), m2.TTL, time.Second)
+}
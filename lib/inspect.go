@@ -3,12 +3,11 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	lambdaService "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -23,10 +22,10 @@ func handleRequest(ctx context.Context, event events.SNSEvent, f Inspector, func
 		err := json.Unmarshal([]byte(record.SNS.Message), &task)
 
 		if err != nil {
-			return errors.Wrap(err, "Fail to unmarshal kinesis data")
+			return WrapCode(ErrCodeMarshal, err, "Fail to unmarshal kinesis data")
 		}
 
-		page, err := f(task)
+		page, err := runInspector(f, task)
 		Logger.WithField("page", page).Info("Got page")
 
 		if err != nil {
@@ -37,46 +36,78 @@ func handleRequest(ctx context.Context, event events.SNSEvent, f Inspector, func
 			continue
 		}
 
-		// Create payload body
 		page.ReportID = task.ReportID
-		payload, err := json.Marshal(page)
-		if err != nil {
-			return errors.Wrap(err, "Fail to marshal Page data")
+		if err := NewSubmitter(funcName, region)(*page); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		ssn := session.Must(session.NewSession(&aws.Config{
-			Region: aws.String(region),
-		}))
-		svc := lambdaService.New(ssn)
+// InspectorMetrics receives metrics of inspector invocations. It is set to
+// CloudWatch by Inspect if METRICS_ENABLED is "true".
+var InspectorMetrics MetricsEmitter
 
-		input := &lambdaService.InvokeInput{
-			FunctionName: &funcName,
-			Payload:      payload,
-		}
-		resp, err := svc.Invoke(input)
+// inspectorName is used as dimension of inspector metrics.
+func inspectorName() string {
+	if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+		return name
+	}
+	return "unknown"
+}
 
-		Logger.WithFields(logrus.Fields{
-			"input":    input,
-			"response": resp,
-			"error":    err,
-		}).Info("Invoke Lambda")
+func inspectorMetrics(name string, err error, elapsed time.Duration) []Metric {
+	dims := map[string]string{"Inspector": name}
+	success, failure := 1.0, 0.0
+	if err != nil {
+		success, failure = 0.0, 1.0
+	}
 
-		if err != nil {
-			return errors.Wrap(err, "Fail to invoke submitter")
-		}
+	return []Metric{
+		{Name: "InspectorInvocations", Value: 1, Unit: "Count", Dimensions: dims},
+		{Name: "InspectorSuccess", Value: success, Unit: "Count", Dimensions: dims},
+		{Name: "InspectorFailure", Value: failure, Unit: "Count", Dimensions: dims},
+		{Name: "InspectorDuration", Value: float64(elapsed) / float64(time.Millisecond), Unit: "Milliseconds", Dimensions: dims},
+	}
+}
 
+// observeInspector emits metrics of an inspector invocation and logs failure
+// as error so that a broken inspector is detected.
+func observeInspector(task Task, start time.Time, err error) {
+	name := inspectorName()
+	EmitMetrics(InspectorMetrics, inspectorMetrics(name, err, time.Since(start)))
+
+	if err != nil {
+		Logger.WithFields(ErrorFields(err)).WithFields(logrus.Fields{
+			"inspector":    name,
+			"report_id":    task.ReportID,
+			CorrelationKey: task.Alert.CorrelationID,
+		}).Error("Inspector failed")
+	}
+}
+
+func runInspector(f Inspector, task Task) (*ReportPage, error) {
+	start := time.Now()
+	page, err := f(task)
+	observeInspector(task, start, err)
+	return page, err
+}
+
+func enableInspectorMetrics(region string) {
+	if InspectorMetrics == nil && os.Getenv("METRICS_ENABLED") == "true" {
+		InspectorMetrics = NewCloudWatchEmitter(nil, region)
 	}
-	return nil
 }
 
 // Inspect is a wrapper of inspector
 func Inspect(f Inspector, funcName, region string) {
+	enableInspectorMetrics(region)
 	lambda.Start(func(ctx context.Context, event events.SNSEvent) error {
 		return handleRequest(ctx, event, f, funcName, region)
 	})
 }
 
+// InspectTest runs the inspector as Inspect does without submitting the page.
 func InspectTest(f Inspector, task Task) (*ReportPage, error) {
-	page, err := f(task)
-	return page, err
+	return runInspector(f, task)
 }
@@ -0,0 +1,80 @@
+package lib_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockMetricsEmitter struct {
+	metrics []lib.Metric
+}
+
+func (x *mockMetricsEmitter) Emit(metrics []lib.Metric) error {
+	x.metrics = append(x.metrics, metrics...)
+	return nil
+}
+
+func (x *mockMetricsEmitter) values() map[string]float64 {
+	values := map[string]float64{}
+	for _, m := range x.metrics {
+		values[m.Name] += m.Value
+	}
+	return values
+}
+
+func mockInspectorMetrics(t *testing.T) (*mockMetricsEmitter, func()) {
+	origName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	orig := lib.InspectorMetrics
+	emitter := &mockMetricsEmitter{}
+	lib.InspectorMetrics = emitter
+	require.NoError(t, os.Setenv("AWS_LAMBDA_FUNCTION_NAME", "virustotal-inspector"))
+
+	return emitter, func() {
+		lib.InspectorMetrics = orig
+		os.Setenv("AWS_LAMBDA_FUNCTION_NAME", origName)
+	}
+}
+
+func TestInspectorFailureMetrics(t *testing.T) {
+	emitter, restore := mockInspectorMetrics(t)
+	defer restore()
+
+	_, err := lib.InspectTest(func(task lib.Task) (*lib.ReportPage, error) {
+		return nil, errors.New("VirusTotal timeout")
+	}, lib.Task{ReportID: "report-1"})
+	require.Error(t, err)
+
+	assert.Equal(t, map[string]float64{
+		"InspectorInvocations": 1,
+		"InspectorSuccess":     0,
+		"InspectorFailure":     1,
+		"InspectorDuration":    emitter.values()["InspectorDuration"],
+	}, emitter.values())
+	for _, m := range emitter.metrics {
+		assert.Equal(t, map[string]string{"Inspector": "virustotal-inspector"}, m.Dimensions)
+	}
+}
+
+func TestInspectorSuccessMetrics(t *testing.T) {
+	emitter, restore := mockInspectorMetrics(t)
+	defer restore()
+
+	for i := 0; i < 2; i++ {
+		page, err := lib.InspectTest(func(task lib.Task) (*lib.ReportPage, error) {
+			page := lib.NewReportPage()
+			return &page, nil
+		}, lib.Task{ReportID: "report-1"})
+		require.NoError(t, err)
+		require.NotNil(t, page)
+	}
+
+	values := emitter.values()
+	assert.Equal(t, 2.0, values["InspectorInvocations"])
+	assert.Equal(t, 2.0, values["InspectorSuccess"])
+	assert.Equal(t, 0.0, values["InspectorFailure"])
+}
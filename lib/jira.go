@@ -0,0 +1,490 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JiraConfig is configuration of PublishJira.
+type JiraConfig struct {
+	// BaseURL is URL of JIRA site, e.g. https://example.atlassian.net
+	BaseURL  string
+	Email    string
+	APIToken string
+
+	ProjectKey string
+	IssueType  string
+
+	// ExternalIDField is ID of a custom field storing ReportID, e.g.
+	// customfield_10050. It is used to find the issue of the report.
+	ExternalIDField string
+
+	// Priorities maps severity to name of JIRA priority. DefaultJiraPriorities
+	// is used for severities not in the map.
+	Priorities map[ReportSeverity]string
+
+	// MinSeverity is the lowest severity that opens a new issue. Existing
+	// issues are updated regardless of severity.
+	MinSeverity ReportSeverity
+
+	Labels []string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+// DefaultJiraPriorities is used if JiraConfig.Priorities does not have the
+// severity.
+var DefaultJiraPriorities = map[ReportSeverity]string{
+	SevUrgent:       "Highest",
+	SevUnclassified: "Medium",
+	SevSafe:         "Low",
+}
+
+const (
+	jiraDefaultIssueType = "Task"
+	jiraMaxSummaryLen    = 255
+
+	// jiraPropertyKey is key of issue property that has a snapshot of the
+	// last published report to compute delta.
+	jiraPropertyKey = "alert-responder"
+)
+
+func (x *JiraConfig) validate() error {
+	if x.BaseURL == "" || x.ProjectKey == "" || x.ExternalIDField == "" {
+		return NewConfigError("JIRA URL, project and external ID field are required")
+	}
+	if !strings.HasPrefix(x.ExternalIDField, "customfield_") {
+		return NewConfigError(fmt.Sprintf("Invalid JIRA custom field: %s", x.ExternalIDField))
+	}
+	if x.Email == "" || x.APIToken == "" {
+		return NewConfigError("JIRA credential is not configured")
+	}
+	return nil
+}
+
+func (x *JiraConfig) priority(sev ReportSeverity) string {
+	if p, ok := x.Priorities[sev]; ok {
+		return p
+	}
+	if p, ok := DefaultJiraPriorities[sev]; ok {
+		return p
+	}
+	return DefaultJiraPriorities[SevUnclassified]
+}
+
+func (x *JiraConfig) minSeverity() ReportSeverity {
+	if x.MinSeverity == "" {
+		return SevUnclassified
+	}
+	return x.MinSeverity
+}
+
+// request sends a JSON request to JIRA REST API v3 and decodes response into
+// out if it is not nil.
+func (x *JiraConfig) request(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to marshal JIRA request")
+		}
+		body = raw
+	}
+
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+	auth := base64.StdEncoding.EncodeToString([]byte(x.Email + ":" + x.APIToken))
+	header.Set("Authorization", "Basic "+auth)
+
+	retry := x.Retry
+	if retry.MaxRetry == 0 && retry.Wait == 0 {
+		retry = DefaultHTTPRetry
+	}
+
+	endpoint := strings.TrimRight(x.BaseURL, "/") + path
+	resp, err := sendHTTPRequest(x.Client, method, endpoint, header, body, retry)
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok &&
+			(httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden) {
+			return WrapCode(ErrCodeInvalidConfig, err, "JIRA authentication failed")
+		}
+		return WrapCode(ErrCodePublish, err, fmt.Sprintf("Fail to %s %s", method, path))
+	}
+
+	if out != nil && len(resp) > 0 {
+		if err := json.Unmarshal(resp, out); err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to unmarshal JIRA response")
+		}
+	}
+	return nil
+}
+
+// AdfNode is a node of Atlassian Document Format.
+type AdfNode struct {
+	Type    string                   `json:"type"`
+	Version int                      `json:"version,omitempty"`
+	Attrs   map[string]interface{}   `json:"attrs,omitempty"`
+	Content []AdfNode                `json:"content,omitempty"`
+	Text    string                   `json:"text,omitempty"`
+	Marks   []map[string]interface{} `json:"marks,omitempty"`
+}
+
+// adfInline converts inline text with `code` spans into text nodes.
+func adfInline(s string) []AdfNode {
+	var nodes []AdfNode
+	for i, seg := range strings.Split(s, "`") {
+		if seg == "" {
+			continue
+		}
+		node := AdfNode{Type: "text", Text: seg}
+		if i%2 == 1 {
+			node.Marks = []map[string]interface{}{{"type": "code"}}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func adfParagraph(s string) AdfNode {
+	return AdfNode{Type: "paragraph", Content: adfInline(s)}
+}
+
+// splitTableRow splits a Markdown table row by unescaped "|".
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimSuffix(line, "|")
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func adfTable(rows []string) AdfNode {
+	table := AdfNode{Type: "table"}
+	for i, row := range rows {
+		// The second row is alignment of columns.
+		if i == 1 && strings.HasPrefix(row, "|:-") {
+			continue
+		}
+
+		cellType := "tableCell"
+		if i == 0 {
+			cellType = "tableHeader"
+		}
+		tr := AdfNode{Type: "tableRow"}
+		for _, cell := range splitTableRow(row) {
+			tr.Content = append(tr.Content, AdfNode{Type: cellType, Content: []AdfNode{adfParagraph(cell)}})
+		}
+		table.Content = append(table.Content, tr)
+	}
+	return table
+}
+
+// MarkDownToADF converts Markdown of RenderMarkDown into Atlassian Document
+// Format. Only headings, lists, tables and inline code are supported.
+func MarkDownToADF(md string) AdfNode {
+	doc := AdfNode{Type: "doc", Version: 1}
+	lines := strings.Split(md, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+
+		case strings.HasPrefix(line, "#"):
+			level := len(line) - len(strings.TrimLeft(line, "#"))
+			doc.Content = append(doc.Content, AdfNode{
+				Type:    "heading",
+				Attrs:   map[string]interface{}{"level": level},
+				Content: adfInline(strings.TrimSpace(line[level:])),
+			})
+
+		case strings.HasPrefix(line, "- "):
+			list := AdfNode{Type: "bulletList"}
+			for ; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+				list.Content = append(list.Content, AdfNode{
+					Type:    "listItem",
+					Content: []AdfNode{adfParagraph(lines[i][2:])},
+				})
+			}
+			i--
+			doc.Content = append(doc.Content, list)
+
+		case strings.HasPrefix(line, "|"):
+			var rows []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], "|"); i++ {
+				rows = append(rows, lines[i])
+			}
+			i--
+			doc.Content = append(doc.Content, adfTable(rows))
+
+		default:
+			doc.Content = append(doc.Content, adfParagraph(line))
+		}
+	}
+
+	return doc
+}
+
+// jiraSnapshot is a summary of the published report stored in JIRA issue
+// property. Delta of recompiled report is computed against it.
+type jiraSnapshot struct {
+	Severity    ReportSeverity `json:"severity"`
+	Status      ReportStatus   `json:"status"`
+	RemoteHosts []string       `json:"remote_hosts"`
+	LocalHosts  []string       `json:"local_hosts"`
+	Users       []string       `json:"users"`
+}
+
+func newJiraSnapshot(report Report) jiraSnapshot {
+	snapshot := jiraSnapshot{
+		Severity: report.Result.Severity,
+		Status:   report.Status,
+	}
+	for id := range report.Content.OpponentHosts {
+		snapshot.RemoteHosts = append(snapshot.RemoteHosts, id)
+	}
+	for id := range report.Content.AlliedHosts {
+		snapshot.LocalHosts = append(snapshot.LocalHosts, id)
+	}
+	for id := range report.Content.SubjectUsers {
+		snapshot.Users = append(snapshot.Users, id)
+	}
+	sort.Strings(snapshot.RemoteHosts)
+	sort.Strings(snapshot.LocalHosts)
+	sort.Strings(snapshot.Users)
+	return snapshot
+}
+
+// addedItems returns items in curr but not in prev.
+func addedItems(prev, curr []string) []string {
+	known := map[string]bool{}
+	for _, v := range prev {
+		known[v] = true
+	}
+	var added []string
+	for _, v := range curr {
+		if !known[v] {
+			added = append(added, v)
+		}
+	}
+	return added
+}
+
+// jiraDelta returns lines describing changes from prev to curr.
+func jiraDelta(prev, curr jiraSnapshot) []string {
+	var lines []string
+	if prev.Severity != curr.Severity {
+		lines = append(lines, fmt.Sprintf("Severity: %s -> %s", prev.Severity, curr.Severity))
+	}
+	if prev.Status != curr.Status {
+		lines = append(lines, fmt.Sprintf("Status: %s -> %s", prev.Status, curr.Status))
+	}
+
+	items := []struct {
+		name       string
+		prev, curr []string
+	}{
+		{"remote host", prev.RemoteHosts, curr.RemoteHosts},
+		{"local host", prev.LocalHosts, curr.LocalHosts},
+		{"user", prev.Users, curr.Users},
+	}
+	for _, item := range items {
+		if added := addedItems(item.prev, item.curr); len(added) > 0 {
+			lines = append(lines, fmt.Sprintf("%s added: %s", plural(len(added), item.name), strings.Join(added, ", ")))
+		}
+		if removed := addedItems(item.curr, item.prev); len(removed) > 0 {
+			lines = append(lines, fmt.Sprintf("%s removed: %s", plural(len(removed), item.name), strings.Join(removed, ", ")))
+		}
+	}
+
+	return lines
+}
+
+func jiraLabel(s string) string {
+	return strings.Join(strings.Fields(s), "-")
+}
+
+func jiraSummary(report Report) string {
+	return truncateText(fmt.Sprintf("[%s] %s", severityLabel(report), report.Alert.Title()), jiraMaxSummaryLen)
+}
+
+// findJiraIssue returns key of the issue of the report. Empty string is
+// returned if not found.
+func findJiraIssue(cfg JiraConfig, report Report) (string, error) {
+	fieldNumber := strings.TrimPrefix(cfg.ExternalIDField, "customfield_")
+	query := map[string]interface{}{
+		"jql":        fmt.Sprintf(`project = "%s" AND cf[%s] ~ "%s"`, cfg.ProjectKey, fieldNumber, report.ID),
+		"fields":     []string{"key", cfg.ExternalIDField},
+		"maxResults": 10,
+	}
+
+	var resp struct {
+		Issues []struct {
+			Key    string                 `json:"key"`
+			Fields map[string]interface{} `json:"fields"`
+		} `json:"issues"`
+	}
+	if err := cfg.request(http.MethodPost, "/rest/api/3/search", query, &resp); err != nil {
+		return "", err
+	}
+
+	// "~" is a text search, then exact match is checked here.
+	for _, issue := range resp.Issues {
+		if v, ok := issue.Fields[cfg.ExternalIDField].(string); ok && v == string(report.ID) {
+			return issue.Key, nil
+		}
+	}
+	return "", nil
+}
+
+func jiraDescription(cfg JiraConfig, report Report) AdfNode {
+	doc := MarkDownToADF(RenderMarkDown(report))
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		doc.Content = append(doc.Content, AdfNode{
+			Type: "paragraph",
+			Content: []AdfNode{{
+				Type:  "text",
+				Text:  "Full report",
+				Marks: []map[string]interface{}{{"type": "link", "attrs": map[string]string{"href": link}}},
+			}},
+		})
+	}
+	return doc
+}
+
+func createJiraIssue(cfg JiraConfig, report Report) (string, error) {
+	issueType := cfg.IssueType
+	if issueType == "" {
+		issueType = jiraDefaultIssueType
+	}
+
+	labels := append([]string{"alert-responder"}, cfg.Labels...)
+	if report.Alert.Rule != "" {
+		labels = append(labels, jiraLabel(report.Alert.Rule))
+	}
+	if report.Result.Severity != "" {
+		labels = append(labels, "severity-"+string(report.Result.Severity))
+	}
+
+	fields := map[string]interface{}{
+		"project":           map[string]string{"key": cfg.ProjectKey},
+		"issuetype":         map[string]string{"name": issueType},
+		"summary":           jiraSummary(report),
+		"description":       jiraDescription(cfg, report),
+		"priority":          map[string]string{"name": cfg.priority(report.Result.Severity)},
+		"labels":            labels,
+		cfg.ExternalIDField: string(report.ID),
+	}
+
+	var resp struct {
+		Key string `json:"key"`
+	}
+	if err := cfg.request(http.MethodPost, "/rest/api/3/issue", map[string]interface{}{"fields": fields}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Key, nil
+}
+
+func updateJiraIssue(cfg JiraConfig, key string, report Report) error {
+	var prop struct {
+		Value jiraSnapshot `json:"value"`
+	}
+	path := fmt.Sprintf("/rest/api/3/issue/%s/properties/%s", url.PathEscape(key), jiraPropertyKey)
+	if err := cfg.request(http.MethodGet, path, nil, &prop); err != nil {
+		// The property does not exist if the issue was created by others.
+		if httpErr, ok := errors.Cause(err).(*HTTPError); !ok || httpErr.StatusCode != http.StatusNotFound {
+			return err
+		}
+	}
+
+	curr := newJiraSnapshot(report)
+	delta := jiraDelta(prop.Value, curr)
+	if len(delta) == 0 {
+		Logger.WithField("issue", key).Info("No change in report, skip JIRA comment")
+		return nil
+	}
+
+	list := make([]string, len(delta))
+	for i, line := range delta {
+		list[i] = "- " + line
+	}
+	body := MarkDownToADF(fmt.Sprintf("Report %s is updated.\n\n%s", report.ID, strings.Join(list, "\n")))
+	commentPath := fmt.Sprintf("/rest/api/3/issue/%s/comment", url.PathEscape(key))
+	if err := cfg.request(http.MethodPost, commentPath, map[string]interface{}{"body": body}, nil); err != nil {
+		return err
+	}
+
+	if prop.Value.Severity != curr.Severity {
+		update := map[string]interface{}{
+			"fields": map[string]interface{}{
+				"priority": map[string]string{"name": cfg.priority(curr.Severity)},
+			},
+		}
+		if err := cfg.request(http.MethodPut, "/rest/api/3/issue/"+url.PathEscape(key), update, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishJira creates a JIRA issue of the report or updates the existing one
+// with a comment of changes. Reports below MinSeverity do not open new issue.
+func PublishJira(cfg JiraConfig, report Report) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	key, err := findJiraIssue(cfg, report)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		if report.Result.Severity.Level() < cfg.minSeverity().Level() {
+			Logger.WithFields(report.LogFields()).Info("Severity is lower than threshold, skip JIRA")
+			return nil
+		}
+
+		if key, err = createJiraIssue(cfg, report); err != nil {
+			return err
+		}
+		Logger.WithField("issue", key).Info("Created JIRA issue")
+	} else {
+		if err := updateJiraIssue(cfg, key, report); err != nil {
+			return err
+		}
+		Logger.WithField("issue", key).Info("Updated JIRA issue")
+	}
+
+	path := fmt.Sprintf("/rest/api/3/issue/%s/properties/%s", url.PathEscape(key), jiraPropertyKey)
+	return cfg.request(http.MethodPut, path, newJiraSnapshot(report), nil)
+}
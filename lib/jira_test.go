@@ -0,0 +1,237 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockJiraIssue struct {
+	Fields     map[string]interface{}
+	Comments   []interface{}
+	Properties map[string]json.RawMessage
+}
+
+// mockJira is a minimum JIRA REST API v3 server for tests.
+type mockJira struct {
+	t        *testing.T
+	srv      *httptest.Server
+	issues   map[string]*mockJiraIssue
+	requests []string
+}
+
+func newMockJira(t *testing.T) *mockJira {
+	x := &mockJira{t: t, issues: map[string]*mockJiraIssue{}}
+	x.srv = httptest.NewServer(http.HandlerFunc(x.handle))
+	return x
+}
+
+var jqlReportID = regexp.MustCompile(`~ "([^"]+)"`)
+var issuePath = regexp.MustCompile(`^/rest/api/3/issue/([A-Z]+-\d+)(/comment|/properties/[a-z-]+)?$`)
+
+func (x *mockJira) handle(w http.ResponseWriter, r *http.Request) {
+	x.requests = append(x.requests, r.Method+" "+r.URL.Path)
+
+	user, token, ok := r.BasicAuth()
+	if !ok || user != "bot@example.com" || token != "valid-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(x.t, err)
+	var in map[string]interface{}
+	if len(body) > 0 {
+		require.NoError(x.t, json.Unmarshal(body, &in))
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/rest/api/3/search":
+		m := jqlReportID.FindStringSubmatch(in["jql"].(string))
+		require.Equal(x.t, 2, len(m))
+		issues := []map[string]interface{}{}
+		for key, issue := range x.issues {
+			if issue.Fields["customfield_10050"] == m[1] {
+				issues = append(issues, map[string]interface{}{"key": key, "fields": issue.Fields})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"issues": issues})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/rest/api/3/issue":
+		key := fmt.Sprintf("SEC-%d", len(x.issues)+1)
+		x.issues[key] = &mockJiraIssue{
+			Fields:     in["fields"].(map[string]interface{}),
+			Properties: map[string]json.RawMessage{},
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"key": key})
+
+	default:
+		m := issuePath.FindStringSubmatch(r.URL.Path)
+		if m == nil || x.issues[m[1]] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		issue := x.issues[m[1]]
+
+		switch {
+		case m[2] == "/comment" && r.Method == http.MethodPost:
+			issue.Comments = append(issue.Comments, in["body"])
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case strings.HasPrefix(m[2], "/properties/") && r.Method == http.MethodPut:
+			issue.Properties[m[2]] = body
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(m[2], "/properties/") && r.Method == http.MethodGet:
+			value, ok := issue.Properties[m[2]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": m[2], "value": value})
+		case m[2] == "" && r.Method == http.MethodPut:
+			for k, v := range in["fields"].(map[string]interface{}) {
+				issue.Fields[k] = v
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (x *mockJira) config() lib.JiraConfig {
+	return lib.JiraConfig{
+		BaseURL:         x.srv.URL,
+		Email:           "bot@example.com",
+		APIToken:        "valid-token",
+		ProjectKey:      "SEC",
+		ExternalIDField: "customfield_10050",
+		Labels:          []string{"security"},
+		ReportURL:       "https://reports.example.com/{report_id}.json",
+		Retry:           lib.HTTPRetry{MaxRetry: 1, Wait: time.Millisecond},
+	}
+}
+
+// commentText concatenates text nodes of ADF document.
+func commentText(node interface{}) string {
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	text, _ := m["text"].(string)
+	content, _ := m["content"].([]interface{})
+	for _, c := range content {
+		text += commentText(c) + "\n"
+	}
+	return text
+}
+
+func TestPublishJiraCreate(t *testing.T) {
+	jira := newMockJira(t)
+	defer jira.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishJira(jira.config(), report))
+
+	require.Equal(t, 1, len(jira.issues))
+	issue := jira.issues["SEC-1"]
+	require.NotNil(t, issue)
+	assert.Equal(t, string(report.ID), issue.Fields["customfield_10050"])
+	assert.Equal(t, map[string]interface{}{"key": "SEC"}, issue.Fields["project"])
+	assert.Equal(t, map[string]interface{}{"name": "Task"}, issue.Fields["issuetype"])
+	assert.Equal(t, map[string]interface{}{"name": "Highest"}, issue.Fields["priority"])
+	assert.Equal(t, []interface{}{"alert-responder", "security", "malware-detected", "severity-urgent"}, issue.Fields["labels"])
+	assert.Contains(t, issue.Fields["summary"], "[URGENT]")
+
+	desc := issue.Fields["description"].(map[string]interface{})
+	assert.Equal(t, "doc", desc["type"])
+	assert.Equal(t, float64(1), desc["version"])
+	assert.Contains(t, commentText(desc), "198.51.100.7")
+	assert.Contains(t, commentText(desc), "Full report")
+
+	assert.Equal(t, 1, len(issue.Properties))
+	assert.Equal(t, 0, len(issue.Comments))
+}
+
+func TestPublishJiraUpdateWithComment(t *testing.T) {
+	jira := newMockJira(t)
+	defer jira.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevUnclassified
+	require.NoError(t, lib.PublishJira(jira.config(), report))
+
+	// Recompiled report with a new remote host and raised severity.
+	report.Result.Severity = lib.SevUrgent
+	report.Content.OpponentHosts["192.0.2.50"] = lib.ReportOpponentHost{ID: "192.0.2.50"}
+	require.NoError(t, lib.PublishJira(jira.config(), report))
+
+	require.Equal(t, 1, len(jira.issues))
+	issue := jira.issues["SEC-1"]
+	require.Equal(t, 1, len(issue.Comments))
+	text := commentText(issue.Comments[0])
+	assert.Contains(t, text, "Severity: unclassified -> urgent")
+	assert.Contains(t, text, "1 remote host added: 192.0.2.50")
+	assert.Equal(t, map[string]interface{}{"name": "Highest"}, issue.Fields["priority"])
+
+	// No comment if nothing changed.
+	require.NoError(t, lib.PublishJira(jira.config(), report))
+	assert.Equal(t, 1, len(issue.Comments))
+}
+
+func TestPublishJiraSkipLowSeverity(t *testing.T) {
+	jira := newMockJira(t)
+	defer jira.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevSafe
+	require.NoError(t, lib.PublishJira(jira.config(), report))
+	assert.Equal(t, 0, len(jira.issues))
+}
+
+func TestPublishJiraAuthFailure(t *testing.T) {
+	jira := newMockJira(t)
+	defer jira.srv.Close()
+
+	cfg := jira.config()
+	cfg.APIToken = "invalid-token"
+	err := lib.PublishJira(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+	// Authentication failure is not retried.
+	assert.Equal(t, []string{"POST /rest/api/3/search"}, jira.requests)
+	assert.Equal(t, 0, len(jira.issues))
+}
+
+func TestMarkDownToADF(t *testing.T) {
+	doc := lib.MarkDownToADF("## Title\n\n- a `b`\n- c\n\n| X | Y |\n|:--|:--|\n| 1 \\| 2 | 3 |\n")
+	require.Equal(t, 3, len(doc.Content))
+
+	assert.Equal(t, "heading", doc.Content[0].Type)
+	assert.Equal(t, 2, doc.Content[0].Attrs["level"])
+
+	list := doc.Content[1]
+	assert.Equal(t, "bulletList", list.Type)
+	require.Equal(t, 2, len(list.Content))
+	inline := list.Content[0].Content[0].Content
+	require.Equal(t, 2, len(inline))
+	assert.Equal(t, "b", inline[1].Text)
+	assert.Equal(t, "code", inline[1].Marks[0]["type"])
+
+	table := doc.Content[2]
+	assert.Equal(t, "table", table.Type)
+	require.Equal(t, 2, len(table.Content))
+	assert.Equal(t, "tableHeader", table.Content[0].Content[0].Type)
+	assert.Equal(t, "1 | 2", table.Content[1].Content[0].Content[0].Content[0].Text)
+}
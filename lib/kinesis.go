@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// DefaultKinesisMaxRecordSize is threshold of a serialized report to be put
+// as it is. Kinesis limits a record to 1MB including partition key.
+const DefaultKinesisMaxRecordSize = 1000 * 1024
+
+// Limits of PutRecords. A request has up to 500 records and 5MB in total.
+const (
+	kinesisMaxBatchRecords = 500
+	kinesisMaxBatchSize    = 5 * 1024 * 1024
+)
+
+// KinesisClient is a client used by PublishKinesis. A client of the region
+// is created if nil.
+var KinesisClient kinesisiface.KinesisAPI
+
+// KinesisConfig is configuration of PublishKinesis.
+type KinesisConfig struct {
+	StreamName string
+	Region     string
+
+	// Gzip compresses data of records.
+	Gzip bool
+
+	// Retry is retry policy of records failed in PutRecords. Only failed
+	// records are put again. DefaultHTTPRetry is used if not set.
+	Retry HTTPRetry
+
+	// MaxMessageSize, AlwaysEnvelope, Bucket, PresignExpiry and S3 are the
+	// same as ReportPublishConfig. An oversized report is put as an envelope.
+	// DefaultKinesisMaxRecordSize is used if MaxMessageSize is 0.
+	MaxMessageSize int
+	AlwaysEnvelope bool
+	Bucket         string
+	PresignExpiry  time.Duration
+	S3             s3iface.S3API
+}
+
+func (x *KinesisConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+func (x *KinesisConfig) envelope() ReportPublishConfig {
+	maxSize := x.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultKinesisMaxRecordSize
+	}
+	return ReportPublishConfig{
+		Region:         x.Region,
+		MaxMessageSize: maxSize,
+		AlwaysEnvelope: x.AlwaysEnvelope,
+		Bucket:         x.Bucket,
+		PresignExpiry:  x.PresignExpiry,
+		S3:             x.S3,
+	}
+}
+
+// PublishKinesis puts the report to Kinesis stream.
+func PublishKinesis(cfg KinesisConfig, report Report) error {
+	return PublishKinesisBatch(cfg, []Report{report})
+}
+
+// PublishKinesisBatch puts the reports to Kinesis stream by PutRecords. ID of
+// the report is partition key so that records of a report are in order.
+func PublishKinesisBatch(cfg KinesisConfig, reports []Report) (err error) {
+	span := StartTrace("PublishKinesis")
+	defer func() { span.End(err) }()
+
+	if cfg.StreamName == "" {
+		return NewConfigError("Kinesis stream is not configured")
+	}
+
+	client := KinesisClient
+	if client == nil {
+		client = kinesis.New(newSession(cfg.Region))
+	}
+
+	var entries []*kinesis.PutRecordsRequestEntry
+	batchSize := 0
+	for _, report := range reports {
+		entry, err := newKinesisEntry(cfg, report)
+		if err != nil {
+			return err
+		}
+
+		size := len(entry.Data) + len(aws.StringValue(entry.PartitionKey))
+		if len(entries) == kinesisMaxBatchRecords || (len(entries) > 0 && batchSize+size > kinesisMaxBatchSize) {
+			if err := putKinesisRecords(client, cfg, entries); err != nil {
+				return err
+			}
+			entries, batchSize = nil, 0
+		}
+		entries = append(entries, entry)
+		batchSize += size
+	}
+
+	if len(entries) > 0 {
+		return putKinesisRecords(client, cfg, entries)
+	}
+	return nil
+}
+
+func newKinesisEntry(cfg KinesisConfig, report Report) (*kinesis.PutRecordsRequestEntry, error) {
+	msg, _, err := reportMessage(cfg.envelope(), report)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
+	}
+
+	if cfg.Gzip {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, errors.Wrap(err, "Fail to compress report data")
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Wrap(err, "Fail to compress report data")
+		}
+		data = buf.Bytes()
+	}
+
+	return &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(string(report.ID)),
+	}, nil
+}
+
+// putKinesisRecords puts the records and retries only failed ones with
+// backoff by cfg.Retry.
+func putKinesisRecords(client kinesisiface.KinesisAPI, cfg KinesisConfig, entries []*kinesis.PutRecordsRequestEntry) error {
+	retry := cfg.retry()
+	wait := retry.Wait
+	pending := entries
+
+	for i := 0; ; i++ {
+		resp, err := client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(cfg.StreamName),
+			Records:    pending,
+		})
+
+		var failed []*kinesis.PutRecordsRequestEntry
+		var reasons []string
+		if err != nil {
+			if !retryableStoreError(err) {
+				return WrapCode(ErrCodePublish, err, "Fail to put reports to Kinesis")
+			}
+			failed, reasons = pending, []string{err.Error()}
+		} else {
+			for j, record := range resp.Records {
+				if record.ErrorCode != nil && j < len(pending) {
+					failed = append(failed, pending[j])
+					reasons = append(reasons, fmt.Sprintf("%s: %s %s",
+						aws.StringValue(pending[j].PartitionKey), aws.StringValue(record.ErrorCode), aws.StringValue(record.ErrorMessage)))
+				}
+			}
+		}
+
+		if len(failed) == 0 {
+			Logger.WithField("stream", cfg.StreamName).WithField("count", len(entries)).Info("Put reports to Kinesis")
+			return nil
+		}
+
+		if i >= retry.MaxRetry {
+			return WrapCode(ErrCodePublish, errors.New(strings.Join(reasons, "; ")),
+				fmt.Sprintf("Fail to put %d of %d report(s) to Kinesis", len(failed), len(entries)))
+		}
+
+		Logger.WithField("failed", len(failed)).WithField("retry", i+1).Warn("Some Kinesis records failed, retrying")
+		time.Sleep(wait)
+		wait *= 2
+		pending = failed
+	}
+}
@@ -0,0 +1,166 @@
+package lib_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockKinesis struct {
+	kinesisiface.KinesisAPI
+	inputs []*kinesis.PutRecordsInput
+
+	// failures is number of following failures by partition key.
+	failures map[string]int
+}
+
+func (x *mockKinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	x.inputs = append(x.inputs, input)
+
+	var output kinesis.PutRecordsOutput
+	for _, record := range input.Records {
+		key := aws.StringValue(record.PartitionKey)
+		if x.failures[key] > 0 {
+			x.failures[key]--
+			output.FailedRecordCount = aws.Int64(aws.Int64Value(output.FailedRecordCount) + 1)
+			output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+				ErrorMessage: aws.String("Rate exceeded"),
+			})
+			continue
+		}
+		output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{
+			SequenceNumber: aws.String("1"),
+			ShardId:        aws.String("shardId-000000000000"),
+		})
+	}
+	return &output, nil
+}
+
+func (x *mockKinesis) keys(i int) []string {
+	var keys []string
+	for _, record := range x.inputs[i].Records {
+		keys = append(keys, aws.StringValue(record.PartitionKey))
+	}
+	return keys
+}
+
+func setupKinesisTest(t *testing.T) (*mockKinesis, lib.KinesisConfig) {
+	client := &mockKinesis{failures: map[string]int{}}
+	lib.KinesisClient = client
+
+	return client, lib.KinesisConfig{
+		StreamName: "results",
+		Region:     "ap-northeast-1",
+		Retry:      lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+}
+
+func kinesisReports(t *testing.T, ids ...lib.ReportID) []lib.Report {
+	var reports []lib.Report
+	for _, id := range ids {
+		report := loadFixtureReport(t)
+		report.ID = id
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func TestPublishKinesis(t *testing.T) {
+	client, cfg := setupKinesisTest(t)
+	defer func() { lib.KinesisClient = nil }()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishKinesis(cfg, report))
+
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, "results", aws.StringValue(client.inputs[0].StreamName))
+	require.Equal(t, 1, len(client.inputs[0].Records))
+	record := client.inputs[0].Records[0]
+	assert.Equal(t, string(report.ID), aws.StringValue(record.PartitionKey))
+
+	var put lib.Report
+	require.NoError(t, json.Unmarshal(record.Data, &put))
+	assert.Equal(t, report.ID, put.ID)
+}
+
+func TestPublishKinesisGzip(t *testing.T) {
+	client, cfg := setupKinesisTest(t)
+	defer func() { lib.KinesisClient = nil }()
+
+	cfg.Gzip = true
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishKinesis(cfg, report))
+
+	r, err := gzip.NewReader(bytes.NewReader(client.inputs[0].Records[0].Data))
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	var put lib.Report
+	require.NoError(t, json.Unmarshal(data, &put))
+	assert.Equal(t, report.ID, put.ID)
+}
+
+func TestPublishKinesisRetryFailedRecords(t *testing.T) {
+	client, cfg := setupKinesisTest(t)
+	defer func() { lib.KinesisClient = nil }()
+
+	client.failures["r2"] = 1
+	client.failures["r4"] = 2
+	require.NoError(t, lib.PublishKinesisBatch(cfg, kinesisReports(t, "r1", "r2", "r3", "r4")))
+
+	require.Equal(t, 3, len(client.inputs))
+	assert.Equal(t, []string{"r1", "r2", "r3", "r4"}, client.keys(0))
+	assert.Equal(t, []string{"r2", "r4"}, client.keys(1))
+	assert.Equal(t, []string{"r4"}, client.keys(2))
+}
+
+func TestPublishKinesisRetryExhausted(t *testing.T) {
+	client, cfg := setupKinesisTest(t)
+	defer func() { lib.KinesisClient = nil }()
+
+	client.failures["r2"] = 10
+	err := lib.PublishKinesisBatch(cfg, kinesisReports(t, "r1", "r2"))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "1 of 2")
+	assert.Contains(t, err.Error(), "r2: ProvisionedThroughputExceededException")
+
+	// Initial attempt and 2 retries of only the failed record.
+	require.Equal(t, 3, len(client.inputs))
+	assert.Equal(t, []string{"r2"}, client.keys(1))
+	assert.Equal(t, []string{"r2"}, client.keys(2))
+}
+
+func TestPublishKinesisEnvelope(t *testing.T) {
+	client, cfg := setupKinesisTest(t)
+	defer func() { lib.KinesisClient = nil }()
+
+	storage := &envelopeS3{}
+	cfg.MaxMessageSize = 100
+	cfg.Bucket = "archive-bucket"
+	cfg.S3 = storage
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishKinesis(cfg, report))
+	require.Equal(t, 1, len(storage.puts))
+
+	var envelope lib.ReportEnvelope
+	require.NoError(t, json.Unmarshal(client.inputs[0].Records[0].Data, &envelope))
+	assert.Equal(t, lib.ReportEnvelopeType, envelope.Type)
+	assert.Equal(t, report.ID, envelope.ReportID)
+
+	_, ok := lib.PublishKinesis(lib.KinesisConfig{}, report).(*lib.ConfigError)
+	assert.True(t, ok)
+}
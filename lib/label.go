@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// normalizeLabel trims and lowercases a label so that "Phishing" and
+// "phishing " are the same label.
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimSpace(label))
+}
+
+// AddLabel adds a label to the report. Empty and duplicated labels are
+// ignored, and false is returned for them.
+func (x *Report) AddLabel(label string) bool {
+	label = normalizeLabel(label)
+	if label == "" || x.HasLabel(label) {
+		return false
+	}
+	x.Labels = append(x.Labels, label)
+	return true
+}
+
+// HasLabel returns true if the report has the label.
+func (x *Report) HasLabel(label string) bool {
+	label = normalizeLabel(label)
+	for _, l := range x.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleLabels maps patterns of alert rule to labels of reports, e.g.
+// {"phish-*": ["phishing"]}. Pattern syntax is the same as path.Match.
+type RuleLabels map[string][]string
+
+// ParseRuleLabels parses JSON of RuleLabels, e.g. value of RULE_LABELS
+// environment variable. Empty string means no labels. Patterns are normalized
+// by NormalizeRulePattern.
+func ParseRuleLabels(raw string) (RuleLabels, error) {
+	if strings.TrimSpace(raw) == "" {
+		return RuleLabels{}, nil
+	}
+
+	var labels RuleLabels
+	if err := json.Unmarshal([]byte(raw), &labels); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid rule labels").Error())
+	}
+	for pattern := range labels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, NewConfigError(fmt.Sprintf("Invalid rule pattern of labels: %s", pattern))
+		}
+	}
+	return RuleLabels(normalizeRulePatterns(labels)), nil
+}
+
+// Seed adds labels of patterns matching the alert rule of the report.
+// Patterns are applied in sorted order to keep order of labels stable.
+func (x RuleLabels) Seed(report *Report) {
+	var patterns []string
+	for pattern := range x {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	rule := NormalizeRule(report.Alert.Rule)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rule); ok {
+			for _, label := range x[pattern] {
+				report.AddLabel(label)
+			}
+		}
+	}
+}
+
+// StoredLabels returns labels of the report stored in the report table, so
+// that labels added after previous compilation are kept. Nil is returned if
+// the report is not stored yet.
+func StoredLabels(tableName, region string, reportID ReportID) ([]string, error) {
+	report, err := LoadReport(tableName, region, reportID)
+	if err == ErrReportNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return report.Labels, nil
+}
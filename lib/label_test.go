@@ -0,0 +1,105 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportAddLabel(t *testing.T) {
+	var report lib.Report
+	assert.True(t, report.AddLabel("phishing"))
+	assert.True(t, report.AddLabel(" Recon "))
+	assert.False(t, report.AddLabel("PHISHING"))
+	assert.False(t, report.AddLabel("recon"))
+	assert.False(t, report.AddLabel("  "))
+	assert.Equal(t, []string{"phishing", "recon"}, report.Labels)
+
+	assert.True(t, report.HasLabel("Phishing"))
+	assert.False(t, report.HasLabel("false-positive"))
+}
+
+func TestRuleLabelsSeed(t *testing.T) {
+	labels, err := lib.ParseRuleLabels(`{
+		"phish-*": ["phishing", "email"],
+		"phish-attachment": ["Email", "malware"],
+		"port-scan": ["recon"]
+	}`)
+	require.NoError(t, err)
+
+	report := lib.Report{Labels: []string{"false-positive"}}
+	report.Alert.Rule = "phish-attachment"
+	labels.Seed(&report)
+	// Existing labels are kept and duplicated labels are ignored.
+	assert.Equal(t, []string{"false-positive", "email", "malware", "phishing"}, report.Labels)
+
+	// Seeding again changes nothing.
+	labels.Seed(&report)
+	assert.Equal(t, 4, len(report.Labels))
+
+	other := lib.Report{}
+	other.Alert.Rule = "brute-force"
+	labels.Seed(&other)
+	assert.Equal(t, 0, len(other.Labels))
+}
+
+func TestParseRuleLabels(t *testing.T) {
+	labels, err := lib.ParseRuleLabels("")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(labels))
+
+	for _, raw := range []string{`{"x": "phishing"}`, `{"[x": ["phishing"]}`} {
+		_, err := lib.ParseRuleLabels(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestStoredLabels(t *testing.T) {
+	table := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	labels, err := lib.StoredLabels("reports", "ap-northeast-1", "r1")
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+
+	report := lib.Report{ID: "r1", Labels: []string{"recon"}}
+	record, err := lib.NewReportRecord(report, "ap-northeast-1")
+	require.NoError(t, err)
+	table.reports = append(table.reports, record)
+
+	labels, err = lib.StoredLabels("reports", "ap-northeast-1", "r1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recon"}, labels)
+}
+
+func TestSearchReportsByLabels(t *testing.T) {
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	table := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	fixtures := map[lib.ReportID][]string{
+		"r1": {"phishing"},
+		"r2": {"phishing", "false-positive"},
+		"r3": nil,
+	}
+	for i, id := range []lib.ReportID{"r1", "r2", "r3"} {
+		at := base.Add(-time.Duration(i) * time.Hour)
+		report := lib.Report{ID: id, ReceivedAt: at, Labels: fixtures[id]}
+		record, err := lib.NewReportRecord(report, "ap-northeast-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+
+	reports, err := lib.SearchReportsByLabels("reports", "ap-northeast-1", "", base.Add(-time.Hour*24), base, []string{"Phishing"})
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"r1", "r2"}, reportIDs(reports))
+
+	reports, err = lib.SearchReportsByLabels("reports", "ap-northeast-1", "", base.Add(-time.Hour*24), base, []string{"phishing", "false-positive"})
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"r2"}, reportIDs(reports))
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// CorrelationKey is a field name of correlation ID in structured logs.
+const CorrelationKey = "correlation_id"
+
 // Logger is exported to allow replacement by external code.
 var Logger = logrus.New()
 
@@ -11,3 +14,8 @@ func init() {
 	Logger.SetLevel(logrus.DebugLevel)
 	Logger.SetFormatter(&logrus.JSONFormatter{})
 }
+
+// WithCorrelation returns a log entry having the correlation ID.
+func WithCorrelation(logger logrus.FieldLogger, id string) *logrus.Entry {
+	return logger.WithField(CorrelationKey, id)
+}
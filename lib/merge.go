@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MergeStrategy specifies how values of the same host are merged.
+type MergeStrategy int
+
+const (
+	// MergeUnion concatenates all values of all pages.
+	MergeUnion MergeStrategy = iota
+	// MergeLatestWins keeps only values of the latest page per field.
+	MergeLatestWins
+	// MergeHistoryCapped concatenates values but keeps only latest N values
+	// per field.
+	MergeHistoryCapped
+)
+
+// DefaultHistoryCap is used for MergeHistoryCapped when HistoryCap is not set.
+const DefaultHistoryCap = 10
+
+// ParseMergeStrategy converts a name of strategy ("union", "latest_wins" or
+// "history_capped") to MergeStrategy. Empty name means MergeUnion.
+func ParseMergeStrategy(name string) (MergeStrategy, error) {
+	switch name {
+	case "", "union":
+		return MergeUnion, nil
+	case "latest_wins":
+		return MergeLatestWins, nil
+	case "history_capped":
+		return MergeHistoryCapped, nil
+	default:
+		return MergeUnion, fmt.Errorf("Invalid merge strategy: %s", name)
+	}
+}
+
+// MergeOption is a set of options for MergePages.
+type MergeOption struct {
+	Strategy   MergeStrategy
+	HistoryCap int
+}
+
+// Conflict is a disagreement between sources about a field of a host that
+// should have one value, e.g. different AS owners of one IP address. Values
+// are merged by the strategy regardless of conflicts. Sources[i] has authors
+// of pages that reported Values[i].
+type Conflict struct {
+	Field   string   `json:"field"`
+	HostID  string   `json:"host_id"`
+	Values  []string `json:"values"`
+	Sources []string `json:"sources"`
+}
+
+type conflictKey struct {
+	hostID string
+	field  string
+}
+
+// conflictTracker collects values of single-valued fields per host and source.
+type conflictTracker map[conflictKey]map[string][]string
+
+func (x conflictTracker) add(hostID, field, source string, values []string) {
+	if source == "" {
+		source = "unknown"
+	}
+
+	key := conflictKey{hostID: hostID, field: field}
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if x[key] == nil {
+			x[key] = map[string][]string{}
+		}
+		if !stringsContain(x[key][v], source) {
+			x[key][v] = append(x[key][v], source)
+		}
+	}
+}
+
+// conflicts returns fields that have different values from different sources
+// sorted by host ID and field.
+func (x conflictTracker) conflicts() []Conflict {
+	var keys []conflictKey
+	for key := range x {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hostID != keys[j].hostID {
+			return keys[i].hostID < keys[j].hostID
+		}
+		return keys[i].field < keys[j].field
+	})
+
+	var conflicts []Conflict
+	for _, key := range keys {
+		values := x[key]
+		if len(values) < 2 {
+			continue
+		}
+
+		c := Conflict{Field: key.field, HostID: key.hostID}
+		sources := map[string]bool{}
+		for v := range values {
+			c.Values = append(c.Values, v)
+		}
+		for _, v := range sortedKeys(c.Values) {
+			c.Sources = append(c.Sources, strings.Join(values[v], ", "))
+			for _, src := range values[v] {
+				sources[src] = true
+			}
+		}
+
+		// Multiple values from only one source are not disagreement.
+		if len(sources) > 1 {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func stringsContain(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MergePages merges hosts and users in the pages into the content. The pages
+// must be sorted from oldest to latest. Conflicts of country and AS owner of
+// remote hosts and OS, owner and host name of local hosts between pages are
+// returned.
+func MergePages(c *ReportContent, pages []*ReportPage, opt MergeOption) []Conflict {
+	if c.OpponentHosts == nil {
+		c.OpponentHosts = map[string]ReportOpponentHost{}
+	}
+	if c.AlliedHosts == nil {
+		c.AlliedHosts = map[string]ReportAlliedHost{}
+	}
+	if c.SubjectUsers == nil {
+		c.SubjectUsers = map[string]ReportUser{}
+	}
+
+	tracker := conflictTracker{}
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+
+		for _, r := range page.OpponentHosts {
+			tracker.add(r.ID, "country", page.Author, r.Country)
+			tracker.add(r.ID, "as_owner", page.Author, r.ASOwner)
+
+			h := c.OpponentHosts[r.ID]
+			if opt.Strategy == MergeUnion {
+				h.Merge(r)
+			} else {
+				// Observed period is widened by any strategy.
+				first, last := h.FirstSeen, h.LastSeen
+				opt.mergeFields(&h, r)
+				h.FirstSeen, h.LastSeen = first, last
+				widenSeen(&h.FirstSeen, &h.LastSeen, r.FirstSeen, r.LastSeen)
+			}
+			c.OpponentHosts[r.ID] = h
+		}
+
+		for _, r := range page.AlliedHosts {
+			tracker.add(r.ID, "os", page.Author, r.OS)
+			tracker.add(r.ID, "owner", page.Author, r.Owner)
+			tracker.add(r.ID, "hostname", page.Author, r.HostName)
+
+			h := c.AlliedHosts[r.ID]
+			if opt.Strategy == MergeUnion {
+				h.Merge(r)
+			} else {
+				first, last := h.FirstSeen, h.LastSeen
+				opt.mergeFields(&h, r)
+				h.FirstSeen, h.LastSeen = first, last
+				widenSeen(&h.FirstSeen, &h.LastSeen, r.FirstSeen, r.LastSeen)
+			}
+			c.AlliedHosts[r.ID] = h
+		}
+
+		for _, r := range page.SubjectUser {
+			h := c.SubjectUsers[r.UserName]
+			if opt.Strategy == MergeUnion {
+				h.Merge(r)
+			} else {
+				opt.mergeFields(&h, r)
+			}
+			c.SubjectUsers[r.UserName] = h
+		}
+	}
+
+	return tracker.conflicts()
+}
+
+// mergeFields merges src struct into dst pointer of struct field by field.
+// Scalar fields are overwritten by non-zero values of src.
+func (x MergeOption) mergeFields(dst, src interface{}) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+
+	for i := 0; i < d.NumField(); i++ {
+		df, sf := d.Field(i), s.Field(i)
+
+		if df.Kind() != reflect.Slice {
+			if !sf.IsZero() {
+				df.Set(sf)
+			}
+			continue
+		}
+
+		switch x.Strategy {
+		case MergeLatestWins:
+			if sf.Len() > 0 {
+				df.Set(sf)
+			}
+
+		case MergeHistoryCapped:
+			limit := x.HistoryCap
+			if limit <= 0 {
+				limit = DefaultHistoryCap
+			}
+			merged := reflect.AppendSlice(df, sf)
+			if merged.Len() > limit {
+				merged = merged.Slice(merged.Len()-limit, merged.Len())
+			}
+			df.Set(merged)
+		}
+	}
+}
+
+// MergeReports consolidates duplicate reports of the same incident. Content
+// and labels are unioned and the higher severity result is taken. ID of the
+// primary is kept and the secondary is recorded in MergedFrom.
+func MergeReports(primary, secondary Report) Report {
+	merged := primary
+
+	merged.Content = newReportContent()
+	merged.Content.Merge(primary.Content)
+	merged.Content.Merge(secondary.Content)
+
+	if secondary.Result.Severity.Level() > primary.Result.Severity.Level() {
+		merged.Result = secondary.Result
+	}
+
+	merged.Labels = append([]string{}, primary.Labels...)
+	for _, label := range secondary.Labels {
+		merged.AddLabel(label)
+	}
+	merged.Occurrences = primary.Occurrences + secondary.Occurrences
+
+	merged.MergedFrom = append([]ReportID{}, primary.MergedFrom...)
+	for _, id := range append([]ReportID{secondary.ID}, secondary.MergedFrom...) {
+		if id != primary.ID && !reportIDsContain(merged.MergedFrom, id) {
+			merged.MergedFrom = append(merged.MergedFrom, id)
+		}
+	}
+	return merged
+}
+
+func reportIDsContain(ids []ReportID, id ReportID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeStoredReports merges the secondary report into the primary and stores
+// them. Pages of the secondary are copied to the primary so that they are
+// kept by recompilation. The secondary is closed as a tombstone that has ID
+// of the primary in MergedInto.
+func MergeStoredReports(reportTable, reportData, region string, primaryID, secondaryID ReportID) (merged *Report, err error) {
+	span := StartTrace("MergeStoredReports")
+	defer func() { span.End(err) }()
+
+	if primaryID == secondaryID {
+		return nil, NewConfigError(fmt.Sprintf("Report %s can not be merged into itself", primaryID))
+	}
+
+	store := OpenReportStore(region, reportTable, reportData)
+	primary, err := store.GetReport(primaryID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to load primary report %s", primaryID)
+	}
+	secondary, err := store.GetReport(secondaryID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to load secondary report %s", secondaryID)
+	}
+	if primary.MergedInto != nil {
+		return nil, NewConfigError(fmt.Sprintf("Report %s is already merged into %s", primaryID, *primary.MergedInto))
+	}
+	if secondary.MergedInto != nil {
+		return nil, NewConfigError(fmt.Sprintf("Report %s is already merged into %s", secondaryID, *secondary.MergedInto))
+	}
+
+	pages, err := store.FetchPages(secondaryID)
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+		page.ReportID = primaryID
+		component := NewReportComponent(primaryID)
+		if err := component.SetPage(*page); err != nil {
+			return nil, err
+		}
+		if err := store.Submit(component); err != nil {
+			if errors.Cause(err) == ErrPageLimitExceeded {
+				Logger.WithField("report_id", primaryID).WithField("author", page.Author).
+					Warn("Skip page of secondary report over limit")
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	result := MergeReports(*primary, *secondary)
+	if err := store.SaveReport(result); err != nil {
+		return nil, WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to save merged report %s", primaryID))
+	}
+
+	secondary.MergedInto = &primaryID
+	secondary.Status = StatusClosed
+	if err := store.SaveReport(*secondary); err != nil {
+		return nil, WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to save merged report %s", secondaryID))
+	}
+
+	Logger.WithFields(result.LogFields()).WithField("secondary", secondaryID).Info("Merged reports")
+	return &result, nil
+}
@@ -0,0 +1,440 @@
+package lib_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mergeTestPages() []*lib.ReportPage {
+	p1 := lib.NewReportPage()
+	p1.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1", IPAddr: []string{"10.0.0.1"}, Country: []string{"US"}},
+	}
+	p1.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "a1", UserName: []string{"alice"}},
+	}
+
+	p2 := lib.NewReportPage()
+	p2.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1", IPAddr: []string{"10.0.0.2", "10.0.0.3"}},
+	}
+
+	p3 := lib.NewReportPage()
+	p3.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1", IPAddr: []string{"10.0.0.4"}, Country: []string{"JP"}},
+	}
+
+	return []*lib.ReportPage{&p1, &p2, nil, &p3}
+}
+
+func TestAlliedHostMergeUserName(t *testing.T) {
+	host := lib.ReportAlliedHost{ID: "a1", UserName: []string{"alice"}}
+	host.Merge(lib.ReportAlliedHost{ID: "a1", UserName: []string{"bob"}, Country: []string{"JP"}})
+	assert.Equal(t, []string{"alice", "bob"}, host.UserName)
+}
+
+func TestParseMergeStrategy(t *testing.T) {
+	s, err := lib.ParseMergeStrategy("")
+	require.NoError(t, err)
+	assert.Equal(t, lib.MergeUnion, s)
+
+	s, err = lib.ParseMergeStrategy("latest_wins")
+	require.NoError(t, err)
+	assert.Equal(t, lib.MergeLatestWins, s)
+
+	s, err = lib.ParseMergeStrategy("history_capped")
+	require.NoError(t, err)
+	assert.Equal(t, lib.MergeHistoryCapped, s)
+
+	_, err = lib.ParseMergeStrategy("magic")
+	assert.Error(t, err)
+}
+
+func TestMergePagesUnion(t *testing.T) {
+	var c lib.ReportContent
+	lib.MergePages(&c, mergeTestPages(), lib.MergeOption{Strategy: lib.MergeUnion})
+
+	h := c.OpponentHosts["h1"]
+	assert.Equal(t, "h1", h.ID)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, h.IPAddr)
+	assert.Equal(t, []string{"US", "JP"}, h.Country)
+	assert.Equal(t, []string{"alice"}, c.AlliedHosts["a1"].UserName)
+}
+
+func TestMergePagesLatestWins(t *testing.T) {
+	var c lib.ReportContent
+	lib.MergePages(&c, mergeTestPages(), lib.MergeOption{Strategy: lib.MergeLatestWins})
+
+	h := c.OpponentHosts["h1"]
+	assert.Equal(t, "h1", h.ID)
+	assert.Equal(t, []string{"10.0.0.4"}, h.IPAddr)
+	assert.Equal(t, []string{"JP"}, h.Country)
+	assert.Equal(t, []string{"alice"}, c.AlliedHosts["a1"].UserName)
+}
+
+func TestMergePagesHistoryCapped(t *testing.T) {
+	var c lib.ReportContent
+	lib.MergePages(&c, mergeTestPages(), lib.MergeOption{
+		Strategy:   lib.MergeHistoryCapped,
+		HistoryCap: 2,
+	})
+
+	h := c.OpponentHosts["h1"]
+	assert.Equal(t, "h1", h.ID)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.4"}, h.IPAddr)
+	assert.Equal(t, []string{"US", "JP"}, h.Country)
+	assert.Equal(t, []string{"alice"}, c.AlliedHosts["a1"].UserName)
+}
+
+func TestMergePagesConflicts(t *testing.T) {
+	p1 := lib.NewReportPage()
+	p1.Author = "inspector-a"
+	p1.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "198.51.100.7", ASOwner: []string{"Example Hosting"}, Country: []string{"RU"}},
+	}
+	p2 := lib.NewReportPage()
+	p2.Author = "inspector-b"
+	p2.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "198.51.100.7", ASOwner: []string{"Other Networks"}, Country: []string{"RU"}},
+	}
+	p3 := lib.NewReportPage()
+	p3.Author = "inspector-c"
+	p3.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "198.51.100.7", ASOwner: []string{"Example Hosting"}},
+	}
+
+	var c lib.ReportContent
+	conflicts := lib.MergePages(&c, []*lib.ReportPage{&p1, &p2, &p3}, lib.MergeOption{})
+	require.Equal(t, 1, len(conflicts))
+	assert.Equal(t, lib.Conflict{
+		Field:   "as_owner",
+		HostID:  "198.51.100.7",
+		Values:  []string{"Example Hosting", "Other Networks"},
+		Sources: []string{"inspector-a, inspector-c", "inspector-b"},
+	}, conflicts[0])
+
+	// Values are still merged.
+	assert.Equal(t, 3, len(c.OpponentHosts["198.51.100.7"].ASOwner))
+}
+
+func TestMergePagesNoConflict(t *testing.T) {
+	p1 := lib.NewReportPage()
+	p1.Author = "inspector-a"
+	p1.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-0123456789", HostName: []string{"web-01", "web-01.local"}},
+	}
+	p2 := lib.NewReportPage()
+	p2.Author = "inspector-b"
+	p2.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-0123456789", OS: []string{"Amazon Linux 2"}},
+	}
+	p3 := lib.NewReportPage()
+	p3.Author = "inspector-c"
+	p3.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "i-0123456789", OS: []string{"Amazon Linux 2"}},
+	}
+
+	// Multiple values from one source and same values from multiple sources
+	// are not conflicts.
+	var c lib.ReportContent
+	conflicts := lib.MergePages(&c, []*lib.ReportPage{&p1, &p2, &p3}, lib.MergeOption{})
+	assert.Empty(t, conflicts)
+}
+
+// Sizes of benchmark data are taken from large reports: hundreds of IP
+// addresses and dozens of malware samples per host, submitted by many pages.
+const (
+	benchPages    = 20
+	benchIPAddrs  = 300
+	benchMalware  = 30
+	benchRelated  = 20
+	benchActivity = 50
+)
+
+func benchOpponentHosts() []lib.ReportOpponentHost {
+	hosts := make([]lib.ReportOpponentHost, benchPages)
+	for p := range hosts {
+		h := lib.ReportOpponentHost{ID: "198.51.100.7"}
+		for i := 0; i < benchIPAddrs/benchPages; i++ {
+			h.IPAddr = append(h.IPAddr, fmt.Sprintf("198.51.%d.%d", p, i))
+		}
+		h.Country = []string{"RU"}
+		h.ASOwner = []string{"Example Hosting"}
+		for i := 0; i < benchMalware; i++ {
+			h.RelatedMalware = append(h.RelatedMalware, lib.ReportMalware{
+				SHA256: fmt.Sprintf("%064x", i),
+				Scans: []lib.ReportMalwareScan{
+					{Vendor: "VendorA", Name: "Trojan.Gen", Positive: true, Source: "VirusTotal"},
+					{Vendor: "VendorB", Positive: false, Source: "VirusTotal"},
+				},
+			})
+		}
+		for i := 0; i < benchRelated; i++ {
+			h.RelatedDomains = append(h.RelatedDomains, lib.ReportDomain{Name: fmt.Sprintf("d%d.example.com", i)})
+			h.RelatedURLs = append(h.RelatedURLs, lib.ReportURL{URL: fmt.Sprintf("http://d%d.example.com/", i)})
+		}
+		hosts[p] = h
+	}
+	return hosts
+}
+
+func benchAlliedHosts() []lib.ReportAlliedHost {
+	hosts := make([]lib.ReportAlliedHost, benchPages)
+	for p := range hosts {
+		h := lib.ReportAlliedHost{ID: "i-0123456789"}
+		for i := 0; i < benchIPAddrs/benchPages; i++ {
+			h.IPAddr = append(h.IPAddr, fmt.Sprintf("10.%d.0.%d", p, i))
+		}
+		h.UserName = []string{"alice", "bob"}
+		h.HostName = []string{"web-01"}
+		h.Software = []string{"nginx", "openssh"}
+		for i := 0; i < benchActivity; i++ {
+			h.Activities = append(h.Activities, lib.ReportActivity{
+				ServiceName: "ssh", RemoteAddr: "198.51.100.7", Principal: "alice", Action: "login",
+			})
+		}
+		hosts[p] = h
+	}
+	return hosts
+}
+
+func BenchmarkOpponentHostMerge(b *testing.B) {
+	src := benchOpponentHosts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var h lib.ReportOpponentHost
+		for _, s := range src {
+			h.Merge(s)
+		}
+	}
+}
+
+func BenchmarkAlliedHostMerge(b *testing.B) {
+	src := benchAlliedHosts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var h lib.ReportAlliedHost
+		for _, s := range src {
+			h.Merge(s)
+		}
+	}
+}
+
+// BenchmarkMergePages compares strategies. MergeHistoryCapped bounds size of
+// merged hosts but reflection costs per field.
+func BenchmarkMergePages(b *testing.B) {
+	opponents, allied := benchOpponentHosts(), benchAlliedHosts()
+	pages := make([]*lib.ReportPage, benchPages)
+	for i := range pages {
+		page := lib.NewReportPage()
+		page.OpponentHosts = []lib.ReportOpponentHost{opponents[i]}
+		page.AlliedHosts = []lib.ReportAlliedHost{allied[i]}
+		pages[i] = &page
+	}
+
+	for _, strategy := range []string{"union", "latest_wins", "history_capped"} {
+		s, err := lib.ParseMergeStrategy(strategy)
+		require.NoError(b, err)
+
+		b.Run(strategy, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				var c lib.ReportContent
+				lib.MergePages(&c, pages, lib.MergeOption{Strategy: s})
+			}
+		})
+	}
+}
+
+func mergeTestReports() (lib.Report, lib.Report) {
+	primary := lib.Report{ID: "primary", Occurrences: 2, Labels: []string{"c2"}}
+	primary.Content = lib.ReportContent{
+		OpponentHosts: map[string]lib.ReportOpponentHost{
+			"h1": {ID: "h1", IPAddr: []string{"10.0.0.1"}},
+		},
+		SubjectUsers: map[string]lib.ReportUser{
+			"alice": {UserName: "alice"},
+		},
+	}
+	primary.Result = lib.ReportResult{Severity: lib.SevUnclassified, Reason: "Unknown host"}
+
+	secondary := lib.Report{ID: "secondary", Occurrences: 1, Labels: []string{"C2", "phishing"}}
+	secondary.Content = lib.ReportContent{
+		OpponentHosts: map[string]lib.ReportOpponentHost{
+			"h1": {ID: "h1", IPAddr: []string{"10.0.0.2"}},
+			"h2": {ID: "h2", IPAddr: []string{"10.0.0.3"}},
+		},
+		AlliedHosts: map[string]lib.ReportAlliedHost{
+			"a1": {ID: "a1", HostName: []string{"web-01"}},
+		},
+	}
+	secondary.Result = lib.ReportResult{Severity: lib.SevUrgent, Reason: "Known C2"}
+	return primary, secondary
+}
+
+func TestMergeReportsContent(t *testing.T) {
+	primary, secondary := mergeTestReports()
+	merged := lib.MergeReports(primary, secondary)
+
+	assert.Equal(t, lib.ReportID("primary"), merged.ID)
+	assert.Equal(t, []lib.ReportID{"secondary"}, merged.MergedFrom)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, merged.Content.OpponentHosts["h1"].IPAddr)
+	assert.Equal(t, []string{"10.0.0.3"}, merged.Content.OpponentHosts["h2"].IPAddr)
+	assert.Equal(t, []string{"web-01"}, merged.Content.AlliedHosts["a1"].HostName)
+	assert.Equal(t, "alice", merged.Content.SubjectUsers["alice"].UserName)
+	assert.Equal(t, []string{"c2", "phishing"}, merged.Labels)
+	assert.Equal(t, 3, merged.Occurrences)
+
+	// Originals are not modified.
+	assert.Equal(t, []string{"10.0.0.1"}, primary.Content.OpponentHosts["h1"].IPAddr)
+	assert.Equal(t, []string{"c2"}, primary.Labels)
+}
+
+func TestMergeReportsSeverity(t *testing.T) {
+	primary, secondary := mergeTestReports()
+
+	merged := lib.MergeReports(primary, secondary)
+	assert.Equal(t, lib.SevUrgent, merged.Result.Severity)
+	assert.Equal(t, "Known C2", merged.Result.Reason)
+
+	secondary.Result = lib.ReportResult{Severity: lib.SevSafe}
+	merged = lib.MergeReports(primary, secondary)
+	assert.Equal(t, lib.SevUnclassified, merged.Result.Severity)
+	assert.Equal(t, "Unknown host", merged.Result.Reason)
+
+	// Unknown severity does not win.
+	primary.Result = lib.ReportResult{}
+	merged = lib.MergeReports(primary, secondary)
+	assert.Equal(t, lib.SevSafe, merged.Result.Severity)
+}
+
+func TestMergeStoredReports(t *testing.T) {
+	orig := lib.ReportStoreBackend
+	lib.ReportStoreBackend = "memory"
+	defer func() { lib.ReportStoreBackend = orig }()
+
+	primary, secondary := mergeTestReports()
+	primary.ID, secondary.ID = lib.NewReportID(), lib.NewReportID()
+	require.NoError(t, lib.SaveReport("reports", "us-east-1", primary))
+	require.NoError(t, lib.SaveReport("reports", "us-east-1", secondary))
+
+	page := lib.NewReportPage()
+	page.Author = "inspector"
+	component := lib.NewReportComponent(secondary.ID)
+	require.NoError(t, component.SetPage(page))
+	require.NoError(t, component.Submit("report-data", "us-east-1"))
+
+	merged, err := lib.MergeStoredReports("reports", "report-data", "us-east-1", primary.ID, secondary.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{secondary.ID}, merged.MergedFrom)
+
+	stored, err := lib.LoadReport("reports", "us-east-1", primary.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lib.SevUrgent, stored.Result.Severity)
+
+	tombstone, err := lib.LoadReport("reports", "us-east-1", secondary.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lib.StatusClosed, tombstone.Status)
+	require.NotNil(t, tombstone.MergedInto)
+	assert.Equal(t, primary.ID, *tombstone.MergedInto)
+
+	// Pages of the secondary are kept for recompilation of the primary.
+	pages, err := lib.FetchReportPages("report-data", "us-east-1", primary.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "inspector", pages[0].Author)
+
+	_, err = lib.MergeStoredReports("reports", "report-data", "us-east-1", primary.ID, secondary.ID)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+	_, err = lib.MergeStoredReports("reports", "report-data", "us-east-1", primary.ID, primary.ID)
+	_, ok = err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+func TestMergePagesRemoteAddrs(t *testing.T) {
+	p1 := lib.NewReportPage()
+	p1.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1", Addrs: []lib.RemoteAddr{{IP: "198.51.100.7", Country: "RU"}, {IP: "203.0.113.9", Country: "NL"}}},
+	}
+	p2 := lib.NewReportPage()
+	p2.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1", Addrs: []lib.RemoteAddr{{IP: "203.0.113.9", ASOwner: "AS64500"}}},
+	}
+
+	var content lib.ReportContent
+	lib.MergePages(&content, []*lib.ReportPage{&p1, &p2}, lib.MergeOption{})
+
+	host := content.OpponentHosts["h1"]
+	require.Equal(t, 2, len(host.Addrs))
+	ru, _ := host.Addr("198.51.100.7")
+	nl, _ := host.Addr("203.0.113.9")
+	assert.Equal(t, lib.RemoteAddr{IP: "198.51.100.7", Country: "RU"}, ru)
+	assert.Equal(t, lib.RemoteAddr{IP: "203.0.113.9", Country: "NL", ASOwner: "AS64500"}, nl)
+	assert.Equal(t, []string{"198.51.100.7", "203.0.113.9"}, host.IPAddrs())
+}
+
+func TestMergePagesSeen(t *testing.T) {
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	p1 := lib.NewReportPage()
+	p1.OpponentHosts = []lib.ReportOpponentHost{{ID: "h1", FirstSeen: base.Add(time.Hour), LastSeen: base.Add(2 * time.Hour)}}
+	p1.AlliedHosts = []lib.ReportAlliedHost{{ID: "a1", FirstSeen: base.Add(time.Hour), LastSeen: base.Add(time.Hour)}}
+	p2 := lib.NewReportPage()
+	p2.OpponentHosts = []lib.ReportOpponentHost{{ID: "h1", FirstSeen: base, LastSeen: base.Add(time.Hour)}}
+	p2.AlliedHosts = []lib.ReportAlliedHost{{ID: "a1", FirstSeen: base.Add(2 * time.Hour), LastSeen: base.Add(3 * time.Hour)}}
+	// Unknown period does not narrow others.
+	p3 := lib.NewReportPage()
+	p3.OpponentHosts = []lib.ReportOpponentHost{{ID: "h1"}}
+	p3.AlliedHosts = []lib.ReportAlliedHost{{ID: "a1"}}
+
+	for _, strategy := range []lib.MergeStrategy{lib.MergeUnion, lib.MergeLatestWins, lib.MergeHistoryCapped} {
+		var c lib.ReportContent
+		lib.MergePages(&c, []*lib.ReportPage{&p1, &p2, &p3}, lib.MergeOption{Strategy: strategy})
+
+		assert.Equal(t, base, c.OpponentHosts["h1"].FirstSeen, strategy)
+		assert.Equal(t, base.Add(2*time.Hour), c.OpponentHosts["h1"].LastSeen, strategy)
+		assert.Equal(t, base.Add(time.Hour), c.AlliedHosts["a1"].FirstSeen, strategy)
+		assert.Equal(t, base.Add(3*time.Hour), c.AlliedHosts["a1"].LastSeen, strategy)
+	}
+
+	// Merged reports cover periods of both.
+	var primary, secondary lib.Report
+	primary.Content.OpponentHosts = map[string]lib.ReportOpponentHost{"h1": p1.OpponentHosts[0]}
+	secondary.Content.OpponentHosts = map[string]lib.ReportOpponentHost{"h1": p2.OpponentHosts[0]}
+	merged := lib.MergeReports(primary, secondary)
+	assert.Equal(t, base, merged.Content.OpponentHosts["h1"].FirstSeen)
+	assert.Equal(t, base.Add(2*time.Hour), merged.Content.OpponentHosts["h1"].LastSeen)
+}
+
+func TestPageSeenAtIngest(t *testing.T) {
+	submitted := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	activity := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	page := lib.NewReportPage()
+	page.OpponentHosts = []lib.ReportOpponentHost{
+		{ID: "h1"},
+		{ID: "h2", FirstSeen: activity},
+	}
+	page.AlliedHosts = []lib.ReportAlliedHost{
+		{ID: "a1", Activities: []lib.ReportActivity{{LastSeen: activity}, {LastSeen: activity.Add(time.Hour)}}},
+	}
+
+	component := lib.NewReportComponent("r1")
+	require.NoError(t, component.SetPage(page))
+	component.SubmittedAt = submitted
+	ingested := component.Page()
+	require.NotNil(t, ingested)
+
+	assert.Equal(t, submitted, ingested.OpponentHosts[0].FirstSeen)
+	assert.Equal(t, submitted, ingested.OpponentHosts[0].LastSeen)
+	assert.Equal(t, activity, ingested.OpponentHosts[1].FirstSeen)
+	assert.Equal(t, activity, ingested.OpponentHosts[1].LastSeen)
+	assert.Equal(t, activity, ingested.AlliedHosts[0].FirstSeen)
+	assert.Equal(t, activity.Add(time.Hour), ingested.AlliedHosts[0].LastSeen)
+}
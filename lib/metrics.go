@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/pkg/errors"
+)
+
+// MetricsNamespace is CloudWatch namespace of metrics by AlertResponder.
+var MetricsNamespace = metricsNamespace(os.Getenv("METRICS_NAMESPACE"))
+
+func metricsNamespace(name string) string {
+	if name == "" {
+		return "AlertResponder"
+	}
+	return name
+}
+
+// Metric is a data point of a metric.
+type Metric struct {
+	Name       string
+	Value      float64
+	Unit       string
+	Dimensions map[string]string
+}
+
+// MetricsEmitter sends metrics to a monitoring service.
+type MetricsEmitter interface {
+	Emit(metrics []Metric) error
+}
+
+type cloudWatchEmitter struct {
+	namespace string
+	client    cloudwatchiface.CloudWatchAPI
+}
+
+// NewCloudWatchEmitter returns MetricsEmitter that puts metrics into
+// CloudWatch of the region. A client is created if client is nil.
+func NewCloudWatchEmitter(client cloudwatchiface.CloudWatchAPI, region string) MetricsEmitter {
+	if client == nil {
+		client = cloudwatch.New(newSession(region))
+	}
+	return &cloudWatchEmitter{namespace: MetricsNamespace, client: client}
+}
+
+func (x *cloudWatchEmitter) Emit(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var data []*cloudwatch.MetricDatum
+	for _, m := range metrics {
+		datum := &cloudwatch.MetricDatum{
+			MetricName: aws.String(m.Name),
+			Value:      aws.Float64(m.Value),
+			Unit:       aws.String(m.Unit),
+			Timestamp:  aws.Time(now),
+		}
+
+		// Dimensions are sorted to keep the request deterministic.
+		var names []string
+		for name := range m.Dimensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(name),
+				Value: aws.String(m.Dimensions[name]),
+			})
+		}
+		data = append(data, datum)
+	}
+
+	_, err := x.client.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(x.namespace),
+		MetricData: data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to put metric data")
+	}
+	return nil
+}
+
+// EmitMetrics sends metrics by emitter. Nothing is done if emitter is nil, and
+// failure is only logged because metrics must not break main procedure.
+func EmitMetrics(emitter MetricsEmitter, metrics []Metric) {
+	if emitter == nil {
+		return
+	}
+	if err := emitter.Emit(metrics); err != nil {
+		Logger.WithError(err).Warn("Fail to emit metrics")
+	}
+}
@@ -0,0 +1,48 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (x *mockCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	x.inputs = append(x.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatchEmitter(t *testing.T) {
+	client := &mockCloudWatch{}
+	emitter := lib.NewCloudWatchEmitter(client, "ap-northeast-1")
+	require.NoError(t, emitter.Emit([]lib.Metric{
+		{Name: "PagesFetched", Value: 3, Unit: "Count", Dimensions: map[string]string{"Severity": "urgent", "Rule": "test"}},
+	}))
+
+	require.Equal(t, 1, len(client.inputs))
+	input := client.inputs[0]
+	assert.Equal(t, "AlertResponder", aws.StringValue(input.Namespace))
+	require.Equal(t, 1, len(input.MetricData))
+
+	datum := input.MetricData[0]
+	assert.Equal(t, "PagesFetched", aws.StringValue(datum.MetricName))
+	assert.Equal(t, 3.0, aws.Float64Value(datum.Value))
+	assert.Equal(t, "Count", aws.StringValue(datum.Unit))
+	require.Equal(t, 2, len(datum.Dimensions))
+	assert.Equal(t, "Rule", aws.StringValue(datum.Dimensions[0].Name))
+	assert.Equal(t, "urgent", aws.StringValue(datum.Dimensions[1].Value))
+}
+
+func TestEmitMetricsNilEmitter(t *testing.T) {
+	// Nothing happens without emitter.
+	lib.EmitMetrics(nil, []lib.Metric{{Name: "PagesFetched", Value: 1}})
+}
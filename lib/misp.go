@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// mispNamespace is UUIDv5 namespace of MISP events and attributes created by
+// AlertResponder.
+var mispNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/m-mizutani/AlertResponder/misp")
+
+// mispFileTemplateUUID is UUID of "file" object template of MISP.
+const mispFileTemplateUUID = "688c46fb-5edb-40a3-8273-1af7923e2215"
+
+var mispTLPs = map[string]bool{
+	"clear": true, "white": true, "green": true, "amber": true, "amber+strict": true, "red": true,
+}
+
+// MISPOptions controls contents of MISP event. Report does not have tags and
+// TLP marking, so they are given by options.
+type MISPOptions struct {
+	Tags []string
+
+	// TLP is a TLP marking of the event, e.g. "amber". "amber" is used by
+	// default.
+	TLP string
+
+	// Distribution is distribution level of the event. 0 (your organisation
+	// only) by default.
+	Distribution int
+
+	// IncludeInternal adds IP addresses, host names and user names of local
+	// hosts to the event. They are not shared by default.
+	IncludeInternal bool
+}
+
+// MISPEvent is an event of MISP REST API. Only fields used by ToMISPEvent
+// are defined.
+type MISPEvent struct {
+	UUID          string          `json:"uuid"`
+	Info          string          `json:"info"`
+	Date          string          `json:"date"`
+	ThreatLevelID string          `json:"threat_level_id"`
+	Analysis      string          `json:"analysis"`
+	Distribution  string          `json:"distribution"`
+	Published     bool            `json:"published"`
+	Attribute     []MISPAttribute `json:"Attribute"`
+	Object        []MISPObject    `json:"Object"`
+	Tag           []MISPTag       `json:"Tag"`
+}
+
+type MISPAttribute struct {
+	UUID           string `json:"uuid"`
+	Type           string `json:"type"`
+	Category       string `json:"category"`
+	Value          string `json:"value"`
+	ToIDS          bool   `json:"to_ids"`
+	Comment        string `json:"comment,omitempty"`
+	ObjectRelation string `json:"object_relation,omitempty"`
+}
+
+type MISPObject struct {
+	UUID         string          `json:"uuid"`
+	Name         string          `json:"name"`
+	MetaCategory string          `json:"meta-category"`
+	TemplateUUID string          `json:"template_uuid"`
+	Comment      string          `json:"comment,omitempty"`
+	Attribute    []MISPAttribute `json:"Attribute"`
+}
+
+type MISPTag struct {
+	Name string `json:"name"`
+}
+
+// MISPEventUUID returns UUID of MISP event of the report. It is same for
+// recompiled reports so that the event is updated.
+func MISPEventUUID(report Report) string {
+	return uuid.NewV5(mispNamespace, string(report.ID)).String()
+}
+
+// mispThreatLevel maps severity to threat_level_id: 1 (high), 2 (medium) and
+// 3 (low).
+func mispThreatLevel(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "1"
+	case SevSafe:
+		return "3"
+	default:
+		return "2"
+	}
+}
+
+// mispScanComment summarizes scan results of the malware sample.
+func mispScanComment(m ReportMalware) string {
+	var names []string
+	for _, scan := range m.Scans {
+		if scan.Positive && scan.Name != "" {
+			names = append(names, fmt.Sprintf("%s: %s", scan.Vendor, scan.Name))
+		}
+	}
+
+	comment := fmt.Sprintf("Detected by %d/%d scanners", countPositives(m), len(m.Scans))
+	if len(names) > 0 {
+		comment += " (" + strings.Join(names, ", ") + ")"
+	}
+	return comment
+}
+
+type mispBuilder struct {
+	eventUUID string
+	seen      map[string]bool
+	event     *MISPEvent
+}
+
+func (x *mispBuilder) attr(attrType, category, value string, toIDS bool, comment string) *MISPAttribute {
+	key := attrType + "|" + value
+	if value == "" || x.seen[key] {
+		return nil
+	}
+	x.seen[key] = true
+
+	return &MISPAttribute{
+		UUID:     uuid.NewV5(mispNamespace, x.eventUUID+"|"+key).String(),
+		Type:     attrType,
+		Category: category,
+		Value:    value,
+		ToIDS:    toIDS,
+		Comment:  comment,
+	}
+}
+
+func (x *mispBuilder) add(attrType, category, value string, toIDS bool, comment string) {
+	if a := x.attr(attrType, category, value, toIDS, comment); a != nil {
+		x.event.Attribute = append(x.event.Attribute, *a)
+	}
+}
+
+func (x *mispBuilder) addMalware(m ReportMalware, hostID string) {
+	a := x.attr("sha256", "Payload delivery", m.SHA256, true, mispScanComment(m))
+	if a == nil {
+		return
+	}
+	a.ObjectRelation = "sha256"
+
+	x.event.Object = append(x.event.Object, MISPObject{
+		UUID:         uuid.NewV5(mispNamespace, x.eventUUID+"|file|"+m.SHA256).String(),
+		Name:         "file",
+		MetaCategory: "file",
+		TemplateUUID: mispFileTemplateUUID,
+		Comment:      fmt.Sprintf("%s %s", m.Relation, hostID),
+		Attribute:    []MISPAttribute{*a},
+	})
+}
+
+// ToMISPEvent converts the report to a MISP event. Remote hosts and their
+// domains and URLs become attributes and malware samples detected by any
+// scanner become file objects with a summary of scan results.
+func ToMISPEvent(r Report, opts MISPOptions) ([]byte, error) {
+	tlp := strings.ToLower(opts.TLP)
+	if tlp == "" {
+		tlp = "amber"
+	}
+	if !mispTLPs[tlp] {
+		return nil, NewConfigError("Invalid TLP marking: " + opts.TLP)
+	}
+
+	analysis := "1" // ongoing
+	if r.IsClosed() {
+		analysis = "2" // completed
+	}
+
+	event := MISPEvent{
+		UUID:          MISPEventUUID(r),
+		Info:          r.OneLineSummary(),
+		Date:          r.ReceivedAt.UTC().Format("2006-01-02"),
+		ThreatLevelID: mispThreatLevel(r.Result.Severity),
+		Analysis:      analysis,
+		Distribution:  strconv.Itoa(opts.Distribution),
+		Attribute:     []MISPAttribute{},
+		Object:        []MISPObject{},
+	}
+	for _, tag := range opts.Tags {
+		event.Tag = append(event.Tag, MISPTag{Name: tag})
+	}
+	event.Tag = append(event.Tag, MISPTag{Name: "tlp:" + tlp})
+
+	b := mispBuilder{eventUUID: event.UUID, seen: map[string]bool{}, event: &event}
+
+	var ids []string
+	for id := range r.Content.OpponentHosts {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedKeys(ids) {
+		host := r.Content.OpponentHosts[id]
+		for _, addr := range host.IPAddr {
+			b.add("ip-dst", "Network activity", addr, true, strings.Join(host.ASOwner, ", "))
+		}
+		for _, d := range host.RelatedDomains {
+			b.add("domain", "Network activity", d.Name, true, "Related to "+id)
+		}
+		for _, u := range host.RelatedURLs {
+			b.add("url", "Network activity", u.URL, true, "Related to "+id)
+		}
+		for _, m := range host.RelatedMalware {
+			if countPositives(m) > 0 {
+				b.addMalware(m, id)
+			}
+		}
+	}
+
+	if opts.IncludeInternal {
+		ids = nil
+		for id := range r.Content.AlliedHosts {
+			ids = append(ids, id)
+		}
+		for _, id := range sortedKeys(ids) {
+			host := r.Content.AlliedHosts[id]
+			for _, addr := range host.IPAddr {
+				b.add("ip-src", "Network activity", addr, false, "Local host "+id)
+			}
+			for _, name := range host.HostName {
+				b.add("target-machine", "Targeting data", name, false, "Local host "+id)
+			}
+		}
+
+		for _, user := range sortUsers(r.Content.SubjectUsers) {
+			b.add("target-user", "Targeting data", user.UserName, false, "")
+		}
+	}
+
+	data, err := json.Marshal(map[string]MISPEvent{"Event": event})
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal MISP event")
+	}
+	return data, nil
+}
+
+// MISPConfig is configuration of PublishMISP.
+type MISPConfig struct {
+	// URL is base URL of MISP instance, e.g. https://misp.example.com
+	URL    string
+	APIKey string
+
+	// MinSeverity is the lowest severity of reports to be shared. All
+	// reports are shared if empty.
+	MinSeverity ReportSeverity
+
+	Options MISPOptions
+	Retry   HTTPRetry
+	Client  *http.Client
+}
+
+func mispHeader(apiKey string) http.Header {
+	h := http.Header{}
+	h.Set("Authorization", apiKey)
+	h.Set("Accept", "application/json")
+	return h
+}
+
+// PublishMISP adds the report to MISP as an event. If the event of the report
+// already exists, it is updated with the latest report.
+func PublishMISP(cfg MISPConfig, report Report) error {
+	if cfg.URL == "" || cfg.APIKey == "" {
+		return NewConfigError("MISP URL and API key are required")
+	}
+
+	if report.Result.Severity.Level() < cfg.MinSeverity.Level() {
+		Logger.WithFields(report.LogFields()).Info("Severity is lower than threshold, skip MISP")
+		return nil
+	}
+
+	raw, err := ToMISPEvent(report, cfg.Options)
+	if err != nil {
+		return err
+	}
+
+	retry := cfg.Retry
+	if retry.MaxRetry == 0 && retry.Wait == 0 {
+		retry = DefaultHTTPRetry
+	}
+	base := strings.TrimRight(cfg.URL, "/")
+	eventUUID := MISPEventUUID(report)
+
+	path := "/events/add"
+	_, err = sendHTTPRequest(cfg.Client, http.MethodGet, base+"/events/view/"+eventUUID, mispHeader(cfg.APIKey), nil, retry)
+	if err == nil {
+		path = "/events/edit/" + eventUUID
+	} else if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusNotFound {
+		return WrapCode(ErrCodePublish, err, "Fail to look up MISP event")
+	}
+
+	if _, err := postJSON(cfg.Client, base+path, mispHeader(cfg.APIKey), raw, retry); err != nil {
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusForbidden {
+			return WrapCode(ErrCodeInvalidConfig, err, "Fail to send MISP event")
+		}
+		return WrapCode(ErrCodePublish, err, "Fail to send MISP event")
+	}
+
+	Logger.WithFields(report.LogFields()).WithField("event_uuid", eventUUID).Info("Sent MISP event")
+	return nil
+}
@@ -0,0 +1,206 @@
+package lib_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var mispUUIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[1-5][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// mispCategories is allowed categories of attribute types used by exporter
+// in MISP describeTypes.
+var mispCategories = map[string][]string{
+	"ip-dst":         {"Network activity", "Payload delivery", "External analysis"},
+	"ip-src":         {"Network activity", "Payload delivery", "External analysis"},
+	"domain":         {"Network activity", "External analysis"},
+	"url":            {"Network activity", "Payload delivery", "External analysis"},
+	"sha256":         {"Payload delivery", "Artifacts dropped", "Payload installation", "External analysis"},
+	"target-machine": {"Targeting data"},
+	"target-user":    {"Targeting data"},
+}
+
+// validateMISPEvent checks shape of the event by MISP event schema and
+// returns the event.
+func validateMISPEvent(t *testing.T, data []byte) map[string]interface{} {
+	var wrapper map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &wrapper))
+	event, ok := wrapper["Event"]
+	require.True(t, ok)
+
+	for _, key := range []string{"uuid", "info", "date", "threat_level_id", "analysis", "distribution"} {
+		require.Contains(t, event, key)
+		assert.IsType(t, "", event[key], key)
+	}
+	assert.Regexp(t, mispUUIDPattern, event["uuid"])
+	assert.Regexp(t, `^\d{4}-\d{2}-\d{2}$`, event["date"])
+	assert.Contains(t, []string{"1", "2", "3", "4"}, event["threat_level_id"])
+	assert.Contains(t, []string{"0", "1", "2"}, event["analysis"])
+	assert.Contains(t, []string{"0", "1", "2", "3", "4"}, event["distribution"])
+
+	checkAttr := func(v interface{}) {
+		attr := v.(map[string]interface{})
+		assert.Regexp(t, mispUUIDPattern, attr["uuid"])
+		categories, ok := mispCategories[attr["type"].(string)]
+		require.True(t, ok, "unexpected type: %v", attr["type"])
+		assert.Contains(t, categories, attr["category"])
+		assert.NotEmpty(t, attr["value"])
+		assert.IsType(t, true, attr["to_ids"])
+	}
+	for _, v := range event["Attribute"].([]interface{}) {
+		checkAttr(v)
+	}
+	for _, v := range event["Object"].([]interface{}) {
+		obj := v.(map[string]interface{})
+		assert.Regexp(t, mispUUIDPattern, obj["uuid"])
+		assert.Regexp(t, mispUUIDPattern, obj["template_uuid"])
+		assert.NotEmpty(t, obj["name"])
+		assert.NotEmpty(t, obj["meta-category"])
+		require.NotEmpty(t, obj["Attribute"])
+		for _, a := range obj["Attribute"].([]interface{}) {
+			checkAttr(a)
+			assert.NotEmpty(t, a.(map[string]interface{})["object_relation"])
+		}
+	}
+	for _, v := range event["Tag"].([]interface{}) {
+		assert.NotEmpty(t, v.(map[string]interface{})["name"])
+	}
+
+	return event
+}
+
+func mispAttrTypes(event map[string]interface{}) []string {
+	var types []string
+	for _, v := range event["Attribute"].([]interface{}) {
+		types = append(types, v.(map[string]interface{})["type"].(string))
+	}
+	return types
+}
+
+func TestToMISPEventGolden(t *testing.T) {
+	report := loadFixtureReport(t)
+	data, err := lib.ToMISPEvent(report, lib.MISPOptions{
+		Tags:            []string{"partner-share"},
+		TLP:             "green",
+		Distribution:    1,
+		IncludeInternal: true,
+	})
+	require.NoError(t, err)
+	validateMISPEvent(t, data)
+
+	var buf bytes.Buffer
+	require.NoError(t, json.Indent(&buf, data, "", "  "))
+	assertGolden(t, "misp_event.json", buf.String())
+}
+
+func TestToMISPEventExcludeInternal(t *testing.T) {
+	report := loadFixtureReport(t)
+	data, err := lib.ToMISPEvent(report, lib.MISPOptions{})
+	require.NoError(t, err)
+	event := validateMISPEvent(t, data)
+
+	assert.Equal(t, []string{"ip-dst", "domain", "url", "ip-dst"}, mispAttrTypes(event))
+	assert.NotContains(t, string(data), "10.1.2.3")
+	assert.NotContains(t, string(data), "alice")
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "tlp:amber"}}, event["Tag"])
+	assert.Equal(t, "0", event["distribution"])
+}
+
+func TestToMISPEventInvalidTLP(t *testing.T) {
+	report := loadFixtureReport(t)
+	_, err := lib.ToMISPEvent(report, lib.MISPOptions{TLP: "purple"})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
+
+// mockMISP is a minimum MISP REST API server for tests.
+type mockMISP struct {
+	events   map[string][]byte
+	requests []string
+	srv      *httptest.Server
+}
+
+func newMockMISP(t *testing.T) *mockMISP {
+	x := &mockMISP{events: map[string][]byte{}}
+	x.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.requests = append(x.requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") != "misp-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/events/view/"):
+			if _, ok := x.events[strings.TrimPrefix(r.URL.Path, "/events/view/")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{}`))
+
+		case r.Method == http.MethodPost:
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			event := validateMISPEvent(t, body)
+			x.events[event["uuid"].(string)] = body
+			w.Write(body)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return x
+}
+
+func TestPublishMISP(t *testing.T) {
+	misp := newMockMISP(t)
+	defer misp.srv.Close()
+
+	cfg := lib.MISPConfig{URL: misp.srv.URL + "/", APIKey: "misp-key"}
+	report := loadFixtureReport(t)
+	eventUUID := lib.MISPEventUUID(report)
+
+	require.NoError(t, lib.PublishMISP(cfg, report))
+	require.NoError(t, lib.PublishMISP(cfg, report))
+	assert.Equal(t, []string{
+		"GET /events/view/" + eventUUID,
+		"POST /events/add",
+		"GET /events/view/" + eventUUID,
+		"POST /events/edit/" + eventUUID,
+	}, misp.requests)
+	assert.Equal(t, 1, len(misp.events))
+}
+
+func TestPublishMISPThreshold(t *testing.T) {
+	misp := newMockMISP(t)
+	defer misp.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevUnclassified
+	cfg := lib.MISPConfig{URL: misp.srv.URL, APIKey: "misp-key", MinSeverity: lib.SevUrgent}
+	require.NoError(t, lib.PublishMISP(cfg, report))
+	assert.Empty(t, misp.requests)
+}
+
+func TestPublishMISPInvalidKey(t *testing.T) {
+	misp := newMockMISP(t)
+	defer misp.srv.Close()
+
+	cfg := lib.MISPConfig{URL: misp.srv.URL, APIKey: "wrong"}
+	err := lib.PublishMISP(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+
+	// No API key
+	err = lib.PublishMISP(lib.MISPConfig{URL: misp.srv.URL}, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// Destinations of notification templates.
+const (
+	NotifySNS   = "sns"
+	NotifySlack = "slack"
+	NotifyEmail = "email"
+	NotifyTeams = "teams"
+)
+
+// NotificationTemplateSource is text of title and body templates of a
+// destination. Body of email is html/template and others are text/template.
+type NotificationTemplateSource struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// DefaultNotificationTemplates produce the same messages as publishers
+// without custom templates.
+//
+//	sns    title is subject of email subscriptions and body is their message.
+//	       Empty means JSON of the report without subject.
+//	slack  title is header and body is the summary section.
+//	email  title is subject and body is HTML part.
+//	teams  title is title of the card and body is text below severity.
+var DefaultNotificationTemplates = map[string]NotificationTemplateSource{
+	NotifySNS: {},
+	NotifySlack: {
+		Title: `[{{.Severity}}] {{with .Report.EscalationMarker}}{{.}}: {{end}}{{.T "report"}} {{.Report.ID}}`,
+		Body:  "*{{.Title}}*\n*{{.T \"rule\"}}*: {{.Report.Alert.Rule}}\n*{{.T \"key\"}}*: {{.Report.Alert.Key}}\n*{{.T \"status\"}}*: {{.Report.Status}}",
+	},
+	NotifyEmail: {
+		Title: `[{{.Severity}}] {{.Report.Alert.Rule}}: {{.Report.Alert.Key}}`,
+		Body:  defaultEmailTemplate,
+	},
+	NotifyTeams: {
+		Title: `{{.Title}}`,
+	},
+}
+
+// NotificationConfig is configuration of notification templates. Templates
+// override DefaultNotificationTemplates by destination. Variables are static
+// values available by function "var", e.g. {{var "account_id"}}.
+type NotificationConfig struct {
+	Variables map[string]string                     `json:"variables"`
+	Templates map[string]NotificationTemplateSource `json:"templates"`
+}
+
+// NotificationData is dot of notification templates. Severity is translated
+// into Locale, and messages of the locale are available by method T, e.g.
+// {{.T "remote_hosts"}}.
+type NotificationData struct {
+	Locale      string
+	Report      Report
+	Summary     string
+	Title       string
+	Subject     string
+	Severity    string
+	Color       string
+	ReportURL   string
+	Observables []Observable
+	RemoteHosts []ReportOpponentHost
+	LocalHosts  []ReportAlliedHost
+	Timeline    []TimelineEvent
+}
+
+// NewNotificationData returns data of the report for templates in
+// DefaultLocale. reportURL is a template of link to the full report. Subject
+// is set by the title of the notification.
+func NewNotificationData(report Report, reportURL string) NotificationData {
+	return newNotificationData(report, reportURL, DefaultLocale)
+}
+
+func newNotificationData(report Report, reportURL, locale string) NotificationData {
+	data := NotificationData{
+		Locale:      locale,
+		Report:      report,
+		Summary:     report.OneLineSummary(),
+		Title:       report.Alert.Title(),
+		Severity:    localizedSeverity(report, locale),
+		Color:       severityColor(report.Result.Severity),
+		ReportURL:   reportLink(reportURL, report),
+		Observables: ReportObservables(report),
+		Timeline:    report.Timeline(),
+	}
+
+	var remoteIDs, localIDs []string
+	for id := range report.Content.OpponentHosts {
+		remoteIDs = append(remoteIDs, id)
+	}
+	for _, id := range sortedKeys(remoteIDs) {
+		data.RemoteHosts = append(data.RemoteHosts, report.Content.OpponentHosts[id])
+	}
+	for id := range report.Content.AlliedHosts {
+		localIDs = append(localIDs, id)
+	}
+	for _, id := range sortedKeys(localIDs) {
+		data.LocalHosts = append(data.LocalHosts, report.Content.AlliedHosts[id])
+	}
+
+	return data
+}
+
+// T returns message of the key in Locale.
+func (x NotificationData) T(key string) string {
+	return Translate(x.Locale, key)
+}
+
+// NotificationText is a rendered notification.
+type NotificationText struct {
+	Title string
+	Body  string
+}
+
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type notificationTemplate struct {
+	title templateExecutor
+	body  templateExecutor
+}
+
+// NotificationTemplates are parsed templates of all destinations. nil
+// renders DefaultNotificationTemplates.
+type NotificationTemplates struct {
+	templates map[string]*notificationTemplate
+}
+
+// missingVariable is rendered in place of a variable that is not configured.
+func missingVariable(name string) string {
+	return fmt.Sprintf("<no value: %s>", name)
+}
+
+func parseNotificationTemplate(dest string, src NotificationTemplateSource, vars map[string]string) (*notificationTemplate, error) {
+	varFunc := func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return missingVariable(name)
+	}
+
+	title, err := template.New(dest + ".title").Funcs(reportFuncs).
+		Funcs(template.FuncMap{"var": varFunc}).Parse(src.Title)
+	if err != nil {
+		return nil, err
+	}
+
+	var body templateExecutor
+	if dest == NotifyEmail {
+		body, err = htmltemplate.New(dest + ".body").Funcs(emailFuncs).
+			Funcs(htmltemplate.FuncMap{"var": varFunc}).Parse(src.Body)
+	} else {
+		body, err = template.New(dest + ".body").Funcs(reportFuncs).
+			Funcs(template.FuncMap{"var": varFunc}).Parse(src.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &notificationTemplate{title: title, body: body}, nil
+}
+
+func (x *notificationTemplate) render(data NotificationData) (NotificationText, error) {
+	var title bytes.Buffer
+	if err := x.title.Execute(&title, &data); err != nil {
+		return NotificationText{}, err
+	}
+	// Title is a subject or a header and must be one line.
+	data.Subject = strings.Join(strings.Fields(title.String()), " ")
+
+	var body bytes.Buffer
+	if err := x.body.Execute(&body, &data); err != nil {
+		return NotificationText{}, err
+	}
+	return NotificationText{Title: data.Subject, Body: body.String()}, nil
+}
+
+var defaultNotificationTemplates = func() map[string]*notificationTemplate {
+	templates := map[string]*notificationTemplate{}
+	for dest, src := range DefaultNotificationTemplates {
+		tmpl, err := parseNotificationTemplate(dest, src, nil)
+		if err != nil {
+			panic(err)
+		}
+		templates[dest] = tmpl
+	}
+	return templates
+}()
+
+// ParseNotificationTemplates parses NotificationConfig in JSON and validates
+// the templates by rendering a sample report, so that a broken template fails
+// at cold start rather than on publishing. Empty raw means default templates.
+func ParseNotificationTemplates(raw string) (*NotificationTemplates, error) {
+	templates := &NotificationTemplates{templates: map[string]*notificationTemplate{}}
+	if raw == "" {
+		return templates, nil
+	}
+
+	var cfg NotificationConfig
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		return nil, NewConfigError(fmt.Sprintf("Invalid notification templates: %v", err))
+	}
+
+	sample := NewNotificationData(sampleReport(), "https://example.com/{report_id}")
+	for dest, src := range cfg.Templates {
+		if _, ok := DefaultNotificationTemplates[dest]; !ok {
+			return nil, NewConfigError("Unknown destination of notification template: " + dest)
+		}
+
+		tmpl, err := parseNotificationTemplate(dest, src, cfg.Variables)
+		if err != nil {
+			return nil, NewConfigError(fmt.Sprintf("Fail to parse notification template of %s: %v", dest, err))
+		}
+		if _, err := tmpl.render(sample); err != nil {
+			return nil, NewConfigError(fmt.Sprintf("Invalid notification template of %s: %v", dest, err))
+		}
+		templates.templates[dest] = tmpl
+	}
+
+	return templates, nil
+}
+
+// Render renders the notification of the report for the destination in the
+// locale. Empty locale means DefaultLocale. If a custom template fails, the
+// default template is used instead of failing the publish.
+func (x *NotificationTemplates) Render(dest string, report Report, reportURL, locale string) NotificationText {
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	data := newNotificationData(report, reportURL, locale)
+
+	if x != nil {
+		if tmpl, ok := x.templates[dest]; ok {
+			text, err := tmpl.render(data)
+			if err == nil {
+				return text
+			}
+			Logger.WithFields(report.LogFields()).WithField("destination", dest).WithError(err).
+				Warn("Fail to render notification template, fallback to default")
+		}
+	}
+
+	tmpl, ok := defaultNotificationTemplates[dest]
+	if !ok {
+		return NotificationText{}
+	}
+	text, err := tmpl.render(data)
+	if err != nil {
+		Logger.WithFields(report.LogFields()).WithField("destination", dest).WithError(err).
+			Error("Fail to render default notification template")
+	}
+	return text
+}
@@ -0,0 +1,157 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseNotificationTemplates(t *testing.T, cfg lib.NotificationConfig) *lib.NotificationTemplates {
+	raw, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	templates, err := lib.ParseNotificationTemplates(string(raw))
+	require.NoError(t, err)
+	return templates
+}
+
+var testNotificationVariables = map[string]string{
+	"team":    "SOC",
+	"runbook": "https://wiki.example.com/runbook",
+}
+
+func TestSlackMessageCustomTemplateGolden(t *testing.T) {
+	templates := parseNotificationTemplates(t, lib.NotificationConfig{
+		Variables: testNotificationVariables,
+		Templates: map[string]lib.NotificationTemplateSource{
+			lib.NotifySlack: {
+				Title: `{{var "team"}} {{.Severity}}: {{.Report.Alert.Rule}} in {{var "account_id"}}`,
+				Body:  "{{.Summary}}\nRunbook: {{var \"runbook\"}}{{range .Observables}}\n• {{.Type}} `{{.Value}}`{{end}}",
+			},
+		},
+	})
+
+	cfg := lib.SlackConfig{ReportURL: "https://reports.example.com/{report_id}.json", Templates: templates}
+	raw, err := json.MarshalIndent(lib.NewSlackMessage(cfg, loadFullReport(t)), "", "  ")
+	require.NoError(t, err)
+	assertGolden(t, "slack_custom.json", string(raw)+"\n")
+}
+
+func TestEmailCustomTemplateGolden(t *testing.T) {
+	templates := parseNotificationTemplates(t, lib.NotificationConfig{
+		Variables: testNotificationVariables,
+		Templates: map[string]lib.NotificationTemplateSource{
+			lib.NotifyEmail: {
+				Title: `[{{var "team"}}] {{.Summary}}`,
+				Body: `<h1>{{.Subject}}</h1>
+<p>Account: {{var "account_id"}}</p>
+<ul>
+{{- range .Observables}}
+<li>{{.Type}}: {{.Value}}</li>
+{{- end}}
+</ul>
+{{- if .ReportURL}}
+<p><a href="{{.ReportURL}}">Open report</a></p>
+{{- end}}
+`,
+			},
+		},
+	})
+
+	text := templates.Render(lib.NotifyEmail, loadFixtureReport(t), "https://reports.example.com/{report_id}.json", "")
+	assertGolden(t, "email_custom.txt", "Subject: "+text.Title+"\n\n"+text.Body)
+}
+
+func TestDefaultNotificationTemplates(t *testing.T) {
+	report := loadFixtureReport(t)
+	var templates *lib.NotificationTemplates
+
+	email := templates.Render(lib.NotifyEmail, report, "", "")
+	assert.Equal(t, lib.EmailSubject(report), email.Title)
+	html, err := lib.RenderEmailHTML(nil, report, "")
+	require.NoError(t, err)
+	assert.Equal(t, html, email.Body)
+
+	// Empty config is same as defaults.
+	parsed, err := lib.ParseNotificationTemplates("")
+	require.NoError(t, err)
+	assert.Equal(t, email, parsed.Render(lib.NotifyEmail, report, "", ""))
+
+	assert.Equal(t, lib.NotificationText{}, templates.Render(lib.NotifySNS, report, "", ""))
+	assert.Equal(t, report.Alert.Title(), templates.Render(lib.NotifyTeams, report, "", "").Title)
+}
+
+func TestParseNotificationTemplatesInvalid(t *testing.T) {
+	for name, raw := range map[string]string{
+		"json":        `{"templates": `,
+		"destination": `{"templates": {"fax": {"title": "{{.Title}}"}}}`,
+		"syntax":      `{"templates": {"slack": {"title": "{{.Title"}}}`,
+		"function":    `{"templates": {"slack": {"body": "{{unknown .Title}}"}}}`,
+		"field":       `{"templates": {"teams": {"title": "{{.Report.NoSuchField}}"}}}`,
+	} {
+		_, err := lib.ParseNotificationTemplates(raw)
+		require.Error(t, err, name)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, name)
+	}
+}
+
+func TestNotificationTemplateMissingVariable(t *testing.T) {
+	templates := parseNotificationTemplates(t, lib.NotificationConfig{
+		Templates: map[string]lib.NotificationTemplateSource{
+			lib.NotifyTeams: {Title: `{{var "account_id"}} {{.Title}}`, Body: `See {{var "runbook"}}`},
+		},
+	})
+
+	report := loadFixtureReport(t)
+	msg := lib.NewTeamsMessage(lib.TeamsConfig{Templates: templates}, report)
+	body := msg.Attachments[0].Content.Body
+	require.Equal(t, 4, len(body))
+	assert.Equal(t, "<no value: account_id> "+report.Alert.Title(), body[0].(lib.AdaptiveTextBlock).Text)
+	assert.Equal(t, "See <no value: runbook>", body[2].(lib.AdaptiveTextBlock).Text)
+}
+
+func TestPublishReportNotificationTemplate(t *testing.T) {
+	client := &mockSNS{}
+	lib.SNSClient = client
+	defer func() { lib.SNSClient = nil }()
+
+	templates := parseNotificationTemplates(t, lib.NotificationConfig{
+		Templates: map[string]lib.NotificationTemplateSource{
+			lib.NotifySNS: {Title: "{{.Summary}} ✓ {{.Summary}}", Body: "Report {{.Report.ID}}: {{.ReportURL}}"},
+		},
+	})
+	report := loadFixtureReport(t)
+	cfg := lib.ReportPublishConfig{
+		TopicArn:  "arn:aws:sns:ap-northeast-1:1234567890:reports",
+		Region:    "ap-northeast-1",
+		Templates: templates,
+		ReportURL: "https://reports.example.com/{report_id}",
+	}
+	require.NoError(t, lib.PublishReport(cfg, report))
+
+	// Default templates publish JSON without subject.
+	cfg.Templates = nil
+	require.NoError(t, lib.PublishReport(cfg, report))
+
+	require.Equal(t, 2, len(client.inputs))
+	input := client.inputs[0]
+	assert.Equal(t, "json", aws.StringValue(input.MessageStructure))
+	// Subject is ASCII within 100 characters.
+	assert.Equal(t, 100, len(aws.StringValue(input.Subject)))
+	assert.Contains(t, aws.StringValue(input.Subject), report.OneLineSummary()+" ? ")
+
+	var structured map[string]string
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(input.Message)), &structured))
+	assert.Equal(t, "Report "+string(report.ID)+": https://reports.example.com/"+string(report.ID), structured["email"])
+	var published lib.Report
+	require.NoError(t, json.Unmarshal([]byte(structured["default"]), &published))
+	assert.Equal(t, report.ID, published.ID)
+
+	assert.Nil(t, client.inputs[1].Subject)
+	assert.Nil(t, client.inputs[1].MessageStructure)
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(client.inputs[1].Message)), &published))
+}
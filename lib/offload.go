@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+var (
+	// PageBucket is S3 bucket to store pages larger than PageOffloadSize.
+	// All pages are stored in the report data table if it is empty. Objects
+	// are not deleted with components, so expire them by lifecycle rule of
+	// the bucket.
+	PageBucket = os.Getenv("PAGE_BUCKET")
+
+	// PageOffloadSize is threshold of serialized page in bytes to store the
+	// page in PageBucket instead of the report data table.
+	PageOffloadSize = envInt("PAGE_OFFLOAD_SIZE", 64*1024)
+)
+
+// PageS3 is S3 client for PageBucket. A client of AWS_REGION is created if
+// nil.
+var PageS3 s3iface.S3API
+
+func pageS3() s3iface.S3API {
+	if PageS3 != nil {
+		return PageS3
+	}
+	return s3.New(newSession(os.Getenv("AWS_REGION")))
+}
+
+// PageKey returns S3 key of the offloaded page.
+func PageKey(reportID ReportID, dataID string) string {
+	return fmt.Sprintf("pages/%s/%s.json", reportID, dataID)
+}
+
+// offloadData puts serialized page to the bucket and keeps only the pointer
+// in the component.
+func (x *ReportComponent) offloadData(client s3iface.S3API, bucket string, data []byte) error {
+	key := PageKey(x.ReportID, x.DataID)
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return WrapCode(ErrCodeStorePut, err, fmt.Sprintf("Fail to put page to s3://%s/%s", bucket, key))
+	}
+
+	x.Data = nil
+	x.DataRef = fmt.Sprintf("s3://%s/%s", bucket, key)
+	return nil
+}
+
+// IsOffloaded returns true if data of the component is stored in S3.
+func (x *ReportComponent) IsOffloaded() bool {
+	return x.DataRef != ""
+}
+
+// LoadData fetches data of an offloaded component from S3. Nothing is done if
+// the data is already available.
+func (x *ReportComponent) LoadData() error {
+	if len(x.Data) > 0 || !x.IsOffloaded() {
+		return nil
+	}
+
+	bucket, key, ok := splitS3URL(x.DataRef)
+	if !ok {
+		return errors.New("Invalid S3 URL of page: " + x.DataRef)
+	}
+
+	resp, err := pageS3().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return WrapStoreError(ErrCodeStoreGet, err, "Fail to get page from "+x.DataRef)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read page from "+x.DataRef)
+	}
+	x.Data = data
+	return nil
+}
+
+// deleteData deletes the offloaded data of a component that is not stored,
+// e.g. rejected by Submit. Nothing is done if the data is not offloaded.
+func (x *ReportComponent) deleteData() error {
+	if !x.IsOffloaded() {
+		return nil
+	}
+
+	bucket, key, ok := splitS3URL(x.DataRef)
+	if !ok {
+		return errors.New("Invalid S3 URL of page: " + x.DataRef)
+	}
+
+	_, err := pageS3().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, "Fail to delete page "+x.DataRef)
+	}
+	return nil
+}
+
+// splitS3URL returns bucket and key of s3://bucket/key.
+func splitS3URL(url string) (string, string, bool) {
+	path := strings.TrimPrefix(url, "s3://")
+	parts := strings.SplitN(path, "/", 2)
+	if path == url || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
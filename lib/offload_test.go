@@ -0,0 +1,105 @@
+package lib_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func offloadFixture(t *testing.T, threshold int) (*mockS3, func()) {
+	client := &mockS3{}
+	origBucket, origSize := lib.PageBucket, lib.PageOffloadSize
+	lib.PageS3 = client
+	lib.PageBucket = "pages-bucket"
+	lib.PageOffloadSize = threshold
+	return client, func() {
+		lib.PageS3 = nil
+		lib.PageBucket, lib.PageOffloadSize = origBucket, origSize
+	}
+}
+
+func largePage(reportID lib.ReportID, hosts int) lib.ReportPage {
+	page := lib.NewReportPage()
+	page.ReportID = reportID
+	page.Author = "scanner"
+	for i := 0; i < hosts; i++ {
+		addr := fmt.Sprintf("198.51.100.%d", i)
+		page.OpponentHosts = append(page.OpponentHosts, lib.ReportOpponentHost{ID: addr, IPAddr: []string{addr}})
+	}
+	return page
+}
+
+func TestSetPageInline(t *testing.T) {
+	client, restore := offloadFixture(t, 1024)
+	defer restore()
+
+	component := lib.NewReportComponent("r1")
+	require.NoError(t, component.SetPage(largePage("r1", 1)))
+	assert.False(t, component.IsOffloaded())
+	assert.NotEmpty(t, component.Data)
+	assert.Equal(t, 0, len(client.puts))
+
+	store := lib.NewMemoryReportStore()
+	require.NoError(t, store.Submit(component))
+	pages, err := store.FetchPages("r1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "198.51.100.0", pages[0].OpponentHosts[0].ID)
+}
+
+func TestSetPageOffloaded(t *testing.T) {
+	client, restore := offloadFixture(t, 1024)
+	defer restore()
+	origMax := lib.MaxPageSize
+	lib.MaxPageSize = 2048
+	defer func() { lib.MaxPageSize = origMax }()
+
+	// Offloaded page is not limited by MaxPageSize.
+	page := largePage("r1", 100)
+	component := lib.NewReportComponent("r1")
+	require.NoError(t, component.SetPage(page))
+	assert.True(t, component.IsOffloaded())
+	assert.Empty(t, component.Data)
+	assert.Equal(t, "s3://pages-bucket/"+lib.PageKey("r1", component.DataID), component.DataRef)
+
+	require.Equal(t, 1, len(client.puts))
+	stored := client.objects["pages-bucket/"+lib.PageKey("r1", component.DataID)]
+	assert.True(t, len(stored) > 2048)
+	assert.True(t, strings.Contains(stored, "198.51.100.99"))
+
+	store := lib.NewMemoryReportStore()
+	require.NoError(t, store.Submit(component))
+	submitPage(t, store, "r1", "inline")
+
+	pages, err := store.FetchPages("r1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pages))
+	assert.Equal(t, "scanner", pages[0].Author)
+	require.Equal(t, 100, len(pages[0].OpponentHosts))
+	assert.Equal(t, page.OpponentHosts[99].ID, pages[0].OpponentHosts[99].ID)
+	assert.Equal(t, "inline", pages[1].Author)
+
+	// Page resolves the pointer as well.
+	fetched := lib.ReportComponent{ReportID: "r1", DataID: component.DataID, DataRef: component.DataRef}
+	require.NotNil(t, fetched.Page())
+	assert.Equal(t, 100, len(fetched.Page().OpponentHosts))
+}
+
+func TestFetchPagesInvalidPageRef(t *testing.T) {
+	_, restore := offloadFixture(t, 1024)
+	defer restore()
+
+	table := lib.NewMemoryReportTable()
+	require.NoError(t, table.PutComponent(&lib.ReportComponent{ReportID: "r1", DataID: "d1", DataRef: "pages-bucket/d1.json"}))
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable { return table }
+	defer func() { lib.OpenReportTable = orig }()
+
+	_, err := lib.OpenReportStore("us-east-1", "", "data").FetchPages("r1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid S3 URL of page")
+}
@@ -0,0 +1,451 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/pkg/errors"
+)
+
+// OpenSearchConfig is configuration of OpenSearch publisher. Requests are
+// signed by SigV4 with Credentials (or credentials of Lambda function if nil)
+// for Amazon OpenSearch Service unless Username is set for basic auth.
+type OpenSearchConfig struct {
+	// Endpoint is URL of the domain, e.g. https://search-xxx.us-east-1.es.amazonaws.com
+	Endpoint string
+	Index    string
+	Region   string
+
+	Username string
+	Password string
+
+	Credentials *credentials.Credentials
+
+	// Tags are added to all documents.
+	Tags []string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+// DefaultOpenSearchIndex is used if Index is not configured.
+const DefaultOpenSearchIndex = "alert-responder-reports"
+
+// OpenSearchObservable is an indicator in the report, e.g. IP address,
+// domain, URL or hash.
+type OpenSearchObservable struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	HostID string `json:"host_id"`
+}
+
+type OpenSearchRemoteHost struct {
+	ID      string   `json:"id"`
+	IPAddr  []string `json:"ipaddr"`
+	Country []string `json:"country"`
+	ASOwner []string `json:"as_owner"`
+}
+
+type OpenSearchLocalHost struct {
+	ID       string   `json:"id"`
+	IPAddr   []string `json:"ipaddr"`
+	HostName []string `json:"hostname"`
+	UserName []string `json:"username"`
+	OS       []string `json:"os"`
+}
+
+// OpenSearchDocument is a flattened report to be indexed.
+type OpenSearchDocument struct {
+	ReportID      ReportID  `json:"report_id"`
+	Severity      string    `json:"severity"`
+	Status        string    `json:"status"`
+	Rule          string    `json:"rule"`
+	Key           string    `json:"key"`
+	AlertName     string    `json:"alert_name"`
+	Description   string    `json:"description"`
+	AccountID     string    `json:"account_id,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Reason        string    `json:"reason"`
+	Summary       string    `json:"summary"`
+	Tags          []string  `json:"tags"`
+	Labels        []string  `json:"labels"`
+	ReceivedAt    time.Time `json:"received_at"`
+	IndexedAt     time.Time `json:"indexed_at"`
+
+	RemoteHosts []OpenSearchRemoteHost `json:"remote_hosts"`
+	LocalHosts  []OpenSearchLocalHost  `json:"local_hosts"`
+	Users       []string               `json:"users"`
+	Observables []OpenSearchObservable `json:"observables"`
+
+	Warnings []string `json:"warnings"`
+	Comments []string `json:"comments"`
+	Text     string   `json:"text,omitempty"`
+}
+
+// openSearchMapping is mapping of the index. Identifiers are keyword for
+// exact match and aggregation, and descriptive texts are analyzed for full
+// text search. Hosts and observables are nested to query pairs of fields.
+const openSearchMapping = `{
+  "mappings": {
+    "properties": {
+      "report_id": {"type": "keyword"},
+      "severity": {"type": "keyword"},
+      "status": {"type": "keyword"},
+      "rule": {"type": "keyword"},
+      "key": {"type": "keyword"},
+      "alert_name": {"type": "text", "fields": {"raw": {"type": "keyword"}}},
+      "description": {"type": "text"},
+      "account_id": {"type": "keyword"},
+      "correlation_id": {"type": "keyword"},
+      "reason": {"type": "text"},
+      "summary": {"type": "text"},
+      "tags": {"type": "keyword"},
+      "labels": {"type": "keyword"},
+      "received_at": {"type": "date"},
+      "indexed_at": {"type": "date"},
+      "remote_hosts": {
+        "type": "nested",
+        "properties": {
+          "id": {"type": "keyword"},
+          "ipaddr": {"type": "keyword"},
+          "country": {"type": "keyword"},
+          "as_owner": {"type": "keyword"}
+        }
+      },
+      "local_hosts": {
+        "type": "nested",
+        "properties": {
+          "id": {"type": "keyword"},
+          "ipaddr": {"type": "keyword"},
+          "hostname": {"type": "keyword"},
+          "username": {"type": "keyword"},
+          "os": {"type": "keyword"}
+        }
+      },
+      "users": {"type": "keyword"},
+      "observables": {
+        "type": "nested",
+        "properties": {
+          "type": {"type": "keyword"},
+          "value": {"type": "keyword"},
+          "host_id": {"type": "keyword"}
+        }
+      },
+      "warnings": {"type": "text"},
+      "comments": {"type": "text"},
+      "text": {"type": "text"}
+    }
+  }
+}`
+
+// NewOpenSearchDocument flattens the report. Arrays are empty instead of null
+// and sorted to index same document for same report.
+func NewOpenSearchDocument(report Report, tags []string, now time.Time) OpenSearchDocument {
+	doc := OpenSearchDocument{
+		ReportID:      report.ID,
+		Severity:      string(report.Result.Severity),
+		Status:        string(report.Status),
+		Rule:          report.Alert.Rule,
+		Key:           report.Alert.Key,
+		AlertName:     report.Alert.Name,
+		Description:   report.Alert.Description,
+		AccountID:     report.AccountID,
+		CorrelationID: report.CorrelationID,
+		Reason:        report.Result.Reason,
+		Summary:       report.OneLineSummary(),
+		Tags:          append([]string{}, tags...),
+		Labels:        uniqueStrings(report.Labels),
+		ReceivedAt:    report.ReceivedAt.UTC(),
+		IndexedAt:     now.UTC(),
+		RemoteHosts:   []OpenSearchRemoteHost{},
+		LocalHosts:    []OpenSearchLocalHost{},
+		Users:         []string{},
+		Observables:   []OpenSearchObservable{},
+		Warnings:      append([]string{}, report.Warnings...),
+		Comments:      []string{},
+		Text:          report.Text,
+	}
+	if doc.Severity == "" {
+		doc.Severity = string(SevUnclassified)
+	}
+
+	seen := map[string]bool{}
+	observe := func(obsType, value, hostID string) {
+		key := obsType + "|" + value
+		if value != "" && !seen[key] {
+			seen[key] = true
+			doc.Observables = append(doc.Observables, OpenSearchObservable{Type: obsType, Value: value, HostID: hostID})
+		}
+	}
+
+	var ids []string
+	for id := range report.Content.OpponentHosts {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedKeys(ids) {
+		host := report.Content.OpponentHosts[id]
+		doc.RemoteHosts = append(doc.RemoteHosts, OpenSearchRemoteHost{
+			ID:      id,
+			IPAddr:  uniqueStrings(host.IPAddr),
+			Country: uniqueStrings(host.Country),
+			ASOwner: uniqueStrings(host.ASOwner),
+		})
+
+		for _, addr := range host.IPAddr {
+			observe("ipaddr", addr, id)
+		}
+		for _, d := range host.RelatedDomains {
+			observe("domain", d.Name, id)
+		}
+		for _, u := range host.RelatedURLs {
+			observe("url", u.URL, id)
+		}
+		for _, m := range host.RelatedMalware {
+			observe("sha256", m.SHA256, id)
+		}
+	}
+
+	ids = nil
+	for id := range report.Content.AlliedHosts {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedKeys(ids) {
+		host := report.Content.AlliedHosts[id]
+		doc.LocalHosts = append(doc.LocalHosts, OpenSearchLocalHost{
+			ID:       id,
+			IPAddr:   uniqueStrings(host.IPAddr),
+			HostName: uniqueStrings(host.HostName),
+			UserName: uniqueStrings(host.UserName),
+			OS:       uniqueStrings(host.OS),
+		})
+	}
+
+	for _, user := range sortUsers(report.Content.SubjectUsers) {
+		doc.Users = append(doc.Users, user.UserName)
+	}
+	for _, c := range report.Comments {
+		doc.Comments = append(doc.Comments, c.Text)
+	}
+
+	return doc
+}
+
+// uniqueStrings returns sorted and deduplicated values. Empty slice is
+// returned for nil.
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return sortedKeys(res)
+}
+
+type openSearchClient struct {
+	cfg    OpenSearchConfig
+	signer *v4.Signer
+}
+
+// openSearchIndices has indices that are already created or confirmed in
+// this process.
+var openSearchIndices = struct {
+	sync.Mutex
+	ready map[string]bool
+}{ready: map[string]bool{}}
+
+func newOpenSearchClient(cfg OpenSearchConfig) (*openSearchClient, error) {
+	if cfg.Endpoint == "" {
+		return nil, NewConfigError("OpenSearch endpoint is not configured")
+	}
+	if cfg.Index == "" {
+		cfg.Index = DefaultOpenSearchIndex
+	}
+	if cfg.Retry.MaxRetry == 0 && cfg.Retry.Wait == 0 {
+		cfg.Retry = DefaultHTTPRetry
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+
+	client := &openSearchClient{cfg: cfg}
+	if cfg.Username == "" {
+		if cfg.Region == "" {
+			return nil, NewConfigError("Region is required to sign OpenSearch requests")
+		}
+		creds := cfg.Credentials
+		if creds == nil {
+			creds = newSession(cfg.Region).Config.Credentials
+		}
+		client.signer = v4.NewSigner(creds)
+	}
+	return client, nil
+}
+
+func (x *openSearchClient) sign(req *http.Request, body []byte) error {
+	if x.signer == nil {
+		req.SetBasicAuth(x.cfg.Username, x.cfg.Password)
+		return nil
+	}
+	_, err := x.signer.Sign(req, bytes.NewReader(body), "es", x.cfg.Region, time.Now())
+	return err
+}
+
+func (x *openSearchClient) request(method, path, contentType string, body []byte) ([]byte, error) {
+	h := http.Header{}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	resp, err := sendSignedHTTPRequest(x.cfg.Client, method, x.cfg.Endpoint+path, h, body, x.cfg.Retry, x.sign)
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok && (httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden) {
+			return nil, WrapCode(ErrCodeInvalidConfig, err, fmt.Sprintf("Fail to %s %s", method, path))
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ensureIndex creates the index with mapping if it does not exist.
+func (x *openSearchClient) ensureIndex() error {
+	openSearchIndices.Lock()
+	defer openSearchIndices.Unlock()
+
+	key := x.cfg.Endpoint + "/" + x.cfg.Index
+	if openSearchIndices.ready[key] {
+		return nil
+	}
+
+	path := "/" + url.PathEscape(x.cfg.Index)
+	_, err := x.request(http.MethodHead, path, "", nil)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+		_, err = x.request(http.MethodPut, path, "application/json", []byte(openSearchMapping))
+		// Another function may create the index at the same time.
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusBadRequest &&
+			bytes.Contains(httpErr.Body, []byte("resource_already_exists_exception")) {
+			err = nil
+		}
+		if err == nil {
+			Logger.WithField("index", x.cfg.Index).Info("Created OpenSearch index")
+		}
+	}
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to prepare OpenSearch index "+x.cfg.Index)
+	}
+
+	openSearchIndices.ready[key] = true
+	return nil
+}
+
+// PublishOpenSearch indexes the report. ReportID is ID of the document, so a
+// recompiled report replaces the existing document. The index is created with
+// mapping on first use.
+func PublishOpenSearch(cfg OpenSearchConfig, report Report) error {
+	client, err := newOpenSearchClient(cfg)
+	if err != nil {
+		return err
+	}
+	if err := client.ensureIndex(); err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(NewOpenSearchDocument(report, client.cfg.Tags, time.Now()))
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal OpenSearch document")
+	}
+
+	path := fmt.Sprintf("/%s/_doc/%s", url.PathEscape(client.cfg.Index), url.PathEscape(string(report.ID)))
+	if _, err := client.request(http.MethodPut, path, "application/json", doc); err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to index report to OpenSearch")
+	}
+	return nil
+}
+
+// DeleteOpenSearchDocument deletes the document of the report. False is
+// returned if the index or the document does not exist.
+func DeleteOpenSearchDocument(cfg OpenSearchConfig, reportID ReportID) (bool, error) {
+	client, err := newOpenSearchClient(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	path := fmt.Sprintf("/%s/_doc/%s", url.PathEscape(client.cfg.Index), url.PathEscape(string(reportID)))
+	_, err = client.request(http.MethodDelete, path, "", nil)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, WrapCode(ErrCodePublish, err, "Fail to delete report from OpenSearch")
+	}
+	return true, nil
+}
+
+// IndexOpenSearchBulk indexes reports by one bulk request, e.g. for backfill.
+// Failures of items are returned together as an error.
+func IndexOpenSearchBulk(cfg OpenSearchConfig, reports []Report) error {
+	if len(reports) == 0 {
+		return nil
+	}
+
+	client, err := newOpenSearchClient(cfg)
+	if err != nil {
+		return err
+	}
+	if err := client.ensureIndex(); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	now := time.Now()
+	for _, report := range reports {
+		action := map[string]map[string]string{
+			"index": {"_index": client.cfg.Index, "_id": string(report.ID)},
+		}
+		for _, v := range []interface{}{action, NewOpenSearchDocument(report, client.cfg.Tags, now)} {
+			line, err := json.Marshal(v)
+			if err != nil {
+				return WrapCode(ErrCodeMarshal, err, "Fail to marshal OpenSearch bulk request")
+			}
+			body.Write(line)
+			body.WriteByte('\n')
+		}
+	}
+
+	raw, err := client.request(http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to send OpenSearch bulk request")
+	}
+
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to unmarshal OpenSearch bulk response")
+	}
+	if !resp.Errors {
+		return nil
+	}
+
+	var failed []string
+	for _, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 300 {
+				failed = append(failed, fmt.Sprintf("%s (%d): %s", result.ID, result.Status, string(result.Error)))
+			}
+		}
+	}
+	return WrapCode(ErrCodePublish, errors.New(strings.Join(failed, "; ")),
+		fmt.Sprintf("Fail to index %d of %d report(s)", len(failed), len(reports)))
+}
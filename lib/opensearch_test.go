@@ -0,0 +1,238 @@
+package lib_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOpenSearch is a minimum OpenSearch REST API server for tests.
+type mockOpenSearch struct {
+	indices  map[string][]byte
+	docs     map[string]map[string]interface{}
+	requests []string
+	auth     []string
+	searches []map[string]interface{}
+	srv      *httptest.Server
+}
+
+func newMockOpenSearch(t *testing.T) *mockOpenSearch {
+	x := &mockOpenSearch{
+		indices: map[string][]byte{},
+		docs:    map[string]map[string]interface{}{},
+	}
+	x.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.requests = append(x.requests, r.Method+" "+r.URL.Path)
+		x.auth = append(x.auth, r.Header.Get("Authorization"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == http.MethodHead && len(parts) == 1:
+			if _, ok := x.indices[parts[0]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+
+		case r.Method == http.MethodPut && len(parts) == 1:
+			if _, ok := x.indices[parts[0]]; ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"type":"resource_already_exists_exception"}}`))
+				return
+			}
+			x.indices[parts[0]] = body
+			w.Write([]byte(`{"acknowledged":true}`))
+
+		case r.Method == http.MethodPut && len(parts) == 3 && parts[1] == "_doc":
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &doc))
+			x.docs[parts[2]] = doc
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"result":"created"}`))
+
+		case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "_doc":
+			if _, ok := x.docs[parts[2]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"result":"not_found"}`))
+				return
+			}
+			delete(x.docs, parts[2])
+			w.Write([]byte(`{"result":"deleted"}`))
+
+		// Search returns all documents. Matching is up to the index.
+		case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "_search":
+			var query map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &query))
+			x.searches = append(x.searches, query)
+			hits := []map[string]interface{}{}
+			for _, doc := range x.docs {
+				hits = append(hits, map[string]interface{}{"_source": doc})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+
+		case r.Method == http.MethodPost && parts[0] == "_bulk":
+			assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+			var items []string
+			hasError := false
+			scanner := bufio.NewScanner(bytes.NewReader(body))
+			scanner.Buffer(nil, 1024*1024)
+			for scanner.Scan() {
+				var action map[string]map[string]string
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+				require.True(t, scanner.Scan())
+				id := action["index"]["_id"]
+				if id == "broken" {
+					hasError = true
+					items = append(items, `{"index":{"_id":"broken","status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+					continue
+				}
+				var doc map[string]interface{}
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+				x.docs[id] = doc
+				items = append(items, `{"index":{"_id":"`+id+`","status":201}}`)
+			}
+			resp := `{"errors":false,"items":[` + strings.Join(items, ",") + `]}`
+			if hasError {
+				resp = strings.Replace(resp, `"errors":false`, `"errors":true`, 1)
+			}
+			w.Write([]byte(resp))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return x
+}
+
+func TestNewOpenSearchDocument(t *testing.T) {
+	report := loadFixtureReport(t)
+	now := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := lib.NewOpenSearchDocument(report, []string{"prod"}, now)
+
+	assert.Equal(t, report.ID, doc.ReportID)
+	assert.Equal(t, report.Alert.Rule, doc.Rule)
+	assert.Equal(t, report.Alert.Key, doc.Key)
+	assert.Equal(t, []string{"prod"}, doc.Tags)
+	assert.Equal(t, now, doc.IndexedAt)
+	assert.Equal(t, len(report.Content.OpponentHosts), len(doc.RemoteHosts))
+	assert.Equal(t, len(report.Content.AlliedHosts), len(doc.LocalHosts))
+
+	var types []string
+	for _, obs := range doc.Observables {
+		types = append(types, obs.Type)
+		assert.NotEmpty(t, obs.Value)
+	}
+	assert.Contains(t, types, "ipaddr")
+
+	// Arrays must not be null to keep consistent document shape.
+	raw, err := json.Marshal(lib.NewOpenSearchDocument(lib.Report{ID: "empty"}, nil, now))
+	require.NoError(t, err)
+	var empty map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &empty))
+	for _, key := range []string{"tags", "remote_hosts", "local_hosts", "users", "observables", "warnings", "comments"} {
+		assert.IsType(t, []interface{}{}, empty[key], key)
+	}
+	assert.Equal(t, string(lib.SevUnclassified), empty["severity"])
+}
+
+func TestPublishOpenSearch(t *testing.T) {
+	search := newMockOpenSearch(t)
+	defer search.srv.Close()
+
+	cfg := lib.OpenSearchConfig{
+		Endpoint: search.srv.URL + "/",
+		Username: "user",
+		Password: "pass",
+		Tags:     []string{"prod"},
+	}
+	report := loadFixtureReport(t)
+
+	require.NoError(t, lib.PublishOpenSearch(cfg, report))
+	report.Result.Severity = lib.SevUrgent
+	require.NoError(t, lib.PublishOpenSearch(cfg, report))
+
+	index := lib.DefaultOpenSearchIndex
+	assert.Equal(t, []string{
+		"HEAD /" + index,
+		"PUT /" + index,
+		"PUT /" + index + "/_doc/" + string(report.ID),
+		"PUT /" + index + "/_doc/" + string(report.ID),
+	}, search.requests)
+
+	// Recompiled report replaces the document.
+	require.Equal(t, 1, len(search.docs))
+	doc := search.docs[string(report.ID)]
+	assert.Equal(t, string(lib.SevUrgent), doc["severity"])
+	assert.Equal(t, []interface{}{"prod"}, doc["tags"])
+
+	var mapping map[string]interface{}
+	require.NoError(t, json.Unmarshal(search.indices[index], &mapping))
+	assert.Contains(t, mapping, "mappings")
+
+	for _, auth := range search.auth {
+		assert.True(t, strings.HasPrefix(auth, "Basic "))
+	}
+}
+
+func TestPublishOpenSearchExistingIndex(t *testing.T) {
+	search := newMockOpenSearch(t)
+	defer search.srv.Close()
+	search.indices["reports"] = []byte(`{}`)
+
+	cfg := lib.OpenSearchConfig{
+		Endpoint:    search.srv.URL,
+		Index:       "reports",
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishOpenSearch(cfg, report))
+	assert.Equal(t, []string{
+		"HEAD /reports",
+		"PUT /reports/_doc/" + string(report.ID),
+	}, search.requests)
+	assert.Equal(t, `{}`, string(search.indices["reports"]))
+
+	for _, auth := range search.auth {
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Contains(t, auth, "/us-east-1/es/aws4_request")
+	}
+}
+
+func TestIndexOpenSearchBulk(t *testing.T) {
+	search := newMockOpenSearch(t)
+	defer search.srv.Close()
+
+	cfg := lib.OpenSearchConfig{Endpoint: search.srv.URL, Username: "user", Password: "pass"}
+	r1 := loadFixtureReport(t)
+	r2 := loadFixtureReport(t)
+	r2.ID = lib.ReportID("second")
+
+	require.NoError(t, lib.IndexOpenSearchBulk(cfg, []lib.Report{r1, r2}))
+	assert.Equal(t, 2, len(search.docs))
+	assert.Contains(t, search.docs, "second")
+
+	broken := loadFixtureReport(t)
+	broken.ID = lib.ReportID("broken")
+	err := lib.IndexOpenSearchBulk(cfg, []lib.Report{r1, broken})
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "mapper_parsing_exception")
+}
+
+func TestPublishOpenSearchNoEndpoint(t *testing.T) {
+	err := lib.PublishOpenSearch(lib.OpenSearchConfig{}, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Endpoints of Opsgenie API by region of the account.
+var opsgenieAPIURLs = map[string]string{
+	"us": "https://api.opsgenie.com",
+	"eu": "https://api.eu.opsgenie.com",
+}
+
+// Limits of Opsgenie alert fields. Longer values are truncated.
+const (
+	opsgenieMaxMessage     = 130
+	opsgenieMaxDescription = 15000
+	opsgenieMaxNote        = 25000
+	opsgenieMaxDetail      = 8000
+	opsgenieMaxIndicators  = 5
+)
+
+// OpsgenieResponders chooses teams notified of an alert. Teams of all matched
+// rule patterns and labels of the report are notified, and Default is used if
+// nothing matches.
+type OpsgenieResponders struct {
+	// Rules maps patterns of alert rule to team names. Pattern syntax is the
+	// same as path.Match.
+	Rules map[string][]string `json:"rules"`
+
+	// Labels maps labels of the report to team names.
+	Labels map[string][]string `json:"labels"`
+
+	Default []string `json:"default"`
+}
+
+// ParseOpsgenieResponders parses JSON of OpsgenieResponders, e.g. value of
+// OPSGENIE_RESPONDERS environment variable. Empty string means no responder.
+// Rule patterns are normalized by NormalizeRulePattern.
+func ParseOpsgenieResponders(raw string) (OpsgenieResponders, error) {
+	var responders OpsgenieResponders
+	if strings.TrimSpace(raw) == "" {
+		return responders, nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), &responders); err != nil {
+		return responders, NewConfigError(errors.Wrap(err, "Invalid Opsgenie responders").Error())
+	}
+	for pattern := range responders.Rules {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return responders, NewConfigError(fmt.Sprintf("Invalid rule pattern of Opsgenie responders: %s", pattern))
+		}
+	}
+	responders.Rules = normalizeRulePatterns(responders.Rules)
+	return responders, nil
+}
+
+// Teams returns sorted and deduplicated team names for the report.
+func (x *OpsgenieResponders) Teams(report Report) []string {
+	var teams []string
+	rule := NormalizeRule(report.Alert.Rule)
+	for pattern, names := range x.Rules {
+		if ok, _ := path.Match(pattern, rule); ok {
+			teams = append(teams, names...)
+		}
+	}
+	for label, names := range x.Labels {
+		if report.HasLabel(label) {
+			teams = append(teams, names...)
+		}
+	}
+	if len(teams) == 0 {
+		teams = x.Default
+	}
+
+	seen := map[string]bool{}
+	var result []string
+	for _, team := range teams {
+		if team != "" && !seen[team] {
+			seen[team] = true
+			result = append(result, team)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// OpsgenieConfig is configuration of PublishOpsgenie.
+type OpsgenieConfig struct {
+	APIKey string
+
+	// Region is "us" (default) or "eu" and chooses the API endpoint. APIURL
+	// overrides it if set.
+	Region string
+	APIURL string
+
+	Responders OpsgenieResponders
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+func (x *OpsgenieConfig) apiURL() (string, error) {
+	if x.APIURL != "" {
+		return strings.TrimRight(x.APIURL, "/"), nil
+	}
+
+	region := strings.ToLower(x.Region)
+	if region == "" {
+		region = "us"
+	}
+	endpoint, ok := opsgenieAPIURLs[region]
+	if !ok {
+		return "", NewConfigError(fmt.Sprintf("Unknown Opsgenie region: %s", x.Region))
+	}
+	return endpoint, nil
+}
+
+func (x *OpsgenieConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+// OpsgenieResponder is a responder of alert. Only teams are used.
+type OpsgenieResponder struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// OpsgenieAlert is a request body of creating alert. Only fields used by
+// NewOpsgenieAlert are defined.
+type OpsgenieAlert struct {
+	Message     string              `json:"message"`
+	Alias       string              `json:"alias"`
+	Description string              `json:"description,omitempty"`
+	Responders  []OpsgenieResponder `json:"responders,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Details     map[string]string   `json:"details,omitempty"`
+	Entity      string              `json:"entity,omitempty"`
+	Source      string              `json:"source"`
+	Priority    string              `json:"priority"`
+}
+
+// OpsgenieNote is a request body of adding note and closing alert.
+type OpsgenieNote struct {
+	Note   string `json:"note"`
+	Source string `json:"source"`
+}
+
+const opsgenieSource = "AlertResponder"
+
+// OpsgenieAlias returns alias of the alert of the report. Opsgenie
+// deduplicates open alerts by alias.
+func OpsgenieAlias(report Report) string {
+	return string(report.ID)
+}
+
+// opsgeniePriority maps severity to priority. Unknown severity is regarded as
+// unclassified.
+func opsgeniePriority(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "P1"
+	case SevSafe:
+		return "P5"
+	default:
+		return "P3"
+	}
+}
+
+// NewOpsgenieAlert builds an alert of the report.
+func NewOpsgenieAlert(cfg OpsgenieConfig, report Report) OpsgenieAlert {
+	alert := OpsgenieAlert{
+		Message:  truncateText(report.OneLineSummary(), opsgenieMaxMessage),
+		Alias:    OpsgenieAlias(report),
+		Entity:   report.Alert.Key,
+		Source:   opsgenieSource,
+		Priority: opsgeniePriority(report.Result.Severity),
+		Details: map[string]string{
+			"report_id": string(report.ID),
+			"rule":      report.Alert.Rule,
+		},
+	}
+
+	description := report.Text
+	if description == "" {
+		description = report.Alert.Description
+	}
+	alert.Description = truncateText(description, opsgenieMaxDescription)
+
+	if report.Result.Severity != "" {
+		alert.Details["severity"] = string(report.Result.Severity)
+		alert.Tags = append(alert.Tags, "severity:"+string(report.Result.Severity))
+	}
+	if report.AccountID != "" {
+		alert.Details["account_id"] = report.AccountID
+	}
+	if indicators := report.TopIndicators(opsgenieMaxIndicators); len(indicators) > 0 {
+		alert.Details["top_indicators"] = truncateText(strings.Join(indicators, "\n"), opsgenieMaxDetail)
+	}
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		alert.Details["report_url"] = link
+	}
+	alert.Tags = append(alert.Tags, report.Labels...)
+
+	for _, team := range cfg.Responders.Teams(report) {
+		alert.Responders = append(alert.Responders, OpsgenieResponder{Type: "team", Name: team})
+	}
+
+	return alert
+}
+
+// opsgenieError maps a rejected API key to ErrCodeInvalidConfig so that it is
+// not retried as a publish failure.
+func opsgenieError(err error, msg string) error {
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusUnauthorized {
+		return WrapCode(ErrCodeInvalidConfig, err, msg)
+	}
+	return WrapCode(ErrCodePublish, err, msg)
+}
+
+type opsgenieClient struct {
+	cfg    OpsgenieConfig
+	apiURL string
+}
+
+func (x *opsgenieClient) request(method, path string, in interface{}) error {
+	var body []byte
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to marshal Opsgenie request")
+		}
+		body = raw
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "GenieKey "+x.cfg.APIKey)
+	header.Set("Content-Type", "application/json")
+
+	_, err := sendHTTPRequest(x.cfg.Client, method, x.apiURL+path, header, body, x.cfg.retry())
+	return err
+}
+
+func opsgenieAlertPath(report Report, action string) string {
+	p := "/v2/alerts/" + url.PathEscape(OpsgenieAlias(report))
+	if action != "" {
+		p += "/" + action
+	}
+	return p + "?identifierType=alias"
+}
+
+// exists returns true if an alert of the report exists.
+func (x *opsgenieClient) exists(report Report) (bool, error) {
+	err := x.request(http.MethodGet, opsgenieAlertPath(report, ""), nil)
+	if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PublishOpsgenie creates an alert of the report. If the alert of the report
+// exists, a note with the latest summary is added instead, and the alert is
+// closed with a note when the report is closed.
+func PublishOpsgenie(cfg OpsgenieConfig, report Report) error {
+	if cfg.APIKey == "" {
+		return NewConfigError("Opsgenie API key is not configured")
+	}
+	apiURL, err := cfg.apiURL()
+	if err != nil {
+		return err
+	}
+	client := &opsgenieClient{cfg: cfg, apiURL: apiURL}
+	logger := Logger.WithFields(report.LogFields())
+
+	if report.IsClosed() {
+		note := OpsgenieNote{
+			Note:   truncateText("Report is closed. "+report.Result.Reason, opsgenieMaxNote),
+			Source: opsgenieSource,
+		}
+		err := client.request(http.MethodPost, opsgenieAlertPath(report, "close"), note)
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+			// Reports closed without being published have no alert.
+			logger.Info("No Opsgenie alert to close")
+			return nil
+		} else if err != nil {
+			return opsgenieError(err, "Fail to close Opsgenie alert")
+		}
+		logger.Info("Closed Opsgenie alert")
+		return nil
+	}
+
+	found, err := client.exists(report)
+	if err != nil {
+		return opsgenieError(err, "Fail to get Opsgenie alert")
+	}
+
+	if found {
+		note := OpsgenieNote{
+			Note:   truncateText("Report is updated: "+report.OneLineSummary(), opsgenieMaxNote),
+			Source: opsgenieSource,
+		}
+		if err := client.request(http.MethodPost, opsgenieAlertPath(report, "notes"), note); err != nil {
+			return opsgenieError(err, "Fail to add note to Opsgenie alert")
+		}
+		logger.Info("Added note to Opsgenie alert")
+		return nil
+	}
+
+	if err := client.request(http.MethodPost, "/v2/alerts", NewOpsgenieAlert(cfg, report)); err != nil {
+		return opsgenieError(err, "Fail to create Opsgenie alert")
+	}
+	logger.Info("Created Opsgenie alert")
+	return nil
+}
@@ -0,0 +1,198 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockOpsgenieAlert struct {
+	lib.OpsgenieAlert
+	Status string
+	Notes  []string
+}
+
+// mockOpsgenie is a minimum Opsgenie Alert API server for tests.
+type mockOpsgenie struct {
+	t         *testing.T
+	srv       *httptest.Server
+	alerts    map[string]*mockOpsgenieAlert
+	auth      []string
+	rateLimit int
+}
+
+func newMockOpsgenie(t *testing.T) *mockOpsgenie {
+	x := &mockOpsgenie{t: t, alerts: map[string]*mockOpsgenieAlert{}}
+	x.srv = httptest.NewServer(http.HandlerFunc(x.handle))
+	return x
+}
+
+var opsgenieAlertPath = regexp.MustCompile(`^/v2/alerts/([^/]+)(/notes|/close)?$`)
+
+func (x *mockOpsgenie) handle(w http.ResponseWriter, r *http.Request) {
+	x.auth = append(x.auth, r.Header.Get("Authorization"))
+
+	if x.rateLimit > 0 {
+		x.rateLimit--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	if r.URL.Path == "/v2/alerts" && r.Method == http.MethodPost {
+		var alert lib.OpsgenieAlert
+		require.NoError(x.t, json.NewDecoder(r.Body).Decode(&alert))
+		x.alerts[alert.Alias] = &mockOpsgenieAlert{OpsgenieAlert: alert, Status: "open"}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"result":"Request will be processed"}`))
+		return
+	}
+
+	m := opsgenieAlertPath.FindStringSubmatch(r.URL.Path)
+	if m == nil || r.URL.Query().Get("identifierType") != "alias" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	alert, ok := x.alerts[m[1]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"Alert does not exist"}`))
+		return
+	}
+
+	var note lib.OpsgenieNote
+	if r.Method == http.MethodPost {
+		require.NoError(x.t, json.NewDecoder(r.Body).Decode(&note))
+	}
+
+	switch {
+	case m[2] == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"status": alert.Status}})
+	case m[2] == "/notes" && r.Method == http.MethodPost:
+		alert.Notes = append(alert.Notes, note.Note)
+		w.WriteHeader(http.StatusAccepted)
+	case m[2] == "/close" && r.Method == http.MethodPost:
+		alert.Status = "closed"
+		alert.Notes = append(alert.Notes, note.Note)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (x *mockOpsgenie) config() lib.OpsgenieConfig {
+	return lib.OpsgenieConfig{
+		APIKey: "test-key",
+		APIURL: x.srv.URL,
+		Responders: lib.OpsgenieResponders{
+			Rules:   map[string][]string{"malware-*": {"malware-team"}},
+			Labels:  map[string][]string{"phishing": {"phishing-team"}},
+			Default: []string{"soc"},
+		},
+		Retry: lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+}
+
+func TestPublishOpsgenieCreate(t *testing.T) {
+	og := newMockOpsgenie(t)
+	defer og.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.AddLabel("phishing")
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+
+	require.Equal(t, 1, len(og.alerts))
+	alert := og.alerts[string(report.ID)]
+	require.NotNil(t, alert)
+	assert.Equal(t, "P1", alert.Priority)
+	assert.Equal(t, report.OneLineSummary(), alert.Message)
+	assert.Equal(t, []lib.OpsgenieResponder{
+		{Type: "team", Name: "malware-team"},
+		{Type: "team", Name: "phishing-team"},
+	}, alert.Responders)
+	assert.Equal(t, []string{"severity:urgent", "phishing"}, alert.Tags)
+	assert.Equal(t, string(report.ID), alert.Details["report_id"])
+	assert.Contains(t, alert.Details["top_indicators"], "198.51.100.7")
+	assert.Equal(t, "GenieKey test-key", og.auth[0])
+}
+
+func TestPublishOpsgenieAppendNote(t *testing.T) {
+	og := newMockOpsgenie(t)
+	defer og.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+
+	// Recompiled report is added as a note even under rate limit.
+	og.rateLimit = 1
+	report.Result.Severity = lib.SevUnclassified
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+
+	require.Equal(t, 1, len(og.alerts))
+	alert := og.alerts[string(report.ID)]
+	require.Equal(t, 1, len(alert.Notes))
+	assert.Contains(t, alert.Notes[0], report.OneLineSummary())
+	assert.Equal(t, "open", alert.Status)
+	assert.Equal(t, "P1", alert.Priority)
+}
+
+func TestPublishOpsgenieClose(t *testing.T) {
+	og := newMockOpsgenie(t)
+	defer og.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+
+	report.Status = lib.StatusClosed
+	report.Result.Reason = "False positive"
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+
+	alert := og.alerts[string(report.ID)]
+	assert.Equal(t, "closed", alert.Status)
+	require.Equal(t, 1, len(alert.Notes))
+	assert.Contains(t, alert.Notes[0], "False positive")
+}
+
+func TestPublishOpsgenieDefaultResponder(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "port-scan"
+	report.Result.Severity = lib.SevSafe
+
+	cfg := lib.OpsgenieConfig{Responders: lib.OpsgenieResponders{Default: []string{"soc"}}}
+	alert := lib.NewOpsgenieAlert(cfg, report)
+	assert.Equal(t, "P5", alert.Priority)
+	assert.Equal(t, []lib.OpsgenieResponder{{Type: "team", Name: "soc"}}, alert.Responders)
+}
+
+func TestPublishOpsgenieInvalidConfig(t *testing.T) {
+	og := newMockOpsgenie(t)
+	defer og.srv.Close()
+
+	cfg := og.config()
+	cfg.APIURL = ""
+	cfg.Region = "jp"
+	err := lib.PublishOpsgenie(cfg, loadFixtureReport(t))
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+
+	_, err = lib.ParseOpsgenieResponders(`{"rules": {"[": ["x"]}}`)
+	_, ok = err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+func TestPublishOpsgenieCloseWithoutAlert(t *testing.T) {
+	og := newMockOpsgenie(t)
+	defer og.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusClosed
+	require.NoError(t, lib.PublishOpsgenie(og.config(), report))
+	assert.Equal(t, 0, len(og.alerts))
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SeverityOverrideReason is prefix of ReportResult.Reason of reports of which
+// severity is forced by SeverityOverrides.
+const SeverityOverrideReason = "severity-override"
+
+// SeverityOverride forces severity of reports matching all of its
+// conditions. Empty conditions match all reports.
+type SeverityOverride struct {
+	Name string `json:"name"`
+
+	// Rules are patterns of alert rule, e.g. "malware-*". Pattern syntax is
+	// the same as path.Match.
+	Rules []string `json:"rules"`
+
+	// Labels are labels of which the report must have at least one.
+	Labels []string `json:"labels"`
+
+	// Hosts are patterns of critical hosts, e.g. "db-prod-*". A report
+	// matches if ID, host name or IP address of any host matches.
+	Hosts []string `json:"hosts"`
+
+	Severity ReportSeverity `json:"severity"`
+}
+
+// SeverityOverrides are evaluated in order and the first matched one is
+// applied.
+type SeverityOverrides []SeverityOverride
+
+// ParseSeverityOverrides parses JSON of SeverityOverrides, e.g. value of
+// SEVERITY_OVERRIDES environment variable. Empty string means no overrides.
+// Rule patterns are normalized by NormalizeRulePattern.
+func ParseSeverityOverrides(raw string) (SeverityOverrides, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var overrides SeverityOverrides
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid severity overrides").Error())
+	}
+
+	for i, o := range overrides {
+		if o.Name == "" {
+			overrides[i].Name = fmt.Sprintf("#%d", i)
+		}
+		overrides[i].Severity = ReportSeverity(strings.ToLower(string(o.Severity)))
+		if overrides[i].Severity.Level() == 0 {
+			return nil, NewConfigError(fmt.Sprintf("Invalid severity of override %s: %s", overrides[i].Name, o.Severity))
+		}
+		for _, pattern := range append(append([]string{}, o.Rules...), o.Hosts...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, NewConfigError(fmt.Sprintf("Invalid pattern of override %s: %s", overrides[i].Name, pattern))
+			}
+		}
+		for j, pattern := range o.Rules {
+			overrides[i].Rules[j] = NormalizeRulePattern(pattern)
+		}
+	}
+	return overrides, nil
+}
+
+// matchAny returns true if any value matches any pattern.
+func matchAny(patterns, values []string) bool {
+	for _, pattern := range patterns {
+		for _, v := range values {
+			if ok, _ := path.Match(pattern, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostNames returns IDs, host names and IP addresses of hosts in the report.
+func hostNames(report Report) []string {
+	var names []string
+	for _, host := range report.Content.OpponentHosts {
+		names = append(names, host.ID)
+		names = append(names, host.IPAddrs()...)
+	}
+	for _, host := range report.Content.AlliedHosts {
+		names = append(names, host.ID)
+		names = append(names, host.HostName...)
+		names = append(names, host.IPAddr...)
+	}
+	return names
+}
+
+func (x SeverityOverride) match(report Report) bool {
+	if len(x.Rules) > 0 && !matchAny(x.Rules, []string{NormalizeRule(report.Alert.Rule)}) {
+		return false
+	}
+
+	if len(x.Labels) > 0 {
+		found := false
+		for _, label := range x.Labels {
+			found = found || report.HasLabel(label)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(x.Hosts) > 0 && !matchAny(x.Hosts, hostNames(report)) {
+		return false
+	}
+	return true
+}
+
+// Apply forces severity of the first matched override and records its name
+// in the reason. The matched override is returned, or nil if none matches.
+// Applying again does not repeat the name in the reason.
+func (x SeverityOverrides) Apply(report *Report) *SeverityOverride {
+	for i := range x {
+		if !x[i].match(*report) {
+			continue
+		}
+
+		reason := fmt.Sprintf("%s: %s", SeverityOverrideReason, x[i].Name)
+		switch prev := report.Result.Reason; {
+		case prev == reason || strings.HasPrefix(prev, reason+"; "):
+			reason = prev
+		case prev != "":
+			reason += "; " + prev
+		}
+		report.Result.Severity = x[i].Severity
+		report.Result.Reason = reason
+		return &x[i]
+	}
+	return nil
+}
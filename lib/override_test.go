@@ -0,0 +1,64 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSeverityOverrides(t *testing.T) {
+	overrides, err := lib.ParseSeverityOverrides("")
+	require.NoError(t, err)
+	assert.Nil(t, overrides)
+
+	overrides, err = lib.ParseSeverityOverrides(`[{"rules": ["c2-*"], "severity": "Urgent"}]`)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(overrides))
+	assert.Equal(t, "#0", overrides[0].Name)
+	assert.Equal(t, lib.SevUrgent, overrides[0].Severity)
+
+	for _, raw := range []string{
+		`{"rules": ["c2-*"]}`,
+		`[{"rules": ["c2-*"], "severity": "critical"}]`,
+		`[{"rules": ["c2-["], "severity": "urgent"}]`,
+		`[{"hosts": ["db-["], "severity": "urgent"}]`,
+	} {
+		_, err := lib.ParseSeverityOverrides(raw)
+		require.Error(t, err, raw)
+		_, ok := err.(*lib.ConfigError)
+		assert.True(t, ok, raw)
+	}
+}
+
+func TestSeverityOverridesFirstMatch(t *testing.T) {
+	overrides, err := lib.ParseSeverityOverrides(`[
+		{"name": "scanner", "rules": ["port-scan"], "labels": ["allowlisted"], "severity": "safe"},
+		{"name": "prod-db", "hosts": ["db-prod-*"], "severity": "urgent"},
+		{"name": "scan", "rules": ["port-*"], "severity": "unclassified"}
+	]`)
+	require.NoError(t, err)
+
+	report := lib.NewReport("r1", lib.Alert{Rule: "port-scan"})
+	report.Result.Reason = "reviewed"
+	report.Content.AlliedHosts["i-1234"] = lib.ReportAlliedHost{ID: "i-1234", HostName: []string{"db-prod-01"}}
+
+	// The first override requires a label and the second one matches.
+	o := overrides.Apply(&report)
+	require.NotNil(t, o)
+	assert.Equal(t, "prod-db", o.Name)
+	assert.Equal(t, lib.SevUrgent, report.Result.Severity)
+	assert.Equal(t, "severity-override: prod-db; reviewed", report.Result.Reason)
+
+	// Applying again, e.g. in Publisher, does not repeat the name.
+	overrides.Apply(&report)
+	assert.Equal(t, "severity-override: prod-db; reviewed", report.Result.Reason)
+
+	report.AddLabel("allowlisted")
+	report.Result = lib.ReportResult{}
+	o = overrides.Apply(&report)
+	require.NotNil(t, o)
+	assert.Equal(t, "scanner", o.Name)
+	assert.Equal(t, lib.SevSafe, report.Result.Severity)
+}
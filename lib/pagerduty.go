@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// PagerDutyEventsURL is endpoint of PagerDuty Events API v2.
+	PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// PagerDutyMinSeverity is the lowest severity that triggers an incident.
+	// Unknown severity falls back to urgent, and functions should check
+	// PAGERDUTY_MIN_SEVERITY by ParsePagerDutyMinSeverity at init.
+	PagerDutyMinSeverity = pagerDutyMinSeverity(os.Getenv("PAGERDUTY_MIN_SEVERITY"))
+
+	// PagerDutyRetry is retry policy for 429 and 5xx responses.
+	PagerDutyRetry = DefaultHTTPRetry
+)
+
+const (
+	pagerDutyMaxSummaryLen = 1024
+	pagerDutyMaxIndicators = 5
+)
+
+func pagerDutyMinSeverity(name string) ReportSeverity {
+	sev, err := ParsePagerDutyMinSeverity(name)
+	if err != nil {
+		return SevUrgent
+	}
+	return sev
+}
+
+// ParsePagerDutyMinSeverity parses value of PAGERDUTY_MIN_SEVERITY. Empty
+// value is urgent and unknown severity is ConfigError.
+func ParsePagerDutyMinSeverity(name string) (ReportSeverity, error) {
+	if name == "" {
+		return SevUrgent, nil
+	}
+	return ParseReportSeverity(name)
+}
+
+// PagerDutyEvent is a request body of Events API v2.
+type PagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *PagerDutyPayload `json:"payload,omitempty"`
+}
+
+type PagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component,omitempty"`
+	Group         string                 `json:"group,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+// PagerDutyDedupKey returns dedup_key of the report. The key is same for
+// recompiled reports so that PagerDuty updates the existing incident.
+func PagerDutyDedupKey(report Report) string {
+	return fmt.Sprintf("alert-responder/%s", report.ID)
+}
+
+func pagerDutySeverity(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "critical"
+	case SevUnclassified:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// NewPagerDutyEvent builds an event of the report. Nil is returned if the
+// report should not be notified, i.e. severity is lower than
+// PagerDutyMinSeverity and the report is not closed.
+func NewPagerDutyEvent(routingKey string, report Report) *PagerDutyEvent {
+	ev := PagerDutyEvent{
+		RoutingKey: routingKey,
+		DedupKey:   PagerDutyDedupKey(report),
+	}
+
+	if report.IsClosed() {
+		ev.EventAction = "resolve"
+		return &ev
+	}
+
+	if report.Result.Severity.Level() < PagerDutyMinSeverity.Level() {
+		return nil
+	}
+
+	source := report.Alert.Key
+	if source == "" {
+		source = "AlertResponder"
+	}
+
+	ev.EventAction = "trigger"
+	ev.Payload = &PagerDutyPayload{
+		Summary:   truncateText(report.OneLineSummary(), pagerDutyMaxSummaryLen),
+		Source:    source,
+		Severity:  pagerDutySeverity(report.Result.Severity),
+		Component: report.Alert.Rule,
+		Group:     report.AccountID,
+		CustomDetails: map[string]interface{}{
+			"report_id":        report.ID,
+			"remote_hosts":     len(report.Content.OpponentHosts),
+			"local_hosts":      len(report.Content.AlliedHosts),
+			"users":            len(report.Content.SubjectUsers),
+			"malicious_hashes": len(report.Content.MaliciousHashes()),
+			"top_indicators":   report.TopIndicators(pagerDutyMaxIndicators),
+		},
+	}
+
+	return &ev
+}
+
+// PublishPagerDuty sends trigger event of the report to PagerDuty if severity
+// is PagerDutyMinSeverity or higher, and resolve event if the report is closed.
+func PublishPagerDuty(routingKey string, report Report) error {
+	if routingKey == "" {
+		return NewConfigError("PagerDuty routing key is not configured")
+	}
+
+	ev := NewPagerDutyEvent(routingKey, report)
+	if ev == nil {
+		Logger.WithFields(report.LogFields()).Info("Severity is lower than threshold, skip PagerDuty")
+		return nil
+	}
+
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal PagerDuty event")
+	}
+
+	if _, err := postJSON(nil, PagerDutyEventsURL, nil, raw, PagerDutyRetry); err != nil {
+		return errors.Wrap(err, "Fail to send PagerDuty event")
+	}
+
+	return nil
+}
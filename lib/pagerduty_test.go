@@ -0,0 +1,146 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pagerDutyServer struct {
+	*httptest.Server
+	calls  int
+	events []lib.PagerDutyEvent
+
+	origURL   string
+	origRetry lib.HTTPRetry
+}
+
+// newPagerDutyServer returns mock of Events API. It responds 429 for first
+// throttled requests.
+func newPagerDutyServer(t *testing.T, throttled int) *pagerDutyServer {
+	s := &pagerDutyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls++
+		if s.calls <= throttled {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var ev lib.PagerDutyEvent
+		require.NoError(t, json.Unmarshal(raw, &ev))
+		s.events = append(s.events, ev)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	s.origURL, s.origRetry = lib.PagerDutyEventsURL, lib.PagerDutyRetry
+	lib.PagerDutyEventsURL = s.URL
+	lib.PagerDutyRetry = lib.HTTPRetry{MaxRetry: 3, Wait: time.Millisecond}
+
+	return s
+}
+
+func (x *pagerDutyServer) Close() {
+	x.Server.Close()
+	lib.PagerDutyEventsURL, lib.PagerDutyRetry = x.origURL, x.origRetry
+}
+
+func TestPublishPagerDutyDedupKey(t *testing.T) {
+	srv := newPagerDutyServer(t, 0)
+	defer srv.Close()
+	report := loadFixtureReport(t)
+	summary := report.OneLineSummary()
+
+	require.NoError(t, lib.PublishPagerDuty("routing-key", report))
+	report.Content.AlliedHosts = nil
+	require.NoError(t, lib.PublishPagerDuty("routing-key", report))
+
+	require.Equal(t, 2, len(srv.events))
+	assert.Equal(t, srv.events[0].DedupKey, srv.events[1].DedupKey)
+	assert.Equal(t, lib.PagerDutyDedupKey(report), srv.events[0].DedupKey)
+
+	ev := srv.events[0]
+	assert.Equal(t, "routing-key", ev.RoutingKey)
+	assert.Equal(t, "trigger", ev.EventAction)
+	require.NotNil(t, ev.Payload)
+	assert.Equal(t, "critical", ev.Payload.Severity)
+	assert.Equal(t, summary, ev.Payload.Summary)
+	assert.Equal(t, float64(2), ev.Payload.CustomDetails["remote_hosts"])
+	assert.Equal(t, float64(1), ev.Payload.CustomDetails["malicious_hashes"])
+	assert.NotEmpty(t, ev.Payload.CustomDetails["top_indicators"])
+}
+
+func TestPublishPagerDutyThreshold(t *testing.T) {
+	srv := newPagerDutyServer(t, 0)
+	defer srv.Close()
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevUnclassified
+
+	require.NoError(t, lib.PublishPagerDuty("routing-key", report))
+	assert.Equal(t, 0, srv.calls)
+
+	orig := lib.PagerDutyMinSeverity
+	defer func() { lib.PagerDutyMinSeverity = orig }()
+	lib.PagerDutyMinSeverity = lib.SevUnclassified
+
+	require.NoError(t, lib.PublishPagerDuty("routing-key", report))
+	require.Equal(t, 1, len(srv.events))
+	assert.Equal(t, "warning", srv.events[0].Payload.Severity)
+}
+
+func TestPublishPagerDutyResolve(t *testing.T) {
+	srv := newPagerDutyServer(t, 0)
+	defer srv.Close()
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusClosed
+	report.Result.Severity = lib.SevSafe
+
+	require.NoError(t, lib.PublishPagerDuty("routing-key", report))
+	require.Equal(t, 1, len(srv.events))
+	assert.Equal(t, "resolve", srv.events[0].EventAction)
+	assert.Equal(t, lib.PagerDutyDedupKey(report), srv.events[0].DedupKey)
+	assert.Nil(t, srv.events[0].Payload)
+}
+
+func TestPublishPagerDutyRateLimit(t *testing.T) {
+	srv := newPagerDutyServer(t, 2)
+	defer srv.Close()
+
+	require.NoError(t, lib.PublishPagerDuty("routing-key", loadFixtureReport(t)))
+	assert.Equal(t, 3, srv.calls)
+	assert.Equal(t, 1, len(srv.events))
+}
+
+func TestPublishPagerDutyNoRoutingKey(t *testing.T) {
+	err := lib.PublishPagerDuty("", loadFixtureReport(t))
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+func TestParsePagerDutyMinSeverity(t *testing.T) {
+	for raw, expected := range map[string]lib.ReportSeverity{
+		"":             lib.SevUrgent,
+		"urgent":       lib.SevUrgent,
+		"Unclassified": lib.SevUnclassified,
+		"safe":         lib.SevSafe,
+	} {
+		sev, err := lib.ParsePagerDutyMinSeverity(raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, expected, sev, raw)
+	}
+
+	for _, raw := range []string{"urgnet", "critical"} {
+		_, err := lib.ParsePagerDutyMinSeverity(raw)
+		require.Error(t, err, raw)
+		assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err), raw)
+	}
+}
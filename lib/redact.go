@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// RedactionRules specifies fields to be masked before the report is published
+// to external services. Zero value redacts nothing.
+type RedactionRules struct {
+	// HashUserNames replaces user names and principals with salted hash.
+	// Same name is converted to same hash to correlate them in a report.
+	HashUserNames bool `json:"hash_usernames"`
+
+	// HashHostNames replaces host names of local hosts with salted hash.
+	HashHostNames bool `json:"hash_hostnames"`
+
+	// DropPrivateIPs removes private IP addresses (see IsPrivateIP) from
+	// hosts, activities and alert attributes. Host IDs of private IP address
+	// are replaced with hash.
+	DropPrivateIPs bool `json:"drop_private_ips"`
+
+	// DropComments removes comments of analysts.
+	DropComments bool `json:"drop_comments"`
+
+	Salt string `json:"salt"`
+}
+
+// ParseRedactionRules parses JSON of RedactionRules, e.g. value of
+// REDACTION_RULES environment variable. Empty string means no redaction.
+func ParseRedactionRules(raw string) (*RedactionRules, error) {
+	var rules RedactionRules
+	if raw == "" {
+		return &rules, nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid redaction rules").Error())
+	}
+	return &rules, nil
+}
+
+func (x RedactionRules) hash(value string) string {
+	if value == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(x.Salt + value))
+	return "redacted-" + hex.EncodeToString(h[:6])
+}
+
+func (x RedactionRules) userName(name string) string {
+	if !x.HashUserNames {
+		return name
+	}
+	return x.hash(name)
+}
+
+// hashAll returns hashed copy of values if enabled.
+func (x RedactionRules) hashAll(enabled bool, values []string) []string {
+	if !enabled || values == nil {
+		return values
+	}
+	res := make([]string, len(values))
+	for i, v := range values {
+		res[i] = x.hash(v)
+	}
+	return res
+}
+
+func (x RedactionRules) ipAddrs(addrs []string) []string {
+	if !x.DropPrivateIPs || addrs == nil {
+		return addrs
+	}
+	res := []string{}
+	for _, addr := range addrs {
+		if !IsPrivateIP(addr) {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+func (x RedactionRules) remoteAddrs(addrs []RemoteAddr) []RemoteAddr {
+	if !x.DropPrivateIPs || addrs == nil {
+		return addrs
+	}
+	res := []RemoteAddr{}
+	for _, addr := range addrs {
+		if !IsPrivateIP(addr.IP) {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// hostID hides ID of a host if it is a private IP address.
+func (x RedactionRules) hostID(id string) string {
+	if x.DropPrivateIPs && IsPrivateIP(id) {
+		return x.hash(id)
+	}
+	return id
+}
+
+func (x RedactionRules) activities(src []ReportActivity) []ReportActivity {
+	if src == nil {
+		return nil
+	}
+	res := make([]ReportActivity, len(src))
+	for i, act := range src {
+		act.Principal = x.userName(act.Principal)
+		if x.DropPrivateIPs && IsPrivateIP(act.RemoteAddr) {
+			act.RemoteAddr = ""
+		}
+		res[i] = act
+	}
+	return res
+}
+
+func (x RedactionRules) alert(src Alert) Alert {
+	alert := src
+	alert.Attrs = nil
+	for _, attr := range src.Attrs {
+		switch {
+		case x.DropPrivateIPs && attr.Type == "ipaddr" && IsPrivateIP(attr.Value):
+			continue
+		case x.HashUserNames && attr.Type == "username":
+			attr.Value = x.hash(attr.Value)
+		case x.HashHostNames && attr.Type == "hostname":
+			attr.Value = x.hash(attr.Value)
+		}
+		attr.Context = append([]string{}, attr.Context...)
+		alert.Attrs = append(alert.Attrs, attr)
+	}
+
+	alert.Key = x.hostID(alert.Key)
+	return alert
+}
+
+// RedactReport returns a sanitized copy of the report for external publishers.
+// The original report is not modified. Text is cleared because it is rendered
+// from unredacted content.
+func RedactReport(report Report, rules RedactionRules) Report {
+	res := report
+	res.Alert = rules.alert(report.Alert)
+	res.Content = newReportContent()
+	res.Text = ""
+	res.Warnings = append([]string{}, report.Warnings...)
+
+	for id, host := range report.Content.OpponentHosts {
+		host.ID = rules.hostID(host.ID)
+		host.IPAddr = rules.ipAddrs(host.IPAddr)
+		host.Addrs = rules.remoteAddrs(host.Addrs)
+		res.Content.OpponentHosts[rules.hostID(id)] = host
+	}
+
+	for id, host := range report.Content.AlliedHosts {
+		host.ID = rules.hostID(host.ID)
+		host.UserName = rules.hashAll(rules.HashUserNames, host.UserName)
+		host.HostName = rules.hashAll(rules.HashHostNames, host.HostName)
+		host.IPAddr = rules.ipAddrs(host.IPAddr)
+		host.Activities = rules.activities(host.Activities)
+		res.Content.AlliedHosts[rules.hostID(id)] = host
+	}
+
+	for _, user := range report.Content.SubjectUsers {
+		user.UserName = rules.userName(user.UserName)
+		user.Activities = rules.activities(user.Activities)
+		res.Content.SubjectUsers[user.UserName] = user
+	}
+
+	res.Conflicts = nil
+	for _, c := range report.Conflicts {
+		c.HostID = rules.hostID(c.HostID)
+		c.Values = rules.hashAll(rules.HashHostNames && c.Field == "hostname", append([]string{}, c.Values...))
+		res.Conflicts = append(res.Conflicts, c)
+	}
+
+	if rules.DropComments {
+		res.Comments = nil
+	} else {
+		res.Comments = append([]Comment(nil), report.Comments...)
+	}
+
+	return res
+}
@@ -0,0 +1,95 @@
+package lib_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactReport(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Text = "## rendered with alice"
+	report.Comments = []lib.Comment{{Author: "bob", Text: "checked web-01"}}
+
+	rules := lib.RedactionRules{
+		HashUserNames:  true,
+		HashHostNames:  true,
+		DropPrivateIPs: true,
+		DropComments:   true,
+		Salt:           "s",
+	}
+	redacted := lib.RedactReport(report, rules)
+
+	// Redacted fields
+	assert.Equal(t, 1, len(redacted.Content.SubjectUsers))
+	for name, user := range redacted.Content.SubjectUsers {
+		assert.True(t, strings.HasPrefix(name, "redacted-"))
+		assert.Equal(t, name, user.UserName)
+		assert.Equal(t, name, user.Activities[0].Principal)
+	}
+
+	allied, ok := redacted.Content.AlliedHosts["i-0123456789"]
+	require.True(t, ok)
+	assert.NotEqual(t, "alice", allied.UserName[0])
+	assert.NotEqual(t, "web-01", allied.HostName[0])
+	assert.Equal(t, []string{}, allied.IPAddr)
+	assert.Equal(t, allied.UserName[0], allied.Activities[0].Principal)
+
+	assert.NotEqual(t, "10.1.2.3", redacted.Alert.Key)
+	require.Equal(t, 1, len(redacted.Alert.Attrs))
+	assert.Equal(t, "198.51.100.7", redacted.Alert.Attrs[0].Value)
+	assert.Equal(t, "", redacted.Text)
+	assert.Nil(t, redacted.Comments)
+
+	// Preserved fields
+	assert.Equal(t, report.ID, redacted.ID)
+	assert.Equal(t, report.Result, redacted.Result)
+	assert.Equal(t, report.Content.OpponentHosts, redacted.Content.OpponentHosts)
+	assert.Equal(t, "198.51.100.7", allied.Activities[0].RemoteAddr)
+	assert.Equal(t, []string{"security-team"}, allied.Owner)
+
+	// Original report is not modified
+	assert.Equal(t, "10.1.2.3", report.Alert.Key)
+	assert.Equal(t, 2, len(report.Alert.Attrs))
+	assert.Equal(t, []string{"alice"}, report.Content.AlliedHosts["i-0123456789"].UserName)
+	assert.Equal(t, []string{"10.1.2.3"}, report.Content.AlliedHosts["i-0123456789"].IPAddr)
+	assert.Contains(t, report.Content.SubjectUsers, "alice")
+	assert.Equal(t, 1, len(report.Comments))
+}
+
+func TestRedactReportConsistentHash(t *testing.T) {
+	report := loadFixtureReport(t)
+	rules := lib.RedactionRules{HashUserNames: true, Salt: "s"}
+
+	r1 := lib.RedactReport(report, rules)
+	r2 := lib.RedactReport(report, rules)
+	assert.Equal(t, r1.Content.SubjectUsers, r2.Content.SubjectUsers)
+
+	rules.Salt = "t"
+	r3 := lib.RedactReport(report, rules)
+	assert.NotEqual(t, r1.Content.SubjectUsers, r3.Content.SubjectUsers)
+
+	// Host names and addresses are kept if not configured.
+	allied := r1.Content.AlliedHosts["i-0123456789"]
+	assert.Equal(t, []string{"web-01"}, allied.HostName)
+	assert.Equal(t, []string{"10.1.2.3"}, allied.IPAddr)
+}
+
+func TestParseRedactionRules(t *testing.T) {
+	rules, err := lib.ParseRedactionRules("")
+	require.NoError(t, err)
+	assert.Equal(t, lib.RedactionRules{}, *rules)
+
+	rules, err = lib.ParseRedactionRules(`{"hash_usernames":true,"drop_private_ips":true,"salt":"x"}`)
+	require.NoError(t, err)
+	assert.True(t, rules.HashUserNames)
+	assert.True(t, rules.DropPrivateIPs)
+	assert.False(t, rules.HashHostNames)
+	assert.Equal(t, "x", rules.Salt)
+
+	_, err = lib.ParseRedactionRules("{")
+	assert.IsType(t, &lib.ConfigError{}, err)
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReportCycle is returned when linking reports makes a cycle, e.g. a
+// report becomes a child of its own descendant.
+var ErrReportCycle = errors.New("Linking reports makes a cycle")
+
+// maxReportDepth limits walking up parents to detect cycles in case stored
+// links are already broken.
+const maxReportDepth = 100
+
+// LinkChild links child to the report as a child. Both reports are modified.
+// A child already linked to another parent must be unlinked first.
+func (x *Report) LinkChild(child *Report) error {
+	if x.ID == child.ID || (x.ParentID != nil && *x.ParentID == child.ID) {
+		return ErrReportCycle
+	}
+	if child.ParentID != nil && *child.ParentID != x.ID {
+		return NewConfigError(fmt.Sprintf("Report %s already has parent %s", child.ID, *child.ParentID))
+	}
+
+	parentID := x.ID
+	child.ParentID = &parentID
+	for _, id := range x.ChildIDs {
+		if id == child.ID {
+			return nil
+		}
+	}
+	x.ChildIDs = append(x.ChildIDs, child.ID)
+	return nil
+}
+
+// Unlink removes link between the report and child. Both reports are
+// modified. False is returned if they are not linked.
+func (x *Report) Unlink(child *Report) bool {
+	found := false
+	var childIDs []ReportID
+	for _, id := range x.ChildIDs {
+		if id == child.ID {
+			found = true
+		} else {
+			childIDs = append(childIDs, id)
+		}
+	}
+	x.ChildIDs = childIDs
+
+	if child.ParentID != nil && *child.ParentID == x.ID {
+		child.ParentID = nil
+		found = true
+	}
+	return found
+}
+
+// isAncestor returns true if ancestorID is the report or one of its parents
+// in the report table.
+func isAncestor(tableName, region string, report *Report, ancestorID ReportID) (bool, error) {
+	for depth := 0; depth < maxReportDepth; depth++ {
+		if report.ID == ancestorID {
+			return true, nil
+		}
+		if report.ParentID == nil {
+			return false, nil
+		}
+
+		parent, err := LoadReport(tableName, region, *report.ParentID)
+		if err == ErrReportNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		report = parent
+	}
+	return false, fmt.Errorf("Parents of report %s are deeper than %d", report.ID, maxReportDepth)
+}
+
+// LinkReports links childID to parentID as a child in the report table.
+// ErrReportCycle is returned if parentID is childID or its descendant.
+func LinkReports(tableName, region string, parentID, childID ReportID) (err error) {
+	span := StartTrace("LinkReports")
+	defer func() { span.End(err) }()
+
+	parent, err := LoadReport(tableName, region, parentID)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to load parent report %s", parentID)
+	}
+	child, err := LoadReport(tableName, region, childID)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to load child report %s", childID)
+	}
+
+	cycle, err := isAncestor(tableName, region, parent, childID)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return ErrReportCycle
+	}
+
+	if err := parent.LinkChild(child); err != nil {
+		return err
+	}
+	return OpenReportTable(region, tableName, "").LinkReport(parentID, childID)
+}
+
+// UnlinkReports removes link between parentID and childID in the report
+// table. Nothing is updated if they are not linked.
+func UnlinkReports(tableName, region string, parentID, childID ReportID) (err error) {
+	span := StartTrace("UnlinkReports")
+	defer func() { span.End(err) }()
+
+	parent, err := LoadReport(tableName, region, parentID)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to load parent report %s", parentID)
+	}
+	child, err := LoadReport(tableName, region, childID)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to load child report %s", childID)
+	}
+
+	if !parent.Unlink(child) {
+		return nil
+	}
+	return OpenReportTable(region, tableName, "").UnlinkReport(parentID, childID)
+}
@@ -0,0 +1,116 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func relationFixture(t *testing.T, ids ...lib.ReportID) *mockReportTable {
+	table := &mockReportTable{}
+	for _, id := range ids {
+		record, err := lib.NewReportRecord(lib.Report{ID: id}, "ap-northeast-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+	return table
+}
+
+func loadRelation(t *testing.T, id lib.ReportID) *lib.Report {
+	report, err := lib.LoadReport("reports", "ap-northeast-1", id)
+	require.NoError(t, err)
+	return report
+}
+
+func TestReportLinkChild(t *testing.T) {
+	parent := lib.Report{ID: "p"}
+	child := lib.Report{ID: "c"}
+
+	require.NoError(t, parent.LinkChild(&child))
+	require.NoError(t, parent.LinkChild(&child))
+	assert.Equal(t, []lib.ReportID{"c"}, parent.ChildIDs)
+	require.NotNil(t, child.ParentID)
+	assert.Equal(t, lib.ReportID("p"), *child.ParentID)
+
+	assert.Equal(t, lib.ErrReportCycle, child.LinkChild(&parent))
+	assert.Equal(t, lib.ErrReportCycle, parent.LinkChild(&parent))
+
+	other := lib.Report{ID: "o"}
+	_, ok := other.LinkChild(&child).(*lib.ConfigError)
+	assert.True(t, ok)
+
+	assert.True(t, parent.Unlink(&child))
+	assert.Equal(t, 0, len(parent.ChildIDs))
+	assert.Nil(t, child.ParentID)
+	assert.False(t, parent.Unlink(&child))
+}
+
+func TestLinkReports(t *testing.T) {
+	table := relationFixture(t, "a", "b", "c")
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	require.NoError(t, lib.LinkReports("reports", "ap-northeast-1", "a", "b"))
+	require.NoError(t, lib.LinkReports("reports", "ap-northeast-1", "a", "c"))
+
+	assert.Equal(t, []lib.ReportID{"b", "c"}, loadRelation(t, "a").ChildIDs)
+	for _, id := range []lib.ReportID{"b", "c"} {
+		child := loadRelation(t, id)
+		require.NotNil(t, child.ParentID)
+		assert.Equal(t, lib.ReportID("a"), *child.ParentID)
+	}
+
+	require.NoError(t, lib.UnlinkReports("reports", "ap-northeast-1", "a", "b"))
+	assert.Equal(t, []lib.ReportID{"c"}, loadRelation(t, "a").ChildIDs)
+	assert.Nil(t, loadRelation(t, "b").ParentID)
+
+	// Unlinking reports that are not linked stores nothing.
+	n := len(table.reports)
+	require.NoError(t, lib.UnlinkReports("reports", "ap-northeast-1", "a", "b"))
+	assert.Equal(t, n, len(table.reports))
+}
+
+func TestLinkReportsRejectCycle(t *testing.T) {
+	table := relationFixture(t, "a", "b", "c")
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	require.NoError(t, lib.LinkReports("reports", "ap-northeast-1", "a", "b"))
+	require.NoError(t, lib.LinkReports("reports", "ap-northeast-1", "b", "c"))
+
+	n := len(table.reports)
+	assert.Equal(t, lib.ErrReportCycle, lib.LinkReports("reports", "ap-northeast-1", "c", "a"))
+	assert.Equal(t, lib.ErrReportCycle, lib.LinkReports("reports", "ap-northeast-1", "b", "a"))
+	assert.Equal(t, lib.ErrReportCycle, lib.LinkReports("reports", "ap-northeast-1", "a", "a"))
+	assert.Equal(t, n, len(table.reports))
+
+	err := lib.LinkReports("reports", "ap-northeast-1", "a", "missing")
+	require.Error(t, err)
+}
+
+func TestSaveReportKeepsLinks(t *testing.T) {
+	table := lib.NewMemoryReportTable()
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable { return table }
+	defer func() { lib.OpenReportTable = orig }()
+
+	for _, id := range []lib.ReportID{"a", "b"} {
+		require.NoError(t, lib.SaveReport("reports", "ap-northeast-1", lib.Report{ID: id}))
+	}
+
+	// A report read before linking, e.g. by compiler, does not overwrite
+	// links when it is saved.
+	stale := loadRelation(t, "a")
+	require.NoError(t, lib.LinkReports("reports", "ap-northeast-1", "a", "b"))
+	stale.Result.Severity = lib.SevUrgent
+	require.NoError(t, lib.SaveReport("reports", "ap-northeast-1", *stale))
+
+	stored := loadRelation(t, "a")
+	assert.Equal(t, lib.SevUrgent, stored.Result.Severity)
+	assert.Equal(t, []lib.ReportID{"b"}, stored.ChildIDs)
+
+	require.NoError(t, lib.UnlinkReports("reports", "ap-northeast-1", "a", "b"))
+	require.NoError(t, lib.SaveReport("reports", "ap-northeast-1", *stored))
+	assert.Empty(t, loadRelation(t, "a").ChildIDs)
+	assert.Nil(t, loadRelation(t, "b").ParentID)
+}
@@ -0,0 +1,514 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// RenderMarkDown renders the report as a Markdown document. Output is
+// deterministic for same report: hosts and users are sorted by ID.
+func RenderMarkDown(report Report) string {
+	lines := []string{fmt.Sprintf("## %s", report.Alert.Title()), ""}
+
+	summary := NewList()
+	summary.Append(fmt.Sprintf("Report ID: %s", report.ID))
+	summary.Append(fmt.Sprintf("Rule: %s", report.Alert.Rule))
+	summary.Append(fmt.Sprintf("Key: %s", report.Alert.Key))
+	if report.Status != "" {
+		summary.Append(fmt.Sprintf("Status: %s", report.Status))
+	}
+	if report.Result.Severity != "" {
+		summary.Append(fmt.Sprintf("Severity: %s", report.Result.Severity))
+	}
+	if report.Result.Reason != "" {
+		summary.Append(fmt.Sprintf("Reason: %s", report.Result.Reason))
+	}
+	lines = append(lines, summary.toMarkDown()...)
+	lines = append(lines, "")
+
+	var sections []Section
+	if len(report.Content.OpponentHosts) > 0 {
+		sections = append(sections, renderOpponentHosts(report.Content.OpponentHosts)...)
+	}
+	if len(report.Content.AlliedHosts) > 0 {
+		sections = append(sections, renderAlliedHosts(report.Content.AlliedHosts))
+	}
+	if len(report.Content.SubjectUsers) > 0 {
+		sections = append(sections, renderSubjectUsers(report.Content.SubjectUsers))
+	}
+	if len(report.Warnings) > 0 {
+		s := NewSection("Warnings")
+		l := NewList()
+		for _, w := range report.Warnings {
+			l.Append(w)
+		}
+		s.Append(&l)
+		sections = append(sections, s)
+	}
+	if len(report.Conflicts) > 0 {
+		s := NewSection("Conflicts")
+		l := NewList()
+		for _, c := range report.Conflicts {
+			values := make([]string, len(c.Values))
+			for i, v := range c.Values {
+				values[i] = fmt.Sprintf("%s (%s)", v, c.Sources[i])
+			}
+			l.Append(fmt.Sprintf("%s of %s: %s", c.Field, c.HostID, strings.Join(values, ", ")))
+		}
+		s.Append(&l)
+		sections = append(sections, s)
+	}
+	if len(report.Comments) > 0 {
+		s := NewSection("Comments")
+		l := NewList()
+		for _, c := range report.Comments {
+			l.Append(fmt.Sprintf("%s %s: %s", c.Timestamp.Format("2006-01-02 15:04:05"), c.Author, c.Text))
+		}
+		s.Append(&l)
+		sections = append(sections, s)
+	}
+
+	for _, s := range sections {
+		lines = append(lines, s.MarkDown()...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// TruncateMarkDown cuts text at a line boundary to be shorter than maxSize
+// bytes and appends a truncation marker. Length of the marker is reserved
+// before cutting, so the result is never longer than maxSize. The marker is
+// omitted if maxSize is too small for it. The text is returned as it is if
+// maxSize is not positive or the text is short enough.
+func TruncateMarkDown(text string, maxSize int) string {
+	if maxSize <= 0 || len(text) <= maxSize {
+		return text
+	}
+
+	marker := fmt.Sprintf("\n\n*(truncated, original size is %d bytes)*\n", len(text))
+	if len(marker) > maxSize {
+		marker = ""
+	}
+	limit := maxSize - len(marker)
+
+	cut := strings.LastIndex(text[:limit], "\n")
+	if cut < 0 {
+		// A multi-byte character is not split.
+		cut = limit
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+	}
+
+	return text[:cut] + marker
+}
+
+func mdCell(items ...string) string {
+	return strings.Replace(strings.Join(items, ", "), "|", "\\|", -1)
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func renderOpponentHosts(hosts map[string]ReportOpponentHost) []Section {
+	var ids []string
+	for id := range hosts {
+		ids = append(ids, id)
+	}
+	ids = sortedKeys(ids)
+
+	hostSection := NewSection("Remote Hosts")
+	tbl := NewTable()
+	for _, h := range []string{"ID", "IP Address", "Country", "AS Owner", "Malware", "Domains", "URLs"} {
+		tbl.Head.AddItem(h)
+	}
+
+	malwareTbl := NewTable()
+	for _, h := range []string{"Host", "SHA256", "Detected", "Relation"} {
+		malwareTbl.Head.AddItem(h)
+	}
+
+	domains := NewList()
+	urls := NewList()
+
+	for _, id := range ids {
+		host := hosts[id]
+
+		row := NewRow()
+		row.AddItem(mdCell(host.ID))
+		row.AddItem(mdCell(host.IPAddr...))
+		row.AddItem(mdCell(host.Country...))
+		row.AddItem(mdCell(host.ASOwner...))
+		row.AddItem(fmt.Sprintf("%d", len(host.RelatedMalware)))
+		row.AddItem(fmt.Sprintf("%d", len(host.RelatedDomains)))
+		row.AddItem(fmt.Sprintf("%d", len(host.RelatedURLs)))
+		tbl.Append(row)
+
+		for _, m := range host.RelatedMalware {
+			positives := 0
+			for _, scan := range m.Scans {
+				if scan.Positive {
+					positives++
+				}
+			}
+
+			r := NewRow()
+			r.AddItem(mdCell(host.ID))
+			r.AddItem(mdCell(m.SHA256))
+			r.AddItem(fmt.Sprintf("%d/%d", positives, len(m.Scans)))
+			r.AddItem(mdCell(m.Relation))
+			malwareTbl.Append(r)
+		}
+
+		for _, d := range host.RelatedDomains {
+			domains.Append(fmt.Sprintf("%s: `%s` (%s)", host.ID, d.Name, d.Source))
+		}
+		for _, u := range host.RelatedURLs {
+			urls.Append(fmt.Sprintf("%s: `%s` (%s)", host.ID, u.URL, u.Source))
+		}
+	}
+
+	hostSection.Append(&tbl)
+	sections := []Section{hostSection}
+
+	if len(malwareTbl.Rows) > 0 {
+		s := NewSection("Related Malware")
+		s.Append(&malwareTbl)
+		sections = append(sections, s)
+	}
+	if len(domains.items) > 0 {
+		s := NewSection("Related Domains")
+		s.Append(&domains)
+		sections = append(sections, s)
+	}
+	if len(urls.items) > 0 {
+		s := NewSection("Related URLs")
+		s.Append(&urls)
+		sections = append(sections, s)
+	}
+
+	return sections
+}
+
+func renderAlliedHosts(hosts map[string]ReportAlliedHost) Section {
+	var ids []string
+	for id := range hosts {
+		ids = append(ids, id)
+	}
+
+	s := NewSection("Local Hosts")
+	tbl := NewTable()
+	for _, h := range []string{"ID", "User", "Owner", "OS", "IP Address", "Hostname", "Software", "Activities"} {
+		tbl.Head.AddItem(h)
+	}
+
+	for _, id := range sortedKeys(ids) {
+		host := hosts[id]
+		row := NewRow()
+		row.AddItem(mdCell(host.ID))
+		row.AddItem(mdCell(host.UserName...))
+		row.AddItem(mdCell(host.Owner...))
+		row.AddItem(mdCell(host.OS...))
+		row.AddItem(mdCell(host.IPAddr...))
+		row.AddItem(mdCell(host.HostName...))
+		row.AddItem(mdCell(host.Software...))
+		row.AddItem(fmt.Sprintf("%d", len(host.Activities)))
+		tbl.Append(row)
+	}
+
+	s.Append(&tbl)
+	return s
+}
+
+func renderSubjectUsers(users map[string]ReportUser) Section {
+	var names []string
+	for name := range users {
+		names = append(names, name)
+	}
+
+	s := NewSection("Users")
+	tbl := NewTable()
+	for _, h := range []string{"User", "Service", "Action", "Target", "Remote Address", "Last Seen"} {
+		tbl.Head.AddItem(h)
+	}
+
+	for _, name := range sortedKeys(names) {
+		user := users[name]
+		if len(user.Activities) == 0 {
+			row := NewRow()
+			row.AddItem(mdCell(user.UserName))
+			for i := 0; i < 5; i++ {
+				row.AddItem("")
+			}
+			tbl.Append(row)
+		}
+		for _, act := range user.Activities {
+			row := NewRow()
+			row.AddItem(mdCell(user.UserName))
+			row.AddItem(mdCell(act.ServiceName))
+			row.AddItem(mdCell(act.Action))
+			row.AddItem(mdCell(act.Target))
+			row.AddItem(mdCell(act.RemoteAddr))
+			row.AddItem(act.LastSeen.UTC().Format("2006-01-02 15:04:05"))
+			tbl.Append(row)
+		}
+	}
+
+	s.Append(&tbl)
+	return s
+}
+
+// severityColor returns RGB color code of the severity for publishers.
+func severityColor(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "#d50200"
+	case SevUnclassified:
+		return "#daa038"
+	case SevSafe:
+		return "#2eb886"
+	default:
+		return "#cccccc"
+	}
+}
+
+// TimelineEvent is an event related to the report.
+type TimelineEvent struct {
+	Time        time.Time
+	Description string
+}
+
+// Timeline returns events of the alert and activities of local hosts and users
+// in chronological order. Events without timestamp are skipped.
+func (x *Report) Timeline() []TimelineEvent {
+	var events []TimelineEvent
+	add := func(t time.Time, desc string) {
+		if !t.IsZero() {
+			events = append(events, TimelineEvent{Time: t.UTC(), Description: desc})
+		}
+	}
+	epoch := func(sec float64) time.Time {
+		if sec <= 0 {
+			return time.Time{}
+		}
+		return time.Unix(int64(sec), 0)
+	}
+
+	add(epoch(x.Alert.Timestamp.Init), "Alert first detected")
+	if x.Alert.Timestamp.Last != x.Alert.Timestamp.Init {
+		add(epoch(x.Alert.Timestamp.Last), "Alert last detected")
+	}
+	add(x.ReceivedAt, "Alert received")
+
+	activity := func(subject string, act ReportActivity) string {
+		desc := fmt.Sprintf("%s: %s %s", subject, act.ServiceName, act.Action)
+		if act.Target != "" {
+			desc += " to " + act.Target
+		}
+		if act.RemoteAddr != "" {
+			desc += " from " + act.RemoteAddr
+		}
+		return desc
+	}
+
+	var hostIDs []string
+	for id := range x.Content.AlliedHosts {
+		hostIDs = append(hostIDs, id)
+	}
+	for _, id := range sortedKeys(hostIDs) {
+		for _, act := range x.Content.AlliedHosts[id].Activities {
+			add(act.LastSeen, activity(id, act))
+		}
+	}
+
+	var userNames []string
+	for name := range x.Content.SubjectUsers {
+		userNames = append(userNames, name)
+	}
+	for _, name := range sortedKeys(userNames) {
+		for _, act := range x.Content.SubjectUsers[name].Activities {
+			add(act.LastSeen, activity(name, act))
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
+
+// plural returns count and the word in plural form if n is not 1, e.g.
+// "2 malicious hashes".
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	for _, suffix := range []string{"s", "x", "z", "ch", "sh"} {
+		if strings.HasSuffix(word, suffix) {
+			return fmt.Sprintf("%d %ses", n, word)
+		}
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// MaliciousHashes returns SHA256 hashes of related malware that is detected by
+// at least one scanner. Hashes are deduplicated and sorted.
+func (x *ReportContent) MaliciousHashes() []string {
+	hashes := map[string]bool{}
+	for _, host := range x.OpponentHosts {
+		for _, m := range host.RelatedMalware {
+			for _, scan := range m.Scans {
+				if scan.Positive {
+					hashes[m.SHA256] = true
+					break
+				}
+			}
+		}
+	}
+
+	var result []string
+	for h := range hashes {
+		result = append(result, h)
+	}
+	return sortedKeys(result)
+}
+
+// Countries returns deduplicated and sorted countries of remote hosts.
+func (x *ReportContent) Countries() []string {
+	countries := map[string]bool{}
+	for _, host := range x.OpponentHosts {
+		for _, c := range host.Country {
+			if c != "" {
+				countries[c] = true
+			}
+		}
+	}
+
+	var result []string
+	for c := range countries {
+		result = append(result, c)
+	}
+	return sortedKeys(result)
+}
+
+// OneLineSummary returns a short description of the report for titles of chat
+// messages or tickets. E.g. "[URGENT] malware-detected: 2 remote hosts,
+// 1 malicious hash across RU, US"
+func (x *Report) OneLineSummary() string {
+	title := x.Alert.Rule
+	if title == "" {
+		title = x.Alert.Name
+	}
+	if x.Result.Severity != "" {
+		title = fmt.Sprintf("[%s] %s", strings.ToUpper(string(x.Result.Severity)), title)
+	}
+
+	var parts []string
+	if n := len(x.Content.OpponentHosts); n > 0 {
+		parts = append(parts, plural(n, "remote host"))
+	}
+	if n := len(x.Content.AlliedHosts); n > 0 {
+		parts = append(parts, plural(n, "local host"))
+	}
+	if n := len(x.Content.MaliciousHashes()); n > 0 {
+		parts = append(parts, plural(n, "malicious hash"))
+	}
+
+	if len(parts) == 0 {
+		return fmt.Sprintf("%s: no findings", title)
+	}
+
+	summary := fmt.Sprintf("%s: %s", title, strings.Join(parts, ", "))
+	if countries := x.Content.Countries(); len(countries) > 0 {
+		summary = fmt.Sprintf("%s across %s", summary, strings.Join(countries, ", "))
+	}
+	return summary
+}
+
+// hostEvidence is a remote host with amount of evidence for ranking.
+type hostEvidence struct {
+	host      ReportOpponentHost
+	risk      int
+	malicious int
+	related   int
+}
+
+// rankOpponentHosts returns remote hosts ordered by RiskScore and then amount
+// of evidence: malicious hashes first, then related domains and URLs.
+func rankOpponentHosts(content ReportContent) []hostEvidence {
+	var hosts []hostEvidence
+	for _, host := range content.OpponentHosts {
+		c := ReportContent{OpponentHosts: map[string]ReportOpponentHost{host.ID: host}}
+		hosts = append(hosts, hostEvidence{
+			host:      host,
+			risk:      host.RiskScore(),
+			malicious: len(c.MaliciousHashes()),
+			related:   len(host.RelatedDomains) + len(host.RelatedURLs),
+		})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		a, b := hosts[i], hosts[j]
+		if a.risk != b.risk {
+			return a.risk > b.risk
+		}
+		if a.malicious != b.malicious {
+			return a.malicious > b.malicious
+		}
+		if a.related != b.related {
+			return a.related > b.related
+		}
+		return a.host.ID < b.host.ID
+	})
+
+	return hosts
+}
+
+// TopIndicators returns descriptions of at most n remote hosts ordered by
+// risk score and amount of evidence, e.g. "198.51.100.7 (RU): 1 malicious
+// hash, 1 domain".
+func (x *Report) TopIndicators(n int) []string {
+	return x.topIndicators(n, false)
+}
+
+// topIndicators is TopIndicators with optional risk score prefix, e.g.
+// "`risk 32` 198.51.100.7 (RU): 1 malicious hash".
+func (x *Report) topIndicators(n int, withRisk bool) []string {
+	var result []string
+	for i, ind := range rankOpponentHosts(x.Content) {
+		if i >= n {
+			break
+		}
+
+		s := ind.host.ID
+		if len(ind.host.Country) > 0 {
+			s = fmt.Sprintf("%s (%s)", s, strings.Join(ind.host.Country, ", "))
+		}
+
+		var evidences []string
+		if ind.malicious > 0 {
+			evidences = append(evidences, plural(ind.malicious, "malicious hash"))
+		}
+		if n := len(ind.host.RelatedDomains); n > 0 {
+			evidences = append(evidences, plural(n, "domain"))
+		}
+		if n := len(ind.host.RelatedURLs); n > 0 {
+			evidences = append(evidences, plural(n, "URL"))
+		}
+		if len(evidences) > 0 {
+			s = fmt.Sprintf("%s: %s", s, strings.Join(evidences, ", "))
+		}
+		if withRisk {
+			s = fmt.Sprintf("`risk %d` %s", ind.risk, s)
+		}
+
+		result = append(result, s)
+	}
+
+	return result
+}
@@ -0,0 +1,156 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func loadFixtureReport(t *testing.T) lib.Report {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "report.json"))
+	require.NoError(t, err)
+
+	var report lib.Report
+	require.NoError(t, json.Unmarshal(raw, &report))
+	return report
+}
+
+// assertGolden compares actual with a golden file in testdata. The golden file
+// is overwritten by actual when the test runs with -update flag.
+func assertGolden(t *testing.T, name string, actual string) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		require.NoError(t, ioutil.WriteFile(path, []byte(actual), 0644))
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), actual)
+}
+
+// loadFullReport returns the fixture report with all optional sections such as
+// conflicts and comments for golden tests of renderers.
+func loadFullReport(t *testing.T) lib.Report {
+	report := loadFixtureReport(t)
+	report.Conflicts = []lib.Conflict{
+		{Field: "country", HostID: "198.51.100.7", Values: []string{"RU", "NL"}, Sources: []string{"geoip", "whois"}},
+	}
+	report.Comments = []lib.Comment{
+		{Author: "analyst", Text: "Confirmed with owner", Timestamp: time.Date(2019, 1, 28, 5, 0, 0, 0, time.UTC)},
+	}
+	return report
+}
+
+// emptyReport is a report issued by Receptor before inspection. All optional
+// sections are omitted.
+func emptyReport() lib.Report {
+	return lib.NewReport("r1", lib.Alert{Name: "test", Rule: "r1", Key: "k1", Description: "empty"})
+}
+
+func TestRenderMarkDownGolden(t *testing.T) {
+	report := loadFixtureReport(t)
+	assertGolden(t, "report.md", lib.RenderMarkDown(report))
+}
+
+func TestRenderMarkDownGoldenFull(t *testing.T) {
+	assertGolden(t, "report_full.md", lib.RenderMarkDown(loadFullReport(t)))
+}
+
+func TestRenderMarkDownGoldenEmpty(t *testing.T) {
+	assertGolden(t, "report_empty.md", lib.RenderMarkDown(emptyReport()))
+}
+
+func TestRenderMarkDownDeterministic(t *testing.T) {
+	report := loadFixtureReport(t)
+	text := lib.RenderMarkDown(report)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, text, lib.RenderMarkDown(report))
+	}
+}
+
+func TestRenderMarkDownEmptyReport(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Name: "test", Description: "empty"})
+	text := lib.RenderMarkDown(report)
+	assert.Contains(t, text, "## test: empty")
+	assert.NotContains(t, text, "Remote Hosts")
+}
+
+func TestTruncateMarkDown(t *testing.T) {
+	text := strings.Repeat("0123456789\n", 100)
+
+	assert.Equal(t, text, lib.TruncateMarkDown(text, 0))
+	assert.Equal(t, text, lib.TruncateMarkDown(text, len(text)))
+
+	truncated := lib.TruncateMarkDown(text, 200)
+	assert.True(t, len(truncated) <= 200)
+	assert.True(t, strings.HasPrefix(truncated, "0123456789\n"))
+	assert.Contains(t, truncated, "*(truncated, original size is 1100 bytes)*")
+}
+
+func TestTruncateMarkDownBoundary(t *testing.T) {
+	text := strings.Repeat("0123456789\n", 100)
+	marker := "\n\n*(truncated, original size is 1100 bytes)*\n"
+
+	assert.Equal(t, text, lib.TruncateMarkDown(text, len(text)))
+	for _, maxSize := range []int{len(text) - 1, 200, len(marker) + 11, len(marker) + 10, len(marker), len(marker) - 1, 1} {
+		truncated := lib.TruncateMarkDown(text, maxSize)
+		assert.True(t, len(truncated) <= maxSize, "maxSize %d: %d bytes", maxSize, len(truncated))
+	}
+
+	// The marker just fits with a line.
+	assert.Equal(t, "0123456789"+marker, lib.TruncateMarkDown(text, len(marker)+11))
+	assert.Equal(t, marker, lib.TruncateMarkDown(text, len(marker)))
+	// The marker is omitted if it does not fit.
+	assert.Equal(t, "0123", lib.TruncateMarkDown(text, 4))
+
+	// A multi-byte character is not split.
+	assert.Equal(t, "あ", lib.TruncateMarkDown("あいう", 5))
+}
+
+func TestOneLineSummary(t *testing.T) {
+	report := loadFixtureReport(t)
+	assert.Equal(t, "[URGENT] malware-detected: 2 remote hosts, 1 local host, 1 malicious hash across RU, US",
+		report.OneLineSummary())
+}
+
+func TestOneLineSummaryEmptyContent(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Rule: "port-scan"})
+	report.Result.Severity = lib.SevSafe
+	assert.Equal(t, "[SAFE] port-scan: no findings", report.OneLineSummary())
+}
+
+func TestOneLineSummaryNoResult(t *testing.T) {
+	report := lib.Report{Alert: lib.Alert{Name: "Test Detection"}}
+	assert.Equal(t, "Test Detection: no findings", report.OneLineSummary())
+
+	report.Content.OpponentHosts = map[string]lib.ReportOpponentHost{
+		"h1": {ID: "h1"},
+	}
+	assert.Equal(t, "Test Detection: 1 remote host", report.OneLineSummary())
+}
+
+func TestOneLineSummaryPlural(t *testing.T) {
+	malware := func(hash string) lib.ReportMalware {
+		return lib.ReportMalware{SHA256: hash, Scans: []lib.ReportMalwareScan{{Positive: true}}}
+	}
+	report := lib.Report{Alert: lib.Alert{Rule: "malware-detected"}}
+	report.Content.OpponentHosts = map[string]lib.ReportOpponentHost{
+		"h1": {ID: "h1", RelatedMalware: []lib.ReportMalware{malware("aaa"), malware("bbb")}},
+		"h2": {ID: "h2"},
+	}
+	report.Content.AlliedHosts = map[string]lib.ReportAlliedHost{
+		"a1": {ID: "a1"},
+		"a2": {ID: "a2"},
+	}
+	assert.Equal(t, "malware-detected: 2 remote hosts, 2 local hosts, 2 malicious hashes", report.OneLineSummary())
+}
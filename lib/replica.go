@@ -0,0 +1,429 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReportTable is a set of tables storing compiled reports and report
+// components in a region.
+type ReportTable interface {
+	PutReport(record *ReportRecord) error
+	PutComponent(component *ReportComponent) error
+	GetComponents(reportID ReportID) ([]ReportComponent, error)
+	GetComponentMeta(reportID ReportID) ([]ReportComponent, error)
+	GetReport(reportID ReportID) (*ReportRecord, error)
+	QueryReports(severity ReportSeverity, from, to time.Time) ([]ReportRecord, error)
+	DeleteReport(reportID ReportID) error
+	DeleteComponent(reportID ReportID, dataID string) error
+
+	// LinkReport and UnlinkReport update only links of the reports, so that
+	// concurrent updates of other links are not lost.
+	LinkReport(parentID, childID ReportID) error
+	UnlinkReport(parentID, childID ReportID) error
+}
+
+// ReportRecord is an item of compiled report in report table.
+type ReportRecord struct {
+	ReportID     ReportID  `dynamo:"report_id"`
+	Data         []byte    `dynamo:"data"`
+	SourceRegion string    `dynamo:"source_region"`
+	UpdatedAt    time.Time `dynamo:"updated_at"`
+	TimeToLive   time.Time `dynamo:"ttl"`
+
+	// Severity and ReceivedAt are keys of severity index for search.
+	Severity   ReportSeverity `dynamo:"severity"`
+	ReceivedAt time.Time      `dynamo:"received_at"`
+
+	// ParentID and ChildIDs are links of related reports. They are written
+	// by PutReport only when the report is created, and are updated by
+	// LinkReport and UnlinkReport after that. They take precedence over
+	// links in Data.
+	ParentID ReportID `dynamo:"parent_id,omitempty"`
+	ChildIDs []string `dynamo:"child_ids,set,omitempty"`
+}
+
+// NewReportRecord serializes the report. sourceRegion is a region where the
+// report is compiled.
+func NewReportRecord(report Report, sourceRegion string) (*ReportRecord, error) {
+	data, err := json.Marshal(&report)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report")
+	}
+
+	now := time.Now().UTC()
+	record := &ReportRecord{
+		ReportID:     report.ID,
+		Data:         data,
+		SourceRegion: sourceRegion,
+		UpdatedAt:    now,
+		TimeToLive:   now.Add(ReportTTL.TTL(report.Result.Severity)),
+		Severity:     report.Result.Severity,
+		ReceivedAt:   report.ReceivedAt.UTC(),
+	}
+
+	// Index keys must not be empty.
+	if record.Severity == "" {
+		record.Severity = SevUnclassified
+	}
+	if record.ReceivedAt.IsZero() {
+		record.ReceivedAt = now
+	}
+
+	if report.ParentID != nil {
+		record.ParentID = *report.ParentID
+	}
+	for _, id := range report.ChildIDs {
+		record.ChildIDs = append(record.ChildIDs, string(id))
+	}
+	return record, nil
+}
+
+// Report deserializes the report and applies links of the record.
+func (x *ReportRecord) Report() (*Report, error) {
+	var report Report
+	if err := json.Unmarshal(x.Data, &report); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Invalid report data: "+string(x.ReportID))
+	}
+	report.EnsureMaps()
+
+	report.ParentID = nil
+	if x.ParentID != "" {
+		parentID := x.ParentID
+		report.ParentID = &parentID
+	}
+	report.ChildIDs = nil
+	for _, id := range x.ChildIDs {
+		report.ChildIDs = append(report.ChildIDs, ReportID(id))
+	}
+	return &report, nil
+}
+
+// isConditionalCheckFailed returns true if a conditional write is rejected.
+func isConditionalCheckFailed(err error) bool {
+	awsErr, ok := errors.Cause(err).(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+type dynamoReportTable struct {
+	region      string
+	reportTable string
+	reportData  string
+}
+
+func (x *dynamoReportTable) PutReport(record *ReportRecord) error {
+	if x.reportTable == "" {
+		return NewConfigError("Report table is not configured")
+	}
+
+	// Links of a stored report are kept because they may be updated by
+	// LinkReport or UnlinkReport after the report is read.
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	err := table.Put(record).If("attribute_not_exists($)", "report_id").Run()
+	if isConditionalCheckFailed(err) {
+		err = table.Update("report_id", record.ReportID).
+			Set("data", record.Data).
+			Set("source_region", record.SourceRegion).
+			Set("updated_at", record.UpdatedAt).
+			Set("ttl", record.TimeToLive).
+			Set("severity", record.Severity).
+			Set("received_at", record.ReceivedAt).
+			Run()
+	}
+	if err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put report to %s in %s", x.reportTable, x.region))
+	}
+	return nil
+}
+
+// LinkReport sets the parent of the child before adding the child to the
+// parent, so that a parent never refers a child that does not know it. A
+// child already linked to another parent is rejected by ConfigError.
+func (x *dynamoReportTable) LinkReport(parentID, childID ReportID) error {
+	if x.reportTable == "" {
+		return NewConfigError("Report table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	err := table.Update("report_id", childID).Set("parent_id", parentID).
+		If("attribute_exists($) AND (attribute_not_exists($) OR $ = ?)", "report_id", "parent_id", "parent_id", parentID).
+		Run()
+	if isConditionalCheckFailed(err) {
+		return NewConfigError(fmt.Sprintf("Report %s is not found or already has another parent", childID))
+	}
+	if err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to link report %s to %s in %s", childID, x.reportTable, x.region))
+	}
+
+	err = table.Update("report_id", parentID).AddStringsToSet("child_ids", string(childID)).
+		If("attribute_exists($)", "report_id").
+		Run()
+	if isConditionalCheckFailed(err) {
+		return ErrReportNotFound
+	}
+	if err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to link report %s to %s in %s", parentID, x.reportTable, x.region))
+	}
+	return nil
+}
+
+// UnlinkReport removes the child from the parent before the parent of the
+// child. Missing reports and links are ignored.
+func (x *dynamoReportTable) UnlinkReport(parentID, childID ReportID) error {
+	if x.reportTable == "" {
+		return NewConfigError("Report table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	err := table.Update("report_id", parentID).DeleteStringsFromSet("child_ids", string(childID)).
+		If("attribute_exists($)", "report_id").
+		Run()
+	if err != nil && !isConditionalCheckFailed(err) {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to unlink report %s in %s in %s", parentID, x.reportTable, x.region))
+	}
+
+	err = table.Update("report_id", childID).Remove("parent_id").
+		If("$ = ?", "parent_id", parentID).
+		Run()
+	if err != nil && !isConditionalCheckFailed(err) {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to unlink report %s in %s in %s", childID, x.reportTable, x.region))
+	}
+	return nil
+}
+
+func (x *dynamoReportTable) PutComponent(component *ReportComponent) error {
+	if x.reportData == "" {
+		return NewConfigError("Report data table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.reportData)
+	if err := table.Put(component).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put report data to %s in %s", x.reportData, x.region))
+	}
+	return nil
+}
+
+func (x *dynamoReportTable) GetComponents(reportID ReportID) ([]ReportComponent, error) {
+	if x.reportData == "" {
+		return nil, NewConfigError("Report data table is not configured")
+	}
+
+	var components []ReportComponent
+	table := NewStorageDB(x.region).Table(x.reportData)
+	if err := table.Get("report_id", reportID).All(&components); err != nil {
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to fetch report data from %s in %s", x.reportData, x.region))
+	}
+	return components, nil
+}
+
+// componentMetaFields are attributes of components fetched by
+// GetComponentMeta.
+var componentMetaFields = []string{"report_id", "data_id", "content_hash", "author"}
+
+// GetComponentMeta returns components of the report with only keys,
+// ContentHash and Author. Data is neither read from the table nor from S3.
+func (x *dynamoReportTable) GetComponentMeta(reportID ReportID) ([]ReportComponent, error) {
+	if x.reportData == "" {
+		return nil, NewConfigError("Report data table is not configured")
+	}
+
+	var components []ReportComponent
+	table := NewStorageDB(x.region).Table(x.reportData)
+	if err := table.Get("report_id", reportID).Project(componentMetaFields...).All(&components); err != nil {
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to fetch report data from %s in %s", x.reportData, x.region))
+	}
+	return components, nil
+}
+
+func (x *dynamoReportTable) GetReport(reportID ReportID) (*ReportRecord, error) {
+	if x.reportTable == "" {
+		return nil, NewConfigError("Report table is not configured")
+	}
+
+	var record ReportRecord
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	if err := table.Get("report_id", reportID).One(&record); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, ErrReportNotFound
+		}
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to get report from %s in %s", x.reportTable, x.region))
+	}
+	return &record, nil
+}
+
+// QueryReports queries reports of the severity on the severity index. Reports
+// stored without severity are not in the index, so the table is scanned for
+// them if severity is empty.
+func (x *dynamoReportTable) QueryReports(severity ReportSeverity, from, to time.Time) ([]ReportRecord, error) {
+	if x.reportTable == "" {
+		return nil, NewConfigError("Report table is not configured")
+	}
+
+	var records []ReportRecord
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	if severity == "" {
+		if err := table.Scan().Filter("attribute_not_exists($)", "severity").All(&records); err != nil {
+			return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to scan reports from %s in %s", x.reportTable, x.region))
+		}
+		return receivedBetween(records, from, to), nil
+	}
+
+	err := table.Get("severity", severity).Index(ReportSeverityIndex).
+		Range("received_at", dynamo.Between, from.UTC(), to.UTC()).All(&records)
+	if err != nil {
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to query reports from %s in %s", x.reportTable, x.region))
+	}
+	return records, nil
+}
+
+func (x *dynamoReportTable) DeleteReport(reportID ReportID) error {
+	if x.reportTable == "" {
+		return NewConfigError("Report table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.reportTable)
+	if err := table.Delete("report_id", reportID).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to delete report from %s in %s", x.reportTable, x.region))
+	}
+	return nil
+}
+
+func (x *dynamoReportTable) DeleteComponent(reportID ReportID, dataID string) error {
+	if x.reportData == "" {
+		return NewConfigError("Report data table is not configured")
+	}
+
+	table := NewStorageDB(x.region).Table(x.reportData)
+	if err := table.Delete("report_id", reportID).Range("data_id", dataID).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to delete report data from %s in %s", x.reportData, x.region))
+	}
+	return nil
+}
+
+// OpenReportTable returns ReportTable of DynamoDB, or of memory if
+// ReportStoreBackend is "memory". It can be replaced for testing.
+var OpenReportTable = func(region, reportTable, reportDataTable string) ReportTable {
+	if ReportStoreBackend == "memory" {
+		return memoryReportTables
+	}
+	return &dynamoReportTable{
+		region:      region,
+		reportTable: reportTable,
+		reportData:  reportDataTable,
+	}
+}
+
+// SaveReport stores the compiled report into the report table.
+func SaveReport(tableName, region string, report Report) (err error) {
+	span := StartTrace("SaveReport")
+	defer func() { span.End(err) }()
+
+	return OpenReportStore(region, tableName, "").SaveReport(report)
+}
+
+// LoadReport returns the report stored in the report table.
+// ErrReportNotFound is returned if the report is not stored.
+func LoadReport(tableName, region string, reportID ReportID) (*Report, error) {
+	return OpenReportStore(region, tableName, "").GetReport(reportID)
+}
+
+var (
+	// ReplicaReportTable and ReplicaReportData are names of tables in the
+	// secondary region.
+	ReplicaReportTable = ResolveTableName(os.Getenv("REPLICA_REPORT_TABLE"))
+	ReplicaReportData  = ResolveTableName(os.Getenv("REPLICA_REPORT_DATA"))
+
+	// ReplicaPageBucket is S3 bucket in the secondary region to store large
+	// pages of replicated reports. Large pages are not replicated if empty,
+	// because pages in PageBucket are not readable after the primary region
+	// is down.
+	ReplicaPageBucket = os.Getenv("REPLICA_PAGE_BUCKET")
+)
+
+// ReplicaPageS3 is S3 client for ReplicaPageBucket. A client of the
+// secondary region is created if nil.
+var ReplicaPageS3 s3iface.S3API
+
+// ReplicationError has all errors of a replication.
+type ReplicationError struct {
+	Errors []error
+}
+
+func (x *ReplicationError) Error() string {
+	msgs := make([]string, len(x.Errors))
+	for i, err := range x.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("Fail to replicate %d item(s): %s", len(x.Errors), strings.Join(msgs, "; "))
+}
+
+// ReplicateReport writes the report and its pages to tables of the secondary
+// region. It is best-effort: all items are tried to be written and failures
+// are returned together as *ReplicationError. DataID of a replicated page is
+// derived from its content, so retried replication overwrites the same items.
+func ReplicateReport(report Report, pages []*ReportPage, primaryRegion, secondaryRegion string) (err error) {
+	span := StartTrace("ReplicateReport")
+	defer func() { span.End(err) }()
+
+	if secondaryRegion == "" || secondaryRegion == primaryRegion {
+		return NewConfigError(fmt.Sprintf("Invalid secondary region for replication: '%s'", secondaryRegion))
+	}
+
+	table := OpenReportTable(secondaryRegion, ReplicaReportTable, ReplicaReportData)
+	newReplicaS3 := func() s3iface.S3API {
+		if ReplicaPageS3 != nil {
+			return ReplicaPageS3
+		}
+		return s3.New(newSession(secondaryRegion))
+	}
+	var errs []error
+
+	record, err := NewReportRecord(report, primaryRegion)
+	if err == nil {
+		err = table.PutReport(record)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// SubmittedAt is shifted for each page to keep order of pages.
+	base := time.Now().UTC()
+	for i, page := range pages {
+		if page == nil {
+			continue
+		}
+
+		component := &ReportComponent{ReportID: report.ID}
+		if err := component.setPage(*page, ReplicaPageBucket, newReplicaS3); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		component.SubmittedAt = base.Add(time.Duration(i) * time.Microsecond)
+		component.TimeToLive = base.Add(ReportTTL.TTL(report.Result.Severity))
+
+		if err := table.PutComponent(component); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		Logger.WithFields(report.LogFields()).WithFields(logrus.Fields{
+			"region": secondaryRegion,
+			"errors": len(errs),
+		}).Warn("Replication is partially failed")
+		return &ReplicationError{Errors: errs}
+	}
+
+	return nil
+}
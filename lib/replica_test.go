@@ -0,0 +1,266 @@
+package lib_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockReportTable struct {
+	reports    []*lib.ReportRecord
+	components []*lib.ReportComponent
+	fail       bool
+
+	// throttle is number of following PutComponent and GetComponents calls
+	// that fail by throttling. calls counts them including failures.
+	throttle int
+	calls    int
+}
+
+func (x *mockReportTable) throttled() error {
+	x.calls++
+	if x.throttle > 0 {
+		x.throttle--
+		return awserr.New("ProvisionedThroughputExceededException", "throttled", nil)
+	}
+	return nil
+}
+
+func (x *mockReportTable) PutReport(record *lib.ReportRecord) error {
+	if x.fail {
+		return errors.New("put report failed")
+	}
+	if stored, err := x.GetReport(record.ReportID); err == nil {
+		record.ParentID, record.ChildIDs = stored.ParentID, stored.ChildIDs
+	}
+	x.reports = append(x.reports, record)
+	return nil
+}
+
+func (x *mockReportTable) LinkReport(parentID, childID lib.ReportID) error {
+	parent, err := x.GetReport(parentID)
+	if err != nil {
+		return err
+	}
+	child, err := x.GetReport(childID)
+	if err != nil {
+		return err
+	}
+	child.ParentID = parentID
+	for _, id := range parent.ChildIDs {
+		if id == string(childID) {
+			return nil
+		}
+	}
+	parent.ChildIDs = append(parent.ChildIDs, string(childID))
+	return nil
+}
+
+func (x *mockReportTable) UnlinkReport(parentID, childID lib.ReportID) error {
+	if parent, err := x.GetReport(parentID); err == nil {
+		var childIDs []string
+		for _, id := range parent.ChildIDs {
+			if id != string(childID) {
+				childIDs = append(childIDs, id)
+			}
+		}
+		parent.ChildIDs = childIDs
+	}
+	if child, err := x.GetReport(childID); err == nil && child.ParentID == parentID {
+		child.ParentID = ""
+	}
+	return nil
+}
+
+func (x *mockReportTable) PutComponent(component *lib.ReportComponent) error {
+	if x.fail {
+		return errors.New("put component failed")
+	}
+	if err := x.throttled(); err != nil {
+		return err
+	}
+	x.components = append(x.components, component)
+	return nil
+}
+
+func (x *mockReportTable) GetComponents(reportID lib.ReportID) ([]lib.ReportComponent, error) {
+	if x.fail {
+		return nil, errors.New("get components failed")
+	}
+	if err := x.throttled(); err != nil {
+		return nil, err
+	}
+	var components []lib.ReportComponent
+	for _, c := range x.components {
+		if c.ReportID == reportID {
+			components = append(components, *c)
+		}
+	}
+	return components, nil
+}
+
+func (x *mockReportTable) GetComponentMeta(reportID lib.ReportID) ([]lib.ReportComponent, error) {
+	return x.GetComponents(reportID)
+}
+
+func (x *mockReportTable) GetReport(reportID lib.ReportID) (*lib.ReportRecord, error) {
+	if x.fail {
+		return nil, errors.New("get report failed")
+	}
+	for i := len(x.reports) - 1; i >= 0; i-- {
+		if x.reports[i].ReportID == reportID {
+			return x.reports[i], nil
+		}
+	}
+	return nil, lib.ErrReportNotFound
+}
+
+func (x *mockReportTable) QueryReports(severity lib.ReportSeverity, from, to time.Time) ([]lib.ReportRecord, error) {
+	if x.fail {
+		return nil, errors.New("query reports failed")
+	}
+	var records []lib.ReportRecord
+	for _, r := range x.reports {
+		if r.Severity == severity && !r.ReceivedAt.Before(from) && !r.ReceivedAt.After(to) {
+			records = append(records, *r)
+		}
+	}
+	return records, nil
+}
+
+func (x *mockReportTable) DeleteReport(reportID lib.ReportID) error {
+	if x.fail {
+		return errors.New("delete report failed")
+	}
+	var reports []*lib.ReportRecord
+	for _, r := range x.reports {
+		if r.ReportID != reportID {
+			reports = append(reports, r)
+		}
+	}
+	x.reports = reports
+	return nil
+}
+
+func (x *mockReportTable) DeleteComponent(reportID lib.ReportID, dataID string) error {
+	if x.fail {
+		return errors.New("delete component failed")
+	}
+	if err := x.throttled(); err != nil {
+		return err
+	}
+	var components []*lib.ReportComponent
+	for _, c := range x.components {
+		if c.ReportID != reportID || c.DataID != dataID {
+			components = append(components, c)
+		}
+	}
+	x.components = components
+	return nil
+}
+
+func mockReportTables(tables map[string]*mockReportTable) func() {
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable {
+		return tables[region]
+	}
+	return func() { lib.OpenReportTable = orig }
+}
+
+func replicaFixture(t *testing.T) (lib.Report, []*lib.ReportPage) {
+	report := loadFixtureReport(t)
+	p1 := lib.NewReportPage()
+	p1.Author = "inspector-a"
+	p1.ReportID = report.ID
+	p2 := lib.NewReportPage()
+	p2.Author = "inspector-b"
+	p2.ReportID = report.ID
+	return report, []*lib.ReportPage{&p1, &p2}
+}
+
+func TestReplicateReport(t *testing.T) {
+	primary := &mockReportTable{}
+	secondary := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{
+		"ap-northeast-1": primary,
+		"us-west-2":      secondary,
+	})()
+
+	report, pages := replicaFixture(t)
+	require.NoError(t, lib.SaveReport("reports", "ap-northeast-1", report))
+	require.NoError(t, lib.ReplicateReport(report, pages, "ap-northeast-1", "us-west-2"))
+
+	require.Equal(t, 1, len(primary.reports))
+	require.Equal(t, 1, len(secondary.reports))
+	assert.Equal(t, primary.reports[0].Data, secondary.reports[0].Data)
+	assert.Equal(t, report.ID, secondary.reports[0].ReportID)
+	assert.Equal(t, "ap-northeast-1", secondary.reports[0].SourceRegion)
+
+	require.Equal(t, 2, len(secondary.components))
+	assert.Equal(t, "inspector-a", secondary.components[0].Page().Author)
+	assert.Equal(t, "inspector-b", secondary.components[1].Page().Author)
+	assert.True(t, secondary.components[0].SubmittedAt.Before(secondary.components[1].SubmittedAt))
+	assert.Equal(t, 0, len(primary.components))
+}
+
+func TestReplicateReportDeterministicDataID(t *testing.T) {
+	secondary := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"us-west-2": secondary})()
+
+	// Retried replication writes pages to the same items.
+	report, pages := replicaFixture(t)
+	require.NoError(t, lib.ReplicateReport(report, pages, "ap-northeast-1", "us-west-2"))
+	require.NoError(t, lib.ReplicateReport(report, pages, "ap-northeast-1", "us-west-2"))
+	require.Equal(t, 4, len(secondary.components))
+	assert.Equal(t, secondary.components[0].DataID, secondary.components[2].DataID)
+	assert.Equal(t, secondary.components[1].DataID, secondary.components[3].DataID)
+	assert.NotEqual(t, secondary.components[0].DataID, secondary.components[1].DataID)
+	assert.Equal(t, secondary.components[0].ContentHash, secondary.components[0].DataID)
+}
+
+func TestReplicateReportOffloadToReplicaBucket(t *testing.T) {
+	secondary := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"us-west-2": secondary})()
+	pageClient, restore := offloadFixture(t, 1024)
+	defer restore()
+	replicaClient := &mockS3{}
+	origBucket := lib.ReplicaPageBucket
+	lib.ReplicaPageS3, lib.ReplicaPageBucket = replicaClient, "replica-pages"
+	defer func() { lib.ReplicaPageS3, lib.ReplicaPageBucket = nil, origBucket }()
+
+	report := loadFixtureReport(t)
+	page := largePage(report.ID, 100)
+	require.NoError(t, lib.ReplicateReport(report, []*lib.ReportPage{&page}, "ap-northeast-1", "us-west-2"))
+
+	require.Equal(t, 1, len(secondary.components))
+	component := secondary.components[0]
+	assert.Equal(t, "s3://replica-pages/"+lib.PageKey(report.ID, component.DataID), component.DataRef)
+	assert.Equal(t, 1, len(replicaClient.puts))
+	assert.Equal(t, 0, len(pageClient.puts))
+}
+
+func TestReplicateReportAggregateErrors(t *testing.T) {
+	secondary := &mockReportTable{fail: true}
+	defer mockReportTables(map[string]*mockReportTable{"us-west-2": secondary})()
+
+	report, pages := replicaFixture(t)
+	err := lib.ReplicateReport(report, pages, "ap-northeast-1", "us-west-2")
+	require.Error(t, err)
+
+	replErr, ok := err.(*lib.ReplicationError)
+	require.True(t, ok)
+	assert.Equal(t, 3, len(replErr.Errors))
+}
+
+func TestReplicateReportSameRegion(t *testing.T) {
+	report, pages := replicaFixture(t)
+	err := lib.ReplicateReport(report, pages, "ap-northeast-1", "ap-northeast-1")
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
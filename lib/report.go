@@ -1,14 +1,17 @@
 package lib
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-
+	"net"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/guregu/dynamo"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
@@ -31,16 +34,112 @@ type Report struct {
 	// published: When publisher receives report with result, report status
 	//            is "published".
 	//
+
+	// ReceivedAt is ingestion time of the alert that issued the report.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// AccountID is copied from the alert.
+	AccountID string `json:"account_id,omitempty"`
+
+	// Warnings has notes about incompleteness of the report, e.g. some
+	// inspectors did not submit results in time.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Text is a Markdown rendering of the report by compiler for publishers
+	// that post the report as it is.
+	Text string `json:"text,omitempty"`
+
+	// Comments are notes by analysts. They are stored apart from pages and
+	// attached to the report in every compilation.
+	Comments []Comment `json:"comments,omitempty"`
+
+	// CorrelationID is copied from the alert to trace the report in logs.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Conflicts are disagreements between pages found in compilation.
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+
+	// Countries is number of hosts by ISO 3166-1 alpha-2 country code. It is
+	// set by CountryCounts of Content in compilation.
+	Countries map[string]int `json:"countries,omitempty"`
+
+	// Occurrences is number of alerts grouped into the report when Receptor
+	// handles the alert.
+	Occurrences int `json:"occurrences,omitempty"`
+
+	// Labels categorize the report, e.g. "phishing". They are normalized to
+	// lower case by AddLabel.
+	Labels []string `json:"labels,omitempty"`
+
+	// ContributedBy is sorted names of inspectors that submitted pages of the
+	// report, and ContributorCount is the number of them. They are set by
+	// SetContributors in compilation.
+	ContributedBy    []string `json:"contributors,omitempty"`
+	ContributorCount int      `json:"contributor_count,omitempty"`
+
+	// ExpectedAuthors is names of inspectors that should contribute to the
+	// report. It is set by Receptor by alert rule of the report.
+	ExpectedAuthors []string `json:"expected_authors,omitempty"`
+
+	// ParentID and ChildIDs link related reports. They are updated by
+	// LinkReports and UnlinkReports to keep both ends consistent.
+	ParentID *ReportID  `json:"parent_id,omitempty"`
+	ChildIDs []ReportID `json:"child_ids,omitempty"`
+
+	// MergedFrom has IDs of duplicate reports merged into the report, and
+	// MergedInto is ID of the report that a merged duplicate is merged into.
+	MergedFrom []ReportID `json:"merged_from,omitempty"`
+	MergedInto *ReportID  `json:"merged_into,omitempty"`
+
+	// PublishedSeverity is severity of the report in the last publication.
+	// EscalatedFrom is set by PublishRouter when severity of the report is
+	// higher than PublishedSeverity.
+	PublishedSeverity ReportSeverity `json:"published_severity,omitempty"`
+	EscalatedFrom     ReportSeverity `json:"escalated_from,omitempty"`
+}
+
+// SetContributors records distinct authors of the pages as contributors of
+// the report. Pages without author are ignored.
+func (x *Report) SetContributors(pages []*ReportPage) {
+	seen := map[string]bool{}
+	var authors []string
+	for _, page := range pages {
+		if page == nil || page.Author == "" || seen[page.Author] {
+			continue
+		}
+		seen[page.Author] = true
+		authors = append(authors, page.Author)
+	}
+	sort.Strings(authors)
+
+	x.ContributedBy = authors
+	x.ContributorCount = len(authors)
 }
 
-// IsNew and IsPublished returns status of the report
+// Contributors returns names of inspectors that contributed to the report.
+func (x *Report) Contributors() []string {
+	return x.ContributedBy
+}
+
+// LogFields returns structured log fields to identify the report.
+func (x *Report) LogFields() log.Fields {
+	return log.Fields{
+		"report_id":    x.ID,
+		CorrelationKey: x.CorrelationID,
+	}
+}
+
+// IsNew, IsPublished and IsClosed returns status of the report
 func (x *Report) IsNew() bool       { return x.Status == StatusNew }
 func (x *Report) IsPublished() bool { return x.Status == StatusPublished }
+func (x *Report) IsClosed() bool    { return x.Status == StatusClosed }
 
 const (
 	StatusNew       ReportStatus = "new"
 	StatusOngoing   ReportStatus = "ongoing"
 	StatusPublished ReportStatus = "published"
+	// StatusClosed means that the incident of the report has been resolved.
+	StatusClosed ReportStatus = "closed"
 )
 
 type ReportContent struct {
@@ -57,6 +156,51 @@ func newReportContent() ReportContent {
 	}
 }
 
+// ensureMaps initializes nil maps of the content.
+func (x *ReportContent) ensureMaps() {
+	if x.OpponentHosts == nil {
+		x.OpponentHosts = map[string]ReportOpponentHost{}
+	}
+	if x.AlliedHosts == nil {
+		x.AlliedHosts = map[string]ReportAlliedHost{}
+	}
+	if x.SubjectUsers == nil {
+		x.SubjectUsers = map[string]ReportUser{}
+	}
+}
+
+// EnsureMaps initializes nil maps of the report content. Reports deserialized
+// from older data may lack some sections, and writing to them would panic.
+func (x *Report) EnsureMaps() {
+	x.Content.ensureMaps()
+}
+
+// Merge unions hosts and users of s into the content. Values of the same host
+// or user are concatenated.
+func (x *ReportContent) Merge(s ReportContent) {
+	x.ensureMaps()
+
+	// Hosts are merged into zero value for new ID as well so that values are
+	// copied and not shared with s.
+	for id, h := range s.OpponentHosts {
+		dst := x.OpponentHosts[id]
+		dst.Merge(h)
+		x.OpponentHosts[id] = dst
+	}
+	for id, h := range s.AlliedHosts {
+		dst := x.AlliedHosts[id]
+		dst.Merge(h)
+		x.AlliedHosts[id] = dst
+	}
+	for name, u := range s.SubjectUsers {
+		if dst, ok := x.SubjectUsers[name]; ok {
+			dst.Merge(u)
+			u = dst
+		}
+		x.SubjectUsers[name] = u
+	}
+}
+
 type ReportPage struct {
 	Title         string               `json:"title"`
 	AlliedHosts   []ReportAlliedHost   `json:"allied_hosts"`
@@ -66,6 +210,34 @@ type ReportPage struct {
 	ReportID      ReportID             `json:"report_id"`
 }
 
+// EnsureSlices initializes nil slices of the page so that a page of older
+// data is serialized with empty sections as a new page.
+func (x *ReportPage) EnsureSlices() {
+	if x.AlliedHosts == nil {
+		x.AlliedHosts = []ReportAlliedHost{}
+	}
+	if x.OpponentHosts == nil {
+		x.OpponentHosts = []ReportOpponentHost{}
+	}
+	if x.SubjectUser == nil {
+		x.SubjectUser = []ReportUser{}
+	}
+}
+
+// observeSeen sets unknown FirstSeen and LastSeen of hosts in the page at
+// ingest. now is time of submission and nothing is set if it is zero.
+func (x *ReportPage) observeSeen(now time.Time) {
+	if now.IsZero() {
+		return
+	}
+	for i := range x.OpponentHosts {
+		x.OpponentHosts[i].observeSeen(now)
+	}
+	for i := range x.AlliedHosts {
+		x.AlliedHosts[i].observeSeen(now)
+	}
+}
+
 // NewReportPage is a constructor of ReportPage
 func NewReportPage() ReportPage {
 	page := ReportPage{}
@@ -90,6 +262,63 @@ const (
 	SevSafe ReportSeverity = "safe"
 )
 
+// ParseReportSeverity parses a severity name, e.g. value of an environment
+// variable. Unknown name is ConfigError.
+func ParseReportSeverity(name string) (ReportSeverity, error) {
+	sev := ReportSeverity(strings.ToLower(strings.TrimSpace(name)))
+	if sev.Level() == 0 {
+		return "", NewConfigError("Unknown severity: " + name)
+	}
+	return sev, nil
+}
+
+// Level returns order of the severity to compare with a threshold. Higher is
+// more serious and unknown severity is 0.
+func (x ReportSeverity) Level() int {
+	switch x {
+	case SevSafe:
+		return 1
+	case SevUnclassified:
+		return 2
+	case SevUrgent:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// publishedSeverity returns severity of the report to be recorded as
+// PublishedSeverity. Empty severity is published as unclassified.
+func (x *Report) publishedSeverity() ReportSeverity {
+	if x.Result.Severity == "" {
+		return SevUnclassified
+	}
+	return x.Result.Severity
+}
+
+// Escalated returns true if severity of the report is higher than the
+// severity in the last publication. A report never published is not
+// escalated.
+func (x *Report) Escalated() bool {
+	return x.PublishedSeverity != "" && x.publishedSeverity().Level() > x.PublishedSeverity.Level()
+}
+
+// MarkPublished records current severity of the report as PublishedSeverity.
+func (x *Report) MarkPublished() {
+	x.PublishedSeverity = x.publishedSeverity()
+	x.EscalatedFrom = ""
+}
+
+// EscalationMarker returns a note of escalation, e.g. "ESCALATED from
+// unclassified to urgent". Empty string is returned if EscalatedFrom is not
+// set.
+func (x *Report) EscalationMarker() string {
+	if x.EscalatedFrom == "" {
+		return ""
+	}
+	return fmt.Sprintf("ESCALATED from %s to %s", x.EscalatedFrom, x.publishedSeverity())
+}
+
 type ReportUser struct {
 	UserName   string           `json:"username"` // Identity
 	Activities []ReportActivity `json:"activities"`
@@ -130,6 +359,60 @@ type ReportURL struct {
 	Source    string    `json:"source"`
 }
 
+// NewReportDomain is a constructor of ReportDomain. Timestamp is set to current
+// time. An error is returned if name is not a valid domain name or source is
+// empty.
+func NewReportDomain(name, source string) (*ReportDomain, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if !isDomainName(name) {
+		return nil, errors.Errorf("Invalid domain name: '%s'", name)
+	}
+	if source == "" {
+		return nil, errors.New("Source of domain is required")
+	}
+
+	return &ReportDomain{Name: name, Timestamp: time.Now().UTC(), Source: source}, nil
+}
+
+// isDomainName checks syntax of domain name roughly: labels of alphanumerics,
+// hyphens and underscores separated by dots. IP address is not a domain name.
+func isDomainName(name string) bool {
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NewReportURL is a constructor of ReportURL. Timestamp is set to current
+// time. An error is returned if rawURL is not an absolute URL with host or
+// source is empty.
+func NewReportURL(rawURL, source string) (*ReportURL, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid URL: '%s'", rawURL)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("URL must have scheme and host: '%s'", rawURL)
+	}
+	if source == "" {
+		return nil, errors.New("Source of URL is required")
+	}
+
+	return &ReportURL{URL: rawURL, Timestamp: time.Now().UTC(), Source: source}, nil
+}
+
 type ReportActivity struct {
 	ServiceName string    `json:"service_name"`
 	RemoteAddr  string    `json:"remote_addr"`
@@ -141,6 +424,7 @@ type ReportActivity struct {
 
 type ReportAlliedHost struct {
 	ID         string           `json:"id"`
+	AccountID  string           `json:"account_id,omitempty"`
 	UserName   []string         `json:"username"`
 	Owner      []string         `json:"owner"`
 	OS         []string         `json:"os"`
@@ -150,11 +434,20 @@ type ReportAlliedHost struct {
 	Country    []string         `json:"country"`
 	Software   []string         `json:"software"`
 	Activities []ReportActivity `json:"activities"`
+
+	// FirstSeen and LastSeen are period in which the host was observed in
+	// the incident. Zero means unknown.
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
 }
 
 func (x *ReportAlliedHost) Merge(s ReportAlliedHost) {
 	x.ID = s.ID
-	x.UserName = append(x.UserName, s.Country...)
+	if s.AccountID != "" {
+		x.AccountID = s.AccountID
+	}
+	widenSeen(&x.FirstSeen, &x.LastSeen, s.FirstSeen, s.LastSeen)
+	x.UserName = append(x.UserName, s.UserName...)
 	x.Owner = append(x.Owner, s.Owner...)
 	x.OS = append(x.OS, s.OS...)
 	x.IPAddr = append(x.IPAddr, s.IPAddr...)
@@ -165,55 +458,302 @@ func (x *ReportAlliedHost) Merge(s ReportAlliedHost) {
 	x.Activities = append(x.Activities, s.Activities...)
 }
 
+// widenSeen widens the period from first to last so that it covers the
+// period from sFirst to sLast. Zero time is unknown and ignored.
+func widenSeen(first, last *time.Time, sFirst, sLast time.Time) {
+	if !sFirst.IsZero() && (first.IsZero() || sFirst.Before(*first)) {
+		*first = sFirst
+	}
+	if !sLast.IsZero() && (last.IsZero() || sLast.After(*last)) {
+		*last = sLast
+	}
+}
+
+// observeSeen sets unknown FirstSeen and LastSeen of the host. Activities
+// widen the period, and the rest is filled by now.
+func (x *ReportAlliedHost) observeSeen(now time.Time) {
+	for _, activity := range x.Activities {
+		widenSeen(&x.FirstSeen, &x.LastSeen, activity.LastSeen, activity.LastSeen)
+	}
+	fillSeen(&x.FirstSeen, &x.LastSeen, now)
+}
+
+// observeSeen sets unknown FirstSeen and LastSeen of the host by now.
+func (x *ReportOpponentHost) observeSeen(now time.Time) {
+	fillSeen(&x.FirstSeen, &x.LastSeen, now)
+}
+
+// fillSeen fills zero of first and last by the other one or now.
+func fillSeen(first, last *time.Time, now time.Time) {
+	switch {
+	case first.IsZero() && last.IsZero():
+		*first, *last = now, now
+	case first.IsZero():
+		*first = *last
+	case last.IsZero():
+		*last = *first
+	}
+}
+
+// RemoteAddr is an IP address of a remote host with attributes of the address.
+type RemoteAddr struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"`
+	ASOwner string `json:"as_owner,omitempty"`
+}
+
 type ReportOpponentHost struct {
-	ID             string          `json:"id"`
+	ID        string `json:"id"`
+	AccountID string `json:"account_id,omitempty"`
+
+	// Addrs links country and AS owner to each IP address. IPAddr, Country
+	// and ASOwner are flat values without the link for backward compatibility.
+	// Use IPAddrs, Countries and ASOwners to get values of both.
+	Addrs []RemoteAddr `json:"addrs,omitempty"`
+
 	IPAddr         []string        `json:"ipaddr"`
 	Country        []string        `json:"country"`
 	ASOwner        []string        `json:"as_owner"`
 	RelatedMalware []ReportMalware `json:"related_malware"`
 	RelatedDomains []ReportDomain  `json:"related_domains"`
 	RelatedURLs    []ReportURL     `json:"related_urls"`
+
+	// FirstSeen and LastSeen are period in which the host was observed in
+	// the incident. Zero means unknown.
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
 }
 
 func (x *ReportOpponentHost) Merge(s ReportOpponentHost) {
 	x.ID = s.ID
+	if s.AccountID != "" {
+		x.AccountID = s.AccountID
+	}
+	widenSeen(&x.FirstSeen, &x.LastSeen, s.FirstSeen, s.LastSeen)
 	x.IPAddr = append(x.IPAddr, s.IPAddr...)
 	x.Country = append(x.Country, s.Country...)
 	x.ASOwner = append(x.ASOwner, s.ASOwner...)
+	// Addresses are deduplicated by IP and their values are added to flat
+	// fields if missing.
+	for _, addr := range s.Addrs {
+		x.AddAddr(addr)
+	}
 	x.RelatedMalware = append(x.RelatedMalware, s.RelatedMalware...)
 	x.RelatedDomains = append(x.RelatedDomains, s.RelatedDomains...)
 	x.RelatedURLs = append(x.RelatedURLs, s.RelatedURLs...)
 }
 
+// mergeAddr adds addr to Addrs. If the IP address already exists, its
+// attributes are overwritten by non-empty attributes of addr.
+func (x *ReportOpponentHost) mergeAddr(addr RemoteAddr) {
+	if addr.IP == "" {
+		return
+	}
+	for i := range x.Addrs {
+		if x.Addrs[i].IP != addr.IP {
+			continue
+		}
+		if addr.Country != "" {
+			x.Addrs[i].Country = addr.Country
+		}
+		if addr.ASOwner != "" {
+			x.Addrs[i].ASOwner = addr.ASOwner
+		}
+		return
+	}
+	x.Addrs = append(x.Addrs, addr)
+}
+
+// AddAddr adds the address with its attributes. The values are also added to
+// flat fields for consumers of them.
+func (x *ReportOpponentHost) AddAddr(addr RemoteAddr) {
+	x.mergeAddr(addr)
+	for _, v := range []struct {
+		dst *[]string
+		val string
+	}{{&x.IPAddr, addr.IP}, {&x.Country, addr.Country}, {&x.ASOwner, addr.ASOwner}} {
+		if v.val != "" && !stringsContain(*v.dst, v.val) {
+			*v.dst = append(*v.dst, v.val)
+		}
+	}
+}
+
+// Addr returns the address in Addrs.
+func (x *ReportOpponentHost) Addr(ip string) (RemoteAddr, bool) {
+	for _, addr := range x.Addrs {
+		if addr.IP == ip {
+			return addr, true
+		}
+	}
+	return RemoteAddr{}, false
+}
+
+// IPAddrs returns distinct IP addresses of Addrs and IPAddr.
+func (x *ReportOpponentHost) IPAddrs() []string {
+	return x.flatValues(x.IPAddr, func(addr RemoteAddr) string { return addr.IP })
+}
+
+// Countries returns distinct countries of Addrs and Country.
+func (x *ReportOpponentHost) Countries() []string {
+	return x.flatValues(x.Country, func(addr RemoteAddr) string { return addr.Country })
+}
+
+// ASOwners returns distinct AS owners of Addrs and ASOwner.
+func (x *ReportOpponentHost) ASOwners() []string {
+	return x.flatValues(x.ASOwner, func(addr RemoteAddr) string { return addr.ASOwner })
+}
+
+func (x *ReportOpponentHost) flatValues(flat []string, attr func(RemoteAddr) string) []string {
+	var values []string
+	for _, addr := range x.Addrs {
+		if v := attr(addr); v != "" && !stringsContain(values, v) {
+			values = append(values, v)
+		}
+	}
+	for _, v := range flat {
+		if v != "" && !stringsContain(values, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Weights of RiskScore. The total of maximum points is 100.
+const (
+	riskDetectionPoints = 40 // by the highest detection ratio of related malware
+	riskMalwarePoints   = 5  // per malware detected by at least one scanner
+	riskMalwareMax      = 20
+	riskDomainPoints    = 4 // per related domain
+	riskDomainMax       = 20
+	riskRelatedMax      = 20 // 1 point per related malware, domain and URL
+)
+
+// RiskScore returns 0 to 100 to prioritize remote hosts to block. It weights
+// the highest detection ratio of related malware, number of detected malware,
+// related domains and number of all related entities.
+func (x *ReportOpponentHost) RiskScore() int {
+	var ratio float64
+	detected := 0
+	for _, m := range x.RelatedMalware {
+		positives := 0
+		for _, scan := range m.Scans {
+			if scan.Positive {
+				positives++
+			}
+		}
+		if positives == 0 {
+			continue
+		}
+		detected++
+		if r := float64(positives) / float64(len(m.Scans)); r > ratio {
+			ratio = r
+		}
+	}
+
+	score := int(ratio*riskDetectionPoints + 0.5)
+	score += minInt(detected*riskMalwarePoints, riskMalwareMax)
+	score += minInt(len(x.RelatedDomains)*riskDomainPoints, riskDomainMax)
+	score += minInt(len(x.RelatedMalware)+len(x.RelatedDomains)+len(x.RelatedURLs), riskRelatedMax)
+	return minInt(score, 100)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 type ReportComponent struct {
-	ReportID   ReportID  `dynamo:"report_id"`
-	DataID     string    `dynamo:"data_id"`
-	Data       []byte    `dynamo:"data"`
-	TimeToLive time.Time `dynamo:"ttl"`
+	ReportID    ReportID  `dynamo:"report_id"`
+	DataID      string    `dynamo:"data_id"`
+	Data        []byte    `dynamo:"data"`
+	SubmittedAt time.Time `dynamo:"submitted_at"`
+	TimeToLive  time.Time `dynamo:"ttl"`
+
+	// DataRef is S3 URL of the data if the page is offloaded to PageBucket.
+	// Data is empty in the case.
+	DataRef string `dynamo:"data_ref,omitempty"`
+
+	// ContentHash is SHA256 of the serialized page to detect duplicates.
+	ContentHash string `dynamo:"content_hash,omitempty"`
+
+	// Author is author of the page to count pages by inspector without
+	// reading Data.
+	Author string `dynamo:"author,omitempty"`
 }
 
 // NewReportComponent is a constructor of ReportComponent
 func NewReportComponent(reportID ReportID) *ReportComponent {
 	data := ReportComponent{
 		ReportID: reportID,
-		DataID:   uuid.NewV4().String(),
+		DataID:   NewUUID(),
 	}
 
 	return &data
 }
 
-// SetPage sets page data with serialization.
-func (x *ReportComponent) SetPage(page ReportPage) {
+// MaxPageSize is limit of serialized ReportPage in bytes. It is smaller than
+// DynamoDB item size limit (400KB) to leave room for other attributes.
+var MaxPageSize = envInt("MAX_PAGE_SIZE", 384*1024)
+
+// SetPage sets page data with serialization. If PageBucket is set and the
+// serialized page exceeds PageOffloadSize, the page is put to the bucket and
+// only the pointer is kept. Otherwise *SizeLimitError is returned if the
+// serialized page exceeds MaxPageSize.
+func (x *ReportComponent) SetPage(page ReportPage) error {
+	return x.setPage(page, PageBucket, pageS3)
+}
+
+// setPage sets page data, and offloads it to bucket by a client of newClient
+// if it is large. DataID is derived from ContentHash if empty.
+func (x *ReportComponent) setPage(page ReportPage, bucket string, newClient func() s3iface.S3API) error {
 	data, err := json.Marshal(&page)
 	if err != nil {
-		log.Println("Fail to marshal report page:", page)
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal report page")
+	}
+
+	x.ContentHash = contentHash(data)
+	x.Author = page.Author
+	if x.DataID == "" {
+		x.DataID = x.ContentHash
+	}
+	if bucket != "" && PageOffloadSize > 0 && len(data) > PageOffloadSize {
+		return x.offloadData(newClient(), bucket, data)
+	}
+	if MaxPageSize > 0 && len(data) > MaxPageSize {
+		return NewSizeLimitError("Report page", len(data), MaxPageSize)
 	}
 
 	x.Data = data
+	return nil
 }
 
-// Page returns deserialized page structure
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// PageHash returns ContentHash of the component. It is computed from Data for
+// components stored without hash. Empty string is returned if neither is
+// available.
+func (x *ReportComponent) PageHash() string {
+	if x.ContentHash != "" {
+		return x.ContentHash
+	}
+	if len(x.Data) == 0 {
+		return ""
+	}
+	return contentHash(x.Data)
+}
+
+// Page returns deserialized page structure. An offloaded page is fetched from
+// S3.
 func (x *ReportComponent) Page() *ReportPage {
+	if err := x.LoadData(); err != nil {
+		Logger.WithFields(ErrorFields(err)).Error("Fail to load offloaded page")
+		return nil
+	}
 	if len(x.Data) == 0 {
 		return nil
 	}
@@ -225,54 +765,45 @@ func (x *ReportComponent) Page() *ReportPage {
 		return nil
 	}
 
+	page.EnsureSlices()
+	page.observeSeen(x.SubmittedAt)
 	return &page
 }
 
-func (x *ReportComponent) Submit(tableName, region string) error {
-	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
-	table := db.Table(tableName)
+// Submit stores the component into the report data table.
+func (x *ReportComponent) Submit(tableName, region string) (err error) {
+	span := StartTrace("SubmitReportComponent")
+	defer func() { span.End(err) }()
 
-	x.TimeToLive = time.Now().UTC().Add(time.Second * 864000)
-
-	log.WithFields(log.Fields{
-		"component": x,
-		"tableName": tableName,
-	}).Info("Put component")
-	err := table.Put(x).Run()
-	if err != nil {
-		return errors.Wrap(err, "Fail to put report data")
-	}
-
-	return nil
+	return OpenReportStore(region, "", tableName).Submit(x)
 }
 
-func FetchReportPages(tableName, region string, reportID ReportID) ([]*ReportPage, error) {
-	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
-	table := db.Table(tableName)
+func FetchReportPages(tableName, region string, reportID ReportID) (pages []*ReportPage, err error) {
+	span := StartTrace("FetchReportPages")
+	defer func() { span.End(err) }()
 
-	dataList := []ReportComponent{}
-	err := table.Get("report_id", reportID).All(&dataList)
-	if err != nil {
-		return nil, errors.Wrap(err, "Fail to fetch report data")
-	}
-
-	pages := []*ReportPage{}
-	for _, data := range dataList {
-		pages = append(pages, data.Page())
-	}
-	return pages, nil
+	return OpenReportStore(region, "", tableName).FetchPages(reportID)
 }
 
 func NewReport(reportID ReportID, alert Alert) Report {
 	report := Report{
-		ID:      reportID,
-		Alert:   alert,
-		Content: newReportContent(),
+		ID:            reportID,
+		Alert:         alert,
+		Content:       newReportContent(),
+		ReceivedAt:    alert.ReceivedAt,
+		AccountID:     alert.AccountID,
+		CorrelationID: alert.CorrelationID,
 	}
 
 	return report
 }
 
+// NewUUID generates IDs of reports and report components. Tests can replace it
+// with a deterministic generator.
+var NewUUID = func() string {
+	return uuid.NewV4().String()
+}
+
 func NewReportID() ReportID {
-	return ReportID(uuid.NewV4().String())
+	return ReportID(NewUUID())
 }
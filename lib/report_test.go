@@ -1 +1,267 @@
 package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fixedUUID() func() {
+	orig := lib.NewUUID
+	seq := 0
+	lib.NewUUID = func() string {
+		seq++
+		return fmt.Sprintf("00000000-0000-0000-0000-%012d", seq)
+	}
+	return func() { lib.NewUUID = orig }
+}
+
+func TestNewReportComponentWithFixedUUID(t *testing.T) {
+	defer fixedUUID()()
+
+	reportID := lib.NewReportID()
+	assert.Equal(t, lib.ReportID("00000000-0000-0000-0000-000000000001"), reportID)
+
+	c1 := lib.NewReportComponent(reportID)
+	c2 := lib.NewReportComponent(reportID)
+	assert.Equal(t, reportID, c1.ReportID)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000002", c1.DataID)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000003", c2.DataID)
+}
+
+func TestSetPageSizeLimit(t *testing.T) {
+	orig := lib.MaxPageSize
+	defer func() { lib.MaxPageSize = orig }()
+
+	page := lib.NewReportPage()
+	page.Title = "test"
+	raw, err := json.Marshal(&page)
+	require.NoError(t, err)
+
+	lib.MaxPageSize = len(raw)
+	c := lib.NewReportComponent(lib.NewReportID())
+	require.NoError(t, c.SetPage(page))
+	assert.Equal(t, raw, c.Data)
+
+	page.Title = "test!"
+	c = lib.NewReportComponent(lib.NewReportID())
+	err = c.SetPage(page)
+	require.Error(t, err)
+	sizeErr, ok := err.(*lib.SizeLimitError)
+	require.True(t, ok)
+	assert.Equal(t, len(raw)+1, sizeErr.Size)
+	assert.Nil(t, c.Data)
+}
+
+func TestNewReportDomain(t *testing.T) {
+	before := time.Now().UTC()
+	domain, err := lib.NewReportDomain(" Bad.Example.COM. ", "VirusTotal")
+	require.NoError(t, err)
+	assert.Equal(t, "bad.example.com", domain.Name)
+	assert.Equal(t, "VirusTotal", domain.Source)
+	assert.False(t, domain.Timestamp.IsZero())
+	assert.False(t, domain.Timestamp.Before(before))
+
+	for _, name := range []string{"", "bad example.com", "-bad.example.com", "a..b", "198.51.100.7", "<script>"} {
+		_, err := lib.NewReportDomain(name, "VirusTotal")
+		assert.Error(t, err, name)
+	}
+
+	_, err = lib.NewReportDomain("example.com", "")
+	assert.Error(t, err)
+}
+
+func TestNewReportURL(t *testing.T) {
+	before := time.Now().UTC()
+	u, err := lib.NewReportURL("http://bad.example.com/payload", "VirusTotal")
+	require.NoError(t, err)
+	assert.Equal(t, "http://bad.example.com/payload", u.URL)
+	assert.Equal(t, "VirusTotal", u.Source)
+	assert.False(t, u.Timestamp.IsZero())
+	assert.False(t, u.Timestamp.Before(before))
+
+	for _, raw := range []string{"", "bad.example.com/payload", "/payload", "http://", "http://%zz"} {
+		_, err := lib.NewReportURL(raw, "VirusTotal")
+		assert.Error(t, err, raw)
+	}
+
+	_, err = lib.NewReportURL("http://example.com", "")
+	assert.Error(t, err)
+}
+
+func TestOpponentHostRiskScore(t *testing.T) {
+	scans := func(positives, total int) []lib.ReportMalwareScan {
+		var result []lib.ReportMalwareScan
+		for i := 0; i < total; i++ {
+			result = append(result, lib.ReportMalwareScan{Vendor: fmt.Sprintf("v%d", i), Positive: i < positives})
+		}
+		return result
+	}
+	domains := func(n int) []lib.ReportDomain {
+		var result []lib.ReportDomain
+		for i := 0; i < n; i++ {
+			result = append(result, lib.ReportDomain{Name: fmt.Sprintf("d%d.example.com", i)})
+		}
+		return result
+	}
+
+	var heavy lib.ReportOpponentHost
+	for i := 0; i < 5; i++ {
+		heavy.RelatedMalware = append(heavy.RelatedMalware, lib.ReportMalware{SHA256: fmt.Sprintf("h%d", i), Scans: scans(10, 10)})
+	}
+	heavy.RelatedDomains = domains(10)
+	heavy.RelatedURLs = make([]lib.ReportURL, 20)
+
+	testCases := []struct {
+		name  string
+		host  lib.ReportOpponentHost
+		score int
+	}{
+		{"no evidence", lib.ReportOpponentHost{ID: "192.0.2.1"}, 0},
+		{"undetected malware", lib.ReportOpponentHost{RelatedMalware: []lib.ReportMalware{
+			{SHA256: "a", Scans: scans(0, 5)}, {SHA256: "b"},
+		}}, 2},
+		{"low detection ratio", lib.ReportOpponentHost{RelatedMalware: []lib.ReportMalware{
+			{SHA256: "a", Scans: scans(1, 3)},
+		}}, 19},
+		{"domains only", lib.ReportOpponentHost{RelatedDomains: domains(3)}, 15},
+		{"fixture host", lib.ReportOpponentHost{
+			RelatedMalware: []lib.ReportMalware{{SHA256: "a", Scans: scans(1, 2)}},
+			RelatedDomains: domains(1),
+			RelatedURLs:    []lib.ReportURL{{URL: "http://d0.example.com/"}},
+		}, 32},
+		{"many detections", heavy, 100},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.score, tc.host.RiskScore(), tc.name)
+	}
+
+	// More evidence never lowers the score.
+	more := testCases[4].host
+	more.RelatedDomains = domains(2)
+	assert.True(t, more.RiskScore() > testCases[4].host.RiskScore())
+}
+
+func TestReportContributors(t *testing.T) {
+	var pages []*lib.ReportPage
+	for _, author := range []string{"orange", "blue", "", "orange", "green", "blue"} {
+		page := lib.NewReportPage()
+		page.Author = author
+		pages = append(pages, &page)
+	}
+	pages = append(pages, nil)
+
+	var report lib.Report
+	report.SetContributors(pages)
+	assert.Equal(t, []string{"blue", "green", "orange"}, report.Contributors())
+	assert.Equal(t, 3, report.ContributorCount)
+
+	raw, err := json.Marshal(report)
+	require.NoError(t, err)
+	var restored lib.Report
+	require.NoError(t, json.Unmarshal(raw, &restored))
+	assert.Equal(t, report.Contributors(), restored.Contributors())
+
+	report.SetContributors(nil)
+	assert.Equal(t, 0, len(report.Contributors()))
+	assert.Equal(t, 0, report.ContributorCount)
+}
+
+func TestOpponentHostAddrsMerge(t *testing.T) {
+	var host lib.ReportOpponentHost
+	host.Merge(lib.ReportOpponentHost{
+		ID: "h1",
+		Addrs: []lib.RemoteAddr{
+			{IP: "198.51.100.7", Country: "RU"},
+			{IP: "203.0.113.9", Country: "NL", ASOwner: "AS64500"},
+		},
+	})
+	host.Merge(lib.ReportOpponentHost{
+		ID: "h1",
+		Addrs: []lib.RemoteAddr{
+			{IP: "198.51.100.7", ASOwner: "AS64501"},
+			{IP: "192.0.2.1", Country: "US"},
+		},
+	})
+
+	// Addresses are deduplicated by IP and keep their own attributes.
+	assert.Equal(t, []lib.RemoteAddr{
+		{IP: "198.51.100.7", Country: "RU", ASOwner: "AS64501"},
+		{IP: "203.0.113.9", Country: "NL", ASOwner: "AS64500"},
+		{IP: "192.0.2.1", Country: "US"},
+	}, host.Addrs)
+
+	addr, ok := host.Addr("203.0.113.9")
+	require.True(t, ok)
+	assert.Equal(t, "NL", addr.Country)
+	_, ok = host.Addr("10.0.0.1")
+	assert.False(t, ok)
+
+	// Flat fields are kept for backward compatibility.
+	assert.Equal(t, []string{"198.51.100.7", "203.0.113.9", "192.0.2.1"}, host.IPAddr)
+	assert.Equal(t, []string{"RU", "NL", "US"}, host.Country)
+	assert.Equal(t, []string{"AS64500", "AS64501"}, host.ASOwner)
+}
+
+func TestOpponentHostFlatAccessors(t *testing.T) {
+	host := lib.ReportOpponentHost{
+		ID:      "h1",
+		IPAddr:  []string{"198.51.100.7", "192.0.2.1"},
+		Country: []string{"JP"},
+	}
+	host.AddAddr(lib.RemoteAddr{IP: "198.51.100.7", Country: "RU", ASOwner: "AS64500"})
+
+	assert.Equal(t, []string{"198.51.100.7", "192.0.2.1"}, host.IPAddrs())
+	assert.Equal(t, []string{"RU", "JP"}, host.Countries())
+	assert.Equal(t, []string{"AS64500"}, host.ASOwners())
+
+	data, err := json.Marshal(host)
+	require.NoError(t, err)
+	var decoded lib.ReportOpponentHost
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, host.Addrs, decoded.Addrs)
+	assert.Equal(t, host.IPAddr, decoded.IPAddr)
+}
+
+func TestFetchLegacyReportWithoutContent(t *testing.T) {
+	table := lib.NewMemoryReportTable()
+	require.NoError(t, table.PutReport(&lib.ReportRecord{
+		ReportID: "r1",
+		Data:     []byte(`{"report_id":"r1","alert":{"rule":"port-scan"},"status":"new"}`),
+	}))
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable { return table }
+	defer func() { lib.OpenReportTable = orig }()
+
+	report, err := lib.OpenReportStore("us-east-1", "reports", "").GetReport("r1")
+	require.NoError(t, err)
+	assert.NotNil(t, report.Content.OpponentHosts)
+	assert.NotNil(t, report.Content.AlliedHosts)
+	assert.NotNil(t, report.Content.SubjectUsers)
+
+	assert.NotPanics(t, func() {
+		report.Content.OpponentHosts["h1"] = lib.ReportOpponentHost{ID: "h1"}
+		report.Content.AlliedHosts["h2"] = lib.ReportAlliedHost{ID: "h2"}
+		report.Content.SubjectUsers["u1"] = lib.ReportUser{UserName: "u1"}
+	})
+}
+
+func TestPageWithMissingSections(t *testing.T) {
+	component := lib.ReportComponent{ReportID: "r1", Data: []byte(`{"title":"legacy"}`)}
+	page := component.Page()
+	require.NotNil(t, page)
+	assert.Equal(t, 0, len(page.OpponentHosts))
+	assert.NotNil(t, page.OpponentHosts)
+	assert.NotNil(t, page.AlliedHosts)
+	assert.NotNil(t, page.SubjectUser)
+
+	data, err := json.Marshal(page)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"opponent_hosts":[]`)
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+// ErrThrottled is cause of an error returned when a storage request is still
+// throttled after retries. The caller should requeue the procedure. Compare
+// it with errors.Cause; ErrorCodeOf returns ErrCodeThrottled for the error.
+var ErrThrottled = errors.New("Storage request is throttled")
+
+// StoreRetry is retry policy for throttling and 5xx errors of storage.
+var StoreRetry = HTTPRetry{MaxRetry: 3, Wait: 100 * time.Millisecond}
+
+func retryableStoreError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case awserr.RequestFailure:
+		if e.StatusCode() >= 500 {
+			return true
+		}
+		return throttlingCodes[e.Code()]
+	case awserr.Error:
+		return throttlingCodes[e.Code()]
+	}
+	return false
+}
+
+// retryStore calls f and retries it with backoff while it fails by throttling
+// or 5xx error. ErrThrottled is returned if retries are exhausted.
+func retryStore(op string, f func() error) error {
+	wait := StoreRetry.Wait
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !retryableStoreError(err) {
+			return err
+		}
+
+		if i >= StoreRetry.MaxRetry {
+			Logger.WithFields(ErrorFields(err)).WithField("op", op).Error("Storage retry exhausted")
+			return WrapCode(ErrCodeThrottled, ErrThrottled, fmt.Sprintf("%s failed after %d attempts (%s)", op, i+1, err.Error()))
+		}
+
+		Logger.WithError(err).WithField("op", op).WithField("retry", i+1).Warn("Storage request failed, retrying")
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
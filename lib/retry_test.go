@@ -0,0 +1,82 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shortStoreRetry() func() {
+	orig := lib.StoreRetry
+	lib.StoreRetry = lib.HTTPRetry{MaxRetry: 3, Wait: time.Millisecond}
+	return func() { lib.StoreRetry = orig }
+}
+
+func TestSubmitRetryThrottling(t *testing.T) {
+	defer shortStoreRetry()()
+	table := &mockReportTable{throttle: 2}
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	page := lib.NewReportPage()
+	page.Title = "retry"
+	c := lib.NewReportComponent(lib.NewReportID())
+	require.NoError(t, c.SetPage(page))
+
+	// Components are read to detect duplicates before the put.
+	require.NoError(t, c.Submit("report-data", "us-east-1"))
+	assert.Equal(t, 4, table.calls)
+	assert.Equal(t, 1, len(table.components))
+}
+
+func TestFetchReportPagesRetryThrottling(t *testing.T) {
+	defer shortStoreRetry()()
+	table := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	reportID := lib.NewReportID()
+	page := lib.NewReportPage()
+	page.Title = "retry"
+	c := lib.NewReportComponent(reportID)
+	require.NoError(t, c.SetPage(page))
+	require.NoError(t, c.Submit("report-data", "us-east-1"))
+
+	table.throttle = 2
+	table.calls = 0
+	pages, err := lib.FetchReportPages("report-data", "us-east-1", reportID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, table.calls)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "retry", pages[0].Title)
+}
+
+func TestSubmitThrottlingExhausted(t *testing.T) {
+	defer shortStoreRetry()()
+	table := &mockReportTable{throttle: 10}
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	c := lib.NewReportComponent(lib.NewReportID())
+	require.NoError(t, c.SetPage(lib.NewReportPage()))
+
+	err := c.Submit("report-data", "us-east-1")
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrThrottled, errors.Cause(err))
+	assert.Equal(t, lib.ErrCodeThrottled, lib.ErrorCodeOf(err))
+	assert.Equal(t, 4, table.calls)
+}
+
+func TestSubmitNotRetryOtherError(t *testing.T) {
+	defer shortStoreRetry()()
+	table := &mockReportTable{fail: true}
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	c := lib.NewReportComponent(lib.NewReportID())
+	require.NoError(t, c.SetPage(lib.NewReportPage()))
+
+	err := c.Submit("report-data", "us-east-1")
+	require.Error(t, err)
+	assert.NotEqual(t, lib.ErrThrottled, errors.Cause(err))
+}
@@ -0,0 +1,407 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// Names of publish actions registered by the publisher function.
+const (
+	PublishActionSNS       = "sns"
+	PublishActionSlack     = "slack"
+	PublishActionPagerDuty = "pagerduty"
+	PublishActionArchive   = "archive"
+	PublishActionSQS       = "sqs"
+	PublishActionKinesis   = "kinesis"
+)
+
+// Publisher delivers a report to a destination.
+type Publisher func(ctx context.Context, report Report) error
+
+// directActions are actions of which destinations also have publisher
+// functions subscribing the report topic.
+var directActions = map[string]bool{
+	PublishActionSlack:     true,
+	PublishActionPagerDuty: true,
+}
+
+type routeActionsKey struct{}
+
+// RoutedAttributes returns message attributes "routed_<action>" = "true" for
+// actions of the route in ctx that deliver to a destination directly. The
+// report topic is published with them, so that subscriptions of the same
+// destination can skip the report by filter policy.
+func RoutedAttributes(ctx context.Context) map[string]string {
+	actions, _ := ctx.Value(routeActionsKey{}).([]string)
+	attrs := map[string]string{}
+	for _, action := range actions {
+		if directActions[action] {
+			attrs["routed_"+action] = "true"
+		}
+	}
+	return attrs
+}
+
+// PublishRoute maps reports to publish actions. Empty conditions match all
+// reports.
+type PublishRoute struct {
+	Name string `json:"name"`
+
+	// Severities are severities of matched reports.
+	Severities []ReportSeverity `json:"severities"`
+
+	// Rules are patterns of alert rule of matched reports, e.g. "malware-*".
+	// Pattern syntax is the same as path.Match.
+	Rules []string `json:"rules"`
+
+	// Actions are names of publishers invoked in order. Only "archive"
+	// means that the report is archived silently.
+	Actions []string `json:"actions"`
+}
+
+func (x PublishRoute) match(report Report) bool {
+	if len(x.Severities) > 0 {
+		found := false
+		for _, sev := range x.Severities {
+			if sev == report.Result.Severity {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(x.Rules) > 0 {
+		rule := NormalizeRule(report.Alert.Rule)
+		found := false
+		for _, pattern := range x.Rules {
+			if ok, _ := path.Match(pattern, rule); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PublishRoutes is configuration of PublishRouter. The first matched route is
+// used, and Default is used if no route matches, e.g. unknown severity.
+type PublishRoutes struct {
+	Routes  []PublishRoute `json:"routes"`
+	Default []string       `json:"default"`
+
+	// Escalation is actions for reports of which severity is higher than in
+	// the last publication. If it is empty, escalated reports are routed by
+	// their current severity as usual.
+	Escalation []string `json:"escalation"`
+
+	// Locales are locales of notifications by action, e.g. {"slack": "ja"}.
+	// Actions not in Locales notify in DefaultLocale.
+	Locales map[string]string `json:"locales"`
+}
+
+// DefaultPublishRoutes publishes all reports to SNS topic.
+var DefaultPublishRoutes = PublishRoutes{Default: []string{PublishActionSNS}}
+
+// ParsePublishRoutes parses JSON of PublishRoutes, e.g. value of
+// PUBLISH_ROUTES environment variable. Empty string means
+// DefaultPublishRoutes. Rule patterns are normalized by NormalizeRulePattern.
+func ParsePublishRoutes(raw string) (PublishRoutes, error) {
+	if strings.TrimSpace(raw) == "" {
+		return DefaultPublishRoutes, nil
+	}
+
+	var routes PublishRoutes
+	if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+		return routes, NewConfigError(errors.Wrap(err, "Invalid publish routes").Error())
+	}
+
+	for i, route := range routes.Routes {
+		for j, pattern := range route.Rules {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return routes, NewConfigError(fmt.Sprintf("Invalid rule pattern in publish route %d: %s", i, pattern))
+			}
+			routes.Routes[i].Rules[j] = NormalizeRulePattern(pattern)
+		}
+	}
+	for action, locale := range routes.Locales {
+		if !ValidLocale(locale) {
+			return routes, NewConfigError(fmt.Sprintf("Unknown locale of action %s: %s", action, locale))
+		}
+	}
+	return routes, nil
+}
+
+// LoadPublishRoutes reads PublishRoutes from S3 object. A client of
+// AWS_REGION is created if client is nil.
+func LoadPublishRoutes(client s3iface.S3API, bucket, key string) (PublishRoutes, error) {
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return PublishRoutes{}, errors.Wrapf(err, "Fail to get publish routes s3://%s/%s", bucket, key)
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return PublishRoutes{}, errors.Wrap(err, "Fail to read publish routes")
+	}
+
+	return ParsePublishRoutes(string(raw))
+}
+
+// PublishRouter invokes publishers chosen by PublishRoutes.
+type PublishRouter struct {
+	routes     PublishRoutes
+	publishers map[string]Publisher
+
+	// idempotency enables idempotency markers of actions if not nil.
+	idempotency *IdempotencyConfig
+}
+
+// NewPublishRouter is a constructor of PublishRouter. publishers is a
+// registry of actions by name. ConfigError is returned if a route has an
+// action that is not registered.
+func NewPublishRouter(routes PublishRoutes, publishers map[string]Publisher) (*PublishRouter, error) {
+	check := func(route string, actions []string) error {
+		for _, action := range actions {
+			if _, ok := publishers[action]; !ok {
+				return NewConfigError(fmt.Sprintf("Publisher '%s' of route '%s' is not available", action, route))
+			}
+		}
+		return nil
+	}
+
+	for i, route := range routes.Routes {
+		name := route.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if err := check(name, route.Actions); err != nil {
+			return nil, err
+		}
+	}
+	if err := check("default", routes.Default); err != nil {
+		return nil, err
+	}
+	if err := check("escalation", routes.Escalation); err != nil {
+		return nil, err
+	}
+
+	return &PublishRouter{routes: routes, publishers: publishers}, nil
+}
+
+// Route returns name of the matched route and its actions. Escalation
+// actions are returned for a report with EscalatedFrom if they are
+// configured.
+func (x *PublishRouter) Route(report Report) (string, []string) {
+	if report.EscalatedFrom != "" && len(x.routes.Escalation) > 0 {
+		return "escalation", x.routes.Escalation
+	}
+
+	for i, route := range x.routes.Routes {
+		if route.match(report) {
+			if route.Name == "" {
+				return fmt.Sprintf("#%d", i), route.Actions
+			}
+			return route.Name, route.Actions
+		}
+	}
+	return "default", x.routes.Default
+}
+
+// EnableIdempotency makes the router skip actions that already published the
+// same report, e.g. before a retry of Step Functions. A marker is written
+// after an action succeeds, so a failure between the action and the marker
+// still results in a duplicate.
+func (x *PublishRouter) EnableIdempotency(cfg IdempotencyConfig) {
+	x.idempotency = &cfg
+}
+
+// PublishResult is an outcome of a publish action.
+type PublishResult struct {
+	Action string
+	Err    error
+
+	// Skipped is true if the action is not invoked because it already
+	// published the report.
+	Skipped bool
+}
+
+// PublishOutcome has results of all actions for a report.
+type PublishOutcome struct {
+	Route   string
+	Results []PublishResult
+
+	// EscalatedFrom is severity of the last publication if the report is
+	// escalated.
+	EscalatedFrom ReportSeverity
+}
+
+// Succeeded returns names of actions completed successfully.
+func (x *PublishOutcome) Succeeded() []string {
+	var actions []string
+	for _, r := range x.Results {
+		if r.Err == nil {
+			actions = append(actions, r.Action)
+		}
+	}
+	return actions
+}
+
+// Skipped returns names of actions skipped by idempotency markers. They are
+// also included in Succeeded.
+func (x *PublishOutcome) Skipped() []string {
+	var actions []string
+	for _, r := range x.Results {
+		if r.Skipped {
+			actions = append(actions, r.Action)
+		}
+	}
+	return actions
+}
+
+// Failed returns names of failed actions.
+func (x *PublishOutcome) Failed() []string {
+	var actions []string
+	for _, r := range x.Results {
+		if r.Err != nil {
+			actions = append(actions, r.Action)
+		}
+	}
+	return actions
+}
+
+// PublishError is cause of an error of PublishRouter.PublishReport if some
+// actions failed. Outcome has results of all actions including succeeded ones.
+type PublishError struct {
+	Outcome *PublishOutcome
+}
+
+func (x *PublishError) Error() string {
+	var msgs []string
+	for _, r := range x.Outcome.Results {
+		if r.Err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", r.Action, r.Err.Error()))
+		}
+	}
+	return fmt.Sprintf("Fail to publish report by %d of %d action(s): %s",
+		len(msgs), len(x.Outcome.Results), strings.Join(msgs, "; "))
+}
+
+// escalate sets EscalatedFrom of the report if severity is higher than in the
+// last publication, and puts the marker at the head of Text. A decreased or
+// unchanged severity clears EscalatedFrom.
+func escalate(report *Report) {
+	report.EscalatedFrom = ""
+	if !report.Escalated() {
+		return
+	}
+
+	report.EscalatedFrom = report.PublishedSeverity
+	if report.Text != "" {
+		report.Text = fmt.Sprintf("**%s**\n\n%s", report.EscalationMarker(), report.Text)
+	}
+}
+
+// PublishReport invokes actions of the route for the report in order. All
+// actions are invoked even if some of them fail, and an error of
+// ErrCodePublish caused by *PublishError is returned in that case. A report
+// escalated from PublishedSeverity is published with the escalation marker.
+// PublishedSeverity is not updated here and callers should save the report
+// after MarkPublished. Each action gets the locale of Locales by WithLocale.
+// Actions that already published the report are skipped if idempotency is
+// enabled. Actions get RoutedAttributes of the route by ctx.
+func (x *PublishRouter) PublishReport(ctx context.Context, report Report) (*PublishOutcome, error) {
+	escalate(&report)
+	name, actions := x.Route(report)
+	outcome := &PublishOutcome{Route: name, EscalatedFrom: report.EscalatedFrom}
+	logger := Logger.WithFields(report.LogFields()).WithField("route", name)
+	if report.EscalatedFrom != "" {
+		logger = logger.WithField("escalated_from", report.EscalatedFrom)
+	}
+
+	ctx = context.WithValue(ctx, routeActionsKey{}, actions)
+	for _, action := range actions {
+		actx := ctx
+		if locale, ok := x.routes.Locales[action]; ok {
+			actx = WithLocale(ctx, locale)
+		}
+		skipped, err := x.publish(actx, action, report)
+		outcome.Results = append(outcome.Results, PublishResult{Action: action, Err: err, Skipped: skipped})
+		if err != nil {
+			logger.WithField("action", action).WithFields(ErrorFields(err)).Error("Fail to publish report")
+		}
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"succeeded": outcome.Succeeded(),
+		"failed":    outcome.Failed(),
+		"skipped":   outcome.Skipped(),
+	}).Info("Published report")
+
+	if len(outcome.Failed()) > 0 {
+		return outcome, WrapCode(ErrCodePublish, &PublishError{Outcome: outcome}, "Fail to publish report")
+	}
+	return outcome, nil
+}
+
+// publish invokes the action with idempotency markers if enabled. It returns
+// true if the action is skipped. A marker that can not be checked fails the
+// action to avoid a duplicate, unless the destination dedups natively. A
+// marker that can not be written is only logged because the report is already
+// delivered.
+func (x *PublishRouter) publish(ctx context.Context, action string, report Report) (bool, error) {
+	if x.idempotency == nil {
+		return false, x.publishers[action](ctx, report)
+	}
+
+	logger := Logger.WithFields(report.LogFields()).WithField("action", action)
+	marker, err := NewIdempotencyMarker(report, action, x.idempotency.TTL)
+	if err != nil {
+		return false, err
+	}
+
+	table := OpenIdempotencyTable(x.idempotency.Region, x.idempotency.Table)
+	done, err := table.HasMarker(marker.Key)
+	switch {
+	case err != nil && !NativeDedupActions[action]:
+		return false, err
+	case err != nil:
+		logger.WithFields(ErrorFields(err)).Warn("Fail to check idempotency marker, rely on dedup of destination")
+	case done:
+		logger.Info("Report is already published by the action, skip")
+		return true, nil
+	}
+
+	if err := x.publishers[action](ctx, report); err != nil {
+		return false, err
+	}
+
+	if err := table.PutMarker(marker); err != nil {
+		logger.WithFields(ErrorFields(err)).Warn("Fail to put idempotency marker")
+	}
+	return false, nil
+}
@@ -0,0 +1,337 @@
+package lib_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePublishers returns a registry recording invoked actions. Actions in
+// failing return an error.
+func fakePublishers(invoked *[]string, failing ...string) map[string]lib.Publisher {
+	registry := map[string]lib.Publisher{}
+	for _, name := range []string{"sns", "slack", "pagerduty", "archive"} {
+		action := name
+		fail := false
+		for _, f := range failing {
+			fail = fail || f == action
+		}
+		registry[action] = func(ctx context.Context, report lib.Report) error {
+			*invoked = append(*invoked, action)
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		}
+	}
+	return registry
+}
+
+const testPublishRoutes = `{
+  "routes": [
+    {"name": "page", "severities": ["urgent"], "rules": ["malware-*", "c2"], "actions": ["pagerduty", "slack", "sns"]},
+    {"name": "notify", "severities": ["urgent", "unclassified"], "actions": ["slack", "sns"]},
+    {"name": "silent", "severities": ["safe"], "actions": ["archive"]}
+  ],
+  "default": ["sns"]
+}`
+
+func TestPublishRouterRoute(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		rule    string
+		sev     lib.ReportSeverity
+		route   string
+		actions []string
+	}{
+		{"malware-download", lib.SevUrgent, "page", []string{"pagerduty", "slack", "sns"}},
+		{"c2", lib.SevUrgent, "page", []string{"pagerduty", "slack", "sns"}},
+		{"port-scan", lib.SevUrgent, "notify", []string{"slack", "sns"}},
+		{"malware-download", lib.SevUnclassified, "notify", []string{"slack", "sns"}},
+		{"malware-download", lib.SevSafe, "silent", []string{"archive"}},
+		{"malware-download", "", "default", []string{"sns"}},
+		{"malware-download", "critical", "default", []string{"sns"}},
+	}
+
+	for _, tc := range testCases {
+		report := lib.Report{ID: "r1"}
+		report.Alert.Rule = tc.rule
+		report.Result.Severity = tc.sev
+
+		name, actions := router.Route(report)
+		assert.Equal(t, tc.route, name, "%s/%s", tc.rule, tc.sev)
+		assert.Equal(t, tc.actions, actions, "%s/%s", tc.rule, tc.sev)
+	}
+}
+
+func TestPublishRouterPublishReport(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.NoError(t, err)
+
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "malware-download"
+	outcome, err := router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, "page", outcome.Route)
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, invoked)
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, outcome.Succeeded())
+	assert.Equal(t, 0, len(outcome.Failed()))
+
+	// Safe report is archived without notification
+	invoked = nil
+	report.Result.Severity = lib.SevSafe
+	outcome, err = router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, "silent", outcome.Route)
+	assert.Equal(t, []string{"archive"}, invoked)
+}
+
+func TestPublishRouterRoutedAttributes(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	var attrs []map[string]string
+	registry := map[string]lib.Publisher{}
+	for _, name := range []string{"sns", "slack", "pagerduty", "archive"} {
+		registry[name] = func(ctx context.Context, report lib.Report) error {
+			attrs = append(attrs, lib.RoutedAttributes(ctx))
+			return nil
+		}
+	}
+	router, err := lib.NewPublishRouter(routes, registry)
+	require.NoError(t, err)
+
+	// Subscriptions of Slack and PagerDuty skip reports delivered directly.
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "malware-download"
+	_, err = router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(attrs))
+	assert.Equal(t, map[string]string{"routed_pagerduty": "true", "routed_slack": "true"}, attrs[2])
+
+	attrs = nil
+	report.Alert.Rule = "port-scan"
+	_, err = router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(attrs))
+	assert.Equal(t, map[string]string{"routed_slack": "true"}, attrs[1])
+
+	// Default route has no direct action.
+	attrs = nil
+	report.Result.Severity = "critical"
+	_, err = router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(attrs))
+	assert.Equal(t, map[string]string{}, attrs[0])
+	assert.Equal(t, map[string]string{}, lib.RoutedAttributes(context.Background()))
+}
+
+func TestPublishRouterPartialFailure(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked, "pagerduty"))
+	require.NoError(t, err)
+
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "c2"
+	outcome, err := router.PublishReport(context.Background(), report)
+	require.Error(t, err)
+
+	// Actions after the failed one are still invoked.
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, invoked)
+	assert.Equal(t, []string{"slack", "sns"}, outcome.Succeeded())
+	assert.Equal(t, []string{"pagerduty"}, outcome.Failed())
+
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	pubErr, ok := errors.Cause(err).(*lib.PublishError)
+	require.True(t, ok)
+	assert.Equal(t, outcome, pubErr.Outcome)
+	assert.Contains(t, err.Error(), "1 of 3 action(s): pagerduty: boom")
+}
+
+func TestNewPublishRouterUnknownAction(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(`{"routes": [{"severities": ["urgent"], "actions": ["sns", "teams"]}]}`)
+	require.NoError(t, err)
+	var invoked []string
+	_, err = lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "'teams' of route '#0'")
+
+	// Default route is also checked
+	_, err = lib.NewPublishRouter(lib.PublishRoutes{Default: []string{"email"}}, fakePublishers(&invoked))
+	require.Error(t, err)
+}
+
+func TestParsePublishRoutes(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes("")
+	require.NoError(t, err)
+	assert.Equal(t, lib.DefaultPublishRoutes, routes)
+
+	_, err = lib.ParsePublishRoutes(`{"routes": [`)
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+
+	_, err = lib.ParsePublishRoutes(`{"routes": [{"rules": ["[malware"], "actions": ["sns"]}]}`)
+	require.Error(t, err)
+	_, ok = err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
+
+func TestLoadPublishRoutes(t *testing.T) {
+	client := &mockS3{objects: map[string]string{"config-bucket/routes.json": testPublishRoutes}}
+	routes, err := lib.LoadPublishRoutes(client, "config-bucket", "routes.json")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(routes.Routes))
+	assert.Equal(t, "page", routes.Routes[0].Name)
+	assert.Equal(t, []string{"sns"}, routes.Default)
+}
+
+const testEscalationRoutes = `{
+  "routes": [
+    {"name": "notify", "severities": ["urgent", "unclassified"], "actions": ["slack", "sns"]},
+    {"name": "silent", "severities": ["safe"], "actions": ["archive"]}
+  ],
+  "default": ["sns"],
+  "escalation": ["pagerduty", "slack", "sns"]
+}`
+
+// escalationRouter returns a router of testEscalationRoutes and a pointer to
+// the report last passed to publishers.
+func escalationRouter(t *testing.T, invoked *[]string) (*lib.PublishRouter, *lib.Report) {
+	routes, err := lib.ParsePublishRoutes(testEscalationRoutes)
+	require.NoError(t, err)
+
+	published := &lib.Report{}
+	registry := fakePublishers(invoked)
+	sns := registry["sns"]
+	registry["sns"] = func(ctx context.Context, report lib.Report) error {
+		*published = report
+		return sns(ctx, report)
+	}
+
+	router, err := lib.NewPublishRouter(routes, registry)
+	require.NoError(t, err)
+	return router, published
+}
+
+func TestPublishRouterEscalation(t *testing.T) {
+	var invoked []string
+	router, published := escalationRouter(t, &invoked)
+
+	report := loadFixtureReport(t)
+	report.Text = "# Report"
+	report.Result.Severity = lib.SevUrgent
+	report.PublishedSeverity = lib.SevUnclassified
+
+	outcome, err := router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, "escalation", outcome.Route)
+	assert.Equal(t, lib.SevUnclassified, outcome.EscalatedFrom)
+	assert.Equal(t, []string{"pagerduty", "slack", "sns"}, invoked)
+
+	assert.Equal(t, lib.SevUnclassified, published.EscalatedFrom)
+	assert.Equal(t, "ESCALATED from unclassified to urgent", published.EscalationMarker())
+	assert.Equal(t, "**ESCALATED from unclassified to urgent**\n\n# Report", published.Text)
+	assert.Equal(t, "unclassified", lib.ReportMessageAttributes(*published)["escalated_from"])
+
+	// The report of the caller is not modified.
+	assert.Equal(t, lib.ReportSeverity(""), report.EscalatedFrom)
+	assert.Equal(t, "# Report", report.Text)
+}
+
+func TestPublishRouterDeescalation(t *testing.T) {
+	var invoked []string
+	router, published := escalationRouter(t, &invoked)
+
+	report := loadFixtureReport(t)
+	report.Text = "# Report"
+	report.Result.Severity = lib.SevSafe
+	report.PublishedSeverity = lib.SevUrgent
+	// Marker of the previous publication must not be carried over.
+	report.EscalatedFrom = lib.SevUnclassified
+
+	outcome, err := router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, "silent", outcome.Route)
+	assert.Equal(t, lib.ReportSeverity(""), outcome.EscalatedFrom)
+	assert.Equal(t, []string{"archive"}, invoked)
+	assert.Equal(t, lib.ReportSeverity(""), published.EscalatedFrom)
+}
+
+func TestPublishRouterSeverityUnchanged(t *testing.T) {
+	testCases := []struct {
+		published lib.ReportSeverity
+		current   lib.ReportSeverity
+	}{
+		{lib.SevUrgent, lib.SevUrgent},
+		{lib.SevUnclassified, ""},
+		// Never published report is not escalated.
+		{"", lib.SevUrgent},
+	}
+
+	for _, tc := range testCases {
+		var invoked []string
+		router, published := escalationRouter(t, &invoked)
+
+		report := loadFixtureReport(t)
+		report.Text = "# Report"
+		report.Result.Severity = tc.current
+		report.PublishedSeverity = tc.published
+
+		outcome, err := router.PublishReport(context.Background(), report)
+		require.NoError(t, err)
+		assert.NotEqual(t, "escalation", outcome.Route, "%s -> %s", tc.published, tc.current)
+		assert.Equal(t, "", published.EscalationMarker(), "%s -> %s", tc.published, tc.current)
+		assert.Equal(t, "# Report", published.Text, "%s -> %s", tc.published, tc.current)
+		assert.Equal(t, "", lib.ReportMessageAttributes(*published)["escalated_from"])
+	}
+}
+
+func TestPublishRouterEscalationWithoutRoute(t *testing.T) {
+	routes, err := lib.ParsePublishRoutes(testPublishRoutes)
+	require.NoError(t, err)
+	var invoked []string
+	router, err := lib.NewPublishRouter(routes, fakePublishers(&invoked))
+	require.NoError(t, err)
+
+	// Escalated report is routed by current severity without escalation
+	// actions.
+	report := loadFixtureReport(t)
+	report.Alert.Rule = "malware-download"
+	report.PublishedSeverity = lib.SevSafe
+	outcome, err := router.PublishReport(context.Background(), report)
+	require.NoError(t, err)
+	assert.Equal(t, "page", outcome.Route)
+	assert.Equal(t, lib.SevSafe, outcome.EscalatedFrom)
+}
+
+func TestReportMarkPublished(t *testing.T) {
+	report := lib.Report{PublishedSeverity: lib.SevSafe, EscalatedFrom: lib.SevSafe}
+	report.Result.Severity = lib.SevUrgent
+	assert.True(t, report.Escalated())
+
+	report.MarkPublished()
+	assert.Equal(t, lib.SevUrgent, report.PublishedSeverity)
+	assert.Equal(t, lib.ReportSeverity(""), report.EscalatedFrom)
+	assert.False(t, report.Escalated())
+
+	// Empty severity is recorded as unclassified.
+	report.Result.Severity = ""
+	report.MarkPublished()
+	assert.Equal(t, lib.SevUnclassified, report.PublishedSeverity)
+}
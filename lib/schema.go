@@ -0,0 +1,354 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultAlertSchema is a JSON Schema of alerts requiring fields to identify
+// the alert.
+const DefaultAlertSchema = `{
+  "type": "object",
+  "required": ["name", "rule", "key"],
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "rule": {"type": "string", "minLength": 1},
+    "key": {"type": "string", "minLength": 1},
+    "description": {"type": "string"},
+    "account_id": {"type": "string"},
+    "severity": {"type": "string", "enum": ["urgent", "unclassified", "safe"]},
+    "timestamp": {
+      "type": "object",
+      "properties": {
+        "init": {"type": "number", "minimum": 0},
+        "last": {"type": "number", "minimum": 0}
+      }
+    },
+    "attrs": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["type", "value"],
+        "properties": {
+          "type": {"type": "string", "minLength": 1},
+          "value": {"type": "string"},
+          "key": {"type": "string"},
+          "context": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`
+
+// JSONSchema is a subset of JSON Schema draft-07. Supported keywords are
+// type, enum, required, properties, additionalProperties (boolean only),
+// items (single schema only), minItems, maxItems, minLength, maxLength,
+// pattern, minimum and maximum. Other keywords except annotations, e.g. title
+// and description, are rejected by ParseJSONSchema.
+type JSONSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes is value of "type" keyword, a string or an array of strings.
+type schemaTypes []string
+
+func (x *schemaTypes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*x = schemaTypes{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*x = schemaTypes(list)
+	return nil
+}
+
+var schemaTypeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// schemaKeywords are keywords accepted by ParseJSONSchema. Annotations are
+// accepted but not used for validation.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "required": true, "properties": true,
+	"additionalProperties": true, "items": true, "minItems": true,
+	"maxItems": true, "minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+// ParseJSONSchema parses a JSON Schema, e.g. value of ALERT_SCHEMA environment
+// variable. Unsupported type names and broken patterns are ConfigError.
+// Unsupported keywords are ErrCodeValidation, because a schema relying on
+// them would accept documents that it should reject.
+func ParseJSONSchema(raw string) (*JSONSchema, error) {
+	var schema JSONSchema
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid JSON Schema").Error())
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, NewConfigError(errors.Wrap(err, "Invalid JSON Schema").Error())
+	}
+	if err := checkSchemaKeywords("$", doc); err != nil {
+		return nil, err
+	}
+
+	if err := schema.compile("$"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// checkSchemaKeywords rejects keywords not in schemaKeywords.
+func checkSchemaKeywords(path string, v interface{}) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !schemaKeywords[name] {
+			return NewCodedError(ErrCodeValidation, fmt.Sprintf("Invalid JSON Schema: unsupported keyword %q at %s", name, path))
+		}
+	}
+
+	if props, ok := obj["properties"].(map[string]interface{}); ok {
+		for name, prop := range props {
+			if err := checkSchemaKeywords(path+"."+name, prop); err != nil {
+				return err
+			}
+		}
+	}
+	return checkSchemaKeywords(path+"[]", obj["items"])
+}
+
+func (x *JSONSchema) compile(path string) error {
+	for _, t := range x.Type {
+		if !schemaTypeNames[t] {
+			return NewConfigError(fmt.Sprintf("Invalid JSON Schema: unknown type %q at %s", t, path))
+		}
+	}
+
+	if x.Pattern != "" {
+		re, err := regexp.Compile(x.Pattern)
+		if err != nil {
+			return NewConfigError(fmt.Sprintf("Invalid JSON Schema: bad pattern at %s: %v", path, err))
+		}
+		x.pattern = re
+	}
+
+	for name, prop := range x.Properties {
+		if prop == nil {
+			continue
+		}
+		if err := prop.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if x.Items != nil {
+		return x.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// SchemaError is returned by JSONSchema.Validate. Violations have a JSON path
+// and a reason, e.g. "$.attrs[0].type: is required".
+type SchemaError struct {
+	Violations []string
+}
+
+func (x *SchemaError) Error() string {
+	return "JSON does not conform to schema: " + strings.Join(x.Violations, "; ")
+}
+
+// Validate checks the JSON document. A *SchemaError with all violations is
+// returned if the document does not conform.
+func (x *JSONSchema) Validate(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to decode JSON for schema validation")
+	}
+
+	var violations []string
+	x.validate("$", doc, &violations)
+	if len(violations) > 0 {
+		return &SchemaError{Violations: violations}
+	}
+	return nil
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch obj := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := obj.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := obj.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func (x *JSONSchema) matchType(v interface{}) bool {
+	if len(x.Type) == 0 {
+		return true
+	}
+
+	actual := schemaTypeOf(v)
+	for _, t := range x.Type {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *JSONSchema) validate(path string, v interface{}, violations *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*violations = append(*violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if !x.matchType(v) {
+		fail("must be %s, but %s", strings.Join(x.Type, " or "), schemaTypeOf(v))
+		return
+	}
+
+	if len(x.Enum) > 0 {
+		found := false
+		for _, e := range x.Enum {
+			if schemaEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of enum values")
+		}
+	}
+
+	switch obj := v.(type) {
+	case map[string]interface{}:
+		for _, name := range x.Required {
+			if _, ok := obj[name]; !ok {
+				*violations = append(*violations, path+"."+name+": is required")
+			}
+		}
+
+		var names []string
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := x.Properties[name]
+			if !ok {
+				if x.AdditionalProperties != nil && !*x.AdditionalProperties {
+					*violations = append(*violations, path+"."+name+": is not allowed")
+				}
+				continue
+			}
+			if prop != nil {
+				prop.validate(path+"."+name, obj[name], violations)
+			}
+		}
+
+	case []interface{}:
+		if x.MinItems != nil && len(obj) < *x.MinItems {
+			fail("must have at least %d items", *x.MinItems)
+		}
+		if x.MaxItems != nil && len(obj) > *x.MaxItems {
+			fail("must have at most %d items", *x.MaxItems)
+		}
+		if x.Items != nil {
+			for i, item := range obj {
+				x.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, violations)
+			}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(obj)
+		if x.MinLength != nil && n < *x.MinLength {
+			fail("must be at least %d characters", *x.MinLength)
+		}
+		if x.MaxLength != nil && n > *x.MaxLength {
+			fail("must be at most %d characters", *x.MaxLength)
+		}
+		if x.pattern != nil && !x.pattern.MatchString(obj) {
+			fail("must match pattern %q", x.Pattern)
+		}
+
+	case json.Number:
+		f, _ := obj.Float64()
+		if x.Minimum != nil && f < *x.Minimum {
+			fail("must be >= %v", *x.Minimum)
+		}
+		if x.Maximum != nil && f > *x.Maximum {
+			fail("must be <= %v", *x.Maximum)
+		}
+	}
+}
+
+// schemaEqual compares an enum value decoded as float64 with a value decoded
+// as json.Number.
+func schemaEqual(expected, actual interface{}) bool {
+	if n, ok := actual.(json.Number); ok {
+		f, err := n.Float64()
+		e, isNum := expected.(float64)
+		return err == nil && isNum && e == f
+	}
+
+	a, _ := json.Marshal(expected)
+	b, _ := json.Marshal(actual)
+	return bytes.Equal(a, b)
+}
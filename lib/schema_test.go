@@ -0,0 +1,103 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultAlertSchema(t *testing.T) {
+	schema, err := lib.ParseJSONSchema(lib.DefaultAlertSchema)
+	require.NoError(t, err)
+
+	valid := []string{
+		`{"name":"test","rule":"r1","key":"k1"}`,
+		`{"name":"test","rule":"r1","key":"k1","timestamp":{"init":1548640000,"last":1548643600.5},
+		  "attrs":[{"type":"ipaddr","value":"10.1.2.3","context":["local"]}],"extra":true}`,
+	}
+	for _, data := range valid {
+		assert.NoError(t, schema.Validate([]byte(data)), data)
+	}
+
+	invalid := map[string][]string{
+		`{"name":"test","rule":"r1"}`:                                   {"$.key: is required"},
+		`{"name":"test","rule":"","key":"k1"}`:                          {"$.rule: must be at least 1 characters"},
+		`{"name":"test","rule":1,"key":"k1"}`:                           {"$.rule: must be string, but integer"},
+		`{"name":"t","rule":"r","key":"k","attrs":{}}`:                  {"$.attrs: must be array, but object"},
+		`{"name":"t","rule":"r","key":"k","attrs":[{"type":"ipaddr"}]}`: {"$.attrs[0].value: is required"},
+		`{"name":"t","rule":"r","key":"k","timestamp":{"init":-1}}`:     {"$.timestamp.init: must be >= 0"},
+		`{"attrs":[{"value":"x","context":[1]}]}`: {
+			"$.name: is required", "$.rule: is required", "$.key: is required",
+			"$.attrs[0].type: is required", "$.attrs[0].context[0]: must be string, but integer",
+		},
+	}
+	for data, violations := range invalid {
+		err := schema.Validate([]byte(data))
+		require.Error(t, err, data)
+		schemaErr, ok := err.(*lib.SchemaError)
+		require.True(t, ok, data)
+		assert.Equal(t, violations, schemaErr.Violations, data)
+	}
+}
+
+func TestJSONSchemaKeywords(t *testing.T) {
+	schema, err := lib.ParseJSONSchema(`{
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"rule": {"type": "string", "pattern": "^[a-z-]+$", "maxLength": 8},
+			"severity": {"enum": ["low", "high", 1]},
+			"count": {"type": "integer", "maximum": 10},
+			"tags": {"type": ["array", "null"], "minItems": 1, "maxItems": 2}
+		}
+	}`)
+	require.NoError(t, err)
+
+	assert.NoError(t, schema.Validate([]byte(`{"rule":"malware","severity":"low","count":3,"tags":null}`)))
+	assert.NoError(t, schema.Validate([]byte(`{"severity":1,"count":3.0,"tags":["a"]}`)))
+
+	err = schema.Validate([]byte(`{"rule":"Malware_Detected","severity":"mid","count":1.5,"tags":[],"other":1}`))
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"$.count: must be integer, but number",
+		"$.other: is not allowed",
+		`$.rule: must be at most 8 characters`,
+		`$.rule: must match pattern "^[a-z-]+$"`,
+		"$.severity: must be one of enum values",
+		"$.tags: must have at least 1 items",
+	}, err.(*lib.SchemaError).Violations)
+	assert.Contains(t, err.Error(), "does not conform to schema")
+}
+
+func TestParseJSONSchemaInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`{"type":`,
+		`{"type":"text"}`,
+		`{"type":1}`,
+		`{"properties":{"rule":{"pattern":"(["}}}`,
+		`{"items":{"type":["string","date"]}}`,
+	} {
+		_, err := lib.ParseJSONSchema(raw)
+		require.Error(t, err, raw)
+		assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err), raw)
+	}
+}
+
+func TestParseJSONSchemaUnsupportedKeyword(t *testing.T) {
+	for _, raw := range []string{
+		`{"type":"string","format":"ipv4"}`,
+		`{"properties":{"rule":{"type":"string","const":"malware"}}}`,
+		`{"items":{"oneOf":[{"type":"string"}]}}`,
+	} {
+		_, err := lib.ParseJSONSchema(raw)
+		require.Error(t, err, raw)
+		assert.Equal(t, lib.ErrCodeValidation, lib.ErrorCodeOf(err), raw)
+		assert.Contains(t, err.Error(), "unsupported keyword", raw)
+	}
+
+	_, err := lib.ParseJSONSchema(`{"$schema":"http://json-schema.org/draft-07/schema#","title":"alert",
+		"properties":{"rule":{"type":"string","description":"rule name"}}}`)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"sort"
+	"time"
+)
+
+// ReportSeverityIndex is name of GSI of report table. Hash key is severity and
+// range key is received_at.
+const ReportSeverityIndex = "severity-index"
+
+// severityOrder is all severities from the lowest.
+var severityOrder = []ReportSeverity{SevSafe, SevUnclassified, SevUrgent}
+
+// searchSeverities returns keys of QueryReports for reports of floor or
+// higher severity. Empty key is of reports stored without severity, e.g.
+// before the severity index, and they are regarded as unclassified.
+func searchSeverities(floor ReportSeverity) []ReportSeverity {
+	var severities []ReportSeverity
+	if floor.Level() <= SevUnclassified.Level() {
+		severities = append(severities, "")
+	}
+	for _, sev := range severityOrder {
+		if sev.Level() >= floor.Level() {
+			severities = append(severities, sev)
+		}
+	}
+	return severities
+}
+
+// receivedBetween returns records received between from and to. Received
+// time of a record stored without received_at is read from its report.
+func receivedBetween(records []ReportRecord, from, to time.Time) []ReportRecord {
+	var found []ReportRecord
+	for _, record := range records {
+		if record.ReceivedAt.IsZero() {
+			if report, err := record.Report(); err == nil {
+				record.ReceivedAt = report.ReceivedAt
+			}
+		}
+		if !record.ReceivedAt.Before(from) && !record.ReceivedAt.After(to) {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// SearchReports returns reports received between from and to and severity of
+// them is minSeverity or higher. All reports are returned if minSeverity is
+// empty, including ones stored without severity. Reports are sorted by
+// received time, newest first.
+func SearchReports(tableName, region string, minSeverity string, from, to time.Time) (reports []Report, err error) {
+	span := StartTrace("SearchReports")
+	defer func() { span.End(err) }()
+
+	floor := ReportSeverity(minSeverity)
+	if minSeverity != "" && floor.Level() == 0 {
+		return nil, NewConfigError("Unknown severity: " + minSeverity)
+	}
+	if to.Before(from) {
+		return nil, NewConfigError("End of range is before start")
+	}
+
+	table := OpenReportTable(region, tableName, "")
+	var records []ReportRecord
+	for _, sev := range searchSeverities(floor) {
+		found, err := table.QueryReports(sev, from, to)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ReceivedAt.After(records[j].ReceivedAt)
+	})
+
+	reports = []Report{}
+	for _, record := range records {
+		report, err := record.Report()
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+
+	return reports, nil
+}
+
+// SearchReportsByLabels returns reports of SearchReports that have all of
+// labels.
+func SearchReportsByLabels(tableName, region string, minSeverity string, from, to time.Time, labels []string) ([]Report, error) {
+	reports, err := SearchReports(tableName, region, minSeverity, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := []Report{}
+	for _, report := range reports {
+		all := true
+		for _, label := range labels {
+			if !report.HasLabel(label) {
+				all = false
+				break
+			}
+		}
+		if all {
+			matched = append(matched, report)
+		}
+	}
+	return matched, nil
+}
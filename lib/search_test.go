@@ -0,0 +1,114 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func searchFixture(t *testing.T) (*mockReportTable, time.Time) {
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	table := &mockReportTable{}
+
+	reports := []struct {
+		id  lib.ReportID
+		sev lib.ReportSeverity
+		at  time.Time
+	}{
+		{"urgent-old", lib.SevUrgent, base.Add(-10 * 24 * time.Hour)},
+		{"urgent-new", lib.SevUrgent, base.Add(-1 * time.Hour)},
+		{"unclassified", lib.SevUnclassified, base.Add(-2 * time.Hour)},
+		{"safe", lib.SevSafe, base.Add(-3 * time.Hour)},
+		{"not-reviewed", "", base.Add(-4 * time.Hour)},
+	}
+	for _, r := range reports {
+		report := lib.Report{ID: r.id, ReceivedAt: r.at, Result: lib.ReportResult{Severity: r.sev}}
+		record, err := lib.NewReportRecord(report, "ap-northeast-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+
+	return table, base
+}
+
+func reportIDs(reports []lib.Report) []lib.ReportID {
+	var ids []lib.ReportID
+	for _, r := range reports {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestSearchReportsRange(t *testing.T) {
+	table, base := searchFixture(t)
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	reports, err := lib.SearchReports("reports", "ap-northeast-1", "", base.Add(-7*24*time.Hour), base)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"urgent-new", "unclassified", "safe", "not-reviewed"}, reportIDs(reports))
+
+	reports, err = lib.SearchReports("reports", "ap-northeast-1", "", base.Add(-11*24*time.Hour), base.Add(-9*24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"urgent-old"}, reportIDs(reports))
+}
+
+func TestSearchReportsSeverityFloor(t *testing.T) {
+	table, base := searchFixture(t)
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	from := base.Add(-7 * 24 * time.Hour)
+	reports, err := lib.SearchReports("reports", "ap-northeast-1", "urgent", from, base)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"urgent-new"}, reportIDs(reports))
+
+	// Reports without severity are regarded as unclassified.
+	reports, err = lib.SearchReports("reports", "ap-northeast-1", "unclassified", from, base)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.ReportID{"urgent-new", "unclassified", "not-reviewed"}, reportIDs(reports))
+}
+
+func TestSearchReportsInvalidArgs(t *testing.T) {
+	table, base := searchFixture(t)
+	defer mockReportTables(map[string]*mockReportTable{"ap-northeast-1": table})()
+
+	_, err := lib.SearchReports("reports", "ap-northeast-1", "critical", base.Add(-time.Hour), base)
+	assert.Error(t, err)
+	_, err = lib.SearchReports("reports", "ap-northeast-1", "", base, base.Add(-time.Hour))
+	assert.Error(t, err)
+}
+
+func TestSearchReportsWithoutSeverity(t *testing.T) {
+	table := lib.NewMemoryReportTable()
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable { return table }
+	defer func() { lib.OpenReportTable = orig }()
+
+	base := time.Date(2019, 1, 28, 0, 0, 0, 0, time.UTC)
+	record, err := lib.NewReportRecord(lib.Report{ID: "indexed", ReceivedAt: base.Add(-time.Hour)}, "ap-northeast-1")
+	require.NoError(t, err)
+	require.NoError(t, table.PutReport(record))
+
+	// Stored before the severity index without severity and received time.
+	require.NoError(t, table.PutReport(&lib.ReportRecord{
+		ReportID: "legacy",
+		Data:     []byte(`{"report_id":"legacy","received_at":"2019-01-27T22:00:00Z"}`),
+	}))
+	require.NoError(t, table.PutReport(&lib.ReportRecord{
+		ReportID: "legacy-old",
+		Data:     []byte(`{"report_id":"legacy-old","received_at":"2018-01-27T22:00:00Z"}`),
+	}))
+
+	from := base.Add(-24 * time.Hour)
+	for _, floor := range []string{"", "safe", "unclassified"} {
+		reports, err := lib.SearchReports("reports", "ap-northeast-1", floor, from, base)
+		require.NoError(t, err)
+		assert.Equal(t, []lib.ReportID{"indexed", "legacy"}, reportIDs(reports), floor)
+	}
+
+	reports, err := lib.SearchReports("reports", "ap-northeast-1", "urgent", from, base)
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+}
@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/securityhub"
+	"github.com/aws/aws-sdk-go/service/securityhub/securityhubiface"
+	"github.com/pkg/errors"
+)
+
+// Limits of AWS Security Finding Format. Longer values are truncated and
+// extra items are dropped.
+const (
+	securityHubMaxID          = 512
+	securityHubMaxTitle       = 256
+	securityHubMaxDescription = 1024
+	securityHubMaxValue       = 512
+	securityHubMaxSource      = 128
+	securityHubMaxResources   = 32
+	securityHubMaxIndicators  = 5
+)
+
+const securityHubSchemaVersion = "2018-10-08"
+
+// SecurityHubConfig is destination of findings.
+type SecurityHubConfig struct {
+	Region string
+
+	// AccountID is AWS account importing findings. It is also AwsAccountId of
+	// findings of reports without account.
+	AccountID string
+
+	// ProductArn is ARN of the product sending findings. The default product
+	// of AccountID is used if it is empty.
+	ProductArn string
+}
+
+func (x *SecurityHubConfig) productArn() string {
+	if x.ProductArn != "" {
+		return x.ProductArn
+	}
+	return fmt.Sprintf("arn:aws:securityhub:%s:%s:product/%s/default", x.Region, x.AccountID, x.AccountID)
+}
+
+// SecurityHubFindingID returns Id of the finding of the report. It is same for
+// recompiled reports so that BatchImportFindings updates the finding.
+func SecurityHubFindingID(report Report) string {
+	return truncateText(fmt.Sprintf("alert-responder/%s", report.ID), securityHubMaxID)
+}
+
+// securityHubSeverity normalizes severity to 0-100 of ASFF. Unknown severity
+// is regarded as unclassified.
+func securityHubSeverity(sev ReportSeverity) int64 {
+	switch sev {
+	case SevUrgent:
+		return 90
+	case SevSafe:
+		return 0
+	default:
+		return 40
+	}
+}
+
+// securityHubWorkflowState maps status of the report to WorkflowState.
+func securityHubWorkflowState(status ReportStatus) string {
+	switch status {
+	case StatusOngoing:
+		return "IN_PROGRESS"
+	case StatusPublished:
+		return "ASSIGNED"
+	case StatusClosed:
+		return "RESOLVED"
+	default:
+		return "NEW"
+	}
+}
+
+// securityHubIndicatorType maps type of Observable to type of
+// ThreatIntelIndicator. Empty string is returned for unsupported observables.
+func securityHubIndicatorType(obs Observable) string {
+	switch obs.Type {
+	case "ipaddr":
+		ip := net.ParseIP(obs.Value)
+		if ip == nil {
+			return ""
+		}
+		if ip.To4() != nil {
+			return "IPV4_ADDRESS"
+		}
+		return "IPV6_ADDRESS"
+	case "domain":
+		return "DOMAIN"
+	case "url":
+		return "URL"
+	case "sha256":
+		return "HASH_SHA256"
+	}
+	return ""
+}
+
+func securityHubTime(t time.Time) *string {
+	return aws.String(t.UTC().Format(time.RFC3339))
+}
+
+func securityHubIndicators(report Report) []*securityhub.ThreatIntelIndicator {
+	var indicators []*securityhub.ThreatIntelIndicator
+	for _, obs := range ReportObservables(report) {
+		if len(indicators) >= securityHubMaxIndicators {
+			break
+		}
+
+		indicatorType := securityHubIndicatorType(obs)
+		if indicatorType == "" || (obs.Type == "ipaddr" && IsPrivateIP(obs.Value)) {
+			continue
+		}
+
+		indicator := &securityhub.ThreatIntelIndicator{
+			Type:  aws.String(indicatorType),
+			Value: aws.String(truncateText(obs.Value, securityHubMaxValue)),
+		}
+		if obs.Source != "" {
+			indicator.Source = aws.String(truncateText(obs.Source, securityHubMaxSource))
+		}
+		if !obs.FirstSeen.IsZero() {
+			indicator.LastObservedAt = securityHubTime(obs.FirstSeen)
+		}
+		indicators = append(indicators, indicator)
+	}
+	return indicators
+}
+
+func securityHubResources(report Report, region string) []*securityhub.Resource {
+	var ids []string
+	for id := range report.Content.AlliedHosts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var resources []*securityhub.Resource
+	for _, id := range ids {
+		if len(resources) >= securityHubMaxResources {
+			break
+		}
+
+		host := report.Content.AlliedHosts[id]
+		resource := &securityhub.Resource{
+			Type:   aws.String("Other"),
+			Id:     aws.String(truncateText(id, securityHubMaxValue)),
+			Region: aws.String(region),
+		}
+		if strings.HasPrefix(id, "i-") {
+			resource.Type = aws.String("AwsEc2Instance")
+		}
+
+		details := map[string]*string{}
+		if len(host.IPAddr) > 0 {
+			details["ipaddr"] = aws.String(truncateText(strings.Join(host.IPAddr, ","), securityHubMaxValue))
+		}
+		if len(host.HostName) > 0 {
+			details["hostname"] = aws.String(truncateText(strings.Join(host.HostName, ","), securityHubMaxValue))
+		}
+		if len(details) > 0 {
+			resource.Details = &securityhub.ResourceDetails{Other: details}
+		}
+		resources = append(resources, resource)
+	}
+
+	// A finding requires at least one resource.
+	if len(resources) == 0 {
+		id := report.Alert.Key
+		if id == "" {
+			id = string(report.ID)
+		}
+		resources = append(resources, &securityhub.Resource{
+			Type: aws.String("Other"),
+			Id:   aws.String(truncateText(id, securityHubMaxValue)),
+		})
+	}
+	return resources
+}
+
+// NewSecurityHubFinding maps the report to a finding of AWS Security Finding
+// Format. The SDK version in use has no Severity.Label and Workflow, so
+// Severity.Normalized and WorkflowState are set instead.
+func NewSecurityHubFinding(cfg SecurityHubConfig, report Report, now time.Time) *securityhub.AwsSecurityFinding {
+	accountID := report.AccountID
+	if accountID == "" {
+		accountID = cfg.AccountID
+	}
+
+	createdAt := report.ReceivedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+
+	title := report.Alert.Name
+	if title == "" {
+		title = report.OneLineSummary()
+	}
+	description := report.Alert.Description
+	if description == "" {
+		description = report.OneLineSummary()
+	}
+
+	severity := securityHubSeverity(report.Result.Severity)
+	finding := &securityhub.AwsSecurityFinding{
+		SchemaVersion: aws.String(securityHubSchemaVersion),
+		Id:            aws.String(SecurityHubFindingID(report)),
+		ProductArn:    aws.String(cfg.productArn()),
+		GeneratorId:   aws.String(truncateText("alert-responder/"+report.Alert.Rule, securityHubMaxID)),
+		AwsAccountId:  aws.String(accountID),
+		Types:         aws.StringSlice([]string{"Unusual Behaviors"}),
+		CreatedAt:     securityHubTime(createdAt),
+		UpdatedAt:     securityHubTime(now),
+		Severity: &securityhub.Severity{
+			Normalized: aws.Int64(severity),
+			Product:    aws.Float64(float64(severity)),
+		},
+		Title:       aws.String(truncateText(title, securityHubMaxTitle)),
+		Description: aws.String(truncateText(description, securityHubMaxDescription)),
+		ProductFields: map[string]*string{
+			"alert-responder/report_id": aws.String(string(report.ID)),
+			"alert-responder/rule":      aws.String(truncateText(report.Alert.Rule, securityHubMaxValue)),
+		},
+		Resources:     securityHubResources(report, cfg.Region),
+		WorkflowState: aws.String(securityHubWorkflowState(report.Status)),
+		RecordState:   aws.String("ACTIVE"),
+	}
+
+	if report.Result.Reason != "" {
+		finding.ProductFields["alert-responder/reason"] = aws.String(truncateText(report.Result.Reason, securityHubMaxValue))
+	}
+	if ts := report.Alert.Timestamp; ts.Init > 0 {
+		finding.FirstObservedAt = securityHubTime(time.Unix(int64(ts.Init), 0))
+		if ts.Last > 0 {
+			finding.LastObservedAt = securityHubTime(time.Unix(int64(ts.Last), 0))
+		}
+	}
+	if indicators := securityHubIndicators(report); len(indicators) > 0 {
+		finding.ThreatIntelIndicators = indicators
+	}
+
+	return finding
+}
+
+// PublishSecurityHub imports the finding of the report. Existing finding of
+// the report is updated. A client of cfg.Region is created if client is nil.
+func PublishSecurityHub(client securityhubiface.SecurityHubAPI, cfg SecurityHubConfig, report Report) error {
+	if cfg.AccountID == "" {
+		return NewConfigError("Security Hub account ID is not configured")
+	}
+
+	if client == nil {
+		client = securityhub.New(newSession(cfg.Region))
+	}
+
+	finding := NewSecurityHubFinding(cfg, report, time.Now().UTC())
+	resp, err := client.BatchImportFindings(&securityhub.BatchImportFindingsInput{
+		Findings: []*securityhub.AwsSecurityFinding{finding},
+	})
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to import finding to Security Hub")
+	}
+
+	if aws.Int64Value(resp.FailedCount) > 0 {
+		var msgs []string
+		for _, f := range resp.FailedFindings {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", aws.StringValue(f.ErrorCode), aws.StringValue(f.ErrorMessage)))
+		}
+		return WrapCode(ErrCodePublish, errors.New(strings.Join(msgs, "; ")), "Security Hub rejected finding")
+	}
+
+	Logger.WithFields(report.LogFields()).WithField("finding", aws.StringValue(finding.Id)).Info("Imported finding to Security Hub")
+	return nil
+}
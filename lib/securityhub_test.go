@@ -0,0 +1,151 @@
+package lib_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/securityhub"
+	"github.com/aws/aws-sdk-go/service/securityhub/securityhubiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSecurityHub struct {
+	securityhubiface.SecurityHubAPI
+	inputs []*securityhub.BatchImportFindingsInput
+	output *securityhub.BatchImportFindingsOutput
+}
+
+func (x *mockSecurityHub) BatchImportFindings(input *securityhub.BatchImportFindingsInput) (*securityhub.BatchImportFindingsOutput, error) {
+	x.inputs = append(x.inputs, input)
+	if x.output != nil {
+		return x.output, nil
+	}
+	return &securityhub.BatchImportFindingsOutput{
+		FailedCount:  aws.Int64(0),
+		SuccessCount: aws.Int64(int64(len(input.Findings))),
+	}, nil
+}
+
+var testSecurityHubConfig = lib.SecurityHubConfig{Region: "ap-northeast-1", AccountID: "123456789012"}
+
+func TestSecurityHubFinding(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusPublished
+	now := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	finding := lib.NewSecurityHubFinding(testSecurityHubConfig, report, now)
+	assert.Equal(t, "alert-responder/"+string(report.ID), aws.StringValue(finding.Id))
+	assert.Equal(t, "arn:aws:securityhub:ap-northeast-1:123456789012:product/123456789012/default", aws.StringValue(finding.ProductArn))
+	assert.Equal(t, "2018-10-08", aws.StringValue(finding.SchemaVersion))
+	assert.Equal(t, int64(90), aws.Int64Value(finding.Severity.Normalized))
+	assert.Equal(t, "ASSIGNED", aws.StringValue(finding.WorkflowState))
+	assert.Equal(t, "2019-02-01T00:00:00Z", aws.StringValue(finding.UpdatedAt))
+	assert.Equal(t, string(report.ID), aws.StringValue(finding.ProductFields["alert-responder/report_id"]))
+
+	require.Equal(t, 1, len(finding.Resources))
+	assert.Equal(t, "AwsEc2Instance", aws.StringValue(finding.Resources[0].Type))
+	assert.Equal(t, "i-0123456789", aws.StringValue(finding.Resources[0].Id))
+
+	var indicators []string
+	for _, ind := range finding.ThreatIntelIndicators {
+		indicators = append(indicators, aws.StringValue(ind.Type)+" "+aws.StringValue(ind.Value))
+	}
+	assert.Equal(t, []string{
+		"IPV4_ADDRESS 198.51.100.7",
+		"DOMAIN bad.example.com",
+		"URL http://bad.example.com/payload",
+		"HASH_SHA256 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"IPV4_ADDRESS 203.0.113.9",
+	}, indicators)
+	assert.Equal(t, "VirusTotal", aws.StringValue(finding.ThreatIntelIndicators[1].Source))
+}
+
+func TestSecurityHubFindingSeverity(t *testing.T) {
+	testCases := []struct {
+		sev        lib.ReportSeverity
+		normalized int64
+	}{
+		{lib.SevUrgent, 90},
+		{lib.SevUnclassified, 40},
+		{lib.SevSafe, 0},
+		{"", 40},
+		{"unknown", 40},
+	}
+
+	for _, tc := range testCases {
+		report := lib.Report{ID: "r1"}
+		report.Result.Severity = tc.sev
+		finding := lib.NewSecurityHubFinding(testSecurityHubConfig, report, time.Now())
+		assert.Equal(t, tc.normalized, aws.Int64Value(finding.Severity.Normalized), tc.sev)
+	}
+}
+
+func TestSecurityHubFindingIndicatorTypes(t *testing.T) {
+	report := lib.Report{ID: "r1", Content: lib.ReportContent{
+		OpponentHosts: map[string]lib.ReportOpponentHost{
+			"2001:db8::1": {ID: "2001:db8::1", IPAddr: []string{"2001:db8::1"}},
+			"10.0.0.5":    {ID: "10.0.0.5", IPAddr: []string{"10.0.0.5", "not-an-ip"}},
+		},
+	}}
+
+	finding := lib.NewSecurityHubFinding(testSecurityHubConfig, report, time.Now())
+	require.Equal(t, 1, len(finding.ThreatIntelIndicators))
+	assert.Equal(t, "IPV6_ADDRESS", aws.StringValue(finding.ThreatIntelIndicators[0].Type))
+
+	// A finding without local hosts still has a resource.
+	require.Equal(t, 1, len(finding.Resources))
+	assert.Equal(t, "Other", aws.StringValue(finding.Resources[0].Type))
+}
+
+func TestSecurityHubFindingTruncate(t *testing.T) {
+	report := loadFixtureReport(t)
+	report.Alert.Name = strings.Repeat("n", 300)
+	report.Alert.Description = strings.Repeat("d", 2000)
+	report.Content.OpponentHosts["198.51.100.7"].RelatedURLs[0].URL = "http://bad.example.com/" + strings.Repeat("x", 1000)
+
+	finding := lib.NewSecurityHubFinding(testSecurityHubConfig, report, time.Now())
+	assert.Equal(t, 256, len(aws.StringValue(finding.Title)))
+	assert.Equal(t, 1024, len(aws.StringValue(finding.Description)))
+	assert.True(t, strings.HasSuffix(aws.StringValue(finding.Description), "..."))
+	for _, ind := range finding.ThreatIntelIndicators {
+		assert.True(t, len(aws.StringValue(ind.Value)) <= 512)
+	}
+}
+
+func TestPublishSecurityHubUpdatesSameFinding(t *testing.T) {
+	client := &mockSecurityHub{}
+	report := loadFixtureReport(t)
+	report.Status = lib.StatusPublished
+	require.NoError(t, lib.PublishSecurityHub(client, testSecurityHubConfig, report))
+
+	report.Status = lib.StatusClosed
+	require.NoError(t, lib.PublishSecurityHub(client, testSecurityHubConfig, report))
+
+	require.Equal(t, 2, len(client.inputs))
+	first, second := client.inputs[0].Findings[0], client.inputs[1].Findings[0]
+	assert.Equal(t, aws.StringValue(first.Id), aws.StringValue(second.Id))
+	assert.Equal(t, aws.StringValue(first.CreatedAt), aws.StringValue(second.CreatedAt))
+	assert.Equal(t, "RESOLVED", aws.StringValue(second.WorkflowState))
+}
+
+func TestPublishSecurityHubFailedFinding(t *testing.T) {
+	client := &mockSecurityHub{output: &securityhub.BatchImportFindingsOutput{
+		FailedCount: aws.Int64(1),
+		FailedFindings: []*securityhub.ImportFindingsError{
+			{Id: aws.String("x"), ErrorCode: aws.String("InvalidInput"), ErrorMessage: aws.String("bad field")},
+		},
+	}}
+
+	err := lib.PublishSecurityHub(client, testSecurityHubConfig, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "InvalidInput: bad field")
+
+	err = lib.PublishSecurityHub(client, lib.SecurityHubConfig{Region: "ap-northeast-1"}, loadFixtureReport(t))
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceNowConfig is configuration of PublishServiceNow. OAuth client
+// credentials (ClientID and ClientSecret) are used if ClientID is set,
+// otherwise Username and Password are used for basic auth.
+type ServiceNowConfig struct {
+	// InstanceURL is URL of the instance, e.g. https://example.service-now.com
+	InstanceURL string
+
+	Username string
+	Password string
+
+	ClientID     string
+	ClientSecret string
+
+	// Levels maps severity to urgency and impact of the incident.
+	// DefaultServiceNowLevels is used for severities not in the map.
+	Levels map[ReportSeverity]ServiceNowLevel
+
+	// MinSeverity is the lowest severity that opens a new incident. Existing
+	// incidents are updated regardless of severity.
+	MinSeverity ReportSeverity
+
+	// AssignmentGroup is name or sys_id of the group assigned to incidents.
+	AssignmentGroup string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+// ServiceNowLevel is urgency and impact of incident, "1" (high) to "3" (low).
+type ServiceNowLevel struct {
+	Urgency string
+	Impact  string
+}
+
+// DefaultServiceNowLevels is used if ServiceNowConfig.Levels does not have
+// the severity.
+var DefaultServiceNowLevels = map[ReportSeverity]ServiceNowLevel{
+	SevUrgent:       {Urgency: "1", Impact: "1"},
+	SevUnclassified: {Urgency: "2", Impact: "2"},
+	SevSafe:         {Urgency: "3", Impact: "3"},
+}
+
+// Limits of incident fields. Longer values are truncated.
+const (
+	serviceNowMaxShortDescription = 160
+	serviceNowMaxDescription      = 4000
+	serviceNowMaxWorkNotes        = 30000
+)
+
+const serviceNowIncidentPath = "/api/now/table/incident"
+
+func (x *ServiceNowConfig) validate() error {
+	if x.InstanceURL == "" {
+		return NewConfigError("ServiceNow instance URL is not configured")
+	}
+	if x.ClientID == "" && (x.Username == "" || x.Password == "") {
+		return NewConfigError("ServiceNow credential is not configured")
+	}
+	return nil
+}
+
+func (x *ServiceNowConfig) level(sev ReportSeverity) ServiceNowLevel {
+	if l, ok := x.Levels[sev]; ok {
+		return l
+	}
+	if l, ok := DefaultServiceNowLevels[sev]; ok {
+		return l
+	}
+	return DefaultServiceNowLevels[SevUnclassified]
+}
+
+func (x *ServiceNowConfig) minSeverity() ReportSeverity {
+	if x.MinSeverity == "" {
+		return SevUnclassified
+	}
+	return x.MinSeverity
+}
+
+func (x *ServiceNowConfig) retry() HTTPRetry {
+	if x.Retry.MaxRetry == 0 && x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+func (x *ServiceNowConfig) instanceURL() string {
+	return strings.TrimRight(x.InstanceURL, "/")
+}
+
+type serviceNowToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// serviceNowTokens caches OAuth access tokens by instance and client ID in
+// this process.
+var serviceNowTokens = struct {
+	sync.Mutex
+	tokens map[string]serviceNowToken
+}{tokens: map[string]serviceNowToken{}}
+
+// oauthToken returns a cached access token or gets a new one if it is
+// expired or refresh is true.
+func (x *ServiceNowConfig) oauthToken(refresh bool) (string, error) {
+	serviceNowTokens.Lock()
+	defer serviceNowTokens.Unlock()
+
+	key := x.instanceURL() + "/" + x.ClientID
+	if token, ok := serviceNowTokens.tokens[key]; ok && !refresh && time.Now().Before(token.expiresAt) {
+		return token.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", x.ClientID)
+	form.Set("client_secret", x.ClientSecret)
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	header.Set("Accept", "application/json")
+
+	resp, err := sendHTTPRequest(x.Client, http.MethodPost, x.instanceURL()+"/oauth_token.do", header, []byte(form.Encode()), x.retry())
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok && (httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusBadRequest) {
+			return "", WrapCode(ErrCodeInvalidConfig, err, "ServiceNow OAuth client is rejected")
+		}
+		return "", WrapCode(ErrCodePublish, err, "Fail to get ServiceNow access token")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(resp, &token); err != nil {
+		return "", WrapCode(ErrCodeMarshal, err, "Fail to unmarshal ServiceNow access token")
+	}
+
+	// The token is refreshed a minute before expiration.
+	serviceNowTokens.tokens[key] = serviceNowToken{
+		accessToken: token.AccessToken,
+		expiresAt:   time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute),
+	}
+	return token.AccessToken, nil
+}
+
+func (x *ServiceNowConfig) authorization(refresh bool) (string, error) {
+	if x.ClientID == "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(x.Username+":"+x.Password)), nil
+	}
+
+	token, err := x.oauthToken(refresh)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+// request sends a JSON request to Table API and decodes response into out if
+// it is not nil. An OAuth access token rejected by 401 is refreshed once, e.g.
+// when it is revoked before expiration.
+func (x *ServiceNowConfig) request(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to marshal ServiceNow request")
+		}
+		body = raw
+	}
+
+	var resp []byte
+	for refresh := false; ; refresh = true {
+		auth, err := x.authorization(refresh)
+		if err != nil {
+			return err
+		}
+
+		header := http.Header{}
+		header.Set("Accept", "application/json")
+		header.Set("Content-Type", "application/json")
+		header.Set("Authorization", auth)
+
+		resp, err = sendHTTPRequest(x.Client, method, x.instanceURL()+path, header, body, x.retry())
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.StatusCode == http.StatusUnauthorized {
+			if x.ClientID != "" && !refresh {
+				Logger.Info("ServiceNow access token is rejected, refresh it")
+				continue
+			}
+			return WrapCode(ErrCodeInvalidConfig, err, "ServiceNow authentication failed")
+		} else if err != nil {
+			return WrapCode(ErrCodePublish, err, fmt.Sprintf("Fail to %s %s", method, path))
+		}
+		break
+	}
+
+	if out != nil && len(resp) > 0 {
+		if err := json.Unmarshal(resp, out); err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to unmarshal ServiceNow response")
+		}
+	}
+	return nil
+}
+
+// ServiceNowShortDescription returns short_description of the incident.
+func ServiceNowShortDescription(report Report) string {
+	return truncateText(report.OneLineSummary(), serviceNowMaxShortDescription)
+}
+
+func serviceNowWorkNotes(cfg ServiceNowConfig, report Report) string {
+	notes := RenderMarkDown(report)
+	if link := reportLink(cfg.ReportURL, report); link != "" {
+		notes += "\n\nFull report: " + link
+	}
+	return TruncateMarkDown(notes, serviceNowMaxWorkNotes)
+}
+
+// findServiceNowIncident returns sys_id of the incident of the report. Empty
+// string is returned if not found.
+func findServiceNowIncident(cfg ServiceNowConfig, report Report) (string, error) {
+	query := url.Values{}
+	query.Set("sysparm_query", "correlation_id="+string(report.ID))
+	query.Set("sysparm_fields", "sys_id,number")
+	query.Set("sysparm_limit", "1")
+
+	var resp struct {
+		Result []struct {
+			SysID  string `json:"sys_id"`
+			Number string `json:"number"`
+		} `json:"result"`
+	}
+	if err := cfg.request(http.MethodGet, serviceNowIncidentPath+"?"+query.Encode(), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Result) == 0 {
+		return "", nil
+	}
+	return resp.Result[0].SysID, nil
+}
+
+func createServiceNowIncident(cfg ServiceNowConfig, report Report) (string, error) {
+	level := cfg.level(report.Result.Severity)
+	incident := map[string]string{
+		"short_description":   ServiceNowShortDescription(report),
+		"description":         truncateText(report.Alert.Description, serviceNowMaxDescription),
+		"work_notes":          serviceNowWorkNotes(cfg, report),
+		"urgency":             level.Urgency,
+		"impact":              level.Impact,
+		"category":            "security",
+		"correlation_id":      string(report.ID),
+		"correlation_display": "AlertResponder",
+	}
+	if cfg.AssignmentGroup != "" {
+		incident["assignment_group"] = cfg.AssignmentGroup
+	}
+
+	var resp struct {
+		Result struct {
+			Number string `json:"number"`
+		} `json:"result"`
+	}
+	if err := cfg.request(http.MethodPost, serviceNowIncidentPath, incident, &resp); err != nil {
+		return "", err
+	}
+	return resp.Result.Number, nil
+}
+
+func updateServiceNowIncident(cfg ServiceNowConfig, sysID string, report Report) error {
+	level := cfg.level(report.Result.Severity)
+	update := map[string]string{
+		"work_notes": serviceNowWorkNotes(cfg, report),
+		"urgency":    level.Urgency,
+		"impact":     level.Impact,
+	}
+	return cfg.request(http.MethodPatch, serviceNowIncidentPath+"/"+url.PathEscape(sysID), update, nil)
+}
+
+// PublishServiceNow opens an incident of the report, or adds work notes to
+// the existing incident found by correlation_id. Reports below MinSeverity do
+// not open new incident.
+func PublishServiceNow(cfg ServiceNowConfig, report Report) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	sysID, err := findServiceNowIncident(cfg, report)
+	if err != nil {
+		return err
+	}
+
+	logger := Logger.WithFields(report.LogFields())
+	if sysID != "" {
+		if err := updateServiceNowIncident(cfg, sysID, report); err != nil {
+			return err
+		}
+		logger.WithField("sys_id", sysID).Info("Updated ServiceNow incident")
+		return nil
+	}
+
+	if report.Result.Severity.Level() < cfg.minSeverity().Level() {
+		logger.Info("Severity is lower than threshold, skip ServiceNow")
+		return nil
+	}
+
+	number, err := createServiceNowIncident(cfg, report)
+	if err != nil {
+		return err
+	}
+	logger.WithField("incident", number).Info("Created ServiceNow incident")
+	return nil
+}
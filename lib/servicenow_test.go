@@ -0,0 +1,215 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockServiceNowIncident struct {
+	Fields    map[string]string
+	WorkNotes []string
+}
+
+// mockServiceNow is a minimum ServiceNow Table API and OAuth server for tests.
+type mockServiceNow struct {
+	t         *testing.T
+	srv       *httptest.Server
+	incidents map[string]*mockServiceNowIncident
+	tokens    map[string]bool
+	issued    int
+	auth      []string
+}
+
+func newMockServiceNow(t *testing.T) *mockServiceNow {
+	x := &mockServiceNow{t: t, incidents: map[string]*mockServiceNowIncident{}, tokens: map[string]bool{}}
+	x.srv = httptest.NewServer(http.HandlerFunc(x.handle))
+	return x
+}
+
+func (x *mockServiceNow) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/oauth_token.do" && r.Method == http.MethodPost {
+		require.NoError(x.t, r.ParseForm())
+		if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		x.issued++
+		token := fmt.Sprintf("token-%d", x.issued)
+		x.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 1800})
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	x.auth = append(x.auth, auth)
+	if strings.HasPrefix(auth, "Bearer ") && !x.tokens[strings.TrimPrefix(auth, "Bearer ")] {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"User Not Authenticated"}}`))
+		return
+	}
+	if user, pass, ok := r.BasicAuth(); ok && (user != "admin" || pass != "pass") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/now/table/incident" && r.Method == http.MethodGet:
+		results := []map[string]string{}
+		query := r.URL.Query().Get("sysparm_query")
+		for id, inc := range x.incidents {
+			if query == "correlation_id="+inc.Fields["correlation_id"] {
+				results = append(results, map[string]string{"sys_id": id, "number": inc.Fields["number"]})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": results})
+
+	case r.URL.Path == "/api/now/table/incident" && r.Method == http.MethodPost:
+		var fields map[string]string
+		require.NoError(x.t, json.NewDecoder(r.Body).Decode(&fields))
+		id := fmt.Sprintf("sys%d", len(x.incidents)+1)
+		fields["number"] = fmt.Sprintf("INC%07d", len(x.incidents)+1)
+		x.incidents[id] = &mockServiceNowIncident{Fields: fields, WorkNotes: []string{fields["work_notes"]}}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": fields})
+
+	case strings.HasPrefix(r.URL.Path, "/api/now/table/incident/") && r.Method == http.MethodPatch:
+		inc, ok := x.incidents[strings.TrimPrefix(r.URL.Path, "/api/now/table/incident/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var fields map[string]string
+		require.NoError(x.t, json.NewDecoder(r.Body).Decode(&fields))
+		for k, v := range fields {
+			if k == "work_notes" {
+				inc.WorkNotes = append(inc.WorkNotes, v)
+			} else {
+				inc.Fields[k] = v
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": inc.Fields})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (x *mockServiceNow) basicConfig() lib.ServiceNowConfig {
+	return lib.ServiceNowConfig{
+		InstanceURL: x.srv.URL,
+		Username:    "admin",
+		Password:    "pass",
+		Retry:       lib.HTTPRetry{MaxRetry: 1, Wait: time.Millisecond},
+	}
+}
+
+func (x *mockServiceNow) oauthConfig() lib.ServiceNowConfig {
+	return lib.ServiceNowConfig{
+		InstanceURL:  x.srv.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Retry:        lib.HTTPRetry{MaxRetry: 1, Wait: time.Millisecond},
+	}
+}
+
+func TestPublishServiceNowCreate(t *testing.T) {
+	sn := newMockServiceNow(t)
+	defer sn.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishServiceNow(sn.basicConfig(), report))
+
+	require.Equal(t, 1, len(sn.incidents))
+	inc := sn.incidents["sys1"]
+	assert.Equal(t, string(report.ID), inc.Fields["correlation_id"])
+	assert.Equal(t, lib.ServiceNowShortDescription(report), inc.Fields["short_description"])
+	assert.Equal(t, "1", inc.Fields["urgency"])
+	assert.Equal(t, "1", inc.Fields["impact"])
+	assert.Contains(t, inc.WorkNotes[0], lib.RenderMarkDown(report))
+	assert.True(t, strings.HasPrefix(sn.auth[0], "Basic "))
+}
+
+func TestPublishServiceNowUpdate(t *testing.T) {
+	sn := newMockServiceNow(t)
+	defer sn.srv.Close()
+
+	cfg := sn.basicConfig()
+	cfg.Levels = map[lib.ReportSeverity]lib.ServiceNowLevel{lib.SevUnclassified: {Urgency: "2", Impact: "3"}}
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishServiceNow(cfg, report))
+
+	// Recompiled report updates work notes of the existing incident.
+	report.Result.Severity = lib.SevUnclassified
+	report.Result.Reason = "Scanner of the vendor"
+	require.NoError(t, lib.PublishServiceNow(cfg, report))
+
+	require.Equal(t, 1, len(sn.incidents))
+	inc := sn.incidents["sys1"]
+	require.Equal(t, 2, len(inc.WorkNotes))
+	assert.Contains(t, inc.WorkNotes[1], "Scanner of the vendor")
+	assert.Equal(t, "2", inc.Fields["urgency"])
+	assert.Equal(t, "3", inc.Fields["impact"])
+}
+
+func TestPublishServiceNowBelowMinSeverity(t *testing.T) {
+	sn := newMockServiceNow(t)
+	defer sn.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Result.Severity = lib.SevSafe
+	require.NoError(t, lib.PublishServiceNow(sn.basicConfig(), report))
+	assert.Equal(t, 0, len(sn.incidents))
+}
+
+func TestPublishServiceNowOAuthRefresh(t *testing.T) {
+	sn := newMockServiceNow(t)
+	defer sn.srv.Close()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishServiceNow(sn.oauthConfig(), report))
+	assert.Equal(t, 1, sn.issued)
+
+	// Cached token is reused while it is valid.
+	require.NoError(t, lib.PublishServiceNow(sn.oauthConfig(), report))
+	assert.Equal(t, 1, sn.issued)
+
+	// Revoked token is refreshed by 401.
+	sn.tokens = map[string]bool{}
+	report.Result.Reason = "After revoke"
+	require.NoError(t, lib.PublishServiceNow(sn.oauthConfig(), report))
+	assert.Equal(t, 2, sn.issued)
+	assert.Equal(t, "Bearer token-2", sn.auth[len(sn.auth)-1])
+	assert.Contains(t, sn.incidents["sys1"].WorkNotes[2], "After revoke")
+
+	// Invalid client is a configuration error.
+	cfg := sn.oauthConfig()
+	cfg.ClientID = "other"
+	cfg.ClientSecret = "wrong"
+	err := lib.PublishServiceNow(cfg, report)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err))
+}
+
+func TestPublishServiceNowTruncate(t *testing.T) {
+	sn := newMockServiceNow(t)
+	defer sn.srv.Close()
+
+	report := loadFixtureReport(t)
+	report.Alert.Rule = strings.Repeat("r", 300)
+	report.Alert.Description = strings.Repeat("d", 5000)
+	require.NoError(t, lib.PublishServiceNow(sn.basicConfig(), report))
+
+	inc := sn.incidents["sys1"]
+	assert.Equal(t, 160, len(inc.Fields["short_description"]))
+	assert.Equal(t, 4000, len(inc.Fields["description"]))
+}
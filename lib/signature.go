@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSignatureHeader is a header of webhook requests that has HMAC
+// signature of the body.
+const DefaultSignatureHeader = "X-AlertResponder-Signature"
+
+// signaturePrefix is an optional prefix of signature, e.g. "sha256=0a1b...".
+const signaturePrefix = "sha256="
+
+var (
+	// ErrSignatureMissing and ErrSignatureMismatch are causes of
+	// VerifySignature errors.
+	ErrSignatureMissing  = errors.New("Signature is missing")
+	ErrSignatureMismatch = errors.New("Signature does not match")
+)
+
+// SignBody returns hex encoded HMAC-SHA256 of the body by the secret.
+func SignBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks that signature is HMAC-SHA256 of the raw body by the
+// secret. The signature is hex encoded and may have "sha256=" prefix. Digests
+// are compared in constant time. An error of ErrCodeInvalidSignature is
+// returned if the signature is missing or does not match.
+func VerifySignature(secret, body []byte, signature string) error {
+	if len(secret) == 0 {
+		return NewConfigError("Secret of signature is not configured")
+	}
+
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return WrapCode(ErrCodeInvalidSignature, ErrSignatureMissing, "Invalid signature")
+	}
+	if strings.HasPrefix(strings.ToLower(signature), signaturePrefix) {
+		signature = signature[len(signaturePrefix):]
+	}
+
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return WrapCode(ErrCodeInvalidSignature, ErrSignatureMismatch, "Invalid signature")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), actual) {
+		return WrapCode(ErrCodeInvalidSignature, ErrSignatureMismatch, "Invalid signature")
+	}
+	return nil
+}
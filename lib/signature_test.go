@@ -0,0 +1,45 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("shared-secret")
+	body := []byte(`{"name":"test","rule":"r1","key":"198.51.100.7"}`)
+	signature := lib.SignBody(secret, body)
+
+	require.NoError(t, lib.VerifySignature(secret, body, signature))
+	require.NoError(t, lib.VerifySignature(secret, body, "sha256="+signature))
+
+	testCases := []struct {
+		title     string
+		secret    []byte
+		body      []byte
+		signature string
+		cause     error
+	}{
+		{"missing", secret, body, "", lib.ErrSignatureMissing},
+		{"blank", secret, body, "  ", lib.ErrSignatureMissing},
+		{"other secret", []byte("other-secret"), body, signature, lib.ErrSignatureMismatch},
+		{"modified body", secret, append(body, ' '), signature, lib.ErrSignatureMismatch},
+		{"not hex", secret, body, "sha256=zz", lib.ErrSignatureMismatch},
+		{"truncated", secret, body, signature[:32], lib.ErrSignatureMismatch},
+	}
+
+	for _, tc := range testCases {
+		err := lib.VerifySignature(tc.secret, tc.body, tc.signature)
+		require.Error(t, err, tc.title)
+		assert.Equal(t, lib.ErrCodeInvalidSignature, lib.ErrorCodeOf(err), tc.title)
+		assert.Equal(t, tc.cause, errors.Cause(err), tc.title)
+	}
+
+	// Missing secret is misconfiguration rather than invalid request.
+	_, ok := lib.VerifySignature(nil, body, signature).(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,404 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Limits of Slack Block Kit
+const (
+	slackMaxHeaderLen  = 150
+	slackMaxTextLen    = 3000
+	slackMaxMessageLen = 40000
+	slackMaxIndicators = 5
+)
+
+// DefaultSlackAPIURL is endpoint of Slack Web API.
+const DefaultSlackAPIURL = "https://slack.com/api"
+
+// Formats of the report file attached to Slack messages.
+const (
+	SlackAttachMarkdown = "markdown"
+	SlackAttachHTML     = "html"
+)
+
+// DefaultSlackMaxFileSize is limit of the attached report file if
+// MaxFileSize is not set. A larger report is truncated with a notice.
+const DefaultSlackMaxFileSize = 1024 * 1024
+
+// SlackConfig is configuration of PublishSlack.
+type SlackConfig struct {
+	WebhookURL string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	// Templates renders header and summary of the message. Default templates
+	// are used if nil.
+	Templates *NotificationTemplates
+
+	// Locale is locale of the message. Empty means DefaultLocale.
+	Locale string
+
+	// BotToken and Channel post the message by chat.postMessage of Web API
+	// instead of WebhookURL. They are required to attach the report file
+	// because incoming webhooks can not upload files.
+	BotToken string
+	Channel  string
+
+	// AttachReport is format of the full report uploaded to the thread of the
+	// message, SlackAttachMarkdown or SlackAttachHTML. Empty means no file.
+	AttachReport string
+
+	// MaxFileSize is limit of the attached file in bytes.
+	// DefaultSlackMaxFileSize is used if it is not positive.
+	MaxFileSize int
+
+	// APIURL overrides DefaultSlackAPIURL, e.g. for tests.
+	APIURL string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+func (x *SlackConfig) apiURL() string {
+	if x.APIURL != "" {
+		return strings.TrimRight(x.APIURL, "/")
+	}
+	return DefaultSlackAPIURL
+}
+
+func (x *SlackConfig) retry() HTTPRetry {
+	if x.Retry.Wait == 0 {
+		return DefaultHTTPRetry
+	}
+	return x.Retry
+}
+
+// reportLink returns URL of the full report. Empty string is returned if no
+// template is configured.
+func reportLink(tmpl string, report Report) string {
+	return strings.Replace(tmpl, "{report_id}", string(report.ID), -1)
+}
+
+// SlackMessage is a message payload of Slack incoming webhook
+type SlackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []SlackAttachment `json:"attachments,omitempty"`
+}
+
+type SlackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []SlackBlock `json:"blocks"`
+}
+
+type SlackBlock struct {
+	Type     string         `json:"type"`
+	Text     *SlackText     `json:"text,omitempty"`
+	Fields   []SlackText    `json:"fields,omitempty"`
+	Elements []SlackElement `json:"elements,omitempty"`
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type SlackElement struct {
+	Type string     `json:"type"`
+	Text *SlackText `json:"text,omitempty"`
+	URL  string     `json:"url,omitempty"`
+}
+
+// SlackColor returns color of attachment for the severity.
+func SlackColor(sev ReportSeverity) string {
+	return severityColor(sev)
+}
+
+// truncateText cuts s to maxLen bytes with "..." on a character boundary.
+func truncateText(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	n := maxLen - 3
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+func severityLabel(report Report) string {
+	if report.Result.Severity == "" {
+		return "UNCLASSIFIED"
+	}
+	return strings.ToUpper(string(report.Result.Severity))
+}
+
+func slackMrkdwn(s string) *SlackText {
+	return &SlackText{Type: "mrkdwn", Text: truncateText(s, slackMaxTextLen)}
+}
+
+// NewSlackMessage builds a Block Kit message of the report. If the message
+// exceeds Slack limits, only summary and link are included.
+func NewSlackMessage(cfg SlackConfig, report Report) SlackMessage {
+	text := cfg.Templates.Render(NotifySlack, report, cfg.ReportURL, cfg.Locale)
+	header := SlackBlock{
+		Type: "header",
+		Text: &SlackText{
+			Type: "plain_text",
+			Text: truncateText(text.Title, slackMaxHeaderLen),
+		},
+	}
+
+	summary := SlackBlock{
+		Type: "section",
+		Text: slackMrkdwn(text.Body),
+		Fields: []SlackText{
+			{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%d", Translate(cfg.Locale, "count.remote_hosts"), len(report.Content.OpponentHosts))},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%d", Translate(cfg.Locale, "count.local_hosts"), len(report.Content.AlliedHosts))},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%d", Translate(cfg.Locale, "count.users"), len(report.Content.SubjectUsers))},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%d", Translate(cfg.Locale, "count.malicious_hashes"), len(report.Content.MaliciousHashes()))},
+		},
+	}
+
+	var link []SlackBlock
+	if url := reportLink(cfg.ReportURL, report); url != "" {
+		link = append(link, SlackBlock{
+			Type: "actions",
+			Elements: []SlackElement{
+				{
+					Type: "button",
+					Text: &SlackText{Type: "plain_text", Text: Translate(cfg.Locale, "full_report")},
+					URL:  url,
+				},
+			},
+		})
+	}
+
+	blocks := []SlackBlock{header, summary}
+	if indicators := report.topIndicators(slackMaxIndicators, true); len(indicators) > 0 {
+		blocks = append(blocks, SlackBlock{
+			Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: "*" + Translate(cfg.Locale, "top_indicators") + "*\n• " + strings.Join(indicators, "\n• ")},
+		})
+	}
+	blocks = append(blocks, link...)
+
+	msg := SlackMessage{
+		Text: report.OneLineSummary(),
+		Attachments: []SlackAttachment{
+			{Color: SlackColor(report.Result.Severity), Blocks: blocks},
+		},
+	}
+
+	if !slackWithinLimits(msg) {
+		Logger.WithFields(report.LogFields()).Warn("Slack message exceeds limits, fallback to summary")
+		msg.Text = truncateText(msg.Text, slackMaxTextLen)
+		msg.Attachments[0].Blocks = append([]SlackBlock{header, summary}, link...)
+	}
+
+	return msg
+}
+
+func slackWithinLimits(msg SlackMessage) bool {
+	if len(msg.Text) > slackMaxTextLen {
+		return false
+	}
+
+	for _, att := range msg.Attachments {
+		for _, block := range att.Blocks {
+			if block.Text != nil && len(block.Text.Text) > slackMaxTextLen {
+				return false
+			}
+		}
+	}
+
+	raw, err := json.Marshal(msg)
+	return err == nil && len(raw) <= slackMaxMessageLen
+}
+
+// PublishSlack posts the report to Slack via incoming webhook, or via Web API
+// if BotToken is set. The report file is attached to the thread of the
+// message after the message is posted, and a failure of the upload is logged
+// without failing the publish because retrying it would post the message
+// again.
+func PublishSlack(cfg SlackConfig, report Report) error {
+	switch cfg.AttachReport {
+	case "", SlackAttachMarkdown, SlackAttachHTML:
+	default:
+		return NewConfigError("Unknown format of Slack report file: " + cfg.AttachReport)
+	}
+
+	if cfg.BotToken != "" {
+		return publishSlackAPI(cfg, report)
+	}
+	if cfg.AttachReport != "" {
+		return NewConfigError("Slack bot token is required to attach report file")
+	}
+	if cfg.WebhookURL == "" {
+		return errors.New("Slack webhook URL is not configured")
+	}
+
+	raw, err := json.Marshal(NewSlackMessage(cfg, report))
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal slack message")
+	}
+
+	if _, err := postJSON(cfg.Client, cfg.WebhookURL, nil, raw, cfg.retry()); err != nil {
+		return errors.Wrap(err, "Fail to post slack message")
+	}
+
+	return nil
+}
+
+// slackPostMessage is a payload of chat.postMessage.
+type slackPostMessage struct {
+	Channel string `json:"channel"`
+	SlackMessage
+}
+
+// slackAPIResponse has fields of responses of Web API methods used by
+// PublishSlack.
+type slackAPIResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	Channel   string `json:"channel"`
+	TS        string `json:"ts"`
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// callAPI calls a method of Web API. Slack responds 200 with "ok": false for
+// errors of the method, and it is returned as an error.
+func (x *SlackConfig) callAPI(method, contentType string, body []byte) (*slackAPIResponse, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+x.BotToken)
+	header.Set("Content-Type", contentType)
+
+	raw, err := sendHTTPRequest(x.Client, http.MethodPost, x.apiURL()+"/"+method, header, body, x.retry())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp slackAPIResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to unmarshal response of "+method)
+	}
+	if !resp.OK {
+		return nil, NewCodedError(ErrCodePublish, fmt.Sprintf("Slack API %s failed: %s", method, resp.Error))
+	}
+	return &resp, nil
+}
+
+func (x *SlackConfig) callForm(method string, form url.Values) (*slackAPIResponse, error) {
+	return x.callAPI(method, "application/x-www-form-urlencoded", []byte(form.Encode()))
+}
+
+func publishSlackAPI(cfg SlackConfig, report Report) error {
+	if cfg.Channel == "" {
+		return NewConfigError("Slack channel is not configured")
+	}
+
+	raw, err := json.Marshal(slackPostMessage{Channel: cfg.Channel, SlackMessage: NewSlackMessage(cfg, report)})
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal slack message")
+	}
+
+	posted, err := cfg.callAPI("chat.postMessage", "application/json; charset=utf-8", raw)
+	if err != nil {
+		return errors.Wrap(err, "Fail to post slack message")
+	}
+
+	if cfg.AttachReport != "" {
+		if err := uploadSlackReport(cfg, report, posted.Channel, posted.TS); err != nil {
+			Logger.WithFields(report.LogFields()).WithFields(ErrorFields(err)).
+				Error("Fail to attach report file to Slack message")
+		}
+	}
+
+	return nil
+}
+
+// truncateHTML cuts html at a line boundary to be shorter than maxSize bytes
+// and appends a truncation notice as TruncateMarkDown does.
+func truncateHTML(html string, maxSize int) string {
+	if maxSize <= 0 || len(html) <= maxSize {
+		return html
+	}
+
+	marker := fmt.Sprintf("\n<p><em>(truncated, original size is %d bytes)</em></p>\n", len(html))
+	limit := maxSize - len(marker)
+	if limit < 0 {
+		limit = 0
+	}
+
+	cut := strings.LastIndex(html[:limit], "\n")
+	if cut < 0 {
+		cut = limit
+	}
+	return html[:cut] + marker
+}
+
+// slackReportFile returns name and content of the report file in format of
+// AttachReport. The content is truncated to MaxFileSize.
+func slackReportFile(cfg SlackConfig, report Report) (string, []byte, error) {
+	maxSize := cfg.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = DefaultSlackMaxFileSize
+	}
+
+	if cfg.AttachReport == SlackAttachHTML {
+		html, err := RenderHTML(report)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("report-%s.html", report.ID), []byte(truncateHTML(html, maxSize)), nil
+	}
+	return fmt.Sprintf("report-%s.md", report.ID), []byte(TruncateMarkDown(RenderMarkDown(report), maxSize)), nil
+}
+
+// uploadSlackReport uploads the report file to the thread by external upload
+// of Web API: the file is sent to URL given by files.getUploadURLExternal and
+// shared by files.completeUploadExternal.
+func uploadSlackReport(cfg SlackConfig, report Report, channel, ts string) error {
+	name, data, err := slackReportFile(cfg, report)
+	if err != nil {
+		return err
+	}
+
+	upload, err := cfg.callForm("files.getUploadURLExternal", url.Values{
+		"filename": {name},
+		"length":   {strconv.Itoa(len(data))},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to get upload URL of report file")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if _, err := sendHTTPRequest(cfg.Client, http.MethodPost, upload.UploadURL, header, data, cfg.retry()); err != nil {
+		return errors.Wrap(err, "Fail to upload report file")
+	}
+
+	files, err := json.Marshal([]map[string]string{{"id": upload.FileID, "title": name}})
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal uploaded files")
+	}
+	if _, err := cfg.callForm("files.completeUploadExternal", url.Values{
+		"files":      {string(files)},
+		"channel_id": {channel},
+		"thread_ts":  {ts},
+	}); err != nil {
+		return errors.Wrap(err, "Fail to complete upload of report file")
+	}
+
+	return nil
+}
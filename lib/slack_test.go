@@ -0,0 +1,286 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type slackServer struct {
+	*httptest.Server
+	failures int
+	calls    int
+	messages []lib.SlackMessage
+}
+
+func newSlackServer(t *testing.T, failures int) *slackServer {
+	s := &slackServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls++
+		if s.calls <= s.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var msg lib.SlackMessage
+		require.NoError(t, json.Unmarshal(raw, &msg))
+		s.messages = append(s.messages, msg)
+		w.Write([]byte("ok"))
+	}))
+	return s
+}
+
+func TestPublishSlack(t *testing.T) {
+	srv := newSlackServer(t, 0)
+	defer srv.Close()
+
+	report := loadFixtureReport(t)
+	err := lib.PublishSlack(lib.SlackConfig{
+		WebhookURL: srv.URL,
+		ReportURL:  "https://reports.example.com/{report_id}.json",
+	}, report)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(srv.messages))
+
+	msg := srv.messages[0]
+	assert.Equal(t, report.OneLineSummary(), msg.Text)
+	require.Equal(t, 1, len(msg.Attachments))
+	assert.Equal(t, "#d50200", msg.Attachments[0].Color)
+
+	blocks := msg.Attachments[0].Blocks
+	require.Equal(t, 4, len(blocks))
+	assert.Equal(t, "header", blocks[0].Type)
+	assert.Contains(t, blocks[0].Text.Text, "[URGENT]")
+	assert.Contains(t, blocks[0].Text.Text, string(report.ID))
+
+	assert.Equal(t, "section", blocks[1].Type)
+	assert.Equal(t, 4, len(blocks[1].Fields))
+	assert.Equal(t, "*Remote hosts*\n2", blocks[1].Fields[0].Text)
+
+	assert.Equal(t, "section", blocks[2].Type)
+	assert.Contains(t, blocks[2].Text.Text, "198.51.100.7 (RU): 1 malicious hash, 1 domain, 1 URL")
+
+	assert.Equal(t, "actions", blocks[3].Type)
+	assert.Equal(t, "https://reports.example.com/5a4d0a3c-6e8f-4d7b-9c1e-2f3a4b5c6d7e.json",
+		blocks[3].Elements[0].URL)
+}
+
+func TestPublishSlackRetry(t *testing.T) {
+	srv := newSlackServer(t, 2)
+	defer srv.Close()
+
+	cfg := lib.SlackConfig{
+		WebhookURL: srv.URL,
+		Retry:      lib.HTTPRetry{MaxRetry: 3, Wait: time.Millisecond},
+	}
+	require.NoError(t, lib.PublishSlack(cfg, loadFixtureReport(t)))
+	assert.Equal(t, 3, srv.calls)
+	assert.Equal(t, 1, len(srv.messages))
+}
+
+func TestPublishSlackRetryExhausted(t *testing.T) {
+	srv := newSlackServer(t, 10)
+	defer srv.Close()
+
+	cfg := lib.SlackConfig{
+		WebhookURL: srv.URL,
+		Retry:      lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+	assert.Error(t, lib.PublishSlack(cfg, loadFixtureReport(t)))
+	assert.Equal(t, 3, srv.calls)
+}
+
+func TestSlackMessageFallback(t *testing.T) {
+	report := loadFixtureReport(t)
+	for i := 0; i < 5; i++ {
+		id := string(rune('a'+i)) + strings.Repeat("x", 1000)
+		report.Content.OpponentHosts[id] = lib.ReportOpponentHost{
+			ID:             id,
+			RelatedDomains: []lib.ReportDomain{{Name: "example.com"}},
+		}
+	}
+
+	msg := lib.NewSlackMessage(lib.SlackConfig{ReportURL: "https://reports.example.com/{report_id}"}, report)
+	blocks := msg.Attachments[0].Blocks
+	require.Equal(t, 3, len(blocks))
+	assert.Equal(t, "header", blocks[0].Type)
+	assert.Equal(t, "section", blocks[1].Type)
+	assert.Equal(t, "actions", blocks[2].Type)
+}
+
+func TestSlackMessageTruncateMultiByte(t *testing.T) {
+	// The title exceeds the header limit in the middle of a character.
+	report := lib.NewReport(lib.ReportID(strings.Repeat("検", 60)), lib.Alert{})
+	msg := lib.NewSlackMessage(lib.SlackConfig{}, report)
+	title := msg.Attachments[0].Blocks[0].Text.Text
+	assert.True(t, utf8.ValidString(title), title)
+	assert.True(t, len(title) <= 150)
+	assert.True(t, strings.HasSuffix(title, "検..."), title)
+}
+
+func TestSlackMessageGolden(t *testing.T) {
+	cfg := lib.SlackConfig{ReportURL: "https://reports.example.com/{report_id}.json"}
+	for name, report := range map[string]lib.Report{
+		"slack_full.json":  loadFullReport(t),
+		"slack_empty.json": emptyReport(),
+	} {
+		raw, err := json.MarshalIndent(lib.NewSlackMessage(cfg, report), "", "  ")
+		require.NoError(t, err)
+		assertGolden(t, name, string(raw)+"\n")
+	}
+}
+
+func TestSlackColor(t *testing.T) {
+	assert.Equal(t, "#d50200", lib.SlackColor(lib.SevUrgent))
+	assert.Equal(t, "#daa038", lib.SlackColor(lib.SevUnclassified))
+	assert.Equal(t, "#2eb886", lib.SlackColor(lib.SevSafe))
+	assert.Equal(t, "#cccccc", lib.SlackColor(""))
+}
+
+// slackAPIServer mocks chat.postMessage and external file upload of Slack Web
+// API. A method in failing responds "ok": false.
+type slackAPIServer struct {
+	*httptest.Server
+	calls   []string
+	auth    []string
+	posted  map[string]interface{}
+	forms   map[string]url.Values
+	file    []byte
+	failing string
+}
+
+func newSlackAPIServer(t *testing.T, failing string) *slackAPIServer {
+	s := &slackAPIServer{forms: map[string]url.Values{}, failing: failing}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/")
+		s.calls = append(s.calls, method)
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		if method == s.failing {
+			w.Write([]byte(`{"ok": false, "error": "not_allowed_token_type"}`))
+			return
+		}
+
+		switch method {
+		case "chat.postMessage":
+			s.auth = append(s.auth, r.Header.Get("Authorization"))
+			require.NoError(t, json.Unmarshal(raw, &s.posted))
+			w.Write([]byte(`{"ok": true, "channel": "C0123", "ts": "1700000000.000100"}`))
+		case "files.getUploadURLExternal", "files.completeUploadExternal":
+			s.auth = append(s.auth, r.Header.Get("Authorization"))
+			form, err := url.ParseQuery(string(raw))
+			require.NoError(t, err)
+			s.forms[method] = form
+			if method == "files.getUploadURLExternal" {
+				w.Write([]byte(`{"ok": true, "upload_url": "` + s.URL + `/upload/F0456", "file_id": "F0456"}`))
+			} else {
+				w.Write([]byte(`{"ok": true}`))
+			}
+		case "upload/F0456":
+			s.file = raw
+			w.Write([]byte("OK - 42"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func TestPublishSlackAttachReport(t *testing.T) {
+	srv := newSlackAPIServer(t, "")
+	defer srv.Close()
+
+	report := loadFixtureReport(t)
+	cfg := lib.SlackConfig{
+		BotToken:     "xoxb-test",
+		Channel:      "#alerts",
+		AttachReport: lib.SlackAttachMarkdown,
+		APIURL:       srv.URL,
+	}
+	require.NoError(t, lib.PublishSlack(cfg, report))
+
+	// Summary is posted before the two-step upload.
+	assert.Equal(t, []string{"chat.postMessage", "files.getUploadURLExternal", "upload/F0456", "files.completeUploadExternal"}, srv.calls)
+	for _, auth := range srv.auth {
+		assert.Equal(t, "Bearer xoxb-test", auth)
+	}
+	assert.Equal(t, "#alerts", srv.posted["channel"])
+	assert.Equal(t, report.OneLineSummary(), srv.posted["text"])
+
+	md := lib.RenderMarkDown(report)
+	assert.Equal(t, md, string(srv.file))
+	upload := srv.forms["files.getUploadURLExternal"]
+	assert.Equal(t, "report-"+string(report.ID)+".md", upload.Get("filename"))
+	assert.Equal(t, strconv.Itoa(len(md)), upload.Get("length"))
+
+	complete := srv.forms["files.completeUploadExternal"]
+	assert.Equal(t, "C0123", complete.Get("channel_id"))
+	assert.Equal(t, "1700000000.000100", complete.Get("thread_ts"))
+	assert.Contains(t, complete.Get("files"), `"id":"F0456"`)
+}
+
+func TestPublishSlackAttachReportTruncated(t *testing.T) {
+	srv := newSlackAPIServer(t, "")
+	defer srv.Close()
+
+	report := loadFixtureReport(t)
+	html, err := lib.RenderHTML(report)
+	require.NoError(t, err)
+
+	cfg := lib.SlackConfig{
+		BotToken:     "xoxb-test",
+		Channel:      "#alerts",
+		AttachReport: lib.SlackAttachHTML,
+		MaxFileSize:  1024,
+		APIURL:       srv.URL,
+	}
+	require.NoError(t, lib.PublishSlack(cfg, report))
+
+	assert.True(t, len(srv.file) <= 1024)
+	assert.True(t, strings.HasPrefix(html, strings.SplitN(string(srv.file), "\n<p><em>(truncated", 2)[0]))
+	assert.Contains(t, string(srv.file), fmt.Sprintf("(truncated, original size is %d bytes)", len(html)))
+	assert.Equal(t, strconv.Itoa(len(srv.file)), srv.forms["files.getUploadURLExternal"].Get("length"))
+}
+
+func TestPublishSlackAttachReportFailure(t *testing.T) {
+	srv := newSlackAPIServer(t, "files.getUploadURLExternal")
+	defer srv.Close()
+
+	cfg := lib.SlackConfig{
+		BotToken:     "xoxb-test",
+		Channel:      "#alerts",
+		AttachReport: lib.SlackAttachMarkdown,
+		APIURL:       srv.URL,
+	}
+	// The posted message is not lost and publish is not retried.
+	require.NoError(t, lib.PublishSlack(cfg, loadFixtureReport(t)))
+	assert.Equal(t, []string{"chat.postMessage", "files.getUploadURLExternal"}, srv.calls)
+	assert.Nil(t, srv.file)
+
+	// Failure of the message itself is an error.
+	srv.failing, srv.calls = "chat.postMessage", nil
+	err := lib.PublishSlack(cfg, loadFixtureReport(t))
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "not_allowed_token_type")
+	assert.Equal(t, []string{"chat.postMessage"}, srv.calls)
+
+	// Webhook can not upload files.
+	_, ok := lib.PublishSlack(lib.SlackConfig{WebhookURL: srv.URL, AttachReport: lib.SlackAttachMarkdown}, loadFixtureReport(t)).(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+)
+
+// Limits of SendMessageBatch. A batch has up to 10 messages and 256KB in
+// total.
+const (
+	sqsMaxBatchEntries = 10
+	sqsMaxBatchSize    = 256 * 1024
+)
+
+// SQSClient is a client used by PublishSQS. A client of the region is created
+// if nil.
+var SQSClient sqsiface.SQSAPI
+
+// SQSConfig is configuration of PublishSQS.
+type SQSConfig struct {
+	QueueURL string
+	Region   string
+
+	// ContentBasedDeduplication omits deduplication ID of FIFO queue messages
+	// and the queue must have content-based deduplication enabled. Otherwise
+	// SQSDeduplicationID of the report is set.
+	ContentBasedDeduplication bool
+
+	// MaxMessageSize, AlwaysEnvelope, Bucket, PresignExpiry and S3 are the
+	// same as ReportPublishConfig. An oversized report is sent as an
+	// envelope.
+	MaxMessageSize int
+	AlwaysEnvelope bool
+	Bucket         string
+	PresignExpiry  time.Duration
+	S3             s3iface.S3API
+}
+
+// IsFIFO returns true if the queue is a FIFO queue by suffix of the name.
+func (x *SQSConfig) IsFIFO() bool {
+	return strings.HasSuffix(x.QueueURL, ".fifo")
+}
+
+func (x *SQSConfig) envelope() ReportPublishConfig {
+	return ReportPublishConfig{
+		Region:         x.Region,
+		MaxMessageSize: x.MaxMessageSize,
+		AlwaysEnvelope: x.AlwaysEnvelope,
+		Bucket:         x.Bucket,
+		PresignExpiry:  x.PresignExpiry,
+		S3:             x.S3,
+	}
+}
+
+// SQSDeduplicationID returns deduplication ID of a FIFO queue message of the
+// report. It depends on ID, status and severity of the report, so recompiled
+// reports without change are delivered once within deduplication interval.
+func SQSDeduplicationID(report Report) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		string(report.ID),
+		string(report.Status),
+		string(report.Result.Severity),
+	}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// PublishSQS sends the report to SQS queue.
+func PublishSQS(cfg SQSConfig, report Report) error {
+	return PublishSQSBatch(cfg, []Report{report})
+}
+
+// PublishSQSBatch sends the reports to SQS queue by SendMessageBatch. Reports
+// of a FIFO queue are grouped by report ID to keep order of each report.
+func PublishSQSBatch(cfg SQSConfig, reports []Report) (err error) {
+	span := StartTrace("PublishSQS")
+	defer func() { span.End(err) }()
+
+	if cfg.QueueURL == "" {
+		return NewConfigError("SQS queue URL is not configured")
+	}
+
+	client := SQSClient
+	if client == nil {
+		client = sqs.New(newSession(cfg.Region))
+	}
+
+	var entries []*sqs.SendMessageBatchRequestEntry
+	batchSize := 0
+	for i, report := range reports {
+		entry, err := newSQSEntry(cfg, report, strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+
+		size := len(aws.StringValue(entry.MessageBody))
+		if len(entries) == sqsMaxBatchEntries || (len(entries) > 0 && batchSize+size > sqsMaxBatchSize) {
+			if err := sendSQSBatch(client, cfg.QueueURL, entries); err != nil {
+				return err
+			}
+			entries, batchSize = nil, 0
+		}
+		entries = append(entries, entry)
+		batchSize += size
+	}
+
+	if len(entries) > 0 {
+		return sendSQSBatch(client, cfg.QueueURL, entries)
+	}
+	return nil
+}
+
+func newSQSEntry(cfg SQSConfig, report Report, id string) (*sqs.SendMessageBatchRequestEntry, error) {
+	msg, attrs, err := reportMessage(cfg.envelope(), report)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal report data")
+	}
+
+	entry := &sqs.SendMessageBatchRequestEntry{
+		Id:          aws.String(id),
+		MessageBody: aws.String(string(body)),
+	}
+	// Attributes are the same as SNS so that consumers can handle both.
+	for name, value := range attrs {
+		name, value = sanitizeSnsAttrName(name), sanitizeSnsAttrValue(value)
+		if name == "" || value == "" {
+			continue
+		}
+		if entry.MessageAttributes == nil {
+			entry.MessageAttributes = map[string]*sqs.MessageAttributeValue{}
+		}
+		entry.MessageAttributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	if cfg.IsFIFO() {
+		entry.MessageGroupId = aws.String(string(report.ID))
+		if !cfg.ContentBasedDeduplication {
+			entry.MessageDeduplicationId = aws.String(SQSDeduplicationID(report))
+		}
+	}
+	return entry, nil
+}
+
+func sendSQSBatch(client sqsiface.SQSAPI, queueURL string, entries []*sqs.SendMessageBatchRequestEntry) error {
+	resp, err := client.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return WrapCode(ErrCodePublish, err, "Fail to send reports to SQS")
+	}
+
+	if len(resp.Failed) > 0 {
+		var msgs []string
+		for _, f := range resp.Failed {
+			msgs = append(msgs, fmt.Sprintf("%s: %s %s", aws.StringValue(f.Id), aws.StringValue(f.Code), aws.StringValue(f.Message)))
+		}
+		return WrapCode(ErrCodePublish, errors.New(strings.Join(msgs, "; ")),
+			fmt.Sprintf("Fail to send %d of %d report(s) to SQS", len(resp.Failed), len(entries)))
+	}
+
+	Logger.WithField("queue", queueURL).WithField("count", len(entries)).Info("Sent reports to SQS")
+	return nil
+}
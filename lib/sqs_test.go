@@ -0,0 +1,154 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSQS struct {
+	sqsiface.SQSAPI
+	inputs []*sqs.SendMessageBatchInput
+
+	// failID is ID of entries that fail in each batch.
+	failID string
+}
+
+func (x *mockSQS) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	x.inputs = append(x.inputs, input)
+
+	var output sqs.SendMessageBatchOutput
+	for _, entry := range input.Entries {
+		if aws.StringValue(entry.Id) == x.failID {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:      entry.Id,
+				Code:    aws.String("InvalidParameterValue"),
+				Message: aws.String("invalid"),
+			})
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return &output, nil
+}
+
+func setupSQSTest(t *testing.T, queueURL string) (*mockSQS, *envelopeS3, lib.SQSConfig) {
+	client := &mockSQS{}
+	lib.SQSClient = client
+	storage := &envelopeS3{}
+
+	return client, storage, lib.SQSConfig{
+		QueueURL: queueURL,
+		Region:   "ap-northeast-1",
+		Bucket:   "archive-bucket",
+		S3:       storage,
+	}
+}
+
+func TestPublishSQSStandard(t *testing.T) {
+	client, storage, cfg := setupSQSTest(t, "https://sqs.ap-northeast-1.amazonaws.com/1234567890/reports")
+	defer func() { lib.SQSClient = nil }()
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishSQS(cfg, report))
+
+	require.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, cfg.QueueURL, aws.StringValue(client.inputs[0].QueueUrl))
+	require.Equal(t, 1, len(client.inputs[0].Entries))
+	entry := client.inputs[0].Entries[0]
+
+	var sent lib.Report
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(entry.MessageBody)), &sent))
+	assert.Equal(t, report.ID, sent.ID)
+	assert.Nil(t, entry.MessageGroupId)
+	assert.Nil(t, entry.MessageDeduplicationId)
+	assert.Equal(t, "urgent", aws.StringValue(entry.MessageAttributes["severity"].StringValue))
+	assert.Equal(t, string(report.ID), aws.StringValue(entry.MessageAttributes["report_id"].StringValue))
+	assert.NotContains(t, entry.MessageAttributes, "envelope")
+	assert.Empty(t, storage.puts)
+}
+
+func TestPublishSQSFIFO(t *testing.T) {
+	client, _, cfg := setupSQSTest(t, "https://sqs.ap-northeast-1.amazonaws.com/1234567890/reports.fifo")
+	defer func() { lib.SQSClient = nil }()
+	require.True(t, cfg.IsFIFO())
+
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishSQS(cfg, report))
+
+	// Recompiled report without change has the same deduplication ID.
+	recompiled := report
+	recompiled.Warnings = []string{"late page"}
+	require.NoError(t, lib.PublishSQS(cfg, recompiled))
+
+	report.Result.Severity = lib.SevSafe
+	require.NoError(t, lib.PublishSQS(cfg, report))
+
+	require.Equal(t, 3, len(client.inputs))
+	e1, e2, e3 := client.inputs[0].Entries[0], client.inputs[1].Entries[0], client.inputs[2].Entries[0]
+	assert.Equal(t, string(report.ID), aws.StringValue(e1.MessageGroupId))
+	assert.Equal(t, lib.SQSDeduplicationID(recompiled), aws.StringValue(e1.MessageDeduplicationId))
+	assert.Equal(t, aws.StringValue(e1.MessageDeduplicationId), aws.StringValue(e2.MessageDeduplicationId))
+	assert.NotEqual(t, aws.StringValue(e1.MessageDeduplicationId), aws.StringValue(e3.MessageDeduplicationId))
+
+	cfg.ContentBasedDeduplication = true
+	require.NoError(t, lib.PublishSQS(cfg, report))
+	e4 := client.inputs[3].Entries[0]
+	assert.Equal(t, string(report.ID), aws.StringValue(e4.MessageGroupId))
+	assert.Nil(t, e4.MessageDeduplicationId)
+}
+
+func TestPublishSQSOversized(t *testing.T) {
+	client, storage, cfg := setupSQSTest(t, "https://sqs.ap-northeast-1.amazonaws.com/1234567890/reports")
+	defer func() { lib.SQSClient = nil }()
+
+	cfg.MaxMessageSize = 100
+	report := loadFixtureReport(t)
+	require.NoError(t, lib.PublishSQS(cfg, report))
+
+	require.Equal(t, 1, len(storage.puts))
+	entry := client.inputs[0].Entries[0]
+	var envelope lib.ReportEnvelope
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(entry.MessageBody)), &envelope))
+	assert.Equal(t, lib.ReportEnvelopeType, envelope.Type)
+	assert.Equal(t, report.ID, envelope.ReportID)
+	assert.Equal(t, "true", aws.StringValue(entry.MessageAttributes["envelope"].StringValue))
+
+	// Oversized report is not sent without bucket.
+	cfg.Bucket = ""
+	_, ok := lib.PublishSQS(cfg, report).(*lib.ConfigError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(client.inputs))
+}
+
+func TestPublishSQSBatch(t *testing.T) {
+	client, _, cfg := setupSQSTest(t, "https://sqs.ap-northeast-1.amazonaws.com/1234567890/reports")
+	defer func() { lib.SQSClient = nil }()
+
+	var reports []lib.Report
+	for i := 0; i < 12; i++ {
+		report := loadFixtureReport(t)
+		report.ID = lib.NewReportID()
+		reports = append(reports, report)
+	}
+	require.NoError(t, lib.PublishSQSBatch(cfg, reports))
+
+	require.Equal(t, 2, len(client.inputs))
+	assert.Equal(t, 10, len(client.inputs[0].Entries))
+	assert.Equal(t, 2, len(client.inputs[1].Entries))
+
+	client.failID = "1"
+	err := lib.PublishSQSBatch(cfg, reports[:3])
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrCodePublish, lib.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "1 of 3")
+
+	_, ok := lib.PublishSQS(lib.SQSConfig{}, reports[0]).(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultStatsTopN is number of alert rules and countries in top-N lists of
+// ComputeStats.
+const DefaultStatsTopN = 10
+
+// StatsBucketSize is time span of a bucket in Timeline of ReportStats.
+const StatsBucketSize = 24 * time.Hour
+
+// StatsCount is a number of reports for a name, e.g. alert rule.
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// StatsBucket is a number of reports received in a time span.
+type StatsBucket struct {
+	Start      time.Time              `json:"start"`
+	Count      int                    `json:"count"`
+	BySeverity map[ReportSeverity]int `json:"by_severity"`
+}
+
+// ReportStats is aggregation of reports for dashboards.
+type ReportStats struct {
+	Total      int                    `json:"total"`
+	BySeverity map[ReportSeverity]int `json:"by_severity"`
+	ByRule     map[string]int         `json:"by_rule"`
+
+	// Timeline has buckets of StatsBucketSize from the oldest. Buckets
+	// without reports between the oldest and the latest are included.
+	Timeline []StatsBucket `json:"timeline"`
+
+	// TopRules and TopCountries are sorted by count, largest first. A report
+	// is counted once for each country of its remote hosts.
+	TopRules     []StatsCount `json:"top_rules"`
+	TopCountries []StatsCount `json:"top_countries"`
+}
+
+// ComputeStats aggregates the reports with DefaultStatsTopN.
+func ComputeStats(reports []Report) ReportStats {
+	return ComputeStatsTopN(reports, DefaultStatsTopN)
+}
+
+// ComputeStatsTopN aggregates the reports. Top-N lists have up to n entries.
+func ComputeStatsTopN(reports []Report, n int) ReportStats {
+	stats := ReportStats{
+		Total:      len(reports),
+		BySeverity: map[ReportSeverity]int{},
+		ByRule:     map[string]int{},
+		Timeline:   []StatsBucket{},
+	}
+
+	countries := map[string]int{}
+	buckets := map[time.Time]*StatsBucket{}
+	var first, last time.Time
+
+	for _, report := range reports {
+		sev := report.Result.Severity
+		stats.BySeverity[sev]++
+		stats.ByRule[statsRuleName(report.Alert)]++
+
+		var seen []string
+		for _, host := range report.Content.OpponentHosts {
+			for _, country := range host.Countries() {
+				if !stringsContain(seen, country) {
+					seen = append(seen, country)
+					countries[country]++
+				}
+			}
+		}
+
+		if report.ReceivedAt.IsZero() {
+			continue
+		}
+		start := report.ReceivedAt.UTC().Truncate(StatsBucketSize)
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &StatsBucket{Start: start, BySeverity: map[ReportSeverity]int{}}
+			buckets[start] = bucket
+		}
+		bucket.Count++
+		bucket.BySeverity[sev]++
+
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+	}
+
+	if !first.IsZero() {
+		for t := first; !t.After(last); t = t.Add(StatsBucketSize) {
+			if bucket, ok := buckets[t]; ok {
+				stats.Timeline = append(stats.Timeline, *bucket)
+			} else {
+				stats.Timeline = append(stats.Timeline, StatsBucket{Start: t, BySeverity: map[ReportSeverity]int{}})
+			}
+		}
+	}
+
+	stats.TopRules = topStatsCounts(stats.ByRule, n)
+	stats.TopCountries = topStatsCounts(countries, n)
+	return stats
+}
+
+// statsRuleName returns rule of the alert, or name of the alert if rule is
+// not set.
+func statsRuleName(alert Alert) string {
+	if alert.Rule != "" {
+		return alert.Rule
+	}
+	return alert.Name
+}
+
+// topStatsCounts returns up to n largest counts. Ties are sorted by name.
+func topStatsCounts(counts map[string]int, n int) []StatsCount {
+	res := []StatsCount{}
+	for name, count := range counts {
+		res = append(res, StatsCount{Name: name, Count: count})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Name < res[j].Name
+	})
+
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// QueryReportStats aggregates reports received between from and to in the
+// report table.
+func QueryReportStats(tableName, region string, from, to time.Time, n int) (ReportStats, error) {
+	reports, err := SearchReports(tableName, region, "", from, to)
+	if err != nil {
+		return ReportStats{}, err
+	}
+	return ComputeStatsTopN(reports, n), nil
+}
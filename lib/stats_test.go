@@ -0,0 +1,124 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func statsReport(rule string, sev lib.ReportSeverity, receivedAt time.Time, countries ...string) lib.Report {
+	report := lib.Report{
+		Alert:      lib.Alert{Name: "Suspicious login", Rule: rule},
+		ReceivedAt: receivedAt,
+		Content: lib.ReportContent{
+			OpponentHosts: map[string]lib.ReportOpponentHost{},
+		},
+	}
+	report.Result.Severity = sev
+	for i, country := range countries {
+		ip := []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"}[i]
+		report.Content.OpponentHosts[ip] = lib.ReportOpponentHost{
+			ID:    ip,
+			Addrs: []lib.RemoteAddr{{IP: ip, Country: country}},
+		}
+	}
+	return report
+}
+
+func statsSample() []lib.Report {
+	base := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	return []lib.Report{
+		statsReport("ssh-brute-force", lib.SevUrgent, base.Add(time.Hour), "RU", "CN"),
+		statsReport("ssh-brute-force", lib.SevSafe, base.Add(2*time.Hour), "RU", "RU"),
+		statsReport("port-scan", lib.SevUnclassified, base.Add(3*time.Hour), "US"),
+		statsReport("ssh-brute-force", lib.SevUrgent, base.Add(49*time.Hour), "CN"),
+		statsReport("port-scan", lib.SevSafe, base.Add(50*time.Hour)),
+		statsReport("", lib.SevUnclassified, base.Add(50*time.Hour), "JP"),
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	stats := lib.ComputeStats(statsSample())
+
+	assert.Equal(t, 6, stats.Total)
+	assert.Equal(t, map[lib.ReportSeverity]int{
+		lib.SevUrgent:       2,
+		lib.SevUnclassified: 2,
+		lib.SevSafe:         2,
+	}, stats.BySeverity)
+	assert.Equal(t, map[string]int{
+		"ssh-brute-force":  3,
+		"port-scan":        2,
+		"Suspicious login": 1,
+	}, stats.ByRule)
+
+	assert.Equal(t, []lib.StatsCount{
+		{Name: "ssh-brute-force", Count: 3},
+		{Name: "port-scan", Count: 2},
+		{Name: "Suspicious login", Count: 1},
+	}, stats.TopRules)
+
+	// RU of the second report is counted once.
+	assert.Equal(t, []lib.StatsCount{
+		{Name: "CN", Count: 2},
+		{Name: "RU", Count: 2},
+		{Name: "JP", Count: 1},
+		{Name: "US", Count: 1},
+	}, stats.TopCountries)
+
+	// A bucket without reports is included.
+	require.Equal(t, 3, len(stats.Timeline))
+	day := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, day, stats.Timeline[0].Start)
+	assert.Equal(t, 3, stats.Timeline[0].Count)
+	assert.Equal(t, 1, stats.Timeline[0].BySeverity[lib.SevUrgent])
+	assert.Equal(t, day.Add(24*time.Hour), stats.Timeline[1].Start)
+	assert.Equal(t, 0, stats.Timeline[1].Count)
+	assert.Equal(t, day.Add(48*time.Hour), stats.Timeline[2].Start)
+	assert.Equal(t, 3, stats.Timeline[2].Count)
+	assert.Equal(t, 1, stats.Timeline[2].BySeverity[lib.SevSafe])
+}
+
+func TestComputeStatsTopN(t *testing.T) {
+	stats := lib.ComputeStatsTopN(statsSample(), 2)
+	assert.Equal(t, []lib.StatsCount{
+		{Name: "ssh-brute-force", Count: 3},
+		{Name: "port-scan", Count: 2},
+	}, stats.TopRules)
+	assert.Equal(t, []lib.StatsCount{
+		{Name: "CN", Count: 2},
+		{Name: "RU", Count: 2},
+	}, stats.TopCountries)
+}
+
+func TestComputeStatsEmpty(t *testing.T) {
+	stats := lib.ComputeStats(nil)
+	assert.Equal(t, 0, stats.Total)
+
+	data, err := json.Marshal(stats)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"timeline":[]`)
+	assert.Contains(t, string(data), `"top_rules":[]`)
+}
+
+func TestQueryReportStats(t *testing.T) {
+	table := &mockReportTable{}
+	for i, report := range statsSample() {
+		report.ID = lib.ReportID([]string{"r1", "r2", "r3", "r4", "r5", "r6"}[i])
+		record, err := lib.NewReportRecord(report, "us-east-1")
+		require.NoError(t, err)
+		table.reports = append(table.reports, record)
+	}
+	defer mockReportTables(map[string]*mockReportTable{"us-east-1": table})()
+
+	from := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	stats, err := lib.QueryReportStats("reports", "us-east-1", from, from.Add(24*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Total)
+	assert.Equal(t, 1, len(stats.Timeline))
+	assert.Equal(t, map[string]int{"ssh-brute-force": 2, "port-scan": 1}, stats.ByRule)
+}
@@ -0,0 +1,276 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	// stixNamespace is UUIDv5 namespace of STIX IDs of SDOs and SROs created
+	// by AlertResponder.
+	stixNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/m-mizutani/AlertResponder")
+
+	// stixSCONamespace is UUIDv5 namespace of SCO IDs defined in STIX 2.1.
+	stixSCONamespace = uuid.FromStringOrNil("00abedb4-aa42-466c-9c01-fed23315a9b7")
+)
+
+const stixTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// STIXObject is a STIX 2.1 object. Only properties used by ToSTIX are defined.
+type STIXObject struct {
+	Type        string `json:"type"`
+	SpecVersion string `json:"spec_version,omitempty"`
+	ID          string `json:"id"`
+	Created     string `json:"created,omitempty"`
+	Modified    string `json:"modified,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// indicator
+	IndicatorTypes []string `json:"indicator_types,omitempty"`
+	Pattern        string   `json:"pattern,omitempty"`
+	PatternType    string   `json:"pattern_type,omitempty"`
+	ValidFrom      string   `json:"valid_from,omitempty"`
+
+	// report
+	ReportTypes []string `json:"report_types,omitempty"`
+	Published   string   `json:"published,omitempty"`
+	Confidence  int      `json:"confidence,omitempty"`
+
+	// observed-data
+	FirstObserved  string `json:"first_observed,omitempty"`
+	LastObserved   string `json:"last_observed,omitempty"`
+	NumberObserved int    `json:"number_observed,omitempty"`
+
+	// report and observed-data
+	ObjectRefs []string `json:"object_refs,omitempty"`
+
+	// relationship
+	RelationshipType string `json:"relationship_type,omitempty"`
+	SourceRef        string `json:"source_ref,omitempty"`
+	TargetRef        string `json:"target_ref,omitempty"`
+
+	// SCO
+	Value string `json:"value,omitempty"`
+}
+
+// STIXBundle is a STIX 2.1 bundle.
+type STIXBundle struct {
+	Type    string       `json:"type"`
+	ID      string       `json:"id"`
+	Objects []STIXObject `json:"objects"`
+}
+
+// stixConfidence maps severity to confidence of the report.
+func stixConfidence(sev ReportSeverity) int {
+	switch sev {
+	case SevUrgent:
+		return 85
+	case SevSafe:
+		return 15
+	default:
+		return 50
+	}
+}
+
+// stixID returns a deterministic ID of the object in the report.
+func stixID(objType string, reportID ReportID, value string) string {
+	return fmt.Sprintf("%s--%s", objType, uuid.NewV5(stixNamespace, string(reportID)+"|"+objType+"|"+value))
+}
+
+// stixSCOID returns an ID of the SCO by value as defined in STIX 2.1, so that
+// same observable has same ID across reports.
+func stixSCOID(objType, value string) string {
+	name, _ := json.Marshal(map[string]string{"value": value})
+	return fmt.Sprintf("%s--%s", objType, uuid.NewV5(stixSCONamespace, string(name)))
+}
+
+// stixQuote escapes a string literal of STIX patterning.
+func stixQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func stixAddrType(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "ipv4-addr"
+	default:
+		return "ipv6-addr"
+	}
+}
+
+type stixIndicator struct {
+	name    string
+	pattern string
+	first   time.Time
+}
+
+func stixIndicators(c ReportContent) []stixIndicator {
+	var indicators []stixIndicator
+	seen := map[string]bool{}
+	add := func(name, pattern string, first time.Time) {
+		if !seen[pattern] {
+			seen[pattern] = true
+			indicators = append(indicators, stixIndicator{name: name, pattern: pattern, first: first})
+		}
+	}
+
+	var ids []string
+	for id := range c.OpponentHosts {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedKeys(ids) {
+		host := c.OpponentHosts[id]
+		for _, addr := range host.IPAddr {
+			if t := stixAddrType(addr); t != "" {
+				add(addr, fmt.Sprintf("[%s:value = %s]", t, stixQuote(addr)), time.Time{})
+			}
+		}
+		for _, d := range host.RelatedDomains {
+			add(d.Name, fmt.Sprintf("[domain-name:value = %s]", stixQuote(d.Name)), d.Timestamp)
+		}
+		for _, u := range host.RelatedURLs {
+			add(u.URL, fmt.Sprintf("[url:value = %s]", stixQuote(u.URL)), u.Timestamp)
+		}
+	}
+
+	for _, h := range c.MaliciousHashes() {
+		add(h, fmt.Sprintf("[file:hashes.'SHA-256' = %s]", stixQuote(h)), time.Time{})
+	}
+
+	return indicators
+}
+
+// ToSTIX converts the report to a STIX 2.1 bundle. Remote hosts and related
+// domains, URLs and malicious hashes become indicators linked to a report
+// object, and IP addresses of local hosts become observed-data. IDs are
+// derived from ReportID and values, so exporting the report again produces
+// the same objects. An error is returned if the report has nothing to export.
+func ToSTIX(r Report) ([]byte, error) {
+	created := r.ReceivedAt.UTC()
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	ts := created.Format(stixTimeFormat)
+	modified := time.Now().UTC()
+	if modified.Before(created) {
+		modified = created
+	}
+
+	bundle := STIXBundle{
+		Type: "bundle",
+		ID:   stixID("bundle", r.ID, ""),
+	}
+	report := STIXObject{
+		Type:        "report",
+		SpecVersion: "2.1",
+		ID:          stixID("report", r.ID, ""),
+		Created:     ts,
+		Modified:    modified.Format(stixTimeFormat),
+		Name:        r.OneLineSummary(),
+		Description: r.Result.Reason,
+		ReportTypes: []string{"threat-report"},
+		Published:   ts,
+		Confidence:  stixConfidence(r.Result.Severity),
+	}
+
+	var objects []STIXObject
+	for _, ind := range stixIndicators(r.Content) {
+		validFrom := ts
+		if !ind.first.IsZero() && ind.first.Before(created) {
+			validFrom = ind.first.UTC().Format(stixTimeFormat)
+		}
+
+		indicator := STIXObject{
+			Type:           "indicator",
+			SpecVersion:    "2.1",
+			ID:             stixID("indicator", r.ID, ind.pattern),
+			Created:        ts,
+			Modified:       report.Modified,
+			Name:           ind.name,
+			IndicatorTypes: []string{"malicious-activity"},
+			Pattern:        ind.pattern,
+			PatternType:    "stix",
+			ValidFrom:      validFrom,
+		}
+		relationship := STIXObject{
+			Type:             "relationship",
+			SpecVersion:      "2.1",
+			ID:               stixID("relationship", r.ID, indicator.ID),
+			Created:          ts,
+			Modified:         report.Modified,
+			RelationshipType: "related-to",
+			SourceRef:        indicator.ID,
+			TargetRef:        report.ID,
+		}
+		objects = append(objects, indicator, relationship)
+		report.ObjectRefs = append(report.ObjectRefs, indicator.ID, relationship.ID)
+	}
+
+	scos := map[string]bool{}
+	var hostIDs []string
+	for id := range r.Content.AlliedHosts {
+		hostIDs = append(hostIDs, id)
+	}
+	for _, id := range sortedKeys(hostIDs) {
+		host := r.Content.AlliedHosts[id]
+		observed := STIXObject{
+			Type:           "observed-data",
+			SpecVersion:    "2.1",
+			ID:             stixID("observed-data", r.ID, id),
+			Created:        ts,
+			Modified:       report.Modified,
+			FirstObserved:  ts,
+			LastObserved:   ts,
+			NumberObserved: 1,
+		}
+		for _, act := range host.Activities {
+			if !act.LastSeen.IsZero() && act.LastSeen.Before(created) {
+				if s := act.LastSeen.UTC().Format(stixTimeFormat); s < observed.FirstObserved {
+					observed.FirstObserved = s
+				}
+			}
+		}
+
+		for _, addr := range host.IPAddr {
+			t := stixAddrType(addr)
+			if t == "" {
+				continue
+			}
+			sco := STIXObject{Type: t, SpecVersion: "2.1", ID: stixSCOID(t, addr), Value: addr}
+			if !scos[sco.ID] {
+				scos[sco.ID] = true
+				objects = append(objects, sco)
+			}
+			observed.ObjectRefs = append(observed.ObjectRefs, sco.ID)
+		}
+
+		// observed-data must refer at least one observable.
+		if len(observed.ObjectRefs) == 0 {
+			continue
+		}
+		objects = append(objects, observed)
+		report.ObjectRefs = append(report.ObjectRefs, observed.ID)
+	}
+
+	// report must refer at least one object.
+	if len(report.ObjectRefs) == 0 {
+		return nil, errors.Errorf("No indicator or observation to export in report %s", r.ID)
+	}
+
+	bundle.Objects = append([]STIXObject{report}, objects...)
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, WrapCode(ErrCodeMarshal, err, "Fail to marshal STIX bundle")
+	}
+	return data, nil
+}
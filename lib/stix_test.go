@@ -0,0 +1,190 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	stixIDPattern        = regexp.MustCompile(`^([a-z][a-z0-9-]+)--[0-9a-f]{8}-[0-9a-f]{4}-[1-5][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	stixTimestampPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?Z$`)
+)
+
+// stixRequired has required properties of each object type by STIX 2.1 JSON
+// schema (common properties are checked separately).
+var stixRequired = map[string][]string{
+	"report":        {"name", "published", "object_refs"},
+	"indicator":     {"pattern", "pattern_type", "valid_from"},
+	"observed-data": {"first_observed", "last_observed", "number_observed", "object_refs"},
+	"relationship":  {"relationship_type", "source_ref", "target_ref"},
+	"ipv4-addr":     {"value"},
+	"ipv6-addr":     {"value"},
+}
+
+// validateSTIXBundle checks the bundle against constraints of STIX 2.1 schema
+// and returns objects by ID.
+func validateSTIXBundle(t *testing.T, data []byte) map[string]map[string]interface{} {
+	var bundle map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &bundle))
+	require.Equal(t, "bundle", bundle["type"])
+	require.Regexp(t, stixIDPattern, bundle["id"])
+	_, hasVersion := bundle["spec_version"]
+	assert.False(t, hasVersion, "bundle of STIX 2.1 must not have spec_version")
+
+	objects := map[string]map[string]interface{}{}
+	for _, v := range bundle["objects"].([]interface{}) {
+		obj := v.(map[string]interface{})
+		id, _ := obj["id"].(string)
+		m := stixIDPattern.FindStringSubmatch(id)
+		require.NotNil(t, m, id)
+		assert.Equal(t, obj["type"], m[1], "type prefix of ID")
+		assert.Equal(t, "2.1", obj["spec_version"], id)
+		assert.NotContains(t, objects, id, "duplicated ID")
+		objects[id] = obj
+
+		required, ok := stixRequired[obj["type"].(string)]
+		require.True(t, ok, "unexpected type: %v", obj["type"])
+		for _, prop := range required {
+			assert.Contains(t, obj, prop, id)
+		}
+
+		// SDO and SRO
+		if _, sco := obj["value"]; !sco {
+			for _, prop := range []string{"created", "modified"} {
+				assert.Regexp(t, stixTimestampPattern, obj[prop], id)
+			}
+		}
+		for _, prop := range []string{"valid_from", "published", "first_observed", "last_observed"} {
+			if v, ok := obj[prop]; ok {
+				assert.Regexp(t, stixTimestampPattern, v, id)
+			}
+		}
+		if refs, ok := obj["object_refs"]; ok {
+			assert.NotEmpty(t, refs, id)
+		}
+		if n, ok := obj["number_observed"]; ok {
+			assert.True(t, n.(float64) >= 1, id)
+		}
+		if c, ok := obj["confidence"]; ok {
+			assert.True(t, 0 <= c.(float64) && c.(float64) <= 100, id)
+		}
+		if obj["type"] == "indicator" {
+			assert.Equal(t, "stix", obj["pattern_type"])
+			assert.Regexp(t, regexp.MustCompile(`^\[[a-z0-9-]+:[a-z_.'A-Z0-9-]+ = '.*'\]$`), obj["pattern"])
+		}
+	}
+
+	// Every reference must be resolved in the bundle.
+	for id, obj := range objects {
+		for _, prop := range []string{"source_ref", "target_ref"} {
+			if ref, ok := obj[prop]; ok {
+				assert.Contains(t, objects, ref, id)
+			}
+		}
+		if refs, ok := obj["object_refs"]; ok {
+			for _, ref := range refs.([]interface{}) {
+				assert.Contains(t, objects, ref, id)
+			}
+		}
+	}
+
+	return objects
+}
+
+func stixPatterns(objects map[string]map[string]interface{}) []string {
+	var patterns []string
+	for _, obj := range objects {
+		if obj["type"] == "indicator" {
+			patterns = append(patterns, obj["pattern"].(string))
+		}
+	}
+	return patterns
+}
+
+func TestToSTIX(t *testing.T) {
+	report := loadFixtureReport(t)
+	data, err := lib.ToSTIX(report)
+	require.NoError(t, err)
+
+	objects := validateSTIXBundle(t, data)
+	assert.ElementsMatch(t, []string{
+		"[ipv4-addr:value = '198.51.100.7']",
+		"[ipv4-addr:value = '203.0.113.9']",
+		"[domain-name:value = 'bad.example.com']",
+		"[url:value = 'http://bad.example.com/payload']",
+		"[file:hashes.'SHA-256' = 'e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855']",
+	}, stixPatterns(objects))
+
+	counts := map[string]int{}
+	var stixReport map[string]interface{}
+	for _, obj := range objects {
+		counts[obj["type"].(string)]++
+		if obj["type"] == "report" {
+			stixReport = obj
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"report": 1, "indicator": 5, "relationship": 5, "observed-data": 1, "ipv4-addr": 1,
+	}, counts)
+
+	require.NotNil(t, stixReport)
+	assert.Equal(t, 85.0, stixReport["confidence"])
+	assert.Equal(t, 11, len(stixReport["object_refs"].([]interface{})))
+	for _, obj := range objects {
+		if obj["type"] == "relationship" {
+			assert.Equal(t, stixReport["id"], obj["target_ref"])
+			assert.Equal(t, "indicator", objects[obj["source_ref"].(string)]["type"])
+		}
+	}
+}
+
+func TestToSTIXDeterministicID(t *testing.T) {
+	report := loadFixtureReport(t)
+	d1, err := lib.ToSTIX(report)
+	require.NoError(t, err)
+	d2, err := lib.ToSTIX(report)
+	require.NoError(t, err)
+
+	// IDs of SDOs and SROs
+	ids := func(data []byte) []string {
+		var res []string
+		for id, obj := range validateSTIXBundle(t, data) {
+			if _, sco := obj["value"]; !sco {
+				res = append(res, id)
+			}
+		}
+		return res
+	}
+	assert.ElementsMatch(t, ids(d1), ids(d2))
+
+	// Another report has other IDs.
+	report.ID = "another-report"
+	d3, err := lib.ToSTIX(report)
+	require.NoError(t, err)
+	for _, id := range ids(d3) {
+		assert.NotContains(t, ids(d1), id)
+	}
+}
+
+func TestToSTIXEscapePattern(t *testing.T) {
+	report := loadFixtureReport(t)
+	host := report.Content.OpponentHosts["198.51.100.7"]
+	host.RelatedURLs[0].URL = `http://bad.example.com/it's\here`
+	report.Content.OpponentHosts["198.51.100.7"] = host
+
+	data, err := lib.ToSTIX(report)
+	require.NoError(t, err)
+	assert.Contains(t, stixPatterns(validateSTIXBundle(t, data)),
+		`[url:value = 'http://bad.example.com/it\'s\\here']`)
+}
+
+func TestToSTIXNoEvidence(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Rule: "r"})
+	_, err := lib.ToSTIX(report)
+	assert.Error(t, err)
+}
@@ -0,0 +1,378 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReportStore stores pages submitted by inspectors and compiled reports.
+type ReportStore interface {
+	Submit(component *ReportComponent) error
+	FetchPages(reportID ReportID) ([]*ReportPage, error)
+	SaveReport(report Report) error
+	GetReport(reportID ReportID) (*Report, error)
+}
+
+// ReportStoreBackend selects storage of OpenReportTable. "memory" keeps all
+// tables in memory of the process for tests and local runs. DynamoDB is used
+// otherwise.
+var ReportStoreBackend = os.Getenv("REPORT_STORE")
+
+// memoryReportTables is shared by all tables opened while ReportStoreBackend
+// is "memory".
+var memoryReportTables = NewMemoryReportTable()
+
+// tableReportStore is ReportStore on ReportTable.
+type tableReportStore struct {
+	region string
+	table  ReportTable
+}
+
+// OpenReportStore returns ReportStore on tables opened by OpenReportTable.
+func OpenReportStore(region, reportTable, reportDataTable string) ReportStore {
+	return &tableReportStore{
+		region: region,
+		table:  OpenReportTable(region, reportTable, reportDataTable),
+	}
+}
+
+// NewMemoryReportStore returns ReportStore in memory. Stores do not share
+// reports each other.
+func NewMemoryReportStore() ReportStore {
+	return &tableReportStore{table: NewMemoryReportTable()}
+}
+
+// MaxPagesPerInspector is limit of pages that an inspector can submit for a
+// report. 0 means no limit.
+var MaxPagesPerInspector = envInt("MAX_PAGES_PER_INSPECTOR", 100)
+
+// ErrPageLimitExceeded is a cause of error returned by Submit when the
+// inspector already submitted MaxPagesPerInspector pages for the report.
+var ErrPageLimitExceeded = errors.New("Page limit of inspector is exceeded")
+
+// Submit stores the component. It expires after ReportTTL.Max() because
+// severity of the report is not decided while inspection. A page identical to
+// a stored page of the report is skipped, and a page over
+// MaxPagesPerInspector of the author is rejected. Stored pages are compared
+// by ContentHash and Author only, so their data is not fetched. Offloaded data
+// of a skipped or rejected page is deleted from PageBucket.
+func (x *tableReportStore) Submit(component *ReportComponent) error {
+	if !component.IsComment() {
+		var components []ReportComponent
+		err := retryStore("GetComponentMeta", func() error {
+			var fetchErr error
+			components, fetchErr = x.table.GetComponentMeta(component.ReportID)
+			return fetchErr
+		})
+		if err != nil {
+			return err
+		}
+
+		if dup := duplicatePage(component, components); dup != nil {
+			log.WithFields(log.Fields{
+				"report_id":    component.ReportID,
+				"data_id":      component.DataID,
+				"duplicate_of": dup.DataID,
+			}).Info("Skip duplicate page")
+			discardData(component)
+			return nil
+		}
+		if err := checkPageLimit(component, components); err != nil {
+			discardData(component)
+			return err
+		}
+	}
+
+	component.SubmittedAt = time.Now().UTC()
+	component.TimeToLive = component.SubmittedAt.Add(ReportTTL.Max())
+
+	log.WithField("component", component).Info("Put component")
+
+	return retryStore("Submit", func() error {
+		return x.table.PutComponent(component)
+	})
+}
+
+// discardData deletes offloaded data of a component that is not stored.
+// Failure is only logged because the object expires by lifecycle rule.
+func discardData(component *ReportComponent) {
+	if err := component.deleteData(); err != nil {
+		log.WithField("data_ref", component.DataRef).WithFields(ErrorFields(err)).Warn("Fail to delete page of rejected component")
+	}
+}
+
+// duplicatePage returns a stored page that has the same content as the
+// component. Replacement of a stored page is not a duplicate.
+func duplicatePage(component *ReportComponent, components []ReportComponent) *ReportComponent {
+	hash := component.PageHash()
+	if hash == "" {
+		return nil
+	}
+
+	var dup *ReportComponent
+	for i, c := range components {
+		if c.DataID == component.DataID {
+			return nil
+		}
+		if dup == nil && !c.IsComment() && c.PageHash() == hash {
+			dup = &components[i]
+		}
+	}
+	return dup
+}
+
+// checkPageLimit counts stored pages of the report by Author and returns
+// error if the author of the component has no room for another page. Pages
+// without author and replacement of a stored page are not limited. Pages
+// stored without Author attribute are not counted.
+func checkPageLimit(component *ReportComponent, components []ReportComponent) error {
+	if MaxPagesPerInspector <= 0 || component.Author == "" {
+		return nil
+	}
+
+	counts := map[string]int{}
+	for _, c := range components {
+		if c.DataID == component.DataID {
+			return nil
+		}
+		if !c.IsComment() && c.Author != "" {
+			counts[c.Author]++
+		}
+	}
+
+	if n := counts[component.Author]; n >= MaxPagesPerInspector {
+		log.WithFields(log.Fields{
+			"report_id": component.ReportID,
+			"author":    component.Author,
+			"pages":     n,
+			"limit":     MaxPagesPerInspector,
+		}).Warn("Reject page over limit of inspector")
+		return WrapCode(ErrCodePageLimit, ErrPageLimitExceeded,
+			fmt.Sprintf("Report %s already has %d pages of %s", component.ReportID, n, component.Author))
+	}
+	return nil
+}
+
+// FetchPages returns pages of the report in order of submission to merge
+// them chronologically. Comments and duplicates of an earlier page are not
+// included.
+func (x *tableReportStore) FetchPages(reportID ReportID) ([]*ReportPage, error) {
+	var dataList []ReportComponent
+	err := retryStore("FetchReportPages", func() error {
+		var fetchErr error
+		dataList, fetchErr = x.table.GetComponents(reportID)
+		return fetchErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(dataList, func(i, j int) bool {
+		return dataList[i].SubmittedAt.Before(dataList[j].SubmittedAt)
+	})
+
+	pages := []*ReportPage{}
+	seen := map[string]bool{}
+	for _, data := range dataList {
+		if data.IsComment() {
+			continue
+		}
+		if hash := data.PageHash(); hash != "" {
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+		}
+		// Failure of S3 is returned rather than dropping the page.
+		if err := data.LoadData(); err != nil {
+			return nil, err
+		}
+		pages = append(pages, data.Page())
+	}
+	return pages, nil
+}
+
+func (x *tableReportStore) SaveReport(report Report) error {
+	record, err := NewReportRecord(report, x.region)
+	if err != nil {
+		return err
+	}
+	return x.table.PutReport(record)
+}
+
+// GetReport returns the compiled report. ErrReportNotFound is returned if the
+// report is not stored.
+func (x *tableReportStore) GetReport(reportID ReportID) (*Report, error) {
+	record, err := x.table.GetReport(reportID)
+	if err != nil {
+		return nil, err
+	}
+	return record.Report()
+}
+
+// MemoryReportTable is ReportTable in memory. Reports and components are
+// stored in one table regardless of table names and regions.
+type MemoryReportTable struct {
+	mu         sync.Mutex
+	reports    map[ReportID]ReportRecord
+	components []ReportComponent
+}
+
+func NewMemoryReportTable() *MemoryReportTable {
+	return &MemoryReportTable{reports: map[ReportID]ReportRecord{}}
+}
+
+// PutReport keeps links of a stored report as DynamoDB table does.
+func (x *MemoryReportTable) PutReport(record *ReportRecord) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	updated := *record
+	if stored, ok := x.reports[record.ReportID]; ok {
+		updated.ParentID, updated.ChildIDs = stored.ParentID, stored.ChildIDs
+	}
+	x.reports[record.ReportID] = updated
+	return nil
+}
+
+func (x *MemoryReportTable) LinkReport(parentID, childID ReportID) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	child, ok := x.reports[childID]
+	if !ok || (child.ParentID != "" && child.ParentID != parentID) {
+		return NewConfigError(fmt.Sprintf("Report %s is not found or already has another parent", childID))
+	}
+	parent, ok := x.reports[parentID]
+	if !ok {
+		return ErrReportNotFound
+	}
+
+	child.ParentID = parentID
+	x.reports[childID] = child
+	for _, id := range parent.ChildIDs {
+		if id == string(childID) {
+			return nil
+		}
+	}
+	parent.ChildIDs = append(append([]string{}, parent.ChildIDs...), string(childID))
+	x.reports[parentID] = parent
+	return nil
+}
+
+func (x *MemoryReportTable) UnlinkReport(parentID, childID ReportID) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if parent, ok := x.reports[parentID]; ok {
+		var childIDs []string
+		for _, id := range parent.ChildIDs {
+			if id != string(childID) {
+				childIDs = append(childIDs, id)
+			}
+		}
+		parent.ChildIDs = childIDs
+		x.reports[parentID] = parent
+	}
+	if child, ok := x.reports[childID]; ok && child.ParentID == parentID {
+		child.ParentID = ""
+		x.reports[childID] = child
+	}
+	return nil
+}
+
+func (x *MemoryReportTable) PutComponent(component *ReportComponent) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// Items are replaced by key of report_id and data_id as DynamoDB does.
+	for i, c := range x.components {
+		if c.ReportID == component.ReportID && c.DataID == component.DataID {
+			x.components[i] = *component
+			return nil
+		}
+	}
+	x.components = append(x.components, *component)
+	return nil
+}
+
+func (x *MemoryReportTable) GetComponents(reportID ReportID) ([]ReportComponent, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var components []ReportComponent
+	for _, c := range x.components {
+		if c.ReportID == reportID {
+			components = append(components, c)
+		}
+	}
+	return components, nil
+}
+
+func (x *MemoryReportTable) GetComponentMeta(reportID ReportID) ([]ReportComponent, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var components []ReportComponent
+	for _, c := range x.components {
+		if c.ReportID == reportID {
+			components = append(components, ReportComponent{
+				ReportID:    c.ReportID,
+				DataID:      c.DataID,
+				ContentHash: c.ContentHash,
+				Author:      c.Author,
+			})
+		}
+	}
+	return components, nil
+}
+
+func (x *MemoryReportTable) GetReport(reportID ReportID) (*ReportRecord, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	record, ok := x.reports[reportID]
+	if !ok {
+		return nil, ErrReportNotFound
+	}
+	return &record, nil
+}
+
+func (x *MemoryReportTable) QueryReports(severity ReportSeverity, from, to time.Time) ([]ReportRecord, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var records []ReportRecord
+	for _, r := range x.reports {
+		if r.Severity == severity {
+			records = append(records, r)
+		}
+	}
+	return receivedBetween(records, from, to), nil
+}
+
+func (x *MemoryReportTable) DeleteReport(reportID ReportID) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.reports, reportID)
+	return nil
+}
+
+func (x *MemoryReportTable) DeleteComponent(reportID ReportID, dataID string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for i, c := range x.components {
+		if c.ReportID == reportID && c.DataID == dataID {
+			x.components = append(x.components[:i], x.components[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func submitPage(t *testing.T, store lib.ReportStore, reportID lib.ReportID, author string) {
+	component := lib.NewReportComponent(reportID)
+	// Title makes the page unique so that it is not skipped as a duplicate.
+	page := lib.ReportPage{ReportID: reportID, Author: author, Title: component.DataID}
+	require.NoError(t, component.SetPage(page))
+	require.NoError(t, store.Submit(component))
+}
+
+func TestMemoryReportStorePages(t *testing.T) {
+	store := lib.NewMemoryReportStore()
+	submitPage(t, store, "r1", "first")
+	submitPage(t, store, "r2", "other")
+	submitPage(t, store, "r1", "second")
+
+	comment, err := lib.NewCommentComponent("r1", lib.Comment{Author: "analyst", Text: "checked"})
+	require.NoError(t, err)
+	require.NoError(t, store.Submit(comment))
+
+	pages, err := store.FetchPages("r1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pages))
+	assert.Equal(t, "first", pages[0].Author)
+	assert.Equal(t, "second", pages[1].Author)
+
+	pages, err = store.FetchPages("none")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(pages))
+}
+
+func TestMemoryReportStoreReports(t *testing.T) {
+	store := lib.NewMemoryReportStore()
+
+	_, err := store.GetReport("r1")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+
+	report := lib.Report{ID: "r1", Status: lib.StatusPublished}
+	report.Result.Severity = lib.SevUrgent
+	require.NoError(t, store.SaveReport(report))
+
+	// Saving again overwrites the report.
+	report.Status = lib.StatusClosed
+	require.NoError(t, store.SaveReport(report))
+
+	stored, err := store.GetReport("r1")
+	require.NoError(t, err)
+	assert.Equal(t, lib.StatusClosed, stored.Status)
+	assert.Equal(t, lib.SevUrgent, stored.Result.Severity)
+
+	// Stores are independent.
+	_, err = lib.NewMemoryReportStore().GetReport("r1")
+	assert.Equal(t, lib.ErrReportNotFound, err)
+}
+
+func TestReportStoreBackendMemory(t *testing.T) {
+	orig := lib.ReportStoreBackend
+	lib.ReportStoreBackend = "memory"
+	defer func() { lib.ReportStoreBackend = orig }()
+
+	component := lib.NewReportComponent("backend-report")
+	require.NoError(t, component.SetPage(lib.ReportPage{Author: "inspector"}))
+	require.NoError(t, component.Submit("report-data", "us-east-1"))
+
+	pages, err := lib.FetchReportPages("report-data", "us-east-1", "backend-report")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "inspector", pages[0].Author)
+
+	require.NoError(t, lib.SaveReport("reports", "us-east-1", lib.Report{ID: "backend-report"}))
+	report, err := lib.OpenReportStore("us-east-1", "reports", "report-data").GetReport("backend-report")
+	require.NoError(t, err)
+	assert.Equal(t, lib.ReportID("backend-report"), report.ID)
+}
+
+func TestReportStorePageLimit(t *testing.T) {
+	orig := lib.MaxPagesPerInspector
+	lib.MaxPagesPerInspector = 2
+	defer func() { lib.MaxPagesPerInspector = orig }()
+
+	store := lib.NewMemoryReportStore()
+	submitPage(t, store, "r1", "runaway")
+	submitPage(t, store, "r1", "runaway")
+
+	// Pages of other inspectors and reports are counted separately.
+	submitPage(t, store, "r1", "other")
+	submitPage(t, store, "r2", "runaway")
+
+	// Comments and pages without author are not limited.
+	comment, err := lib.NewCommentComponent("r1", lib.Comment{Author: "runaway", Text: "checked"})
+	require.NoError(t, err)
+	require.NoError(t, store.Submit(comment))
+	submitPage(t, store, "r1", "")
+
+	over := lib.NewReportComponent("r1")
+	require.NoError(t, over.SetPage(lib.ReportPage{ReportID: "r1", Author: "runaway"}))
+	err = store.Submit(over)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrPageLimitExceeded, errors.Cause(err))
+	assert.Equal(t, lib.ErrCodePageLimit, lib.ErrorCodeOf(err))
+
+	pages, err := store.FetchPages("r1")
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(pages))
+
+	// Replacing a stored page is allowed at the limit.
+	stored := lib.NewReportComponent("r1")
+	require.NoError(t, stored.SetPage(lib.ReportPage{ReportID: "r1", Author: "limited"}))
+	require.NoError(t, store.Submit(stored))
+	submitPage(t, store, "r1", "limited")
+	require.NoError(t, stored.SetPage(lib.ReportPage{ReportID: "r1", Author: "limited", Title: "updated"}))
+	require.NoError(t, store.Submit(stored))
+
+	// No limit with 0.
+	lib.MaxPagesPerInspector = 0
+	require.NoError(t, store.Submit(over))
+}
+
+// noGetS3 is mockS3 that fails GetObject.
+type noGetS3 struct {
+	mockS3
+}
+
+func (x *noGetS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, errors.New("GetObject is not allowed")
+}
+
+func TestReportStorePageLimitWithoutData(t *testing.T) {
+	_, restore := offloadFixture(t, 16)
+	defer restore()
+	client := &noGetS3{}
+	lib.PageS3 = client
+	orig := lib.MaxPagesPerInspector
+	lib.MaxPagesPerInspector = 2
+	defer func() { lib.MaxPagesPerInspector = orig }()
+
+	// Stored pages are offloaded, and counted by their Author attribute.
+	store := lib.NewMemoryReportStore()
+	submitPage(t, store, "r1", "runaway")
+	submitPage(t, store, "r1", "runaway")
+	require.Equal(t, 2, len(client.puts))
+
+	over := lib.NewReportComponent("r1")
+	require.NoError(t, over.SetPage(lib.ReportPage{ReportID: "r1", Author: "runaway"}))
+	assert.Equal(t, "runaway", over.Author)
+	err := store.Submit(over)
+	require.Error(t, err)
+	assert.Equal(t, lib.ErrPageLimitExceeded, errors.Cause(err))
+
+	// Offloaded data of the rejected page is deleted.
+	require.Equal(t, 1, len(client.deletes))
+	assert.Equal(t, over.DataRef, "s3://"+aws.StringValue(client.deletes[0].Bucket)+"/"+aws.StringValue(client.deletes[0].Key))
+	assert.Equal(t, 2, len(client.objects))
+}
+
+func TestReportStoreDeleteDuplicateOffloadedPage(t *testing.T) {
+	client, restore := offloadFixture(t, 16)
+	defer restore()
+
+	store := lib.NewMemoryReportStore()
+	page := lib.ReportPage{ReportID: "r1", Author: "retrying", Title: "same"}
+	first := lib.NewReportComponent("r1")
+	require.NoError(t, first.SetPage(page))
+	require.NoError(t, store.Submit(first))
+
+	retry := lib.NewReportComponent("r1")
+	require.NoError(t, retry.SetPage(page))
+	require.NoError(t, store.Submit(retry))
+
+	require.Equal(t, 2, len(client.puts))
+	require.Equal(t, 1, len(client.deletes))
+	assert.Equal(t, lib.PageKey("r1", retry.DataID), aws.StringValue(client.deletes[0].Key))
+	assert.Contains(t, client.objects, "pages-bucket/"+lib.PageKey("r1", first.DataID))
+}
+
+func TestReportStoreSkipDuplicatePage(t *testing.T) {
+	store := lib.NewMemoryReportStore()
+	page := lib.ReportPage{ReportID: "r1", Author: "retrying", Title: "same"}
+
+	first := lib.NewReportComponent("r1")
+	require.NoError(t, first.SetPage(page))
+	require.NoError(t, store.Submit(first))
+	assert.NotEmpty(t, first.ContentHash)
+
+	// Retry of the inspector submits the same page as a new component.
+	retry := lib.NewReportComponent("r1")
+	require.NoError(t, retry.SetPage(page))
+	assert.Equal(t, first.ContentHash, retry.ContentHash)
+	require.NoError(t, store.Submit(retry))
+
+	// Same page of another report is not a duplicate.
+	other := lib.NewReportComponent("r2")
+	require.NoError(t, other.SetPage(lib.ReportPage{ReportID: "r1", Author: "retrying", Title: "same"}))
+	require.NoError(t, store.Submit(other))
+
+	pages, err := store.FetchPages("r1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pages))
+	assert.Equal(t, "same", pages[0].Title)
+
+	pages, err = store.FetchPages("r2")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(pages))
+
+	// Updating a stored page to the same content is a replacement.
+	require.NoError(t, first.SetPage(page))
+	require.NoError(t, store.Submit(first))
+}
+
+func TestFetchPagesDeduplicateStoredPages(t *testing.T) {
+	table := lib.NewMemoryReportTable()
+	orig := lib.OpenReportTable
+	lib.OpenReportTable = func(region, reportTable, reportDataTable string) lib.ReportTable { return table }
+	defer func() { lib.OpenReportTable = orig }()
+
+	// Components stored without hash, e.g. before deduplication.
+	for _, id := range []string{"d1", "d2"} {
+		require.NoError(t, table.PutComponent(&lib.ReportComponent{
+			ReportID: "r1",
+			DataID:   id,
+			Data:     []byte(`{"title":"same","author":"retrying","report_id":"r1"}`),
+		}))
+	}
+	require.NoError(t, table.PutComponent(&lib.ReportComponent{
+		ReportID: "r1",
+		DataID:   "d3",
+		Data:     []byte(`{"title":"other","author":"retrying","report_id":"r1"}`),
+	}))
+
+	pages, err := lib.OpenReportStore("us-east-1", "", "data").FetchPages("r1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pages))
+	assert.Equal(t, "same", pages[0].Title)
+	assert.Equal(t, "other", pages[1].Title)
+}
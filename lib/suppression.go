@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// Suppression is an item of suppression table. Alerts of AlertKey and Rule are
+// ignored by receptor until TTL. Zero TTL means that the suppression never
+// expires.
+type Suppression struct {
+	SuppressionID string    `dynamo:"suppression_id"`
+	AlertKey      string    `dynamo:"alert_key"`
+	Rule          string    `dynamo:"rule"`
+	Reason        string    `dynamo:"reason"`
+	Timestamp     time.Time `dynamo:"timestamp"`
+	TTL           time.Time `dynamo:"ttl"`
+}
+
+// Expired returns true if the suppression has expiry and it is past.
+func (x *Suppression) Expired(now time.Time) bool {
+	return !x.TTL.IsZero() && !x.TTL.After(now)
+}
+
+// SuppressionTable is a table of suppressions. GetSuppression returns nil
+// without error if the suppression does not exist.
+type SuppressionTable interface {
+	GetSuppression(id string) (*Suppression, error)
+	PutSuppression(suppression *Suppression) error
+	DeleteSuppression(id string) error
+}
+
+type dynamoSuppressionTable struct {
+	region    string
+	tableName string
+}
+
+func (x *dynamoSuppressionTable) GetSuppression(id string) (*Suppression, error) {
+	var suppression Suppression
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Get("suppression_id", id).One(&suppression); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, WrapStoreError(ErrCodeStoreGet, err, fmt.Sprintf("Fail to get suppression from %s in %s", x.tableName, x.region))
+	}
+	return &suppression, nil
+}
+
+func (x *dynamoSuppressionTable) PutSuppression(suppression *Suppression) error {
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Put(suppression).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to put suppression to %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+func (x *dynamoSuppressionTable) DeleteSuppression(id string) error {
+	table := NewStorageDB(x.region).Table(x.tableName)
+	if err := table.Delete("suppression_id", id).Run(); err != nil {
+		return WrapStoreError(ErrCodeStorePut, err, fmt.Sprintf("Fail to delete suppression from %s in %s", x.tableName, x.region))
+	}
+	return nil
+}
+
+// OpenSuppressionTable returns SuppressionTable of DynamoDB. It can be
+// replaced for testing.
+var OpenSuppressionTable = func(region, tableName string) SuppressionTable {
+	return &dynamoSuppressionTable{region: region, tableName: tableName}
+}
+
+// SuppressionStore is a durable list of suppressed alerts maintained by
+// teams, e.g. alerts of a known scanner for a rule, or marked as false
+// positive. A suppression is kept until it is removed or its expiry.
+type SuppressionStore struct {
+	Table  string
+	Region string
+}
+
+// AddSuppression suppresses alerts of key and rule. Zero expiry means that the
+// suppression is permanent. An existing suppression of them is replaced.
+func (x *SuppressionStore) AddSuppression(key, rule, reason string, expiry time.Duration) error {
+	if expiry < 0 {
+		return NewConfigError(fmt.Sprintf("Invalid expiry of suppression: %s", expiry))
+	}
+
+	now := time.Now().UTC()
+	suppression := Suppression{
+		SuppressionID: GenAlertKey(key, rule, ""),
+		AlertKey:      key,
+		Rule:          NormalizeRule(rule),
+		Reason:        reason,
+		Timestamp:     now,
+	}
+	if expiry > 0 {
+		suppression.TTL = now.Add(expiry)
+	}
+	return OpenSuppressionTable(x.Region, x.Table).PutSuppression(&suppression)
+}
+
+// FalsePositiveReason is the reason of suppressions by MarkFalsePositive.
+const FalsePositiveReason = "false-positive"
+
+// FalsePositiveSuppression is a period in which alerts marked by
+// MarkFalsePositive are suppressed, read from FALSE_POSITIVE_SUPPRESSION in
+// seconds. The default is 7 days.
+var FalsePositiveSuppression = time.Duration(envInt("FALSE_POSITIVE_SUPPRESSION", 7*24*3600)) * time.Second
+
+// MarkFalsePositive suppresses following alerts of key and rule for
+// FalsePositiveSuppression.
+func (x *SuppressionStore) MarkFalsePositive(key, rule string) error {
+	return x.AddSuppression(key, rule, FalsePositiveReason, FalsePositiveSuppression)
+}
+
+// RemoveSuppression removes the suppression of key and rule. Removing a
+// suppression that does not exist is not an error.
+func (x *SuppressionStore) RemoveSuppression(key, rule string) error {
+	return OpenSuppressionTable(x.Region, x.Table).DeleteSuppression(GenAlertKey(key, rule, ""))
+}
+
+// IsSuppressed returns true if alerts of key and rule are suppressed and the
+// suppression has not expired.
+func (x *SuppressionStore) IsSuppressed(key, rule string) (bool, error) {
+	suppression, err := OpenSuppressionTable(x.Region, x.Table).GetSuppression(GenAlertKey(key, rule, ""))
+	if err != nil || suppression == nil {
+		return false, err
+	}
+	return !suppression.Expired(time.Now().UTC()), nil
+}
@@ -0,0 +1,112 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSuppressionTable struct {
+	items map[string]lib.Suppression
+}
+
+func (x *mockSuppressionTable) GetSuppression(id string) (*lib.Suppression, error) {
+	item, ok := x.items[id]
+	if !ok {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+func (x *mockSuppressionTable) PutSuppression(suppression *lib.Suppression) error {
+	x.items[suppression.SuppressionID] = *suppression
+	return nil
+}
+
+func (x *mockSuppressionTable) DeleteSuppression(id string) error {
+	delete(x.items, id)
+	return nil
+}
+
+func mockSuppressionTables(table *mockSuppressionTable) func() {
+	orig := lib.OpenSuppressionTable
+	lib.OpenSuppressionTable = func(region, tableName string) lib.SuppressionTable {
+		return table
+	}
+	return func() { lib.OpenSuppressionTable = orig }
+}
+
+func TestSuppressionStoreMatch(t *testing.T) {
+	table := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	defer mockSuppressionTables(table)()
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+
+	require.NoError(t, store.AddSuppression("198.51.100.7", "port-scan", "known scanner", 0))
+	ok, err := store.IsSuppressed("198.51.100.7", "port-scan")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Other rule and key of the same scanner are not suppressed.
+	ok, err = store.IsSuppressed("198.51.100.7", "c2")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = store.IsSuppressed("198.51.100.8", "port-scan")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.RemoveSuppression("198.51.100.7", "port-scan"))
+	ok, err = store.IsSuppressed("198.51.100.7", "port-scan")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, store.RemoveSuppression("198.51.100.7", "port-scan"))
+}
+
+func TestSuppressionStoreExpiry(t *testing.T) {
+	table := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	defer mockSuppressionTables(table)()
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+
+	require.NoError(t, store.AddSuppression("198.51.100.7", "port-scan", "maintenance", time.Hour))
+	ok, err := store.IsSuppressed("198.51.100.7", "port-scan")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// An expired suppression that is not deleted yet is ignored.
+	for id, item := range table.items {
+		item.TTL = time.Now().Add(-time.Minute)
+		table.items[id] = item
+	}
+	ok, err = store.IsSuppressed("198.51.100.7", "port-scan")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	err = store.AddSuppression("198.51.100.7", "port-scan", "", -time.Hour)
+	require.Error(t, err)
+	_, isConfig := err.(*lib.ConfigError)
+	assert.True(t, isConfig)
+}
+
+func TestSuppressionStoreMarkFalsePositive(t *testing.T) {
+	table := &mockSuppressionTable{items: map[string]lib.Suppression{}}
+	defer mockSuppressionTables(table)()
+	store := lib.SuppressionStore{Table: "suppression", Region: "ap-northeast-1"}
+
+	require.NoError(t, store.MarkFalsePositive("10.0.0.1", "rule1"))
+	require.Equal(t, 1, len(table.items))
+	for _, item := range table.items {
+		assert.Equal(t, lib.FalsePositiveReason, item.Reason)
+		assert.True(t, item.TTL.After(time.Now().Add(lib.FalsePositiveSuppression-time.Minute)))
+	}
+
+	ok, err := store.IsSuppressed("10.0.0.1", "rule1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Other rule of the same key is not suppressed.
+	ok, err = store.IsSuppressed("10.0.0.1", "rule2")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Limits of Teams message. Teams rejects a message larger than about 28KB.
+const (
+	teamsMaxMessageLen = 28000
+	teamsMaxTopHosts   = 5
+	teamsMaxTitleLen   = 1000
+)
+
+// TeamsConfig is configuration of PublishTeams.
+type TeamsConfig struct {
+	// WebhookURL is URL of incoming webhook or workflow of Teams.
+	WebhookURL string
+
+	// ReportURL is a template of link to the full report. "{report_id}" is
+	// replaced with ID of the report.
+	ReportURL string
+
+	// Templates renders title and text of the card. Default templates are
+	// used if nil.
+	Templates *NotificationTemplates
+
+	// Locale is locale of the card. Empty means DefaultLocale.
+	Locale string
+
+	Retry  HTTPRetry
+	Client *http.Client
+}
+
+// TeamsMessage is a message payload including an Adaptive Card.
+type TeamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []TeamsAttachment `json:"attachments"`
+}
+
+type TeamsAttachment struct {
+	ContentType string       `json:"contentType"`
+	Content     AdaptiveCard `json:"content"`
+}
+
+// AdaptiveCard is a root element of Adaptive Card. Body has elements such as
+// AdaptiveTextBlock, AdaptiveFactSet and AdaptiveTable.
+type AdaptiveCard struct {
+	Schema  string           `json:"$schema"`
+	Type    string           `json:"type"`
+	Version string           `json:"version"`
+	Body    []interface{}    `json:"body"`
+	Actions []AdaptiveAction `json:"actions,omitempty"`
+}
+
+type AdaptiveTextBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Size   string `json:"size,omitempty"`
+	Weight string `json:"weight,omitempty"`
+	Color  string `json:"color,omitempty"`
+	Wrap   bool   `json:"wrap,omitempty"`
+}
+
+type AdaptiveFactSet struct {
+	Type  string         `json:"type"`
+	Facts []AdaptiveFact `json:"facts"`
+}
+
+type AdaptiveFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+type AdaptiveTable struct {
+	Type              string                `json:"type"`
+	Columns           []AdaptiveTableColumn `json:"columns"`
+	Rows              []AdaptiveTableRow    `json:"rows"`
+	FirstRowAsHeaders bool                  `json:"firstRowAsHeaders"`
+	ShowGridLines     bool                  `json:"showGridLines"`
+}
+
+type AdaptiveTableColumn struct {
+	Width int `json:"width"`
+}
+
+type AdaptiveTableRow struct {
+	Type  string              `json:"type"`
+	Cells []AdaptiveTableCell `json:"cells"`
+}
+
+type AdaptiveTableCell struct {
+	Type  string              `json:"type"`
+	Items []AdaptiveTextBlock `json:"items"`
+}
+
+type AdaptiveAction struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// TeamsColor returns color of severity badge for the severity.
+func TeamsColor(sev ReportSeverity) string {
+	switch sev {
+	case SevUrgent:
+		return "Attention"
+	case SevUnclassified:
+		return "Warning"
+	case SevSafe:
+		return "Good"
+	default:
+		return "Default"
+	}
+}
+
+func adaptiveText(text string) AdaptiveTextBlock {
+	return AdaptiveTextBlock{Type: "TextBlock", Text: text, Wrap: true}
+}
+
+func teamsHostTable(report Report, locale string) *AdaptiveTable {
+	hosts := rankOpponentHosts(report.Content)
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	row := func(items ...string) AdaptiveTableRow {
+		r := AdaptiveTableRow{Type: "TableRow"}
+		for _, item := range items {
+			r.Cells = append(r.Cells, AdaptiveTableCell{
+				Type:  "TableCell",
+				Items: []AdaptiveTextBlock{adaptiveText(item)},
+			})
+		}
+		return r
+	}
+
+	header := row(Translate(locale, "host"), Translate(locale, "country"),
+		Translate(locale, "malware"), Translate(locale, "domains"), Translate(locale, "urls"))
+	tbl := AdaptiveTable{
+		Type:              "Table",
+		Columns:           []AdaptiveTableColumn{{Width: 3}, {Width: 2}, {Width: 1}, {Width: 1}, {Width: 1}},
+		FirstRowAsHeaders: true,
+		ShowGridLines:     true,
+		Rows:              []AdaptiveTableRow{header},
+	}
+
+	for i, h := range hosts {
+		if i >= teamsMaxTopHosts {
+			break
+		}
+		tbl.Rows = append(tbl.Rows, row(h.host.ID,
+			strings.Join(h.host.Country, ", "),
+			fmt.Sprintf("%d", h.malicious),
+			fmt.Sprintf("%d", len(h.host.RelatedDomains)),
+			fmt.Sprintf("%d", len(h.host.RelatedURLs))))
+	}
+
+	return &tbl
+}
+
+// NewTeamsMessage builds an Adaptive Card of the report. If the message
+// exceeds Teams limit, a summary card without the host table is returned.
+func NewTeamsMessage(cfg TeamsConfig, report Report) TeamsMessage {
+	text := cfg.Templates.Render(NotifyTeams, report, cfg.ReportURL, cfg.Locale)
+	title := AdaptiveTextBlock{
+		Type:   "TextBlock",
+		Text:   truncateText(text.Title, teamsMaxTitleLen),
+		Size:   "Large",
+		Weight: "Bolder",
+		Wrap:   true,
+	}
+	badge := AdaptiveTextBlock{
+		Type:   "TextBlock",
+		Text:   localizedSeverity(report, cfg.Locale),
+		Weight: "Bolder",
+		Color:  TeamsColor(report.Result.Severity),
+	}
+	facts := AdaptiveFactSet{
+		Type: "FactSet",
+		Facts: []AdaptiveFact{
+			{Title: Translate(cfg.Locale, "report_id"), Value: string(report.ID)},
+			{Title: Translate(cfg.Locale, "rule"), Value: report.Alert.Rule},
+			{Title: Translate(cfg.Locale, "key"), Value: report.Alert.Key},
+			{Title: Translate(cfg.Locale, "count.remote_hosts"), Value: fmt.Sprintf("%d", len(report.Content.OpponentHosts))},
+			{Title: Translate(cfg.Locale, "count.local_hosts"), Value: fmt.Sprintf("%d", len(report.Content.AlliedHosts))},
+			{Title: Translate(cfg.Locale, "count.users"), Value: fmt.Sprintf("%d", len(report.Content.SubjectUsers))},
+			{Title: Translate(cfg.Locale, "count.malicious_hashes"), Value: fmt.Sprintf("%d", len(report.Content.MaliciousHashes()))},
+		},
+	}
+
+	card := AdaptiveCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.5",
+		Body:    []interface{}{title, badge},
+	}
+	if text.Body != "" {
+		card.Body = append(card.Body, adaptiveText(text.Body))
+	}
+	card.Body = append(card.Body, facts)
+	if url := reportLink(cfg.ReportURL, report); url != "" {
+		card.Actions = []AdaptiveAction{{Type: "Action.OpenUrl", Title: Translate(cfg.Locale, "full_report"), URL: url}}
+	}
+
+	summary := card
+	summary.Body = append([]interface{}{}, card.Body...)
+	if tbl := teamsHostTable(report, cfg.Locale); tbl != nil {
+		card.Body = append(card.Body, *tbl)
+	}
+
+	msg := newTeamsMessage(card)
+	if !teamsWithinLimits(msg) {
+		Logger.WithFields(report.LogFields()).Warn("Teams message exceeds limits, fallback to summary")
+		msg = newTeamsMessage(summary)
+	}
+
+	return msg
+}
+
+func newTeamsMessage(card AdaptiveCard) TeamsMessage {
+	return TeamsMessage{
+		Type: "message",
+		Attachments: []TeamsAttachment{
+			{ContentType: "application/vnd.microsoft.card.adaptive", Content: card},
+		},
+	}
+}
+
+func teamsWithinLimits(msg TeamsMessage) bool {
+	raw, err := json.Marshal(msg)
+	return err == nil && len(raw) <= teamsMaxMessageLen
+}
+
+// PublishTeams posts the report to Microsoft Teams via incoming webhook.
+func PublishTeams(cfg TeamsConfig, report Report) error {
+	if cfg.WebhookURL == "" {
+		return NewConfigError("Teams webhook URL is not configured")
+	}
+
+	raw, err := json.Marshal(NewTeamsMessage(cfg, report))
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal teams message")
+	}
+
+	retry := cfg.Retry
+	if retry.Wait == 0 {
+		retry = DefaultHTTPRetry
+	}
+
+	if _, err := postJSON(cfg.Client, cfg.WebhookURL, nil, raw, retry); err != nil {
+		return errors.Wrap(err, "Fail to post teams message")
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func renderTeamsCard(t *testing.T, report lib.Report) (string, map[string]interface{}) {
+	msg := lib.NewTeamsMessage(lib.TeamsConfig{
+		ReportURL: "https://reports.example.com/{report_id}.json",
+	}, report)
+	raw, err := json.MarshalIndent(msg, "", "  ")
+	require.NoError(t, err)
+
+	var obj map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &obj))
+	return string(raw) + "\n", obj
+}
+
+// assertAdaptiveCardShape checks required properties of Teams message and
+// Adaptive Card elements.
+func assertAdaptiveCardShape(t *testing.T, msg map[string]interface{}) []interface{} {
+	assert.Equal(t, "message", msg["type"])
+	attachments, ok := msg["attachments"].([]interface{})
+	require.True(t, ok)
+	require.Equal(t, 1, len(attachments))
+
+	att := attachments[0].(map[string]interface{})
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", att["contentType"])
+	card := att["content"].(map[string]interface{})
+	assert.Equal(t, "AdaptiveCard", card["type"])
+	assert.Equal(t, "http://adaptivecards.io/schemas/adaptive-card.json", card["$schema"])
+	assert.NotEmpty(t, card["version"])
+
+	body, ok := card["body"].([]interface{})
+	require.True(t, ok)
+	require.NotEmpty(t, body)
+	for _, e := range body {
+		elem := e.(map[string]interface{})
+		switch elem["type"] {
+		case "TextBlock":
+			assert.NotEmpty(t, elem["text"])
+		case "FactSet":
+			assert.NotEmpty(t, elem["facts"])
+		case "Table":
+			assert.NotEmpty(t, elem["columns"])
+			assert.NotEmpty(t, elem["rows"])
+		default:
+			assert.Fail(t, fmt.Sprintf("Unexpected element type: %v", elem["type"]))
+		}
+	}
+
+	actions, _ := card["actions"].([]interface{})
+	for _, a := range actions {
+		action := a.(map[string]interface{})
+		assert.Equal(t, "Action.OpenUrl", action["type"])
+		assert.NotEmpty(t, action["url"])
+	}
+
+	return body
+}
+
+func TestTeamsCardGolden(t *testing.T) {
+	text, msg := renderTeamsCard(t, loadFixtureReport(t))
+	assertGolden(t, "teams_card.json", text)
+
+	body := assertAdaptiveCardShape(t, msg)
+	require.Equal(t, 4, len(body))
+	assert.Equal(t, "Attention", body[1].(map[string]interface{})["color"])
+	assert.Equal(t, "Table", body[3].(map[string]interface{})["type"])
+}
+
+func TestTeamsCardSummaryFallback(t *testing.T) {
+	report := loadFixtureReport(t)
+	for i := 0; i < 5; i++ {
+		id := string(rune('a'+i)) + strings.Repeat("x", 10000)
+		report.Content.OpponentHosts[id] = lib.ReportOpponentHost{ID: id}
+	}
+
+	text, msg := renderTeamsCard(t, report)
+	assertGolden(t, "teams_card_summary.json", text)
+
+	body := assertAdaptiveCardShape(t, msg)
+	require.Equal(t, 3, len(body))
+	assert.Equal(t, "FactSet", body[2].(map[string]interface{})["type"])
+}
+
+func TestPublishTeams(t *testing.T) {
+	var calls int
+	var received map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(raw, &received))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	}))
+	defer srv.Close()
+
+	cfg := lib.TeamsConfig{
+		WebhookURL: srv.URL,
+		Retry:      lib.HTTPRetry{MaxRetry: 2, Wait: time.Millisecond},
+	}
+	require.NoError(t, lib.PublishTeams(cfg, loadFixtureReport(t)))
+	assert.Equal(t, 2, calls)
+	assertAdaptiveCardShape(t, received)
+}
+
+func TestPublishTeamsNoWebhook(t *testing.T) {
+	err := lib.PublishTeams(lib.TeamsConfig{}, loadFixtureReport(t))
+	require.Error(t, err)
+	_, ok := err.(*lib.ConfigError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// DefaultReportTemplate is a text/template of Markdown report. It produces
+// same output as RenderMarkDown and can be a starting point of custom
+// templates. Dot of templates is *Report.
+const DefaultReportTemplate = `## {{.Alert.Title}}
+
+- Report ID: {{.ID}}
+- Rule: {{.Alert.Rule}}
+- Key: {{.Alert.Key}}
+{{- if .Status}}
+- Status: {{.Status}}
+{{- end}}
+{{- if .Result.Severity}}
+- Severity: {{.Result.Severity}}
+{{- end}}
+{{- if .Result.Reason}}
+- Reason: {{.Result.Reason}}
+{{- end}}
+{{- $hosts := sortHosts .Content.OpponentHosts}}
+{{- if $hosts}}
+
+### Remote Hosts
+
+| ID | IP Address | Country | AS Owner | Malware | Domains | URLs |
+|:---------|:---------|:---------|:---------|:---------|:---------|:---------|
+{{- range $hosts}}
+| {{cell .ID}} | {{cell .IPAddr}} | {{cell .Country}} | {{cell .ASOwner}} | {{len .RelatedMalware}} | {{len .RelatedDomains}} | {{len .RelatedURLs}} |
+{{- end}}
+{{- $malware := false}}{{$domains := false}}{{$urls := false}}
+{{- range $hosts}}
+{{- if .RelatedMalware}}{{$malware = true}}{{end}}
+{{- if .RelatedDomains}}{{$domains = true}}{{end}}
+{{- if .RelatedURLs}}{{$urls = true}}{{end}}
+{{- end}}
+{{- if $malware}}
+
+### Related Malware
+
+| Host | SHA256 | Detected | Relation |
+|:---------|:---------|:---------|:---------|
+{{- range $h := $hosts}}{{range .RelatedMalware}}
+| {{cell $h.ID}} | {{cell .SHA256}} | {{countPositives .}}/{{len .Scans}} | {{cell .Relation}} |
+{{- end}}{{end}}
+{{- end}}
+{{- if $domains}}
+
+### Related Domains
+{{range $h := $hosts}}{{range .RelatedDomains}}
+- {{$h.ID}}: {{code .Name}} ({{.Source}})
+{{- end}}{{end}}
+{{- end}}
+{{- if $urls}}
+
+### Related URLs
+{{range $h := $hosts}}{{range .RelatedURLs}}
+- {{$h.ID}}: {{code .URL}} ({{.Source}})
+{{- end}}{{end}}
+{{- end}}
+{{- end}}
+{{- with sortHosts .Content.AlliedHosts}}
+
+### Local Hosts
+
+| ID | User | Owner | OS | IP Address | Hostname | Software | Activities |
+|:---------|:---------|:---------|:---------|:---------|:---------|:---------|:---------|
+{{- range .}}
+| {{cell .ID}} | {{cell .UserName}} | {{cell .Owner}} | {{cell .OS}} | {{cell .IPAddr}} | {{cell .HostName}} | {{cell .Software}} | {{len .Activities}} |
+{{- end}}
+{{- end}}
+{{- with sortUsers .Content.SubjectUsers}}
+
+### Users
+
+| User | Service | Action | Target | Remote Address | Last Seen |
+|:---------|:---------|:---------|:---------|:---------|:---------|
+{{- range .}}
+{{- $name := .UserName}}
+{{- if not .Activities}}
+| {{cell $name}} |  |  |  |  |  |
+{{- end}}
+{{- range .Activities}}
+| {{cell $name}} | {{cell .ServiceName}} | {{cell .Action}} | {{cell .Target}} | {{cell .RemoteAddr}} | {{datetime .LastSeen}} |
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Warnings}}
+
+### Warnings
+{{range .Warnings}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- if .Comments}}
+
+### Comments
+{{range .Comments}}
+- {{.Timestamp.Format "2006-01-02 15:04:05"}} {{.Author}}: {{.Text}}
+{{- end}}
+{{- end}}
+`
+
+// reportFuncs are helper functions available in report templates.
+//
+//	severityBadge SEV    "**[URGENT]**" style label of severity
+//	truncate N TEXT      TEXT cut to N characters with "..."
+//	sortHosts MAP        remote or local hosts sorted by ID
+//	sortUsers MAP        users sorted by name
+//	countPositives MAL   number of positive scans of the malware
+//	cell VALUE           string or []string escaped for a table cell
+//	code TEXT            TEXT as inline code
+//	datetime TIME        TIME formatted as "2006-01-02 15:04:05" in UTC
+var reportFuncs = template.FuncMap{
+	"severityBadge":  severityBadge,
+	"truncate":       templateTruncate,
+	"sortHosts":      sortHosts,
+	"sortUsers":      sortUsers,
+	"countPositives": countPositives,
+	"cell":           templateCell,
+	"code":           func(s string) string { return "`" + s + "`" },
+	"datetime":       func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05") },
+}
+
+func severityBadge(sev ReportSeverity) string {
+	if sev == "" {
+		sev = SevUnclassified
+	}
+	return fmt.Sprintf("**[%s]**", strings.ToUpper(string(sev)))
+}
+
+func templateTruncate(n int, s string) string {
+	r := []rune(s)
+	if n < 0 || len(r) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(r[:n])
+	}
+	return string(r[:n-3]) + "..."
+}
+
+func sortHosts(hosts interface{}) (interface{}, error) {
+	switch m := hosts.(type) {
+	case map[string]ReportOpponentHost:
+		var ids []string
+		for id := range m {
+			ids = append(ids, id)
+		}
+		var sorted []ReportOpponentHost
+		for _, id := range sortedKeys(ids) {
+			sorted = append(sorted, m[id])
+		}
+		return sorted, nil
+
+	case map[string]ReportAlliedHost:
+		var ids []string
+		for id := range m {
+			ids = append(ids, id)
+		}
+		var sorted []ReportAlliedHost
+		for _, id := range sortedKeys(ids) {
+			sorted = append(sorted, m[id])
+		}
+		return sorted, nil
+	}
+
+	return nil, fmt.Errorf("sortHosts: unsupported type %T", hosts)
+}
+
+func sortUsers(users map[string]ReportUser) []ReportUser {
+	var names []string
+	for name := range users {
+		names = append(names, name)
+	}
+	var sorted []ReportUser
+	for _, name := range sortedKeys(names) {
+		sorted = append(sorted, users[name])
+	}
+	return sorted
+}
+
+func countPositives(m ReportMalware) int {
+	positives := 0
+	for _, scan := range m.Scans {
+		if scan.Positive {
+			positives++
+		}
+	}
+	return positives
+}
+
+func templateCell(v interface{}) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return mdCell(s), nil
+	case []string:
+		return mdCell(s...), nil
+	}
+	return "", fmt.Errorf("cell: unsupported type %T", v)
+}
+
+// sampleReport has every kind of content to run all branches of a template
+// for validation.
+func sampleReport() Report {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := NewReport("00000000-0000-0000-0000-000000000000",
+		Alert{Name: "sample", Rule: "sample-rule", Key: "sample-key", Description: "sample alert"})
+	report.Status = StatusNew
+	report.Result = ReportResult{Severity: SevUnclassified, Reason: "sample"}
+	report.Content.OpponentHosts["198.51.100.1"] = ReportOpponentHost{
+		ID:             "198.51.100.1",
+		IPAddr:         []string{"198.51.100.1"},
+		RelatedMalware: []ReportMalware{{SHA256: "sample", Scans: []ReportMalwareScan{{Positive: true}}}},
+		RelatedDomains: []ReportDomain{{Name: "example.com", Timestamp: now}},
+		RelatedURLs:    []ReportURL{{URL: "http://example.com", Timestamp: now}},
+	}
+	report.Content.AlliedHosts["i-sample"] = ReportAlliedHost{ID: "i-sample"}
+	report.Content.SubjectUsers["sample"] = ReportUser{UserName: "sample"}
+	report.Warnings = []string{"sample"}
+	report.Comments = []Comment{{Author: "sample", Text: "sample", Timestamp: now}}
+	return report
+}
+
+// ParseReportTemplate parses a report template and validates it by rendering
+// a sample report, so that a broken template fails at load time rather than
+// on publishing.
+func ParseReportTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("report").Funcs(reportFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to parse report template")
+	}
+
+	if _, err := ExecReportTemplate(tmpl, sampleReport()); err != nil {
+		return nil, errors.Wrap(err, "Invalid report template")
+	}
+	return tmpl, nil
+}
+
+// LoadReportTemplate reads a report template from S3 object and validates it.
+// A client of AWS_REGION is created if client is nil.
+func LoadReportTemplate(client s3iface.S3API, bucket, key string) (*template.Template, error) {
+	if client == nil {
+		client = s3.New(newSession(os.Getenv("AWS_REGION")))
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get report template s3://%s/%s", bucket, key)
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read report template")
+	}
+
+	return ParseReportTemplate(string(raw))
+}
+
+// ExecReportTemplate renders the report by a parsed template.
+func ExecReportTemplate(tmpl *template.Template, r Report) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &r); err != nil {
+		return "", errors.Wrap(err, "Fail to render report template")
+	}
+	return buf.String(), nil
+}
+
+// RenderReport renders the report by text/template. DefaultReportTemplate is
+// used if tmpl is empty.
+func RenderReport(r Report, tmpl string) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultReportTemplate
+	}
+
+	t, err := ParseReportTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return ExecReportTemplate(t, r)
+}
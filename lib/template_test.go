@@ -0,0 +1,68 @@
+package lib_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderReportDefaultGolden(t *testing.T) {
+	report := loadFixtureReport(t)
+	text, err := lib.RenderReport(report, "")
+	require.NoError(t, err)
+
+	// Default template must keep same output as the built-in renderer.
+	assertGolden(t, "report.md", text)
+	assert.Equal(t, lib.RenderMarkDown(report), text)
+}
+
+func TestRenderReportDefaultEmptyReport(t *testing.T) {
+	report := lib.NewReport("r1", lib.Alert{Name: "test", Description: "empty"})
+	text, err := lib.RenderReport(report, "")
+	require.NoError(t, err)
+	assert.Equal(t, lib.RenderMarkDown(report), text)
+}
+
+func TestRenderReportCustomGolden(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "report_custom.tmpl"))
+	require.NoError(t, err)
+
+	report := loadFixtureReport(t)
+	text, err := lib.RenderReport(report, string(raw))
+	require.NoError(t, err)
+	assertGolden(t, "report_custom.md", text)
+}
+
+func TestParseReportTemplateInvalid(t *testing.T) {
+	_, err := lib.ParseReportTemplate("{{.Alert.Title")
+	assert.Error(t, err)
+
+	// Unknown fields are found by validation at load time.
+	_, err = lib.ParseReportTemplate("{{.NoSuchField}}")
+	assert.Error(t, err)
+
+	_, err = lib.ParseReportTemplate("{{cell .Result}}")
+	assert.Error(t, err)
+}
+
+func TestLoadReportTemplate(t *testing.T) {
+	client := &mockS3{objects: map[string]string{
+		"templates/report.tmpl": "{{severityBadge .Result.Severity}} {{.Alert.Key}}",
+		"templates/broken.tmpl": "{{.Unknown}}",
+	}}
+
+	tmpl, err := lib.LoadReportTemplate(client, "templates", "report.tmpl")
+	require.NoError(t, err)
+
+	report := loadFixtureReport(t)
+	text, err := lib.ExecReportTemplate(tmpl, report)
+	require.NoError(t, err)
+	assert.Equal(t, "**[URGENT]** 10.1.2.3", text)
+
+	_, err = lib.LoadReportTemplate(client, "templates", "broken.tmpl")
+	assert.Error(t, err)
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// TracingEnabled turns on X-Ray subsegments. Nothing is emitted when it is
+// false or the Lambda invocation is not sampled.
+var TracingEnabled = os.Getenv("XRAY_TRACING") == "true"
+
+// Subsegment is an independent subsegment document of X-Ray.
+type Subsegment struct {
+	Name      string                 `json:"name"`
+	ID        string                 `json:"id"`
+	TraceID   string                 `json:"trace_id"`
+	ParentID  string                 `json:"parent_id"`
+	Type      string                 `json:"type"`
+	StartTime float64                `json:"start_time"`
+	EndTime   float64                `json:"end_time"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Error     bool                   `json:"error,omitempty"`
+	AWS       map[string]interface{} `json:"aws,omitempty"`
+}
+
+// TraceEmitter sends subsegments to X-Ray.
+type TraceEmitter interface {
+	Emit(seg *Subsegment) error
+}
+
+// daemonEmitter sends subsegments to X-Ray daemon via UDP. A connection is
+// reused over invocations and dialed again after failure of sending.
+type daemonEmitter struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (x *daemonEmitter) Emit(seg *Subsegment) error {
+	raw, err := json.Marshal(seg)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal subsegment")
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.conn == nil {
+		conn, err := net.Dial("udp", x.addr)
+		if err != nil {
+			return errors.Wrap(err, "Fail to connect X-Ray daemon")
+		}
+		x.conn = conn
+	}
+
+	msg := append([]byte(`{"format": "json", "version": 1}`+"\n"), raw...)
+	if _, err := x.conn.Write(msg); err != nil {
+		x.conn.Close()
+		x.conn = nil
+		return errors.Wrap(err, "Fail to send subsegment")
+	}
+	return nil
+}
+
+var (
+	traceEmitterMutex sync.Mutex
+	traceEmitter      TraceEmitter
+)
+
+// SetTraceEmitter replaces destination of subsegments, e.g. for testing.
+func SetTraceEmitter(emitter TraceEmitter) {
+	traceEmitterMutex.Lock()
+	defer traceEmitterMutex.Unlock()
+	traceEmitter = emitter
+}
+
+func getTraceEmitter() TraceEmitter {
+	traceEmitterMutex.Lock()
+	defer traceEmitterMutex.Unlock()
+
+	if traceEmitter == nil {
+		addr := os.Getenv("AWS_XRAY_DAEMON_ADDRESS")
+		if addr == "" {
+			addr = "127.0.0.1:2000"
+		}
+		traceEmitter = &daemonEmitter{addr: addr}
+	}
+	return traceEmitter
+}
+
+// traceHeader parses _X_AMZN_TRACE_ID set by Lambda, e.g.
+// "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+func traceHeader() (root, parent string, sampled bool) {
+	for _, kv := range strings.Split(os.Getenv("_X_AMZN_TRACE_ID"), ";") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		switch p[0] {
+		case "Root":
+			root = p[1]
+		case "Parent":
+			parent = p[1]
+		case "Sampled":
+			sampled = p[1] == "1"
+		}
+	}
+	return
+}
+
+func newSegmentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// TraceSpan is a running subsegment. Methods of nil TraceSpan do nothing, so
+// callers need not check if tracing is enabled.
+type TraceSpan struct {
+	seg Subsegment
+}
+
+var (
+	openSpanMutex sync.Mutex
+	openSpans     []*TraceSpan
+)
+
+// StartTrace starts a subsegment under the latest running subsegment of
+// current Lambda invocation, or under the segment of the invocation if none
+// is running. It returns nil if tracing is disabled or not sampled.
+func StartTrace(name string) *TraceSpan {
+	return startTraceAt(name, time.Now())
+}
+
+func startTraceAt(name string, start time.Time) *TraceSpan {
+	if !TracingEnabled {
+		return nil
+	}
+
+	root, parent, sampled := traceHeader()
+	if root == "" || parent == "" || !sampled {
+		return nil
+	}
+
+	openSpanMutex.Lock()
+	defer openSpanMutex.Unlock()
+
+	// Spans left open by previous invocations are dropped.
+	if n := len(openSpans); n > 0 && openSpans[n-1].seg.TraceID != root {
+		openSpans = nil
+	}
+	if n := len(openSpans); n > 0 {
+		parent = openSpans[n-1].seg.ID
+	}
+
+	span := &TraceSpan{
+		seg: Subsegment{
+			Name:      name,
+			ID:        newSegmentID(),
+			TraceID:   root,
+			ParentID:  parent,
+			Type:      "subsegment",
+			StartTime: epochSeconds(start),
+		},
+	}
+	openSpans = append(openSpans, span)
+	return span
+}
+
+// close removes the span from running spans.
+func (x *TraceSpan) close() {
+	openSpanMutex.Lock()
+	defer openSpanMutex.Unlock()
+
+	for i, span := range openSpans {
+		if span == x {
+			openSpans = append(openSpans[:i], openSpans[i+1:]...)
+			return
+		}
+	}
+}
+
+// End closes the subsegment and sends it. The subsegment is marked as error
+// if err is not nil. Failure of sending is only logged.
+func (x *TraceSpan) End(err error) {
+	if x == nil {
+		return
+	}
+
+	x.close()
+	x.seg.EndTime = epochSeconds(time.Now())
+	x.seg.Error = err != nil
+
+	if err := getTraceEmitter().Emit(&x.seg); err != nil {
+		Logger.WithError(err).Warn("Fail to emit subsegment")
+	}
+}
+
+// traceHandler records each AWS API call as a subsegment.
+var traceHandler = request.NamedHandler{
+	Name: "alertresponder.TraceHandler",
+	Fn: func(r *request.Request) {
+		span := startTraceAt(r.ClientInfo.ServiceName, r.Time)
+		if span == nil {
+			return
+		}
+
+		span.seg.Namespace = "aws"
+		span.seg.AWS = map[string]interface{}{
+			"region": aws.StringValue(r.Config.Region),
+		}
+		if r.Operation != nil {
+			span.seg.AWS["operation"] = r.Operation.Name
+		}
+		if r.RequestID != "" {
+			span.seg.AWS["request_id"] = r.RequestID
+		}
+		span.End(r.Error)
+	},
+}
+
+// TraceHandlers adds the trace handler to handlers of AWS session or client.
+func TraceHandlers(h *request.Handlers) {
+	h.Complete.PushBackNamed(traceHandler)
+}
+
+// newSession creates AWS session of the region. API calls by clients of the
+// session are traced if tracing is enabled.
+func newSession(region string) *session.Session {
+	ssn := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	TraceHandlers(&ssn.Handlers)
+	return ssn
+}
@@ -0,0 +1,163 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockEmitter struct {
+	segments []*lib.Subsegment
+}
+
+func (x *mockEmitter) Emit(seg *lib.Subsegment) error {
+	x.segments = append(x.segments, seg)
+	return nil
+}
+
+const testTraceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+
+func enableTracing(header string) (*mockEmitter, func()) {
+	emitter := &mockEmitter{}
+	origEnabled := lib.TracingEnabled
+	origHeader := os.Getenv("_X_AMZN_TRACE_ID")
+
+	lib.TracingEnabled = true
+	os.Setenv("_X_AMZN_TRACE_ID", header)
+	lib.SetTraceEmitter(emitter)
+
+	return emitter, func() {
+		lib.TracingEnabled = origEnabled
+		os.Setenv("_X_AMZN_TRACE_ID", origHeader)
+		lib.SetTraceEmitter(nil)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	emitter, restore := enableTracing(testTraceHeader)
+	defer restore()
+	lib.TracingEnabled = false
+
+	span := lib.StartTrace("test")
+	assert.Nil(t, span)
+	span.End(nil)
+	assert.Equal(t, 0, len(emitter.segments))
+}
+
+func TestTraceNotSampled(t *testing.T) {
+	emitter, restore := enableTracing("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0")
+	defer restore()
+
+	lib.StartTrace("test").End(nil)
+	assert.Equal(t, 0, len(emitter.segments))
+}
+
+func TestTraceSubsegment(t *testing.T) {
+	emitter, restore := enableTracing(testTraceHeader)
+	defer restore()
+
+	lib.StartTrace("FetchReportPages").End(nil)
+	lib.StartTrace("SaveReport").End(errors.New("fail"))
+
+	require.Equal(t, 2, len(emitter.segments))
+	seg := emitter.segments[0]
+	assert.Equal(t, "FetchReportPages", seg.Name)
+	assert.Equal(t, "subsegment", seg.Type)
+	assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", seg.TraceID)
+	assert.Equal(t, "53995c3f42cd8ad8", seg.ParentID)
+	assert.Equal(t, 16, len(seg.ID))
+	assert.True(t, seg.StartTime <= seg.EndTime)
+	assert.False(t, seg.Error)
+
+	assert.Equal(t, "SaveReport", emitter.segments[1].Name)
+	assert.True(t, emitter.segments[1].Error)
+	assert.NotEqual(t, seg.ID, emitter.segments[1].ID)
+}
+
+func TestTraceAWSRequest(t *testing.T) {
+	emitter, restore := enableTracing(testTraceHeader)
+	defer restore()
+
+	var handlers request.Handlers
+	lib.TraceHandlers(&handlers)
+
+	handlers.Complete.Run(&request.Request{
+		Config:     aws.Config{Region: aws.String("ap-northeast-1")},
+		ClientInfo: metadata.ClientInfo{ServiceName: "sns"},
+		Operation:  &request.Operation{Name: "Publish"},
+		Time:       time.Now().Add(-time.Second),
+		RequestID:  "req-1",
+	})
+
+	require.Equal(t, 1, len(emitter.segments))
+	seg := emitter.segments[0]
+	assert.Equal(t, "sns", seg.Name)
+	assert.Equal(t, "aws", seg.Namespace)
+	assert.Equal(t, "Publish", seg.AWS["operation"])
+	assert.Equal(t, "ap-northeast-1", seg.AWS["region"])
+	assert.Equal(t, "req-1", seg.AWS["request_id"])
+	assert.True(t, seg.EndTime-seg.StartTime >= 1.0)
+}
+
+func TestTraceNestedSubsegment(t *testing.T) {
+	emitter, restore := enableTracing(testTraceHeader)
+	defer restore()
+
+	outer := lib.StartTrace("LinkReports")
+	inner := lib.StartTrace("SaveReport")
+	inner.End(nil)
+	lib.StartTrace("LoadReport").End(nil)
+	outer.End(nil)
+	lib.StartTrace("Next").End(nil)
+
+	require.Equal(t, 4, len(emitter.segments))
+	saved, loaded, linked, next := emitter.segments[0], emitter.segments[1], emitter.segments[2], emitter.segments[3]
+	assert.Equal(t, "53995c3f42cd8ad8", linked.ParentID)
+	assert.Equal(t, linked.ID, saved.ParentID)
+	assert.Equal(t, linked.ID, loaded.ParentID)
+	assert.Equal(t, "53995c3f42cd8ad8", next.ParentID)
+}
+
+func TestTraceDaemonEmitterReuseConnection(t *testing.T) {
+	_, restore := enableTracing(testTraceHeader)
+	defer restore()
+
+	daemon, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer daemon.Close()
+
+	origAddr := os.Getenv("AWS_XRAY_DAEMON_ADDRESS")
+	os.Setenv("AWS_XRAY_DAEMON_ADDRESS", daemon.LocalAddr().String())
+	defer os.Setenv("AWS_XRAY_DAEMON_ADDRESS", origAddr)
+	lib.SetTraceEmitter(nil)
+
+	lib.StartTrace("first").End(nil)
+	lib.StartTrace("second").End(nil)
+
+	var senders []string
+	buf := make([]byte, 4096)
+	for _, name := range []string{"first", "second"} {
+		daemon.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := daemon.ReadFrom(buf)
+		require.NoError(t, err)
+		senders = append(senders, addr.String())
+
+		lines := strings.SplitN(string(buf[:n]), "\n", 2)
+		require.Equal(t, 2, len(lines))
+		var seg lib.Subsegment
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &seg))
+		assert.Equal(t, name, seg.Name)
+	}
+	assert.Equal(t, senders[0], senders[1])
+}
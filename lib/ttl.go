@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReportTTL is retention of reports and pages in DynamoDB if no
+// severity rule is configured.
+const DefaultReportTTL = 10 * 24 * time.Hour
+
+// SeverityTTL chooses retention of a report by its severity.
+type SeverityTTL struct {
+	// Default is used for severity without rule. DefaultReportTTL is used if 0.
+	Default    time.Duration
+	BySeverity map[ReportSeverity]time.Duration
+}
+
+// ParseSeverityTTL parses rules such as "urgent=90d,safe=7d,default=30d".
+// Duration is days with "d" suffix or a Go duration, e.g. "36h". Empty string
+// means DefaultReportTTL for all severities.
+func ParseSeverityTTL(raw string) (SeverityTTL, error) {
+	ttl := SeverityTTL{BySeverity: map[ReportSeverity]time.Duration{}}
+
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return ttl, NewConfigError(fmt.Sprintf("Invalid report TTL rule: %s", item))
+		}
+
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		d, err := parseTTLDuration(strings.TrimSpace(kv[1]))
+		if err != nil || d <= 0 {
+			return ttl, NewConfigError(fmt.Sprintf("Invalid report TTL duration: %s", item))
+		}
+
+		switch sev := ReportSeverity(name); sev {
+		case "default":
+			ttl.Default = d
+		case SevUrgent, SevUnclassified, SevSafe:
+			ttl.BySeverity[sev] = d
+		default:
+			return ttl, NewConfigError(fmt.Sprintf("Invalid severity of report TTL rule: %s", item))
+		}
+	}
+
+	return ttl, nil
+}
+
+func parseTTLDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// TTL returns retention of a report with the severity. Empty severity is
+// regarded as unclassified.
+func (x SeverityTTL) TTL(sev ReportSeverity) time.Duration {
+	if sev == "" {
+		sev = SevUnclassified
+	}
+	if d, ok := x.BySeverity[sev]; ok {
+		return d
+	}
+	if x.Default > 0 {
+		return x.Default
+	}
+	return DefaultReportTTL
+}
+
+// Max returns the longest retention of all severities. It is used for pages
+// and comments that are stored before severity of the report is decided, so
+// that they are kept as long as the compiled report.
+func (x SeverityTTL) Max() time.Duration {
+	max := x.Default
+	if max <= 0 {
+		max = DefaultReportTTL
+	}
+	for _, d := range x.BySeverity {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// ReportTTL is retention rules read from REPORT_TTL. DefaultReportTTL is used
+// for all severities if it is not set or invalid.
+var ReportTTL = func() SeverityTTL {
+	ttl, err := ParseSeverityTTL(os.Getenv("REPORT_TTL"))
+	if err != nil {
+		Logger.WithError(err).Warn("Invalid REPORT_TTL, use default")
+		return SeverityTTL{}
+	}
+	return ttl
+}()
@@ -0,0 +1,81 @@
+package lib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const day = 24 * time.Hour
+
+func TestParseSeverityTTL(t *testing.T) {
+	ttl, err := lib.ParseSeverityTTL("urgent=90d, safe=7d,Unclassified=36h")
+	require.NoError(t, err)
+	assert.Equal(t, 90*day, ttl.TTL(lib.SevUrgent))
+	assert.Equal(t, 7*day, ttl.TTL(lib.SevSafe))
+	assert.Equal(t, 36*time.Hour, ttl.TTL(lib.SevUnclassified))
+	assert.Equal(t, 36*time.Hour, ttl.TTL(""))
+	assert.Equal(t, 90*day, ttl.Max())
+
+	ttl, err = lib.ParseSeverityTTL("safe=3d,default=30d")
+	require.NoError(t, err)
+	assert.Equal(t, 30*day, ttl.TTL(lib.SevUrgent))
+	assert.Equal(t, 3*day, ttl.TTL(lib.SevSafe))
+	assert.Equal(t, 30*day, ttl.Max())
+
+	ttl, err = lib.ParseSeverityTTL("")
+	require.NoError(t, err)
+	assert.Equal(t, lib.DefaultReportTTL, ttl.TTL(lib.SevUrgent))
+	assert.Equal(t, lib.DefaultReportTTL, ttl.Max())
+
+	for _, raw := range []string{"urgent", "urgent=", "urgent=xd", "urgent=-1d", "critical=90d"} {
+		_, err := lib.ParseSeverityTTL(raw)
+		require.Error(t, err, raw)
+		assert.Equal(t, lib.ErrCodeInvalidConfig, lib.ErrorCodeOf(err), raw)
+	}
+}
+
+func TestReportTTLBySeverity(t *testing.T) {
+	orig := lib.ReportTTL
+	defer func() { lib.ReportTTL = orig }()
+
+	var err error
+	lib.ReportTTL, err = lib.ParseSeverityTTL("urgent=90d,safe=7d")
+	require.NoError(t, err)
+
+	secondary := &mockReportTable{}
+	defer mockReportTables(map[string]*mockReportTable{
+		"ap-northeast-1": secondary,
+		"us-west-2":      secondary,
+	})()
+
+	report, pages := replicaFixture(t)
+	for _, tc := range []struct {
+		severity lib.ReportSeverity
+		ttl      time.Duration
+	}{
+		{lib.SevUrgent, 90 * day},
+		{lib.SevSafe, 7 * day},
+		{lib.SevUnclassified, lib.DefaultReportTTL},
+	} {
+		report.Result.Severity = tc.severity
+		record, err := lib.NewReportRecord(report, "ap-northeast-1")
+		require.NoError(t, err)
+		assert.Equal(t, tc.ttl, record.TimeToLive.Sub(record.UpdatedAt), tc.severity)
+
+		secondary.components = nil
+		require.NoError(t, lib.ReplicateReport(report, pages, "ap-northeast-1", "us-west-2"))
+		for _, c := range secondary.components {
+			assert.True(t, c.TimeToLive.Sub(c.SubmittedAt) <= tc.ttl)
+			assert.True(t, c.TimeToLive.Sub(c.SubmittedAt) > tc.ttl-time.Second)
+		}
+	}
+
+	// Comments are stored before severity is decided.
+	c, err := lib.NewCommentComponent(report.ID, lib.Comment{Author: "analyst", Text: "checked"})
+	require.NoError(t, err)
+	assert.Equal(t, 90*day, c.TimeToLive.Sub(c.SubmittedAt))
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	lambdaService "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/pkg/errors"
+)
+
+// PageWriter accumulates findings of an inspector and submits them as report
+// pages. Accumulated findings are flushed automatically into a new page before
+// the serialized page exceeds MaxSize, then inspectors can add findings without
+// caring about size of the page.
+type PageWriter struct {
+	// MaxSize is limit of a serialized page. MaxPageSize is used by default.
+	MaxSize int
+
+	reportID ReportID
+	author   string
+	title    string
+	submit   func(page ReportPage) error
+
+	page    ReportPage
+	size    int
+	items   int
+	flushed int
+}
+
+// NewPageWriter is a constructor of PageWriter. submit is called with a page
+// for each flush.
+func NewPageWriter(task Task, author, title string, submit func(page ReportPage) error) *PageWriter {
+	w := &PageWriter{
+		MaxSize:  MaxPageSize,
+		reportID: task.ReportID,
+		author:   author,
+		title:    title,
+		submit:   submit,
+	}
+	w.reset()
+	return w
+}
+
+func (x *PageWriter) reset() {
+	x.page = NewReportPage()
+	x.page.ReportID = x.reportID
+	x.page.Author = x.author
+	x.page.Title = x.title
+
+	// Empty page is a base of size estimation. Each item adds its length and
+	// a separator, which is never smaller than actual increment.
+	base, _ := json.Marshal(&x.page)
+	x.size = len(base)
+	x.items = 0
+}
+
+// add reserves room for an item. The current page is flushed if the item does
+// not fit in it.
+func (x *PageWriter) add(target string, item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return WrapCode(ErrCodeMarshal, err, "Fail to marshal "+target)
+	}
+	itemSize := len(data) + 1
+
+	if x.MaxSize > 0 && x.size+itemSize > x.MaxSize {
+		if x.items == 0 {
+			return NewSizeLimitError(target, x.size+itemSize, x.MaxSize)
+		}
+		if err := x.Flush(); err != nil {
+			return err
+		}
+		if x.size+itemSize > x.MaxSize {
+			return NewSizeLimitError(target, x.size+itemSize, x.MaxSize)
+		}
+	}
+
+	x.size += itemSize
+	x.items++
+	return nil
+}
+
+// AddOpponentHost appends a remote host to the page.
+func (x *PageWriter) AddOpponentHost(host ReportOpponentHost) error {
+	if err := x.add("Remote host", host); err != nil {
+		return err
+	}
+	x.page.OpponentHosts = append(x.page.OpponentHosts, host)
+	return nil
+}
+
+// AddAlliedHost appends a local host to the page.
+func (x *PageWriter) AddAlliedHost(host ReportAlliedHost) error {
+	if err := x.add("Local host", host); err != nil {
+		return err
+	}
+	x.page.AlliedHosts = append(x.page.AlliedHosts, host)
+	return nil
+}
+
+// AddUser appends a user to the page.
+func (x *PageWriter) AddUser(user ReportUser) error {
+	if err := x.add("User", user); err != nil {
+		return err
+	}
+	x.page.SubjectUser = append(x.page.SubjectUser, user)
+	return nil
+}
+
+// Flush submits accumulated findings as a page. Nothing is submitted if no
+// finding is accumulated.
+func (x *PageWriter) Flush() error {
+	if x.items == 0 {
+		return nil
+	}
+
+	if err := x.submit(x.page); err != nil {
+		return errors.Wrap(err, "Fail to submit page")
+	}
+	x.flushed++
+	x.reset()
+	return nil
+}
+
+// Flushed returns number of submitted pages.
+func (x *PageWriter) Flushed() int {
+	return x.flushed
+}
+
+// NewSubmitter returns a function to submit a page to the submitter Lambda.
+func NewSubmitter(funcName, region string) func(page ReportPage) error {
+	return func(page ReportPage) error {
+		payload, err := json.Marshal(page)
+		if err != nil {
+			return WrapCode(ErrCodeMarshal, err, "Fail to marshal Page data")
+		}
+
+		svc := lambdaService.New(newSession(region))
+		input := &lambdaService.InvokeInput{
+			FunctionName: &funcName,
+			Payload:      payload,
+		}
+		resp, err := svc.Invoke(input)
+		Logger.WithField("response", resp).Info("Invoke submitter")
+		if err != nil {
+			return WrapCode(ErrCodeDispatch, err, "Fail to invoke submitter")
+		}
+		return nil
+	}
+}
+
+// PageInspector is callback function type that adds findings to PageWriter.
+// Remaining findings are flushed after the callback returns.
+type PageInspector func(task Task, w *PageWriter) error
+
+func handleWriterRequest(event events.SNSEvent, f PageInspector, author string, submit func(ReportPage) error) error {
+	for _, record := range event.Records {
+		task := Task{}
+		if err := json.Unmarshal([]byte(record.SNS.Message), &task); err != nil {
+			// A broken task never succeeds by retry of the SNS delivery.
+			Logger.WithFields(ErrorFields(WrapCode(ErrCodeMarshal, err, "Fail to unmarshal task"))).
+				Error("Drop invalid task")
+			continue
+		}
+
+		w := NewPageWriter(task, author, "", submit)
+		start := time.Now()
+		err := f(task, w)
+		observeInspector(task, start, err)
+		if err != nil {
+			return errors.Wrap(err, "Fail to inspect")
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		Logger.WithField("pages", w.Flushed()).Info("Submitted pages")
+	}
+	return nil
+}
+
+// InspectWithWriter is a wrapper of PageInspector. author is set to all pages.
+func InspectWithWriter(f PageInspector, author, funcName, region string) {
+	enableInspectorMetrics(region)
+	submit := NewSubmitter(funcName, region)
+	lambda.Start(func(ctx context.Context, event events.SNSEvent) error {
+		return handleWriterRequest(event, f, author, submit)
+	})
+}
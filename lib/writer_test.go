@@ -0,0 +1,69 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/AlertResponder/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageWriterAutoFlush(t *testing.T) {
+	var pages []lib.ReportPage
+	w := lib.NewPageWriter(lib.Task{ReportID: "report-1"}, "inspector-a", "", func(page lib.ReportPage) error {
+		pages = append(pages, page)
+		return nil
+	})
+	w.MaxSize = 4096
+
+	// Each host is about 200 bytes, then 30 hosts do not fit in one page.
+	for i := 0; i < 30; i++ {
+		require.NoError(t, w.AddOpponentHost(lib.ReportOpponentHost{
+			ID:      fmt.Sprintf("198.51.100.%d", i),
+			IPAddr:  []string{fmt.Sprintf("198.51.100.%d", i)},
+			ASOwner: []string{strings.Repeat("x", 64)},
+		}))
+	}
+	require.NoError(t, w.Flush())
+
+	require.Equal(t, 2, len(pages))
+	assert.Equal(t, 2, w.Flushed())
+
+	var total int
+	for _, page := range pages {
+		raw, err := json.Marshal(&page)
+		require.NoError(t, err)
+		assert.True(t, len(raw) <= 4096, fmt.Sprintf("page size %d exceeds limit", len(raw)))
+		assert.Equal(t, lib.ReportID("report-1"), page.ReportID)
+		assert.Equal(t, "inspector-a", page.Author)
+		total += len(page.OpponentHosts)
+	}
+	assert.Equal(t, 30, total)
+	assert.Equal(t, "198.51.100.0", pages[0].OpponentHosts[0].ID)
+	assert.Equal(t, "198.51.100.29", pages[1].OpponentHosts[len(pages[1].OpponentHosts)-1].ID)
+}
+
+func TestPageWriterFlushEmpty(t *testing.T) {
+	var calls int
+	w := lib.NewPageWriter(lib.Task{ReportID: "report-1"}, "inspector-a", "", func(page lib.ReportPage) error {
+		calls++
+		return nil
+	})
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 0, calls)
+}
+
+func TestPageWriterTooLargeItem(t *testing.T) {
+	w := lib.NewPageWriter(lib.Task{ReportID: "report-1"}, "inspector-a", "", func(page lib.ReportPage) error {
+		return nil
+	})
+	w.MaxSize = 256
+
+	err := w.AddAlliedHost(lib.ReportAlliedHost{ID: strings.Repeat("x", 512)})
+	require.Error(t, err)
+	_, ok := err.(*lib.SizeLimitError)
+	assert.True(t, ok)
+}
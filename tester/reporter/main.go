@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -17,11 +16,13 @@ func handleRequest(ctx context.Context, event events.SNSEvent) error {
 	logger.WithField("event", event).Info("Start")
 
 	for _, record := range event.Records {
-		var report lib.Report
-		if err := json.Unmarshal([]byte(record.SNS.Message), &report); err != nil {
-			logger.WithError(err).Error("Fail to unmarshal report data")
+		report, ok, err := lib.DecodeReportRecord(logger, record)
+		if err != nil {
 			return err
 		}
+		if !ok {
+			continue
+		}
 
 		logger.WithField("report", report).Info("Reported")
 	}